@@ -3,13 +3,16 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/argoproj-labs/argocd-image-updater/pkg/argocd"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/cache"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/env"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/health"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
@@ -17,8 +20,10 @@ import (
 	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/metrics"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/registry"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/prommetrics"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/version"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/semaphore"
 )
@@ -31,6 +36,10 @@ const defaultArgoCDServerAddr = "argocd-server.argocd"
 // Default path to registry configuration
 const defaultRegistriesConfPath = "/app/config/registries.conf"
 
+// Time the tags of all images may take to be prefetched during warm-up, if no
+// maximum cycle duration is configured
+const defaultPrefetchTimeout = 10 * time.Minute
+
 const applicationsAPIKindK8S = "kubernetes"
 const applicationsAPIKindArgoCD = "argocd"
 
@@ -41,6 +50,7 @@ type ImageUpdaterConfig struct {
 	ArgocdNamespace     string
 	DryRun              bool
 	CheckInterval       time.Duration
+	MaxCycleDuration    time.Duration
 	ArgoClient          argocd.ArgoCD
 	LogLevel            string
 	KubeClient          *kube.KubernetesClient
@@ -48,6 +58,9 @@ type ImageUpdaterConfig struct {
 	HealthPort          int
 	MetricsPort         int
 	RegistriesConf      string
+	RegistriesStrict    bool
+	CycleSummary        bool
+	WriteImageStatus    bool
 	AppNamePatterns     []string
 	GitCommitUser       string
 	GitCommitMail       string
@@ -55,7 +68,8 @@ type ImageUpdaterConfig struct {
 
 // warmupImageCache performs a cache warm-up, which is basically one cycle of
 // the image update process with dryRun set to true and a maximum concurrency
-// of 1, i.e. sequential processing.
+// of 1, i.e. sequential processing. The tags of all images are prefetched
+// concurrently before.
 func warmupImageCache(cfg *ImageUpdaterConfig) error {
 	log.Infof("Warming up image cache")
 	_, err := runImageUpdater(cfg, true)
@@ -115,6 +129,20 @@ func runImageUpdater(cfg *ImageUpdaterConfig, warmUp bool) (argocd.ImageUpdaterR
 
 	if !warmUp {
 		log.Infof("Starting image update cycle, considering %d annotated application(s) for update", len(appList))
+	} else {
+		// Fetch the tags of all images concurrently first, so that the
+		// sequential warm-up cycle is served from the cache. This also
+		// reveals misconfigured registries right away.
+		timeout := defaultPrefetchTimeout
+		if cfg.MaxCycleDuration > 0 {
+			timeout = cfg.MaxCycleDuration
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		errs := argocd.PrefetchImages(ctx, appList, cfg.KubeClient, registry.NewClient)
+		cancel()
+		for name, err := range errs {
+			log.Warnf("Could not prefetch tags of image %s: %v", name, err)
+		}
 	}
 
 	// Allow a maximum of MaxConcurrency number of goroutines to exist at the
@@ -129,12 +157,42 @@ func runImageUpdater(cfg *ImageUpdaterConfig, warmUp bool) (argocd.ImageUpdaterR
 	}
 	sem := semaphore.NewWeighted(int64(concurrency))
 
+	// The deadline for the cycle. Once exceeded, no further images will be
+	// processed.
+	ctx := context.Background()
+	if cfg.MaxCycleDuration > 0 && !warmUp {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.MaxCycleDuration)
+		defer cancel()
+	}
+
+	numImages := 0
+	for _, curApplication := range appList {
+		numImages += len(curApplication.Images)
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(len(appList))
 
+	// The result is updated by the dispatch loop and by the workers
+	var resultLock sync.Mutex
+
 	for app, curApplication := range appList {
-		lockErr := sem.Acquire(context.TODO(), 1)
-		if lockErr != nil {
+		if ctx.Err() != nil {
+			resultLock.Lock()
+			result.NumImagesUnprocessed += len(curApplication.Images)
+			resultLock.Unlock()
+			wg.Done()
+			continue
+		}
+		lockErr := sem.Acquire(ctx, 1)
+		if lockErr != nil && ctx.Err() != nil {
+			resultLock.Lock()
+			result.NumImagesUnprocessed += len(curApplication.Images)
+			resultLock.Unlock()
+			wg.Done()
+			continue
+		} else if lockErr != nil {
 			log.Errorf("Could not acquire semaphore for application %s: %v", app, lockErr)
 			// Release entry in wait group on error, too - we're never gonna execute
 			wg.Done()
@@ -145,20 +203,25 @@ func runImageUpdater(cfg *ImageUpdaterConfig, warmUp bool) (argocd.ImageUpdaterR
 			defer sem.Release(1)
 			log.Debugf("Processing application %s", app)
 			upconf := &argocd.UpdateConfiguration{
-				NewRegFN:       registry.NewClient,
-				ArgoClient:     cfg.ArgoClient,
-				KubeClient:     cfg.KubeClient,
-				UpdateApp:      &curApplication,
-				DryRun:         dryRun,
-				GitCommitUser:  cfg.GitCommitUser,
-				GitCommitEmail: cfg.GitCommitMail,
+				NewRegFN:         registry.NewClient,
+				ArgoClient:       cfg.ArgoClient,
+				KubeClient:       cfg.KubeClient,
+				UpdateApp:        &curApplication,
+				DryRun:           dryRun,
+				GitCommitUser:    cfg.GitCommitUser,
+				GitCommitEmail:   cfg.GitCommitMail,
+				WriteImageStatus: cfg.WriteImageStatus,
+				Ctx:              ctx,
 			}
 			res := argocd.UpdateApplication(upconf)
+			resultLock.Lock()
 			result.NumApplicationsProcessed += 1
 			result.NumErrors += res.NumErrors
 			result.NumImagesConsidered += res.NumImagesConsidered
 			result.NumImagesUpdated += res.NumImagesUpdated
 			result.NumSkipped += res.NumSkipped
+			result.NumImagesUnprocessed += res.NumImagesUnprocessed
+			resultLock.Unlock()
 			if !warmUp && !cfg.DryRun {
 				metrics.Applications().IncreaseImageUpdate(app, res.NumImagesUpdated)
 			}
@@ -171,9 +234,31 @@ func runImageUpdater(cfg *ImageUpdaterConfig, warmUp bool) (argocd.ImageUpdaterR
 	// Wait for all goroutines to finish
 	wg.Wait()
 
+	if ctx.Err() != nil {
+		log.Warnf("Cycle deadline of %s exceeded, %d of %d images processed", cfg.MaxCycleDuration, numImages-result.NumImagesUnprocessed, numImages)
+	}
+
 	return result, nil
 }
 
+// logCycleSummary logs a single line summarizing the result of an update
+// cycle to logCtx
+func logCycleSummary(logCtx *log.LogContext, result argocd.ImageUpdaterResult, stats registry.CycleStats, duration time.Duration) {
+	logCtx.
+		AddField("applications", result.NumApplicationsProcessed).
+		AddField("images_checked", result.NumImagesConsidered).
+		AddField("images_skipped", result.NumSkipped).
+		AddField("images_unprocessed", result.NumImagesUnprocessed).
+		AddField("updates", result.NumImagesUpdated).
+		AddField("errors", result.NumErrors).
+		AddField("rate_limit_waits", stats.RateLimitWaits).
+		AddField("rate_limit_delay", stats.RateLimitDelay.String()).
+		AddField("cache_hit_ratio", fmt.Sprintf("%.2f", stats.CacheHitRatio())).
+		AddField("duration", duration.String()).
+		Infof("Update cycle finished: %d image(s) checked, %d update(s), %d error(s) in %s",
+			result.NumImagesConsidered, result.NumImagesUpdated, result.NumErrors, duration.Round(time.Millisecond))
+}
+
 func getPrintableInterval(interval time.Duration) string {
 	if interval == 0 {
 		return "once"
@@ -199,6 +284,7 @@ func newRootCommand() error {
 	rootCmd.AddCommand(newRunCommand())
 	rootCmd.AddCommand(newVersionCommand())
 	rootCmd.AddCommand(newTestCommand())
+	rootCmd.AddCommand(newTestRegistryCommand())
 	err := rootCmd.Execute()
 	return err
 }
@@ -238,6 +324,13 @@ func newTestCommand() *cobra.Command {
 		kubeConfig        string
 		disableKubernetes bool
 		ignoreTags        []string
+		explain           bool
+		tagDatePattern    string
+		tagDateLayout     string
+		fetchMetadata     bool
+		sortCommand       string
+		sortCommandDir    string
+		signatureKey      string
 	)
 	var runCmd = &cobra.Command{
 		Use:   "test IMAGE",
@@ -296,6 +389,30 @@ argocd-image-updater test nginx --allow-tags '^1.19.\d+(\-.*)*$' --update-strate
 
 			vc.IgnoreList = ignoreTags
 
+			if tagDatePattern != "" {
+				re, err := regexp.Compile(tagDatePattern)
+				if err != nil {
+					log.Fatalf("invalid tag date pattern '%s': %v", tagDatePattern, err)
+				}
+				vc.DatePattern, vc.DateLayout = re, tagDateLayout
+			}
+
+			vc.FetchMetadata = fetchMetadata
+			vc.SortCommand = sortCommand
+			image.SetSortCommands(sortCommandDir, image.DefaultSortCommandTimeout)
+
+			if signatureKey != "" {
+				key, err := ioutil.ReadFile(signatureKey)
+				if err != nil {
+					log.Fatalf("could not read signature key: %v", err)
+				}
+				vc.RequireSignature = &image.SignaturePolicy{PublicKey: key}
+			}
+
+			if err := vc.Validate(); err != nil {
+				log.Fatalf("%v", err)
+			}
+
 			img := image.NewFromIdentifier(args[0])
 			log.WithContext().
 				AddField("registry", img.RegistryURL).
@@ -308,10 +425,13 @@ argocd-image-updater test nginx --allow-tags '^1.19.\d+(\-.*)*$' --update-strate
 				}
 			}
 
-			ep, err := registry.GetRegistryEndpoint(img.RegistryURL)
+			ep, err := registry.GetRegistryEndpointForImage(img)
 			if err != nil {
 				log.Fatalf("could not get registry endpoint: %v", err)
 			}
+			if ep.ArtifactType == registry.ArtifactHelmChart {
+				vc.UseChartVersions()
+			}
 
 			if err := ep.SetEndpointCredentials(kubeClient); err != nil {
 				log.Fatalf("could not set registry credentials: %v", err)
@@ -341,25 +461,60 @@ argocd-image-updater test nginx --allow-tags '^1.19.\d+(\-.*)*$' --update-strate
 				AddField("image_name", img.ImageName).
 				Infof("Fetching available tags and metadata from registry")
 
-			tags, err := ep.GetTags(img, regClient, vc)
-			if err != nil {
-				log.Fatalf("could not get tags: %v", err)
-			}
+			var selection *image.VersionSelection
+			if explain {
+				explanations, sel, err := ep.ExplainTags(ctx, img, regClient, vc)
+				if err != nil {
+					log.Fatalf("could not explain tags: %v", err)
+				}
+				log.WithContext().
+					AddField("image_name", img.ImageName).
+					Infof("Found %d tags in registry", len(explanations))
+				for _, e := range explanations {
+					log.Infof("tag %s: %s", e.TagName, e.Reason)
+				}
+				for _, w := range sel.Warnings {
+					log.Warnf("%s", w)
+				}
+				selection = sel
+			} else {
+				tags, err := ep.GetTags(ctx, img, regClient, vc)
+				if err != nil {
+					log.Fatalf("could not get tags: %v", err)
+				}
 
-			log.WithContext().
-				AddField("image_name", img.ImageName).
-				Infof("Found %d tags in registry", len(tags.Tags()))
+				log.WithContext().
+					AddField("image_name", img.ImageName).
+					Infof("Found %d tags in registry", len(tags.Tags()))
 
-			upImg, err := img.GetNewestVersionFromTags(vc, tags)
-			if err != nil {
-				log.Fatalf("could not get updateable image from tags: %v", err)
+				if vc.RequireSignature != nil {
+					vc.VerifyCandidate = ep.SignatureVerifier(ctx, img, regClient, vc.RequireSignature)
+				}
+				selection, err = img.SelectVersionFromTags(vc, tags)
+				if err != nil {
+					log.Fatalf("could not get updateable image from tags: %v", err)
+				}
 			}
+
+			upImg := selection.Selected
 			if upImg == nil {
 				log.Infof("no newer version of image found")
 				return
 			}
 
 			log.Infof("latest image according to constraint is %s", img.WithTag(upImg))
+			if ti := upImg.TagInfo; ti != nil {
+				log.Infof("image was created at %s (%s ago) and has digest %s", ti.CreatedAt.Format(time.RFC3339), time.Since(ti.CreatedAt).Round(time.Second), ti.Digest)
+			}
+			if selection.Alternative != nil {
+				alternative, err := ep.ResolveAlternative(ctx, img, selection.Alternative, regClient)
+				if err != nil {
+					log.Warnf("could not resolve digest and creation date of alternative %s: %v", selection.Alternative.TagName, err)
+					log.Infof("next-best alternative according to constraint is %s", img.WithTag(selection.Alternative))
+				} else {
+					log.Infof("next-best alternative according to constraint is %s, created at %s", img.WithTag(alternative), alternative.TagDate.Format(time.RFC3339))
+				}
+			}
 		},
 	}
 
@@ -367,14 +522,131 @@ argocd-image-updater test nginx --allow-tags '^1.19.\d+(\-.*)*$' --update-strate
 	runCmd.Flags().StringVar(&allowTags, "allow-tags", "", "only consider tags in registry that satisfy the match function")
 	runCmd.Flags().StringArrayVar(&ignoreTags, "ignore-tags", nil, "ignore tags in registry that match given glob pattern")
 	runCmd.Flags().StringVar(&strategy, "update-strategy", "semver", "update strategy to use, one of: semver, latest)")
+	runCmd.Flags().StringVar(&tagDatePattern, "tag-date-pattern", "", "regular expression to extract the date from tag names with the tag-date strategy")
+	runCmd.Flags().StringVar(&tagDateLayout, "tag-date-layout", image.DefaultTagDateLayout, "Go time layout of the date in tag names")
+	runCmd.Flags().BoolVar(&fetchMetadata, "fetch-metadata", false, "fetch the meta data of all tags, regardless of the update strategy")
+	runCmd.Flags().StringVar(&sortCommand, "sort-command", "", "name of the executable that sorts tags with the external strategy")
+	runCmd.Flags().StringVar(&sortCommandDir, "sort-command-dir", "", "directory to look up sort commands in")
 	runCmd.Flags().StringVar(&registriesConf, "registries-conf", "", "path to registries configuration")
 	runCmd.Flags().StringVar(&logLevel, "loglevel", "debug", "log level to use (one of trace, debug, info, warn, error)")
 	runCmd.Flags().BoolVar(&disableKubernetes, "disable-kubernetes", false, "whether to disable the Kubernetes client")
 	runCmd.Flags().StringVar(&kubeConfig, "kubeconfig", "", "path to your Kubernetes client configuration")
 	runCmd.Flags().StringVar(&credentials, "credentials", "", "the credentials definition for the test (overrides registry config)")
+	runCmd.Flags().BoolVar(&explain, "explain", false, "explain for each tag in the registry why it was or was not considered")
+	runCmd.Flags().StringVar(&signatureKey, "signature-key", "", "only consider tags signed with the public key at the given path")
 	return runCmd
 }
 
+// newTestRegistryCommand implements "test-registry" command
+func newTestRegistryCommand() *cobra.Command {
+	var (
+		registriesConf string
+		logLevel       string
+		credentials    string
+		kubeConfig     string
+		timeout        time.Duration
+	)
+	var testRegistryCmd = &cobra.Command{
+		Use:   "test-registry [PREFIX]",
+		Short: "Test connectivity and authentication to a registry",
+		Long: `
+The test-registry command checks whether the registry configured for the
+given prefix can be reached and accepts the configured credentials, by
+requesting the base endpoint of its API. If no prefix is given, the default
+registry is checked.
+
+It exits with a non-zero status if the registry is not healthy, so it can be
+used to catch a misconfigured API URL or bad credentials at deploy time.
+`,
+		Example: `
+# Check access to Docker Hub
+argocd-image-updater test-registry
+
+# Check access to a registry from the registries configuration
+argocd-image-updater test-registry ghcr.io --registries-conf /app/config/registries.conf
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) > 1 {
+				cmd.HelpFunc()(cmd, args)
+				log.Fatalf("at most one registry prefix can be specified")
+			}
+			prefix := ""
+			if len(args) == 1 {
+				prefix = args[0]
+			}
+
+			if err := log.SetLogLevel(logLevel); err != nil {
+				log.Fatalf("could not set log level to %s: %v", logLevel, err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			var kubeClient *kube.KubernetesClient
+			var err error
+			if kubeConfig != "" {
+				kubeClient, err = getKubeConfig(ctx, "", kubeConfig)
+				if err != nil {
+					log.Fatalf("could not create K8s client: %v", err)
+				}
+			}
+
+			if registriesConf != "" {
+				if err := registry.LoadRegistryConfiguration(registriesConf, false); err != nil {
+					log.Fatalf("could not load registries configuration: %v", err)
+				}
+			}
+
+			ep, err := registry.GetRegistryEndpoint(prefix)
+			if err != nil {
+				log.Fatalf("could not get registry endpoint: %v", err)
+			}
+
+			var username, password string
+			if credentials != "" {
+				credSrc, err := image.ParseCredentialSource(credentials, false)
+				if err != nil {
+					log.Fatalf("could not parse credential definition '%s': %v", credentials, err)
+				}
+				creds, err := credSrc.FetchCredentials(ep.RegistryAPI, kubeClient)
+				if err != nil {
+					log.Fatalf("could not fetch credentials: %v", err)
+				}
+				username = creds.Username
+				password = creds.Password
+			} else if err := ep.SetEndpointCredentials(kubeClient); err != nil {
+				log.Fatalf("could not set registry credentials: %v", err)
+			}
+
+			regClient, err := registry.NewClient(ep, username, password)
+			if err != nil {
+				log.Fatalf("could not create registry client: %v", err)
+			}
+
+			log.Infof("Checking registry %s (%s)", ep.RegistryName, ep.RegistryAPI)
+			hs := ep.HealthCheck(ctx, regClient)
+			log.WithContext().
+				AddField("reachable", hs.Reachable).
+				AddField("authenticated", hs.Authenticated).
+				AddField("status", hs.StatusCode).
+				AddField("api_version", hs.APIVersion).
+				AddField("duration", hs.Duration.Round(time.Millisecond)).
+				Infof("Finished checking registry %s", ep.RegistryAPI)
+			if !hs.Healthy() {
+				log.Fatalf("registry %s is not healthy: %v", ep.RegistryAPI, hs.Err)
+			}
+			log.Infof("registry %s is healthy", ep.RegistryAPI)
+		},
+	}
+
+	testRegistryCmd.Flags().StringVar(&registriesConf, "registries-conf", "", "path to registries configuration")
+	testRegistryCmd.Flags().StringVar(&logLevel, "loglevel", "info", "log level to use (one of trace, debug, info, warn, error)")
+	testRegistryCmd.Flags().StringVar(&kubeConfig, "kubeconfig", "", "path to your Kubernetes client configuration")
+	testRegistryCmd.Flags().StringVar(&credentials, "credentials", "", "the credentials definition for the test (overrides registry config)")
+	testRegistryCmd.Flags().DurationVar(&timeout, "timeout", 30*time.Second, "time to wait for the registry to respond")
+	return testRegistryCmd
+}
+
 // newRunCommand implements "run" command
 func newRunCommand() *cobra.Command {
 	var cfg *ImageUpdaterConfig = &ImageUpdaterConfig{}
@@ -382,6 +654,17 @@ func newRunCommand() *cobra.Command {
 	var kubeConfig string
 	var disableKubernetes bool
 	var warmUpCache bool = true
+	var cacheDir string
+	var cacheTTL time.Duration
+	var disableCachePersistence bool
+	var sortCommandDir string
+	var sortCommandTimeout time.Duration
+	var signatureKeyDir string
+	var sigstoreRoots string
+	var rekorPublicKey string
+	var registryTimeout time.Duration
+	var registryUserAgent string
+	var registryRequestID bool
 	var runCmd = &cobra.Command{
 		Use:   "run",
 		Short: "Runs the argocd-image-updater with a set of options",
@@ -410,6 +693,21 @@ func newRunCommand() *cobra.Command {
 
 			// Load registries configuration early on. We do not consider it a fatal
 			// error when the file does not exist, but we emit a warning.
+			registry.SetStrictPrefixMatching(cfg.RegistriesStrict)
+			registry.SetDefaultTimeout(registryTimeout)
+			registry.SetDefaultUserAgent(registryUserAgent)
+			registry.SetDefaultRequestID(registryRequestID)
+			if cacheDir != "" && !disableCachePersistence {
+				log.Infof("Persisting image cache to %s", cacheDir)
+				registry.SetCacheFactory(cache.DiskCacheFactory(cacheDir, cacheTTL))
+			}
+			if sortCommandDir != "" {
+				log.Infof("Enabling external sort commands from %s", sortCommandDir)
+				image.SetSortCommands(sortCommandDir, sortCommandTimeout)
+			}
+			if err := loadSignatureTrust(signatureKeyDir, sigstoreRoots, rekorPublicKey); err != nil {
+				return err
+			}
 			if cfg.RegistriesConf != "" {
 				st, err := os.Stat(cfg.RegistriesConf)
 				if err != nil || st.IsDir() {
@@ -467,8 +765,17 @@ func newRunCommand() *cobra.Command {
 			if cfg.MetricsPort > 0 {
 				log.Infof("Starting metrics server on TCP port=%d", cfg.MetricsPort)
 				msErrCh = metrics.StartMetricsServer(cfg.MetricsPort)
+				registryMetrics := prommetrics.New()
+				if err := prometheus.Register(registryMetrics); err != nil {
+					log.Warnf("Could not register registry metrics: %v", err)
+				} else {
+					registry.SetMetrics(registryMetrics)
+				}
 			}
 
+			// Keep credentials with a refresh lead time warm in the background
+			registry.StartCredentialRefresher(context.Background(), cfg.KubeClient)
+
 			if warmUpCache {
 				err := warmupImageCache(cfg)
 				if err != nil {
@@ -497,6 +804,8 @@ func newRunCommand() *cobra.Command {
 					return nil
 				default:
 					if lastRun.IsZero() || time.Since(lastRun) > cfg.CheckInterval {
+						cycleStart := time.Now()
+						registry.TakeCycleStats()
 						result, err := runImageUpdater(cfg, false)
 						if err != nil {
 							log.Errorf("Error: %v", err)
@@ -507,6 +816,9 @@ func newRunCommand() *cobra.Command {
 								result.NumSkipped,
 								result.NumImagesUpdated,
 								result.NumErrors)
+							if cfg.CycleSummary {
+								logCycleSummary(log.WithContext(), result, registry.TakeCycleStats(), time.Since(cycleStart))
+							}
 						}
 						lastRun = time.Now()
 					}
@@ -529,23 +841,62 @@ func newRunCommand() *cobra.Command {
 	runCmd.Flags().StringVar(&cfg.ClientOpts.AuthToken, "argocd-auth-token", "", "use token for authenticating to ArgoCD (unsafe - consider setting ARGOCD_TOKEN env var instead)")
 	runCmd.Flags().BoolVar(&cfg.DryRun, "dry-run", false, "run in dry-run mode. If set to true, do not perform any changes")
 	runCmd.Flags().DurationVar(&cfg.CheckInterval, "interval", 2*time.Minute, "interval for how often to check for updates")
+	runCmd.Flags().DurationVar(&cfg.MaxCycleDuration, "max-cycle-duration", 0, "maximum duration of an update cycle, 0 for no limit")
 	runCmd.Flags().StringVar(&cfg.LogLevel, "loglevel", env.GetStringVal("IMAGE_UPDATER_LOGLEVEL", "info"), "set the loglevel to one of trace|debug|info|warn|error")
 	runCmd.Flags().StringVar(&kubeConfig, "kubeconfig", "", "full path to kubernetes client configuration, i.e. ~/.kube/config")
 	runCmd.Flags().IntVar(&cfg.HealthPort, "health-port", 8080, "port to start the health server on, 0 to disable")
 	runCmd.Flags().IntVar(&cfg.MetricsPort, "metrics-port", 8081, "port to start the metrics server on, 0 to disable")
 	runCmd.Flags().BoolVar(&once, "once", false, "run only once, same as specifying --interval=0 and --health-port=0")
 	runCmd.Flags().StringVar(&cfg.RegistriesConf, "registries-conf-path", defaultRegistriesConfPath, "path to registries configuration file")
+	runCmd.Flags().BoolVar(&cfg.CycleSummary, "cycle-summary", env.GetBoolVal("IMAGE_UPDATER_CYCLE_SUMMARY", false), "log a structured summary of each update cycle")
+	runCmd.Flags().BoolVar(&cfg.WriteImageStatus, "write-image-status", env.GetBoolVal("IMAGE_UPDATER_WRITE_IMAGE_STATUS", false), "write the result of checking the images of an application to an annotation of the application")
+	runCmd.Flags().DurationVar(&registryTimeout, "registry-timeout", env.GetDurationVal("IMAGE_UPDATER_REGISTRY_TIMEOUT", 0), "time a single request to a registry may take, 0 for no timeout")
+	runCmd.Flags().StringVar(&registryUserAgent, "registry-user-agent", env.GetStringVal("IMAGE_UPDATER_REGISTRY_USER_AGENT", ""), "user agent to send to registries, argocd-image-updater/<version> by default")
+	runCmd.Flags().BoolVar(&registryRequestID, "registry-request-id", env.GetBoolVal("IMAGE_UPDATER_REGISTRY_REQUEST_ID", false), "send a unique X-Request-ID header with each request to a registry")
+	runCmd.Flags().BoolVar(&cfg.RegistriesStrict, "registries-strict-prefix", env.GetBoolVal("REGISTRIES_STRICT_PREFIX", false), "treat ambiguous registry prefix matches as an error")
 	runCmd.Flags().BoolVar(&disableKubernetes, "disable-kubernetes", false, "do not create and use a Kubernetes client")
 	runCmd.Flags().IntVar(&cfg.MaxConcurrency, "max-concurrency", 10, "maximum number of update threads to run concurrently")
 	runCmd.Flags().StringVar(&cfg.ArgocdNamespace, "argocd-namespace", "", "namespace where ArgoCD runs in (current namespace by default)")
 	runCmd.Flags().StringSliceVar(&cfg.AppNamePatterns, "match-application-name", nil, "patterns to match application name against")
 	runCmd.Flags().BoolVar(&warmUpCache, "warmup-cache", true, "whether to perform a cache warm-up on startup")
+	runCmd.Flags().StringVar(&cacheDir, "cache-dir", env.GetStringVal("IMAGE_UPDATER_CACHE_DIR", ""), "directory to persist the image cache to, in-memory only if empty")
+	runCmd.Flags().DurationVar(&cacheTTL, "cache-ttl", 24*time.Hour, "duration after which persisted tag meta data expires, 0 for no expiry")
+	runCmd.Flags().StringVar(&sortCommandDir, "sort-command-dir", env.GetStringVal("IMAGE_UPDATER_SORT_COMMAND_DIR", ""), "directory with executables for sorting tags with the external update strategy, disabled if empty")
+	runCmd.Flags().DurationVar(&sortCommandTimeout, "sort-command-timeout", image.DefaultSortCommandTimeout, "time an external sort command may take")
+	runCmd.Flags().StringVar(&signatureKeyDir, "signature-key-dir", env.GetStringVal("IMAGE_UPDATER_SIGNATURE_KEY_DIR", ""), "directory with public keys for verifying image signatures, disabled if empty")
+	runCmd.Flags().StringVar(&sigstoreRoots, "sigstore-roots", env.GetStringVal("IMAGE_UPDATER_SIGSTORE_ROOTS", ""), "path to the PEM-encoded CA certificates for verifying keyless image signatures")
+	runCmd.Flags().StringVar(&rekorPublicKey, "rekor-public-key", env.GetStringVal("IMAGE_UPDATER_REKOR_PUBLIC_KEY", ""), "path to the PEM-encoded public key of the transparency log for verifying keyless image signatures")
+	runCmd.Flags().BoolVar(&disableCachePersistence, "disable-cache-persistence", env.GetBoolVal("IMAGE_UPDATER_DISABLE_CACHE_PERSISTENCE", false), "keep the image cache in memory only, even if a cache directory is set")
 	runCmd.Flags().StringVar(&cfg.GitCommitUser, "git-commit-user", env.GetStringVal("GIT_COMMIT_USER", "argocd-image-updater"), "Username to use for Git commits")
 	runCmd.Flags().StringVar(&cfg.GitCommitMail, "git-commit-email", env.GetStringVal("GIT_COMMIT_EMAIL", "noreply@argoproj.io"), "E-Mail address to use for Git commits")
 
 	return runCmd
 }
 
+// loadSignatureTrust configures the public keys and trust roots image
+// signatures are verified with
+func loadSignatureTrust(keyDir, rootsPath, rekorKeyPath string) error {
+	var roots, rekorKey []byte
+	var err error
+	if rootsPath != "" || rekorKeyPath != "" {
+		if rootsPath == "" || rekorKeyPath == "" {
+			return fmt.Errorf("--sigstore-roots and --rekor-public-key must be given together")
+		}
+		if roots, err = ioutil.ReadFile(rootsPath); err != nil {
+			return fmt.Errorf("could not read sigstore roots: %v", err)
+		}
+		if rekorKey, err = ioutil.ReadFile(rekorKeyPath); err != nil {
+			return fmt.Errorf("could not read Rekor public key: %v", err)
+		}
+		log.Infof("Enabling keyless signature verification with roots from %s", rootsPath)
+	}
+	if keyDir != "" {
+		log.Infof("Enabling signature verification with public keys from %s", keyDir)
+	}
+	image.SetSignatureTrust(keyDir, roots, rekorKey)
+	return nil
+}
+
 func getKubeConfig(ctx context.Context, namespace string, kubeConfig string) (*kube.KubernetesClient, error) {
 	var fullKubeConfigPath string
 	var kubeClient *kube.KubernetesClient
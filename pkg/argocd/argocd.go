@@ -2,22 +2,27 @@ package argocd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"time"
 
 	"github.com/argoproj-labs/argocd-image-updater/pkg/common"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/kube"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/metrics"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry"
 
 	argocdclient "github.com/argoproj/argo-cd/pkg/apiclient"
 	"github.com/argoproj/argo-cd/pkg/apiclient/application"
 	"github.com/argoproj/argo-cd/pkg/apis/application/v1alpha1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // Kubernetes based client
@@ -57,6 +62,69 @@ func (client *k8sClient) UpdateSpec(ctx context.Context, spec *application.Appli
 
 }
 
+// WriteImageStatus writes the result of checking the images of app for
+// updates to the image status annotation of the application resource. The
+// annotation is left alone if the statuses differ from the existing ones only
+// in the time they were checked, so that the application is not modified on
+// every update cycle.
+func WriteImageStatus(ctx context.Context, kubeClient *kube.KubernetesClient, app *v1alpha1.Application, statuses []*registry.ImageUpdateStatus) error {
+	if kubeClient == nil || kubeClient.ApplicationsClientset == nil {
+		return fmt.Errorf("no Kubernetes client to write image status of application %s", app.GetName())
+	}
+
+	if existing, ok := app.GetAnnotations()[common.ImageStatusAnnotation]; ok {
+		var previous []*registry.ImageUpdateStatus
+		if err := json.Unmarshal([]byte(existing), &previous); err == nil && sameImageStatus(previous, statuses) {
+			return nil
+		}
+	}
+
+	value, err := json.Marshal(statuses)
+	if err != nil {
+		return fmt.Errorf("could not marshal image status: %v", err)
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{common.ImageStatusAnnotation: string(value)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("could not marshal image status: %v", err)
+	}
+
+	namespace := app.GetNamespace()
+	if namespace == "" {
+		namespace = kubeClient.Namespace
+	}
+	_, err = kubeClient.ApplicationsClientset.ArgoprojV1alpha1().Applications(namespace).Patch(ctx, app.GetName(), types.MergePatchType, patch, v1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("could not write image status of application %s: %v", app.GetName(), err)
+	}
+	return nil
+}
+
+// sameImageStatus returns true if a and b are equal, apart from the time the
+// images have been checked
+func sameImageStatus(a, b []*registry.ImageUpdateStatus) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] == nil || b[i] == nil {
+			if a[i] != b[i] {
+				return false
+			}
+			continue
+		}
+		x, y := *a[i], *b[i]
+		x.LastChecked, y.LastChecked = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
 // NewAPIClient creates a new API client for ArgoCD and connects to the ArgoCD
 // API server.
 func NewK8SClient(kubeClient *kube.KubernetesClient) (ArgoCD, error) {
@@ -331,11 +399,12 @@ func SetHelmImage(app *v1alpha1.Application, newImage *image.ContainerImage) err
 
 	appName := app.GetName()
 
-	var hpImageName, hpImageTag, hpImageSpec string
+	var hpImageName, hpImageTag, hpImageSpec, hpImagePlatform string
 
 	hpImageSpec = newImage.GetParameterHelmImageSpec(app.Annotations)
 	hpImageName = newImage.GetParameterHelmImageName(app.Annotations)
 	hpImageTag = newImage.GetParameterHelmImageTag(app.Annotations)
+	hpImagePlatform = newImage.GetParameterHelmImagePlatform(app.Annotations)
 
 	if hpImageSpec == "" {
 		if hpImageName == "" {
@@ -365,11 +434,17 @@ func SetHelmImage(app *v1alpha1.Application, newImage *image.ContainerImage) err
 			mergeParams = append(mergeParams, p)
 		}
 		if hpImageTag != "" {
-			p := v1alpha1.HelmParameter{Name: hpImageTag, Value: newImage.ImageTag.TagName, ForceString: true}
+			p := v1alpha1.HelmParameter{Name: hpImageTag, Value: newImage.ImageTag.TagWithDigest(), ForceString: true}
 			mergeParams = append(mergeParams, p)
 		}
 	}
 
+	// The platform is metadata only, and is recorded if we know about it
+	if hpImagePlatform != "" && newImage.GetPlatform() != "" {
+		p := v1alpha1.HelmParameter{Name: hpImagePlatform, Value: newImage.GetPlatform(), ForceString: true}
+		mergeParams = append(mergeParams, p)
+	}
+
 	if app.Spec.Source.Helm == nil {
 		app.Spec.Source.Helm = &v1alpha1.ApplicationSourceHelm{}
 	}
@@ -391,6 +466,10 @@ func SetKustomizeImage(app *v1alpha1.Application, newImage *image.ContainerImage
 
 	var ksImageParam string
 	ksImageName := newImage.GetParameterKustomizeImageName(app.Annotations)
+	if ksImageName == "" {
+		// A rewritten image must still replace the image it has been rewritten from
+		ksImageName = newImage.RewrittenFrom
+	}
 	if ksImageName != "" {
 		ksImageParam = fmt.Sprintf("%s=%s", ksImageName, newImage.GetFullNameWithTag())
 	} else {
@@ -405,6 +484,15 @@ func SetKustomizeImage(app *v1alpha1.Application, newImage *image.ContainerImage
 
 	app.Spec.Source.Kustomize.MergeImage(v1alpha1.KustomizeImage(ksImageParam))
 
+	// The platform is metadata only, and is recorded as a common label if we
+	// know about it. Label values must not contain slashes.
+	if ksImagePlatform := newImage.GetParameterKustomizeImagePlatform(app.Annotations); ksImagePlatform != "" && newImage.GetPlatform() != "" {
+		if app.Spec.Source.Kustomize.CommonLabels == nil {
+			app.Spec.Source.Kustomize.CommonLabels = map[string]string{}
+		}
+		app.Spec.Source.Kustomize.CommonLabels[ksImagePlatform] = strings.ReplaceAll(newImage.GetPlatform(), "/", "_")
+	}
+
 	return nil
 }
 
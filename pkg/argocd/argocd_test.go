@@ -2,12 +2,15 @@ package argocd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/argoproj-labs/argocd-image-updater/pkg/common"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/kube"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry"
 
 	"github.com/argoproj/argo-cd/pkg/apiclient/application"
 	"github.com/argoproj/argo-cd/pkg/apis/application/v1alpha1"
@@ -390,6 +393,75 @@ func Test_SetKustomizeImage(t *testing.T) {
 		assert.Equal(t, v1alpha1.KustomizeImage("jannfis/foobar:1.0.1"), app.Spec.Source.Kustomize.Images[0])
 	})
 
+	t.Run("Test set Kustomize image parameters with rewritten registry", func(t *testing.T) {
+		app := &v1alpha1.Application{
+			ObjectMeta: v1.ObjectMeta{
+				Name:      "test-app",
+				Namespace: "testns",
+			},
+			Spec: v1alpha1.ApplicationSpec{
+				Source: v1alpha1.ApplicationSource{
+					Kustomize: &v1alpha1.ApplicationSourceKustomize{
+						Images: v1alpha1.KustomizeImages{
+							"jannfis/foobar=cache.example.com/jannfis/foobar:1.0.0",
+						},
+					},
+				},
+			},
+			Status: v1alpha1.ApplicationStatus{
+				SourceType: v1alpha1.ApplicationSourceTypeKustomize,
+				Summary: v1alpha1.ApplicationSummary{
+					Images: []string{
+						"cache.example.com/jannfis/foobar:1.0.0",
+					},
+				},
+			},
+		}
+		img := image.NewFromIdentifier("cache.example.com/jannfis/foobar:1.0.1")
+		img.RewrittenFrom = "jannfis/foobar"
+		err := SetKustomizeImage(app, img)
+		require.NoError(t, err)
+		require.NotNil(t, app.Spec.Source.Kustomize)
+		assert.Len(t, app.Spec.Source.Kustomize.Images, 1)
+		assert.Equal(t, v1alpha1.KustomizeImage("jannfis/foobar=cache.example.com/jannfis/foobar:1.0.1"), app.Spec.Source.Kustomize.Images[0])
+	})
+
+	t.Run("Test set Kustomize image parameters with platform", func(t *testing.T) {
+		app := &v1alpha1.Application{
+			ObjectMeta: v1.ObjectMeta{
+				Name:      "test-app",
+				Namespace: "testns",
+				Annotations: map[string]string{
+					fmt.Sprintf(common.KustomizeImagePlatformAnnotation, "foobar"): "example.com/platform",
+				},
+			},
+			Spec: v1alpha1.ApplicationSpec{
+				Source: v1alpha1.ApplicationSource{
+					Kustomize: &v1alpha1.ApplicationSourceKustomize{
+						Images: v1alpha1.KustomizeImages{
+							"jannfis/foobar:1.0.0",
+						},
+					},
+				},
+			},
+			Status: v1alpha1.ApplicationStatus{
+				SourceType: v1alpha1.ApplicationSourceTypeKustomize,
+				Summary: v1alpha1.ApplicationSummary{
+					Images: []string{
+						"jannfis/foobar:1.0.0",
+					},
+				},
+			},
+		}
+		img := image.NewFromIdentifier("foobar=jannfis/foobar:1.0.1")
+		img.ImageTag.TagPlatform = "linux/arm64"
+		err := SetKustomizeImage(app, img)
+		require.NoError(t, err)
+		require.NotNil(t, app.Spec.Source.Kustomize)
+		assert.Equal(t, v1alpha1.KustomizeImage("jannfis/foobar:1.0.1"), app.Spec.Source.Kustomize.Images[0])
+		assert.Equal(t, "linux_arm64", app.Spec.Source.Kustomize.CommonLabels["example.com/platform"])
+	})
+
 	t.Run("Test set Kustomize image parameters on Kustomize app with no params set", func(t *testing.T) {
 		app := &v1alpha1.Application{
 			ObjectMeta: v1.ObjectMeta{
@@ -702,3 +774,56 @@ func TestKubernetesClient_UpdateSpec_Conflict(t *testing.T) {
 
 	assert.Equal(t, "https://github.com/argoproj/argocd-example-apps", spec.Source.RepoURL)
 }
+
+func Test_WriteImageStatus(t *testing.T) {
+	app := &v1alpha1.Application{
+		ObjectMeta: v1.ObjectMeta{Name: "test-app", Namespace: "testns"},
+	}
+	clientset := fake.NewSimpleClientset(app)
+	patches := 0
+	clientset.PrependReactor("patch", "*", func(action k8stesting.Action) (handled bool, ret runtime.Object, err error) {
+		patches++
+		return false, nil, nil
+	})
+	kubeClient := &kube.KubernetesClient{
+		Namespace:             "testns",
+		ApplicationsClientset: clientset,
+	}
+	statuses := []*registry.ImageUpdateStatus{
+		{Image: "nginx", Current: "1.12.2", Selected: "1.13.0", AvailableHigher: 1, LastChecked: time.Unix(1000, 0).UTC(), Reason: registry.UpdateStatusUpdateAvailable},
+	}
+
+	t.Run("Write status to annotation", func(t *testing.T) {
+		err := WriteImageStatus(context.TODO(), kubeClient, app, statuses)
+		require.NoError(t, err)
+		assert.Equal(t, 1, patches)
+		updated, err := clientset.ArgoprojV1alpha1().Applications("testns").Get(context.TODO(), "test-app", v1.GetOptions{})
+		require.NoError(t, err)
+		var written []*registry.ImageUpdateStatus
+		require.NoError(t, json.Unmarshal([]byte(updated.Annotations[common.ImageStatusAnnotation]), &written))
+		assert.Equal(t, statuses, written)
+		app = updated
+	})
+
+	t.Run("Do not write status if only check time changed", func(t *testing.T) {
+		rechecked := *statuses[0]
+		rechecked.LastChecked = time.Unix(2000, 0).UTC()
+		err := WriteImageStatus(context.TODO(), kubeClient, app, []*registry.ImageUpdateStatus{&rechecked})
+		require.NoError(t, err)
+		assert.Equal(t, 1, patches)
+	})
+
+	t.Run("Write changed status", func(t *testing.T) {
+		changed := *statuses[0]
+		changed.Current = "1.13.0"
+		changed.Reason = registry.UpdateStatusUpToDate
+		err := WriteImageStatus(context.TODO(), kubeClient, app, []*registry.ImageUpdateStatus{&changed})
+		require.NoError(t, err)
+		assert.Equal(t, 2, patches)
+	})
+
+	t.Run("No Kubernetes client", func(t *testing.T) {
+		err := WriteImageStatus(context.TODO(), nil, app, statuses)
+		assert.Error(t, err)
+	})
+}
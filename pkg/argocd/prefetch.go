@@ -0,0 +1,106 @@
+package argocd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/kube"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry"
+)
+
+// prefetchBatch is a set of images that can be prefetched using the same
+// registry client and version constraint
+type prefetchBatch struct {
+	endpoint *registry.RegistryEndpoint
+	credSrc  *image.CredentialSource
+	vc       *image.VersionConstraint
+	images   []*image.ContainerImage
+}
+
+// PrefetchImages fetches the tags of all images of the given applications,
+// so that their meta data is cached before the first update cycle. The
+// version constraint of each image is built the same way as for updating it,
+// and images that are not live are skipped, like they are when updating.
+// Images using the same registry, pull secret and version constraint are
+// prefetched together. Once ctx is done, no more tags are fetched. Returns
+// the errors for images whose tags could not be fetched, by the images'
+// names.
+func PrefetchImages(ctx context.Context, appList map[string]ApplicationImages, kubeClient *kube.KubernetesClient, newRegFN registry.NewRegistryClient) map[string]error {
+	errs := make(map[string]error)
+	batches := make(map[string]*prefetchBatch)
+	var keys []string
+	for _, app := range appList {
+		annotations := app.Application.Annotations
+		liveImages := GetImagesFromApplication(&app.Application)
+		for _, img := range app.Images {
+			updateableImage := liveImage(liveImages, img)
+			if updateableImage == nil {
+				continue
+			}
+			rep, err := registry.GetRegistryEndpointForImage(img)
+			if err != nil {
+				errs[img.GetFullNameWithoutTag()] = err
+				continue
+			}
+			vc := imageVersionConstraint(rep, img, updateableImage, annotations)
+			if err := vc.Validate(); err != nil {
+				errs[img.GetFullNameWithoutTag()] = err
+				continue
+			}
+			credSrc := img.GetParameterPullSecret(annotations)
+			credKey := ""
+			if credSrc != nil {
+				credKey = fmt.Sprintf("%v", *credSrc)
+			}
+			key := fmt.Sprintf("%s|%s|%s", rep.RegistryPrefix, credKey, vc.Key())
+			b, ok := batches[key]
+			if !ok {
+				b = &prefetchBatch{endpoint: rep, credSrc: credSrc, vc: vc}
+				batches[key] = b
+				keys = append(keys, key)
+			}
+			b.images = append(b.images, img)
+		}
+	}
+
+	for _, key := range keys {
+		b := batches[key]
+		if ctx.Err() != nil {
+			for _, img := range b.images {
+				errs[img.GetFullNameWithoutTag()] = ctx.Err()
+			}
+			continue
+		}
+		setErrs := func(err error) {
+			for _, img := range b.images {
+				errs[img.GetFullNameWithoutTag()] = err
+			}
+		}
+		if err := b.endpoint.SetEndpointCredentials(kubeClient); err != nil {
+			setErrs(fmt.Errorf("could not set registry endpoint credentials: %v", err))
+			continue
+		}
+		creds := &image.Credential{}
+		if b.credSrc != nil {
+			var err error
+			creds, err = b.credSrc.FetchCredentials(b.endpoint.RegistryAPI, kubeClient)
+			if err != nil {
+				setErrs(fmt.Errorf("could not fetch credentials: %v", err))
+				continue
+			}
+		}
+		regClient, err := newRegFN(b.endpoint, creds.Username, creds.Password)
+		if err != nil {
+			setErrs(fmt.Errorf("could not create registry client: %v", err))
+			continue
+		}
+		for name, err := range b.endpoint.Prefetch(ctx, b.images, regClient, b.vc) {
+			errs[name] = err
+		}
+	}
+
+	log.Debugf("Prefetched tags of images in %d batches, %d image(s) failed", len(keys), len(errs))
+	return errs
+}
@@ -2,11 +2,13 @@ package argocd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/argoproj-labs/argocd-image-updater/ext/git"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/common"
@@ -14,6 +16,7 @@ import (
 	"github.com/argoproj-labs/argocd-image-updater/pkg/kube"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/registry"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
 
 	"gopkg.in/yaml.v2"
 
@@ -29,6 +32,11 @@ type ImageUpdaterResult struct {
 	NumImagesConsidered      int
 	NumSkipped               int
 	NumErrors                int
+	// NumImagesUnprocessed is the number of images that have not been
+	// processed because the deadline of the update cycle was exceeded
+	NumImagesUnprocessed int
+	// ImageStatus holds the result of checking each image for updates
+	ImageStatus []*registry.ImageUpdateStatus
 }
 
 type UpdateConfiguration struct {
@@ -39,6 +47,15 @@ type UpdateConfiguration struct {
 	DryRun         bool
 	GitCommitUser  string
 	GitCommitEmail string
+	// WriteImageStatus enables writing the result of checking the images
+	// to the image status annotation of the application
+	WriteImageStatus bool
+	// Ctx is the context of the update cycle. Once it is done, no further
+	// images are processed. If nil, the background context is used.
+	Ctx context.Context
+	// Now returns the current time, which update windows are evaluated at.
+	// If nil, time.Now is used.
+	Now func() time.Time
 }
 
 type GitCredsSource func(app *v1alpha1.Application) (git.Creds, error)
@@ -64,7 +81,8 @@ type WriteBackConfig struct {
 
 // The following are helper structs to only marshal the fields we require
 type kustomizeImages struct {
-	Images *v1alpha1.KustomizeImages `json:"images"`
+	Images       *v1alpha1.KustomizeImages `json:"images"`
+	CommonLabels map[string]string         `json:"commonLabels,omitempty"`
 }
 
 type kustomizeOverride struct {
@@ -91,14 +109,31 @@ func UpdateApplication(updateConf *UpdateConfiguration) ImageUpdaterResult {
 
 	result.NumApplicationsProcessed += 1
 
+	ctx := updateConf.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	now := updateConf.Now
+	if now == nil {
+		now = time.Now
+	}
+
 	// Loop through all images of current application, and check whether one of
 	// its images is eligible for updating.
 	//
 	// Whether an image qualifies for update is dependent on semantic version
 	// constraints which are part of the application's annotation values.
 	//
-	for _, applicationImage := range updateConf.UpdateApp.Images {
-		updateableImage := applicationImages.ContainsImage(applicationImage, false)
+	for i, applicationImage := range updateConf.UpdateApp.Images {
+		// Stop processing further images once the cycle's deadline is exceeded,
+		// these images will keep their current state.
+		if ctx.Err() != nil {
+			result.NumImagesUnprocessed += len(updateConf.UpdateApp.Images) - i
+			log.WithContext().AddField("application", app).Warnf("Not processing remaining %d image(s): %v", len(updateConf.UpdateApp.Images)-i, ctx.Err())
+			break
+		}
+
+		updateableImage := liveImage(applicationImages, applicationImage)
 		if updateableImage == nil {
 			log.WithContext().AddField("application", app).Debugf("Image '%s' seems not to be live in this application, skipping", applicationImage.ImageName)
 			result.NumSkipped += 1
@@ -116,24 +151,48 @@ func UpdateApplication(updateConf *UpdateConfiguration) ImageUpdaterResult {
 
 		imgCtx.Debugf("Considering this image for update")
 
-		rep, err := registry.GetRegistryEndpoint(updateableImage.RegistryURL)
+		var rep *registry.RegistryEndpoint
+		var err error
+		tagsCtx := ctx
+		if applicationImage.RegistryURL == "" && len(registry.GetSearchRegistries()) > 0 {
+			// Unqualified image names are resolved against the search registries
+			rep, tagsCtx, err = registry.ResolveSearchRegistry(ctx, applicationImage, func(ep *registry.RegistryEndpoint) (registry.RegistryClient, error) {
+				if err := ep.SetEndpointCredentials(updateConf.KubeClient); err != nil {
+					return nil, err
+				}
+				creds := &image.Credential{}
+				if credSrc := applicationImage.GetParameterPullSecret(updateConf.UpdateApp.Application.Annotations); credSrc != nil {
+					var err error
+					creds, err = credSrc.FetchCredentials(ep.RegistryAPI, updateConf.KubeClient)
+					if err != nil {
+						return nil, err
+					}
+				}
+				return updateConf.NewRegFN(ep, creds.Username, creds.Password)
+			})
+		} else {
+			rep, err = registry.GetRegistryEndpointForImage(applicationImage)
+		}
 		if err != nil {
 			imgCtx.Errorf("Could not get registry endpoint from configuration: %v", err)
 			result.NumErrors += 1
 			continue
 		}
 
-		var vc image.VersionConstraint
-		if applicationImage.ImageTag != nil {
-			vc.Constraint = applicationImage.ImageTag.TagName
+		vc := imageVersionConstraint(rep, applicationImage, updateableImage, updateConf.UpdateApp.Application.Annotations)
+		if vc.Track != "" {
+			imgCtx.Debugf("Only considering tags on track %s of the current version", vc.Track)
+		}
+		if vc.Constraint != "" {
 			imgCtx.Debugf("Using version constraint '%s' when looking for a new tag", vc.Constraint)
 		} else {
 			imgCtx.Debugf("Using no version constraint when looking for a new tag")
 		}
-
-		vc.SortMode = applicationImage.GetParameterUpdateStrategy(updateConf.UpdateApp.Application.Annotations)
-		vc.MatchFunc, vc.MatchArgs = applicationImage.GetParameterMatch(updateConf.UpdateApp.Application.Annotations)
-		vc.IgnoreList = applicationImage.GetParameterIgnoreTags(updateConf.UpdateApp.Application.Annotations)
+		if err := vc.Validate(); err != nil {
+			imgCtx.Errorf("Invalid configuration for image: %v", err)
+			result.NumErrors += 1
+			continue
+		}
 
 		// The endpoint can provide default credentials for pulling images
 		err = rep.SetEndpointCredentials(updateConf.KubeClient)
@@ -161,9 +220,23 @@ func UpdateApplication(updateConf *UpdateConfiguration) ImageUpdaterResult {
 			continue
 		}
 
+		// Only the tag that is selected for update is verified
+		if vc.RequireSignature != nil {
+			vc.VerifyCandidate = rep.SignatureVerifier(ctx, applicationImage, regClient, vc.RequireSignature)
+		}
+
 		// Get list of available image tags from the repository
-		tags, err := rep.GetTags(applicationImage, regClient, &vc)
-		if err != nil {
+		tags, err := rep.GetTags(tagsCtx, applicationImage, regClient, vc)
+		if err != nil && (ctx.Err() != nil || errors.Is(err, registry.ErrRateLimited) || errors.Is(err, registry.ErrRegistryUnavailable) || registry.IsTruncatedTagListError(err)) {
+			// Rate limited images, images whose registry is unavailable and
+			// images whose tag list seems truncated are tried again in the
+			// next cycle
+			imgCtx.Warnf("Could not get tags from registry: %v", err)
+			result.NumImagesConsidered -= 1
+			result.NumImagesUnprocessed += 1
+			continue
+		} else if err != nil {
+			result.ImageStatus = append(result.ImageStatus, registry.NewImageUpdateStatus(updateableImage, nil, time.Now(), err))
 			imgCtx.Errorf("Could not get tags from registry: %v", err)
 			result.NumErrors += 1
 			continue
@@ -171,14 +244,43 @@ func UpdateApplication(updateConf *UpdateConfiguration) ImageUpdaterResult {
 
 		imgCtx.Tracef("List of available tags found: %v", tags.Tags())
 
+		// Images pinned to a digest are never updated, but we still report the
+		// version they would be updated to. When tracking a tag by its digest,
+		// or pinning the digest of new tags, the digest is what we update.
+		if updateableImage.IsDigestPinned() && vc.SortMode != image.VersionSortDigest && !vc.PinDigest {
+			pinnedTag := tag.NewImageTag(rep.ResolvePinnedTag(ctx, updateableImage, tags.Tags(), regClient), time.Unix(0, 0))
+			pinnedTag.TagDigest = updateableImage.ImageTag.TagDigest
+			pinnedImage := updateableImage.WithTag(pinnedTag)
+			current := pinnedImage
+			if pinnedTag.TagName == "" {
+				current = updateableImage.WithTag(nil)
+			}
+			selection, err := current.SelectVersionFromTags(vc, tags)
+			status := registry.NewImageUpdateStatus(pinnedImage, selection, time.Now(), err)
+			result.ImageStatus = append(result.ImageStatus, status)
+			if err != nil {
+				imgCtx.Errorf("Unable to find newest version from available tags: %v", err)
+				result.NumErrors += 1
+				continue
+			}
+			imgCtx.Infof("Image is pinned to digest %s, not updating (newest version: %s, %d version(s) ahead)", pinnedTag.TagDigest, status.Selected, status.AvailableHigher)
+			result.NumSkipped += 1
+			continue
+		}
+
 		// Get the latest available tag matching any constraint that might be set
 		// for allowed updates.
-		latest, err := updateableImage.GetNewestVersionFromTags(&vc, tags)
+		selection, err := updateableImage.SelectVersionFromTags(vc, tags)
+		result.ImageStatus = append(result.ImageStatus, registry.NewImageUpdateStatus(updateableImage, selection, time.Now(), err))
 		if err != nil {
 			imgCtx.Errorf("Unable to find newest version from available tags: %v", err)
 			result.NumErrors += 1
 			continue
 		}
+		latest := selection.Selected
+		if selection.Alternative != nil {
+			imgCtx.Debugf("Next-best alternative to the selected version is %s", selection.Alternative.TagName)
+		}
 
 		// If we have no latest tag information, it means there was no tag which
 		// has met our version constraint (or there was no semantic versioned tag
@@ -189,17 +291,79 @@ func UpdateApplication(updateConf *UpdateConfiguration) ImageUpdaterResult {
 			continue
 		}
 
+		// When pinning digests, the new tag is referenced along with the
+		// digest it currently points to. The tag from the list is shared
+		// with the cache, so it is not modified.
+		if vc.PinDigest && vc.SortMode != image.VersionSortDigest {
+			resolved, err := rep.ResolveTagDigest(ctx, applicationImage, latest.TagName, regClient)
+			if err != nil {
+				imgCtx.Errorf("Could not pin digest of tag %s: %v", latest.TagName, err)
+				result.NumErrors += 1
+				continue
+			}
+			pinned := *latest
+			pinned.TagDigest = resolved.TagDigest
+			latest = &pinned
+		}
+
 		// If the latest tag does not match image's current tag, it means we have
-		// an update candidate.
-		if updateableImage.ImageTag.TagName != latest.TagName {
+		// an update candidate. When tracking a tag by its digest, or pinning
+		// digests, a different digest of the same tag is an update candidate
+		// as well.
+		changed := updateableImage.ImageTag.TagName != latest.TagName || ((vc.SortMode == image.VersionSortDigest || vc.PinDigest) && updateableImage.ImageTag.TagDigest != latest.TagDigest)
+
+		// A tag pointing to the image already running is no update candidate,
+		// if so configured.
+		if changed && vc.SkipSameDigest && vc.SortMode != image.VersionSortDigest {
+			same, err := rep.HasSameDigest(ctx, applicationImage.WithTag(updateableImage.ImageTag), latest, regClient)
+			if err != nil {
+				imgCtx.Warnf("Could not compare digests of tags %s and %s: %v", updateableImage.ImageTag.TagName, latest.TagName, err)
+			} else if same {
+				imgCtx.Infof("Tag %s points to the same digest as current tag %s, not updating", latest.TagName, updateableImage.ImageTag.TagName)
+				changed = false
+			}
+		}
 
-			imgCtx.Infof("Setting new image to %s", updateableImage.WithTag(latest).String())
+		// Updates outside of the update window are deferred until it opens
+		if changed && vc.UpdateWindow != nil {
+			if t := now(); !vc.UpdateWindow.IsOpen(t) {
+				if opens := vc.UpdateWindow.NextOpen(t); opens.IsZero() {
+					imgCtx.Infof("Not updating to %s, update window never opens", latest.TagName)
+				} else {
+					imgCtx.Infof("Deferring update to %s until update window opens at %s", latest.TagName, opens.Format(time.RFC3339))
+				}
+				result.NumSkipped += 1
+				continue
+			}
+		}
+
+		if changed {
+
+			// The platform is only resolved for the tag we update to. The tag
+			// from the list is shared with the cache, so it is not modified.
+			if vc.IncludePlatform && selection.Platform == "" {
+				platform, err := rep.ResolvePlatform(ctx, applicationImage, latest.TagName, regClient)
+				if err != nil {
+					imgCtx.Warnf("Could not resolve platform of tag %s: %v", latest.TagName, err)
+				} else {
+					withPlatform := *latest
+					withPlatform.TagPlatform = platform
+					latest = &withPlatform
+					selection.Platform = platform
+				}
+			}
+
+			newImage := rep.WriteBackImage(applicationImage.WithTag(latest))
+			imgCtx.Infof("Setting new image to %s", newImage.String())
+			if selection.Platform != "" {
+				imgCtx.Infof("Resolved platform of new image is %s", selection.Platform)
+			}
 			needUpdate = true
 
 			if appType := GetApplicationType(&updateConf.UpdateApp.Application); appType == ApplicationTypeKustomize {
-				err = SetKustomizeImage(&updateConf.UpdateApp.Application, applicationImage.WithTag(latest))
+				err = SetKustomizeImage(&updateConf.UpdateApp.Application, newImage)
 			} else if appType == ApplicationTypeHelm {
-				err = SetHelmImage(&updateConf.UpdateApp.Application, applicationImage.WithTag(latest))
+				err = SetHelmImage(&updateConf.UpdateApp.Application, newImage)
 			} else {
 				result.NumErrors += 1
 				err = fmt.Errorf("Could not update application %s - neither Helm nor Kustomize application", app)
@@ -210,7 +374,7 @@ func UpdateApplication(updateConf *UpdateConfiguration) ImageUpdaterResult {
 				result.NumErrors += 1
 				continue
 			} else {
-				imgCtx.Infof("Successfully updated image '%s' to '%s', but pending spec update (dry run=%v)", updateableImage.GetFullNameWithTag(), updateableImage.WithTag(latest).GetFullNameWithTag(), updateConf.DryRun)
+				imgCtx.Infof("Successfully updated image '%s' to '%s', but pending spec update (dry run=%v)", updateableImage.GetFullNameWithTag(), newImage.GetFullNameWithTag(), updateConf.DryRun)
 				result.NumImagesUpdated += 1
 			}
 		} else {
@@ -249,9 +413,78 @@ func UpdateApplication(updateConf *UpdateConfiguration) ImageUpdaterResult {
 		}
 	}
 
+	// The status is only written once all images have been checked, so the
+	// status of images that are tried again in the next cycle is not lost
+	if updateConf.WriteImageStatus && !updateConf.DryRun && len(result.ImageStatus) > 0 && result.NumImagesUnprocessed == 0 {
+		err := WriteImageStatus(ctx, updateConf.KubeClient, &updateConf.UpdateApp.Application, result.ImageStatus)
+		if err != nil {
+			log.WithContext().AddField("application", app).Warnf("Could not write image status: %v", err)
+		}
+	}
+
 	return result
 }
 
+// liveImage returns the image of the application's live images that the
+// given image from the application's annotations refers to, or nil if it is
+// not live. The live image may carry the registry the endpoint rewrites it to
+// on write-back.
+func liveImage(liveImages image.ContainerImageList, applicationImage *image.ContainerImage) *image.ContainerImage {
+	updateableImage := liveImages.ContainsImage(applicationImage, false)
+	if updateableImage == nil {
+		if ep, err := registry.GetRegistryEndpointForImage(applicationImage); err == nil && ep.WriteBackPrefix != "" {
+			updateableImage = liveImages.ContainsImage(ep.WriteBackImage(applicationImage), false)
+		}
+	}
+	return updateableImage
+}
+
+// imageVersionConstraint returns the version constraint for finding a new tag
+// of the application image, which is live as updateableImage. Updates and
+// prefetching use the same constraint, so that prefetched tags are found.
+func imageVersionConstraint(rep *registry.RegistryEndpoint, applicationImage, updateableImage *image.ContainerImage, annotations map[string]string) *image.VersionConstraint {
+	vc := newVersionConstraint(applicationImage, annotations)
+	if rep.ArtifactType == registry.ArtifactHelmChart {
+		vc.UseChartVersions()
+	}
+	vc.SetTrack(updateableImage.ImageTag)
+	return vc
+}
+
+// newVersionConstraint returns the version constraint for the given image,
+// as configured by the application's annotations
+func newVersionConstraint(img *image.ContainerImage, annotations map[string]string) *image.VersionConstraint {
+	vc := &image.VersionConstraint{}
+	if img.ImageTag != nil {
+		vc.Constraint = img.ImageTag.TagName
+	}
+	vc.SortMode = img.GetParameterUpdateStrategy(annotations)
+	vc.MatchFunc, vc.MatchArgs = img.GetParameterMatch(annotations)
+	vc.IgnoreList = img.GetParameterIgnoreTags(annotations)
+	vc.MinDownloads = img.GetParameterMinDownloads(annotations)
+	vc.MissingDownloads = img.GetParameterMissingDownloads(annotations)
+	vc.VariantSuffix = img.GetParameterVariantSuffix(annotations)
+	vc.IncludePlatform = img.GetParameterIncludePlatform(annotations)
+	vc.Normalization = img.GetParameterTagNormalization(annotations)
+	vc.MaxJump, vc.MaxJumpUnit = img.GetParameterMaxJump(annotations)
+	vc.Lock = img.GetParameterLockTrack(annotations)
+	vc.IgnorePrerelease, vc.AllowPrereleaseFor = img.GetParameterIgnorePrerelease(annotations)
+	vc.DatePattern, vc.DateLayout = img.GetParameterTagDate(annotations)
+	vc.RequirePlatforms = img.GetParameterRequirePlatforms(annotations)
+	vc.RequireLabels = img.GetParameterRequireLabels(annotations)
+	vc.MinTags = img.GetParameterMinTags(annotations)
+	vc.MaxTags = img.GetParameterMaxTags(annotations)
+	vc.SortCommand = img.GetParameterSortCommand(annotations)
+	vc.SkipSameDigest = img.GetParameterSkipSameDigest(annotations)
+	vc.PinDigest = img.GetParameterPinDigest(annotations)
+	vc.MaxAge = img.GetParameterMaxAge(annotations)
+	vc.MissingAge = img.GetParameterMissingAge(annotations)
+	vc.CompareBuildMetadata = img.GetParameterCompareBuildMetadata(annotations)
+	vc.RequireSignature = img.GetParameterRequireSignature(annotations)
+	vc.UpdateWindow = img.GetParameterUpdateWindow(annotations)
+	return vc
+}
+
 // marshalParamsOverride marshals the parameter overrides of a given application
 // into YAML bytes
 func marshalParamsOverride(app *v1alpha1.Application) ([]byte, error) {
@@ -266,7 +499,8 @@ func marshalParamsOverride(app *v1alpha1.Application) ([]byte, error) {
 		}
 		params := kustomizeOverride{
 			Kustomize: kustomizeImages{
-				Images: &app.Spec.Source.Kustomize.Images,
+				Images:       &app.Spec.Source.Kustomize.Images,
+				CommonLabels: app.Spec.Source.Kustomize.CommonLabels,
 			},
 		}
 		override, err = yaml.Marshal(params)
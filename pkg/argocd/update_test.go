@@ -1,10 +1,12 @@
 package argocd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/argoproj-labs/argocd-image-updater/ext/git"
 	gitmock "github.com/argoproj-labs/argocd-image-updater/ext/git/mocks"
@@ -20,17 +22,29 @@ import (
 	"github.com/argoproj/argo-cd/pkg/apis/application/v1alpha1"
 	argogit "github.com/argoproj/argo-cd/util/git"
 	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// digestRegistryClient is a registry client that resolves all tags to the
+// same digest
+type digestRegistryClient struct {
+	regmock.RegistryClient
+	digest string
+}
+
+func (c *digestRegistryClient) TagDigest(ctx context.Context, nameInRepository, tagName string) (string, error) {
+	return c.digest, nil
+}
+
 func Test_UpdateApplication(t *testing.T) {
 	t.Run("Test successful update", func(t *testing.T) {
 		mockClientFn := func(endpoint *registry.RegistryEndpoint, username, password string) (registry.RegistryClient, error) {
 			regMock := regmock.RegistryClient{}
-			regMock.On("Tags", mock.Anything).Return([]string{"1.0.1"}, nil)
+			regMock.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.1"}, nil)
 			return &regMock, nil
 		}
 
@@ -80,6 +94,220 @@ func Test_UpdateApplication(t *testing.T) {
 		assert.Equal(t, 1, res.NumApplicationsProcessed)
 		assert.Equal(t, 1, res.NumImagesConsidered)
 		assert.Equal(t, 1, res.NumImagesUpdated)
+		require.Len(t, res.ImageStatus, 1)
+		assert.Equal(t, registry.UpdateStatusUpdateAvailable, res.ImageStatus[0].Reason)
+		assert.Equal(t, "1.0.1", res.ImageStatus[0].Selected)
+	})
+
+	t.Run("Test update with pinned digest", func(t *testing.T) {
+		mockClientFn := func(endpoint *registry.RegistryEndpoint, username, password string) (registry.RegistryClient, error) {
+			regMock := &digestRegistryClient{digest: "sha256:abc"}
+			regMock.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.1"}, nil)
+			regMock.On("ManifestForDigest", mock.Anything, mock.Anything, "sha256:abc").Return(&schema2.DeserializedManifest{}, nil)
+			return regMock, nil
+		}
+
+		argoClient := argomock.ArgoCD{}
+		argoClient.On("UpdateSpec", mock.Anything, mock.Anything).Return(nil, nil)
+
+		kubeClient := kube.KubernetesClient{
+			Clientset: fake.NewFakeKubeClient(),
+		}
+		newAppImages := func(current string) *ApplicationImages {
+			return &ApplicationImages{
+				Application: v1alpha1.Application{
+					ObjectMeta: v1.ObjectMeta{
+						Name:      "guestbook",
+						Namespace: "guestbook",
+						Annotations: map[string]string{
+							fmt.Sprintf(common.PinDigestAnnotation, "dummy"): "true",
+						},
+					},
+					Spec: v1alpha1.ApplicationSpec{
+						Source: v1alpha1.ApplicationSource{
+							Kustomize: &v1alpha1.ApplicationSourceKustomize{
+								Images: v1alpha1.KustomizeImages{
+									v1alpha1.KustomizeImage(current),
+								},
+							},
+						},
+					},
+					Status: v1alpha1.ApplicationStatus{
+						SourceType: v1alpha1.ApplicationSourceTypeKustomize,
+						Summary: v1alpha1.ApplicationSummary{
+							Images: []string{current},
+						},
+					},
+				},
+				Images: image.ContainerImageList{
+					image.NewFromIdentifier("dummy=jannfis/foobar:~1.0.0"),
+				},
+			}
+		}
+
+		// The new tag is written along with its digest
+		appImages := newAppImages("jannfis/foobar:1.0.0")
+		res := UpdateApplication(&UpdateConfiguration{
+			NewRegFN:   mockClientFn,
+			ArgoClient: &argoClient,
+			KubeClient: &kubeClient,
+			UpdateApp:  appImages,
+			DryRun:     false,
+		})
+		assert.Equal(t, 0, res.NumErrors)
+		assert.Equal(t, 1, res.NumImagesUpdated)
+		assert.Equal(t, v1alpha1.KustomizeImage("jannfis/foobar:1.0.1@sha256:abc"), appImages.Application.Spec.Source.Kustomize.Images[0])
+
+		// An image already pinned to the digest of the newest tag is not
+		// updated again
+		appImages = newAppImages("jannfis/foobar:1.0.1@sha256:abc")
+		res = UpdateApplication(&UpdateConfiguration{
+			NewRegFN:   mockClientFn,
+			ArgoClient: &argoClient,
+			KubeClient: &kubeClient,
+			UpdateApp:  appImages,
+			DryRun:     false,
+		})
+		assert.Equal(t, 0, res.NumErrors)
+		assert.Equal(t, 0, res.NumImagesUpdated)
+	})
+
+	t.Run("Test no update after cycle deadline exceeded", func(t *testing.T) {
+		mockClientFn := func(endpoint *registry.RegistryEndpoint, username, password string) (registry.RegistryClient, error) {
+			regMock := regmock.RegistryClient{}
+			regMock.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.1"}, nil)
+			return &regMock, nil
+		}
+
+		argoClient := argomock.ArgoCD{}
+		argoClient.On("UpdateSpec", mock.Anything, mock.Anything).Return(nil, nil)
+
+		kubeClient := kube.KubernetesClient{
+			Clientset: fake.NewFakeKubeClient(),
+		}
+		appImages := &ApplicationImages{
+			Application: v1alpha1.Application{
+				ObjectMeta: v1.ObjectMeta{
+					Name:      "guestbook",
+					Namespace: "guestbook",
+				},
+				Spec: v1alpha1.ApplicationSpec{
+					Source: v1alpha1.ApplicationSource{
+						Kustomize: &v1alpha1.ApplicationSourceKustomize{
+							Images: v1alpha1.KustomizeImages{
+								"jannfis/foobar:1.0.0",
+							},
+						},
+					},
+				},
+				Status: v1alpha1.ApplicationStatus{
+					SourceType: v1alpha1.ApplicationSourceTypeKustomize,
+					Summary: v1alpha1.ApplicationSummary{
+						Images: []string{
+							"jannfis/foobar:1.0.0",
+						},
+					},
+				},
+			},
+			Images: image.ContainerImageList{
+				image.NewFromIdentifier("jannfis/foobar:~1.0.0"),
+			},
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		res := UpdateApplication(&UpdateConfiguration{
+			NewRegFN:   mockClientFn,
+			ArgoClient: &argoClient,
+			KubeClient: &kubeClient,
+			UpdateApp:  appImages,
+			DryRun:     false,
+			Ctx:        ctx,
+		})
+		assert.Equal(t, 0, res.NumErrors)
+		assert.Equal(t, 0, res.NumImagesConsidered)
+		assert.Equal(t, 0, res.NumImagesUpdated)
+		assert.Equal(t, 1, res.NumImagesUnprocessed)
+		assert.Equal(t, v1alpha1.KustomizeImage("jannfis/foobar:1.0.0"), appImages.Application.Spec.Source.Kustomize.Images[0])
+	})
+
+	t.Run("Test update deferred until update window opens", func(t *testing.T) {
+		mockClientFn := func(endpoint *registry.RegistryEndpoint, username, password string) (registry.RegistryClient, error) {
+			regMock := regmock.RegistryClient{}
+			regMock.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.1"}, nil)
+			return &regMock, nil
+		}
+
+		argoClient := argomock.ArgoCD{}
+		argoClient.On("UpdateSpec", mock.Anything, mock.Anything).Return(nil, nil)
+
+		kubeClient := kube.KubernetesClient{
+			Clientset: fake.NewFakeKubeClient(),
+		}
+		newAppImages := func() *ApplicationImages {
+			return &ApplicationImages{
+				Application: v1alpha1.Application{
+					ObjectMeta: v1.ObjectMeta{
+						Name:      "guestbook",
+						Namespace: "guestbook",
+						Annotations: map[string]string{
+							fmt.Sprintf(common.UpdateWindowAnnotation, "dummy"): "Mon-Fri 18:00-07:00",
+						},
+					},
+					Spec: v1alpha1.ApplicationSpec{
+						Source: v1alpha1.ApplicationSource{
+							Kustomize: &v1alpha1.ApplicationSourceKustomize{
+								Images: v1alpha1.KustomizeImages{
+									"jannfis/foobar:1.0.0",
+								},
+							},
+						},
+					},
+					Status: v1alpha1.ApplicationStatus{
+						SourceType: v1alpha1.ApplicationSourceTypeKustomize,
+						Summary: v1alpha1.ApplicationSummary{
+							Images: []string{
+								"jannfis/foobar:1.0.0",
+							},
+						},
+					},
+				},
+				Images: image.ContainerImageList{
+					image.NewFromIdentifier("dummy=jannfis/foobar:~1.0.0"),
+				},
+			}
+		}
+
+		// Saturday noon is outside of the window
+		appImages := newAppImages()
+		res := UpdateApplication(&UpdateConfiguration{
+			NewRegFN:   mockClientFn,
+			ArgoClient: &argoClient,
+			KubeClient: &kubeClient,
+			UpdateApp:  appImages,
+			DryRun:     false,
+			Now:        func() time.Time { return time.Date(2021, 5, 8, 12, 0, 0, 0, time.UTC) },
+		})
+		assert.Equal(t, 0, res.NumErrors)
+		assert.Equal(t, 1, res.NumSkipped)
+		assert.Equal(t, 1, res.NumImagesConsidered)
+		assert.Equal(t, 0, res.NumImagesUpdated)
+		require.Len(t, res.ImageStatus, 1)
+		assert.Equal(t, "1.0.1", res.ImageStatus[0].Selected)
+		assert.Equal(t, v1alpha1.KustomizeImage("jannfis/foobar:1.0.0"), appImages.Application.Spec.Source.Kustomize.Images[0])
+
+		// Tuesday night is inside of the window
+		appImages = newAppImages()
+		res = UpdateApplication(&UpdateConfiguration{
+			NewRegFN:   mockClientFn,
+			ArgoClient: &argoClient,
+			KubeClient: &kubeClient,
+			UpdateApp:  appImages,
+			DryRun:     false,
+			Now:        func() time.Time { return time.Date(2021, 5, 11, 20, 0, 0, 0, time.UTC) },
+		})
+		assert.Equal(t, 0, res.NumErrors)
+		assert.Equal(t, 0, res.NumSkipped)
+		assert.Equal(t, 1, res.NumImagesUpdated)
 	})
 
 	t.Run("Test successful update with credentials", func(t *testing.T) {
@@ -87,7 +315,7 @@ func Test_UpdateApplication(t *testing.T) {
 			regMock := regmock.RegistryClient{}
 			assert.Equal(t, "myuser", username)
 			assert.Equal(t, "mypass", password)
-			regMock.On("Tags", mock.Anything).Return([]string{"1.0.1"}, nil)
+			regMock.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.1"}, nil)
 			return &regMock, nil
 		}
 
@@ -145,7 +373,7 @@ func Test_UpdateApplication(t *testing.T) {
 	t.Run("Test skip because of image not in list", func(t *testing.T) {
 		mockClientFn := func(endpoint *registry.RegistryEndpoint, username, password string) (registry.RegistryClient, error) {
 			regMock := regmock.RegistryClient{}
-			regMock.On("Tags", mock.Anything).Return([]string{"1.0.1"}, nil)
+			regMock.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.1"}, nil)
 			return &regMock, nil
 		}
 
@@ -200,7 +428,7 @@ func Test_UpdateApplication(t *testing.T) {
 	t.Run("Test skip because of image up-to-date", func(t *testing.T) {
 		mockClientFn := func(endpoint *registry.RegistryEndpoint, username, password string) (registry.RegistryClient, error) {
 			regMock := regmock.RegistryClient{}
-			regMock.On("Tags", mock.Anything).Return([]string{"1.0.1"}, nil)
+			regMock.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.1"}, nil)
 			return &regMock, nil
 		}
 
@@ -269,8 +497,8 @@ func Test_UpdateApplication(t *testing.T) {
 		called := 0
 		mockClientFn := func(endpoint *registry.RegistryEndpoint, username, password string) (registry.RegistryClient, error) {
 			regMock := regmock.RegistryClient{}
-			regMock.On("Tags", mock.Anything).Return([]string{"one", "two", "three", "four"}, nil)
-			regMock.On("ManifestV1", mock.Anything).Return(meta[called], nil)
+			regMock.On("Tags", mock.Anything, mock.Anything).Return([]string{"one", "two", "three", "four"}, nil)
+			regMock.On("ManifestV1", mock.Anything, mock.Anything).Return(meta[called], nil)
 			called += 1
 			return &regMock, nil
 		}
@@ -344,8 +572,8 @@ func Test_UpdateApplication(t *testing.T) {
 		called := 0
 		mockClientFn := func(endpoint *registry.RegistryEndpoint, username, password string) (registry.RegistryClient, error) {
 			regMock := regmock.RegistryClient{}
-			regMock.On("Tags", mock.Anything).Return([]string{"one", "two", "three", "four"}, nil)
-			regMock.On("ManifestV1", mock.Anything).Return(meta[called], nil)
+			regMock.On("Tags", mock.Anything, mock.Anything).Return([]string{"one", "two", "three", "four"}, nil)
+			regMock.On("ManifestV1", mock.Anything, mock.Anything).Return(meta[called], nil)
 			called += 1
 			return &regMock, nil
 		}
@@ -405,7 +633,7 @@ func Test_UpdateApplication(t *testing.T) {
 	t.Run("Error - unknown registry", func(t *testing.T) {
 		mockClientFn := func(endpoint *registry.RegistryEndpoint, username, password string) (registry.RegistryClient, error) {
 			regMock := regmock.RegistryClient{}
-			regMock.On("Tags", mock.Anything).Return([]string{"1.0.1"}, nil)
+			regMock.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.1"}, nil)
 			return &regMock, nil
 		}
 
@@ -513,7 +741,7 @@ func Test_UpdateApplication(t *testing.T) {
 	t.Run("Test error on failure to list tags", func(t *testing.T) {
 		mockClientFn := func(endpoint *registry.RegistryEndpoint, username, password string) (registry.RegistryClient, error) {
 			regMock := regmock.RegistryClient{}
-			regMock.On("Tags", mock.Anything).Return(nil, errors.New("some error"))
+			regMock.On("Tags", mock.Anything, mock.Anything).Return(nil, errors.New("some error"))
 			return &regMock, nil
 		}
 
@@ -568,7 +796,7 @@ func Test_UpdateApplication(t *testing.T) {
 	t.Run("Test error on improper semver in tag", func(t *testing.T) {
 		mockClientFn := func(endpoint *registry.RegistryEndpoint, username, password string) (registry.RegistryClient, error) {
 			regMock := regmock.RegistryClient{}
-			regMock.On("Tags", mock.Anything).Return([]string{"1.0.0", "1.0.1"}, nil)
+			regMock.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.0", "1.0.1"}, nil)
 			return &regMock, nil
 		}
 
@@ -1,17 +1,78 @@
 package cache
 
 import (
+	"strings"
+	"time"
+
 	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
 )
 
+// ImageTagCache is the interface of a cache for the meta data and digests of
+// image tags. MemCache is the default implementation, other backends can be
+// used for the registry endpoints with registry.SetCacheFactory.
 type ImageTagCache interface {
 	HasTag(imageName string, imageTag string) bool
 	GetTag(imageName string, imageTag string) (*tag.ImageTag, error)
 	SetTag(imageName string, imgTag *tag.ImageTag)
+	GetDigest(imageName string, imageTag string) string
+	SetDigest(imageName string, imageTag string, digest string)
+	// SetNoTags records that no tags matched the constraint with the given
+	// key for an image, for the duration of ttl
+	SetNoTags(imageName string, constraintKey string, ttl time.Duration)
+	// HasNoTags returns true if it has been recorded that no tags matched
+	// the constraint with the given key, and that record has not expired
+	HasNoTags(imageName string, constraintKey string) bool
+	// SetTagCount records the number of tags the registry returned for an
+	// image
+	SetTagCount(imageName string, count int)
+	// GetTagCount returns the recorded number of tags for an image, or 0 if
+	// none has been recorded
+	GetTagCount(imageName string) int
+	// SetTagList records the list of tags the registry returned for an
+	// image, along with the ETag the registry sent for the list
+	SetTagList(imageName string, etag string, tags []string)
+	// GetTagList returns the recorded ETag and list of tags for an image,
+	// or an empty ETag if none has been recorded
+	GetTagList(imageName string) (string, []string)
 	ClearCache()
+	// ClearCacheForRepo removes all entries of the image with the given name,
+	// i.e. after its tags have been pushed again. Registry endpoints keep
+	// results of their own, use the endpoint's ClearCacheForRepo to remove
+	// those as well.
+	ClearCacheForRepo(imageName string)
+	// ClearCacheForPrefix removes all entries of the images whose name starts
+	// with the given prefix
+	ClearCacheForPrefix(prefix string)
 	NumEntries() int
 }
 
+// imageNameOfKey returns the name of the image the entry with the given key
+// belongs to. Keys start with the kind of the entry, followed by the name of
+// the image, separated by colons.
+func imageNameOfKey(key string) string {
+	tokens := strings.SplitN(key, ":", 3)
+	if len(tokens) < 2 {
+		return ""
+	}
+	return tokens[1]
+}
+
+// repoMatcher returns a function that matches the image name of cache keys
+// against the given name
+func repoMatcher(imageName string) func(string) bool {
+	return func(key string) bool {
+		return imageNameOfKey(key) == imageName
+	}
+}
+
+// prefixMatcher returns a function that matches the image name of cache keys
+// against the given prefix
+func prefixMatcher(prefix string) func(string) bool {
+	return func(key string) bool {
+		return strings.HasPrefix(imageNameOfKey(key), prefix)
+	}
+}
+
 // KnownImage represents a known image and the applications using it, without
 // any version/tag information.
 type KnownImage struct {
@@ -0,0 +1,369 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+// Number of superseded records in the cache file that triggers rewriting it
+const diskCacheCompactThreshold = 1024
+
+// diskEntry is a record in the file of a DiskCache. Each write appends a
+// record, and later records for the same key replace earlier ones.
+type diskEntry struct {
+	Key     string        `json:"key"`
+	Tag     *tag.ImageTag `json:"tag,omitempty"`
+	Digest  string        `json:"digest,omitempty"`
+	Count   int           `json:"count,omitempty"`
+	ETag    string        `json:"etag,omitempty"`
+	TagList []string      `json:"taglist,omitempty"`
+	Expires *time.Time    `json:"expires,omitempty"`
+	Deleted bool          `json:"deleted,omitempty"`
+}
+
+// expired returns true if the entry has an expiry that has passed
+func (e *diskEntry) expired(now time.Time) bool {
+	return e.Expires != nil && now.After(*e.Expires)
+}
+
+// DiskCache is an ImageTagCache that persists its entries to a file, so that
+// they survive restarts. Entries are kept in memory as well, and each write
+// is appended to the file. The file is loaded when the cache is created, and
+// rewritten without superseded and expired records from time to time. Tag
+// entries expire after the TTL of the cache, recorded digests never expire.
+type DiskCache struct {
+	path    string
+	ttl     time.Duration
+	lock    sync.Mutex
+	entries map[string]*diskEntry
+	file    *os.File
+	records int
+}
+
+// NewDiskCache returns a new instance of DiskCache persisting to the file at
+// path, with the entries already present in the file. Tag entries expire
+// after ttl, a ttl of 0 means that they never expire.
+func NewDiskCache(path string, ttl time.Duration) (*DiskCache, error) {
+	dc := &DiskCache{path: path, ttl: ttl, entries: map[string]*diskEntry{}}
+	if err := dc.load(); err != nil {
+		return nil, err
+	}
+	if err := dc.compact(); err != nil {
+		return nil, err
+	}
+	log.Debugf("Loaded %d entries from cache file %s", len(dc.entries), path)
+	return dc, nil
+}
+
+// DiskCacheFactory returns a function that creates a DiskCache for the
+// registry endpoint with the given prefix, persisting to a file in dir. If
+// the DiskCache cannot be created, an in-memory cache is used instead.
+func DiskCacheFactory(dir string, ttl time.Duration) func(prefix string) ImageTagCache {
+	return func(prefix string) ImageTagCache {
+		path := filepath.Join(dir, diskCacheFileName(prefix))
+		dc, err := NewDiskCache(path, ttl)
+		if err != nil {
+			log.Warnf("could not use cache file %s, not persisting cache: %v", path, err)
+			return NewMemCache()
+		}
+		return dc
+	}
+}
+
+// diskCacheFileName returns the name of the cache file for the registry
+// endpoint with the given prefix
+func diskCacheFileName(prefix string) string {
+	if prefix == "" {
+		prefix = "default"
+	}
+	return strings.NewReplacer("/", "_", ":", "_", "\\", "_").Replace(prefix) + ".cache"
+}
+
+// load reads the entries from the cache file, if it exists. Records that
+// cannot be parsed, i.e. because writing them was interrupted, are skipped.
+func (dc *DiskCache) load() error {
+	f, err := os.Open(dc.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not open cache file: %v", err)
+	}
+	defer f.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e diskEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || e.Key == "" {
+			log.Debugf("skipping invalid record in cache file %s", dc.path)
+			continue
+		}
+		if e.Deleted && e.Key == "*" {
+			dc.entries = map[string]*diskEntry{}
+		} else if e.Deleted {
+			delete(dc.entries, e.Key)
+		} else if e.expired(now) {
+			delete(dc.entries, e.Key)
+		} else {
+			dc.entries[e.Key] = &e
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("could not read cache file: %v", err)
+	}
+	return nil
+}
+
+// compact rewrites the cache file with the current, unexpired entries and
+// opens it for appending. Must be called with the lock held, or before the
+// cache is used.
+func (dc *DiskCache) compact() error {
+	if err := os.MkdirAll(filepath.Dir(dc.path), 0700); err != nil {
+		return fmt.Errorf("could not create cache directory: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dc.path), filepath.Base(dc.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not create cache file: %v", err)
+	}
+	now := time.Now()
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for k, e := range dc.entries {
+		if e.expired(now) {
+			delete(dc.entries, k)
+			continue
+		}
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dc.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("could not write cache file: %v", err)
+	}
+
+	if dc.file != nil {
+		dc.file.Close()
+		dc.file = nil
+	}
+	dc.file, err = os.OpenFile(dc.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open cache file: %v", err)
+	}
+	dc.records = len(dc.entries)
+	return nil
+}
+
+// write appends a record to the cache file. Must be called with the lock
+// held.
+func (dc *DiskCache) write(e *diskEntry) {
+	if dc.file == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err == nil {
+		_, err = dc.file.Write(append(b, '\n'))
+	}
+	if err != nil {
+		log.Warnf("could not write to cache file %s: %v", dc.path, err)
+		return
+	}
+	dc.records += 1
+	if dc.records-len(dc.entries) > diskCacheCompactThreshold {
+		if err := dc.compact(); err != nil {
+			log.Warnf("could not compact cache file %s: %v", dc.path, err)
+		}
+	}
+}
+
+// set stores an entry in memory and appends it to the cache file
+func (dc *DiskCache) set(e *diskEntry) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	dc.entries[e.Key] = e
+	dc.write(e)
+}
+
+// get returns the unexpired entry for key, or nil if there is none
+func (dc *DiskCache) get(key string) *diskEntry {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	e, ok := dc.entries[key]
+	if !ok {
+		return nil
+	}
+	if e.expired(time.Now()) {
+		delete(dc.entries, key)
+		return nil
+	}
+	return e
+}
+
+// expiry returns the point in time an entry written now expires after ttl,
+// or nil if ttl is 0
+func expiry(ttl time.Duration) *time.Time {
+	if ttl <= 0 {
+		return nil
+	}
+	t := time.Now().Add(ttl)
+	return &t
+}
+
+// HasTag returns true if cache has entry for given tag, false if not
+func (dc *DiskCache) HasTag(imageName string, tagName string) bool {
+	return dc.get(tagCacheKey(imageName, tagName)) != nil
+}
+
+// SetTag sets a tag entry into the cache
+func (dc *DiskCache) SetTag(imageName string, imgTag *tag.ImageTag) {
+	t := *imgTag
+	dc.set(&diskEntry{Key: tagCacheKey(imageName, imgTag.TagName), Tag: &t, Expires: expiry(dc.ttl)})
+}
+
+// GetTag gets a tag entry from the cache
+func (dc *DiskCache) GetTag(imageName string, tagName string) (*tag.ImageTag, error) {
+	e := dc.get(tagCacheKey(imageName, tagName))
+	if e == nil {
+		return nil, nil
+	}
+	if e.Tag == nil {
+		return nil, fmt.Errorf("no tag in cache entry %s", e.Key)
+	}
+	t := *e.Tag
+	return &t, nil
+}
+
+// SetDigest records the digest that has been observed for a tag
+func (dc *DiskCache) SetDigest(imageName string, tagName string, digest string) {
+	dc.set(&diskEntry{Key: digestCacheKey(imageName, tagName), Digest: digest})
+}
+
+// GetDigest returns the recorded digest for a tag, or the empty string if no
+// digest has been recorded
+func (dc *DiskCache) GetDigest(imageName string, tagName string) string {
+	e := dc.get(digestCacheKey(imageName, tagName))
+	if e == nil {
+		return ""
+	}
+	return e.Digest
+}
+
+// SetNoTags records that no tags matched a constraint for an image, until
+// ttl has passed
+func (dc *DiskCache) SetNoTags(imageName string, constraintKey string, ttl time.Duration) {
+	dc.set(&diskEntry{Key: noTagsCacheKey(imageName, constraintKey), Expires: expiry(ttl)})
+}
+
+// HasNoTags returns true if there is an unexpired record that no tags matched
+// a constraint for an image
+func (dc *DiskCache) HasNoTags(imageName string, constraintKey string) bool {
+	return dc.get(noTagsCacheKey(imageName, constraintKey)) != nil
+}
+
+// SetTagCount records the number of tags the registry returned for an image
+func (dc *DiskCache) SetTagCount(imageName string, count int) {
+	dc.set(&diskEntry{Key: tagCountCacheKey(imageName), Count: count})
+}
+
+// GetTagCount returns the recorded number of tags for an image, or 0 if none
+// has been recorded
+func (dc *DiskCache) GetTagCount(imageName string) int {
+	e := dc.get(tagCountCacheKey(imageName))
+	if e == nil {
+		return 0
+	}
+	return e.Count
+}
+
+// SetTagList records the list of tags the registry returned for an image,
+// along with its ETag
+func (dc *DiskCache) SetTagList(imageName string, etag string, tags []string) {
+	dc.set(&diskEntry{Key: tagListCacheKey(imageName), ETag: etag, TagList: append([]string{}, tags...)})
+}
+
+// GetTagList returns the recorded ETag and list of tags for an image, or an
+// empty ETag if none has been recorded
+func (dc *DiskCache) GetTagList(imageName string) (string, []string) {
+	e := dc.get(tagListCacheKey(imageName))
+	if e == nil {
+		return "", nil
+	}
+	return e.ETag, append([]string{}, e.TagList...)
+}
+
+// ClearCache clears the cache, both in memory and on disk
+func (dc *DiskCache) ClearCache() {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	dc.entries = map[string]*diskEntry{}
+	if err := dc.compact(); err != nil {
+		log.Warnf("could not clear cache file %s: %v", dc.path, err)
+		// Make sure the entries are not loaded again after a restart
+		dc.write(&diskEntry{Key: "*", Deleted: true})
+	}
+}
+
+// ClearCacheForRepo removes all entries of the image with the given name, both
+// in memory and on disk
+func (dc *DiskCache) ClearCacheForRepo(imageName string) {
+	dc.clearMatching(repoMatcher(imageName))
+}
+
+// ClearCacheForPrefix removes all entries of the images whose name starts
+// with the given prefix, both in memory and on disk
+func (dc *DiskCache) ClearCacheForPrefix(prefix string) {
+	dc.clearMatching(prefixMatcher(prefix))
+}
+
+// clearMatching removes all entries whose key matches, and records their
+// removal in the cache file
+func (dc *DiskCache) clearMatching(matches func(key string) bool) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	for k := range dc.entries {
+		if matches(k) {
+			delete(dc.entries, k)
+			dc.write(&diskEntry{Key: k, Deleted: true})
+		}
+	}
+}
+
+// NumEntries returns the number of entries in the cache
+func (dc *DiskCache) NumEntries() int {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	return len(dc.entries)
+}
+
+// Close closes the cache file. Entries written afterwards are only kept in
+// memory.
+func (dc *DiskCache) Close() error {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	if dc.file == nil {
+		return nil
+	}
+	err := dc.file.Close()
+	dc.file = nil
+	return err
+}
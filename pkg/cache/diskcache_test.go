@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_DiskCache(t *testing.T) {
+	imageName := "foo/bar"
+	imageTag := "v1.0.0"
+
+	dir, err := ioutil.TempDir("", "diskcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("Entries survive a restart", func(t *testing.T) {
+		path := filepath.Join(dir, "restart.cache")
+		dc, err := NewDiskCache(path, time.Hour)
+		require.NoError(t, err)
+		newTag := tag.NewImageTag(imageTag, time.Unix(1600000000, 0))
+		newTag.TagDigest = "sha256:abc"
+		dc.SetTag(imageName, newTag)
+		dc.SetDigest(imageName, imageTag, "sha256:def")
+		require.NoError(t, dc.Close())
+
+		dc, err = NewDiskCache(path, time.Hour)
+		require.NoError(t, err)
+		defer dc.Close()
+		cachedTag, err := dc.GetTag(imageName, imageTag)
+		require.NoError(t, err)
+		require.NotNil(t, cachedTag)
+		assert.Equal(t, imageTag, cachedTag.TagName)
+		assert.Equal(t, "sha256:abc", cachedTag.TagDigest)
+		assert.True(t, cachedTag.TagDate.Equal(time.Unix(1600000000, 0)))
+		assert.Equal(t, "sha256:def", dc.GetDigest(imageName, imageTag))
+		assert.Equal(t, 2, dc.NumEntries())
+	})
+
+	t.Run("Cache miss", func(t *testing.T) {
+		dc, err := NewDiskCache(filepath.Join(dir, "miss.cache"), time.Hour)
+		require.NoError(t, err)
+		defer dc.Close()
+		cachedTag, err := dc.GetTag(imageName, imageTag)
+		require.NoError(t, err)
+		assert.Nil(t, cachedTag)
+		assert.False(t, dc.HasTag(imageName, imageTag))
+		assert.Equal(t, "", dc.GetDigest(imageName, imageTag))
+	})
+
+	t.Run("Tag entries expire", func(t *testing.T) {
+		path := filepath.Join(dir, "expiry.cache")
+		dc, err := NewDiskCache(path, 50*time.Millisecond)
+		require.NoError(t, err)
+		dc.SetTag(imageName, tag.NewImageTag(imageTag, time.Unix(0, 0)))
+		dc.SetDigest(imageName, imageTag, "sha256:def")
+		assert.True(t, dc.HasTag(imageName, imageTag))
+		require.NoError(t, dc.Close())
+		time.Sleep(100 * time.Millisecond)
+
+		dc, err = NewDiskCache(path, 50*time.Millisecond)
+		require.NoError(t, err)
+		defer dc.Close()
+		assert.False(t, dc.HasTag(imageName, imageTag))
+		assert.Equal(t, "sha256:def", dc.GetDigest(imageName, imageTag))
+	})
+
+	t.Run("Clear cache wipes memory and disk", func(t *testing.T) {
+		path := filepath.Join(dir, "clear.cache")
+		dc, err := NewDiskCache(path, 0)
+		require.NoError(t, err)
+		dc.SetTag(imageName, tag.NewImageTag(imageTag, time.Unix(0, 0)))
+		dc.ClearCache()
+		assert.Equal(t, 0, dc.NumEntries())
+		require.NoError(t, dc.Close())
+
+		dc, err = NewDiskCache(path, 0)
+		require.NoError(t, err)
+		defer dc.Close()
+		assert.Equal(t, 0, dc.NumEntries())
+	})
+
+	t.Run("Clear cache for repository survives a restart", func(t *testing.T) {
+		path := filepath.Join(dir, "clear-repo.cache")
+		dc, err := NewDiskCache(path, 0)
+		require.NoError(t, err)
+		for _, name := range []string{imageName, "foo/baz", "other/bar"} {
+			dc.SetTag(name, tag.NewImageTag(imageTag, time.Unix(0, 0)))
+			dc.SetDigest(name, imageTag, "sha256:abc")
+		}
+		dc.ClearCacheForRepo(imageName)
+		assert.False(t, dc.HasTag(imageName, imageTag))
+		assert.Equal(t, 4, dc.NumEntries())
+		require.NoError(t, dc.Close())
+
+		dc, err = NewDiskCache(path, 0)
+		require.NoError(t, err)
+		assert.False(t, dc.HasTag(imageName, imageTag))
+		assert.Equal(t, "", dc.GetDigest(imageName, imageTag))
+		assert.True(t, dc.HasTag("foo/baz", imageTag))
+		assert.True(t, dc.HasTag("other/bar", imageTag))
+
+		dc.ClearCacheForPrefix("foo/")
+		require.NoError(t, dc.Close())
+		dc, err = NewDiskCache(path, 0)
+		require.NoError(t, err)
+		defer dc.Close()
+		assert.False(t, dc.HasTag("foo/baz", imageTag))
+		assert.True(t, dc.HasTag("other/bar", imageTag))
+		assert.Equal(t, 2, dc.NumEntries())
+	})
+
+	t.Run("Invalid records are skipped", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.cache")
+		dc, err := NewDiskCache(path, 0)
+		require.NoError(t, err)
+		dc.SetNoTags(imageName, "key", time.Hour)
+		require.NoError(t, dc.Close())
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		require.NoError(t, err)
+		_, err = f.WriteString(`{"key":"tags:foo/bar:v1`)
+		require.NoError(t, err)
+		f.Close()
+
+		dc, err = NewDiskCache(path, 0)
+		require.NoError(t, err)
+		defer dc.Close()
+		assert.True(t, dc.HasNoTags(imageName, "key"))
+		assert.Equal(t, 1, dc.NumEntries())
+	})
+
+	t.Run("Tag lists survive a restart", func(t *testing.T) {
+		path := filepath.Join(dir, "taglist.cache")
+		dc, err := NewDiskCache(path, time.Hour)
+		require.NoError(t, err)
+		dc.SetTagList(imageName, `"abc"`, []string{"v1", "v2"})
+		require.NoError(t, dc.Close())
+
+		dc, err = NewDiskCache(path, time.Hour)
+		require.NoError(t, err)
+		defer dc.Close()
+		etag, tags := dc.GetTagList(imageName)
+		assert.Equal(t, `"abc"`, etag)
+		assert.Equal(t, []string{"v1", "v2"}, tags)
+		etag, _ = dc.GetTagList("foo/baz")
+		assert.Equal(t, "", etag)
+	})
+
+	t.Run("Cache file per endpoint", func(t *testing.T) {
+		factory := DiskCacheFactory(dir, time.Hour)
+		c := factory("ghcr.io/org")
+		c.SetTag(imageName, tag.NewImageTag(imageTag, time.Unix(0, 0)))
+		c.(*DiskCache).Close()
+		_, err := os.Stat(filepath.Join(dir, "ghcr.io_org.cache"))
+		assert.NoError(t, err)
+		assert.Equal(t, "default.cache", diskCacheFileName(""))
+	})
+}
@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+// LayeredCache is an ImageTagCache that composes a primary cache, i.e. a
+// shared remote cache, with a warm-standby secondary cache, i.e. an in-memory
+// cache. Writes go to both caches, so that the secondary always holds the
+// entries seen by this instance. Reads are served from the primary, and fall
+// through to the secondary if the primary fails or has no entry. Entries read
+// from the secondary are written back to the primary, so that a primary that
+// recovered from a failure is populated again.
+type LayeredCache struct {
+	primary   ImageTagCache
+	secondary ImageTagCache
+	lock      sync.Mutex
+	failed    bool
+}
+
+// NewLayeredCache returns a new instance of LayeredCache using the given
+// primary and secondary caches
+func NewLayeredCache(primary, secondary ImageTagCache) ImageTagCache {
+	return &LayeredCache{primary: primary, secondary: secondary}
+}
+
+// setPrimaryFailed records whether the last read from the primary cache has
+// failed, and logs when that state changes
+func (lc *LayeredCache) setPrimaryFailed(failed bool, err error) {
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	if failed && !lc.failed {
+		log.Warnf("primary cache failed, using secondary cache: %v", err)
+	} else if !failed && lc.failed {
+		log.Infof("primary cache recovered")
+	}
+	lc.failed = failed
+}
+
+// HasTag returns true if either cache has an entry for given tag
+func (lc *LayeredCache) HasTag(imageName string, tagName string) bool {
+	imgTag, err := lc.GetTag(imageName, tagName)
+	return err == nil && imgTag != nil
+}
+
+// SetTag sets a tag entry into both caches
+func (lc *LayeredCache) SetTag(imageName string, imgTag *tag.ImageTag) {
+	lc.primary.SetTag(imageName, imgTag)
+	lc.secondary.SetTag(imageName, imgTag)
+}
+
+// GetTag gets a tag entry from the primary cache, or from the secondary cache
+// if the primary cache failed or has no such entry
+func (lc *LayeredCache) GetTag(imageName string, tagName string) (*tag.ImageTag, error) {
+	imgTag, err := lc.primary.GetTag(imageName, tagName)
+	lc.setPrimaryFailed(err != nil, err)
+	if err == nil && imgTag != nil {
+		return imgTag, nil
+	}
+	imgTag, serr := lc.secondary.GetTag(imageName, tagName)
+	if serr != nil {
+		return nil, serr
+	}
+	if imgTag != nil && err == nil {
+		lc.primary.SetTag(imageName, imgTag)
+	}
+	return imgTag, nil
+}
+
+// SetDigest records the digest that has been observed for a tag in both
+// caches
+func (lc *LayeredCache) SetDigest(imageName string, tagName string, digest string) {
+	lc.primary.SetDigest(imageName, tagName, digest)
+	lc.secondary.SetDigest(imageName, tagName, digest)
+}
+
+// GetDigest returns the recorded digest for a tag from the primary cache, or
+// from the secondary cache if the primary cache has no digest recorded
+func (lc *LayeredCache) GetDigest(imageName string, tagName string) string {
+	if digest := lc.primary.GetDigest(imageName, tagName); digest != "" {
+		return digest
+	}
+	digest := lc.secondary.GetDigest(imageName, tagName)
+	if digest != "" {
+		lc.primary.SetDigest(imageName, tagName, digest)
+	}
+	return digest
+}
+
+// SetNoTags records in both caches that no tags matched a constraint
+func (lc *LayeredCache) SetNoTags(imageName string, constraintKey string, ttl time.Duration) {
+	lc.primary.SetNoTags(imageName, constraintKey, ttl)
+	lc.secondary.SetNoTags(imageName, constraintKey, ttl)
+}
+
+// HasNoTags returns true if either cache has a record that no tags matched a
+// constraint. Records are not written back to the primary cache, since the
+// remaining time to live is not known.
+func (lc *LayeredCache) HasNoTags(imageName string, constraintKey string) bool {
+	return lc.primary.HasNoTags(imageName, constraintKey) || lc.secondary.HasNoTags(imageName, constraintKey)
+}
+
+// SetTagCount records the number of tags of an image in both caches
+func (lc *LayeredCache) SetTagCount(imageName string, count int) {
+	lc.primary.SetTagCount(imageName, count)
+	lc.secondary.SetTagCount(imageName, count)
+}
+
+// GetTagCount returns the recorded number of tags of an image from the
+// primary cache, or from the secondary cache if the primary cache has none
+func (lc *LayeredCache) GetTagCount(imageName string) int {
+	if count := lc.primary.GetTagCount(imageName); count > 0 {
+		return count
+	}
+	return lc.secondary.GetTagCount(imageName)
+}
+
+// SetTagList records the list of tags of an image and its ETag in both
+// caches
+func (lc *LayeredCache) SetTagList(imageName string, etag string, tags []string) {
+	lc.primary.SetTagList(imageName, etag, tags)
+	lc.secondary.SetTagList(imageName, etag, tags)
+}
+
+// GetTagList returns the recorded ETag and list of tags of an image from the
+// primary cache, or from the secondary cache if the primary cache has none
+func (lc *LayeredCache) GetTagList(imageName string) (string, []string) {
+	if etag, tags := lc.primary.GetTagList(imageName); etag != "" {
+		return etag, tags
+	}
+	return lc.secondary.GetTagList(imageName)
+}
+
+// ClearCache clears both caches
+func (lc *LayeredCache) ClearCache() {
+	lc.primary.ClearCache()
+	lc.secondary.ClearCache()
+}
+
+// ClearCacheForRepo removes all entries of the image with the given name from
+// both caches
+func (lc *LayeredCache) ClearCacheForRepo(imageName string) {
+	lc.primary.ClearCacheForRepo(imageName)
+	lc.secondary.ClearCacheForRepo(imageName)
+}
+
+// ClearCacheForPrefix removes all entries of the images whose name starts
+// with the given prefix from both caches
+func (lc *LayeredCache) ClearCacheForPrefix(prefix string) {
+	lc.primary.ClearCacheForPrefix(prefix)
+	lc.secondary.ClearCacheForPrefix(prefix)
+}
+
+// NumEntries returns the number of entries in the cache holding more entries
+func (lc *LayeredCache) NumEntries() int {
+	primary, secondary := lc.primary.NumEntries(), lc.secondary.NumEntries()
+	if primary > secondary {
+		return primary
+	}
+	return secondary
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unreliableCache is a cache that fails all reads and drops all writes while
+// it is down
+type unreliableCache struct {
+	ImageTagCache
+	down bool
+}
+
+func (uc *unreliableCache) GetTag(imageName string, tagName string) (*tag.ImageTag, error) {
+	if uc.down {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return uc.ImageTagCache.GetTag(imageName, tagName)
+}
+
+func (uc *unreliableCache) SetTag(imageName string, imgTag *tag.ImageTag) {
+	if !uc.down {
+		uc.ImageTagCache.SetTag(imageName, imgTag)
+	}
+}
+
+func Test_LayeredCache(t *testing.T) {
+	imageName := "foo/bar"
+
+	t.Run("Writes go to both caches", func(t *testing.T) {
+		primary, secondary := NewMemCache(), NewMemCache()
+		lc := NewLayeredCache(primary, secondary)
+		lc.SetTag(imageName, tag.NewImageTag("v1.0.0", time.Unix(0, 0)))
+		lc.SetDigest(imageName, "v1.0.0", "sha256:abc")
+		assert.True(t, primary.HasTag(imageName, "v1.0.0"))
+		assert.True(t, secondary.HasTag(imageName, "v1.0.0"))
+		assert.Equal(t, "sha256:abc", primary.GetDigest(imageName, "v1.0.0"))
+		assert.Equal(t, "sha256:abc", secondary.GetDigest(imageName, "v1.0.0"))
+		assert.Equal(t, 2, lc.NumEntries())
+	})
+
+	t.Run("Clearing a repository clears both caches", func(t *testing.T) {
+		primary, secondary := NewMemCache(), NewMemCache()
+		lc := NewLayeredCache(primary, secondary)
+		lc.SetTag(imageName, tag.NewImageTag("v1.0.0", time.Unix(0, 0)))
+		lc.SetTag("other/bar", tag.NewImageTag("v1.0.0", time.Unix(0, 0)))
+		lc.ClearCacheForRepo(imageName)
+		assert.False(t, lc.HasTag(imageName, "v1.0.0"))
+		assert.False(t, secondary.HasTag(imageName, "v1.0.0"))
+		assert.True(t, lc.HasTag("other/bar", "v1.0.0"))
+		lc.ClearCacheForPrefix("other/")
+		assert.False(t, primary.HasTag("other/bar", "v1.0.0"))
+		assert.False(t, secondary.HasTag("other/bar", "v1.0.0"))
+	})
+
+	t.Run("Reads fall through to secondary when primary is down", func(t *testing.T) {
+		primary := &unreliableCache{ImageTagCache: NewMemCache()}
+		lc := NewLayeredCache(primary, NewMemCache())
+		lc.SetTag(imageName, tag.NewImageTag("v1.0.0", time.Unix(0, 0)))
+
+		primary.down = true
+		cachedTag, err := lc.GetTag(imageName, "v1.0.0")
+		require.NoError(t, err)
+		require.NotNil(t, cachedTag)
+		assert.Equal(t, "v1.0.0", cachedTag.TagName)
+
+		lc.SetTag(imageName, tag.NewImageTag("v1.1.0", time.Unix(1, 0)))
+		assert.True(t, lc.HasTag(imageName, "v1.1.0"))
+	})
+
+	t.Run("Recovered primary is populated again", func(t *testing.T) {
+		primary := &unreliableCache{ImageTagCache: NewMemCache(), down: true}
+		lc := NewLayeredCache(primary, NewMemCache())
+		lc.SetTag(imageName, tag.NewImageTag("v1.0.0", time.Unix(0, 0)))
+		assert.Equal(t, 0, primary.ImageTagCache.NumEntries())
+
+		primary.down = false
+		assert.True(t, lc.HasTag(imageName, "v1.0.0"))
+		assert.True(t, primary.HasTag(imageName, "v1.0.0"))
+
+		lc.SetTag(imageName, tag.NewImageTag("v1.1.0", time.Unix(1, 0)))
+		assert.True(t, primary.HasTag(imageName, "v1.1.0"))
+	})
+
+	t.Run("Cache miss in both caches", func(t *testing.T) {
+		lc := NewLayeredCache(NewMemCache(), NewMemCache())
+		cachedTag, err := lc.GetTag(imageName, "v1.0.0")
+		require.NoError(t, err)
+		assert.Nil(t, cachedTag)
+		assert.Equal(t, "", lc.GetDigest(imageName, "v1.0.0"))
+	})
+}
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
 
@@ -14,8 +15,15 @@ type MemCache struct {
 
 // NewMemCache returns a new instance of MemCache
 func NewMemCache() ImageTagCache {
+	return NewMemCacheWithExpiry(0)
+}
+
+// NewMemCacheWithExpiry returns a new instance of MemCache whose tag entries
+// expire after the given duration. A duration of 0 means that entries never
+// expire. Recorded digests never expire.
+func NewMemCacheWithExpiry(expiry time.Duration) ImageTagCache {
 	mc := MemCache{}
-	c := memcache.New(0, 0)
+	c := memcache.New(expiry, expiry)
 	mc.cache = c
 	return &mc
 }
@@ -32,7 +40,7 @@ func (mc *MemCache) HasTag(imageName string, tagName string) bool {
 
 // SetTag sets a tag entry into the cache
 func (mc *MemCache) SetTag(imageName string, imgTag *tag.ImageTag) {
-	mc.cache.Set(tagCacheKey(imageName, imgTag.TagName), *imgTag, -1)
+	mc.cache.Set(tagCacheKey(imageName, imgTag.TagName), *imgTag, memcache.DefaultExpiration)
 }
 
 // GetTag gets a tag entry from the cache
@@ -49,6 +57,74 @@ func (mc *MemCache) GetTag(imageName string, tagName string) (*tag.ImageTag, err
 	return &imgTag, nil
 }
 
+// SetDigest records the digest that has been observed for a tag
+func (mc *MemCache) SetDigest(imageName string, tagName string, digest string) {
+	mc.cache.Set(digestCacheKey(imageName, tagName), digest, memcache.NoExpiration)
+}
+
+// GetDigest returns the recorded digest for a tag, or the empty string if no
+// digest has been recorded
+func (mc *MemCache) GetDigest(imageName string, tagName string) string {
+	e, ok := mc.cache.Get(digestCacheKey(imageName, tagName))
+	if !ok {
+		return ""
+	}
+	digest, _ := e.(string)
+	return digest
+}
+
+// SetNoTags records that no tags matched a constraint for an image, until
+// ttl has passed
+func (mc *MemCache) SetNoTags(imageName string, constraintKey string, ttl time.Duration) {
+	mc.cache.Set(noTagsCacheKey(imageName, constraintKey), true, ttl)
+}
+
+// HasNoTags returns true if there is an unexpired record that no tags matched
+// a constraint for an image
+func (mc *MemCache) HasNoTags(imageName string, constraintKey string) bool {
+	_, ok := mc.cache.Get(noTagsCacheKey(imageName, constraintKey))
+	return ok
+}
+
+// SetTagCount records the number of tags the registry returned for an image
+func (mc *MemCache) SetTagCount(imageName string, count int) {
+	mc.cache.Set(tagCountCacheKey(imageName), count, memcache.NoExpiration)
+}
+
+// GetTagCount returns the recorded number of tags for an image, or 0 if none
+// has been recorded
+func (mc *MemCache) GetTagCount(imageName string) int {
+	e, ok := mc.cache.Get(tagCountCacheKey(imageName))
+	if !ok {
+		return 0
+	}
+	count, _ := e.(int)
+	return count
+}
+
+// tagListEntry is the list of tags of an image along with its ETag
+type tagListEntry struct {
+	etag string
+	tags []string
+}
+
+// SetTagList records the list of tags the registry returned for an image,
+// along with its ETag
+func (mc *MemCache) SetTagList(imageName string, etag string, tags []string) {
+	mc.cache.Set(tagListCacheKey(imageName), tagListEntry{etag: etag, tags: append([]string{}, tags...)}, memcache.NoExpiration)
+}
+
+// GetTagList returns the recorded ETag and list of tags for an image, or an
+// empty ETag if none has been recorded
+func (mc *MemCache) GetTagList(imageName string) (string, []string) {
+	e, ok := mc.cache.Get(tagListCacheKey(imageName))
+	if !ok {
+		return "", nil
+	}
+	entry, _ := e.(tagListEntry)
+	return entry.etag, append([]string{}, entry.tags...)
+}
+
 func (mc *MemCache) SetImage(imageName, application string) {
 	mc.cache.Set(imageCacheKey(imageName), application, -1)
 }
@@ -60,6 +136,26 @@ func (mc *MemCache) ClearCache() {
 	}
 }
 
+// ClearCacheForRepo removes all entries of the image with the given name
+func (mc *MemCache) ClearCacheForRepo(imageName string) {
+	mc.clearMatching(repoMatcher(imageName))
+}
+
+// ClearCacheForPrefix removes all entries of the images whose name starts
+// with the given prefix
+func (mc *MemCache) ClearCacheForPrefix(prefix string) {
+	mc.clearMatching(prefixMatcher(prefix))
+}
+
+// clearMatching removes all entries whose key matches
+func (mc *MemCache) clearMatching(matches func(key string) bool) {
+	for k := range mc.cache.Items() {
+		if matches(k) {
+			mc.cache.Delete(k)
+		}
+	}
+}
+
 // NumEntries returns the number of entries in the cache
 func (mc *MemCache) NumEntries() int {
 	return mc.cache.ItemCount()
@@ -69,6 +165,22 @@ func tagCacheKey(imageName, imageTag string) string {
 	return fmt.Sprintf("tags:%s:%s", imageName, imageTag)
 }
 
+func digestCacheKey(imageName, imageTag string) string {
+	return fmt.Sprintf("digests:%s:%s", imageName, imageTag)
+}
+
+func noTagsCacheKey(imageName, constraintKey string) string {
+	return fmt.Sprintf("notags:%s:%s", imageName, constraintKey)
+}
+
+func tagCountCacheKey(imageName string) string {
+	return fmt.Sprintf("tagcount:%s", imageName)
+}
+
+func tagListCacheKey(imageName string) string {
+	return fmt.Sprintf("taglist:%s", imageName)
+}
+
 func imageCacheKey(imageName string) string {
 	return fmt.Sprintf("image:%s", imageName)
 }
@@ -48,4 +48,79 @@ func Test_MemCache(t *testing.T) {
 		require.NoError(t, err)
 		require.Nil(t, cachedTag)
 	})
+
+	t.Run("Cache clear for repository", func(t *testing.T) {
+		mc := NewMemCache()
+		for _, name := range []string{imageName, "foo/barbaz", "other/bar"} {
+			mc.SetTag(name, tag.NewImageTag(imageTag, time.Unix(0, 0)))
+			mc.SetDigest(name, imageTag, "sha256:abc")
+			mc.SetTagList(name, "etag", []string{imageTag})
+		}
+		mc.ClearCacheForRepo(imageName)
+		assert.False(t, mc.HasTag(imageName, imageTag))
+		assert.Equal(t, "", mc.GetDigest(imageName, imageTag))
+		etag, _ := mc.GetTagList(imageName)
+		assert.Equal(t, "", etag)
+		assert.True(t, mc.HasTag("foo/barbaz", imageTag))
+		assert.True(t, mc.HasTag("other/bar", imageTag))
+		assert.Equal(t, 6, mc.NumEntries())
+	})
+
+	t.Run("Cache clear for prefix", func(t *testing.T) {
+		mc := NewMemCache()
+		for _, name := range []string{imageName, "foo/barbaz", "other/bar"} {
+			mc.SetTag(name, tag.NewImageTag(imageTag, time.Unix(0, 0)))
+			mc.SetDigest(name, imageTag, "sha256:abc")
+		}
+		mc.ClearCacheForPrefix("foo/")
+		assert.False(t, mc.HasTag(imageName, imageTag))
+		assert.False(t, mc.HasTag("foo/barbaz", imageTag))
+		assert.True(t, mc.HasTag("other/bar", imageTag))
+		assert.Equal(t, "sha256:abc", mc.GetDigest("other/bar", imageTag))
+		assert.Equal(t, 2, mc.NumEntries())
+	})
+
+	t.Run("Cache expiry", func(t *testing.T) {
+		mc := NewMemCacheWithExpiry(50 * time.Millisecond)
+		mc.SetTag(imageName, tag.NewImageTag(imageTag, time.Unix(0, 0)))
+		mc.SetDigest(imageName, imageTag, "sha256:abc")
+		assert.True(t, mc.HasTag(imageName, imageTag))
+		time.Sleep(100 * time.Millisecond)
+		assert.False(t, mc.HasTag(imageName, imageTag))
+		assert.Equal(t, "sha256:abc", mc.GetDigest(imageName, imageTag))
+	})
+}
+
+func Test_MemCacheDigest(t *testing.T) {
+	mc := NewMemCache()
+	assert.Equal(t, "", mc.GetDigest("foo/bar", "v1.0.0"))
+	mc.SetDigest("foo/bar", "v1.0.0", "sha256:abc")
+	assert.Equal(t, "sha256:abc", mc.GetDigest("foo/bar", "v1.0.0"))
+	assert.Equal(t, "", mc.GetDigest("foo/baz", "v1.0.0"))
+}
+
+func Test_MemCacheNoTags(t *testing.T) {
+	mc := NewMemCache()
+	assert.False(t, mc.HasNoTags("foo/bar", "semver"))
+	mc.SetNoTags("foo/bar", "semver", 50*time.Millisecond)
+	assert.True(t, mc.HasNoTags("foo/bar", "semver"))
+	assert.False(t, mc.HasNoTags("foo/bar", "latest"))
+	assert.False(t, mc.HasTag("foo/bar", "semver"))
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, mc.HasNoTags("foo/bar", "semver"))
+}
+
+func Test_MemCacheTagList(t *testing.T) {
+	mc := NewMemCache()
+	etag, tags := mc.GetTagList("foo/bar")
+	assert.Equal(t, "", etag)
+	assert.Empty(t, tags)
+	mc.SetTagList("foo/bar", `"abc"`, []string{"v1", "v2"})
+	etag, tags = mc.GetTagList("foo/bar")
+	assert.Equal(t, `"abc"`, etag)
+	assert.Equal(t, []string{"v1", "v2"}, tags)
+	// The returned list is a copy
+	tags[0] = "v3"
+	_, tags = mc.GetTagList("foo/bar")
+	assert.Equal(t, []string{"v1", "v2"}, tags)
 }
@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+// NoCache is an ImageTagCache that records nothing, so that every lookup is a
+// miss. It is used where the cache must be bypassed, without having to check
+// whether there is one.
+type NoCache struct{}
+
+// NewNoCache returns a new instance of NoCache
+func NewNoCache() ImageTagCache {
+	return &NoCache{}
+}
+
+// HasTag always returns false
+func (nc *NoCache) HasTag(imageName string, imageTag string) bool {
+	return false
+}
+
+// GetTag always returns nil
+func (nc *NoCache) GetTag(imageName string, imageTag string) (*tag.ImageTag, error) {
+	return nil, nil
+}
+
+// SetTag does nothing
+func (nc *NoCache) SetTag(imageName string, imgTag *tag.ImageTag) {}
+
+// GetDigest always returns the empty string
+func (nc *NoCache) GetDigest(imageName string, imageTag string) string {
+	return ""
+}
+
+// SetDigest does nothing
+func (nc *NoCache) SetDigest(imageName string, imageTag string, digest string) {}
+
+// SetNoTags does nothing
+func (nc *NoCache) SetNoTags(imageName string, constraintKey string, ttl time.Duration) {}
+
+// HasNoTags always returns false
+func (nc *NoCache) HasNoTags(imageName string, constraintKey string) bool {
+	return false
+}
+
+// SetTagCount does nothing
+func (nc *NoCache) SetTagCount(imageName string, count int) {}
+
+// GetTagCount always returns 0
+func (nc *NoCache) GetTagCount(imageName string) int {
+	return 0
+}
+
+// SetTagList does nothing
+func (nc *NoCache) SetTagList(imageName string, etag string, tags []string) {}
+
+// GetTagList always returns an empty ETag
+func (nc *NoCache) GetTagList(imageName string) (string, []string) {
+	return "", nil
+}
+
+// ClearCache does nothing
+func (nc *NoCache) ClearCache() {}
+
+// ClearCacheForRepo does nothing
+func (nc *NoCache) ClearCacheForRepo(imageName string) {}
+
+// ClearCacheForPrefix does nothing
+func (nc *NoCache) ClearCacheForPrefix(prefix string) {}
+
+// NumEntries always returns 0
+func (nc *NoCache) NumEntries() int {
+	return 0
+}
@@ -0,0 +1,32 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NoCache(t *testing.T) {
+	nc := NewNoCache()
+	nc.SetTag("foo/bar", tag.NewImageTag("1.0", time.Unix(0, 0)))
+	nc.SetDigest("foo/bar", "1.0", "sha256:abc")
+	nc.SetNoTags("foo/bar", "key", time.Hour)
+	nc.SetTagCount("foo/bar", 10)
+	nc.SetTagList("foo/bar", "etag", []string{"1.0"})
+
+	imgTag, err := nc.GetTag("foo/bar", "1.0")
+	require.NoError(t, err)
+	assert.Nil(t, imgTag)
+	assert.False(t, nc.HasTag("foo/bar", "1.0"))
+	assert.Equal(t, "", nc.GetDigest("foo/bar", "1.0"))
+	assert.False(t, nc.HasNoTags("foo/bar", "key"))
+	assert.Equal(t, 0, nc.GetTagCount("foo/bar"))
+	etag, tags := nc.GetTagList("foo/bar")
+	assert.Equal(t, "", etag)
+	assert.Nil(t, tags)
+	assert.Equal(t, 0, nc.NumEntries())
+}
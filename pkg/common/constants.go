@@ -8,6 +8,10 @@ const ImageUpdaterAnnotationPrefix = "argocd-image-updater.argoproj.io"
 // allowed for updates.
 const ImageUpdaterAnnotation = ImageUpdaterAnnotationPrefix + "/image-list"
 
+// The annotation on the application resources the result of checking its
+// images for updates is written to, as a JSON list
+const ImageStatusAnnotation = ImageUpdaterAnnotationPrefix + "/image-status"
+
 // Defaults for Helm parameter names
 const (
 	DefaultHelmImageName = "image.name"
@@ -16,14 +20,16 @@ const (
 
 // Helm related annotations
 const (
-	HelmParamImageNameAnnotation = ImageUpdaterAnnotationPrefix + "/%s.helm.image-name"
-	HelmParamImageTagAnnotation  = ImageUpdaterAnnotationPrefix + "/%s.helm.image-tag"
-	HelmParamImageSpecAnnotation = ImageUpdaterAnnotationPrefix + "/%s.helm.image-spec"
+	HelmParamImageNameAnnotation     = ImageUpdaterAnnotationPrefix + "/%s.helm.image-name"
+	HelmParamImageTagAnnotation      = ImageUpdaterAnnotationPrefix + "/%s.helm.image-tag"
+	HelmParamImageSpecAnnotation     = ImageUpdaterAnnotationPrefix + "/%s.helm.image-spec"
+	HelmParamImagePlatformAnnotation = ImageUpdaterAnnotationPrefix + "/%s.helm.image-platform"
 )
 
 // Kustomize related annotations
 const (
 	KustomizeApplicationNameAnnotation = ImageUpdaterAnnotationPrefix + "/%s.kustomize.image-name"
+	KustomizeImagePlatformAnnotation   = ImageUpdaterAnnotationPrefix + "/%s.kustomize.image-platform"
 )
 
 // Upgrade strategy related annotations
@@ -32,6 +38,33 @@ const (
 	AllowTagsOptionAnnotation  = ImageUpdaterAnnotationPrefix + "/%s.allow-tags"
 	IgnoreTagsOptionAnnotation = ImageUpdaterAnnotationPrefix + "/%s.ignore-tags"
 	UpdateStrategyAnnotation   = ImageUpdaterAnnotationPrefix + "/%s.update-strategy"
+	MinDownloadsAnnotation     = ImageUpdaterAnnotationPrefix + "/%s.min-downloads"
+	MissingDownloadsAnnotation = ImageUpdaterAnnotationPrefix + "/%s.missing-downloads"
+	VariantSuffixAnnotation    = ImageUpdaterAnnotationPrefix + "/%s.variant-suffix"
+	IncludePlatformAnnotation  = ImageUpdaterAnnotationPrefix + "/%s.include-platform"
+	TagStripPrefixAnnotation   = ImageUpdaterAnnotationPrefix + "/%s.tag-strip-prefix"
+	TagCaseFoldAnnotation      = ImageUpdaterAnnotationPrefix + "/%s.tag-case-fold"
+	TagExtractAnnotation       = ImageUpdaterAnnotationPrefix + "/%s.tag-extract"
+	MaxJumpAnnotation          = ImageUpdaterAnnotationPrefix + "/%s.max-jump"
+	LockTrackAnnotation        = ImageUpdaterAnnotationPrefix + "/%s.lock-track"
+	IgnorePrereleaseAnnotation = ImageUpdaterAnnotationPrefix + "/%s.ignore-prerelease"
+	AllowPrereleaseAnnotation  = ImageUpdaterAnnotationPrefix + "/%s.allow-prerelease-for"
+	TagDatePatternAnnotation   = ImageUpdaterAnnotationPrefix + "/%s.tag-date-pattern"
+	TagDateLayoutAnnotation    = ImageUpdaterAnnotationPrefix + "/%s.tag-date-layout"
+	RequirePlatformsAnnotation = ImageUpdaterAnnotationPrefix + "/%s.require-platforms"
+	RequireLabelsAnnotation    = ImageUpdaterAnnotationPrefix + "/%s.require-labels"
+	MinTagsAnnotation          = ImageUpdaterAnnotationPrefix + "/%s.min-tags"
+	MaxTagsAnnotation          = ImageUpdaterAnnotationPrefix + "/%s.max-tags"
+	SortCommandAnnotation      = ImageUpdaterAnnotationPrefix + "/%s.sort-command"
+	SkipSameDigestAnnotation   = ImageUpdaterAnnotationPrefix + "/%s.skip-same-digest"
+	PinDigestAnnotation        = ImageUpdaterAnnotationPrefix + "/%s.pin-digest"
+	MaxAgeAnnotation           = ImageUpdaterAnnotationPrefix + "/%s.max-age"
+	MissingAgeAnnotation       = ImageUpdaterAnnotationPrefix + "/%s.missing-age"
+	BuildMetadataAnnotation    = ImageUpdaterAnnotationPrefix + "/%s.compare-build-metadata"
+	SignatureKeyAnnotation     = ImageUpdaterAnnotationPrefix + "/%s.signature-key"
+	SignerIdentityAnnotation   = ImageUpdaterAnnotationPrefix + "/%s.signature-identity"
+	SignerIssuerAnnotation     = ImageUpdaterAnnotationPrefix + "/%s.signature-issuer"
+	UpdateWindowAnnotation     = ImageUpdaterAnnotationPrefix + "/%s.update-window"
 )
 
 // Image pull secret related annotations
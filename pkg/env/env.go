@@ -3,6 +3,7 @@ package env
 import (
 	"os"
 	"strings"
+	"time"
 )
 
 // Package env provides some utility functions to interact with the environment
@@ -30,3 +31,14 @@ func GetStringVal(envVar string, defaultValue string) string {
 		return defaultValue
 	}
 }
+
+// GetDurationVal retrieves a duration value from given environment envVar.
+// Returns default value if envVar is not set or is not a valid duration.
+func GetDurationVal(envVar string, defaultValue time.Duration) time.Duration {
+	if val := os.Getenv(envVar); val != "" {
+		if d, err := time.ParseDuration(val); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
@@ -3,6 +3,7 @@ package env
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -36,3 +37,20 @@ func Test_GetStringVal(t *testing.T) {
 		assert.Equal(t, "invalid", GetStringVal("TEST_STRING_VAL", "invalid"))
 	})
 }
+
+func Test_GetDurationVal(t *testing.T) {
+	t.Run("Get duration value from existing env var", func(t *testing.T) {
+		_ = os.Setenv("TEST_DURATION_VAL", "90s")
+		defer os.Setenv("TEST_DURATION_VAL", "")
+		assert.Equal(t, 90*time.Second, GetDurationVal("TEST_DURATION_VAL", time.Second))
+	})
+	t.Run("Get default value from invalid env var", func(t *testing.T) {
+		_ = os.Setenv("TEST_DURATION_VAL", "soon")
+		defer os.Setenv("TEST_DURATION_VAL", "")
+		assert.Equal(t, time.Second, GetDurationVal("TEST_DURATION_VAL", time.Second))
+	})
+	t.Run("Get default value from non-existing env var", func(t *testing.T) {
+		_ = os.Setenv("TEST_DURATION_VAL", "")
+		assert.Equal(t, time.Second, GetDurationVal("TEST_DURATION_VAL", time.Second))
+	})
+}
@@ -0,0 +1,282 @@
+package image
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// The user name to use along with an ACR refresh token for authenticating to
+// Azure Container Registry
+const acrTokenUsername = "00000000-0000-0000-0000-000000000000"
+
+// The resource AAD access tokens are requested for, which ACR accepts for
+// exchange
+const azureTokenResource = "https://management.azure.com/"
+
+// Ways to get an AAD access token
+const (
+	azureAuthManaged = "managed"
+	azureAuthEnv     = "env"
+	azureAuthFile    = "file"
+)
+
+// URL of the instance metadata service's endpoint returning an access token
+// for the managed identity of the VM or pod, and the host of the AAD
+// authority. These are variables so that they can be pointed to a test
+// server.
+var (
+	azureIMDSTokenURL        = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureDefaultAuthorityURL = "https://login.microsoftonline.com"
+)
+
+// HTTP clients used to talk to the metadata service, and to AAD and ACR. The
+// metadata service is expected to respond quickly, if it is available.
+var (
+	azureIMDSClient = &http.Client{Timeout: 5 * time.Second}
+	azureHTTPClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// azureServicePrincipal holds the credentials of a service principal, in the
+// format written by 'az ad sp create-for-rbac'
+type azureServicePrincipal struct {
+	ClientID     string `json:"appId"`
+	ClientSecret string `json:"password"`
+	TenantID     string `json:"tenant"`
+}
+
+// azureSeconds is a number of seconds that is given either as JSON number or
+// as string, since the metadata service returns numbers as strings
+type azureSeconds int64
+
+// UnmarshalJSON parses a number of seconds given as number or as string
+func (s *azureSeconds) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number of seconds: %s", data)
+	}
+	*s = azureSeconds(v)
+	return nil
+}
+
+// azureTokenResponse is the response of both, the metadata service and the
+// AAD token endpoint
+type azureTokenResponse struct {
+	AccessToken string       `json:"access_token"`
+	ExpiresIn   azureSeconds `json:"expires_in"`
+}
+
+// Parse an ACR definition, which is either 'managed' for using the managed
+// identity of the VM or pod, optionally followed by the client ID of a user
+// assigned identity, i.e. 'managed/<client_id>', 'env' for using a service
+// principal given in the environment, or the absolute path to a file holding
+// the credentials of a service principal.
+func (src *CredentialSource) parseACRDefinition(definition string) error {
+	switch {
+	case definition == azureAuthManaged:
+		src.AzureAuth = azureAuthManaged
+	case strings.HasPrefix(definition, azureAuthManaged+"/"):
+		src.AzureAuth = azureAuthManaged
+		src.AzureClientID = strings.TrimPrefix(definition, azureAuthManaged+"/")
+		if src.AzureClientID == "" {
+			return fmt.Errorf("invalid ACR definition, client ID of managed identity missing: %s", definition)
+		}
+	case definition == azureAuthEnv:
+		src.AzureAuth = azureAuthEnv
+	case strings.HasPrefix(definition, "/"):
+		src.AzureAuth = azureAuthFile
+		src.KeyPath = definition
+	default:
+		return fmt.Errorf("invalid ACR definition, must be 'managed', 'managed/<client_id>', 'env' or absolute path to service principal: %s", definition)
+	}
+	return nil
+}
+
+// fetchACRCredentials gets a refresh token for authenticating to the Azure
+// Container Registry at registryURL, by exchanging an AAD access token at the
+// registry. The access token is requested for the managed identity, or for
+// the service principal from the environment or the key file. The returned
+// credentials expire along with the refresh token.
+func fetchACRCredentials(src *CredentialSource, registryURL string) (*Credential, error) {
+	var token *azureTokenResponse
+	var err error
+	switch src.AzureAuth {
+	case azureAuthManaged:
+		token, err = fetchAzureManagedIdentityToken(src.AzureClientID)
+	case azureAuthEnv:
+		token, err = fetchAzureServicePrincipalToken(&azureServicePrincipal{
+			TenantID:     os.Getenv("AZURE_TENANT_ID"),
+			ClientID:     os.Getenv("AZURE_CLIENT_ID"),
+			ClientSecret: os.Getenv("AZURE_CLIENT_SECRET"),
+		})
+	case azureAuthFile:
+		var sp *azureServicePrincipal
+		if sp, err = readAzureServicePrincipal(src.KeyPath); err == nil {
+			token, err = fetchAzureServicePrincipalToken(sp)
+		}
+	default:
+		err = fmt.Errorf("unknown authentication method %s", src.AzureAuth)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get AAD access token: %v", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("could not get AAD access token: no token returned")
+	}
+
+	refreshToken, err := exchangeACRRefreshToken(registryURL, token.AccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("could not get ACR refresh token: %v", err)
+	}
+
+	creds := &Credential{Username: acrTokenUsername, Password: refreshToken}
+	if exp, ok := jwtExpiry(refreshToken); ok {
+		creds.ExpiresAt = exp
+	} else if token.ExpiresIn > 0 {
+		creds.ExpiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return creds, nil
+}
+
+// fetchAzureManagedIdentityToken requests an access token for the managed
+// identity from the instance metadata service. If clientID is given, the
+// token is requested for that user assigned identity.
+func fetchAzureManagedIdentityToken(clientID string) (*azureTokenResponse, error) {
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", azureTokenResource)
+	if clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	req, err := http.NewRequest(http.MethodGet, azureIMDSTokenURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := azureIMDSClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("metadata service not available: %v", err)
+	}
+	var token azureTokenResponse
+	if err := parseAzureResponse(resp, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// readAzureServicePrincipal reads the credentials of a service principal
+// from the given file
+func readAzureServicePrincipal(path string) (*azureServicePrincipal, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read service principal: %v", err)
+	}
+	var sp azureServicePrincipal
+	if err := json.Unmarshal(data, &sp); err != nil {
+		return nil, fmt.Errorf("could not parse service principal %s: %v", path, err)
+	}
+	return &sp, nil
+}
+
+// fetchAzureServicePrincipalToken requests an access token for the service
+// principal from AAD using the client credentials flow
+func fetchAzureServicePrincipalToken(sp *azureServicePrincipal) (*azureTokenResponse, error) {
+	if sp.TenantID == "" || sp.ClientID == "" || sp.ClientSecret == "" {
+		return nil, fmt.Errorf("tenant, client ID and client secret of service principal are required")
+	}
+	authority := strings.TrimSuffix(os.Getenv("AZURE_AUTHORITY_HOST"), "/")
+	if authority == "" {
+		authority = azureDefaultAuthorityURL
+	}
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", sp.ClientID)
+	form.Set("client_secret", sp.ClientSecret)
+	form.Set("scope", azureTokenResource+".default")
+	resp, err := azureHTTPClient.PostForm(fmt.Sprintf("%s/%s/oauth2/v2.0/token", authority, url.PathEscape(sp.TenantID)), form)
+	if err != nil {
+		return nil, err
+	}
+	var token azureTokenResponse
+	if err := parseAzureResponse(resp, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// exchangeACRRefreshToken exchanges an AAD access token for a refresh token
+// of the registry at registryURL
+func exchangeACRRefreshToken(registryURL string, accessToken string) (string, error) {
+	if !strings.Contains(registryURL, "://") {
+		registryURL = "https://" + registryURL
+	}
+	u, err := url.Parse(registryURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid registry URL %s", registryURL)
+	}
+	form := url.Values{}
+	form.Set("grant_type", "access_token")
+	form.Set("service", u.Host)
+	form.Set("access_token", accessToken)
+	log.Debugf("exchanging AAD access token for refresh token of %s", u.Host)
+	resp, err := azureHTTPClient.PostForm(fmt.Sprintf("%s://%s/oauth2/exchange", u.Scheme, u.Host), form)
+	if err != nil {
+		return "", err
+	}
+	var exchange struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := parseAzureResponse(resp, &exchange); err != nil {
+		return "", err
+	}
+	if exchange.RefreshToken == "" {
+		return "", fmt.Errorf("no refresh token returned by %s", u.Host)
+	}
+	return exchange.RefreshToken, nil
+}
+
+// parseAzureResponse parses the JSON response of a token request into v and
+// closes its body
+func parseAzureResponse(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token request to %s failed: %s: %s", resp.Request.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("invalid token response from %s: %v", resp.Request.URL.Host, err)
+	}
+	return nil
+}
+
+// jwtExpiry returns the expiry of the given JWT, without verifying it. A
+// missing or non-positive expiry is not considered known.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
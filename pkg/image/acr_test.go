@@ -0,0 +1,184 @@
+package image
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// refreshToken returns an unsigned JWT expiring at exp, standing in for an
+// ACR refresh token
+func refreshToken(subject string, exp time.Time) string {
+	claims := fmt.Sprintf(`{"sub":%q,"exp":%d}`, subject, exp.Unix())
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".sig"
+}
+
+// newACRServer returns a test server for the instance metadata service, the
+// AAD token endpoint and the ACR token exchange, and points the metadata and
+// authority URLs to it. The refresh tokens returned by the exchange carry the
+// access token they have been issued for as subject.
+func newACRServer(t *testing.T, exp time.Time) (*httptest.Server, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		switch r.URL.Path {
+		case "/metadata":
+			if r.Header.Get("Metadata") != "true" || r.Form.Get("resource") != azureTokenResource {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if id := r.Form.Get("client_id"); id != "" {
+				fmt.Fprintf(w, `{"access_token":"identity-%s","expires_in":"86399","token_type":"Bearer"}`, id)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"identity-system","expires_in":"86399","token_type":"Bearer"}`)
+		case "/tenant/oauth2/v2.0/token":
+			if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_secret") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprint(w, `{"error":"invalid_client"}`)
+				return
+			}
+			fmt.Fprintf(w, `{"access_token":"sp-%s","expires_in":3599,"token_type":"Bearer"}`, r.Form.Get("client_id"))
+		case "/oauth2/exchange":
+			if r.Form.Get("grant_type") != "access_token" || r.Form.Get("service") != r.Host {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprintf(w, `{"refresh_token":%q}`, refreshToken(r.Form.Get("access_token"), exp))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	oldIMDS, oldAuthority := azureIMDSTokenURL, azureDefaultAuthorityURL
+	azureIMDSTokenURL = srv.URL + "/metadata"
+	azureDefaultAuthorityURL = srv.URL
+	return srv, func() {
+		azureIMDSTokenURL, azureDefaultAuthorityURL = oldIMDS, oldAuthority
+		srv.Close()
+	}
+}
+
+func Test_ParseACRCredentialSource(t *testing.T) {
+	t.Run("Parse ACR definition using managed identity", func(t *testing.T) {
+		src, err := ParseCredentialSource("myregistry.azurecr.io=acr:managed", true)
+		require.NoError(t, err)
+		assert.Equal(t, CredentialSourceACR, src.Type)
+		assert.Equal(t, "managed", src.AzureAuth)
+		assert.Equal(t, "", src.AzureClientID)
+	})
+	t.Run("Parse ACR definition using user assigned identity", func(t *testing.T) {
+		src, err := ParseCredentialSource("acr:managed/1234-5678", false)
+		require.NoError(t, err)
+		assert.Equal(t, CredentialSourceACR, src.Type)
+		assert.Equal(t, "managed", src.AzureAuth)
+		assert.Equal(t, "1234-5678", src.AzureClientID)
+	})
+	t.Run("Parse ACR definition using service principal from environment", func(t *testing.T) {
+		src, err := ParseCredentialSource("acr:env", false)
+		require.NoError(t, err)
+		assert.Equal(t, "env", src.AzureAuth)
+	})
+	t.Run("Parse ACR definition using service principal from file", func(t *testing.T) {
+		src, err := ParseCredentialSource("acr:/etc/azure/sp.json", false)
+		require.NoError(t, err)
+		assert.Equal(t, "file", src.AzureAuth)
+		assert.Equal(t, "/etc/azure/sp.json", src.KeyPath)
+	})
+	t.Run("Parse invalid ACR definitions", func(t *testing.T) {
+		for _, def := range []string{"acr:sp.json", "acr:managed/", "acr:"} {
+			src, err := ParseCredentialSource(def, false)
+			assert.Error(t, err, def)
+			assert.Nil(t, src, def)
+		}
+	})
+}
+
+func Test_FetchCredentialsFromACR(t *testing.T) {
+	exp := time.Now().Add(3 * time.Hour).Truncate(time.Second)
+	srv, done := newACRServer(t, exp)
+	defer done()
+
+	t.Run("Fetch refresh token for managed identity", func(t *testing.T) {
+		src := &CredentialSource{Type: CredentialSourceACR, AzureAuth: "managed"}
+		creds, err := src.FetchCredentials(srv.URL, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "00000000-0000-0000-0000-000000000000", creds.Username)
+		assert.Equal(t, refreshToken("identity-system", exp), creds.Password)
+		assert.Equal(t, exp, creds.ExpiresAt)
+	})
+
+	t.Run("Fetch refresh token for user assigned identity", func(t *testing.T) {
+		src := &CredentialSource{Type: CredentialSourceACR, AzureAuth: "managed", AzureClientID: "1234"}
+		creds, err := src.FetchCredentials(srv.URL, nil)
+		require.NoError(t, err)
+		assert.Equal(t, refreshToken("identity-1234", exp), creds.Password)
+	})
+
+	t.Run("Fetch refresh token for service principal from environment", func(t *testing.T) {
+		for k, v := range map[string]string{"AZURE_TENANT_ID": "tenant", "AZURE_CLIENT_ID": "updater", "AZURE_CLIENT_SECRET": "secret"} {
+			old := os.Getenv(k)
+			os.Setenv(k, v)
+			defer os.Setenv(k, old)
+		}
+		src := &CredentialSource{Type: CredentialSourceACR, AzureAuth: "env"}
+		creds, err := src.FetchCredentials(srv.URL, nil)
+		require.NoError(t, err)
+		assert.Equal(t, refreshToken("sp-updater", exp), creds.Password)
+		assert.Equal(t, exp, creds.ExpiresAt)
+	})
+
+	t.Run("Fetch refresh token for service principal from file", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir("", "acr")
+		require.NoError(t, err)
+		defer os.RemoveAll(tempDir)
+		spFile := filepath.Join(tempDir, "sp.json")
+		require.NoError(t, ioutil.WriteFile(spFile, []byte(`{"appId":"from-file","password":"secret","tenant":"tenant"}`), 0600))
+		src := &CredentialSource{Type: CredentialSourceACR, AzureAuth: "file", KeyPath: spFile}
+		creds, err := src.FetchCredentials(srv.URL, nil)
+		require.NoError(t, err)
+		assert.Equal(t, refreshToken("sp-from-file", exp), creds.Password)
+
+		require.NoError(t, ioutil.WriteFile(spFile, []byte(`{"appId":"from-file","password":"wrong","tenant":"tenant"}`), 0600))
+		creds, err = src.FetchCredentials(srv.URL, nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "401 Unauthorized")
+		assert.Nil(t, creds)
+	})
+
+	t.Run("No metadata service", func(t *testing.T) {
+		azureIMDSTokenURL = srv.URL + "/notfound"
+		defer func() { azureIMDSTokenURL = srv.URL + "/metadata" }()
+		creds, err := fetchACRCredentials(&CredentialSource{AzureAuth: "managed"}, srv.URL)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not get AAD access token")
+		assert.Nil(t, creds)
+	})
+
+	t.Run("Invalid registry URL", func(t *testing.T) {
+		creds, err := fetchACRCredentials(&CredentialSource{AzureAuth: "managed"}, "")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not get ACR refresh token")
+		assert.Nil(t, creds)
+	})
+}
+
+func Test_JWTExpiry(t *testing.T) {
+	exp := time.Unix(1700000000, 0)
+	e, ok := jwtExpiry(refreshToken("x", exp))
+	assert.True(t, ok)
+	assert.Equal(t, exp, e)
+	_, ok = jwtExpiry("not-a-jwt")
+	assert.False(t, ok)
+	_, ok = jwtExpiry(refreshToken("x", time.Unix(0, 0)))
+	assert.False(t, ok)
+	_, ok = jwtExpiry(refreshToken("x", time.Unix(-1, 0)))
+	assert.False(t, ok)
+}
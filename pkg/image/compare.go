@@ -0,0 +1,278 @@
+package image
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+// Ranks of tags that are compared, in ascending order. Tags the sort mode
+// cannot order, i.e. tags that are not valid versions when sorting by semver,
+// are never selected for update and rank below all others.
+const (
+	tagRankUnordered = iota
+	tagRankAllowed
+	tagRankOrdered
+)
+
+// CompareTags compares the tags a and b the same way tags are ordered when
+// selecting a version for update using the sort mode of vc. It returns -1 if
+// a is older than b, 1 if a is newer than b, and 0 if both are the same tag.
+// The result is deterministic: tags the sort mode considers equal, i.e. the
+// versions 1.0 and 1.0.0, are ordered by their names.
+//
+// Tags are compared by their normalized keys, if vc normalizes tags. Filters
+// of vc, i.e. the semver constraint or ignored tags, are not applied. Tags
+// that cannot be ordered by the sort mode, i.e. tags that are not valid
+// versions when sorting by semver, rank below all tags that can.
+//
+// For sort modes that need the tags' meta data, use CompareTagsWithInfo.
+func CompareTags(a, b string, vc *VersionConstraint) int {
+	return CompareTagsWithInfo(a, b, nil, nil, vc)
+}
+
+// CompareTagsWithInfo compares the tags a and b like CompareTags, using the
+// given meta data of the tags, if known. The meta data is required when
+// sorting by VersionSortLatest, where tags are ordered by their creation
+// date. Tags without meta data are considered to be created at the zero time.
+func CompareTagsWithInfo(a, b string, infoA, infoB *tag.TagInfo, vc *VersionConstraint) int {
+	if a == b {
+		return 0
+	}
+	if vc == nil {
+		vc = &VersionConstraint{SortMode: VersionSortSemVer}
+	}
+
+	keyA, keyB := compareKey(a, vc), compareKey(b, vc)
+	var rankA, rankB, result int
+	switch vc.SortMode {
+	case VersionSortSemVer:
+		var verA, verB *semver.Version
+		verA, rankA = semverRank(a, keyA, vc)
+		verB, rankB = semverRank(b, keyB, vc)
+		if rankA == tagRankOrdered && rankB == tagRankOrdered {
+			result = verA.Compare(verB)
+			if result == 0 && vc.CompareBuildMetadata {
+				result = compareBuildMetadata(verA.Metadata(), verB.Metadata())
+			}
+		}
+	case VersionSortLatest:
+		rankA, rankB = rankIfKey(keyA), rankIfKey(keyB)
+		result = compareTimes(createdAt(infoA), createdAt(infoB))
+	case VersionSortDate:
+		var dateA, dateB time.Time
+		dateA, rankA = dateRank(a, keyA, vc)
+		dateB, rankB = dateRank(b, keyB, vc)
+		result = compareTimes(dateA, dateB)
+	case VersionSortExternal:
+		rankA, rankB, result = externalRanks(keyA, keyB, vc)
+	default:
+		rankA, rankB = rankIfKey(keyA), rankIfKey(keyB)
+	}
+
+	if rankA != rankB {
+		return compareInts(rankA, rankB)
+	}
+	if result == 0 {
+		result = strings.Compare(keyA, keyB)
+	}
+	if result == 0 {
+		result = strings.Compare(a, b)
+	}
+	return result
+}
+
+// compareKey returns the normalized key of the tag, or the empty string if
+// the tag does not match the normalization. Explicitly allowed tags are
+// never normalized.
+func compareKey(tagName string, vc *VersionConstraint) string {
+	if vc.IsTagAllowed(tagName) {
+		return tagName
+	}
+	key, _ := NormalizeTag(tagName, vc)
+	return key
+}
+
+// rankIfKey returns the rank of a tag that can be ordered if it has a key
+func rankIfKey(key string) int {
+	if key == "" {
+		return tagRankUnordered
+	}
+	return tagRankOrdered
+}
+
+// semverRank returns the version of the tag with the given key and its rank
+// when sorting by semver. Explicitly allowed tags that are not versions rank
+// below all versions.
+func semverRank(tagName, key string, vc *VersionConstraint) (*semver.Version, int) {
+	if key == "" {
+		return nil, tagRankUnordered
+	}
+	ver, err := semver.NewVersion(strings.TrimSuffix(key, vc.VariantSuffix))
+	if err == nil {
+		return ver, tagRankOrdered
+	}
+	if vc.IsTagAllowed(tagName) {
+		return nil, tagRankAllowed
+	}
+	return nil, tagRankUnordered
+}
+
+// dateRank returns the date embedded in the tag's name and its rank when
+// sorting by VersionSortDate
+func dateRank(tagName, key string, vc *VersionConstraint) (time.Time, int) {
+	if key == "" {
+		return time.Time{}, tagRankUnordered
+	}
+	date, ok := vc.TagDate(tagName)
+	if !ok {
+		return time.Time{}, tagRankUnordered
+	}
+	return date, tagRankOrdered
+}
+
+// externalRanks sorts the tags with the given keys using the sort command of
+// vc. Tags dropped by the command rank below the others. If the command
+// fails, both tags rank the same, so that they are ordered by their names.
+func externalRanks(keyA, keyB string, vc *VersionConstraint) (int, int, int) {
+	rankA, rankB := rankIfKey(keyA), rankIfKey(keyB)
+	if rankA != tagRankOrdered || rankB != tagRankOrdered {
+		return rankA, rankB, 0
+	}
+	tagList := tag.NewImageTagList()
+	tagList.Add(tag.NewImageTag(keyA, time.Time{}))
+	tagList.Add(tag.NewImageTag(keyB, time.Time{}))
+	sorted, err := vc.sortExternal(tagList)
+	if err != nil {
+		log.Warnf("could not compare tags %s and %s: %v", keyA, keyB, err)
+		return rankA, rankB, 0
+	}
+	posA, posB := -1, -1
+	for i, t := range sorted {
+		switch t.TagName {
+		case keyA:
+			posA = i
+		case keyB:
+			posB = i
+		}
+	}
+	if posA < 0 {
+		rankA = tagRankUnordered
+	}
+	if posB < 0 {
+		rankB = tagRankUnordered
+	}
+	return rankA, rankB, compareInts(posA, posB)
+}
+
+// sortByBuildMetadata sorts the list of versions, which is sorted by semver,
+// so that versions of the same precedence are ordered by their build
+// metadata. Versions with equal build metadata keep their order.
+func sortByBuildMetadata(tags tag.SortableImageTagList, vc *VersionConstraint) {
+	versions := make(map[string]*semver.Version, len(tags))
+	for _, t := range tags {
+		ver, err := semver.NewVersion(strings.TrimSuffix(t.TagName, vc.VariantSuffix))
+		if err != nil {
+			continue
+		}
+		versions[t.TagName] = ver
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		verI, verJ := versions[tags[i].TagName], versions[tags[j].TagName]
+		if verI == nil || verJ == nil {
+			return false
+		}
+		if c := verI.Compare(verJ); c != 0 {
+			return c < 0
+		}
+		return compareBuildMetadata(verI.Metadata(), verJ.Metadata()) < 0
+	})
+}
+
+// compareBuildMetadata compares the build metadata of two versions. The
+// dot-separated identifiers are compared in order: numerically if both are
+// numeric, otherwise lexically, with numeric identifiers ranking below
+// alphanumeric ones. If all identifiers are equal, the metadata with more
+// identifiers is greater. Versions without build metadata rank lowest.
+func compareBuildMetadata(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return -1
+	}
+	if b == "" {
+		return 1
+	}
+	idsA, idsB := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(idsA) && i < len(idsB); i++ {
+		if c := compareIdentifiers(idsA[i], idsB[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(idsA), len(idsB))
+}
+
+// compareIdentifiers compares two identifiers of build metadata
+func compareIdentifiers(a, b string) int {
+	numA, numB := isNumeric(a), isNumeric(b)
+	switch {
+	case numA && numB:
+		// Compare without parsing, so that no identifier can overflow
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		if len(a) != len(b) {
+			return compareInts(len(a), len(b))
+		}
+		return strings.Compare(a, b)
+	case numA:
+		return -1
+	case numB:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// createdAt returns the creation date from the given meta data, if known
+func createdAt(info *tag.TagInfo) time.Time {
+	if info == nil {
+		return time.Time{}
+	}
+	return info.CreatedAt
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
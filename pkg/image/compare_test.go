@@ -0,0 +1,125 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+func Test_CompareTags(t *testing.T) {
+	t.Run("Compare by semver", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortSemVer}
+		assert.Equal(t, -1, CompareTags("1.2.3", "1.10.0", vc))
+		assert.Equal(t, 1, CompareTags("v2.0.0", "1.9.9", vc))
+		assert.Equal(t, 0, CompareTags("1.0.0", "1.0.0", vc))
+		assert.Equal(t, -1, CompareTags("1.0.0-rc1", "1.0.0", vc))
+		// Equal versions are ordered by name
+		assert.Equal(t, -1, CompareTags("1.0", "1.0.0", vc))
+		assert.Equal(t, 1, CompareTags("1.0.0", "1.0", vc))
+		// Tags that are not versions rank below all versions
+		assert.Equal(t, -1, CompareTags("latest", "0.0.1", vc))
+		assert.Equal(t, 1, CompareTags("0.0.1", "latest", vc))
+		assert.Equal(t, -1, CompareTags("latest", "stable", vc))
+	})
+
+	t.Run("Compare by semver with allowed tags", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortSemVer, AllowTags: []string{"stable"}}
+		assert.Equal(t, -1, CompareTags("stable", "0.0.1", vc))
+		assert.Equal(t, 1, CompareTags("stable", "latest", vc))
+	})
+
+	t.Run("Compare by semver with normalization and variants", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortSemVer, VariantSuffix: "-alpine", Normalization: &TagNormalization{StripPrefix: "release-"}}
+		assert.Equal(t, -1, CompareTags("release-1.9.0", "release-1.10.0", vc))
+		assert.Equal(t, 1, CompareTags("release-1.10.0-alpine", "release-1.9.0-alpine", vc))
+	})
+
+	t.Run("Compare by semver with extraction", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortSemVer, Normalization: &TagNormalization{Extract: regexp.MustCompile(`^app-(\d+\.\d+\.\d+)$`)}}
+		assert.Equal(t, -1, CompareTags("app-1.0.0", "app-1.1.0", vc))
+		assert.Equal(t, -1, CompareTags("other-2.0.0", "app-1.0.0", vc))
+	})
+
+	t.Run("Compare by semver with build metadata", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortSemVer}
+		// Build metadata is ignored, so that the tags are ordered by name
+		assert.Equal(t, 1, CompareTags("1.0.0+5", "1.0.0+10", vc))
+		vc.CompareBuildMetadata = true
+		assert.Equal(t, -1, CompareTags("1.0.0+5", "1.0.0+10", vc))
+		assert.Equal(t, 1, CompareTags("1.0.0+10", "1.0.0+5", vc))
+		assert.Equal(t, -1, CompareTags("1.0.0", "1.0.0+1", vc))
+		assert.Equal(t, -1, CompareTags("1.0.0+build.9", "1.0.0+build.10", vc))
+		assert.Equal(t, -1, CompareTags("1.0.0+10", "1.0.0+abc", vc))
+		assert.Equal(t, -1, CompareTags("1.0.0+1", "1.0.0+1.1", vc))
+		// Precedence still comes first
+		assert.Equal(t, -1, CompareTags("1.0.0+99", "1.0.1+1", vc))
+	})
+
+	t.Run("Compare by name", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortName}
+		assert.Equal(t, -1, CompareTags("a", "b", vc))
+		assert.Equal(t, -1, CompareTags("1.10", "1.9", vc))
+		assert.Equal(t, 0, CompareTags("a", "a", vc))
+	})
+
+	t.Run("Compare by digest", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortDigest, Constraint: "stable"}
+		assert.Equal(t, -1, CompareTags("latest", "stable", vc))
+		assert.Equal(t, 1, CompareTags("stable", "latest", vc))
+	})
+
+	t.Run("Compare by creation date", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortLatest}
+		older := &tag.TagInfo{CreatedAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+		newer := &tag.TagInfo{CreatedAt: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+		assert.Equal(t, 1, CompareTagsWithInfo("a", "b", newer, older, vc))
+		assert.Equal(t, -1, CompareTagsWithInfo("b", "a", older, newer, vc))
+		// Tags created at the same time are ordered by name
+		assert.Equal(t, -1, CompareTagsWithInfo("a", "b", newer, newer, vc))
+		// Tags without meta data are considered oldest
+		assert.Equal(t, -1, CompareTagsWithInfo("b", "a", nil, older, vc))
+		assert.Equal(t, -1, CompareTags("a", "b", vc))
+	})
+
+	t.Run("Compare by date in tag name", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortDate, DatePattern: regexp.MustCompile(`\d{8}`), DateLayout: "20060102"}
+		assert.Equal(t, -1, CompareTags("build-20200131", "build-20200201", vc))
+		assert.Equal(t, 1, CompareTags("nightly-20211231", "build-20200201", vc))
+		// Tags without a date rank below all dated tags
+		assert.Equal(t, -1, CompareTags("latest", "build-20200201", vc))
+	})
+
+	t.Run("Compare using sort command", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "sort")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		writeSortCommand(t, dir, "reverse", "sort -r")
+		writeSortCommand(t, dir, "only-odd", "grep -E '[13579]$'")
+		writeSortCommand(t, dir, "fail", "exit 1")
+		SetSortCommands(dir, 0)
+		defer SetSortCommands("", 0)
+
+		vc := &VersionConstraint{SortMode: VersionSortExternal, SortCommand: "reverse"}
+		assert.Equal(t, 1, CompareTags("v1", "v2", vc))
+		assert.Equal(t, -1, CompareTags("v2", "v1", vc))
+
+		vc = &VersionConstraint{SortMode: VersionSortExternal, SortCommand: "only-odd"}
+		assert.Equal(t, -1, CompareTags("v4", "v3", vc))
+		assert.Equal(t, 1, CompareTags("v3", "v1", vc))
+
+		// If the command fails, tags are ordered by name
+		vc = &VersionConstraint{SortMode: VersionSortExternal, SortCommand: "fail"}
+		assert.Equal(t, -1, CompareTags("v1", "v2", vc))
+	})
+
+	t.Run("Default to semver without constraint", func(t *testing.T) {
+		assert.Equal(t, -1, CompareTags("1.9.0", "1.10.0", nil))
+	})
+}
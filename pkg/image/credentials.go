@@ -4,8 +4,10 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"sort"
 	"strings"
 	"time"
 
@@ -23,6 +25,12 @@ const (
 	CredentialSourceSecret     CredentialSourceType = 2
 	CredentialSourceEnv        CredentialSourceType = 3
 	CredentialSourceExt        CredentialSourceType = 4
+	CredentialSourceFile       CredentialSourceType = 5
+	CredentialSourceHelper     CredentialSourceType = 6
+	CredentialSourceECR        CredentialSourceType = 7
+	CredentialSourceGCP        CredentialSourceType = 8
+	CredentialSourceACR        CredentialSourceType = 9
+	CredentialSourceHarbor     CredentialSourceType = 10
 )
 
 type CredentialSource struct {
@@ -33,11 +41,20 @@ type CredentialSource struct {
 	SecretField     string
 	EnvName         string
 	ScriptPath      string
+	FilePath        string
+	HelperName      string
+	Region          string
+	KeyPath         string
+	AzureAuth       string
+	AzureClientID   string
+	HarborAuth      string
 }
 
 type Credential struct {
 	Username string
 	Password string
+	// Time at which the credentials expire, if known
+	ExpiresAt time.Time
 }
 
 const pullSecretField = ".dockerconfigjson"
@@ -45,6 +62,18 @@ const pullSecretField = ".dockerconfigjson"
 // gcr.io=secret:foo/bar#baz
 // gcr.io=pullsecret:foo/bar
 // gcr.io=env:FOOBAR
+// gcr.io=file:/path/to/creds
+// gcr.io=helper:ecr-login
+// 123456789012.dkr.ecr.us-east-1.amazonaws.com=ecr:us-east-1
+// gcr.io=gcp:default
+// gcr.io=gcp:/path/to/key.json
+// myregistry.azurecr.io=acr:managed
+// myregistry.azurecr.io=acr:managed/<client_id>
+// myregistry.azurecr.io=acr:env
+// myregistry.azurecr.io=acr:/path/to/sp.json
+// harbor.example.com=harbor:secret/foo/bar#robot
+// harbor.example.com=harbor:env/HARBOR_ROBOT
+// harbor.example.com=harbor:/path/to/robot.json
 
 func ParseCredentialSource(credentialSource string, requirePrefix bool) (*CredentialSource, error) {
 	src := CredentialSource{}
@@ -79,6 +108,24 @@ func ParseCredentialSource(credentialSource string, requirePrefix bool) (*Creden
 	case "ext":
 		err = src.parseExtDefinition(tokens[1])
 		src.Type = CredentialSourceExt
+	case "file":
+		err = src.parseFileDefinition(tokens[1])
+		src.Type = CredentialSourceFile
+	case "helper":
+		err = src.parseHelperDefinition(tokens[1])
+		src.Type = CredentialSourceHelper
+	case "ecr":
+		err = src.parseECRDefinition(tokens[1])
+		src.Type = CredentialSourceECR
+	case "gcp":
+		err = src.parseGCPDefinition(tokens[1])
+		src.Type = CredentialSourceGCP
+	case "acr":
+		err = src.parseACRDefinition(tokens[1])
+		src.Type = CredentialSourceACR
+	case "harbor":
+		err = src.parseHarborDefinition(tokens[1])
+		src.Type = CredentialSourceHarbor
 	default:
 		err = fmt.Errorf("unknown credential source: %s", tokens[0])
 	}
@@ -156,6 +203,31 @@ func (src *CredentialSource) FetchCredentials(registryURL string, kubeclient *ku
 		creds.Username = tokens[0]
 		creds.Password = tokens[1]
 		return &creds, nil
+	case CredentialSourceFile:
+		if !strings.HasPrefix(src.FilePath, "/") {
+			return nil, fmt.Errorf("path to credentials file must be absolute, but is '%s'", src.FilePath)
+		}
+		data, err := ioutil.ReadFile(src.FilePath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read credentials from %s: %v", src.FilePath, err)
+		}
+		tokens := strings.SplitN(strings.TrimSpace(string(data)), ":", 2)
+		if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+			return nil, fmt.Errorf("could not fetch credentials: content of %s is malformed, must be <username>:<password>", src.FilePath)
+		}
+		creds.Username = tokens[0]
+		creds.Password = tokens[1]
+		return &creds, nil
+	case CredentialSourceHelper:
+		return fetchHelperCredentials(src.HelperName, registryURL)
+	case CredentialSourceECR:
+		return fetchECRCredentials(src.Region, registryURL)
+	case CredentialSourceGCP:
+		return fetchGCPCredentials(src.KeyPath)
+	case CredentialSourceACR:
+		return fetchACRCredentials(src, registryURL)
+	case CredentialSourceHarbor:
+		return fetchHarborCredentials(src, kubeclient)
 
 	default:
 		return nil, fmt.Errorf("unknown credential type")
@@ -207,8 +279,90 @@ func (src *CredentialSource) parseExtDefinition(definition string) error {
 	return nil
 }
 
+// Parse a credentials file definition
+// nolint:unparam
+func (src *CredentialSource) parseFileDefinition(definition string) error {
+	src.FilePath = definition
+	return nil
+}
+
+// Parse a credential helper definition, which is either the name of the
+// helper, i.e. 'ecr-login', the name of its executable, i.e.
+// 'docker-credential-ecr-login', or the absolute path to its executable
+// nolint:unparam
+func (src *CredentialSource) parseHelperDefinition(definition string) error {
+	src.HelperName = definition
+	return nil
+}
+
+// Prefix of the names of Docker credential helper executables
+const credentialHelperPrefix = "docker-credential-"
+
+// fetchHelperCredentials runs the given Docker credential helper to get the
+// credentials for the registry at registryURL. The helper is passed the host
+// of the registry, and must print the credentials as JSON document.
+func fetchHelperCredentials(helper string, registryURL string) (*Credential, error) {
+	helperPath := helper
+	if !strings.HasPrefix(helper, "/") {
+		if !strings.HasPrefix(helper, credentialHelperPrefix) {
+			helper = credentialHelperPrefix + helper
+		}
+		var err error
+		helperPath, err = exec.LookPath(helper)
+		if err != nil {
+			return nil, fmt.Errorf("could not find credential helper %s: %v", helper, err)
+		}
+	}
+
+	serverURL := strings.TrimPrefix(strings.TrimPrefix(registryURL, "https://"), "http://")
+	serverURL = strings.TrimSuffix(serverURL, "/")
+	cmd := exec.Command(helperPath, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	out, err := argoexec.RunCommandExt(cmd, argoexec.CmdOpts{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %s failed for %s: %v: %s", helper, serverURL, err, strings.TrimSpace(out))
+	}
+
+	var helperCreds struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal([]byte(out), &helperCreds); err != nil {
+		return nil, fmt.Errorf("invalid output of credential helper %s: %v", helper, err)
+	}
+	if helperCreds.Username == "" || helperCreds.Secret == "" {
+		return nil, fmt.Errorf("credential helper %s returned no credentials for %s", helper, serverURL)
+	}
+	return &Credential{Username: helperCreds.Username, Password: helperCreds.Secret}, nil
+}
+
+// Host names under which Docker Hub may appear in a Docker configuration
+var dockerHubHosts = map[string]bool{
+	"docker.io":               true,
+	"index.docker.io":         true,
+	"registry-1.docker.io":    true,
+	"registry.hub.docker.com": true,
+}
+
+// dockerConfigHost returns the host of a registry URL or of the key of an auth
+// entry in a Docker configuration, which may or may not have a protocol and a
+// path. All host names of Docker Hub are returned as docker.io.
+func dockerConfigHost(registryURL string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(registryURL, "http://"), "https://")
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	host = strings.ToLower(host)
+	if dockerHubHosts[host] {
+		return "docker.io"
+	}
+	return host
+}
+
 // This unmarshals & parses Docker's config.json file, returning username and
-// password for given registry URL
+// password for given registry URL. The auth entry for the host of the
+// registry is used, or otherwise the first entry whose key starts with the
+// registry URL.
 func parseDockerConfigJson(registryURL string, jsonSource string) (string, string, error) {
 	var dockerConf map[string]interface{}
 	err := json.Unmarshal([]byte(jsonSource), &dockerConf)
@@ -229,16 +383,47 @@ func parseDockerConfigJson(registryURL string, jsonSource string) (string, strin
 		regPrefix = registryURL
 	}
 
-	for registry, authConf := range auths {
-		if !strings.HasPrefix(registry, registryURL) && !strings.HasPrefix(registry, regPrefix) {
-			log.Tracef("found registry %s in image pull secret, but we want %s - skipping", registry, registryURL)
-			continue
+	registries := make([]string, 0, len(auths))
+	for registry := range auths {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+
+	host := dockerConfigHost(registryURL)
+	match := ""
+	for _, registry := range registries {
+		if dockerConfigHost(registry) == host {
+			match = registry
+			break
 		}
-		authEntry, ok := authConf.(map[string]interface{})
-		if !ok {
-			return "", "", fmt.Errorf("invalid auth entry for registry entry %s ('auths' entry should be map)", registry)
+	}
+	if match == "" {
+		for _, registry := range registries {
+			if strings.HasPrefix(registry, registryURL) || strings.HasPrefix(registry, regPrefix) {
+				match = registry
+				break
+			}
+			log.Tracef("found registry %s in image pull secret, but we want %s - skipping", registry, registryURL)
 		}
-		authString, ok := authEntry["auth"].(string)
+	}
+	if match == "" {
+		return "", "", fmt.Errorf("no valid auth entry for registry %s found in image pull secret", registryURL)
+	}
+
+	authEntry, ok := auths[match].(map[string]interface{})
+	if !ok {
+		return "", "", fmt.Errorf("invalid auth entry for registry entry %s ('auths' entry should be map)", match)
+	}
+	return parseDockerAuthEntry(match, authEntry)
+}
+
+// parseDockerAuthEntry returns username and password from an auth entry of a
+// Docker configuration. The entry holds them either base64-encoded as
+// <username>:<password> in the auth field, or in separate username and
+// password fields.
+func parseDockerAuthEntry(registry string, authEntry map[string]interface{}) (string, string, error) {
+	if authData, ok := authEntry["auth"]; ok && authData != "" {
+		authString, ok := authData.(string)
 		if !ok {
 			return "", "", fmt.Errorf("invalid auth token for registry entry %s ('auth' should be string')", registry)
 		}
@@ -250,9 +435,13 @@ func parseDockerConfigJson(registryURL string, jsonSource string) (string, strin
 		if len(tokens) != 2 {
 			return "", "", fmt.Errorf("invalid data after base64 decoding auth entry for registry entry %s", registry)
 		}
-
 		return tokens[0], tokens[1], nil
 	}
 
-	return "", "", fmt.Errorf("no valid auth entry for registry %s found in image pull secret", registryURL)
+	username, uok := authEntry["username"].(string)
+	password, pok := authEntry["password"].(string)
+	if !uok || !pok || username == "" || password == "" {
+		return "", "", fmt.Errorf("auth entry for registry entry %s has neither 'auth' nor 'username' and 'password'", registry)
+	}
+	return username, password, nil
 }
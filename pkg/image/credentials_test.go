@@ -1,6 +1,7 @@
 package image
 
 import (
+	"io/ioutil"
 	"os"
 	"path"
 	"testing"
@@ -101,6 +102,22 @@ func Test_ParseCredentialAnnotation(t *testing.T) {
 		assert.Equal(t, "DUMMY_SECRET", src.EnvName)
 	})
 
+	t.Run("Parse valid credentials definition from file", func(t *testing.T) {
+		src, err := ParseCredentialSource("file:/etc/creds/registry", false)
+		require.NoError(t, err)
+		require.NotNil(t, src)
+		assert.Equal(t, CredentialSourceFile, src.Type)
+		assert.Equal(t, "/etc/creds/registry", src.FilePath)
+	})
+
+	t.Run("Parse valid credentials definition from credential helper", func(t *testing.T) {
+		src, err := ParseCredentialSource("helper:ecr-login", false)
+		require.NoError(t, err)
+		require.NotNil(t, src)
+		assert.Equal(t, CredentialSourceHelper, src.Type)
+		assert.Equal(t, "ecr-login", src.HelperName)
+	})
+
 }
 
 func Test_ParseCredentialReference(t *testing.T) {
@@ -266,6 +283,85 @@ func Test_FetchCredentialsFromExt(t *testing.T) {
 	})
 }
 
+func Test_FetchCredentialsFromFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "creds")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	t.Run("Fetch credentials from file", func(t *testing.T) {
+		credsFile := path.Join(tempDir, "valid")
+		require.NoError(t, ioutil.WriteFile(credsFile, []byte("foo:bar\n"), 0600))
+		credSrc := &CredentialSource{Type: CredentialSourceFile, FilePath: credsFile}
+		creds, err := credSrc.FetchCredentials("https://registry-1.docker.io", nil)
+		require.NoError(t, err)
+		require.NotNil(t, creds)
+		assert.Equal(t, "foo", creds.Username)
+		assert.Equal(t, "bar", creds.Password)
+	})
+	t.Run("Fetch credentials from file that does not exist", func(t *testing.T) {
+		credSrc := &CredentialSource{Type: CredentialSourceFile, FilePath: path.Join(tempDir, "notexist")}
+		creds, err := credSrc.FetchCredentials("https://registry-1.docker.io", nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not read credentials from")
+		require.Nil(t, creds)
+	})
+	t.Run("Fetch credentials from file with invalid content", func(t *testing.T) {
+		credsFile := path.Join(tempDir, "invalid")
+		require.NoError(t, ioutil.WriteFile(credsFile, []byte("foobar\n"), 0600))
+		credSrc := &CredentialSource{Type: CredentialSourceFile, FilePath: credsFile}
+		creds, err := credSrc.FetchCredentials("https://registry-1.docker.io", nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "is malformed")
+		require.Nil(t, creds)
+	})
+	t.Run("Fetch credentials from file with relative path", func(t *testing.T) {
+		credSrc := &CredentialSource{Type: CredentialSourceFile, FilePath: "creds"}
+		creds, err := credSrc.FetchCredentials("https://registry-1.docker.io", nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "must be absolute")
+		require.Nil(t, creds)
+	})
+}
+
+func Test_FetchCredentialsFromHelper(t *testing.T) {
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	scripts := path.Join(pwd, "..", "..", "test", "testdata", "scripts")
+
+	t.Run("Fetch credentials from helper by path", func(t *testing.T) {
+		credSrc := &CredentialSource{Type: CredentialSourceHelper, HelperName: path.Join(scripts, "docker-credential-valid")}
+		creds, err := credSrc.FetchCredentials("https://123.dkr.ecr.us-east-1.amazonaws.com", nil)
+		require.NoError(t, err)
+		require.NotNil(t, creds)
+		assert.Equal(t, "AWS", creds.Username)
+		assert.Equal(t, "secret-for-123.dkr.ecr.us-east-1.amazonaws.com", creds.Password)
+	})
+	t.Run("Fetch credentials from helper by name", func(t *testing.T) {
+		oldPath := os.Getenv("PATH")
+		os.Setenv("PATH", scripts+string(os.PathListSeparator)+oldPath)
+		defer os.Setenv("PATH", oldPath)
+		credSrc := &CredentialSource{Type: CredentialSourceHelper, HelperName: "valid"}
+		creds, err := credSrc.FetchCredentials("https://registry.example.com/", nil)
+		require.NoError(t, err)
+		require.NotNil(t, creds)
+		assert.Equal(t, "secret-for-registry.example.com", creds.Password)
+	})
+	t.Run("Fetch credentials from failing helper", func(t *testing.T) {
+		credSrc := &CredentialSource{Type: CredentialSourceHelper, HelperName: path.Join(scripts, "docker-credential-failing")}
+		creds, err := credSrc.FetchCredentials("https://registry.example.com", nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "credentials not found in native keychain")
+		require.Nil(t, creds)
+	})
+	t.Run("Fetch credentials from helper that does not exist", func(t *testing.T) {
+		credSrc := &CredentialSource{Type: CredentialSourceHelper, HelperName: "notexist"}
+		creds, err := credSrc.FetchCredentials("https://registry.example.com", nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not find credential helper docker-credential-notexist")
+		require.Nil(t, creds)
+	})
+}
+
 func Test_ParseDockerConfig(t *testing.T) {
 	t.Run("Parse valid Docker configuration with matching registry", func(t *testing.T) {
 		config := fixture.MustReadFile("../../test/testdata/docker/valid-config.json")
@@ -283,6 +379,45 @@ func Test_ParseDockerConfig(t *testing.T) {
 		assert.Equal(t, "bar", password)
 	})
 
+	t.Run("Parse Docker configuration matching registry by host", func(t *testing.T) {
+		config := `{"auths":{"https://registry.example.com.evil.io":{"auth":"ZXZpbDpldmls"},"https://registry.example.com/v1/":{"auth":"Zm9vOmJhcg=="}}}`
+		username, password, err := parseDockerConfigJson("https://registry.example.com", config)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", username)
+		assert.Equal(t, "bar", password)
+	})
+
+	t.Run("Parse Docker configuration with Docker Hub alias", func(t *testing.T) {
+		config := `{"auths":{"https://index.docker.io/v1/":{"auth":"Zm9vOmJhcg=="}}}`
+		username, password, err := parseDockerConfigJson("https://registry-1.docker.io", config)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", username)
+		assert.Equal(t, "bar", password)
+	})
+
+	t.Run("Parse Docker configuration with separate username and password", func(t *testing.T) {
+		config := `{"auths":{"gcr.io":{"username":"foo","password":"bar"}}}`
+		username, password, err := parseDockerConfigJson("https://gcr.io", config)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", username)
+		assert.Equal(t, "bar", password)
+	})
+
+	t.Run("Parse Docker configuration with empty auth and separate username and password", func(t *testing.T) {
+		config := `{"auths":{"gcr.io":{"auth":"","username":"foo","password":"bar"}}}`
+		username, password, err := parseDockerConfigJson("https://gcr.io", config)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", username)
+		assert.Equal(t, "bar", password)
+	})
+
+	t.Run("Parse Docker configuration with auth entry without credentials", func(t *testing.T) {
+		config := `{"auths":{"gcr.io":{"username":"foo"}}}`
+		_, _, err := parseDockerConfigJson("https://gcr.io", config)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "has neither 'auth' nor 'username' and 'password'")
+	})
+
 	t.Run("Parse valid Docker configuration without matching registry", func(t *testing.T) {
 		config := fixture.MustReadFile("../../test/testdata/docker/valid-config.json")
 		username, password, err := parseDockerConfigJson("https://gcr.io", config)
@@ -0,0 +1,95 @@
+package image
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+)
+
+// URL of the AWS APIs, overriding the endpoints of all services if set. This
+// is a variable so that it can be pointed to a test server.
+var awsEndpointURL = ""
+
+// HTTP client used to talk to the AWS APIs. The SDK's buildable client is
+// used so that settings like AWS_CA_BUNDLE can be applied to it.
+var awsHTTPClient = awshttp.NewBuildableClient().WithTimeout(30 * time.Second)
+
+var ecrRegionRegexp = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// Matches the host of a private ECR registry, capturing the AWS account ID
+var ecrHostRegexp = regexp.MustCompile(`^([0-9]{12})\.dkr\.ecr\.`)
+
+// Parse an ECR definition, which is the AWS region of the registry
+func (src *CredentialSource) parseECRDefinition(definition string) error {
+	if !ecrRegionRegexp.MatchString(definition) {
+		return fmt.Errorf("invalid AWS region: %s", definition)
+	}
+	src.Region = definition
+	return nil
+}
+
+// fetchECRCredentials gets an authorization token for the ECR registry at
+// registryURL in the given region, using the GetAuthorizationToken API. The
+// AWS credentials are taken from the SDK's default credential chain, which
+// includes static credentials from the environment, shared configuration
+// files, and the role given by a web identity token, which is what EKS sets
+// up for pods using IAM roles for service accounts. The returned credentials
+// expire along with the token.
+func fetchECRCredentials(region string, registryURL string) (*Credential, error) {
+	ctx := context.Background()
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(region),
+		awsconfig.WithHTTPClient(awsHTTPClient),
+	}
+	if awsEndpointURL != "" {
+		opts = append(opts, awsconfig.WithEndpointResolverWithOptions(aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+			return aws.Endpoint{URL: awsEndpointURL + "/" + strings.ToLower(service) + "/", SigningRegion: region}, nil
+		})))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not load AWS configuration: %v", err)
+	}
+	if _, err := cfg.Credentials.Retrieve(ctx); err != nil {
+		return nil, fmt.Errorf("could not get AWS credentials: %v", err)
+	}
+
+	// Private registries are addressed by the account ID in their host name,
+	// which we pass along so that tokens for other accounts can be requested.
+	input := &ecr.GetAuthorizationTokenInput{}
+	host := strings.TrimPrefix(strings.TrimPrefix(registryURL, "https://"), "http://")
+	if m := ecrHostRegexp.FindStringSubmatch(host); m != nil {
+		input.RegistryIds = []string{m[1]}
+	}
+
+	output, err := ecr.NewFromConfig(cfg).GetAuthorizationToken(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("could not get ECR authorization token: %v", err)
+	}
+	if len(output.AuthorizationData) == 0 || output.AuthorizationData[0].AuthorizationToken == nil {
+		return nil, fmt.Errorf("ECR returned no authorization token for %s", registryURL)
+	}
+	authData := output.AuthorizationData[0]
+	token, err := base64.StdEncoding.DecodeString(aws.ToString(authData.AuthorizationToken))
+	if err != nil {
+		return nil, fmt.Errorf("could not base64-decode ECR authorization token: %v", err)
+	}
+	tokens := strings.SplitN(string(token), ":", 2)
+	if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+		return nil, fmt.Errorf("invalid ECR authorization token, must be <username>:<password>")
+	}
+
+	creds := &Credential{Username: tokens[0], Password: tokens[1]}
+	if authData.ExpiresAt != nil {
+		creds.ExpiresAt = *authData.ExpiresAt
+	}
+	return creds, nil
+}
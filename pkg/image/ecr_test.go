@@ -0,0 +1,176 @@
+package image
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setEnv sets the given environment variables, and unsets all AWS variables
+// not given. Shared configuration files and the instance metadata service are
+// disabled, so that only the given variables provide credentials. The
+// returned function restores the previous environment.
+func setEnv(vars map[string]string) func() {
+	names := []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_ROLE_ARN", "AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_SESSION_NAME", "AWS_PROFILE",
+		"AWS_CONFIG_FILE", "AWS_SHARED_CREDENTIALS_FILE", "AWS_EC2_METADATA_DISABLED"}
+	defaults := map[string]string{
+		"AWS_CONFIG_FILE":             filepath.Join(os.TempDir(), "nonexistent-aws-config"),
+		"AWS_SHARED_CREDENTIALS_FILE": filepath.Join(os.TempDir(), "nonexistent-aws-credentials"),
+		"AWS_EC2_METADATA_DISABLED":   "true",
+	}
+	old := map[string]string{}
+	for _, name := range names {
+		old[name] = os.Getenv(name)
+		value, ok := vars[name]
+		if !ok {
+			value = defaults[name]
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, value := range old {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+// ecrRequest records the last request received by the test ECR API
+type ecrRequest struct {
+	body          string
+	securityToken string
+}
+
+// newECRServer returns a test server for the ECR and STS APIs, and points
+// the API endpoints to it
+func newECRServer(t *testing.T, token string, expiresAt int64) (*ecrRequest, func()) {
+	last := &ecrRequest{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sts/":
+			require.NoError(t, r.ParseForm())
+			if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "webtoken" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse><AssumeRoleWithWebIdentityResult><Credentials><AccessKeyId>ASIASTS</AccessKeyId><SecretAccessKey>stssecret</SecretAccessKey><SessionToken>stssession</SessionToken><Expiration>%s</Expiration></Credentials></AssumeRoleWithWebIdentityResult></AssumeRoleWithWebIdentityResponse>`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+		case "/ecr/":
+			if r.Header.Get("X-Amz-Target") != "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			last.body = string(body)
+			last.securityToken = r.Header.Get("X-Amz-Security-Token")
+			authData := map[string]interface{}{"authorizationToken": base64.StdEncoding.EncodeToString([]byte(token))}
+			if expiresAt != 0 {
+				authData["expiresAt"] = expiresAt
+			}
+			resp := map[string]interface{}{"authorizationData": []map[string]interface{}{authData}}
+			_ = json.NewEncoder(w).Encode(resp)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	oldURL := awsEndpointURL
+	awsEndpointURL = srv.URL
+	return last, func() {
+		awsEndpointURL = oldURL
+		srv.Close()
+	}
+}
+
+func Test_ParseECRCredentialSource(t *testing.T) {
+	t.Run("Parse valid ECR definition", func(t *testing.T) {
+		src, err := ParseCredentialSource("ecr:eu-central-1", false)
+		require.NoError(t, err)
+		assert.Equal(t, CredentialSourceECR, src.Type)
+		assert.Equal(t, "eu-central-1", src.Region)
+	})
+	t.Run("Parse invalid ECR definition", func(t *testing.T) {
+		src, err := ParseCredentialSource("ecr:eu-central-1.evil.com/", false)
+		assert.Error(t, err)
+		assert.Nil(t, src)
+	})
+}
+
+func Test_FetchCredentialsFromECR(t *testing.T) {
+	expiresAt := time.Now().Add(12 * time.Hour).Unix()
+	_, done := newECRServer(t, "AWS:ecrpassword", expiresAt)
+	defer done()
+
+	t.Run("Fetch token using static credentials", func(t *testing.T) {
+		defer setEnv(map[string]string{"AWS_ACCESS_KEY_ID": "AKIDEXAMPLE", "AWS_SECRET_ACCESS_KEY": "secret"})()
+		src := &CredentialSource{Type: CredentialSourceECR, Region: "us-east-1"}
+		creds, err := src.FetchCredentials("https://123456789012.dkr.ecr.us-east-1.amazonaws.com", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "AWS", creds.Username)
+		assert.Equal(t, "ecrpassword", creds.Password)
+		assert.Equal(t, expiresAt, creds.ExpiresAt.Unix())
+	})
+
+	t.Run("Fetch token using web identity", func(t *testing.T) {
+		tempDir, err := ioutil.TempDir("", "ecr")
+		require.NoError(t, err)
+		defer os.RemoveAll(tempDir)
+		tokenFile := filepath.Join(tempDir, "token")
+		require.NoError(t, ioutil.WriteFile(tokenFile, []byte("webtoken"), 0600))
+		defer setEnv(map[string]string{"AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/updater", "AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile})()
+
+		creds, err := fetchECRCredentials("us-east-1", "https://123456789012.dkr.ecr.us-east-1.amazonaws.com")
+		require.NoError(t, err)
+		assert.Equal(t, "ecrpassword", creds.Password)
+	})
+
+	t.Run("Fetch token without AWS credentials", func(t *testing.T) {
+		defer setEnv(map[string]string{})()
+		creds, err := fetchECRCredentials("us-east-1", "https://123456789012.dkr.ecr.us-east-1.amazonaws.com")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not get AWS credentials")
+		assert.Nil(t, creds)
+	})
+}
+
+func Test_FetchECRCredentialsRequest(t *testing.T) {
+	defer setEnv(map[string]string{"AWS_ACCESS_KEY_ID": "AKIDEXAMPLE", "AWS_SECRET_ACCESS_KEY": "secret", "AWS_SESSION_TOKEN": "session"})()
+
+	t.Run("Registry ID is taken from registry host", func(t *testing.T) {
+		last, done := newECRServer(t, "AWS:ecrpassword", 0)
+		defer done()
+		creds, err := fetchECRCredentials("us-east-1", "https://123456789012.dkr.ecr.us-east-1.amazonaws.com")
+		require.NoError(t, err)
+		assert.True(t, creds.ExpiresAt.IsZero())
+		assert.Equal(t, `{"registryIds":["123456789012"]}`, last.body)
+		assert.Equal(t, "session", last.securityToken)
+	})
+
+	t.Run("Registry ID is not passed for other registries", func(t *testing.T) {
+		last, done := newECRServer(t, "AWS:ecrpassword", 0)
+		defer done()
+		_, err := fetchECRCredentials("us-east-1", "https://public.ecr.aws")
+		require.NoError(t, err)
+		assert.Equal(t, `{}`, last.body)
+	})
+
+	t.Run("Invalid token", func(t *testing.T) {
+		_, done := newECRServer(t, "notatoken", 0)
+		defer done()
+		_, err := fetchECRCredentials("us-east-1", "https://123456789012.dkr.ecr.us-east-1.amazonaws.com")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid ECR authorization token")
+	})
+}
@@ -0,0 +1,135 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+// DefaultSortCommandTimeout is the time a sort command may take, if no
+// other timeout has been set
+const DefaultSortCommandTimeout = 10 * time.Second
+
+// Sort commands can only be run from this directory, so that whoever may set
+// annotations cannot run arbitrary executables. External sorting is disabled
+// as long as no directory has been set.
+var (
+	sortCommandLock    sync.RWMutex
+	sortCommandDir     string
+	sortCommandTimeout = DefaultSortCommandTimeout
+)
+
+// SetSortCommands enables external sorting using the executables in dir,
+// which have to finish within timeout. An empty dir disables external
+// sorting, a timeout of 0 sets the default timeout.
+func SetSortCommands(dir string, timeout time.Duration) {
+	sortCommandLock.Lock()
+	defer sortCommandLock.Unlock()
+	if timeout <= 0 {
+		timeout = DefaultSortCommandTimeout
+	}
+	sortCommandDir = dir
+	sortCommandTimeout = timeout
+}
+
+// sortCommandPath returns the path of the sort command with the given name,
+// and the timeout it has to finish within
+func sortCommandPath(name string) (string, time.Duration, error) {
+	sortCommandLock.RLock()
+	dir, timeout := sortCommandDir, sortCommandTimeout
+	sortCommandLock.RUnlock()
+	if dir == "" {
+		return "", 0, fmt.Errorf("external sorting is disabled, no sort command directory configured")
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", 0, fmt.Errorf("invalid sort command name '%s'", name)
+	}
+	path := filepath.Join(dir, name)
+	st, err := os.Stat(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("sort command %s not found: %v", name, err)
+	}
+	if st.IsDir() || st.Mode()&0111 == 0 {
+		return "", 0, fmt.Errorf("sort command %s is not executable", name)
+	}
+	return path, timeout, nil
+}
+
+// sortExternal sorts the tags in tagList using the external command named by
+// SortCommand. The command gets the tag names on stdin, one per line, and
+// writes them to stdout in ascending order, i.e. the newest version last.
+// Tags it does not write are dropped. The command must exit with status 0
+// within the configured timeout, otherwise an error is returned.
+func (vc *VersionConstraint) sortExternal(tagList *tag.ImageTagList) (tag.SortableImageTagList, error) {
+	path, timeout, err := sortCommandPath(vc.SortCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	names := tagList.Tags()
+	sort.Strings(names)
+	var stdin, stdout, stderr bytes.Buffer
+	for _, name := range names {
+		stdin.WriteString(name)
+		stdin.WriteByte('\n')
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = &stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("could not run sort command %s: %v", vc.SortCommand, err)
+	}
+
+	// Waiting for the command also waits for its output to be closed, which
+	// may be held open by processes it started, even after it has been
+	// killed. So we don't wait for it any longer than the timeout.
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("sort command %s did not finish within %v", vc.SortCommand, timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sort command %s failed: %v: %s", vc.SortCommand, err, strings.TrimSpace(stderr.String()))
+	}
+	log.Tracef("sort command %s sorted %d tags in %v", vc.SortCommand, len(names), time.Since(start))
+
+	sorted := tag.SortableImageTagList{}
+	seen := make(map[string]bool, len(names))
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" || seen[name] {
+			continue
+		}
+		t := tagList.Get(name)
+		if t == nil {
+			return nil, fmt.Errorf("sort command %s returned unknown tag '%s'", vc.SortCommand, name)
+		}
+		seen[name] = true
+		sorted = append(sorted, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read output of sort command %s: %v", vc.SortCommand, err)
+	}
+	return sorted, nil
+}
@@ -0,0 +1,95 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSortCommand writes a shell script with the given body as sort command
+// to dir
+func writeSortCommand(t *testing.T, dir, name, body string) {
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+body+"\n"), 0755))
+}
+
+func Test_ExternalSort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sort")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeSortCommand(t, dir, "reverse", "sort -r")
+	writeSortCommand(t, dir, "only-odd", "grep -E '[13579]$'")
+	writeSortCommand(t, dir, "fail", "echo broken >&2; exit 3")
+	writeSortCommand(t, dir, "slow", "sleep 5")
+	writeSortCommand(t, dir, "unknown", "echo v9")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "not-executable"), []byte("#!/bin/sh\n"), 0644))
+
+	SetSortCommands(dir, 500*time.Millisecond)
+	defer SetSortCommands("", 0)
+
+	img := NewFromIdentifier("jannfis/test:v2")
+	tagList := newImageTagList([]string{"v1", "v2", "v3", "v4"})
+
+	t.Run("Select newest tag in order of sort command", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortExternal, SortCommand: "reverse"}
+		require.NoError(t, vc.Validate())
+		selection, err := img.SelectVersionFromTags(vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "v1", selection.Selected.TagName)
+		assert.Equal(t, "v2", selection.Alternative.TagName)
+	})
+
+	t.Run("Tags not returned by sort command are dropped", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortExternal, SortCommand: "only-odd", Explain: true}
+		selection, err := img.SelectVersionFromTags(vc, tagList)
+		require.NoError(t, err)
+		assert.Equal(t, "v3", selection.Selected.TagName)
+		assert.Len(t, selection.Candidates, 2)
+		assert.Contains(t, selection.Excluded["v4"], "sort-command")
+	})
+
+	t.Run("Sort command fails", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortExternal, SortCommand: "fail"}
+		_, err := img.SelectVersionFromTags(vc, tagList)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "exit status 3")
+		assert.Contains(t, err.Error(), "broken")
+	})
+
+	t.Run("Sort command times out", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortExternal, SortCommand: "slow"}
+		start := time.Now()
+		_, err := img.SelectVersionFromTags(vc, tagList)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "did not finish within 500ms")
+		assert.Less(t, int64(time.Since(start)), int64(4*time.Second))
+	})
+
+	t.Run("Sort command returns unknown tag", func(t *testing.T) {
+		vc := &VersionConstraint{SortMode: VersionSortExternal, SortCommand: "unknown"}
+		_, err := img.SelectVersionFromTags(vc, tagList)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unknown tag 'v9'")
+	})
+
+	t.Run("Invalid sort commands", func(t *testing.T) {
+		for _, name := range []string{"", "missing", "../reverse", "not-executable"} {
+			vc := &VersionConstraint{SortMode: VersionSortExternal, SortCommand: name}
+			assert.Error(t, vc.Validate(), name)
+		}
+	})
+
+	t.Run("External sorting disabled", func(t *testing.T) {
+		SetSortCommands("", 0)
+		defer SetSortCommands(dir, 500*time.Millisecond)
+		vc := &VersionConstraint{SortMode: VersionSortExternal, SortCommand: "reverse"}
+		err := vc.Validate()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "disabled")
+	})
+}
@@ -0,0 +1,84 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// The user name to use along with an OAuth access token for authenticating
+// to GCR and Artifact Registry
+const gcpTokenUsername = "oauth2accesstoken"
+
+// The OAuth scope requested for access tokens
+const gcpTokenScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// HTTP client used to talk to the OAuth token endpoint. The metadata server
+// is queried with the metadata client's own HTTP client, whose host can be
+// changed with the env GCE_METADATA_HOST.
+var gcpHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// Parse a GCP definition, which is either 'default' for using the metadata
+// server, or the absolute path to a service account key file
+func (src *CredentialSource) parseGCPDefinition(definition string) error {
+	if definition != "default" && !strings.HasPrefix(definition, "/") {
+		return fmt.Errorf("invalid GCP definition, must be 'default' or absolute path to service account key: %s", definition)
+	}
+	if definition != "default" {
+		src.KeyPath = definition
+	}
+	return nil
+}
+
+// fetchGCPCredentials gets an OAuth access token for authenticating to GCR
+// and Artifact Registry. If keyFile is given, the token is requested for
+// the credentials in that file. Otherwise, the token is requested from the
+// metadata server, falling back to the file set in the env
+// GOOGLE_APPLICATION_CREDENTIALS if the metadata server is not available.
+// The returned credentials expire along with the token.
+func fetchGCPCredentials(keyFile string) (*Credential, error) {
+	var token *oauth2.Token
+	var err error
+	if keyFile != "" {
+		token, err = fetchGCPKeyFileToken(keyFile)
+	} else {
+		token, err = google.ComputeTokenSource("").Token()
+		if err != nil && os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") != "" {
+			keyFile = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+			log.Debugf("could not get access token from metadata server, using %s: %v", keyFile, err)
+			token, err = fetchGCPKeyFileToken(keyFile)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get GCP access token: %v", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("could not get GCP access token: no token returned")
+	}
+
+	return &Credential{Username: gcpTokenUsername, Password: token.AccessToken, ExpiresAt: token.Expiry}, nil
+}
+
+// fetchGCPKeyFileToken requests an access token for the credentials in the
+// given file, i.e. a service account key
+func fetchGCPKeyFileToken(keyFile string) (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account key: %v", err)
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, gcpHTTPClient)
+	creds, err := google.CredentialsFromJSON(ctx, data, gcpTokenScope)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse service account key %s: %v", keyFile, err)
+	}
+	return creds.TokenSource.Token()
+}
@@ -0,0 +1,171 @@
+package image
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newGCPServer returns a test server for the metadata server and the OAuth
+// token endpoint, and points the metadata host to it. Requests to the token
+// endpoint must be signed by the given key.
+func newGCPServer(t *testing.T, key *rsa.PrivateKey) (*httptest.Server, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/computeMetadata/v1/instance/service-accounts/default/token":
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"metadata-token","expires_in":3599,"token_type":"Bearer"}`)
+		case "/token":
+			require.NoError(t, r.ParseForm())
+			parts := strings.Split(r.Form.Get("assertion"), ".")
+			require.Len(t, parts, 3)
+			signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+			require.NoError(t, err)
+			hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], signature) != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+			require.NoError(t, err)
+			var c map[string]interface{}
+			require.NoError(t, json.Unmarshal(claims, &c))
+			fmt.Fprintf(w, `{"access_token":"token-for-%s","expires_in":3600,"token_type":"Bearer"}`, c["iss"])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	oldHost, hadHost := os.LookupEnv("GCE_METADATA_HOST")
+	os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+	return srv, func() {
+		if hadHost {
+			os.Setenv("GCE_METADATA_HOST", oldHost)
+		} else {
+			os.Unsetenv("GCE_METADATA_HOST")
+		}
+		srv.Close()
+	}
+}
+
+// writeServiceAccountKey writes a service account key file for the given key
+// and token endpoint to dir
+func writeServiceAccountKey(t *testing.T, dir string, key *rsa.PrivateKey, tokenURI string) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	sa, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "updater@project.iam.gserviceaccount.com",
+		"private_key_id": "abc",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      tokenURI,
+	})
+	require.NoError(t, err)
+	keyFile := filepath.Join(dir, "key.json")
+	require.NoError(t, ioutil.WriteFile(keyFile, sa, 0600))
+	return keyFile
+}
+
+func Test_ParseGCPCredentialSource(t *testing.T) {
+	t.Run("Parse GCP definition using metadata server", func(t *testing.T) {
+		src, err := ParseCredentialSource("gcr.io=gcp:default", true)
+		require.NoError(t, err)
+		assert.Equal(t, CredentialSourceGCP, src.Type)
+		assert.Equal(t, "", src.KeyPath)
+	})
+	t.Run("Parse GCP definition using service account key", func(t *testing.T) {
+		src, err := ParseCredentialSource("gcp:/etc/gcp/key.json", false)
+		require.NoError(t, err)
+		assert.Equal(t, CredentialSourceGCP, src.Type)
+		assert.Equal(t, "/etc/gcp/key.json", src.KeyPath)
+	})
+	t.Run("Parse invalid GCP definition", func(t *testing.T) {
+		src, err := ParseCredentialSource("gcp:key.json", false)
+		assert.Error(t, err)
+		assert.Nil(t, src)
+	})
+}
+
+func Test_FetchCredentialsFromGCP(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	srv, done := newGCPServer(t, key)
+	defer done()
+	tempDir, err := ioutil.TempDir("", "gcp")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+	keyFile := writeServiceAccountKey(t, tempDir, key, srv.URL+"/token")
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+
+	oldEnv := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	defer os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", oldEnv)
+
+	t.Run("Fetch token from metadata server", func(t *testing.T) {
+		os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+		src := &CredentialSource{Type: CredentialSourceGCP}
+		creds, err := src.FetchCredentials("https://gcr.io", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "oauth2accesstoken", creds.Username)
+		assert.Equal(t, "metadata-token", creds.Password)
+		assert.WithinDuration(t, time.Now().Add(3599*time.Second), creds.ExpiresAt, 5*time.Second)
+	})
+
+	t.Run("Fetch token for service account key", func(t *testing.T) {
+		src := &CredentialSource{Type: CredentialSourceGCP, KeyPath: keyFile}
+		creds, err := src.FetchCredentials("https://europe-docker.pkg.dev", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "oauth2accesstoken", creds.Username)
+		assert.Equal(t, "token-for-updater@project.iam.gserviceaccount.com", creds.Password)
+	})
+
+	t.Run("Fall back to application credentials without metadata server", func(t *testing.T) {
+		os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(notFound.URL, "http://"))
+		defer os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+		os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", keyFile)
+		creds, err := fetchGCPCredentials("")
+		require.NoError(t, err)
+		assert.Equal(t, "token-for-updater@project.iam.gserviceaccount.com", creds.Password)
+	})
+
+	t.Run("No metadata server and no application credentials", func(t *testing.T) {
+		os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(notFound.URL, "http://"))
+		defer os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(srv.URL, "http://"))
+		os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+		creds, err := fetchGCPCredentials("")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not get GCP access token")
+		assert.Nil(t, creds)
+	})
+
+	t.Run("Service account key signed by another key", func(t *testing.T) {
+		otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		require.NoError(t, err)
+		otherDir, err := ioutil.TempDir("", "gcp")
+		require.NoError(t, err)
+		defer os.RemoveAll(otherDir)
+		creds, err := fetchGCPCredentials(writeServiceAccountKey(t, otherDir, otherKey, srv.URL+"/token"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "401 Unauthorized")
+		assert.Nil(t, creds)
+	})
+}
@@ -0,0 +1,127 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/kube"
+)
+
+// Where to read the name and secret of a Harbor robot account from
+const (
+	harborAuthSecret = "secret"
+	harborAuthEnv    = "env"
+	harborAuthFile   = "file"
+)
+
+// harborRobot holds the credentials of a Harbor robot account, in the format
+// Harbor exports them in. ExpiresAt is a Unix timestamp, or -1 if the account
+// does not expire.
+type harborRobot struct {
+	Name      string `json:"name"`
+	Secret    string `json:"secret"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// Parse a Harbor definition, which is either 'secret/<namespace>/<name>#<field>'
+// for a robot account held in a Kubernetes secret, 'env/<name>' for a robot
+// account held in an environment variable, or the absolute path to a file
+// holding the robot account.
+func (src *CredentialSource) parseHarborDefinition(definition string) error {
+	switch {
+	case strings.HasPrefix(definition, harborAuthSecret+"/"):
+		src.HarborAuth = harborAuthSecret
+		if err := src.parseSecretDefinition(strings.TrimPrefix(definition, harborAuthSecret+"/")); err != nil {
+			return fmt.Errorf("invalid Harbor definition: %v", err)
+		}
+	case strings.HasPrefix(definition, harborAuthEnv+"/"):
+		src.HarborAuth = harborAuthEnv
+		src.EnvName = strings.TrimPrefix(definition, harborAuthEnv+"/")
+		if src.EnvName == "" {
+			return fmt.Errorf("invalid Harbor definition, name of environment variable missing: %s", definition)
+		}
+	case strings.HasPrefix(definition, "/"):
+		src.HarborAuth = harborAuthFile
+		src.FilePath = definition
+	default:
+		return fmt.Errorf("invalid Harbor definition, must be 'secret/<namespace>/<name>#<field>', 'env/<name>' or absolute path to robot account: %s", definition)
+	}
+	return nil
+}
+
+// fetchHarborCredentials reads the robot account, whose name and secret are
+// used as credentials for the Harbor registry. Since Harbor scopes its tokens
+// to repositories, the registry client requests the tokens for the individual
+// repositories with the robot account, and caches them until they expire. The
+// returned credentials expire along with the robot account, so that it is read
+// again by then and a rotated secret is picked up.
+func fetchHarborCredentials(src *CredentialSource, kubeclient *kube.KubernetesClient) (*Credential, error) {
+	robot, err := readHarborRobot(src, kubeclient)
+	if err != nil {
+		return nil, fmt.Errorf("could not read Harbor robot account: %v", err)
+	}
+	creds := &Credential{Username: robot.Name, Password: robot.Secret}
+	if robot.ExpiresAt > 0 {
+		creds.ExpiresAt = time.Unix(robot.ExpiresAt, 0)
+		if time.Now().After(creds.ExpiresAt) {
+			return nil, fmt.Errorf("robot account %s expired at %s", robot.Name, creds.ExpiresAt.Format(time.RFC3339))
+		}
+	}
+	return creds, nil
+}
+
+// readHarborRobot reads the robot account from the secret, the environment
+// or the file of the credential source
+func readHarborRobot(src *CredentialSource, kubeclient *kube.KubernetesClient) (*harborRobot, error) {
+	var data string
+	switch src.HarborAuth {
+	case harborAuthSecret:
+		if kubeclient == nil {
+			return nil, fmt.Errorf("no Kubernetes client given")
+		}
+		var err error
+		data, err = kubeclient.GetSecretField(src.SecretNamespace, src.SecretName, src.SecretField)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch secret '%s' from namespace '%s' (field: '%s'): %v", src.SecretName, src.SecretNamespace, src.SecretField, err)
+		}
+	case harborAuthEnv:
+		data = os.Getenv(src.EnvName)
+		if data == "" {
+			return nil, fmt.Errorf("env '%s' is not set", src.EnvName)
+		}
+	case harborAuthFile:
+		raw, err := ioutil.ReadFile(src.FilePath)
+		if err != nil {
+			return nil, err
+		}
+		data = string(raw)
+	default:
+		return nil, fmt.Errorf("unknown source %s", src.HarborAuth)
+	}
+	return parseHarborRobot(data)
+}
+
+// parseHarborRobot parses a robot account, which is either given as JSON as
+// exported by Harbor, or as '<name>:<secret>'
+func parseHarborRobot(data string) (*harborRobot, error) {
+	data = strings.TrimSpace(data)
+	var robot harborRobot
+	if strings.HasPrefix(data, "{") {
+		if err := json.Unmarshal([]byte(data), &robot); err != nil {
+			return nil, fmt.Errorf("invalid robot account: %v", err)
+		}
+	} else {
+		tokens := strings.SplitN(data, ":", 2)
+		if len(tokens) == 2 {
+			robot.Name, robot.Secret = tokens[0], tokens[1]
+		}
+	}
+	if robot.Name == "" || robot.Secret == "" {
+		return nil, fmt.Errorf("name and secret of robot account are required")
+	}
+	return &robot, nil
+}
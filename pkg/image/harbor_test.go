@@ -0,0 +1,110 @@
+package image
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseHarborCredentialSource(t *testing.T) {
+	t.Run("Parse robot account from secret", func(t *testing.T) {
+		src, err := ParseCredentialSource("harbor.example.com=harbor:secret/argocd/robot#creds", true)
+		require.NoError(t, err)
+		assert.Equal(t, CredentialSourceHarbor, src.Type)
+		assert.Equal(t, harborAuthSecret, src.HarborAuth)
+		assert.Equal(t, "argocd", src.SecretNamespace)
+		assert.Equal(t, "robot", src.SecretName)
+		assert.Equal(t, "creds", src.SecretField)
+	})
+	t.Run("Parse robot account from environment", func(t *testing.T) {
+		src, err := ParseCredentialSource("harbor:env/HARBOR_ROBOT", false)
+		require.NoError(t, err)
+		assert.Equal(t, harborAuthEnv, src.HarborAuth)
+		assert.Equal(t, "HARBOR_ROBOT", src.EnvName)
+	})
+	t.Run("Parse robot account from file", func(t *testing.T) {
+		src, err := ParseCredentialSource("harbor:/etc/harbor/robot.json", false)
+		require.NoError(t, err)
+		assert.Equal(t, harborAuthFile, src.HarborAuth)
+		assert.Equal(t, "/etc/harbor/robot.json", src.FilePath)
+	})
+	t.Run("Invalid definitions", func(t *testing.T) {
+		for _, def := range []string{"harbor:robot", "harbor:env/", "harbor:secret/argocd/robot"} {
+			_, err := ParseCredentialSource(def, false)
+			assert.Error(t, err, def)
+		}
+	})
+}
+
+func Test_FetchHarborCredentials(t *testing.T) {
+	t.Run("Robot account from environment", func(t *testing.T) {
+		os.Setenv("HARBOR_ROBOT", "robot$ci:s3cr3t")
+		defer os.Unsetenv("HARBOR_ROBOT")
+		src, err := ParseCredentialSource("harbor:env/HARBOR_ROBOT", false)
+		require.NoError(t, err)
+		creds, err := src.FetchCredentials("https://harbor.example.com", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "robot$ci", creds.Username)
+		assert.Equal(t, "s3cr3t", creds.Password)
+		assert.True(t, creds.ExpiresAt.IsZero())
+	})
+
+	t.Run("Expiring robot account from file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "harbor")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		expiresAt := time.Now().Add(10 * time.Minute).Unix()
+		path := filepath.Join(dir, "robot.json")
+		require.NoError(t, ioutil.WriteFile(path, []byte(fmt.Sprintf(`{"id":1,"name":"robot$ci","secret":"s3cr3t","expires_at":%d}`, expiresAt)), 0600))
+		src, err := ParseCredentialSource("harbor:"+path, false)
+		require.NoError(t, err)
+		creds, err := src.FetchCredentials("https://harbor.example.com", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "robot$ci", creds.Username)
+		assert.Equal(t, "s3cr3t", creds.Password)
+		assert.True(t, time.Unix(expiresAt, 0).Equal(creds.ExpiresAt))
+	})
+
+	t.Run("Robot account not expiring", func(t *testing.T) {
+		os.Setenv("HARBOR_ROBOT", `{"name":"robot$ci","secret":"s3cr3t","expires_at":-1}`)
+		defer os.Unsetenv("HARBOR_ROBOT")
+		src, err := ParseCredentialSource("harbor:env/HARBOR_ROBOT", false)
+		require.NoError(t, err)
+		creds, err := src.FetchCredentials("https://harbor.example.com", nil)
+		require.NoError(t, err)
+		assert.True(t, creds.ExpiresAt.IsZero())
+	})
+
+	t.Run("Expired robot account", func(t *testing.T) {
+		os.Setenv("HARBOR_ROBOT", `{"name":"robot$ci","secret":"s3cr3t","expires_at":1}`)
+		defer os.Unsetenv("HARBOR_ROBOT")
+		src, err := ParseCredentialSource("harbor:env/HARBOR_ROBOT", false)
+		require.NoError(t, err)
+		_, err = src.FetchCredentials("https://harbor.example.com", nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "robot account robot$ci expired")
+	})
+
+	t.Run("Malformed robot account", func(t *testing.T) {
+		os.Setenv("HARBOR_ROBOT", "robot$ci")
+		defer os.Unsetenv("HARBOR_ROBOT")
+		src, err := ParseCredentialSource("harbor:env/HARBOR_ROBOT", false)
+		require.NoError(t, err)
+		_, err = src.FetchCredentials("https://harbor.example.com", nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not read Harbor robot account")
+	})
+
+	t.Run("Secret without Kubernetes client", func(t *testing.T) {
+		src, err := ParseCredentialSource("harbor:secret/argocd/robot#creds", false)
+		require.NoError(t, err)
+		_, err = src.FetchCredentials("https://harbor.example.com", nil)
+		require.Error(t, err)
+	})
+}
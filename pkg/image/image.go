@@ -14,7 +14,10 @@ type ContainerImage struct {
 	ImageAlias            string
 	HelmParamImageName    string
 	HelmParamImageVersion string
-	original              string
+	// RewrittenFrom is the name of the image before its registry has been
+	// rewritten for writing back, if it has been rewritten
+	RewrittenFrom string
+	original      string
 }
 
 type ContainerImageList []*ContainerImage
@@ -39,10 +42,7 @@ func (img *ContainerImage) String() string {
 		str += img.RegistryURL + "/"
 	}
 	str += img.ImageName
-	if img.ImageTag != nil {
-		str += ":"
-		str += img.ImageTag.TagName
-	}
+	str += img.tagSuffix()
 	return str
 }
 
@@ -61,13 +61,38 @@ func (img *ContainerImage) GetFullNameWithTag() string {
 		str += img.RegistryURL + "/"
 	}
 	str += img.ImageName
-	if img.ImageTag != nil {
-		str += ":"
-		str += img.ImageTag.TagName
-	}
+	str += img.tagSuffix()
 	return str
 }
 
+// tagSuffix returns the tag of the image as it is appended to the name,
+// including the digest the image is pinned to, if any
+func (img *ContainerImage) tagSuffix() string {
+	switch {
+	case img.ImageTag == nil:
+		return ""
+	case img.ImageTag.TagName == "" && img.ImageTag.TagDigest != "":
+		return "@" + img.ImageTag.TagDigest
+	default:
+		return ":" + img.ImageTag.TagWithDigest()
+	}
+}
+
+// IsDigestPinned returns whether the image is referenced by a digest, i.e.
+// foo/bar@sha256:...
+func (img *ContainerImage) IsDigestPinned() bool {
+	return img.ImageTag != nil && img.ImageTag.TagDigest != ""
+}
+
+// GetPlatform returns the platform (os/arch) the image's tag was resolved
+// for, or the empty string if it is not known.
+func (img *ContainerImage) GetPlatform() string {
+	if img.ImageTag == nil {
+		return ""
+	}
+	return img.ImageTag.TagPlatform
+}
+
 func (img *ContainerImage) Original() string {
 	return img.original
 }
@@ -88,6 +113,7 @@ func (img *ContainerImage) WithTag(newTag *tag.ImageTag) *ContainerImage {
 	nimg.ImageAlias = img.ImageAlias
 	nimg.HelmParamImageName = img.HelmParamImageName
 	nimg.HelmParamImageVersion = img.HelmParamImageVersion
+	nimg.RewrittenFrom = img.RewrittenFrom
 	return nimg
 }
 
@@ -149,7 +175,21 @@ func getImageTagFromIdentifier(identifier string) (string, string, *tag.ImageTag
 		imageString = strings.Join(comp[1:], "/")
 	}
 
+	// The image might be pinned to a digest, optionally along with a tag
+	var digest string
+	if comp = strings.SplitN(imageString, "@", 2); len(comp) == 2 {
+		imageString, digest = comp[0], comp[1]
+	}
+
 	comp = strings.SplitN(imageString, ":", 2)
+	if digest != "" {
+		imgTag := tag.NewImageTag("", time.Unix(0, 0))
+		if len(comp) == 2 {
+			imgTag.TagName = comp[1]
+		}
+		imgTag.TagDigest = digest
+		return sourceName, comp[0], imgTag
+	}
 	if len(comp) != 2 {
 		return sourceName, imageString, nil
 	} else {
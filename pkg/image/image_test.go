@@ -22,6 +22,28 @@ func Test_ParseImageTags(t *testing.T) {
 		assert.Equal(t, "jannfis/test-image", image.GetFullNameWithoutTag())
 	})
 
+	t.Run("Parse image pinned to a digest", func(t *testing.T) {
+		image := NewFromIdentifier("gcr.io/jannfis/test-image@sha256:abcdef")
+		assert.Equal(t, "gcr.io", image.RegistryURL)
+		assert.Equal(t, "jannfis/test-image", image.ImageName)
+		require.NotNil(t, image.ImageTag)
+		assert.Equal(t, "", image.ImageTag.TagName)
+		assert.Equal(t, "sha256:abcdef", image.ImageTag.TagDigest)
+		assert.True(t, image.IsDigestPinned())
+		assert.Equal(t, "gcr.io/jannfis/test-image@sha256:abcdef", image.GetFullNameWithTag())
+	})
+
+	t.Run("Parse image pinned to a digest with tag", func(t *testing.T) {
+		image := NewFromIdentifier("jannfis/test-image:0.1@sha256:abcdef")
+		assert.Equal(t, "jannfis/test-image", image.ImageName)
+		require.NotNil(t, image.ImageTag)
+		assert.Equal(t, "0.1", image.ImageTag.TagName)
+		assert.Equal(t, "sha256:abcdef", image.ImageTag.TagDigest)
+		assert.True(t, image.IsDigestPinned())
+		assert.Equal(t, "jannfis/test-image:0.1@sha256:abcdef", image.GetFullNameWithTag())
+		assert.False(t, NewFromIdentifier("jannfis/test-image:0.1").IsDigestPinned())
+	})
+
 	t.Run("Parse valid image name with registry info", func(t *testing.T) {
 		image := NewFromIdentifier("gcr.io/jannfis/test-image:0.1")
 		assert.Equal(t, "gcr.io", image.RegistryURL)
@@ -1,7 +1,9 @@
 package image
 
 import (
+	"fmt"
 	"regexp"
+	"strings"
 
 	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
 )
@@ -25,3 +27,73 @@ func MatchFuncRegexp(tagName string, args interface{}) bool {
 	}
 	return pattern.Match([]byte(tagName))
 }
+
+// Glob is a compiled glob-like pattern for matching tag names. It supports
+// the same syntax as the patterns for ignoring tags: '*' matches any sequence
+// of characters, '?' matches any single character, '[...]' matches a class of
+// characters and '\' escapes the character following it.
+type Glob struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// CompileGlob compiles the given glob-like pattern, which must match the tag
+// name as a whole
+func CompileGlob(pattern string) (*Glob, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		case '\\':
+			if i+1 >= len(pattern) {
+				return nil, fmt.Errorf("pattern %s ends with an escape character", pattern)
+			}
+			i += 1
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("pattern %s has an unterminated character class", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("could not compile pattern %s: %v", pattern, err)
+	}
+	return &Glob{pattern: pattern, re: re}, nil
+}
+
+// Match returns whether the tag name matches the pattern
+func (g *Glob) Match(tagName string) bool {
+	return g.re.MatchString(tagName)
+}
+
+// String returns the pattern the glob was compiled from
+func (g *Glob) String() string {
+	return g.pattern
+}
+
+// MatchFuncGlob matches the tagName against a compiled glob pattern and
+// returns the result
+func MatchFuncGlob(tagName string, args interface{}) bool {
+	pattern, ok := args.(*Glob)
+	if !ok {
+		log.Errorf("args is not a Glob")
+		return false
+	}
+	return pattern.Match(tagName)
+}
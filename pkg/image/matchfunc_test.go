@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_MatchFuncAny(t *testing.T) {
@@ -25,3 +26,34 @@ func Test_MatchFuncRegexp(t *testing.T) {
 		assert.False(t, MatchFuncRegexp("lemon", "[a-z]+"))
 	})
 }
+
+func Test_MatchFuncGlob(t *testing.T) {
+	t.Run("Test with valid patterns", func(t *testing.T) {
+		glob, err := CompileGlob("release-*")
+		require.NoError(t, err)
+		assert.True(t, MatchFuncGlob("release-1.0", glob))
+		assert.False(t, MatchFuncGlob("pre-release-1.0", glob))
+		assert.Equal(t, "release-*", glob.String())
+
+		glob, err = CompileGlob("v?.?.?")
+		require.NoError(t, err)
+		assert.True(t, MatchFuncGlob("v1.2.3", glob))
+		assert.False(t, MatchFuncGlob("v1.22.3", glob))
+		assert.False(t, MatchFuncGlob("v1x2x3", glob))
+
+		glob, err = CompileGlob("[!a-z]*-\\*")
+		require.NoError(t, err)
+		assert.True(t, MatchFuncGlob("1.0-*", glob))
+		assert.False(t, MatchFuncGlob("a1.0-*", glob))
+		assert.False(t, MatchFuncGlob("1.0-rc1", glob))
+	})
+	t.Run("Test with invalid patterns", func(t *testing.T) {
+		_, err := CompileGlob("release-[0-9")
+		assert.Error(t, err)
+		_, err = CompileGlob("release-\\")
+		assert.Error(t, err)
+	})
+	t.Run("Test with invalid type", func(t *testing.T) {
+		assert.False(t, MatchFuncGlob("release-1.0", "release-*"))
+	})
+}
@@ -0,0 +1,137 @@
+package image
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+// TagNormalization defines how tag names are normalized into the key that is
+// used for matching, comparing and de-duplicating tags. The steps are always
+// applied in the following order:
+//
+//  1. StripPrefix is removed from the beginning of the tag name
+//  2. If CaseFold is set, the result is converted to lower case
+//  3. If ChartVersion is set, the first underscore is replaced by a plus
+//     sign, which Helm replaces the other way round when pushing charts
+//     with build metadata to OCI registries
+//  4. If Extract is set, the capture group named version of its match
+//     becomes the key. If it has no such group, the first capture group (or
+//     the whole match, if it has no capture groups) becomes the key.
+//
+// The original tag name is always kept for writing back.
+type TagNormalization struct {
+	StripPrefix  string
+	CaseFold     bool
+	ChartVersion bool
+	Extract      *regexp.Regexp
+}
+
+// VersionCaptureGroup is the name of the capture group of an extraction
+// pattern whose value becomes the key of a tag
+const VersionCaptureGroup = "version"
+
+// NormalizeTag runs raw through the normalization pipeline of the given
+// constraint and returns the key to compare the tag by, and the original tag
+// name. If the tag does not match the extraction pattern, the returned key is
+// empty.
+func NormalizeTag(raw string, vc *VersionConstraint) (string, string) {
+	key, _ := normalizeTag(raw, vc)
+	return key, raw
+}
+
+// NormalizationError returns why the given tag has no key, i.e. because it
+// does not match the extraction pattern, or nil if it has one.
+func NormalizationError(raw string, vc *VersionConstraint) error {
+	_, err := normalizeTag(raw, vc)
+	return err
+}
+
+// normalizeTag returns the key of the given tag, or an error if the tag does
+// not match the extraction pattern
+func normalizeTag(raw string, vc *VersionConstraint) (string, error) {
+	if vc == nil || vc.Normalization == nil {
+		return raw, nil
+	}
+	tn := vc.Normalization
+	key := strings.TrimPrefix(raw, tn.StripPrefix)
+	if tn.CaseFold {
+		key = strings.ToLower(key)
+	}
+	if tn.ChartVersion {
+		key = strings.Replace(key, "_", "+", 1)
+	}
+	if tn.Extract != nil {
+		return tn.extract(key)
+	}
+	return key, nil
+}
+
+// extract returns the part of key to compare the tag by, as matched by the
+// extraction pattern
+func (tn *TagNormalization) extract(key string) (string, error) {
+	m := tn.Extract.FindStringSubmatchIndex(key)
+	if m == nil {
+		return "", fmt.Errorf("does not match extraction pattern %s", tn.Extract)
+	}
+	group, named := 0, false
+	for i, name := range tn.Extract.SubexpNames() {
+		if name == VersionCaptureGroup {
+			group, named = i, true
+			break
+		}
+	}
+	if !named && len(m) > 2 {
+		group = 1
+	}
+	if m[2*group] < 0 || m[2*group] == m[2*group+1] {
+		if named {
+			return "", fmt.Errorf("capture group %s of extraction pattern %s did not match", VersionCaptureGroup, tn.Extract)
+		}
+		return "", fmt.Errorf("does not match extraction pattern %s", tn.Extract)
+	}
+	return key[m[2*group]:m[2*group+1]], nil
+}
+
+// normalizeTagList returns a list of tags that are named by their normalized
+// keys, and a map to look up the original tag for each key. If more than one
+// tag normalizes to the same key, the tag whose name equals the key is kept,
+// or otherwise the one with the lexically lowest name. Tags that are dropped
+// are recorded in excluded.
+func normalizeTagList(tagList *tag.ImageTagList, vc *VersionConstraint, excluded TagExclusions) (*tag.ImageTagList, map[string]*tag.ImageTag) {
+	normList := tag.NewImageTagList()
+	originals := make(map[string]*tag.ImageTag)
+
+	names := tagList.Tags()
+	sort.Strings(names)
+	for _, name := range names {
+		key, _ := NormalizeTag(name, vc)
+		if vc.IsTagAllowed(name) {
+			key = name
+		}
+		if key == "" {
+			log.Tracef("Tag %s does not match normalization pattern", name)
+			excluded.Exclude(name, "normalize", "%v", NormalizationError(name, vc))
+			continue
+		}
+		if existing, ok := originals[key]; ok {
+			if existing.TagName != key {
+				log.Tracef("Tags %s and %s both normalize to %s", existing.TagName, name, key)
+			}
+			if existing.TagName == key || name != key {
+				excluded.Exclude(name, "normalize", "duplicate of %s", existing.TagName)
+				continue
+			}
+			excluded.Exclude(existing.TagName, "normalize", "duplicate of %s", name)
+		}
+		orig := tagList.Get(name)
+		originals[key] = orig
+		normList.Add(&tag.ImageTag{TagName: key, TagDate: orig.TagDate, TagDigest: orig.TagDigest, TagPlatform: orig.TagPlatform, TagInfo: orig.TagInfo})
+	}
+
+	return normList, originals
+}
@@ -0,0 +1,123 @@
+package image
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NormalizeTag(t *testing.T) {
+	t.Run("No normalization", func(t *testing.T) {
+		key, orig := NormalizeTag("V1.0.0", &VersionConstraint{})
+		assert.Equal(t, "V1.0.0", key)
+		assert.Equal(t, "V1.0.0", orig)
+	})
+	t.Run("Pipeline is applied in order", func(t *testing.T) {
+		vc := &VersionConstraint{Normalization: &TagNormalization{
+			StripPrefix: "release-",
+			CaseFold:    true,
+			Extract:     regexp.MustCompile(`^v(\d+\.\d+\.\d+)`),
+		}}
+		key, orig := NormalizeTag("release-V1.2.3-Build42", vc)
+		assert.Equal(t, "1.2.3", key)
+		assert.Equal(t, "release-V1.2.3-Build42", orig)
+	})
+	t.Run("Extraction without capture group", func(t *testing.T) {
+		vc := &VersionConstraint{Normalization: &TagNormalization{
+			Extract: regexp.MustCompile(`\d+\.\d+\.\d+`),
+		}}
+		key, _ := NormalizeTag("app-1.2.3-alpine", vc)
+		assert.Equal(t, "1.2.3", key)
+	})
+	t.Run("Extraction does not match", func(t *testing.T) {
+		vc := &VersionConstraint{Normalization: &TagNormalization{
+			Extract: regexp.MustCompile(`^\d+\.\d+\.\d+$`),
+		}}
+		key, orig := NormalizeTag("latest", vc)
+		assert.Equal(t, "", key)
+		assert.Equal(t, "latest", orig)
+	})
+	t.Run("Extraction by named capture group", func(t *testing.T) {
+		vc := &VersionConstraint{Normalization: &TagNormalization{
+			Extract: regexp.MustCompile(`^(build)-(?P<version>\d+\.\d+\.\d+)-([a-f0-9]+)$`),
+		}}
+		key, orig := NormalizeTag("build-1.4.2-abc123", vc)
+		assert.Equal(t, "1.4.2", key)
+		assert.Equal(t, "build-1.4.2-abc123", orig)
+		assert.NoError(t, NormalizationError("build-1.4.2-abc123", vc))
+	})
+	t.Run("Named capture group is missing from tag", func(t *testing.T) {
+		vc := &VersionConstraint{Normalization: &TagNormalization{
+			Extract: regexp.MustCompile(`^build-(?P<version>\d+\.\d+\.\d+)?-?[a-f0-9]+$`),
+		}}
+		key, _ := NormalizeTag("build-abc123", vc)
+		assert.Equal(t, "", key)
+		err := NormalizationError("build-abc123", vc)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "capture group version of extraction pattern")
+		err = NormalizationError("latest", vc)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "does not match extraction pattern")
+	})
+}
+
+func Test_SelectVersionNormalized(t *testing.T) {
+	t.Run("Select by normalized key and return original", func(t *testing.T) {
+		tagList := newImageTagList([]string{"V1.0.0", "V1.2.0", "v1.1.0", "latest"})
+		img := NewFromIdentifier("jannfis/test:V1.0.0")
+		vc := VersionConstraint{Constraint: "^1.0", Normalization: &TagNormalization{CaseFold: true, StripPrefix: "V"}}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "V1.2.0", selection.Selected.TagName)
+		require.NotNil(t, selection.Alternative)
+		assert.Equal(t, "v1.1.0", selection.Alternative.TagName)
+	})
+	t.Run("Select by semver captured from tag", func(t *testing.T) {
+		tagList := newImageTagList([]string{"build-1.4.2-abc123", "build-1.10.0-def456", "build-1.9.1-0a1b2c", "build-abc123", "latest"})
+		img := NewFromIdentifier("jannfis/test:build-1.4.2-abc123")
+		vc := VersionConstraint{Constraint: "^1.0", Explain: true, Normalization: &TagNormalization{Extract: regexp.MustCompile(`^build-(?P<version>\d+\.\d+\.\d+)?-?[a-f0-9]+$`)}}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "build-1.10.0-def456", selection.Selected.TagName)
+		assert.Contains(t, selection.Excluded["build-abc123"], "capture group version")
+		assert.Contains(t, selection.Excluded["latest"], "does not match extraction pattern")
+	})
+	t.Run("Duplicate keys are de-duplicated", func(t *testing.T) {
+		tagList := newImageTagList([]string{"v1.0.0", "V1.0.0", "1.0.0"})
+		vc := VersionConstraint{Normalization: &TagNormalization{CaseFold: true, StripPrefix: "V", Extract: regexp.MustCompile(`^v?(.*)$`)}}
+		normList, originals := normalizeTagList(tagList, &vc, nil)
+		assert.Equal(t, []string{"1.0.0"}, normList.Tags())
+		assert.Equal(t, "1.0.0", originals["1.0.0"].TagName)
+	})
+}
+
+func Test_SelectChartVersion(t *testing.T) {
+	t.Run("Underscore is build metadata of chart versions", func(t *testing.T) {
+		vc := &VersionConstraint{}
+		vc.UseChartVersions()
+		key, orig := NormalizeTag("1.2.3_build.4", vc)
+		assert.Equal(t, "1.2.3+build.4", key)
+		assert.Equal(t, "1.2.3_build.4", orig)
+	})
+	t.Run("Chart versions keep other normalization", func(t *testing.T) {
+		vc := &VersionConstraint{Normalization: &TagNormalization{StripPrefix: "v"}}
+		vc.UseChartVersions()
+		key, _ := NormalizeTag("v1.2.3_a_b", vc)
+		assert.Equal(t, "1.2.3+a_b", key)
+		assert.NotEqual(t, (&VersionConstraint{Normalization: &TagNormalization{StripPrefix: "v"}}).Key(), vc.Key())
+	})
+	t.Run("Select newest chart version and return original tag", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.0.0", "1.1.0_abc", "1.0.1_def", "latest"})
+		img := NewFromIdentifier("charts/test:1.0.0")
+		vc := &VersionConstraint{Constraint: "^1.0"}
+		vc.UseChartVersions()
+		selection, err := img.SelectVersionFromTags(vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "1.1.0_abc", selection.Selected.TagName)
+	})
+}
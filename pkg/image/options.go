@@ -3,10 +3,14 @@ package image
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/argoproj-labs/argocd-image-updater/pkg/common"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+
+	"github.com/Masterminds/semver"
 )
 
 // GetParameterHelmImageName gets the value for image-name option for the image
@@ -42,6 +46,17 @@ func (img *ContainerImage) GetParameterHelmImageSpec(annotations map[string]stri
 	return val
 }
 
+// GetParameterHelmImagePlatform gets the value for image-platform option for
+// the image from a set of annotations
+func (img *ContainerImage) GetParameterHelmImagePlatform(annotations map[string]string) string {
+	key := fmt.Sprintf(common.HelmParamImagePlatformAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		return ""
+	}
+	return val
+}
+
 // GetParameterKustomizeImageName gets the value for image-spec option for the
 // image from a set of annotations
 func (img *ContainerImage) GetParameterKustomizeImageName(annotations map[string]string) string {
@@ -53,6 +68,17 @@ func (img *ContainerImage) GetParameterKustomizeImageName(annotations map[string
 	return val
 }
 
+// GetParameterKustomizeImagePlatform gets the value for image-platform option
+// for the image from a set of annotations
+func (img *ContainerImage) GetParameterKustomizeImagePlatform(annotations map[string]string) string {
+	key := fmt.Sprintf(common.KustomizeImagePlatformAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		return ""
+	}
+	return val
+}
+
 // GetParameterSort gets and validates the value for the sort option for the
 // image from a set of annotations
 func (img *ContainerImage) GetParameterUpdateStrategy(annotations map[string]string) VersionSortMode {
@@ -75,6 +101,12 @@ func ParseUpdateStrategy(val string) VersionSortMode {
 		return VersionSortLatest
 	case "name":
 		return VersionSortName
+	case "digest":
+		return VersionSortDigest
+	case "tag-date":
+		return VersionSortDate
+	case "external":
+		return VersionSortExternal
 	default:
 		log.Warnf("Unknown sort option %s -- using semver", val)
 		return VersionSortSemVer
@@ -125,6 +157,13 @@ func ParseMatchfunc(val string) (MatchFuncFn, interface{}) {
 			return MatchFuncNone, nil
 		}
 		return MatchFuncRegexp, re
+	case "glob":
+		glob, err := CompileGlob(opt[1])
+		if err != nil {
+			log.Warnf("Could not compile glob '%s': %v", opt[1], err)
+			return MatchFuncNone, nil
+		}
+		return MatchFuncGlob, glob
 	default:
 		log.Warnf("Unknown match function: %s", opt[0])
 		return MatchFuncNone, nil
@@ -167,6 +206,450 @@ func (img *ContainerImage) GetParameterIgnoreTags(annotations map[string]string)
 	return ignoreList
 }
 
+// GetParameterRequirePlatforms retrieves the list of platforms a tag must be
+// available for from a comma-separated string
+func (img *ContainerImage) GetParameterRequirePlatforms(annotations map[string]string) []string {
+	key := fmt.Sprintf(common.RequirePlatformsAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No require-platforms annotation %s found", key)
+		return nil
+	}
+	platforms := make([]string, 0)
+	for _, platform := range strings.Split(val, ",") {
+		trimmed := strings.TrimSpace(platform)
+		if trimmed == "" {
+			continue
+		}
+		if len(strings.Split(trimmed, "/")) < 2 {
+			log.Warnf("Invalid platform %s in require-platforms, must be os/arch -- ignoring", trimmed)
+			continue
+		}
+		platforms = append(platforms, trimmed)
+	}
+	return platforms
+}
+
+// GetParameterRequireLabels retrieves the labels a tag's image configuration
+// must carry from a comma-separated list of name=value pairs
+func (img *ContainerImage) GetParameterRequireLabels(annotations map[string]string) map[string]string {
+	key := fmt.Sprintf(common.RequireLabelsAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No require-labels annotation %s found", key)
+		return nil
+	}
+	labels := make(map[string]string)
+	for _, label := range strings.Split(val, ",") {
+		trimmed := strings.TrimSpace(label)
+		if trimmed == "" {
+			continue
+		}
+		nv := strings.SplitN(trimmed, "=", 2)
+		if len(nv) != 2 || strings.TrimSpace(nv[0]) == "" {
+			log.Warnf("Invalid label %s in require-labels, must be name=value -- ignoring", trimmed)
+			continue
+		}
+		labels[strings.TrimSpace(nv[0])] = strings.TrimSpace(nv[1])
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// GetParameterMinTags retrieves the minimum fraction of the last known number
+// of tags the registry must return, given either as a percentage, i.e. "90%",
+// or as a fraction, i.e. "0.9". Returns 0 if not set or invalid.
+func (img *ContainerImage) GetParameterMinTags(annotations map[string]string) float64 {
+	key := fmt.Sprintf(common.MinTagsAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No min-tags annotation %s found", key)
+		return 0
+	}
+	trimmed := strings.TrimSpace(val)
+	percent := strings.HasSuffix(trimmed, "%")
+	minTags, err := strconv.ParseFloat(strings.TrimSuffix(trimmed, "%"), 64)
+	if err == nil && percent {
+		minTags /= 100
+	}
+	if err != nil || minTags < 0 || minTags > 1 {
+		log.Warnf("Invalid value for min-tags: %s -- ignoring", val)
+		return 0
+	}
+	return minTags
+}
+
+// GetParameterSortCommand retrieves the name of the command that sorts the
+// tags with the external update strategy. Returns the empty string if not
+// set.
+func (img *ContainerImage) GetParameterSortCommand(annotations map[string]string) string {
+	key := fmt.Sprintf(common.SortCommandAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No sort-command annotation %s found", key)
+		return ""
+	}
+	return strings.TrimSpace(val)
+}
+
+// GetParameterSkipSameDigest retrieves whether updates to a tag pointing to
+// the same digest as the current tag are skipped
+func (img *ContainerImage) GetParameterSkipSameDigest(annotations map[string]string) bool {
+	key := fmt.Sprintf(common.SkipSameDigestAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No skip-same-digest annotation %s found", key)
+		return false
+	}
+	return strings.ToLower(strings.TrimSpace(val)) == "true"
+}
+
+// GetParameterPinDigest retrieves whether the image is written back with the
+// digest the new tag points to, in addition to the tag
+func (img *ContainerImage) GetParameterPinDigest(annotations map[string]string) bool {
+	key := fmt.Sprintf(common.PinDigestAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No pin-digest annotation %s found", key)
+		return false
+	}
+	return strings.ToLower(strings.TrimSpace(val)) == "true"
+}
+
+// GetParameterCompareBuildMetadata retrieves whether versions that only
+// differ in their build metadata are ordered by it
+func (img *ContainerImage) GetParameterCompareBuildMetadata(annotations map[string]string) bool {
+	key := fmt.Sprintf(common.BuildMetadataAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No compare-build-metadata annotation %s found", key)
+		return false
+	}
+	return strings.ToLower(strings.TrimSpace(val)) == "true"
+}
+
+// GetParameterRequireSignature retrieves the policy for the signatures tags
+// must carry to be considered for update, or nil if no signature is
+// required. Signatures are verified using the public key named in the
+// signature-key annotation, or keyless using the signature-identity and
+// signature-issuer annotations. If the policy cannot be set up, i.e. because
+// the key does not exist, a policy that no signature satisfies is returned,
+// so that misconfigured images are not updated at all.
+func (img *ContainerImage) GetParameterRequireSignature(annotations map[string]string) *SignaturePolicy {
+	name := img.normalizedSymbolicName()
+	keyName := strings.TrimSpace(annotations[fmt.Sprintf(common.SignatureKeyAnnotation, name)])
+	identity := strings.TrimSpace(annotations[fmt.Sprintf(common.SignerIdentityAnnotation, name)])
+	issuer := strings.TrimSpace(annotations[fmt.Sprintf(common.SignerIssuerAnnotation, name)])
+
+	var policy *SignaturePolicy
+	var err error
+	switch {
+	case keyName != "":
+		policy, err = NewKeySignaturePolicy(keyName)
+	case identity != "" || issuer != "":
+		policy, err = NewKeylessSignaturePolicy(identity, issuer)
+	default:
+		log.Tracef("No signature annotations found for %s", name)
+		return nil
+	}
+	if err != nil {
+		log.Errorf("Signatures of %s cannot be verified, no tag will be considered for update: %v", name, err)
+		return &SignaturePolicy{}
+	}
+	return policy
+}
+
+// GetParameterUpdateWindow retrieves the window of time in which the image
+// may be updated, or nil if it may be updated at any time. If the window is
+// invalid, a window that never opens is returned, so that misconfigured
+// images are not updated at unwanted times.
+func (img *ContainerImage) GetParameterUpdateWindow(annotations map[string]string) *UpdateWindow {
+	key := fmt.Sprintf(common.UpdateWindowAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No update-window annotation %s found", key)
+		return nil
+	}
+	window, err := ParseUpdateWindow(val)
+	if err != nil {
+		log.Errorf("Invalid update window for %s, image will not be updated: %v", img.normalizedSymbolicName(), err)
+		return &UpdateWindow{}
+	}
+	return window
+}
+
+// GetParameterMaxAge retrieves the maximum age of tags to be considered for
+// update, given as a duration, i.e. "720h", or as a number of days, i.e.
+// "180d". Returns 0 if not set or invalid.
+func (img *ContainerImage) GetParameterMaxAge(annotations map[string]string) time.Duration {
+	key := fmt.Sprintf(common.MaxAgeAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No max-age annotation %s found", key)
+		return 0
+	}
+	trimmed := strings.TrimSpace(val)
+	var maxAge time.Duration
+	var err error
+	if strings.HasSuffix(trimmed, "d") {
+		var days int64
+		days, err = strconv.ParseInt(strings.TrimSuffix(trimmed, "d"), 10, 64)
+		maxAge = time.Duration(days) * 24 * time.Hour
+	} else {
+		maxAge, err = time.ParseDuration(trimmed)
+	}
+	if err != nil || maxAge < 0 {
+		log.Warnf("Invalid value for max-age: %s -- ignoring", val)
+		return 0
+	}
+	return maxAge
+}
+
+// GetParameterMissingAge retrieves the policy for tags without known
+// creation date
+func (img *ContainerImage) GetParameterMissingAge(annotations map[string]string) MissingDataPolicy {
+	key := fmt.Sprintf(common.MissingAgeAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No missing-age annotation %s found", key)
+		return MissingDataKeep
+	}
+	return ParseMissingDataPolicy(val)
+}
+
+// GetParameterMinDownloads retrieves the minimum number of pulls a tag must
+// have to be considered for update. Returns 0 if not set or invalid.
+func (img *ContainerImage) GetParameterMinDownloads(annotations map[string]string) int64 {
+	key := fmt.Sprintf(common.MinDownloadsAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No min-downloads annotation %s found", key)
+		return 0
+	}
+	minDownloads, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+	if err != nil || minDownloads < 0 {
+		log.Warnf("Invalid value for min-downloads: %s -- ignoring", val)
+		return 0
+	}
+	return minDownloads
+}
+
+// GetParameterMaxTags retrieves the maximum number of tags that are considered
+// for update. Returns 0 if not set or invalid.
+func (img *ContainerImage) GetParameterMaxTags(annotations map[string]string) int {
+	key := fmt.Sprintf(common.MaxTagsAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No max-tags annotation %s found", key)
+		return 0
+	}
+	maxTags, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil || maxTags < 0 {
+		log.Warnf("Invalid value for max-tags: %s -- ignoring", val)
+		return 0
+	}
+	return maxTags
+}
+
+// GetParameterMissingDownloads retrieves the policy for tags without known
+// pull count
+func (img *ContainerImage) GetParameterMissingDownloads(annotations map[string]string) MissingDataPolicy {
+	key := fmt.Sprintf(common.MissingDownloadsAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No missing-downloads annotation %s found", key)
+		return MissingDataKeep
+	}
+	return ParseMissingDataPolicy(val)
+}
+
+// ParseMissingDataPolicy returns the MissingDataPolicy for given value
+func ParseMissingDataPolicy(val string) MissingDataPolicy {
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "keep":
+		return MissingDataKeep
+	case "drop":
+		return MissingDataDrop
+	default:
+		log.Warnf("Unknown policy for missing data %s -- using keep", val)
+		return MissingDataKeep
+	}
+}
+
+// GetParameterVariantSuffix retrieves the suffix of the image variant to track
+func (img *ContainerImage) GetParameterVariantSuffix(annotations map[string]string) string {
+	key := fmt.Sprintf(common.VariantSuffixAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No variant-suffix annotation %s found", key)
+		return ""
+	}
+	return strings.TrimSpace(val)
+}
+
+// GetParameterIncludePlatform returns whether the platform of the selected
+// tag should be resolved and recorded
+func (img *ContainerImage) GetParameterIncludePlatform(annotations map[string]string) bool {
+	key := fmt.Sprintf(common.IncludePlatformAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No include-platform annotation %s found", key)
+		return false
+	}
+	return strings.ToLower(strings.TrimSpace(val)) == "true"
+}
+
+// GetParameterIgnorePrerelease returns whether tags that are pre-release
+// versions should be ignored, and the semver constraint of the versions for
+// which pre-releases are still allowed
+func (img *ContainerImage) GetParameterIgnorePrerelease(annotations map[string]string) (bool, string) {
+	key := fmt.Sprintf(common.IgnorePrereleaseAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No ignore-prerelease annotation %s found", key)
+		return false, ""
+	}
+	if strings.ToLower(strings.TrimSpace(val)) != "true" {
+		return false, ""
+	}
+	key = fmt.Sprintf(common.AllowPrereleaseAnnotation, img.normalizedSymbolicName())
+	val, ok = annotations[key]
+	if !ok {
+		log.Tracef("No allow-prerelease-for annotation %s found", key)
+		return true, ""
+	}
+	val = strings.TrimSpace(val)
+	if _, err := semver.NewConstraint(val); err != nil {
+		log.Warnf("Invalid constraint '%s' for allowing pre-releases, ignoring all pre-releases: %v", val, err)
+		return true, ""
+	}
+	return true, val
+}
+
+// GetParameterTagNormalization retrieves the normalization to apply to tag
+// names before matching and comparing them. Returns nil if no normalization
+// is configured.
+func (img *ContainerImage) GetParameterTagNormalization(annotations map[string]string) *TagNormalization {
+	tn := &TagNormalization{}
+	configured := false
+
+	key := fmt.Sprintf(common.TagStripPrefixAnnotation, img.normalizedSymbolicName())
+	if val, ok := annotations[key]; ok {
+		tn.StripPrefix = strings.TrimSpace(val)
+		configured = true
+	}
+
+	key = fmt.Sprintf(common.TagCaseFoldAnnotation, img.normalizedSymbolicName())
+	if val, ok := annotations[key]; ok {
+		tn.CaseFold = strings.ToLower(strings.TrimSpace(val)) == "true"
+		configured = true
+	}
+
+	key = fmt.Sprintf(common.TagExtractAnnotation, img.normalizedSymbolicName())
+	if val, ok := annotations[key]; ok {
+		re, err := regexp.Compile(strings.TrimSpace(val))
+		if err != nil {
+			log.Warnf("Invalid regular expression for tag-extract: %s -- ignoring: %v", val, err)
+		} else {
+			tn.Extract = re
+			configured = true
+		}
+	}
+
+	if !configured {
+		log.Tracef("No tag normalization configured for %s", img.normalizedSymbolicName())
+		return nil
+	}
+	return tn
+}
+
+// GetParameterMaxJump retrieves the maximum number of steps an update may go
+// beyond the current version, and the unit the steps are counted in. The value
+// is either a number of positions in the sorted list of tags, i.e. "2", or a
+// unit followed by a number, i.e. "minor:1". Returns 0 if not set or invalid.
+func (img *ContainerImage) GetParameterMaxJump(annotations map[string]string) (int, JumpUnit) {
+	key := fmt.Sprintf(common.MaxJumpAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No max-jump annotation %s found", key)
+		return 0, JumpUnitTag
+	}
+	return ParseMaxJump(val)
+}
+
+// ParseMaxJump returns the maximum number of steps and their unit from given
+// value
+func ParseMaxJump(val string) (int, JumpUnit) {
+	unit := JumpUnitTag
+	steps := strings.TrimSpace(val)
+	if opt := strings.SplitN(steps, ":", 2); len(opt) == 2 {
+		switch strings.ToLower(strings.TrimSpace(opt[0])) {
+		case "major":
+			unit = JumpUnitMajor
+		case "minor":
+			unit = JumpUnitMinor
+		case "patch":
+			unit = JumpUnitPatch
+		case "tag":
+			unit = JumpUnitTag
+		default:
+			log.Warnf("Unknown unit for max-jump: %s -- ignoring", val)
+			return 0, JumpUnitTag
+		}
+		steps = strings.TrimSpace(opt[1])
+	}
+	n, err := strconv.Atoi(steps)
+	if err != nil || n < 0 {
+		log.Warnf("Invalid value for max-jump: %s -- ignoring", val)
+		return 0, JumpUnitTag
+	}
+	return n, unit
+}
+
+// GetParameterLockTrack retrieves the part of the current version all tags
+// considered for update must share with it, which is either "major" or
+// "minor". Returns LockNone if not set or invalid.
+func (img *ContainerImage) GetParameterLockTrack(annotations map[string]string) TrackLock {
+	key := fmt.Sprintf(common.LockTrackAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No lock-track annotation %s found", key)
+		return LockNone
+	}
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "major":
+		return LockMajor
+	case "minor":
+		return LockMinor
+	case "none", "":
+		return LockNone
+	default:
+		log.Warnf("Unknown value for lock-track: %s -- ignoring", val)
+		return LockNone
+	}
+}
+
+// GetParameterTagDate retrieves the pattern for extracting the date embedded
+// in tag names, and the layout of the date. Returns a nil pattern if not set
+// or invalid.
+func (img *ContainerImage) GetParameterTagDate(annotations map[string]string) (*regexp.Regexp, string) {
+	key := fmt.Sprintf(common.TagDatePatternAnnotation, img.normalizedSymbolicName())
+	val, ok := annotations[key]
+	if !ok {
+		log.Tracef("No tag-date-pattern annotation %s found", key)
+		return nil, ""
+	}
+	re, err := regexp.Compile(strings.TrimSpace(val))
+	if err != nil {
+		log.Warnf("Invalid regular expression for tag-date-pattern: %s -- ignoring: %v", val, err)
+		return nil, ""
+	}
+	key = fmt.Sprintf(common.TagDateLayoutAnnotation, img.normalizedSymbolicName())
+	return re, strings.TrimSpace(annotations[key])
+}
+
 func (img *ContainerImage) normalizedSymbolicName() string {
 	return strings.ReplaceAll(img.ImageAlias, "/", "_")
 }
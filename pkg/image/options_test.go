@@ -2,8 +2,12 @@ package image
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/argoproj-labs/argocd-image-updater/pkg/common"
 
@@ -14,18 +18,21 @@ import (
 func Test_GetHelmOptions(t *testing.T) {
 	t.Run("Get Helm parameter for configured application", func(t *testing.T) {
 		annotations := map[string]string{
-			fmt.Sprintf(common.HelmParamImageNameAnnotation, "dummy"): "release.name",
-			fmt.Sprintf(common.HelmParamImageTagAnnotation, "dummy"):  "release.tag",
-			fmt.Sprintf(common.HelmParamImageSpecAnnotation, "dummy"): "release.image",
+			fmt.Sprintf(common.HelmParamImageNameAnnotation, "dummy"):     "release.name",
+			fmt.Sprintf(common.HelmParamImageTagAnnotation, "dummy"):      "release.tag",
+			fmt.Sprintf(common.HelmParamImageSpecAnnotation, "dummy"):     "release.image",
+			fmt.Sprintf(common.HelmParamImagePlatformAnnotation, "dummy"): "release.platform",
 		}
 
 		img := NewFromIdentifier("dummy=foo/bar:1.12")
 		paramName := img.GetParameterHelmImageName(annotations)
 		paramTag := img.GetParameterHelmImageTag(annotations)
 		paramSpec := img.GetParameterHelmImageSpec(annotations)
+		paramPlatform := img.GetParameterHelmImagePlatform(annotations)
 		assert.Equal(t, "release.name", paramName)
 		assert.Equal(t, "release.tag", paramTag)
 		assert.Equal(t, "release.image", paramSpec)
+		assert.Equal(t, "release.platform", paramPlatform)
 	})
 
 	t.Run("Get Helm parameter for non-configured application", func(t *testing.T) {
@@ -65,11 +72,14 @@ func Test_GetKustomizeOptions(t *testing.T) {
 	t.Run("Get Helm parameter for configured application", func(t *testing.T) {
 		annotations := map[string]string{
 			fmt.Sprintf(common.KustomizeApplicationNameAnnotation, "dummy"): "argoproj/argo-cd",
+			fmt.Sprintf(common.KustomizeImagePlatformAnnotation, "dummy"):   "example.com/platform",
 		}
 
 		img := NewFromIdentifier("dummy=foo/bar:1.12")
 		paramName := img.GetParameterKustomizeImageName(annotations)
 		assert.Equal(t, "argoproj/argo-cd", paramName)
+		paramPlatform := img.GetParameterKustomizeImagePlatform(annotations)
+		assert.Equal(t, "example.com/platform", paramPlatform)
 	})
 }
 
@@ -102,6 +112,35 @@ func Test_GetSortOption(t *testing.T) {
 		assert.Equal(t, VersionSortName, sortMode)
 	})
 
+	t.Run("Get update strategy digest for configured application", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.UpdateStrategyAnnotation, "dummy"): "digest",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:stable")
+		sortMode := img.GetParameterUpdateStrategy(annotations)
+		assert.Equal(t, VersionSortDigest, sortMode)
+	})
+
+	t.Run("Get update strategy tag-date for configured application", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.UpdateStrategyAnnotation, "dummy"): "tag-date",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:app-20240115-1")
+		sortMode := img.GetParameterUpdateStrategy(annotations)
+		assert.Equal(t, VersionSortDate, sortMode)
+	})
+
+	t.Run("Get update strategy external for configured application", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.UpdateStrategyAnnotation, "dummy"): "external",
+			fmt.Sprintf(common.SortCommandAnnotation, "dummy"):    " calver-sort ",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:2024.01")
+		assert.Equal(t, VersionSortExternal, img.GetParameterUpdateStrategy(annotations))
+		assert.Equal(t, "calver-sort", img.GetParameterSortCommand(annotations))
+		assert.Equal(t, "", img.GetParameterSortCommand(map[string]string{}))
+	})
+
 	t.Run("Get update strategy option configured application because of invalid option", func(t *testing.T) {
 		annotations := map[string]string{
 			fmt.Sprintf(common.UpdateStrategyAnnotation, "dummy"): "invalid",
@@ -142,6 +181,28 @@ func Test_GetMatchOption(t *testing.T) {
 		require.Nil(t, matchArgs)
 	})
 
+	t.Run("Get glob match option for configured application", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.AllowTagsOptionAnnotation, "dummy"): "glob:release-*",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.12")
+		matchFunc, matchArgs := img.GetParameterMatch(annotations)
+		require.NotNil(t, matchFunc)
+		require.NotNil(t, matchArgs)
+		assert.IsType(t, &Glob{}, matchArgs)
+		assert.True(t, matchFunc("release-1.12", matchArgs))
+	})
+
+	t.Run("Get glob match option for configured application with invalid pattern", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.AllowTagsOptionAnnotation, "dummy"): "glob:release-[0-9",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.12")
+		matchFunc, matchArgs := img.GetParameterMatch(annotations)
+		require.NotNil(t, matchFunc)
+		require.Nil(t, matchArgs)
+	})
+
 	t.Run("Get invalid match option for configured application", func(t *testing.T) {
 		annotations := map[string]string{
 			fmt.Sprintf(common.AllowTagsOptionAnnotation, "dummy"): "invalid",
@@ -193,3 +254,366 @@ func Test_GetIgnoreTags(t *testing.T) {
 		assert.Equal(t, "tag4", tags[3])
 	})
 }
+
+func Test_GetMinDownloads(t *testing.T) {
+	t.Run("Get min-downloads and policy from annotations", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.MinDownloadsAnnotation, "dummy"):     "100",
+			fmt.Sprintf(common.MissingDownloadsAnnotation, "dummy"): "drop",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.12")
+		assert.Equal(t, int64(100), img.GetParameterMinDownloads(annotations))
+		assert.Equal(t, MissingDataDrop, img.GetParameterMissingDownloads(annotations))
+	})
+
+	t.Run("Get defaults without annotations", func(t *testing.T) {
+		img := NewFromIdentifier("dummy=foo/bar:1.12")
+		assert.Equal(t, int64(0), img.GetParameterMinDownloads(map[string]string{}))
+		assert.Equal(t, MissingDataKeep, img.GetParameterMissingDownloads(map[string]string{}))
+	})
+
+	t.Run("Invalid min-downloads value", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.MinDownloadsAnnotation, "dummy"): "many",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.12")
+		assert.Equal(t, int64(0), img.GetParameterMinDownloads(annotations))
+	})
+}
+
+func Test_GetMaxAge(t *testing.T) {
+	img := NewFromIdentifier("dummy=foo/bar:1.12")
+	for val, expected := range map[string]time.Duration{"180d": 180 * 24 * time.Hour, " 72h ": 72 * time.Hour, "1h30m": 90 * time.Minute, "-1d": 0, "-5m": 0, "old": 0, "d": 0} {
+		annotations := map[string]string{
+			fmt.Sprintf(common.MaxAgeAnnotation, "dummy"):     val,
+			fmt.Sprintf(common.MissingAgeAnnotation, "dummy"): "drop",
+		}
+		assert.Equal(t, expected, img.GetParameterMaxAge(annotations), "value %q", val)
+		assert.Equal(t, MissingDataDrop, img.GetParameterMissingAge(annotations))
+	}
+	assert.Equal(t, time.Duration(0), img.GetParameterMaxAge(map[string]string{}))
+	assert.Equal(t, MissingDataKeep, img.GetParameterMissingAge(map[string]string{}))
+}
+
+func Test_GetMinTags(t *testing.T) {
+	img := NewFromIdentifier("dummy=foo/bar:1.12")
+	for val, expected := range map[string]float64{"90%": 0.9, " 0.5 ": 0.5, "1": 1, "150%": 0, "-0.1": 0, "most": 0} {
+		annotations := map[string]string{
+			fmt.Sprintf(common.MinTagsAnnotation, "dummy"): val,
+		}
+		assert.InDelta(t, expected, img.GetParameterMinTags(annotations), 0.0001, "value %q", val)
+	}
+	assert.Equal(t, float64(0), img.GetParameterMinTags(map[string]string{}))
+}
+
+func Test_GetTagNormalization(t *testing.T) {
+	t.Run("Get normalization from annotations", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.TagStripPrefixAnnotation, "dummy"): "release-",
+			fmt.Sprintf(common.TagCaseFoldAnnotation, "dummy"):    "true",
+			fmt.Sprintf(common.TagExtractAnnotation, "dummy"):     `^v(\d+\.\d+)`,
+		}
+		img := NewFromIdentifier("dummy=foo/bar:release-v1.0")
+		tn := img.GetParameterTagNormalization(annotations)
+		require.NotNil(t, tn)
+		assert.Equal(t, "release-", tn.StripPrefix)
+		assert.True(t, tn.CaseFold)
+		require.NotNil(t, tn.Extract)
+		assert.Equal(t, `^v(\d+\.\d+)`, tn.Extract.String())
+	})
+	t.Run("No normalization configured", func(t *testing.T) {
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		assert.Nil(t, img.GetParameterTagNormalization(map[string]string{}))
+	})
+	t.Run("Invalid extraction pattern", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.TagExtractAnnotation, "dummy"): `(`,
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		assert.Nil(t, img.GetParameterTagNormalization(annotations))
+	})
+}
+
+func Test_GetTagDate(t *testing.T) {
+	t.Run("Get tag date pattern and layout from annotations", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.TagDatePatternAnnotation, "dummy"): `^app-(\d{8})-\d+$`,
+			fmt.Sprintf(common.TagDateLayoutAnnotation, "dummy"):  "20060102",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:app-20240115-1")
+		re, layout := img.GetParameterTagDate(annotations)
+		require.NotNil(t, re)
+		assert.Equal(t, `^app-(\d{8})-\d+$`, re.String())
+		assert.Equal(t, "20060102", layout)
+	})
+	t.Run("No tag date pattern configured", func(t *testing.T) {
+		img := NewFromIdentifier("dummy=foo/bar:app-20240115-1")
+		re, layout := img.GetParameterTagDate(map[string]string{})
+		assert.Nil(t, re)
+		assert.Equal(t, "", layout)
+	})
+	t.Run("Invalid tag date pattern", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.TagDatePatternAnnotation, "dummy"): `(`,
+		}
+		img := NewFromIdentifier("dummy=foo/bar:app-20240115-1")
+		re, _ := img.GetParameterTagDate(annotations)
+		assert.Nil(t, re)
+	})
+}
+
+func Test_GetMaxJump(t *testing.T) {
+	t.Run("Number of tags", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.MaxJumpAnnotation, "dummy"): "2",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		steps, unit := img.GetParameterMaxJump(annotations)
+		assert.Equal(t, 2, steps)
+		assert.Equal(t, JumpUnitTag, unit)
+	})
+	t.Run("Number of minor versions", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.MaxJumpAnnotation, "dummy"): "minor:1",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		steps, unit := img.GetParameterMaxJump(annotations)
+		assert.Equal(t, 1, steps)
+		assert.Equal(t, JumpUnitMinor, unit)
+	})
+	t.Run("Invalid values", func(t *testing.T) {
+		for _, val := range []string{"foo:1", "minor:x", "-1"} {
+			steps, _ := ParseMaxJump(val)
+			assert.Equal(t, 0, steps)
+		}
+	})
+	t.Run("Not set", func(t *testing.T) {
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		steps, _ := img.GetParameterMaxJump(map[string]string{})
+		assert.Equal(t, 0, steps)
+	})
+}
+
+func Test_GetIgnorePrerelease(t *testing.T) {
+	t.Run("Ignore pre-releases", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.IgnorePrereleaseAnnotation, "dummy"): "true",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		ignore, allow := img.GetParameterIgnorePrerelease(annotations)
+		assert.True(t, ignore)
+		assert.Equal(t, "", allow)
+	})
+	t.Run("Allow pre-releases of a track", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.IgnorePrereleaseAnnotation, "dummy"): "true",
+			fmt.Sprintf(common.AllowPrereleaseAnnotation, "dummy"):  " ~2.0 ",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		ignore, allow := img.GetParameterIgnorePrerelease(annotations)
+		assert.True(t, ignore)
+		assert.Equal(t, "~2.0", allow)
+	})
+	t.Run("Invalid track", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.IgnorePrereleaseAnnotation, "dummy"): "true",
+			fmt.Sprintf(common.AllowPrereleaseAnnotation, "dummy"):  "not a constraint",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		ignore, allow := img.GetParameterIgnorePrerelease(annotations)
+		assert.True(t, ignore)
+		assert.Equal(t, "", allow)
+	})
+	t.Run("Not set", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.AllowPrereleaseAnnotation, "dummy"): "~2.0",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		ignore, allow := img.GetParameterIgnorePrerelease(annotations)
+		assert.False(t, ignore)
+		assert.Equal(t, "", allow)
+	})
+}
+
+func Test_GetRequirePlatforms(t *testing.T) {
+	t.Run("Get required platforms from annotations", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.RequirePlatformsAnnotation, "dummy"): "linux/amd64, linux/arm64/v8,,linux",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		assert.Equal(t, []string{"linux/amd64", "linux/arm64/v8"}, img.GetParameterRequirePlatforms(annotations))
+	})
+	t.Run("No required platforms configured", func(t *testing.T) {
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		assert.Nil(t, img.GetParameterRequirePlatforms(map[string]string{}))
+	})
+}
+
+func Test_GetRequireLabels(t *testing.T) {
+	t.Run("Get required labels from annotations", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.RequireLabelsAnnotation, "dummy"): "release.channel=stable, team = core,,invalid,=x",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		assert.Equal(t, map[string]string{"release.channel": "stable", "team": "core"}, img.GetParameterRequireLabels(annotations))
+	})
+	t.Run("No required labels configured", func(t *testing.T) {
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		assert.Nil(t, img.GetParameterRequireLabels(map[string]string{}))
+	})
+}
+
+func Test_GetCompareBuildMetadata(t *testing.T) {
+	t.Run("Compare build metadata enabled", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.BuildMetadataAnnotation, "dummy"): "true",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0.0")
+		assert.True(t, img.GetParameterCompareBuildMetadata(annotations))
+	})
+	t.Run("Compare build metadata not configured", func(t *testing.T) {
+		img := NewFromIdentifier("dummy=foo/bar:1.0.0")
+		assert.False(t, img.GetParameterCompareBuildMetadata(map[string]string{}))
+	})
+}
+
+func Test_GetRequireSignature(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "signature-keys")
+	require.NoError(t, err)
+	defer os.RemoveAll(keyDir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(keyDir, "release"), []byte("release key"), 0600))
+	SetSignatureTrust(keyDir, []byte("roots"), []byte("rekor key"))
+	defer SetSignatureTrust("", nil, nil)
+
+	t.Run("Signature with key required", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.SignatureKeyAnnotation, "dummy"): "release",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0.0")
+		policy := img.GetParameterRequireSignature(annotations)
+		require.NotNil(t, policy)
+		assert.Equal(t, []byte("release key"), policy.PublicKey)
+		assert.False(t, policy.Keyless())
+	})
+	t.Run("Keyless signature required", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.SignerIdentityAnnotation, "dummy"): "dev@example.com",
+			fmt.Sprintf(common.SignerIssuerAnnotation, "dummy"):   "https://accounts.google.com",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0.0")
+		policy := img.GetParameterRequireSignature(annotations)
+		require.NotNil(t, policy)
+		assert.True(t, policy.Keyless())
+		assert.Equal(t, "dev@example.com", policy.Identity)
+		assert.Equal(t, "https://accounts.google.com", policy.Issuer)
+		assert.Equal(t, []byte("roots"), policy.Roots)
+		assert.Equal(t, []byte("rekor key"), policy.RekorPublicKey)
+	})
+	t.Run("Signature not required", func(t *testing.T) {
+		img := NewFromIdentifier("dummy=foo/bar:1.0.0")
+		assert.Nil(t, img.GetParameterRequireSignature(map[string]string{}))
+	})
+	t.Run("Invalid configuration is never satisfied", func(t *testing.T) {
+		for _, annotations := range []map[string]string{
+			{fmt.Sprintf(common.SignatureKeyAnnotation, "dummy"): "missing"},
+			{fmt.Sprintf(common.SignatureKeyAnnotation, "dummy"): "../release"},
+			{fmt.Sprintf(common.SignerIdentityAnnotation, "dummy"): "dev@example.com"},
+		} {
+			img := NewFromIdentifier("dummy=foo/bar:1.0.0")
+			policy := img.GetParameterRequireSignature(annotations)
+			require.NotNil(t, policy, annotations)
+			assert.Empty(t, policy.PublicKey, annotations)
+			assert.Empty(t, policy.Identity, annotations)
+		}
+	})
+}
+
+func Test_SignaturePolicyKey(t *testing.T) {
+	key := (&SignaturePolicy{PublicKey: []byte("key")}).Key()
+	assert.Equal(t, key, (&SignaturePolicy{PublicKey: []byte("key")}).Key())
+	assert.NotEqual(t, key, (&SignaturePolicy{PublicKey: []byte("other key")}).Key())
+	assert.NotEqual(t, (&SignaturePolicy{Identity: "ab", Issuer: "c"}).Key(), (&SignaturePolicy{Identity: "a", Issuer: "bc"}).Key())
+}
+
+func Test_GetUpdateWindow(t *testing.T) {
+	t.Run("Update window configured", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.UpdateWindowAnnotation, "dummy"): "Mon-Fri 18:00-07:00",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0.0")
+		w := img.GetParameterUpdateWindow(annotations)
+		require.NotNil(t, w)
+		assert.True(t, w.IsOpen(time.Date(2021, 5, 10, 20, 0, 0, 0, time.UTC)))
+	})
+	t.Run("Update window not configured", func(t *testing.T) {
+		img := NewFromIdentifier("dummy=foo/bar:1.0.0")
+		assert.Nil(t, img.GetParameterUpdateWindow(map[string]string{}))
+	})
+	t.Run("Invalid update window never opens", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.UpdateWindowAnnotation, "dummy"): "after lunch",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0.0")
+		w := img.GetParameterUpdateWindow(annotations)
+		require.NotNil(t, w)
+		assert.False(t, w.IsOpen(time.Date(2021, 5, 10, 20, 0, 0, 0, time.UTC)))
+	})
+}
+
+func Test_GetSkipSameDigest(t *testing.T) {
+	t.Run("Skip same digest enabled", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.SkipSameDigestAnnotation, "dummy"): " True",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:rc")
+		assert.True(t, img.GetParameterSkipSameDigest(annotations))
+	})
+	t.Run("Skip same digest not configured", func(t *testing.T) {
+		img := NewFromIdentifier("dummy=foo/bar:rc")
+		assert.False(t, img.GetParameterSkipSameDigest(map[string]string{}))
+	})
+}
+
+func Test_GetMaxTags(t *testing.T) {
+	img := NewFromIdentifier("dummy=foo/bar:1.12")
+	t.Run("Get max-tags from annotations", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.MaxTagsAnnotation, "dummy"): " 500",
+		}
+		assert.Equal(t, 500, img.GetParameterMaxTags(annotations))
+	})
+	t.Run("No limit without annotation", func(t *testing.T) {
+		assert.Equal(t, 0, img.GetParameterMaxTags(map[string]string{}))
+	})
+	t.Run("Invalid max-tags value", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.MaxTagsAnnotation, "dummy"): "-1",
+		}
+		assert.Equal(t, 0, img.GetParameterMaxTags(annotations))
+	})
+}
+
+func Test_GetPinDigest(t *testing.T) {
+	t.Run("Pin digest enabled", func(t *testing.T) {
+		annotations := map[string]string{
+			fmt.Sprintf(common.PinDigestAnnotation, "dummy"): "true",
+		}
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		assert.True(t, img.GetParameterPinDigest(annotations))
+	})
+	t.Run("Pin digest not configured", func(t *testing.T) {
+		img := NewFromIdentifier("dummy=foo/bar:1.0")
+		assert.False(t, img.GetParameterPinDigest(map[string]string{}))
+	})
+}
+
+func Test_GetLockTrack(t *testing.T) {
+	img := NewFromIdentifier("dummy=foo/bar:1.0")
+	for val, lock := range map[string]TrackLock{"minor": LockMinor, " Major ": LockMajor, "none": LockNone, "patch": LockNone} {
+		annotations := map[string]string{
+			fmt.Sprintf(common.LockTrackAnnotation, "dummy"): val,
+		}
+		assert.Equal(t, lock, img.GetParameterLockTrack(annotations), val)
+	}
+	assert.Equal(t, LockNone, img.GetParameterLockTrack(map[string]string{}))
+}
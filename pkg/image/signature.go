@@ -0,0 +1,102 @@
+package image
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SignaturePolicy describes the cosign signature a tag must carry to be
+// considered for update. Signatures are verified using PublicKey if it is
+// set. Otherwise, they are verified keyless: the signing certificate must be
+// issued to Identity by Issuer, chain up to one of Roots, and the signature
+// must have been recorded in the transparency log whose key is
+// RekorPublicKey. A policy that sets neither is never satisfied.
+type SignaturePolicy struct {
+	// PEM-encoded public key of the signer
+	PublicKey []byte
+	// Identity the signing certificate must be issued to, i.e. an email
+	// address or URI, and the OIDC issuer that has verified it
+	Identity string
+	Issuer   string
+	// PEM-encoded certificates of the CAs that issue signing certificates,
+	// i.e. Fulcio
+	Roots []byte
+	// PEM-encoded public key of the transparency log, i.e. Rekor
+	RekorPublicKey []byte
+}
+
+// Keyless returns true if signatures are verified using the signing
+// certificate instead of a public key
+func (sp *SignaturePolicy) Keyless() bool {
+	return len(sp.PublicKey) == 0
+}
+
+// Key returns a string that identifies the policy, for use in cache keys
+func (sp *SignaturePolicy) Key() string {
+	h := sha256.New()
+	for _, field := range [][]byte{sp.PublicKey, []byte(sp.Identity), []byte(sp.Issuer), sp.Roots, sp.RekorPublicKey} {
+		fmt.Fprintf(h, "%d:%s|", len(field), field)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Public keys can only be read from this directory, so that whoever may set
+// annotations cannot read arbitrary files. The trust roots for keyless
+// verification are set once for all images.
+var (
+	signatureTrustLock sync.RWMutex
+	signatureKeyDir    string
+	signatureRoots     []byte
+	signatureRekorKey  []byte
+)
+
+// SetSignatureTrust configures the directory public keys for verifying
+// signatures are looked up in, along with the PEM-encoded CA certificates and
+// transparency log key for keyless verification. An empty dir disables
+// verification using public keys, empty roots disable keyless verification.
+func SetSignatureTrust(keyDir string, roots, rekorKey []byte) {
+	signatureTrustLock.Lock()
+	defer signatureTrustLock.Unlock()
+	signatureKeyDir = keyDir
+	signatureRoots = roots
+	signatureRekorKey = rekorKey
+}
+
+// NewKeySignaturePolicy returns a policy requiring signatures made with the
+// public key of the given name in the directory set by SetSignatureTrust
+func NewKeySignaturePolicy(name string) (*SignaturePolicy, error) {
+	signatureTrustLock.RLock()
+	dir := signatureKeyDir
+	signatureTrustLock.RUnlock()
+	if dir == "" {
+		return nil, fmt.Errorf("signature key %s cannot be used: no signature key directory configured", name)
+	}
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid name of signature key: %s", name)
+	}
+	key, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("could not read signature key %s: %v", name, err)
+	}
+	return &SignaturePolicy{PublicKey: key}, nil
+}
+
+// NewKeylessSignaturePolicy returns a policy requiring signatures whose
+// certificate was issued to identity by issuer, using the trust roots set by
+// SetSignatureTrust
+func NewKeylessSignaturePolicy(identity, issuer string) (*SignaturePolicy, error) {
+	signatureTrustLock.RLock()
+	roots, rekorKey := signatureRoots, signatureRekorKey
+	signatureTrustLock.RUnlock()
+	if len(roots) == 0 || len(rekorKey) == 0 {
+		return nil, fmt.Errorf("keyless signatures cannot be verified: no trust roots configured")
+	}
+	if identity == "" || issuer == "" {
+		return nil, fmt.Errorf("keyless signatures require both identity and issuer")
+	}
+	return &SignaturePolicy{Identity: identity, Issuer: issuer, Roots: roots, RekorPublicKey: rekorKey}, nil
+}
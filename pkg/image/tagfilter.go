@@ -0,0 +1,82 @@
+package image
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+// TagFilter decides whether a tag is considered for update. It is evaluated
+// after the MatchFunc of a VersionConstraint, which is itself evaluated as a
+// MatchTagFilter, and allows embedders to accept tags by arbitrary logic
+// without running external commands.
+type TagFilter interface {
+	// Accept returns whether the tag is considered for update. The tag name
+	// is normalized if the constraint normalizes tags. info is the meta data
+	// of the tag if it is already known from the cache and may be used for
+	// the tag, and nil otherwise.
+	Accept(tagName string, info *tag.TagInfo) bool
+}
+
+// KeyedTagFilter is a TagFilter that can identify itself. Two filters with
+// the same key must accept the same tags. The key becomes part of the key of
+// the constraint, so that fetches with a keyed filter are cached and shared
+// like any other. Fetches with filters that are not keyed are neither cached
+// nor shared, since their effect on the list of tags cannot be told apart.
+type KeyedTagFilter interface {
+	TagFilter
+	// Key returns a string that identifies the filter's effect
+	Key() string
+}
+
+// TagFilterFunc is a function that implements TagFilter
+type TagFilterFunc func(tagName string, info *tag.TagInfo) bool
+
+// Accept calls f
+func (f TagFilterFunc) Accept(tagName string, info *tag.TagInfo) bool {
+	return f(tagName, info)
+}
+
+// RegexpTagFilter accepts tags whose name matches the regular expression
+type RegexpTagFilter struct {
+	*regexp.Regexp
+}
+
+// Accept returns whether the tag name matches the regular expression
+func (f RegexpTagFilter) Accept(tagName string, info *tag.TagInfo) bool {
+	return f.MatchString(tagName)
+}
+
+// Key returns the regular expression
+func (f RegexpTagFilter) Key() string {
+	return "regexp:" + f.String()
+}
+
+// Accept returns whether the tag name matches the pattern, so that a Glob can
+// be used as TagFilter
+func (g *Glob) Accept(tagName string, info *tag.TagInfo) bool {
+	return g.Match(tagName)
+}
+
+// Key returns the pattern
+func (g *Glob) Key() string {
+	return "glob:" + g.pattern
+}
+
+// MatchTagFilter adapts a MatchFuncFn and its arguments, as returned by
+// ParseMatchfunc, to a TagFilter
+type MatchTagFilter struct {
+	Func MatchFuncFn
+	Args interface{}
+}
+
+// Accept calls the match function with the tag name and the arguments
+func (f MatchTagFilter) Accept(tagName string, info *tag.TagInfo) bool {
+	return f.Func(tagName, f.Args)
+}
+
+// Key returns the match function and its arguments
+func (f MatchTagFilter) Key() string {
+	return fmt.Sprintf("match:%p:%v", f.Func, f.Args)
+}
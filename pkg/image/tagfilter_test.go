@@ -0,0 +1,71 @@
+package image
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_TagFilters(t *testing.T) {
+	t.Run("Function as tag filter", func(t *testing.T) {
+		var f TagFilter = TagFilterFunc(func(tagName string, info *tag.TagInfo) bool {
+			return info != nil && info.Arch == "arm64"
+		})
+		assert.True(t, f.Accept("1.0", &tag.TagInfo{Arch: "arm64"}))
+		assert.False(t, f.Accept("1.0", &tag.TagInfo{Arch: "amd64"}))
+		assert.False(t, f.Accept("1.0", nil))
+	})
+	t.Run("Regexp as tag filter", func(t *testing.T) {
+		var f TagFilter = RegexpTagFilter{regexp.MustCompile(`^v\d+`)}
+		assert.True(t, f.Accept("v1.0", nil))
+		assert.False(t, f.Accept("latest", nil))
+	})
+	t.Run("Glob as tag filter", func(t *testing.T) {
+		glob, err := CompileGlob("1.2.*")
+		require.NoError(t, err)
+		var f TagFilter = glob
+		assert.True(t, f.Accept("1.2.3", nil))
+		assert.False(t, f.Accept("1.3.0", nil))
+	})
+	t.Run("Match function as tag filter", func(t *testing.T) {
+		fn, args := ParseMatchfunc("regexp:^1\\.")
+		var f TagFilter = MatchTagFilter{Func: fn, Args: args}
+		assert.True(t, f.Accept("1.0.0", nil))
+		assert.False(t, f.Accept("2.0.0", nil))
+	})
+	t.Run("Tag filter is part of the constraint key", func(t *testing.T) {
+		glob, err := CompileGlob("1.2.*")
+		require.NoError(t, err)
+		other, err := CompileGlob("1.3.*")
+		require.NoError(t, err)
+		assert.NotEqual(t, (&VersionConstraint{}).Key(), (&VersionConstraint{TagFilter: glob}).Key())
+		assert.NotEqual(t, (&VersionConstraint{TagFilter: other}).Key(), (&VersionConstraint{TagFilter: glob}).Key())
+		assert.NotEqual(t, (&VersionConstraint{TagFilter: RegexpTagFilter{regexp.MustCompile(`^1`)}}).Key(), (&VersionConstraint{TagFilter: RegexpTagFilter{regexp.MustCompile(`^2`)}}).Key())
+		fn, args := ParseMatchfunc("regexp:^1\\.")
+		assert.Contains(t, (&VersionConstraint{TagFilter: MatchTagFilter{Func: fn, Args: args}}).Key(), "^1\\.")
+	})
+	t.Run("Match function is the first tag filter of the constraint", func(t *testing.T) {
+		glob, err := CompileGlob("1.2.*")
+		require.NoError(t, err)
+		fn, args := ParseMatchfunc("regexp:^1\\.")
+		filters := (&VersionConstraint{MatchFunc: fn, MatchArgs: args, TagFilter: glob}).TagFilters()
+		require.Len(t, filters, 2)
+		mf, ok := filters[0].(MatchTagFilter)
+		require.True(t, ok)
+		assert.Equal(t, args, mf.Args)
+		assert.Equal(t, glob, filters[1])
+		assert.Empty(t, (&VersionConstraint{}).TagFilters())
+	})
+	t.Run("Only keyed tag filters have a stable key", func(t *testing.T) {
+		glob, err := CompileGlob("1.2.*")
+		require.NoError(t, err)
+		assert.True(t, (&VersionConstraint{}).HasStableKey())
+		assert.True(t, (&VersionConstraint{TagFilter: glob}).HasStableKey())
+		fn := TagFilterFunc(func(tagName string, info *tag.TagInfo) bool { return true })
+		assert.False(t, (&VersionConstraint{TagFilter: fn}).HasStableKey())
+	})
+}
@@ -1,7 +1,12 @@
 package image
 
 import (
+	"fmt"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
@@ -19,8 +24,18 @@ const (
 	VersionSortLatest VersionSortMode = 1
 	// VersionSortName sorts tags alphabetically by name
 	VersionSortName VersionSortMode = 2
+	// VersionSortDigest tracks a tag by the digest it points to
+	VersionSortDigest VersionSortMode = 3
+	// VersionSortDate sorts tags after a date embedded in their names
+	VersionSortDate VersionSortMode = 4
+	// VersionSortExternal sorts tags using an external command
+	VersionSortExternal VersionSortMode = 5
 )
 
+// DefaultTagDateLayout is the layout of dates embedded in tag names, if none
+// is given
+const DefaultTagDateLayout = "20060102"
+
 // ConstraintMatchMode defines how the constraint should be matched
 type ConstraintMatchMode int
 
@@ -33,63 +48,392 @@ const (
 	ConstraintMatchNone ConstraintMatchMode = 2
 )
 
+// MissingDataPolicy defines how to treat a tag for which the data that is
+// required to evaluate a constraint is not available
+type MissingDataPolicy int
+
+const (
+	// MissingDataKeep keeps the tag as a candidate
+	MissingDataKeep MissingDataPolicy = 0
+	// MissingDataDrop removes the tag from the candidates
+	MissingDataDrop MissingDataPolicy = 1
+)
+
+// JumpUnit defines the unit in which the distance of an update is measured
+type JumpUnit int
+
+const (
+	// JumpUnitTag counts positions in the sorted list of tags
+	JumpUnitTag JumpUnit = 0
+	// JumpUnitMajor counts distinct major versions
+	JumpUnitMajor JumpUnit = 1
+	// JumpUnitMinor counts distinct minor versions
+	JumpUnitMinor JumpUnit = 2
+	// JumpUnitPatch counts distinct patch versions
+	JumpUnitPatch JumpUnit = 3
+)
+
+// TrackLock defines the part of the current version all tags considered for
+// update must share with it
+type TrackLock int
+
+const (
+	// LockNone considers tags regardless of the current version
+	LockNone TrackLock = 0
+	// LockMajor considers only tags with the current major version
+	LockMajor TrackLock = 1
+	// LockMinor considers only tags with the current major and minor version
+	LockMinor TrackLock = 2
+)
+
 // VersionConstraint defines a constraint for comparing versions
 type VersionConstraint struct {
-	Constraint string
-	MatchFunc  MatchFuncFn
-	MatchArgs  interface{}
-	IgnoreList []string
-	SortMode   VersionSortMode
+	Constraint       string
+	MatchFunc        MatchFuncFn
+	MatchArgs        interface{}
+	TagFilter        TagFilter
+	IgnoreList       []string
+	SortMode         VersionSortMode
+	MinDownloads     int64
+	MissingDownloads MissingDataPolicy
+	VariantSuffix    string
+	IncludePlatform  bool
+	Normalization    *TagNormalization
+	// MaxJump is the maximum number of steps, measured in MaxJumpUnit, an
+	// update may go beyond the current version. Zero means no limit.
+	MaxJump     int
+	MaxJumpUnit JumpUnit
+	// IgnorePrerelease drops all tags that are semantic versions with a
+	// pre-release component, except for those whose version satisfies the
+	// semver constraint AllowPrereleaseFor, if set.
+	IgnorePrerelease   bool
+	AllowPrereleaseFor string
+	// Lock restricts the tags considered for update to those on the track
+	// of the current version, i.e. "1" for LockMajor or "1.4" for LockMinor
+	// at version 1.4.2. Track is derived from the current tag by SetTrack,
+	// and tags are not restricted as long as it is empty.
+	Lock  TrackLock
+	Track string
+	// Explain enables recording the reason for each tag that is excluded
+	Explain bool
+	// AllowTags holds the names of tags that are always considered for
+	// update, even if they are not valid versions or would otherwise be
+	// filtered. When sorting by semver, those that are not valid versions
+	// rank below all other candidates. DenyTags holds the
+	// names of tags that are never considered, and takes precedence.
+	AllowTags []string
+	DenyTags  []string
+	// DatePattern extracts the date from a tag name when sorting by
+	// VersionSortDate. If the pattern has a capturing group, the first group
+	// is the date, otherwise the whole match. The date is parsed using the Go
+	// time layout DateLayout, or DefaultTagDateLayout if empty.
+	DatePattern *regexp.Regexp
+	DateLayout  string
+	// RequirePlatforms holds platforms, as os/arch or os/arch/variant, a tag
+	// must be available for to be considered for update
+	RequirePlatforms []string
+	// RequireLabels holds labels a tag's image configuration must carry with
+	// the given values to be considered for update. The configuration of
+	// each tag is fetched from the registry if set.
+	RequireLabels map[string]string
+	// MaxTags limits the number of tags considered for update to the first
+	// MaxTags tags that pass all filters, in the order the registry returns
+	// them. Zero means no limit. With a limit, the newest version is only
+	// guaranteed to be found if the registry returns the tags newest first,
+	// and the tag list is only fetched until enough tags passed all filters.
+	MaxTags int
+	// MinTags is the minimum fraction of the last known number of tags of
+	// the image, i.e. 0.9 for 90%, the registry must return. If it returns
+	// fewer tags, the tag list is considered truncated and not used.
+	MinTags float64
+	// FetchMetadata enables fetching the meta data of all tags, regardless
+	// of the sort mode, so that the TagInfo of each returned tag is set.
+	// This requires additional requests to the registry for each tag.
+	FetchMetadata bool
+	// NoCache makes fetching the tags bypass the cache of the registry
+	// endpoint, so that nothing is read from or written to it
+	NoCache bool
+	// SortCommand is the name of the executable that sorts the tags when
+	// sorting by VersionSortExternal. It is looked up in the directory set
+	// by SetSortCommands.
+	SortCommand string
+	// SkipSameDigest prevents updating to a tag that points to the same
+	// digest as the tag currently in use, i.e. because the same image has
+	// been tagged under a new name.
+	SkipSameDigest bool
+	// PinDigest makes the new tag be referenced along with the digest it
+	// points to, i.e. 1.0@sha256:..., so that the image cannot change
+	// without another update.
+	PinDigest bool
+	// MaxAge drops all tags that were created longer ago, according to
+	// their meta data, which is fetched for all tags if set. Tags whose
+	// creation date is not known are treated according to MissingAge.
+	// Zero means no limit.
+	MaxAge     time.Duration
+	MissingAge MissingDataPolicy
+	// CompareBuildMetadata orders versions that only differ in their build
+	// metadata by it when sorting by semver, i.e. 1.0.0+10 is newer than
+	// 1.0.0+5. This deviates from semver, which ignores build metadata for
+	// precedence. Dot-separated identifiers are compared numerically if both
+	// are numeric.
+	CompareBuildMetadata bool
+	// RequireSignature only selects tags that carry a cosign signature
+	// satisfying the policy, which is checked by VerifyCandidate. Nil means
+	// no signature is required.
+	RequireSignature *SignaturePolicy
+	// VerifyCandidate checks the update candidates from the newest down
+	// until one passes, which is then selected, so that tags that are never
+	// selected are not checked. It returns the reason for rejecting a
+	// candidate, or an error if it could not be checked, which fails the
+	// selection. It must be set if a signature is required, i.e. using
+	// RegistryEndpoint.SignatureVerifier.
+	VerifyCandidate func(*tag.ImageTag) (string, error)
+	// UpdateWindow restricts the times at which the image is updated. Tags
+	// are still fetched outside of the window, but the update is deferred
+	// until it opens. Nil means the image may be updated at any time.
+	UpdateWindow *UpdateWindow
+	// TagTransform rewrites the selected tag and its alternative before they
+	// are returned, i.e. to map a tag to the alias that is written back. It
+	// is passed a copy of the tag, which it may modify, and returning nil
+	// keeps the tag unchanged. Nil means tags are returned as selected.
+	TagTransform func(*tag.ImageTag) *tag.ImageTag
 }
 
 type MatchFuncFn func(tagName string, pattern interface{}) bool
 
+// VersionSelection is the result of selecting a version from a list of tags
+type VersionSelection struct {
+	// Selected is the tag that was selected
+	Selected *tag.ImageTag
+	// Alternative is the next-best candidate after Selected, or nil if there
+	// is none. It is not checked by VerifyCandidate. Its digest and creation
+	// date are only set if they are known from the tag list, and can be
+	// resolved with the registry endpoint's ResolveAlternative.
+	Alternative *tag.ImageTag
+	// Platform is the platform (os/arch) of the selected tag, if requested
+	// by the constraint and known.
+	Platform string
+	// Excluded holds the reason for each tag that was not considered, if
+	// requested by the constraint.
+	Excluded TagExclusions
+	// Candidates holds all tags that were eligible for update, ordered from
+	// lowest to highest. If the constraint verifies candidates, only the
+	// highest one has been verified.
+	Candidates tag.SortableImageTagList
+	// Warnings describe likely misconfigurations detected when explaining
+	// the selection, i.e. sorting by semver although none of the tags is a
+	// semantic version.
+	Warnings []string
+}
+
 // String returns the string representation of VersionConstraint
 func (vc *VersionConstraint) String() string {
 	return vc.Constraint
 }
 
+// Key returns a string that identifies the constraint's effect on the list
+// of tags fetched from a registry. Two constraints with the same key will
+// result in the same list of tags.
+func (vc *VersionConstraint) Key() string {
+	key := fmt.Sprintf("%s|%d|%p|%v|%s|%d|%d|%t|%t|%s",
+		vc.Constraint, vc.SortMode, vc.MatchFunc, vc.MatchArgs, strings.Join(vc.IgnoreList, ","),
+		vc.MinDownloads, vc.MissingDownloads, vc.IncludePlatform, vc.IgnorePrerelease, vc.AllowPrereleaseFor)
+	if len(vc.RequirePlatforms) > 0 {
+		key += "|" + strings.Join(vc.RequirePlatforms, ",")
+	}
+	if len(vc.RequireLabels) > 0 {
+		labels := make([]string, 0, len(vc.RequireLabels))
+		for name, value := range vc.RequireLabels {
+			labels = append(labels, name+"="+value)
+		}
+		sort.Strings(labels)
+		key += "|labels=" + strings.Join(labels, ",")
+	}
+	if vc.VariantSuffix != "" {
+		key += "|variant=" + vc.VariantSuffix
+	}
+	if vc.Track != "" {
+		key += fmt.Sprintf("|track=%d:%s", vc.Lock, vc.Track)
+	}
+	if vc.MaxTags > 0 {
+		key += fmt.Sprintf("|max=%d", vc.MaxTags)
+	}
+	if vc.MinTags > 0 {
+		key += fmt.Sprintf("|min=%g", vc.MinTags)
+	}
+	if kf, ok := vc.TagFilter.(KeyedTagFilter); ok {
+		key += "|filter=" + kf.Key()
+	} else if vc.TagFilter != nil {
+		key += "|filter=unkeyed"
+	}
+	if vc.FetchMetadata {
+		key += "|metadata"
+	}
+	if vc.NoCache {
+		key += "|nocache"
+	}
+	if vc.MaxAge > 0 {
+		key += fmt.Sprintf("|maxage=%s|%d", vc.MaxAge, vc.MissingAge)
+	}
+	if vc.CompareBuildMetadata {
+		key += "|buildmetadata"
+	}
+	if vc.RequireSignature != nil {
+		key += "|sig=" + vc.RequireSignature.Key()
+	}
+	if vc.DatePattern != nil {
+		key += fmt.Sprintf("|%s|%s", vc.DatePattern, vc.DateLayout)
+	}
+	if len(vc.AllowTags) > 0 || len(vc.DenyTags) > 0 {
+		key += fmt.Sprintf("|%s|%s", strings.Join(vc.AllowTags, ","), strings.Join(vc.DenyTags, ","))
+	}
+	if tn := vc.Normalization; tn != nil {
+		key += fmt.Sprintf("|%s|%t|%t|%v", tn.StripPrefix, tn.CaseFold, tn.ChartVersion, tn.Extract)
+	}
+	return key
+}
+
+// TagFilters returns the filters a tag must be accepted by to be considered
+// for update, in the order they are evaluated. The match function of the
+// constraint, if any, is the first of them as a MatchTagFilter, followed by
+// the constraint's TagFilter.
+func (vc *VersionConstraint) TagFilters() []TagFilter {
+	filters := []TagFilter{}
+	if vc.MatchFunc != nil {
+		filters = append(filters, MatchTagFilter{Func: vc.MatchFunc, Args: vc.MatchArgs})
+	}
+	if vc.TagFilter != nil {
+		filters = append(filters, vc.TagFilter)
+	}
+	return filters
+}
+
+// HasStableKey returns whether Key identifies the constraint's effect on the
+// list of tags, so that results for the constraint may be cached and shared
+// by its key. This is not the case if the constraint has a tag filter that is
+// not a KeyedTagFilter.
+func (vc *VersionConstraint) HasStableKey() bool {
+	if vc.TagFilter == nil {
+		return true
+	}
+	_, ok := vc.TagFilter.(KeyedTagFilter)
+	return ok
+}
+
 // GetNewestVersionFromTags returns the latest available version from a list of
 // tags while optionally taking a semver constraint into account. Returns the
 // original version if no new version could be found from the list of tags.
 func (img *ContainerImage) GetNewestVersionFromTags(vc *VersionConstraint, tagList *tag.ImageTagList) (*tag.ImageTag, error) {
+	selection, err := img.SelectVersionFromTags(vc, tagList)
+	if err != nil {
+		return nil, err
+	}
+	return selection.Selected, nil
+}
+
+// SelectVersionFromTags selects the latest available version from a list of
+// tags the same way GetNewestVersionFromTags does, but additionally returns
+// the runner-up candidate as an alternative.
+func (img *ContainerImage) SelectVersionFromTags(vc *VersionConstraint, tagList *tag.ImageTagList) (*VersionSelection, error) {
 	logCtx := log.NewContext()
 	logCtx.AddField("image", img.String())
 
+	var excluded TagExclusions
+	if vc.Explain {
+		excluded = TagExclusions{}
+	}
+
+	// Tags are compared by their normalized keys, and candidates are mapped
+	// back to their original tags before being returned.
+	var originals map[string]*tag.ImageTag
+	if vc.Normalization != nil {
+		tagList, originals = normalizeTagList(tagList, vc, excluded)
+	}
+	originalName := func(t *tag.ImageTag) string {
+		if originals != nil {
+			return originals[t.TagName].TagName
+		}
+		return t.TagName
+	}
+
 	var availableTags tag.SortableImageTagList
 	switch vc.SortMode {
 	case VersionSortSemVer:
 		availableTags = tagList.SortBySemVer()
+		if vc.CompareBuildMetadata {
+			sortByBuildMetadata(availableTags, vc)
+		}
 	case VersionSortName:
 		availableTags = tagList.SortByName()
-	case VersionSortLatest:
+	case VersionSortLatest, VersionSortDate:
 		availableTags = tagList.SortByDate()
+	case VersionSortDigest:
+		availableTags = tagList.SortByName()
+	case VersionSortExternal:
+		var err error
+		availableTags, err = vc.sortExternal(tagList)
+		if err != nil {
+			logCtx.Errorf("%v", err)
+			return nil, err
+		}
+		if excluded != nil && len(availableTags) < len(tagList.Tags()) {
+			sorted := make(map[string]bool, len(availableTags))
+			for _, t := range availableTags {
+				sorted[t.TagName] = true
+			}
+			for _, name := range tagList.Tags() {
+				if !sorted[name] {
+					excluded.Exclude(originalName(tagList.Get(name)), "sort-command", "not returned by sort command %s", vc.SortCommand)
+				}
+			}
+		}
 	}
 
 	considerTags := tag.SortableImageTagList{}
 
+	// Sorting by semver drops all tags that are not valid versions, except
+	// for the explicitly allowed ones. These rank below all versions.
+	if vc.SortMode == VersionSortSemVer {
+		valid := make(map[string]bool, len(availableTags))
+		for _, t := range availableTags {
+			valid[t.TagName] = true
+		}
+		names := tagList.Tags()
+		sort.Strings(names)
+		for _, name := range names {
+			if valid[name] {
+				continue
+			}
+			if vc.IsTagAllowed(originalName(tagList.Get(name))) {
+				logCtx.Tracef("Considering %s because it is explicitly allowed", name)
+				considerTags = append(considerTags, tagList.Get(name))
+			} else {
+				excluded.Exclude(originalName(tagList.Get(name)), "semver", "not a valid semantic version")
+			}
+		}
+	}
+
 	// It makes no sense to proceed if we have no available tags
-	if len(availableTags) == 0 {
-		return img.ImageTag, nil
+	if len(availableTags) == 0 && len(considerTags) == 0 {
+		return &VersionSelection{Selected: img.ImageTag, Excluded: excluded}, nil
 	}
 
 	// The given constraint MUST match a semver constraint
 	var semverConstraint *semver.Constraints
 	var err error
 	if vc.SortMode == VersionSortSemVer {
-		if img.ImageTag != nil {
-			_, err := semver.NewVersion(img.ImageTag.TagName)
+		if img.ImageTag != nil && !vc.IsTagAllowed(img.ImageTag.TagName) {
+			current, _ := NormalizeTag(img.ImageTag.TagName, vc)
+			_, err := semver.NewVersion(strings.TrimSuffix(current, vc.VariantSuffix))
 			if err != nil {
 				return nil, err
 			}
 		}
 
-		if vc.Constraint != "" {
-			semverConstraint, err = semver.NewConstraint(vc.Constraint)
-			if err != nil {
-				logCtx.Errorf("invalid constraint '%s' given: '%v'", vc, err)
-				return nil, err
-			}
+		semverConstraint, err = vc.SemverConstraint()
+		if err != nil {
+			logCtx.Errorf("%v", err)
+			return nil, err
 		}
 	}
 
@@ -97,11 +441,33 @@ func (img *ContainerImage) GetNewestVersionFromTags(vc *VersionConstraint, tagLi
 	for _, tag := range availableTags {
 		logCtx.Tracef("Finding out whether to consider %s for being updateable", tag.TagName)
 
-		if vc.SortMode == VersionSortSemVer {
+		// When tracking a variant, versions are ordered by their base tags and the
+		// variant tags themselves are only looked up for a chosen base.
+		if vc.VariantSuffix != "" && strings.HasSuffix(tag.TagName, vc.VariantSuffix) {
+			logCtx.Tracef("Skipping variant tag %s in version ordering", tag.TagName)
+			excluded.Exclude(originalName(tag), "variant", "variant tags are only considered along with their base tag")
+			continue
+		}
+
+		// When tracking a tag by its digest, only the tracked tag is considered
+		// and we must know the digest it points to.
+		if vc.SortMode == VersionSortDigest {
+			if vc.Constraint != "" && tag.TagName != vc.Constraint {
+				excluded.Exclude(originalName(tag), "digest", "not the tracked tag %s", vc.Constraint)
+				continue
+			}
+			if tag.TagDigest == "" {
+				excluded.Exclude(originalName(tag), "digest", "digest is not known")
+				continue
+			}
+		}
+
+		if vc.SortMode == VersionSortSemVer && !vc.IsTagAllowed(originalName(tag)) {
 			// Non-parseable tag does not mean error - just skip it
 			ver, err := semver.NewVersion(tag.TagName)
 			if err != nil {
 				logCtx.Tracef("Not a valid version: %s", tag.TagName)
+				excluded.Exclude(originalName(tag), "semver", "not a valid semantic version")
 				continue
 			}
 
@@ -110,33 +476,378 @@ func (img *ContainerImage) GetNewestVersionFromTags(vc *VersionConstraint, tagLi
 			if semverConstraint != nil {
 				if !semverConstraint.Check(ver) {
 					logCtx.Tracef("%s did not match constraint %s", ver.Original(), vc.Constraint)
+					excluded.Exclude(originalName(tag), "constraint", "does not satisfy constraint %s", vc.Constraint)
 					continue
 				}
 			}
 		}
 
+		// Replace the base tag with its variant, if the variant exists.
+		if vc.VariantSuffix != "" {
+			variant := tagList.Get(tag.TagName + vc.VariantSuffix)
+			if variant == nil {
+				logCtx.Tracef("No variant %s%s found for %s", tag.TagName, vc.VariantSuffix, tag.TagName)
+				excluded.Exclude(originalName(tag), "variant", "no variant %s%s exists", tag.TagName, vc.VariantSuffix)
+				continue
+			}
+			tag = variant
+		}
+
 		// Append tag as update candidate
 		considerTags = append(considerTags, tag)
 	}
 
-	logCtx.Debugf("found %d from %d tags eligible for consideration", len(considerTags), len(availableTags))
+	logCtx.Debugf("found %d from %d tags eligible for consideration", len(considerTags), len(tagList.Tags()))
+
+	if vc.MaxJump > 0 && img.ImageTag != nil {
+		current, _ := NormalizeTag(img.ImageTag.TagName, vc)
+		considerTags = limitJump(current, considerTags, vc, excluded, originalName)
+	}
+
+	if originals != nil {
+		for i, t := range considerTags {
+			considerTags[i] = originals[t.TagName]
+		}
+	}
+
+	// Only the candidate that is selected needs to pass verification, so the
+	// candidates are checked from the newest down until one passes
+	if vc.RequireSignature != nil && vc.VerifyCandidate == nil {
+		return nil, fmt.Errorf("signature required for %s, but no verifier set", img.ImageName)
+	}
+	if vc.VerifyCandidate != nil {
+		for len(considerTags) > 0 {
+			t := considerTags[len(considerTags)-1]
+			reason, err := vc.VerifyCandidate(t)
+			if err != nil {
+				logCtx.Errorf("Could not verify tag %s: %v", t.TagName, err)
+				return nil, err
+			}
+			if reason == "" {
+				break
+			}
+			logCtx.Infof("Skipping tag %s: %s", t.TagName, reason)
+			excluded.Exclude(t.TagName, "signature", "%s", reason)
+			considerTags = considerTags[:len(considerTags)-1]
+		}
+	}
 
 	// Sort update candidates and return the most recent version in its original
-	// form, so we can later fetch it from the registry.
+	// form, so we can later fetch it from the registry. The candidate right
+	// before it is the alternative.
+	selection := &VersionSelection{Selected: img.ImageTag, Excluded: excluded, Candidates: considerTags}
 	if len(considerTags) > 0 {
-		return considerTags[len(considerTags)-1], nil
+		selection.Selected = considerTags[len(considerTags)-1]
+	}
+	if len(considerTags) > 1 {
+		selection.Alternative = considerTags[len(considerTags)-2]
+	}
+	if vc.TagTransform != nil && len(considerTags) > 0 {
+		selection.Selected = vc.transformTag(selection.Selected)
+		selection.Alternative = vc.transformTag(selection.Alternative)
+	}
+	if vc.IncludePlatform && selection.Selected != nil {
+		selection.Platform = selection.Selected.TagPlatform
+	}
+	return selection, nil
+}
+
+// transformTag returns the given tag as rewritten by the constraint's
+// TagTransform. The tag itself is left untouched, as it may be shared with the
+// tag cache.
+func (vc *VersionConstraint) transformTag(t *tag.ImageTag) *tag.ImageTag {
+	if t == nil {
+		return nil
+	}
+	transformed := vc.TagTransform(t.DeepCopy())
+	if transformed == nil {
+		return t
+	}
+	if transformed.TagName != t.TagName {
+		log.Debugf("Tag %s has been transformed to %s", t.TagName, transformed.TagName)
+	}
+	return transformed
+}
+
+// limitJump removes all candidates from the ascending list considerTags that
+// are more than vc.MaxJump steps beyond the current version. Versions are
+// compared semantically when sorting by semver, otherwise only candidates
+// after the current tag in the list are counted. If the current tag cannot be
+// located, the list is returned unchanged.
+func limitJump(current string, considerTags tag.SortableImageTagList, vc *VersionConstraint, excluded TagExclusions, originalName func(*tag.ImageTag) string) tag.SortableImageTagList {
+	var curVer *semver.Version
+	curIdx := -1
+	if vc.SortMode == VersionSortSemVer {
+		ver, err := semver.NewVersion(strings.TrimSuffix(current, vc.VariantSuffix))
+		if err != nil {
+			return considerTags
+		}
+		curVer = ver
 	} else {
-		return img.ImageTag, nil
+		for i, t := range considerTags {
+			if t.TagName == current {
+				curIdx = i
+			}
+		}
+		if curIdx == -1 {
+			log.Debugf("current tag %s not found in candidates, not limiting jump", current)
+			return considerTags
+		}
+	}
+
+	unit := vc.MaxJumpUnit
+	if curVer == nil {
+		unit = JumpUnitTag
+	}
+
+	limited := tag.SortableImageTagList{}
+	steps := 0
+	lastGroup := jumpGroup(curVer, unit)
+	for i, t := range considerTags {
+		var ver *semver.Version
+		if curVer != nil {
+			ver, _ = semver.NewVersion(strings.TrimSuffix(t.TagName, vc.VariantSuffix))
+			if ver == nil || !ver.GreaterThan(curVer) {
+				limited = append(limited, t)
+				continue
+			}
+		} else if i <= curIdx {
+			limited = append(limited, t)
+			continue
+		}
+
+		if unit == JumpUnitTag {
+			steps += 1
+		} else if group := jumpGroup(ver, unit); group != lastGroup {
+			steps += 1
+			lastGroup = group
+		}
+		if steps > vc.MaxJump {
+			log.Tracef("%s is more than %d steps beyond %s", t.TagName, vc.MaxJump, current)
+			excluded.Exclude(originalName(t), "max-jump", "more than %d steps beyond current version %s", vc.MaxJump, current)
+			continue
+		}
+		limited = append(limited, t)
+	}
+	return limited
+}
+
+// jumpGroup returns the part of ver that is relevant for counting steps in
+// the given unit.
+func jumpGroup(ver *semver.Version, unit JumpUnit) string {
+	if ver == nil {
+		return ""
+	}
+	switch unit {
+	case JumpUnitMajor:
+		return fmt.Sprintf("%d", ver.Major())
+	case JumpUnitMinor:
+		return fmt.Sprintf("%d.%d", ver.Major(), ver.Minor())
+	case JumpUnitPatch:
+		return fmt.Sprintf("%d.%d.%d", ver.Major(), ver.Minor(), ver.Patch())
+	default:
+		return ""
 	}
 }
 
 // IsTagIgnored matches tag against the patterns in IgnoreList and returns true if one of them matches
 func (vc *VersionConstraint) IsTagIgnored(tag string) bool {
+	return vc.IgnorePatternFor(tag) != ""
+}
+
+// IgnorePatternFor returns the first pattern in IgnoreList that matches tag,
+// or the empty string if tag is not ignored.
+func (vc *VersionConstraint) IgnorePatternFor(tag string) string {
 	for _, t := range vc.IgnoreList {
 		if match, err := filepath.Match(t, tag); err == nil && match {
 			log.Tracef("tag %s is ignored by pattern %s", tag, t)
+			return t
+		}
+	}
+	return ""
+}
+
+// UseChartVersions makes the constraint compare tags as versions of Helm
+// charts, whose build metadata is separated by an underscore instead of a
+// plus sign in OCI registries
+func (vc *VersionConstraint) UseChartVersions() {
+	if vc.Normalization == nil {
+		vc.Normalization = &TagNormalization{}
+	}
+	vc.Normalization.ChartVersion = true
+}
+
+// SemverConstraint returns the constraint parsed as semver range, such as
+// ">= 1.4, < 2.0", or nil if the constraint does not restrict versions. Only
+// constraints for sorting by semver are ranges.
+func (vc *VersionConstraint) SemverConstraint() (*semver.Constraints, error) {
+	if vc.SortMode != VersionSortSemVer || vc.Constraint == "" {
+		return nil, nil
+	}
+	c, err := semver.NewConstraint(vc.Constraint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid semver constraint '%s': %v", vc.Constraint, err)
+	}
+	return c, nil
+}
+
+// Validate returns an error if the constraint is not valid
+func (vc *VersionConstraint) Validate() error {
+	if vc.SortMode == VersionSortExternal {
+		if _, _, err := sortCommandPath(vc.SortCommand); err != nil {
+			return err
+		}
+	}
+	_, err := vc.SemverConstraint()
+	return err
+}
+
+// TagDate extracts the date embedded in tagName using DatePattern and
+// DateLayout. Returns false if there is no pattern, or the tag name does not
+// contain a date matching it.
+func (vc *VersionConstraint) TagDate(tagName string) (time.Time, bool) {
+	if vc.DatePattern == nil {
+		return time.Time{}, false
+	}
+	m := vc.DatePattern.FindStringSubmatch(tagName)
+	if m == nil {
+		return time.Time{}, false
+	}
+	date := m[0]
+	if len(m) > 1 {
+		date = m[1]
+	}
+	layout := vc.DateLayout
+	if layout == "" {
+		layout = DefaultTagDateLayout
+	}
+	t, err := time.Parse(layout, date)
+	if err != nil {
+		log.Tracef("could not parse date %s of tag %s: %v", date, tagName, err)
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// IsTagAllowed returns true if tag is one of the tags in AllowTags and is
+// not denied
+func (vc *VersionConstraint) IsTagAllowed(tag string) bool {
+	return containsTag(vc.AllowTags, tag) && !vc.IsTagDenied(tag)
+}
+
+// IsTagDenied returns true if tag is one of the tags in DenyTags
+func (vc *VersionConstraint) IsTagDenied(tag string) bool {
+	return containsTag(vc.DenyTags, tag)
+}
+
+// containsTag returns true if tags contains tag
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
 			return true
 		}
 	}
 	return false
 }
+
+// IsPrereleaseIgnored returns whether tag is dropped for being a pre-release.
+// Only tags that are semantic versions can be pre-releases, and the variant
+// suffix is not considered part of the pre-release component.
+func (vc *VersionConstraint) IsPrereleaseIgnored(tag string) bool {
+	if !vc.IgnorePrerelease {
+		return false
+	}
+	ver, err := semver.NewVersion(strings.TrimSuffix(tag, vc.VariantSuffix))
+	if err != nil || ver.Prerelease() == "" {
+		return false
+	}
+	if vc.AllowPrereleaseFor != "" {
+		track, err := semver.NewConstraint(vc.AllowPrereleaseFor)
+		if err != nil {
+			log.Warnf("invalid constraint '%s' for allowing pre-releases: %v", vc.AllowPrereleaseFor, err)
+			return true
+		}
+		release, err := ver.SetPrerelease("")
+		if err == nil && track.Check(&release) {
+			return false
+		}
+	}
+	return true
+}
+
+// SemverWarning returns a warning if the constraint sorts by semver, but none
+// of the given tags is a semantic version or explicitly allowed, i.e. because
+// the image is only tagged latest or stable. No tag can be selected for
+// update in that case. Returns the empty string otherwise.
+func (vc *VersionConstraint) SemverWarning(tags []string) string {
+	if vc.SortMode != VersionSortSemVer || len(tags) == 0 {
+		return ""
+	}
+	for _, t := range tags {
+		if vc.IsTagAllowed(t) {
+			return ""
+		}
+		key, _ := NormalizeTag(t, vc)
+		if _, err := semver.NewVersion(strings.TrimSuffix(key, vc.VariantSuffix)); err == nil {
+			return ""
+		}
+	}
+	examples := append([]string{}, tags...)
+	sort.Strings(examples)
+	if len(examples) > 3 {
+		examples = append(examples[:3], "...")
+	}
+	return fmt.Sprintf("none of the %d tags is a semantic version (%s), so the semver update strategy cannot select any of them; consider using the latest, name or digest update strategy instead", len(tags), strings.Join(examples, ", "))
+}
+
+// versionTrack returns the track of the given version for the given lock
+func versionTrack(ver *semver.Version, lock TrackLock) string {
+	switch lock {
+	case LockMajor:
+		return fmt.Sprintf("%d", ver.Major())
+	case LockMinor:
+		return fmt.Sprintf("%d.%d", ver.Major(), ver.Minor())
+	default:
+		return ""
+	}
+}
+
+// SetTrack derives the track tags are locked to from the tag currently in
+// use. The track is left empty, so that tags are not restricted, if no lock
+// is configured, or the current tag is not a semantic version.
+func (vc *VersionConstraint) SetTrack(current *tag.ImageTag) {
+	vc.Track = ""
+	if vc.Lock == LockNone || current == nil {
+		return
+	}
+	key, _ := NormalizeTag(current.TagName, vc)
+	ver, err := semver.NewVersion(strings.TrimSuffix(key, vc.VariantSuffix))
+	if err != nil {
+		log.Warnf("Not locking tags to the track of current tag %s, which is not a semantic version", current.TagName)
+		return
+	}
+	vc.Track = versionTrack(ver, vc.Lock)
+}
+
+// IsOffTrack returns true if tags are locked to a track, and the given tag is
+// not a semantic version on that track
+func (vc *VersionConstraint) IsOffTrack(tag string) bool {
+	if vc.Track == "" {
+		return false
+	}
+	ver, err := semver.NewVersion(strings.TrimSuffix(tag, vc.VariantSuffix))
+	return err != nil || versionTrack(ver, vc.Lock) != vc.Track
+}
+
+// TagExclusions maps the names of tags that have been excluded from being
+// considered for update to the reason of their exclusion. A nil TagExclusions
+// does not record anything.
+type TagExclusions map[string]string
+
+// Exclude records that tagName was excluded at given filter stage
+func (te TagExclusions) Exclude(tagName, stage, format string, args ...interface{}) {
+	if te == nil {
+		return
+	}
+	te[tagName] = stage + ": " + fmt.Sprintf(format, args...)
+}
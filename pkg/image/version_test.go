@@ -1,6 +1,9 @@
 package image
 
 import (
+	"fmt"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -107,3 +110,589 @@ func Test_LatestVersion(t *testing.T) {
 	})
 
 }
+
+func Test_SelectVersion(t *testing.T) {
+	t.Run("Select version with alternative", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.4.0", "1.4.1", "1.4.2", "2.0.0"})
+		img := NewFromIdentifier("jannfis/test:1.4.0")
+		vc := VersionConstraint{Constraint: "~1.4"}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		require.NotNil(t, selection.Alternative)
+		assert.Equal(t, "1.4.2", selection.Selected.TagName)
+		assert.Equal(t, "1.4.1", selection.Alternative.TagName)
+	})
+
+	t.Run("Alternative keeps date and digest", func(t *testing.T) {
+		tagList := tag.NewImageTagList()
+		for i, name := range []string{"1.0.0", "1.0.1"} {
+			it := tag.NewImageTag(name, time.Unix(int64(i*10), 0))
+			it.TagDigest = "sha256:" + name
+			tagList.Add(it)
+		}
+		img := NewFromIdentifier("jannfis/test:1.0.0")
+		selection, err := img.SelectVersionFromTags(&VersionConstraint{}, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Alternative)
+		assert.Equal(t, "sha256:1.0.0", selection.Alternative.TagDigest)
+		assert.Equal(t, time.Unix(0, 0), *selection.Alternative.TagDate)
+	})
+
+	t.Run("No alternative for single candidate", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.4.0"})
+		img := NewFromIdentifier("jannfis/test:1.4.0")
+		selection, err := img.SelectVersionFromTags(&VersionConstraint{}, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "1.4.0", selection.Selected.TagName)
+		assert.Nil(t, selection.Alternative)
+	})
+}
+
+func Test_BuildMetadataVersion(t *testing.T) {
+	tagList := newImageTagList([]string{"1.0.0+5", "1.0.0+10", "1.0.0+9", "0.9.0+20"})
+	img := NewFromIdentifier("jannfis/test:1.0.0+5")
+
+	t.Run("Build metadata orders equal versions", func(t *testing.T) {
+		vc := VersionConstraint{CompareBuildMetadata: true}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		require.NotNil(t, selection.Alternative)
+		assert.Equal(t, "1.0.0+10", selection.Selected.TagName)
+		assert.Equal(t, "1.0.0+9", selection.Alternative.TagName)
+	})
+
+	t.Run("Build metadata with constraint", func(t *testing.T) {
+		vc := VersionConstraint{Constraint: "~1.0", CompareBuildMetadata: true}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "1.0.0+10", selection.Selected.TagName)
+	})
+}
+
+func Test_SemverConstraint(t *testing.T) {
+	t.Run("Parse range", func(t *testing.T) {
+		vc := VersionConstraint{Constraint: ">= 1.4, < 2.0"}
+		require.NoError(t, vc.Validate())
+		c, err := vc.SemverConstraint()
+		require.NoError(t, err)
+		require.NotNil(t, c)
+	})
+	t.Run("No range without constraint or for other strategies", func(t *testing.T) {
+		c, err := (&VersionConstraint{}).SemverConstraint()
+		require.NoError(t, err)
+		assert.Nil(t, c)
+		vc := VersionConstraint{Constraint: "stable", SortMode: VersionSortDigest}
+		require.NoError(t, vc.Validate())
+	})
+	t.Run("Invalid range", func(t *testing.T) {
+		vc := VersionConstraint{Constraint: "not a range"}
+		err := vc.Validate()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid semver constraint 'not a range'")
+	})
+	t.Run("Select newest version below ceiling", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.4.0", "1.9.9", "2.0.0"})
+		img := NewFromIdentifier("jannfis/test:1.4.0")
+		newTag, err := img.GetNewestVersionFromTags(&VersionConstraint{Constraint: "< 2.0.0"}, tagList)
+		require.NoError(t, err)
+		assert.Equal(t, "1.9.9", newTag.TagName)
+	})
+}
+
+func Test_AllowDenyTags(t *testing.T) {
+	t.Run("Allowed tags rank below versions", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.0.0", "1.1.0", "canary", "edge", "nightly"})
+		img := NewFromIdentifier("jannfis/test:1.0.0")
+		vc := VersionConstraint{AllowTags: []string{"edge", "canary"}}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "1.1.0", selection.Selected.TagName)
+		assert.Equal(t, []string{"canary", "edge", "1.0.0", "1.1.0"}, selection.Candidates.Tags())
+	})
+
+	t.Run("Allowed tag is selected without versions", func(t *testing.T) {
+		tagList := newImageTagList([]string{"canary", "nightly"})
+		img := NewFromIdentifier("jannfis/test:canary")
+		vc := VersionConstraint{Constraint: "~1.0", AllowTags: []string{"canary"}}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "canary", selection.Selected.TagName)
+	})
+
+	t.Run("Allowed version bypasses constraint", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.0.0", "1.0.1", "2.0.0"})
+		img := NewFromIdentifier("jannfis/test:1.0.0")
+		vc := VersionConstraint{Constraint: "~1.0", AllowTags: []string{"2.0.0"}}
+		newTag, err := img.GetNewestVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		assert.Equal(t, "2.0.0", newTag.TagName)
+	})
+
+	t.Run("Denied tags are not allowed", func(t *testing.T) {
+		vc := VersionConstraint{AllowTags: []string{"canary", "edge"}, DenyTags: []string{"edge"}}
+		assert.True(t, vc.IsTagAllowed("canary"))
+		assert.False(t, vc.IsTagAllowed("edge"))
+		assert.False(t, vc.IsTagAllowed("nightly"))
+		assert.True(t, vc.IsTagDenied("edge"))
+	})
+}
+
+func Test_TagDateVersion(t *testing.T) {
+	t.Run("Extract date from capturing group", func(t *testing.T) {
+		vc := VersionConstraint{DatePattern: regexp.MustCompile(`^app-(\d{8})-\d+$`)}
+		date, ok := vc.TagDate("app-20240115-1")
+		require.True(t, ok)
+		assert.Equal(t, time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), date)
+		_, ok = vc.TagDate("app-2024011-1")
+		assert.False(t, ok)
+		_, ok = vc.TagDate("app-20241315-1")
+		assert.False(t, ok)
+	})
+
+	t.Run("Extract date from whole match with custom layout", func(t *testing.T) {
+		vc := VersionConstraint{DatePattern: regexp.MustCompile(`\d{4}-\d{2}-\d{2}`), DateLayout: "2006-01-02"}
+		date, ok := vc.TagDate("build.2023-12-31")
+		require.True(t, ok)
+		assert.Equal(t, time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC), date)
+	})
+
+	t.Run("No date without pattern", func(t *testing.T) {
+		_, ok := (&VersionConstraint{}).TagDate("app-20240115-1")
+		assert.False(t, ok)
+	})
+
+	t.Run("Select tag with most recent date", func(t *testing.T) {
+		tagList := tag.NewImageTagList()
+		tagList.Add(tag.NewImageTag("app-20240115-1", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)))
+		tagList.Add(tag.NewImageTag("app-20240115-2", time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC)))
+		tagList.Add(tag.NewImageTag("app-20231231-7", time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC)))
+		img := NewFromIdentifier("jannfis/test:app-20231231-7")
+		selection, err := img.SelectVersionFromTags(&VersionConstraint{SortMode: VersionSortDate}, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "app-20240115-2", selection.Selected.TagName)
+		assert.Equal(t, "app-20240115-1", selection.Alternative.TagName)
+	})
+}
+
+func Test_VariantVersion(t *testing.T) {
+	t.Run("Select highest version that has the variant", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.2.1", "1.2.1-debug", "1.2.2", "1.2.2-debug", "1.2.3"})
+		img := NewFromIdentifier("jannfis/test:1.2.1-debug")
+		vc := VersionConstraint{VariantSuffix: "-debug"}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "1.2.2-debug", selection.Selected.TagName)
+		require.NotNil(t, selection.Alternative)
+		assert.Equal(t, "1.2.1-debug", selection.Alternative.TagName)
+	})
+
+	t.Run("Variant with constraint", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.2.1", "1.2.1-distroless", "1.3.0", "1.3.0-distroless"})
+		img := NewFromIdentifier("jannfis/test:1.2.1-distroless")
+		vc := VersionConstraint{Constraint: "~1.2", VariantSuffix: "-distroless"}
+		newTag, err := img.GetNewestVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, newTag)
+		assert.Equal(t, "1.2.1-distroless", newTag.TagName)
+	})
+
+	t.Run("No version has the variant", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.2.1", "1.2.2"})
+		img := NewFromIdentifier("jannfis/test:1.2.0-debug")
+		vc := VersionConstraint{VariantSuffix: "-debug"}
+		newTag, err := img.GetNewestVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, newTag)
+		assert.Equal(t, "1.2.0-debug", newTag.TagName)
+	})
+
+	t.Run("Variant is part of the key", func(t *testing.T) {
+		vc := VersionConstraint{Constraint: "~1.2", VariantSuffix: "-debug"}
+		other := VersionConstraint{Constraint: "~1.2", VariantSuffix: "-distroless"}
+		assert.NotEqual(t, vc.Key(), other.Key())
+		assert.NotEqual(t, vc.Key(), (&VersionConstraint{Constraint: "~1.2"}).Key())
+	})
+}
+
+func Test_SelectVersionPlatform(t *testing.T) {
+	tagList := newImageTagList([]string{"1.0.0", "1.0.1"})
+	tagList.Get("1.0.1").TagPlatform = "linux/arm64"
+
+	t.Run("Include platform in selection", func(t *testing.T) {
+		img := NewFromIdentifier("jannfis/test:1.0.0")
+		vc := VersionConstraint{IncludePlatform: true}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "1.0.1", selection.Selected.TagName)
+		assert.Equal(t, "linux/arm64", selection.Platform)
+		assert.Equal(t, "linux/arm64", img.WithTag(selection.Selected).GetPlatform())
+	})
+
+	t.Run("Do not include platform unless requested", func(t *testing.T) {
+		img := NewFromIdentifier("jannfis/test:1.0.0")
+		vc := VersionConstraint{}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		assert.Equal(t, "", selection.Platform)
+	})
+}
+
+func Test_SelectVersionExplained(t *testing.T) {
+	tagList := newImageTagList([]string{"1.0.0", "1.1.0", "2.0.0", "latest"})
+
+	t.Run("Record reasons for excluded tags", func(t *testing.T) {
+		img := NewFromIdentifier("jannfis/test:1.0.0")
+		vc := VersionConstraint{Constraint: "~1.0", Explain: true}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		assert.Equal(t, "1.0.0", selection.Selected.TagName)
+		assert.Len(t, selection.Excluded, 3)
+		assert.Equal(t, "semver: not a valid semantic version", selection.Excluded["latest"])
+		assert.Equal(t, "constraint: does not satisfy constraint ~1.0", selection.Excluded["2.0.0"])
+		assert.Contains(t, selection.Excluded, "1.1.0")
+	})
+
+	t.Run("Do not record reasons unless requested", func(t *testing.T) {
+		img := NewFromIdentifier("jannfis/test:1.0.0")
+		vc := VersionConstraint{Constraint: "~1.0"}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		assert.Nil(t, selection.Excluded)
+	})
+}
+
+func Test_MaxJump(t *testing.T) {
+	tagList := newImageTagList([]string{"1.0.0", "1.0.1", "1.1.0", "1.1.2", "1.2.0", "2.0.0", "2.1.0"})
+
+	t.Run("Limit jump by minor versions", func(t *testing.T) {
+		img := NewFromIdentifier("jannfis/test:1.0.0")
+		vc := VersionConstraint{MaxJump: 1, MaxJumpUnit: JumpUnitMinor}
+		newTag, err := img.GetNewestVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, newTag)
+		assert.Equal(t, "1.1.2", newTag.TagName)
+	})
+
+	t.Run("Limit jump by major versions", func(t *testing.T) {
+		img := NewFromIdentifier("jannfis/test:1.0.0")
+		vc := VersionConstraint{MaxJump: 1, MaxJumpUnit: JumpUnitMajor}
+		newTag, err := img.GetNewestVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, newTag)
+		assert.Equal(t, "2.1.0", newTag.TagName)
+	})
+
+	t.Run("Limit jump by tags", func(t *testing.T) {
+		img := NewFromIdentifier("jannfis/test:1.1.0")
+		vc := VersionConstraint{MaxJump: 2, Explain: true}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "1.2.0", selection.Selected.TagName)
+		assert.Equal(t, "max-jump: more than 2 steps beyond current version 1.1.0", selection.Excluded["2.0.0"])
+	})
+
+	t.Run("Current version not in list", func(t *testing.T) {
+		img := NewFromIdentifier("jannfis/test:1.0.5")
+		vc := VersionConstraint{MaxJump: 1, MaxJumpUnit: JumpUnitPatch}
+		newTag, err := img.GetNewestVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, newTag)
+		assert.Equal(t, "1.1.0", newTag.TagName)
+	})
+
+	t.Run("Limit jump by positions when sorting by name", func(t *testing.T) {
+		nameList := newImageTagList([]string{"a", "b", "c", "d"})
+		img := NewFromIdentifier("jannfis/test:b")
+		vc := VersionConstraint{SortMode: VersionSortName, MaxJump: 1, MaxJumpUnit: JumpUnitMinor}
+		newTag, err := img.GetNewestVersionFromTags(&vc, nameList)
+		require.NoError(t, err)
+		require.NotNil(t, newTag)
+		assert.Equal(t, "c", newTag.TagName)
+	})
+
+	t.Run("Current tag unknown when sorting by name", func(t *testing.T) {
+		nameList := newImageTagList([]string{"a", "b", "c", "d"})
+		img := NewFromIdentifier("jannfis/test:x")
+		vc := VersionConstraint{SortMode: VersionSortName, MaxJump: 1}
+		newTag, err := img.GetNewestVersionFromTags(&vc, nameList)
+		require.NoError(t, err)
+		require.NotNil(t, newTag)
+		assert.Equal(t, "d", newTag.TagName)
+	})
+}
+
+func Test_SelectVersionCandidates(t *testing.T) {
+	tagList := newImageTagList([]string{"1.0.0", "1.1.0", "1.2.0", "2.0.0", "foo"})
+	img := NewFromIdentifier("jannfis/test:1.0.0")
+	vc := VersionConstraint{Constraint: "^1.0"}
+	selection, err := img.SelectVersionFromTags(&vc, tagList)
+	require.NoError(t, err)
+	names := []string{}
+	for _, c := range selection.Candidates {
+		names = append(names, c.TagName)
+	}
+	assert.Equal(t, []string{"1.0.0", "1.1.0", "1.2.0"}, names)
+}
+
+func Test_TagTransform(t *testing.T) {
+	img := NewFromIdentifier("jannfis/test:1.0.0")
+	stripInternal := func(t *tag.ImageTag) *tag.ImageTag {
+		t.TagName = strings.TrimSuffix(t.TagName, "-internal")
+		return t
+	}
+
+	t.Run("Selected tag and alternative are transformed", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.0.0-internal", "1.1.0-internal", "1.2.0-internal"})
+		vc := VersionConstraint{TagTransform: stripInternal}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		assert.Equal(t, "1.2.0", selection.Selected.TagName)
+		assert.Equal(t, "1.1.0", selection.Alternative.TagName)
+		// The tags in the list are not modified
+		assert.NotNil(t, tagList.Get("1.2.0-internal"))
+		assert.Equal(t, "1.2.0-internal", selection.Candidates[len(selection.Candidates)-1].TagName)
+	})
+
+	t.Run("Meta data of tags in the list is not modified", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.0.0", "1.1.0"})
+		tagList.Get("1.1.0").TagInfo = &tag.TagInfo{Labels: map[string]string{"channel": "stable"}}
+		vc := VersionConstraint{TagTransform: func(t *tag.ImageTag) *tag.ImageTag {
+			if t.TagInfo != nil {
+				t.TagInfo.Labels["channel"] = "transformed"
+			}
+			return t
+		}}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		assert.Equal(t, "transformed", selection.Selected.TagInfo.Labels["channel"])
+		assert.Equal(t, "stable", tagList.Get("1.1.0").TagInfo.Labels["channel"])
+	})
+
+	t.Run("Returning nil keeps the tag", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.0.0", "1.1.0"})
+		vc := VersionConstraint{TagTransform: func(*tag.ImageTag) *tag.ImageTag { return nil }}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		assert.Equal(t, "1.1.0", selection.Selected.TagName)
+	})
+
+	t.Run("Current tag is not transformed without candidates", func(t *testing.T) {
+		tagList := newImageTagList([]string{"2.0.0-internal"})
+		vc := VersionConstraint{Constraint: "^1.0", TagTransform: stripInternal}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		assert.Same(t, img.ImageTag, selection.Selected)
+	})
+}
+
+func Test_VerifyCandidate(t *testing.T) {
+	img := NewFromIdentifier("jannfis/test:1.0.0")
+
+	t.Run("Candidates are verified from the newest down", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.0.0", "1.1.0", "1.2.0", "1.3.0"})
+		verified := []string{}
+		vc := VersionConstraint{Explain: true, VerifyCandidate: func(t *tag.ImageTag) (string, error) {
+			verified = append(verified, t.TagName)
+			if t.TagName == "1.3.0" {
+				return "not signed", nil
+			}
+			return "", nil
+		}}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		assert.Equal(t, "1.2.0", selection.Selected.TagName)
+		assert.Equal(t, []string{"1.3.0", "1.2.0"}, verified)
+		assert.Equal(t, "signature: not signed", selection.Excluded["1.3.0"])
+	})
+
+	t.Run("Errors fail the selection", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.0.0", "1.1.0"})
+		vc := VersionConstraint{VerifyCandidate: func(*tag.ImageTag) (string, error) {
+			return "", fmt.Errorf("registry unavailable")
+		}}
+		_, err := img.SelectVersionFromTags(&vc, tagList)
+		assert.Error(t, err)
+	})
+
+	t.Run("Required signature without verifier fails the selection", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.0.0", "1.1.0"})
+		vc := VersionConstraint{RequireSignature: &SignaturePolicy{PublicKey: []byte("key")}}
+		_, err := img.SelectVersionFromTags(&vc, tagList)
+		assert.Error(t, err)
+	})
+}
+
+func Test_PartialSemVer(t *testing.T) {
+	t.Run("Single part versions are compared as major versions", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1", "2", "10", "3"})
+		img := NewFromIdentifier("jannfis/test:2")
+		vc := VersionConstraint{}
+		newTag, err := img.GetNewestVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, newTag)
+		assert.Equal(t, "10", newTag.TagName)
+	})
+
+	t.Run("Two part versions are compared as if patch was 0", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1.4", "1.10", "1.9", "2.0"})
+		img := NewFromIdentifier("jannfis/test:1.4")
+		vc := VersionConstraint{Constraint: "~1.4 || ^1.5"}
+		newTag, err := img.GetNewestVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, newTag)
+		assert.Equal(t, "1.10", newTag.TagName)
+	})
+
+	t.Run("Mixed width versions keep their original names", func(t *testing.T) {
+		tagList := newImageTagList([]string{"1", "1.4", "1.4.1", "1.5", "2"})
+		img := NewFromIdentifier("jannfis/test:1.4")
+		vc := VersionConstraint{Constraint: "<2.0.0"}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "1.5", selection.Selected.TagName)
+		require.NotNil(t, selection.Alternative)
+		assert.Equal(t, "1.4.1", selection.Alternative.TagName)
+	})
+}
+
+func Test_DigestVersion(t *testing.T) {
+	newDigestTagList := func(digests map[string]string) *tag.ImageTagList {
+		tagList := tag.NewImageTagList()
+		for tagName, digest := range digests {
+			imgTag := tag.NewImageTag(tagName, time.Unix(0, 0))
+			imgTag.TagDigest = digest
+			tagList.Add(imgTag)
+		}
+		return tagList
+	}
+
+	t.Run("Select tracked tag with changed digest", func(t *testing.T) {
+		tagList := newDigestTagList(map[string]string{"stable": "sha256:new", "latest": "sha256:other"})
+		img := NewFromIdentifier("jannfis/test:stable@sha256:old")
+		vc := VersionConstraint{Constraint: "stable", SortMode: VersionSortDigest, Explain: true}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "stable", selection.Selected.TagName)
+		assert.Equal(t, "sha256:new", selection.Selected.TagDigest)
+		assert.Equal(t, "digest: not the tracked tag stable", selection.Excluded["latest"])
+	})
+
+	t.Run("Tag without known digest is not selected", func(t *testing.T) {
+		tagList := newDigestTagList(map[string]string{"stable": ""})
+		img := NewFromIdentifier("jannfis/test:stable@sha256:old")
+		vc := VersionConstraint{Constraint: "stable", SortMode: VersionSortDigest}
+		selection, err := img.SelectVersionFromTags(&vc, tagList)
+		require.NoError(t, err)
+		assert.Empty(t, selection.Candidates)
+		assert.Equal(t, "sha256:old", selection.Selected.TagDigest)
+	})
+}
+
+func Test_IsPrereleaseIgnored(t *testing.T) {
+	t.Run("Pre-releases are ignored", func(t *testing.T) {
+		vc := VersionConstraint{IgnorePrerelease: true}
+		assert.True(t, vc.IsPrereleaseIgnored("1.3.0-rc1"))
+		assert.True(t, vc.IsPrereleaseIgnored("v2.0.0-beta.2"))
+		assert.False(t, vc.IsPrereleaseIgnored("1.3.0"))
+		assert.False(t, vc.IsPrereleaseIgnored("latest"))
+	})
+	t.Run("Pre-releases are kept unless requested", func(t *testing.T) {
+		vc := VersionConstraint{}
+		assert.False(t, vc.IsPrereleaseIgnored("1.3.0-rc1"))
+	})
+	t.Run("Pre-releases of allowed track are kept", func(t *testing.T) {
+		vc := VersionConstraint{IgnorePrerelease: true, AllowPrereleaseFor: "~2.0"}
+		assert.False(t, vc.IsPrereleaseIgnored("2.0.1-rc1"))
+		assert.True(t, vc.IsPrereleaseIgnored("2.1.0-rc1"))
+		assert.True(t, vc.IsPrereleaseIgnored("1.3.0-rc1"))
+	})
+	t.Run("Variant suffix is not a pre-release", func(t *testing.T) {
+		vc := VersionConstraint{IgnorePrerelease: true, VariantSuffix: "-alpine"}
+		assert.False(t, vc.IsPrereleaseIgnored("1.3.0-alpine"))
+		assert.True(t, vc.IsPrereleaseIgnored("1.3.0-rc1-alpine"))
+	})
+}
+
+func Test_TrackLock(t *testing.T) {
+	t.Run("Lock to minor version", func(t *testing.T) {
+		vc := VersionConstraint{Lock: LockMinor}
+		vc.SetTrack(tag.NewImageTag("v1.4.2", time.Unix(0, 0)))
+		assert.Equal(t, "1.4", vc.Track)
+		assert.False(t, vc.IsOffTrack("1.4.0"))
+		assert.False(t, vc.IsOffTrack("v1.4.10"))
+		assert.True(t, vc.IsOffTrack("1.5.0"))
+		assert.True(t, vc.IsOffTrack("2.4.0"))
+		assert.True(t, vc.IsOffTrack("latest"))
+	})
+	t.Run("Lock to major version", func(t *testing.T) {
+		vc := VersionConstraint{Lock: LockMajor}
+		vc.SetTrack(tag.NewImageTag("1.4.2", time.Unix(0, 0)))
+		assert.Equal(t, "1", vc.Track)
+		assert.False(t, vc.IsOffTrack("1.9.0"))
+		assert.True(t, vc.IsOffTrack("2.0.0"))
+	})
+	t.Run("Lock with variant suffix", func(t *testing.T) {
+		vc := VersionConstraint{Lock: LockMinor, VariantSuffix: "-alpine"}
+		vc.SetTrack(tag.NewImageTag("1.4.2-alpine", time.Unix(0, 0)))
+		assert.Equal(t, "1.4", vc.Track)
+		assert.False(t, vc.IsOffTrack("1.4.3-alpine"))
+	})
+	t.Run("No track without semantic version", func(t *testing.T) {
+		vc := VersionConstraint{Lock: LockMinor}
+		vc.SetTrack(tag.NewImageTag("latest", time.Unix(0, 0)))
+		assert.Equal(t, "", vc.Track)
+		assert.False(t, vc.IsOffTrack("2.0.0"))
+	})
+	t.Run("No track without lock", func(t *testing.T) {
+		vc := VersionConstraint{}
+		vc.SetTrack(tag.NewImageTag("1.4.2", time.Unix(0, 0)))
+		assert.Equal(t, "", vc.Track)
+		assert.False(t, vc.IsOffTrack("2.0.0"))
+	})
+	t.Run("Track is part of the key", func(t *testing.T) {
+		vc := VersionConstraint{Lock: LockMinor}
+		vc.SetTrack(tag.NewImageTag("1.4.2", time.Unix(0, 0)))
+		other := VersionConstraint{Lock: LockMinor}
+		other.SetTrack(tag.NewImageTag("1.5.0", time.Unix(0, 0)))
+		assert.NotEqual(t, vc.Key(), other.Key())
+	})
+}
+
+func Test_SemverWarning(t *testing.T) {
+	t.Run("Warn if no tag is a semantic version", func(t *testing.T) {
+		vc := VersionConstraint{}
+		warning := vc.SemverWarning([]string{"stable", "latest", "edge", "nightly"})
+		assert.Contains(t, warning, "none of the 4 tags is a semantic version (edge, latest, nightly, ...)")
+		assert.Contains(t, warning, "latest, name or digest update strategy")
+	})
+	t.Run("No warning with a semantic version", func(t *testing.T) {
+		vc := VersionConstraint{}
+		assert.Empty(t, vc.SemverWarning([]string{"latest", "v1.0.0"}))
+	})
+	t.Run("No warning with normalized semantic versions", func(t *testing.T) {
+		vc := VersionConstraint{Normalization: &TagNormalization{StripPrefix: "release-"}}
+		assert.Empty(t, vc.SemverWarning([]string{"latest", "release-1.0.0"}))
+	})
+	t.Run("No warning with allowed tags", func(t *testing.T) {
+		vc := VersionConstraint{AllowTags: []string{"stable"}}
+		assert.Empty(t, vc.SemverWarning([]string{"latest", "stable"}))
+	})
+	t.Run("No warning with other strategies or without tags", func(t *testing.T) {
+		vc := VersionConstraint{SortMode: VersionSortLatest}
+		assert.Empty(t, vc.SemverWarning([]string{"latest"}))
+		vc = VersionConstraint{}
+		assert.Empty(t, vc.SemverWarning(nil))
+	})
+}
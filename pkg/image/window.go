@@ -0,0 +1,183 @@
+package image
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UpdateWindow restricts the times at which images may be updated to one or
+// more recurring ranges. A window without ranges is never open.
+type UpdateWindow struct {
+	ranges []windowRange
+}
+
+// windowRange is a range of time on certain days of the week. If the range
+// ends before it starts, it extends into the following day.
+type windowRange struct {
+	// bit i is set if the range starts on time.Weekday(i)
+	days     uint8
+	start    time.Duration
+	end      time.Duration
+	location *time.Location
+}
+
+// Names of the days of the week, as used in update windows
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// allDays has the bits of all days of the week set
+const allDays uint8 = 1<<7 - 1
+
+// ParseUpdateWindow parses a comma-separated list of time ranges, in which
+// updates are allowed. Each range consists of optional days of the week, a
+// time range and an optional time zone, i.e. "Mon-Fri 18:00-07:00
+// Europe/Berlin" or "Sat 00:00-24:00". Days are given as a single day or a
+// range of days, and default to all days. Times are given as HH:MM, and a
+// range that ends before it starts extends into the following day. The time
+// zone defaults to UTC.
+func ParseUpdateWindow(spec string) (*UpdateWindow, error) {
+	window := &UpdateWindow{}
+	for _, rangeSpec := range strings.Split(spec, ",") {
+		fields := strings.Fields(rangeSpec)
+		if len(fields) == 0 {
+			continue
+		}
+		wr := windowRange{days: allDays, location: time.UTC}
+		// The days come first, if given
+		if !strings.ContainsAny(fields[0][:1], "0123456789") {
+			days, err := parseWindowDays(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			wr.days = days
+			fields = fields[1:]
+		}
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("invalid update window '%s': expected [days] HH:MM-HH:MM [time zone]", strings.TrimSpace(rangeSpec))
+		}
+		times := strings.SplitN(fields[0], "-", 2)
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid time range '%s' in update window: expected HH:MM-HH:MM", fields[0])
+		}
+		var err error
+		if wr.start, err = parseWindowTime(times[0]); err != nil {
+			return nil, err
+		}
+		if wr.end, err = parseWindowTime(times[1]); err != nil {
+			return nil, err
+		}
+		if wr.start == 24*time.Hour {
+			return nil, fmt.Errorf("invalid time range '%s' in update window: range must not start at 24:00", fields[0])
+		}
+		if wr.start == wr.end {
+			return nil, fmt.Errorf("invalid time range '%s' in update window: range is empty", fields[0])
+		}
+		if len(fields) == 2 {
+			if wr.location, err = time.LoadLocation(fields[1]); err != nil {
+				return nil, fmt.Errorf("invalid time zone '%s' in update window: %v", fields[1], err)
+			}
+		}
+		window.ranges = append(window.ranges, wr)
+	}
+	if len(window.ranges) == 0 {
+		return nil, fmt.Errorf("update window must not be empty")
+	}
+	return window, nil
+}
+
+// parseWindowDays parses a single day of the week or a range of days, i.e.
+// "Mon-Fri" or "Fri-Mon"
+func parseWindowDays(spec string) (uint8, error) {
+	names := strings.SplitN(strings.ToLower(spec), "-", 2)
+	first, ok := weekdays[names[0]]
+	if !ok {
+		return 0, fmt.Errorf("invalid day '%s' in update window", names[0])
+	}
+	last := first
+	if len(names) == 2 {
+		if last, ok = weekdays[names[1]]; !ok {
+			return 0, fmt.Errorf("invalid day '%s' in update window", names[1])
+		}
+	}
+	var days uint8
+	for d := first; ; d = (d + 1) % 7 {
+		days |= 1 << uint(d)
+		if d == last {
+			break
+		}
+	}
+	return days, nil
+}
+
+// parseWindowTime parses a time of day given as HH:MM, where 24:00 is the end
+// of the day
+func parseWindowTime(spec string) (time.Duration, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) == 2 && len(parts[1]) == 2 {
+		hours, herr := strconv.Atoi(parts[0])
+		minutes, merr := strconv.Atoi(parts[1])
+		if herr == nil && merr == nil && hours >= 0 && minutes >= 0 && minutes < 60 && (hours < 24 || hours == 24 && minutes == 0) {
+			return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time '%s' in update window: expected HH:MM", spec)
+}
+
+// IsOpen returns true if updates are allowed at the given time
+func (w *UpdateWindow) IsOpen(t time.Time) bool {
+	for _, wr := range w.ranges {
+		if wr.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextOpen returns the time at which the window opens next, which is t if the
+// window is open at t. Returns the zero time if the window never opens.
+func (w *UpdateWindow) NextOpen(t time.Time) time.Time {
+	if w.IsOpen(t) {
+		return t
+	}
+	var next time.Time
+	for _, wr := range w.ranges {
+		local := t.In(wr.location)
+		for i := 0; i <= 7; i++ {
+			// Days are counted by date, so that days with a daylight saving
+			// time change do not shift the start
+			start := time.Date(local.Year(), local.Month(), local.Day()+i, 0, int(wr.start/time.Minute), 0, 0, wr.location)
+			if wr.days&(1<<uint(start.Weekday())) == 0 {
+				continue
+			}
+			if start.After(t) {
+				if next.IsZero() || start.Before(next) {
+					next = start
+				}
+				break
+			}
+		}
+	}
+	return next
+}
+
+// contains returns true if t falls into the range, either on a day the range
+// starts on, or on the following day if the range extends into it
+func (wr windowRange) contains(t time.Time) bool {
+	local := t.In(wr.location)
+	sinceMidnight := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute + time.Duration(local.Second())*time.Second
+	today := wr.days&(1<<uint(local.Weekday())) != 0
+	yesterday := wr.days&(1<<uint((local.Weekday()+6)%7)) != 0
+	if wr.start < wr.end {
+		return today && sinceMidnight >= wr.start && sinceMidnight < wr.end
+	}
+	return today && sinceMidnight >= wr.start || yesterday && sinceMidnight < wr.end
+}
@@ -0,0 +1,121 @@
+package image
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseUpdateWindow(t *testing.T) {
+	t.Run("Valid update windows", func(t *testing.T) {
+		for _, spec := range []string{
+			"18:00-07:00",
+			"Mon-Fri 18:00-07:00",
+			"sat 00:00-24:00",
+			"Fri-Mon 22:00-23:30 Europe/Berlin",
+			"Mon-Fri 18:00-07:00, Sat-Sun 00:00-24:00",
+		} {
+			w, err := ParseUpdateWindow(spec)
+			require.NoError(t, err, spec)
+			assert.NotNil(t, w, spec)
+		}
+	})
+
+	t.Run("Invalid update windows", func(t *testing.T) {
+		for spec, msg := range map[string]string{
+			"":                         "must not be empty",
+			"Mon-Fri":                  "expected [days] HH:MM-HH:MM",
+			"Someday 18:00-07:00":      "invalid day 'someday'",
+			"Mon-Someday 18:00-07:00":  "invalid day 'someday'",
+			"18:00":                    "expected HH:MM-HH:MM",
+			"18:00-25:00":              "invalid time '25:00'",
+			"18:0-19:00":               "invalid time '18:0'",
+			"18:00-18:00":              "range is empty",
+			"24:00-06:00":              "must not start at 24:00",
+			"18:00-07:00 Nowhere/City": "invalid time zone 'Nowhere/City'",
+			"Mon 18:00-07:00 UTC more": "expected [days] HH:MM-HH:MM",
+		} {
+			_, err := ParseUpdateWindow(spec)
+			require.Error(t, err, spec)
+			assert.Contains(t, err.Error(), msg, spec)
+		}
+	})
+}
+
+func Test_UpdateWindowIsOpen(t *testing.T) {
+	// 2021-05-10 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2021, 5, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	t.Run("Window within a day", func(t *testing.T) {
+		w, err := ParseUpdateWindow("Mon-Fri 09:00-17:00")
+		require.NoError(t, err)
+		assert.False(t, w.IsOpen(at(10, 8, 59)))
+		assert.True(t, w.IsOpen(at(10, 9, 0)))
+		assert.True(t, w.IsOpen(at(14, 16, 59)))
+		assert.False(t, w.IsOpen(at(14, 17, 0)))
+		assert.False(t, w.IsOpen(at(15, 12, 0)))
+	})
+
+	t.Run("Window extending into the next day", func(t *testing.T) {
+		w, err := ParseUpdateWindow("Mon-Fri 18:00-07:00")
+		require.NoError(t, err)
+		assert.False(t, w.IsOpen(at(10, 6, 0)))
+		assert.True(t, w.IsOpen(at(10, 18, 0)))
+		assert.True(t, w.IsOpen(at(11, 6, 59)))
+		assert.False(t, w.IsOpen(at(11, 12, 0)))
+		assert.True(t, w.IsOpen(at(15, 6, 0)))
+		assert.False(t, w.IsOpen(at(15, 18, 0)))
+		assert.False(t, w.IsOpen(at(16, 6, 0)))
+	})
+
+	t.Run("Whole days", func(t *testing.T) {
+		w, err := ParseUpdateWindow("Sat-Sun 00:00-24:00")
+		require.NoError(t, err)
+		assert.False(t, w.IsOpen(at(14, 23, 59)))
+		assert.True(t, w.IsOpen(at(15, 0, 0)))
+		assert.True(t, w.IsOpen(at(16, 23, 59)))
+		assert.False(t, w.IsOpen(at(17, 0, 0)))
+	})
+
+	t.Run("Window in time zone", func(t *testing.T) {
+		w, err := ParseUpdateWindow("22:00-23:00 Asia/Tokyo")
+		require.NoError(t, err)
+		assert.True(t, w.IsOpen(at(10, 13, 30)))
+		assert.False(t, w.IsOpen(at(10, 22, 30)))
+	})
+
+	t.Run("Several ranges", func(t *testing.T) {
+		w, err := ParseUpdateWindow("Mon 09:00-10:00, Wed 09:00-10:00")
+		require.NoError(t, err)
+		assert.True(t, w.IsOpen(at(10, 9, 30)))
+		assert.False(t, w.IsOpen(at(11, 9, 30)))
+		assert.True(t, w.IsOpen(at(12, 9, 30)))
+	})
+
+	t.Run("Empty window is never open", func(t *testing.T) {
+		w := &UpdateWindow{}
+		assert.False(t, w.IsOpen(at(10, 12, 0)))
+		assert.True(t, w.NextOpen(at(10, 12, 0)).IsZero())
+	})
+}
+
+func Test_UpdateWindowNextOpen(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2021, 5, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	w, err := ParseUpdateWindow("Mon-Fri 18:00-07:00, Sat 10:00-12:00")
+	require.NoError(t, err)
+	assert.Equal(t, at(10, 20, 0), w.NextOpen(at(10, 20, 0)))
+	assert.Equal(t, at(10, 18, 0), w.NextOpen(at(10, 12, 0)))
+	assert.Equal(t, at(15, 10, 0), w.NextOpen(at(15, 8, 0)))
+	assert.Equal(t, at(17, 18, 0), w.NextOpen(at(15, 12, 0)))
+
+	w, err = ParseUpdateWindow("Mon 02:00-03:00 Europe/Berlin")
+	require.NoError(t, err)
+	assert.True(t, at(17, 0, 0).Equal(w.NextOpen(at(10, 12, 0))))
+}
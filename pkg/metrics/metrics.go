@@ -16,8 +16,9 @@ var cpm *ClientMetrics
 
 // EndpointMetrics stores metrics for registry endpoints
 type EndpointMetrics struct {
-	requestsTotal  *prometheus.CounterVec
-	requestsFailed *prometheus.CounterVec
+	requestsTotal          *prometheus.CounterVec
+	requestsFailed         *prometheus.CounterVec
+	immutableTagViolations *prometheus.CounterVec
 }
 
 // ApplicationMetrics stores metrics for applications
@@ -58,6 +59,10 @@ func NewEndpointMetrics() *EndpointMetrics {
 		Name: "argocd_image_updater_registry_requests_failed_total",
 		Help: "The number of failed requests to this endpoint",
 	}, []string{"registry"})
+	metrics.immutableTagViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "argocd_image_updater_registry_immutable_tag_violations_total",
+		Help: "The number of times the digest of an immutable tag has changed",
+	}, []string{"registry"})
 
 	return metrics
 }
@@ -139,6 +144,11 @@ func (epm *EndpointMetrics) IncreaseRequest(registryURL string, isFailed bool) {
 	}
 }
 
+// IncreaseImmutableTagViolation increases the counter for changed immutable tags
+func (epm *EndpointMetrics) IncreaseImmutableTagViolation(registryURL string) {
+	epm.immutableTagViolations.WithLabelValues(registryURL).Inc()
+}
+
 // SetNumberOfApplications sets the total number of currently watched applications
 func (apm *ApplicationMetrics) SetNumberOfApplications(num int) {
 	apm.applicationsTotal.Set(float64(num))
@@ -0,0 +1,151 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// ArtifactType defines the kind of OCI artifacts the repositories of an
+// endpoint hold
+type ArtifactType int
+
+const (
+	ArtifactImage     ArtifactType = 0
+	ArtifactHelmChart ArtifactType = 1
+)
+
+// Media type of the config of Helm charts that are stored as OCI artifacts
+const HelmChartConfigMediaType = "application/vnd.cncf.helm.config.v1+json"
+
+// ArtifactTypeFromString gets the ArtifactType value from a given string
+func ArtifactTypeFromString(artifactType string) ArtifactType {
+	switch strings.ToLower(artifactType) {
+	case "helm":
+		return ArtifactHelmChart
+	case "image", "":
+		return ArtifactImage
+	default:
+		log.Warnf("unknown artifact type: %s", artifactType)
+		return ArtifactImage
+	}
+}
+
+// String returns the string representation of an ArtifactType
+func (at ArtifactType) String() string {
+	switch at {
+	case ArtifactHelmChart:
+		return "helm"
+	default:
+		return "image"
+	}
+}
+
+// ConfigMediaType returns the media type of the config of the artifacts of
+// this type
+func (at ArtifactType) ConfigMediaType() string {
+	switch at {
+	case ArtifactHelmChart:
+		return HelmChartConfigMediaType
+	default:
+		return ""
+	}
+}
+
+// ConfigMediaTypeClient is implemented by registry clients that are able to
+// resolve the media type of the config a tag's manifest references, which
+// tells apart images from other kinds of OCI artifacts.
+type ConfigMediaTypeClient interface {
+	// ConfigMediaType returns the media type of the config of the manifest
+	// given tag points to, or an empty string if it points to an index
+	ConfigMediaType(ctx context.Context, nameInRepository, tagName string) (string, error)
+}
+
+// ConfigMediaType fetches the manifest of given tag and returns the media type
+// of the config it references
+func (client *registryClient) ConfigMediaType(ctx context.Context, nameInRepository, tagName string) (string, error) {
+	body, err := client.RawManifest(ctx, nameInRepository, tagName)
+	if err != nil {
+		return "", err
+	}
+	return parseConfigMediaType(nameInRepository, tagName, body)
+}
+
+// ConfigMediaType returns the media type of the config referenced by the
+// manifest given tag or digest points to
+func (client *ociLayoutClient) ConfigMediaType(ctx context.Context, nameInRepository, tagName string) (string, error) {
+	desc, err := client.descriptor(nameInRepository, tagName)
+	if err != nil {
+		return "", err
+	}
+	body, err := client.readBlob(client.layoutDir(nameInRepository), desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyDigest(desc.Digest, body); err != nil {
+		return "", err
+	}
+	return parseConfigMediaType(nameInRepository, tagName, body)
+}
+
+// parseConfigMediaType returns the media type of the config referenced by the
+// given manifest. Indexes have no config, so the media type is empty for
+// them.
+func parseConfigMediaType(nameInRepository, tagName string, body []byte) (string, error) {
+	var man struct {
+		Config *struct {
+			MediaType string `json:"mediaType"`
+		} `json:"config"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &man); err != nil {
+		return "", fmt.Errorf("could not parse manifest for %s:%s: %v", nameInRepository, tagName, err)
+	}
+	if man.Config == nil {
+		if man.Manifests != nil {
+			return "", nil
+		}
+		return "", fmt.Errorf("manifest for %s:%s references no config", nameInRepository, tagName)
+	}
+	return man.Config.MediaType, nil
+}
+
+// filterByArtifactType removes all tags from the list whose manifest does not
+// reference a config of the media type of the endpoint's artifact type, i.e.
+// images that are pushed to a repository of Helm charts. The config media
+// types are looked up by the digests the tags point to, so that the manifest
+// is only fetched once for each digest. Tags whose config media type cannot
+// be determined are removed as well. Removed tags are recorded in excluded.
+func (endpoint *RegistryEndpoint) filterByArtifactType(ctx context.Context, nameInRegistry string, tags []string, regClient RegistryClient, excluded image.TagExclusions) []string {
+	cc, ok := regClient.(ConfigMediaTypeClient)
+	if !ok {
+		log.Warnf("registry client for %s cannot determine config media types, not considering any tags of %s", endpoint.RegistryAPI, nameInRegistry)
+		for _, t := range tags {
+			excluded.Exclude(t, "artifact-type", "registry client cannot determine config media type")
+		}
+		return []string{}
+	}
+
+	wanted := endpoint.ArtifactType.ConfigMediaType()
+	tags, mediaTypes := endpoint.filterTagsByDigest(ctx, nameInRegistry, tags, "config media type", "artifact-type", regClient, excluded, cc.ConfigMediaType)
+	matching := []string{}
+	for _, t := range tags {
+		mediaType := mediaTypes[t]
+		if mediaType == "" {
+			log.Debugf("Removing tag %s because it points to an index, not to a %s artifact", t, endpoint.ArtifactType)
+			excluded.Exclude(t, "artifact-type", "tag points to an index")
+			continue
+		}
+		if mediaType != wanted {
+			log.Debugf("Removing tag %s because it is no %s artifact (config media type %s)", t, endpoint.ArtifactType, mediaType)
+			excluded.Exclude(t, "artifact-type", "config media type %s is not %s", mediaType, wanted)
+			continue
+		}
+		matching = append(matching, t)
+	}
+	return matching
+}
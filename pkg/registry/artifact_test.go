@@ -0,0 +1,182 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/cache"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/mocks"
+
+	"github.com/nokia/docker-registry-client/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// configMediaTypeRegistryClient is a RegistryClient that resolves config
+// media types from a map
+type configMediaTypeRegistryClient struct {
+	mocks.RegistryClient
+	mediaTypes map[string]string
+}
+
+func (c *configMediaTypeRegistryClient) ConfigMediaType(ctx context.Context, nameInRepository, tagName string) (string, error) {
+	if mediaType, ok := c.mediaTypes[tagName]; ok {
+		return mediaType, nil
+	}
+	return "", fmt.Errorf("not found")
+}
+
+// configDigestRegistryClient is a RegistryClient that resolves the digests of
+// tags and the config media types of digests from maps, and counts the
+// lookups of config media types
+type configDigestRegistryClient struct {
+	mocks.RegistryClient
+	digests    map[string]string
+	mediaTypes map[string]string
+	lock       sync.Mutex
+	lookups    int
+}
+
+func (c *configDigestRegistryClient) TagDigest(ctx context.Context, nameInRepository, tagName string) (string, error) {
+	if digest, ok := c.digests[tagName]; ok {
+		return digest, nil
+	}
+	return "", fmt.Errorf("not found")
+}
+
+func (c *configDigestRegistryClient) ConfigMediaType(ctx context.Context, nameInRepository, reference string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lookups++
+	if mediaType, ok := c.mediaTypes[reference]; ok {
+		return mediaType, nil
+	}
+	return "", fmt.Errorf("not found")
+}
+
+func Test_ArtifactTypeFromString(t *testing.T) {
+	assert.Equal(t, ArtifactHelmChart, ArtifactTypeFromString("helm"))
+	assert.Equal(t, ArtifactHelmChart, ArtifactTypeFromString("Helm"))
+	assert.Equal(t, ArtifactImage, ArtifactTypeFromString("image"))
+	assert.Equal(t, ArtifactImage, ArtifactTypeFromString(""))
+	assert.Equal(t, ArtifactImage, ArtifactTypeFromString("unknown"))
+	assert.Equal(t, "helm", ArtifactHelmChart.String())
+	assert.Equal(t, "image", ArtifactImage.String())
+}
+
+func Test_ConfigMediaType(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/manifests/chart"):
+			w.Header().Set("Content-Type", ociManifestMediaType)
+			fmt.Fprintf(w, `{"schemaVersion":2,"config":{"mediaType":"%s","digest":"sha256:abc","size":10},"layers":[]}`, HelmChartConfigMediaType)
+		case strings.HasSuffix(r.URL.Path, "/manifests/image"):
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			fmt.Fprint(w, `{"schemaVersion":2,"config":{"mediaType":"application/vnd.docker.container.image.v1+json","digest":"sha256:abc","size":10},"layers":[]}`)
+		case strings.HasSuffix(r.URL.Path, "/manifests/index"):
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			fmt.Fprint(w, `{"schemaVersion":2,"manifests":[]}`)
+		case strings.HasSuffix(r.URL.Path, "/manifests/invalid"):
+			w.Header().Set("Content-Type", ociManifestMediaType)
+			fmt.Fprint(w, `{"schemaVersion":2}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	client := &registryClient{regClient: &registry.Registry{URL: srv.URL, Client: srv.Client()}}
+
+	mediaType, err := client.ConfigMediaType(context.Background(), "charts/foo", "chart")
+	require.NoError(t, err)
+	assert.Equal(t, HelmChartConfigMediaType, mediaType)
+
+	mediaType, err = client.ConfigMediaType(context.Background(), "charts/foo", "image")
+	require.NoError(t, err)
+	assert.Equal(t, "application/vnd.docker.container.image.v1+json", mediaType)
+
+	mediaType, err = client.ConfigMediaType(context.Background(), "charts/foo", "index")
+	require.NoError(t, err)
+	assert.Equal(t, "", mediaType)
+
+	_, err = client.ConfigMediaType(context.Background(), "charts/foo", "invalid")
+	assert.Error(t, err)
+
+	_, err = client.ConfigMediaType(context.Background(), "charts/foo", "missing")
+	assert.Error(t, err)
+}
+
+func Test_GetTagsHelmCharts(t *testing.T) {
+	t.Run("Exclude tags that are no charts", func(t *testing.T) {
+		regClient := &configMediaTypeRegistryClient{mediaTypes: map[string]string{
+			"1.0.0":     HelmChartConfigMediaType,
+			"1.1.0_abc": HelmChartConfigMediaType,
+			"1.2.0":     "application/vnd.oci.image.config.v1+json",
+			"1.3.0":     "",
+		}}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.0", "1.1.0_abc", "1.2.0", "1.3.0", "1.4.0"}, nil)
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache(), ArtifactType: ArtifactHelmChart}
+
+		img := image.NewFromIdentifier("example.com/charts/foo:1.0.0")
+		vc := &image.VersionConstraint{Constraint: "^1.0"}
+		vc.UseChartVersions()
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.0.0", "1.1.0_abc"}, tl.Tags())
+		assert.Equal(t, "artifact-type: config media type application/vnd.oci.image.config.v1+json is not "+HelmChartConfigMediaType, excluded["1.2.0"])
+		assert.Equal(t, "artifact-type: tag points to an index", excluded["1.3.0"])
+		assert.Equal(t, "artifact-type: could not determine config media type: not found", excluded["1.4.0"])
+
+		selected, err := img.GetNewestVersionFromTags(vc, tl)
+		require.NoError(t, err)
+		require.NotNil(t, selected)
+		assert.Equal(t, "1.1.0_abc", selected.TagName)
+	})
+
+	t.Run("Config media types are looked up once per digest", func(t *testing.T) {
+		regClient := &configDigestRegistryClient{
+			digests:    map[string]string{"1.0.0": "sha256:aaa", "1.0.1": "sha256:aaa", "1.1.0": "sha256:bbb"},
+			mediaTypes: map[string]string{"sha256:aaa": HelmChartConfigMediaType, "sha256:bbb": "application/vnd.oci.image.config.v1+json"},
+		}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.0", "1.0.1", "1.1.0", "1.2.0"}, nil)
+		// Tags are resolved one after another, so that tags pointing to the same
+		// digest are not looked up concurrently
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache(), ArtifactType: ArtifactHelmChart, MaxStreams: 1}
+		img := image.NewFromIdentifier("example.com/charts/foo:1.0.0")
+		vc := &image.VersionConstraint{Constraint: "^1.0"}
+
+		for i := 0; i < 2; i++ {
+			tl, excluded, err := ep.GetTagsExplained(context.Background(), img, regClient, vc)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{"1.0.0", "1.0.1"}, tl.Tags())
+			assert.Equal(t, "artifact-type: could not determine config media type: not found", excluded["1.2.0"])
+		}
+		assert.Equal(t, 2, regClient.lookups)
+	})
+
+	t.Run("Images are not checked for their config", func(t *testing.T) {
+		regClient := &mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.0"}, nil)
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0.0")
+		tl, err := ep.GetTags(context.Background(), img, regClient, &image.VersionConstraint{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.0.0"}, tl.Tags())
+	})
+
+	t.Run("Exclude all tags if client cannot determine config media types", func(t *testing.T) {
+		regClient := &mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.0"}, nil)
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", ArtifactType: ArtifactHelmChart}
+		img := image.NewFromIdentifier("example.com/charts/foo:1.0.0")
+		tl, _, err := ep.GetTagsExplained(context.Background(), img, regClient, &image.VersionConstraint{})
+		require.NoError(t, err)
+		assert.Empty(t, tl.Tags())
+	})
+}
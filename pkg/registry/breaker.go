@@ -0,0 +1,272 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+// Default for the time the circuit of an endpoint stays open before a probe
+// request is sent to the registry
+const DefaultCircuitBreakerCooldown = time.Minute
+
+// CircuitState is the state of the circuit breaker of an endpoint
+type CircuitState int
+
+const (
+	// Requests are sent to the registry
+	CircuitClosed CircuitState = iota
+	// Requests fail without being sent to the registry
+	CircuitOpen
+	// A single probe request is sent to the registry to decide whether to
+	// close the circuit, other requests fail without being sent
+	CircuitHalfOpen
+)
+
+func (cs CircuitState) String() string {
+	switch cs {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitOpenError is returned for requests that are not sent to a registry
+// because the circuit breaker of its endpoint is open. It is a kind of
+// ErrRegistryUnavailable.
+type CircuitOpenError struct {
+	// API URL of the registry
+	Registry string
+	// When the next probe request is sent to the registry
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for registry %s is open until %s", e.Registry, e.Until.Format(time.RFC3339))
+}
+
+// Is returns true for ErrRegistryUnavailable
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrRegistryUnavailable
+}
+
+// IsCircuitOpenError returns true if err is or wraps a CircuitOpenError
+func IsCircuitOpenError(err error) bool {
+	var coe *CircuitOpenError
+	return errors.As(err, &coe)
+}
+
+// circuitBreaker stops requests to a registry after a number of consecutive
+// failures, for the duration of the cooldown. Once the cooldown has passed,
+// a single probe request decides whether the circuit is closed again, or
+// stays open for another cooldown.
+type circuitBreaker struct {
+	registryAPI string
+	threshold   int
+	cooldown    time.Duration
+	lock        sync.Mutex
+	state       CircuitState
+	failures    int
+	openedAt    time.Time
+}
+
+// newCircuitBreaker returns a closed circuit breaker that opens after the
+// given number of consecutive failures
+func newCircuitBreaker(registryAPI string, threshold int, cooldown time.Duration) *circuitBreaker {
+	if cooldown <= 0 {
+		cooldown = DefaultCircuitBreakerCooldown
+	}
+	getMetrics().CircuitState(registryAPI, CircuitClosed.String())
+	return &circuitBreaker{registryAPI: registryAPI, threshold: threshold, cooldown: cooldown}
+}
+
+// setState changes the state of the circuit and reports it to the metrics.
+// Must be called with the lock held.
+func (cb *circuitBreaker) setState(state CircuitState) {
+	if cb.state == state {
+		return
+	}
+	cb.state = state
+	getMetrics().CircuitState(cb.registryAPI, state.String())
+}
+
+// State returns the current state of the circuit
+func (cb *circuitBreaker) State() CircuitState {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.state
+}
+
+// blocked returns whether requests are currently failing without being sent
+// to the registry, and if so, until when. A request sent once the cooldown
+// has passed is the probe, so the circuit does not block in that case. The
+// circuit of a nil circuit breaker never blocks.
+func (cb *circuitBreaker) blocked() (bool, time.Time) {
+	if cb == nil {
+		return false, time.Time{}
+	}
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	until := cb.openedAt.Add(cb.cooldown)
+	switch cb.state {
+	case CircuitOpen:
+		return time.Now().Before(until), until
+	case CircuitHalfOpen:
+		return true, until
+	default:
+		return false, time.Time{}
+	}
+}
+
+// allow returns whether a request may be sent to the registry, and whether
+// it is the probe request deciding about the state of the circuit. If it may
+// not be sent, a CircuitOpenError is returned.
+func (cb *circuitBreaker) allow() (bool, error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	until := cb.openedAt.Add(cb.cooldown)
+	switch cb.state {
+	case CircuitOpen:
+		if time.Now().Before(until) {
+			return false, &CircuitOpenError{Registry: cb.registryAPI, Until: until}
+		}
+		log.Debugf("cooldown of circuit breaker for registry %s has passed, probing registry", cb.registryAPI)
+		cb.setState(CircuitHalfOpen)
+		return true, nil
+	case CircuitHalfOpen:
+		return false, &CircuitOpenError{Registry: cb.registryAPI, Until: until}
+	default:
+		return false, nil
+	}
+}
+
+// record records the outcome of a request that was sent to the registry
+func (cb *circuitBreaker) record(probe bool, failed bool) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if probe {
+		if failed {
+			log.Warnf("registry %s is still failing, circuit stays open for %s", cb.registryAPI, cb.cooldown)
+			cb.openedAt = time.Now()
+			cb.setState(CircuitOpen)
+		} else {
+			log.Infof("registry %s has recovered, closing circuit", cb.registryAPI)
+			cb.failures = 0
+			cb.setState(CircuitClosed)
+		}
+		return
+	}
+	// Requests sent before the circuit opened do not change it anymore
+	if cb.state != CircuitClosed {
+		return
+	}
+	if !failed {
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		log.Warnf("registry %s failed %d times in a row, opening circuit for %s", cb.registryAPI, cb.failures, cb.cooldown)
+		cb.openedAt = time.Now()
+		cb.setState(CircuitOpen)
+	}
+}
+
+// abort records that the probe request ended without an outcome, i.e.
+// because its context was cancelled, so that the next request probes again
+func (cb *circuitBreaker) abort() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.state == CircuitHalfOpen {
+		cb.setState(CircuitOpen)
+	}
+}
+
+// circuitBreakerTransport fails requests without sending them while the
+// circuit of the endpoint is open, and records the outcome of all requests
+// it sends. Requests fail if the registry cannot be reached, or responds
+// with a server error. Requests that are rate limited do not fail, since the
+// registry is up.
+type circuitBreakerTransport struct {
+	breaker   *circuitBreaker
+	transport http.RoundTripper
+}
+
+// RoundTrip performs the request if the circuit allows it
+func (cbt *circuitBreakerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	probe, err := cbt.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cbt.transport.RoundTrip(r)
+	switch {
+	case err != nil && r.Context().Err() != nil:
+		if probe {
+			cbt.breaker.abort()
+		}
+	case err != nil:
+		cbt.breaker.record(probe, !IsRateLimitError(err))
+	default:
+		cbt.breaker.record(probe, resp.StatusCode >= 500)
+	}
+	return resp, err
+}
+
+// circuitBreaker returns the circuit breaker of the endpoint, creating it on
+// first use, or nil if the endpoint has none
+func (ep *RegistryEndpoint) circuitBreaker() *circuitBreaker {
+	if ep.CircuitThreshold <= 0 {
+		return nil
+	}
+	ep.breakerLock.Lock()
+	defer ep.breakerLock.Unlock()
+	if ep.breaker == nil {
+		ep.breaker = newCircuitBreaker(ep.RegistryAPI, ep.CircuitThreshold, ep.CircuitCooldown)
+	}
+	return ep.breaker
+}
+
+// CircuitState returns the state of the endpoint's circuit breaker. The
+// circuit of endpoints without a circuit breaker is always closed.
+func (ep *RegistryEndpoint) CircuitState() CircuitState {
+	if cb := ep.circuitBreaker(); cb != nil {
+		return cb.State()
+	}
+	return CircuitClosed
+}
+
+// lastTagResult returns a copy of the tags that last resulted for the image
+// with the given name, the constraint with the given key and the credentials
+// with the given key, or nil if there are none
+func (endpoint *RegistryEndpoint) lastTagResult(nameInRegistry, constraintKey, credsKey string) *tag.ImageTagList {
+	endpoint.resultLock.Lock()
+	defer endpoint.resultLock.Unlock()
+	r, ok := endpoint.lastResults[nameInRegistry+"|"+constraintKey+"|"+credsKey]
+	if !ok {
+		return nil
+	}
+	r.used = time.Now()
+	return r.tagList.DeepCopy()
+}
+
+// setLastTagResult records a copy of the tags that resulted for the image
+// with the given name, the constraint with the given key and the credentials
+// with the given key, to be returned while the circuit is open. Results are
+// kept like the ones of unchanged tag lists, and the least recently used one
+// is evicted once maxTagResults are kept.
+func (endpoint *RegistryEndpoint) setLastTagResult(nameInRegistry, constraintKey, credsKey string, tagList *tag.ImageTagList) {
+	endpoint.resultLock.Lock()
+	defer endpoint.resultLock.Unlock()
+	if endpoint.lastResults == nil {
+		endpoint.lastResults = make(map[string]*tagResult)
+	}
+	storeTagResult(endpoint.lastResults, nameInRegistry+"|"+constraintKey+"|"+credsKey, &tagResult{tagList: tagList.DeepCopy(), used: time.Now()})
+}
@@ -0,0 +1,145 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CircuitBreaker(t *testing.T) {
+	m := newTestMetrics()
+	SetMetrics(m)
+	defer SetMetrics(nil)
+
+	cb := newCircuitBreaker("https://example.com", 2, 50*time.Millisecond)
+
+	t.Run("Successful requests reset the failures", func(t *testing.T) {
+		cb.record(false, true)
+		cb.record(false, false)
+		cb.record(false, true)
+		assert.Equal(t, CircuitClosed, cb.State())
+		_, err := cb.allow()
+		require.NoError(t, err)
+	})
+
+	t.Run("Consecutive failures open the circuit", func(t *testing.T) {
+		cb.record(false, true)
+		assert.Equal(t, CircuitOpen, cb.State())
+		_, err := cb.allow()
+		require.Error(t, err)
+		assert.True(t, IsCircuitOpenError(err))
+		assert.True(t, errors.Is(err, ErrRegistryUnavailable))
+		blocked, _ := cb.blocked()
+		assert.True(t, blocked)
+	})
+
+	t.Run("Failed probe keeps the circuit open", func(t *testing.T) {
+		time.Sleep(60 * time.Millisecond)
+		blocked, _ := cb.blocked()
+		assert.False(t, blocked)
+		probe, err := cb.allow()
+		require.NoError(t, err)
+		assert.True(t, probe)
+		assert.Equal(t, CircuitHalfOpen, cb.State())
+		// Only a single probe is sent
+		_, err = cb.allow()
+		require.Error(t, err)
+		cb.record(true, true)
+		assert.Equal(t, CircuitOpen, cb.State())
+		_, err = cb.allow()
+		require.Error(t, err)
+	})
+
+	t.Run("Aborted probe is sent again", func(t *testing.T) {
+		time.Sleep(60 * time.Millisecond)
+		probe, err := cb.allow()
+		require.NoError(t, err)
+		assert.True(t, probe)
+		cb.abort()
+		assert.Equal(t, CircuitOpen, cb.State())
+		probe, err = cb.allow()
+		require.NoError(t, err)
+		assert.True(t, probe)
+	})
+
+	t.Run("Successful probe closes the circuit", func(t *testing.T) {
+		cb.record(true, false)
+		assert.Equal(t, CircuitClosed, cb.State())
+		probe, err := cb.allow()
+		require.NoError(t, err)
+		assert.False(t, probe)
+	})
+
+	assert.Equal(t, []string{"closed", "open", "half-open", "open", "half-open", "open", "half-open", "closed"}, m.circuits)
+}
+
+func Test_GetTagsCircuitBreaker(t *testing.T) {
+	var requests, failing int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"name":"foo/bar","tags":["1.0","1.1"]}`))
+	}))
+	defer srv.Close()
+
+	ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+	ep.CircuitThreshold = 1
+	ep.CircuitCooldown = time.Hour
+	client, err := NewClient(ep, "", "")
+	require.NoError(t, err)
+	vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer}
+
+	tl, err := ep.GetTags(context.Background(), image.NewFromIdentifier("example.com/foo/bar:1.0"), client, vc)
+	require.NoError(t, err)
+	assert.Len(t, tl.Tags(), 2)
+	assert.Equal(t, CircuitClosed, ep.CircuitState())
+
+	atomic.StoreInt32(&failing, 1)
+	_, err = ep.GetTags(context.Background(), image.NewFromIdentifier("example.com/foo/baz:1.0"), client, vc)
+	require.Error(t, err)
+	assert.False(t, IsCircuitOpenError(err))
+	assert.Equal(t, CircuitOpen, ep.CircuitState())
+	sent := atomic.LoadInt32(&requests)
+
+	t.Run("Last known tags are returned while the circuit is open", func(t *testing.T) {
+		tl, err := ep.GetTags(context.Background(), image.NewFromIdentifier("example.com/foo/bar:1.0"), client, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.0", "1.1"}, tl.Tags())
+	})
+
+	t.Run("Last known tags are not shared between credentials", func(t *testing.T) {
+		other, err := NewClient(ep, "user", "secret")
+		require.NoError(t, err)
+		_, err = ep.GetTags(context.Background(), image.NewFromIdentifier("example.com/foo/bar:1.0"), other, vc)
+		require.Error(t, err)
+		assert.True(t, IsCircuitOpenError(err))
+	})
+
+	t.Run("Error is returned without last known tags", func(t *testing.T) {
+		_, err := ep.GetTags(context.Background(), image.NewFromIdentifier("example.com/foo/baz:1.0"), client, vc)
+		require.Error(t, err)
+		assert.True(t, IsCircuitOpenError(err))
+		assert.True(t, errors.Is(err, ErrRegistryUnavailable))
+	})
+
+	t.Run("Requests of clients are not sent while the circuit is open", func(t *testing.T) {
+		_, err := client.Tags(context.Background(), "foo/bar")
+		require.Error(t, err)
+		assert.True(t, IsCircuitOpenError(err))
+	})
+
+	assert.Equal(t, sent, atomic.LoadInt32(&requests))
+}
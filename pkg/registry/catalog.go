@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+
+	"github.com/nokia/docker-registry-client/registry"
+)
+
+// ErrCatalogUnsupported is returned when the registry does not allow listing
+// its repositories. Many registries disable the catalog endpoint, or restrict
+// it to administrators.
+var ErrCatalogUnsupported = errors.New("catalog unsupported")
+
+// MaxCatalogPages is the maximum number of pages of the catalog that are
+// followed, to protect against registries linking pages in circles
+const MaxCatalogPages = 1000
+
+// CatalogClient is implemented by registry clients that are able to list the
+// repositories of the registry
+type CatalogClient interface {
+	// Catalog returns the names of all repositories in the registry,
+	// following pagination. If the registry does not allow listing its
+	// repositories, an error of kind ErrCatalogUnsupported is returned.
+	Catalog(ctx context.Context) ([]string, error)
+}
+
+// Catalog returns the names of all repositories of the registry, using the
+// given client. If the registry or the client does not support listing the
+// repositories, an error of kind ErrCatalogUnsupported is returned.
+func (endpoint *RegistryEndpoint) Catalog(ctx context.Context, regClient RegistryClient) ([]string, error) {
+	cc, ok := regClient.(CatalogClient)
+	if !ok {
+		return nil, &RegistryError{
+			Registry: endpoint.RegistryAPI,
+			Err:      fmt.Errorf("registry client for %s cannot list repositories", endpoint.RegistryAPI),
+			kind:     ErrCatalogUnsupported,
+		}
+	}
+	return cc.Catalog(ctx)
+}
+
+// catalogUnsupported returns true if the given HTTP status of a catalog
+// request indicates that the registry does not allow listing its repositories
+func catalogUnsupported(statusCode int) bool {
+	return statusCode == http.StatusNotFound || statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
+
+// catalogUnsupportedError returns the error for a registry that responded to
+// a catalog request with the given HTTP status
+func (client *registryClient) catalogUnsupportedError(statusCode int) error {
+	return &RegistryError{
+		Registry:   client.registryAPI(),
+		StatusCode: statusCode,
+		Err:        fmt.Errorf("registry %s does not allow listing repositories: %d %s", client.registryAPI(), statusCode, http.StatusText(statusCode)),
+		kind:       ErrCatalogUnsupported,
+	}
+}
+
+// Catalog lists the repositories of the registry using its /v2/_catalog
+// endpoint, following the links to further pages of at most MaxCatalogPages
+func (client *registryClient) Catalog(ctx context.Context) (_ []string, err error) {
+	defer func() { err = client.classifyError(err); client.recordCall("catalog", err) }()
+
+	var page struct {
+		Repositories []string `json:"repositories"`
+	}
+
+	repositories := []string{}
+	httpClient := client.withContext(ctx).Client
+	next := client.regClient.URL + "/v2/_catalog"
+	for pages := 0; next != ""; pages++ {
+		if pages >= MaxCatalogPages {
+			return nil, fmt.Errorf("catalog of registry %s has more than %d pages", client.registryAPI(), MaxCatalogPages)
+		}
+		resp, err := httpClient.Get(next)
+		if err != nil {
+			// Error responses are returned as errors by the registry client
+			var hse *registry.HttpStatusError
+			if errors.As(err, &hse) && hse.Response != nil && catalogUnsupported(hse.Response.StatusCode) {
+				return nil, client.catalogUnsupportedError(hse.Response.StatusCode)
+			}
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			if catalogUnsupported(resp.StatusCode) {
+				return nil, client.catalogUnsupportedError(resp.StatusCode)
+			}
+			return nil, client.statusError(resp, "could not list repositories of registry %s", client.registryAPI())
+		}
+		page.Repositories = nil
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, page.Repositories...)
+		if next, err = nextPageURL(resp); err != nil {
+			return nil, err
+		}
+		if next != "" {
+			log.Tracef("fetching next page of catalog of registry %s: %s", client.registryAPI(), next)
+		}
+	}
+	return repositories, nil
+}
@@ -0,0 +1,89 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Catalog(t *testing.T) {
+	catalog := func(handler http.HandlerFunc) ([]string, error) {
+		srv := httptest.NewServer(handler)
+		defer srv.Close()
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		return ep.Catalog(context.Background(), client)
+	}
+
+	t.Run("All pages are fetched", func(t *testing.T) {
+		repos, err := catalog(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, "/v2/_catalog", r.URL.Path)
+			if r.URL.Query().Get("last") == "" {
+				w.Header().Set("Link", `</v2/_catalog?last=foo/bar&n=2>; rel="next"`)
+				fmt.Fprint(w, `{"repositories":["foo/baz","foo/bar"]}`)
+				return
+			}
+			fmt.Fprint(w, `{"repositories":["library/nginx"]}`)
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"foo/baz", "foo/bar", "library/nginx"}, repos)
+	})
+
+	t.Run("Empty catalog", func(t *testing.T) {
+		repos, err := catalog(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"repositories":[]}`)
+		})
+		require.NoError(t, err)
+		assert.Empty(t, repos)
+	})
+
+	t.Run("Disabled catalog is unsupported", func(t *testing.T) {
+		for _, status := range []int{http.StatusNotFound, http.StatusUnauthorized, http.StatusForbidden} {
+			repos, err := catalog(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+			})
+			require.Error(t, err, status)
+			assert.Nil(t, repos)
+			assert.True(t, errors.Is(err, ErrCatalogUnsupported), status)
+			var regErr *RegistryError
+			require.True(t, errors.As(err, &regErr))
+			assert.Equal(t, status, regErr.StatusCode)
+		}
+	})
+
+	t.Run("Server error is no unsupported catalog", func(t *testing.T) {
+		_, err := catalog(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, ErrCatalogUnsupported))
+	})
+
+	t.Run("Number of pages is limited", func(t *testing.T) {
+		requests := 0
+		_, err := catalog(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Header().Set("Link", `</v2/_catalog?n=1>; rel="next"`)
+			fmt.Fprint(w, `{"repositories":["foo/bar"]}`)
+		})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "more than 1000 pages")
+		assert.Equal(t, MaxCatalogPages, requests)
+	})
+
+	t.Run("Client without catalog support", func(t *testing.T) {
+		ep := newRegistryEndpoint("example.com", "Example", "https://example.com", "", "", false, SortUnsorted, 0, 0)
+		_, err := ep.Catalog(context.Background(), &mocks.RegistryClient{})
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrCatalogUnsupported))
+	})
+}
@@ -2,11 +2,20 @@ package registry
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
@@ -14,6 +23,7 @@ import (
 	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
 
 	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
 	"github.com/docker/distribution/manifest/schema1"
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/nokia/docker-registry-client/registry"
@@ -23,11 +33,16 @@ import (
 // TODO: Check image's architecture and OS
 
 // RegistryClient defines the methods we need for querying container registries
+//
+// All requests sent to the registry are bound to the given context, so that
+// they are aborted once it is done.
 type RegistryClient interface {
-	Tags(nameInRepository string) ([]string, error)
-	ManifestV1(repository string, reference string) (*schema1.SignedManifest, error)
-	ManifestV2(repository string, reference string) (*schema2.DeserializedManifest, error)
-	TagMetadata(repository string, manifest distribution.Manifest) (*tag.TagInfo, error)
+	Tags(ctx context.Context, nameInRepository string) ([]string, error)
+	ManifestV1(ctx context.Context, repository string, reference string) (*schema1.SignedManifest, error)
+	ManifestV2(ctx context.Context, repository string, reference string) (*schema2.DeserializedManifest, error)
+	ManifestList(ctx context.Context, repository string, reference string) (*manifestlist.DeserializedManifestList, error)
+	ManifestForDigest(ctx context.Context, repository string, digest string) (distribution.Manifest, error)
+	TagMetadata(ctx context.Context, repository string, manifest distribution.Manifest) (*tag.TagInfo, error)
 }
 
 type NewRegistryClient func(*RegistryEndpoint, string, string) (RegistryClient, error)
@@ -35,6 +50,43 @@ type NewRegistryClient func(*RegistryEndpoint, string, string) (RegistryClient,
 // Helper type for registry clients
 type registryClient struct {
 	regClient *registry.Registry
+	flavor    RegistryFlavor
+	endpoint  *RegistryEndpoint
+	credsKey  string
+}
+
+// credentialsIdentifier is implemented by registry clients that can identify
+// the credentials they access the registry with, so that results fetched with
+// different credentials are not shared
+type credentialsIdentifier interface {
+	// credentialsKey returns an identifier of the client's credentials that
+	// does not reveal them, or the empty string for anonymous access
+	credentialsKey() string
+}
+
+// credentialsKey returns an identifier of the client's credentials
+func (client *registryClient) credentialsKey() string {
+	return client.credsKey
+}
+
+// clientCredentialsKey returns an identifier of the credentials the given
+// registry client accesses the registry with, or the empty string if they
+// cannot be identified
+func clientCredentialsKey(regClient RegistryClient) string {
+	if ci, ok := regClient.(credentialsIdentifier); ok {
+		return ci.credentialsKey()
+	}
+	return ""
+}
+
+// newCredentialsKey returns an identifier of the given credentials that does
+// not reveal them, or the empty string if there are none
+func newCredentialsKey(username, password string) string {
+	if username == "" && password == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	return hex.EncodeToString(sum[:8])
 }
 
 // rateLimitTransport encapsulates our custom HTTP round tripper with rate
@@ -47,28 +99,292 @@ type rateLimitTransport struct {
 
 // RoundTrip is a custom RoundTrip method with rate-limiter
 func (rlt *rateLimitTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
 	rlt.limiter.Take()
+	recordRateLimitWait(time.Since(start))
 	log.Tracef("%s", r.URL)
+	scanCollectorFrom(r.Context()).countRequest()
+	start = time.Now()
 	resp, err := rlt.transport.RoundTrip(r)
+	getMetrics().RequestLatency(rlt.endpoint, time.Since(start))
 	metrics.Endpoint().IncreaseRequest(rlt.endpoint, err != nil)
 	return resp, err
 }
 
+// contextTransport binds all requests it sends to a context
+type contextTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
+}
+
+// RoundTrip performs the request with the transport's context
+func (ct *contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return ct.transport.RoundTrip(r.WithContext(ct.ctx))
+}
+
+// authHostTransport rewrites the host of the token realm advertised by the
+// registry in its WWW-Authenticate challenge. Path and query of the realm are
+// left untouched.
+type authHostTransport struct {
+	authHost  string
+	transport http.RoundTripper
+}
+
+// realmRegexp matches the realm parameter of a WWW-Authenticate challenge
+var realmRegexp = regexp.MustCompile(`realm="([^"]*)"`)
+
+// RoundTrip performs the request and rewrites the realm of any auth challenge
+// returned by the registry.
+func (aht *authHostTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := aht.transport.RoundTrip(r)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenges := resp.Header.Values("WWW-Authenticate")
+	resp.Header.Del("WWW-Authenticate")
+	for _, challenge := range challenges {
+		resp.Header.Add("WWW-Authenticate", rewriteRealmHost(challenge, aht.authHost))
+	}
+	return resp, nil
+}
+
+// anonymousFallbackTransport retries requests whose credentials have been
+// rejected without any credentials, so that public repositories can still be
+// accessed with stale or wrong credentials. This applies to requests using
+// basic authentication, i.e. token requests sent to the auth server of the
+// registry, or requests sent to registries without token authentication.
+type anonymousFallbackTransport struct {
+	endpoint  string
+	transport http.RoundTripper
+	warned    sync.Once
+}
+
+// RoundTrip performs the request, and performs it again without credentials
+// if they are rejected. If the request is rejected without credentials, too,
+// the original response is returned. Requests whose context disables the
+// fallback are performed only once.
+func (aft *anonymousFallbackTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := aft.transport.RoundTrip(r)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if r.Context().Value(noAnonymousFallbackKey{}) != nil {
+		return resp, err
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return resp, err
+	}
+	if !strings.HasPrefix(strings.ToLower(r.Header.Get("Authorization")), "basic ") {
+		return resp, err
+	}
+
+	anonymous := r.Clone(r.Context())
+	anonymous.Header.Del("Authorization")
+	aresp, aerr := aft.transport.RoundTrip(anonymous)
+	if aerr != nil || aresp.StatusCode == http.StatusUnauthorized {
+		if aerr == nil {
+			aresp.Body.Close()
+		}
+		return resp, err
+	}
+	resp.Body.Close()
+	aft.warned.Do(func() {
+		log.Warnf("credentials for registry %s were rejected by %s, falling back to anonymous access", aft.endpoint, r.URL.Host)
+	})
+	log.Debugf("credentials rejected for %s, used anonymous access", r.URL)
+	return aresp, nil
+}
+
+// rewriteRealmHost replaces the host of the realm URL in given challenge
+func rewriteRealmHost(challenge string, authHost string) string {
+	return realmRegexp.ReplaceAllStringFunc(challenge, func(m string) string {
+		realm := realmRegexp.FindStringSubmatch(m)[1]
+		u, err := url.Parse(realm)
+		if err != nil || u.Host == "" {
+			log.Debugf("could not parse auth realm %s, not rewriting", realm)
+			return m
+		}
+		if u.Host == authHost {
+			return m
+		}
+		log.Debugf("rewriting auth realm host from %s to %s", u.Host, authHost)
+		u.Host = authHost
+		return fmt.Sprintf(`realm="%s"`, u.String())
+	})
+}
+
+// hostAliasDialer returns a dial function that connects to the IP address
+// configured for a host in aliases instead of resolving the host name, similar
+// to an entry in /etc/hosts. Hosts without an alias are dialed as usual. Since
+// only the dialed address changes, TLS verification is still performed against
+// the original host name.
+func hostAliasDialer(aliases map[string]string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			if ip, ok := aliases[strings.ToLower(host)]; ok {
+				log.Tracef("dialing %s instead of %s", ip, host)
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// getTransport returns the HTTP transport for the endpoint, creating it on
+// first use. The transport is shared by all clients of the endpoint, so that
+// connections can be re-used. HTTP/2 is enabled explicitly, and for HTTP/1.1
+// registries the connection pool is sized to the endpoint's maximum number of
+// concurrent streams, limiting both the idle and the open connections per
+// host. TLS settings only apply to the endpoint's transport.
+func (ep *RegistryEndpoint) getTransport(insecure bool) (*http.Transport, error) {
+	ep.transportLock.Lock()
+	defer ep.transportLock.Unlock()
+	if ep.transport != nil {
+		return ep.transport, nil
+	}
+	tlsConfig, err := ep.tlsConfig(insecure)
+	if err != nil {
+		return nil, err
+	}
+	maxStreams := ep.MaxStreams
+	if maxStreams <= 0 {
+		maxStreams = DefaultMaxStreams
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConnsPerHost = maxStreams
+	transport.MaxConnsPerHost = maxStreams
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	if ep.Proxy != "" {
+		proxy, err := parseProxy(ep.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy for registry %s: %v", ep.RegistryAPI, err)
+		}
+		if proxy == nil {
+			transport.Proxy = nil
+		} else {
+			transport.Proxy = http.ProxyURL(proxy)
+		}
+	}
+	if len(ep.HostAliases) > 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		transport.DialContext = hostAliasDialer(ep.HostAliases, dialer.DialContext)
+	}
+	ep.transport = transport
+	return transport, nil
+}
+
+// ProxyNone is the proxy setting of endpoints that connect directly to the
+// registry, even if a proxy is set in the environment
+const ProxyNone = "none"
+
+// parseProxy parses the proxy setting of an endpoint, which is either the
+// URL of an HTTP, HTTPS or SOCKS5 proxy, or ProxyNone. Returns nil for
+// ProxyNone.
+func parseProxy(proxy string) (*url.URL, error) {
+	if strings.ToLower(proxy) == ProxyNone {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s', must be one of http, https or socks5", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %s has no host", proxy)
+	}
+	return u, nil
+}
+
+// tlsConfig returns the TLS configuration for connections to the endpoint,
+// which trusts the endpoint's CA certificate in addition to the system's
+// ones, and presents the endpoint's client certificate. The certificates
+// loaded from the endpoint's TLS secret are used along with the files.
+// Returns nil if the endpoint has no TLS settings.
+func (ep *RegistryEndpoint) tlsConfig(insecure bool) (*tls.Config, error) {
+	if !insecure && ep.TLSCAFile == "" && ep.TLSCertFile == "" && ep.TLSKeyFile == "" && ep.tlsCert == nil {
+		return nil, nil
+	}
+	config := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+	if ep.TLSCAFile != "" || len(ep.tlsCAPEM) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if ep.TLSCAFile != "" {
+			caPEM, err := ioutil.ReadFile(ep.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read CA certificate for registry %s: %v", ep.RegistryAPI, err)
+			}
+			if !pool.AppendCertsFromPEM(caPEM) {
+				return nil, fmt.Errorf("no valid CA certificate found in %s", ep.TLSCAFile)
+			}
+		}
+		if len(ep.tlsCAPEM) > 0 && !pool.AppendCertsFromPEM(ep.tlsCAPEM) {
+			return nil, fmt.Errorf("no valid CA certificate found in %s", ep.TLSCredentials)
+		}
+		config.RootCAs = pool
+	}
+	if ep.tlsCert != nil {
+		config.Certificates = []tls.Certificate{*ep.tlsCert}
+	}
+	if ep.TLSCertFile != "" || ep.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(ep.TLSCertFile, ep.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate for registry %s: %v", ep.RegistryAPI, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
 // newRegistry is a wrapper for creating a registry client that is possibly
-// rate-limited by using a custom HTTP round tripper method.
-func newRegistry(ep *RegistryEndpoint, opts registry.Options) (*registry.Registry, error) {
+// rate-limited by using a custom HTTP round tripper method. If
+// anonymousFallback is true, requests whose credentials are rejected are
+// repeated without credentials.
+func newRegistry(ep *RegistryEndpoint, opts registry.Options, anonymousFallback bool, headers http.Header) (*registry.Registry, error) {
 	url := strings.TrimSuffix(ep.RegistryAPI, "/")
-	var transport http.RoundTripper
-	if opts.Insecure {
-		transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
+	epTransport, err := ep.getTransport(opts.Insecure)
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper = epTransport
+	if len(headers) > 0 {
+		transport, err = newHeaderTransport(url, headers, transport)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		transport = http.DefaultTransport
 	}
+	userAgent, requestID := ep.requestIdentification()
+	transport = &userAgentTransport{userAgent: userAgent, requestID: requestID, transport: transport}
+	if ep.AuthHost != "" {
+		transport = &authHostTransport{
+			authHost:  ep.AuthHost,
+			transport: transport,
+		}
+	}
+	// Tokens are shared with other endpoints using the same credentials
+	transport = &tokenCacheTransport{cache: bearerTokens, transport: transport}
+	if anonymousFallback && (opts.Username != "" || opts.Password != "") {
+		transport = &anonymousFallbackTransport{endpoint: ep.RegistryAPI, transport: transport}
+	}
+	transport = &authChallengeTransport{endpoint: ep, transport: transport}
 	transport = registry.WrapTransport(transport, url, opts)
+	if timeout := ep.requestTimeout(); timeout > 0 {
+		transport = &timeoutTransport{timeout: timeout, transport: transport}
+	}
+	if ep.MinInterval > 0 || ep.Jitter > 0 {
+		transport = &pacingTransport{interval: ep.MinInterval, jitter: ep.Jitter, transport: transport}
+	}
 
 	rlt := &rateLimitTransport{
 		limiter:   ep.Limiter,
@@ -76,6 +392,21 @@ func newRegistry(ep *RegistryEndpoint, opts registry.Options) (*registry.Registr
 		endpoint:  ep.RegistryAPI,
 	}
 
+	maxBackoff := ep.RateLimitMaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultRateLimitMaxBackoff
+	}
+	rt := &retryTransport{
+		transport:  rlt,
+		maxRetries: ep.RateLimitRetries,
+		maxBackoff: maxBackoff,
+		endpoint:   ep.RegistryAPI,
+	}
+	var clientTransport http.RoundTripper = rt
+	if cb := ep.circuitBreaker(); cb != nil {
+		clientTransport = &circuitBreakerTransport{breaker: cb, transport: rt}
+	}
+
 	logf := opts.Logf
 	if logf == nil {
 		logf = registry.Log
@@ -83,7 +414,7 @@ func newRegistry(ep *RegistryEndpoint, opts registry.Options) (*registry.Registr
 	registry := &registry.Registry{
 		URL: url,
 		Client: &http.Client{
-			Transport: rlt,
+			Transport: clientTransport,
 		},
 		Logf: logf,
 	}
@@ -99,12 +430,19 @@ func newRegistry(ep *RegistryEndpoint, opts registry.Options) (*registry.Registr
 // NewClient returns a new RegistryClient for the given endpoint information
 func NewClient(endpoint *RegistryEndpoint, username, password string) (RegistryClient, error) {
 
+	endpoint.lock.RLock()
 	if username == "" && endpoint.Username != "" {
 		username = endpoint.Username
 	}
 	if password == "" && endpoint.Password != "" {
 		password = endpoint.Password
 	}
+	headers := endpoint.headers
+	endpoint.lock.RUnlock()
+
+	if strings.HasPrefix(endpoint.RegistryAPI, OCILayoutScheme) {
+		return newOCILayoutClient(endpoint)
+	}
 
 	client, err := newRegistry(endpoint, registry.Options{
 		DoInitialPing: endpoint.Ping,
@@ -112,70 +450,234 @@ func NewClient(endpoint *RegistryEndpoint, username, password string) (RegistryC
 		Username:      username,
 		Password:      password,
 		Insecure:      endpoint.Insecure,
-	})
+	}, true, headers)
 	if err != nil {
 		return nil, err
 	}
 	return &registryClient{
 		regClient: client,
+		flavor:    endpoint.Flavor,
+		endpoint:  endpoint,
+		credsKey:  newCredentialsKey(username, password),
 	}, nil
 }
 
-// Tags returns a list of tags for given name in repository
-func (client *registryClient) Tags(nameInRepository string) ([]string, error) {
-	return client.regClient.Tags(nameInRepository)
+// withContext returns a copy of the client's registry whose requests are
+// bound to the given context
+func (client *registryClient) withContext(ctx context.Context) *registry.Registry {
+	reg := *client.regClient
+	httpClient := *client.regClient.Client
+	httpClient.Transport = &contextTransport{ctx: ctx, transport: httpClient.Transport}
+	reg.Client = &httpClient
+	return &reg
 }
 
-// ManifestV1 returns a signed V1 manifest for a given tag in given repository
-func (client *registryClient) ManifestV1(repository string, reference string) (*schema1.SignedManifest, error) {
-	return client.regClient.ManifestV1(repository, reference)
+// Maximum number of pages of a tag list that are followed, to guard against
+// misbehaving registries
+const MaxTagListPages = 1000
+
+// Tags returns a list of tags for given name in repository. If the registry
+// paginates the list with Link headers, all pages are fetched, up to
+// MaxTagListPages.
+func (client *registryClient) Tags(ctx context.Context, nameInRepository string) ([]string, error) {
+	tags, _, _, err := client.TagsIfNoneMatch(ctx, nameInRepository, "")
+	return tags, err
+}
+
+// TagsIfNoneMatch returns the list of tags for given name in repository like
+// Tags, unless the list still has the given ETag. The ETag is only returned
+// for lists that fit on a single page, and never for endpoints that enumerate
+// tags with a custom tag list strategy.
+func (client *registryClient) TagsIfNoneMatch(ctx context.Context, nameInRepository string, etag string) (_ []string, _ string, _ bool, err error) {
+	defer func() { err = client.classifyError(err); client.recordCall("tags", err) }()
+
+	if client.endpoint != nil && client.endpoint.TagList.Method != TagListStandard {
+		tags, err := client.customTags(ctx, nameInRepository)
+		return tags, "", false, err
+	}
+
+	tags := []string{}
+	newETag, unchanged, err := client.tagPages(ctx, nameInRepository, etag, func(page []string) bool {
+		tags = append(tags, page...)
+		return true
+	})
+	if err != nil || unchanged {
+		return nil, newETag, unchanged, err
+	}
+	return tags, newETag, false, nil
 }
 
-// ManifestV2 returns a deserialized V2 manifest for a given tag in given repository
-func (client *registryClient) ManifestV2(repository string, reference string) (*schema2.DeserializedManifest, error) {
-	return client.regClient.ManifestV2(repository, reference)
+// PagedTagsClient is implemented by registry clients that are able to pass
+// the list of tags page by page, so that the remaining pages need not be
+// fetched once enough tags are known.
+type PagedTagsClient interface {
+	// TagPages passes the pages of the list of tags for given name in
+	// repository to fn in the order the registry returns them, until fn
+	// returns false
+	TagPages(ctx context.Context, nameInRepository string, fn func(tags []string) bool) error
 }
 
-// GetTagInfo retrieves metadata for a given manifest of given repository
-func (client *registryClient) TagMetadata(repository string, manifest distribution.Manifest) (*tag.TagInfo, error) {
-	ti := &tag.TagInfo{}
+// TagPages passes the pages of the list of tags for given name in repository
+// to fn, until fn returns false. Endpoints that enumerate tags with a custom
+// tag list strategy pass all tags as a single page.
+func (client *registryClient) TagPages(ctx context.Context, nameInRepository string, fn func(tags []string) bool) (err error) {
+	defer func() { err = client.classifyError(err); client.recordCall("tags", err) }()
+
+	if client.endpoint != nil && client.endpoint.TagList.Method != TagListStandard {
+		tags, err := client.customTags(ctx, nameInRepository)
+		if err != nil {
+			return err
+		}
+		fn(tags)
+		return nil
+	}
+	_, _, err = client.tagPages(ctx, nameInRepository, "", fn)
+	return err
+}
+
+// tagPages fetches the pages of the list of tags for given name in repository
+// and passes them to fn, until fn returns false or there are no more pages.
+// If etag is set and the list still has it, unchanged is true and fn is never
+// called. The ETag of the list is only returned if it fits on a single page.
+func (client *registryClient) tagPages(ctx context.Context, nameInRepository string, etag string, fn func(tags []string) bool) (newETag string, unchanged bool, err error) {
+	var page struct {
+		Tags []string `json:"tags"`
+	}
+
+	httpClient := client.withContext(ctx).Client
+	next := fmt.Sprintf("%s/v2/%s/tags/list", client.regClient.URL, nameInRepository)
+	for pages := 0; next != ""; pages++ {
+		if pages >= MaxTagListPages {
+			return "", false, fmt.Errorf("tag list of %s has more than %d pages", nameInRepository, MaxTagListPages)
+		}
+		req, err := http.NewRequest(http.MethodGet, next, nil)
+		if err != nil {
+			return "", false, err
+		}
+		if pages == 0 && etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return "", false, err
+		}
+		if pages == 0 && etag != "" && resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			return etag, true, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", false, client.statusError(resp, "could not get tags of %s", nameInRepository)
+		}
+		page.Tags = nil
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return "", false, err
+		}
+		if next, err = nextPageURL(resp); err != nil {
+			return "", false, err
+		}
+		if !fn(page.Tags) {
+			return "", false, nil
+		}
+		if next != "" {
+			log.Tracef("fetching next page of tags of %s: %s", nameInRepository, next)
+		} else if pages == 0 {
+			newETag = resp.Header.Get("ETag")
+		}
+	}
+	return newETag, false, nil
+}
+
+// nextPageURL returns the URL of the next page given in the Link header of a
+// paginated response, resolved against the URL of the request, or the empty
+// string if there is no next page. Links to other hosts are not followed.
+func nextPageURL(resp *http.Response) (string, error) {
+	m := linkNextRegexp.FindStringSubmatch(resp.Header.Get("Link"))
+	if m == nil {
+		return "", nil
+	}
+	return sameHostURL(resp.Request.URL, m[1])
+}
+
+// ManifestV1 returns a signed V1 manifest for a given tag in given repository
+func (client *registryClient) ManifestV1(ctx context.Context, repository string, reference string) (_ *schema1.SignedManifest, err error) {
+	defer func() { err = client.classifyError(err); client.recordCall("manifest_v1", err) }()
+	mediaType, body, err := client.fetchManifest(ctx, repository, reference)
+	if err != nil {
+		return nil, err
+	}
+	// Registries serving V1 manifests often do so with a generic content type
+	if mediaType != schema1.MediaTypeSignedManifest && mediaType != schema1.MediaTypeManifest && mediaType != "" {
+		return nil, fmt.Errorf("manifest for %s:%s is of type %s, not a V1 manifest", repository, reference, mediaType)
+	}
+	man := &schema1.SignedManifest{}
+	if err := man.UnmarshalJSON(body); err != nil {
+		return nil, fmt.Errorf("could not parse V1 manifest for %s:%s: %v", repository, reference, err)
+	}
+	return man, nil
+}
+
+// ManifestV2 returns a deserialized V2 manifest for a given tag in given
+// repository
+func (client *registryClient) ManifestV2(ctx context.Context, repository string, reference string) (_ *schema2.DeserializedManifest, err error) {
+	defer func() { err = client.classifyError(err); client.recordCall("manifest_v2", err) }()
+	mediaType, body, err := client.fetchManifest(ctx, repository, reference)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != schema2.MediaTypeManifest {
+		return nil, fmt.Errorf("manifest for %s:%s is of type %s, not a V2 manifest", repository, reference, mediaType)
+	}
+	man := &schema2.DeserializedManifest{}
+	if err := man.UnmarshalJSON(body); err != nil {
+		return nil, fmt.Errorf("could not parse V2 manifest for %s:%s: %v", repository, reference, err)
+	}
+	return man, nil
+}
 
-	var info struct {
-		Arch    string `json:"architecture"`
-		Created string `json:"created"`
-		OS      string `json:"os"`
+// fetchManifest fetches the manifest at the given reference, negotiating the
+// media types with the registry, and returns it along with its media type.
+func (client *registryClient) fetchManifest(ctx context.Context, repository string, reference string) (string, []byte, error) {
+	resp, err := client.manifestRequest(ctx, http.MethodGet, repository, reference)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, client.statusError(resp, "could not get manifest for %s:%s", repository, reference)
 	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	return manifestMediaType(resp.Header.Get("Content-Type"), body), body, nil
+}
+
+// GetTagInfo retrieves metadata for a given manifest of given repository
+func (client *registryClient) TagMetadata(ctx context.Context, repository string, manifest distribution.Manifest) (_ *tag.TagInfo, err error) {
+	defer func() { err = client.classifyError(err); client.recordCall("tag_metadata", err) }()
 
 	// We support both V1 and V2 manifest schemas. Everything else will trigger
 	// an error.
 	switch deserialized := manifest.(type) {
 
 	case *schema1.SignedManifest:
-		var man schema1.Manifest = deserialized.Manifest
-		if len(man.History) == 0 {
-			return nil, fmt.Errorf("no history information found in schema V1")
-		}
-		if err := json.Unmarshal([]byte(man.History[0].V1Compatibility), &info); err != nil {
-			return nil, err
-		}
-		if createdAt, err := time.Parse(time.RFC3339Nano, info.Created); err != nil {
-			return nil, err
-		} else {
-			ti.CreatedAt = createdAt
-		}
-		return ti, nil
+		return tagInfoFromV1(deserialized, client.createdSources())
 
 	case *schema2.DeserializedManifest:
 		var man schema2.Manifest = deserialized.Manifest
 
 		// The data we require from a V2 manifest is in a blob that we need to
 		// fetch from the registry.
-		_, err := client.regClient.BlobMetadata(repository, man.Config.Digest)
+		regClient := client.withContext(ctx)
+		_, err := regClient.BlobMetadata(repository, man.Config.Digest)
 		if err != nil {
 			return nil, fmt.Errorf("could not get metadata: %v", err)
 		}
 
-		blobReader, err := client.regClient.DownloadBlob(repository, man.Config.Digest)
+		blobReader, err := regClient.DownloadBlob(repository, man.Config.Digest)
 		if err != nil {
 			return nil, err
 		}
@@ -189,14 +691,7 @@ func (client *registryClient) TagMetadata(repository string, manifest distributi
 
 		log.Tracef("read %d bytes of blob data for %s", n, repository)
 
-		if err := json.Unmarshal(blobBytes.Bytes(), &info); err != nil {
-			return nil, err
-		}
-
-		if ti.CreatedAt, err = time.Parse(time.RFC3339Nano, info.Created); err != nil {
-			return nil, err
-		}
-		return ti, nil
+		return tagInfoFromConfig(blobBytes.Bytes(), client.createdSources())
 
 	default:
 		return nil, fmt.Errorf("invalid manifest type")
@@ -3,8 +3,11 @@ package registry
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
+	"strings"
 	"time"
 
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
 
 	"gopkg.in/yaml.v2"
@@ -13,21 +16,55 @@ import (
 // RegistryConfiguration represents a single repository configuration for being
 // unmarshaled from YAML.
 type RegistryConfiguration struct {
-	Name        string        `yaml:"name"`
-	ApiURL      string        `yaml:"api_url"`
-	Ping        bool          `yaml:"ping,omitempty"`
-	Credentials string        `yaml:"credentials,omitempty"`
-	CredsExpire time.Duration `yaml:"credsexpire,omitempty"`
-	TagSortMode string        `yaml:"tagsortmode,omitempty"`
-	Prefix      string        `yaml:"prefix,omitempty"`
-	Insecure    bool          `yaml:"insecure,omitempty"`
-	DefaultNS   string        `yaml:"defaultns,omitempty"`
-	Limit       int           `yaml:"limit,omitempty"`
+	Name                string                `yaml:"name"`
+	ApiURL              string                `yaml:"api_url"`
+	Ping                bool                  `yaml:"ping,omitempty"`
+	Credentials         string                `yaml:"credentials,omitempty"`
+	CredsExpire         time.Duration         `yaml:"credsexpire,omitempty"`
+	CredsRefresh        time.Duration         `yaml:"credsrefresh,omitempty"`
+	TagSortMode         string                `yaml:"tagsortmode,omitempty"`
+	Prefix              string                `yaml:"prefix,omitempty"`
+	Insecure            bool                  `yaml:"insecure,omitempty"`
+	DefaultNS           string                `yaml:"defaultns,omitempty"`
+	Limit               int                   `yaml:"limit,omitempty"`
+	AuthHost            string                `yaml:"authhost,omitempty"`
+	Flavor              string                `yaml:"flavor,omitempty"`
+	MaxStreams          int                   `yaml:"maxstreams,omitempty"`
+	MetadataConcurrency int                   `yaml:"metadataconcurrency,omitempty"`
+	Singleflight        bool                  `yaml:"singleflight,omitempty"`
+	ImmutableTags       []string              `yaml:"immutabletags,omitempty"`
+	WriteBackPrefix     string                `yaml:"writebackprefix,omitempty"`
+	HostAliases         map[string]string     `yaml:"hostaliases,omitempty"`
+	AllowedMediaTypes   []string              `yaml:"allowedmediatypes,omitempty"`
+	NegativeCacheTTL    time.Duration         `yaml:"negativecachettl,omitempty"`
+	Cache               *bool                 `yaml:"cache,omitempty"`
+	RateLimitRetries    int                   `yaml:"ratelimitretries,omitempty"`
+	RateLimitMaxBackoff time.Duration         `yaml:"ratelimitmaxbackoff,omitempty"`
+	CircuitThreshold    int                   `yaml:"circuitbreakerthreshold,omitempty"`
+	CircuitCooldown     time.Duration         `yaml:"circuitbreakercooldown,omitempty"`
+	TLSCAFile           string                `yaml:"tls_ca_file,omitempty"`
+	TLSCertFile         string                `yaml:"tls_cert_file,omitempty"`
+	TLSKeyFile          string                `yaml:"tls_key_file,omitempty"`
+	TLSCredentials      string                `yaml:"tls_credentials,omitempty"`
+	Proxy               string                `yaml:"proxy,omitempty"`
+	FallbackCredentials []string              `yaml:"fallbackcredentials,omitempty"`
+	MinInterval         time.Duration         `yaml:"min_interval,omitempty"`
+	Jitter              time.Duration         `yaml:"jitter,omitempty"`
+	Headers             map[string]string     `yaml:"headers,omitempty"`
+	CredentialsFrom     string                `yaml:"credentials_from,omitempty"`
+	Default             bool                  `yaml:"default,omitempty"`
+	Timeout             time.Duration         `yaml:"timeout,omitempty"`
+	UserAgent           string                `yaml:"user_agent,omitempty"`
+	RequestID           bool                  `yaml:"request_id,omitempty"`
+	ArtifactType        string                `yaml:"artifacttype,omitempty"`
+	CreatedFrom         []string              `yaml:"createdfrom,omitempty"`
+	TagList             *TagListConfiguration `yaml:"tag_list,omitempty"`
 }
 
 // RegistryList contains multiple RegistryConfiguration items
 type RegistryList struct {
-	Items []RegistryConfiguration `yaml:"registries"`
+	Items  []RegistryConfiguration `yaml:"registries"`
+	Search []string                `yaml:"search,omitempty"`
 }
 
 // LoadRegistryConfiguration loads a YAML-formatted registry configuration from
@@ -49,13 +86,14 @@ func LoadRegistryConfiguration(path string, clear bool) error {
 	}
 
 	for _, reg := range registryList.Items {
-		tagSortMode := TagListSortFromString(reg.TagSortMode)
-		err = AddRegistryEndpoint(reg.Prefix, reg.Name, reg.ApiURL, reg.Credentials, reg.DefaultNS, reg.Insecure, tagSortMode, reg.Limit, reg.CredsExpire)
+		err = AddRegistryEndpointFromConfig(reg)
 		if err != nil {
 			return err
 		}
 	}
 
+	SetSearchRegistries(registryList.Search)
+
 	log.Infof("Loaded %d registry configurations from %s", len(registryList.Items), path)
 	return nil
 }
@@ -64,26 +102,236 @@ func LoadRegistryConfiguration(path string, clear bool) error {
 // of registries.
 func ParseRegistryConfiguration(yamlSource string) (RegistryList, error) {
 	var regList RegistryList
-	var defaultPrefixFound = ""
 	err := yaml.UnmarshalStrict([]byte(yamlSource), &regList)
 	if err != nil {
 		return RegistryList{}, err
 	}
 
-	// validate the parsed list
+	err = validateRegistryList(regList)
+	if err != nil {
+		return RegistryList{}, err
+	}
+
+	warnOverlappingPrefixes(regList)
+
+	return regList, nil
+}
+
+// ParseRegistryConfigurationFromFiles parses the registry configurations from
+// the YAML files at the given paths and merges them into a single list of
+// registries. An entry in a later file overrides the entry of an earlier file
+// with the same name, or with the same prefix, in place. The search list of a
+// later file replaces the search list of earlier files. It is an error if the
+// same prefix is used by more than one registry in a file, or if an entry
+// would override two different entries of earlier files, as these are likely
+// not intended.
+func ParseRegistryConfigurationFromFiles(paths ...string) (RegistryList, error) {
+	var merged RegistryList
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return RegistryList{}, err
+		}
+		var regList RegistryList
+		err = yaml.UnmarshalStrict(data, &regList)
+		if err != nil {
+			return RegistryList{}, fmt.Errorf("could not parse registry configuration from %s: %v", path, err)
+		}
+		err = mergeRegistryList(&merged, regList)
+		if err != nil {
+			return RegistryList{}, fmt.Errorf("could not merge registry configuration from %s: %v", path, err)
+		}
+	}
+
+	err := validateRegistryList(merged)
+	if err != nil {
+		return RegistryList{}, err
+	}
+
+	warnOverlappingPrefixes(merged)
+
+	return merged, nil
+}
+
+// mergeRegistryList merges the registries of regList into merged, overriding
+// the entries with the same name or prefix
+func mergeRegistryList(merged *RegistryList, regList RegistryList) error {
+	prefixes := make(map[string]string, len(regList.Items))
+	for _, registry := range regList.Items {
+		prefix := strings.TrimSuffix(registry.Prefix, "/")
+		if other, ok := prefixes[prefix]; ok {
+			return fmt.Errorf("registries %s and %s use the same prefix '%s'", other, registry.Name, registry.Prefix)
+		}
+		prefixes[prefix] = registry.Name
+	}
+
+	numMerged := len(merged.Items)
+	for _, registry := range regList.Items {
+		prefix := strings.TrimSuffix(registry.Prefix, "/")
+		override := -1
+		for i, existing := range merged.Items[:numMerged] {
+			if existing.Name != registry.Name && strings.TrimSuffix(existing.Prefix, "/") != prefix {
+				continue
+			}
+			if override >= 0 {
+				return fmt.Errorf("registry %s would override both registries %s and %s", registry.Name, merged.Items[override].Name, existing.Name)
+			}
+			override = i
+		}
+		if override >= 0 {
+			log.Debugf("registry %s overrides registry %s", registry.Name, merged.Items[override].Name)
+			merged.Items[override] = registry
+		} else {
+			merged.Items = append(merged.Items, registry)
+		}
+	}
+
+	if len(regList.Search) > 0 {
+		merged.Search = regList.Search
+	}
+	return nil
+}
+
+// validateRegistryList returns an error if any of the registries in the list
+// is not configured properly
+func validateRegistryList(regList RegistryList) error {
+	var err error
+	var defaultPrefixFound = ""
 	for _, registry := range regList.Items {
 		if registry.Name == "" {
 			err = fmt.Errorf("registry name is missing for entry %v", registry)
 		} else if registry.ApiURL == "" {
 			err = fmt.Errorf("API URL must be specified for registry %s", registry.Name)
-		} else if registry.Prefix == "" {
-			if defaultPrefixFound != "" {
-				err = fmt.Errorf("there must be only one default registry (already is %s), %s needs a prefix", defaultPrefixFound, registry.Name)
-			} else {
+		} else if registry.Prefix == "" || registry.Default {
+			if defaultPrefixFound == "" {
 				defaultPrefixFound = registry.Name
+			} else if registry.Default {
+				err = fmt.Errorf("there must be only one default registry (already is %s), %s cannot be marked as default", defaultPrefixFound, registry.Name)
+			} else {
+				err = fmt.Errorf("there must be only one default registry (already is %s), %s needs a prefix", defaultPrefixFound, registry.Name)
+			}
+		}
+
+		if err == nil && registry.AuthHost != "" {
+			if strings.Contains(registry.AuthHost, "/") {
+				err = fmt.Errorf("auth host for registry %s must be a host name, not an URL: %s", registry.Name, registry.AuthHost)
+			}
+		}
+
+		if err == nil && strings.Contains(registry.WriteBackPrefix, "://") {
+			err = fmt.Errorf("write-back prefix for registry %s must not contain a scheme: %s", registry.Name, registry.WriteBackPrefix)
+		}
+
+		if err == nil {
+			for host, ip := range registry.HostAliases {
+				if net.ParseIP(ip) == nil {
+					err = fmt.Errorf("host alias %s for registry %s must be an IP address: %s", host, registry.Name, ip)
+					break
+				}
+			}
+		}
+
+		if err == nil {
+			for _, mediaType := range registry.AllowedMediaTypes {
+				if !isManifestMediaType(mediaType) {
+					err = fmt.Errorf("unknown manifest media type for registry %s: %s", registry.Name, mediaType)
+					break
+				}
+			}
+		}
+
+		if err == nil && registry.CredsRefresh != 0 {
+			if registry.CredsExpire <= 0 {
+				err = fmt.Errorf("credsrefresh for registry %s requires credsexpire to be set", registry.Name)
+			} else if registry.CredsRefresh < 0 || registry.CredsRefresh >= registry.CredsExpire {
+				err = fmt.Errorf("credsrefresh for registry %s must be positive and less than credsexpire", registry.Name)
+			}
+		}
+
+		if err == nil && registry.MaxStreams < 0 {
+			err = fmt.Errorf("maxstreams for registry %s must not be negative", registry.Name)
+		}
+
+		if err == nil && registry.MetadataConcurrency < 0 {
+			err = fmt.Errorf("metadataconcurrency for registry %s must not be negative", registry.Name)
+		}
+
+		if err == nil && registry.NegativeCacheTTL < 0 {
+			err = fmt.Errorf("negativecachettl for registry %s must not be negative", registry.Name)
+		}
+
+		if err == nil && (registry.TLSCertFile == "") != (registry.TLSKeyFile == "") {
+			err = fmt.Errorf("tls_cert_file and tls_key_file for registry %s must be given together", registry.Name)
+		}
+
+		if err == nil && registry.TLSCredentials != "" {
+			if registry.TLSCertFile != "" {
+				err = fmt.Errorf("tls_credentials and tls_cert_file for registry %s are mutually exclusive", registry.Name)
+			} else if _, _, perr := parseTLSCredentials(registry.TLSCredentials); perr != nil {
+				err = fmt.Errorf("invalid tls_credentials for registry %s: %v", registry.Name, perr)
 			}
 		}
 
+		if err == nil && registry.Proxy != "" {
+			_, err = parseProxy(registry.Proxy)
+			if err != nil {
+				err = fmt.Errorf("invalid proxy for registry %s: %v", registry.Name, err)
+			}
+		}
+
+		if err == nil && len(registry.FallbackCredentials) > 0 {
+			if registry.Credentials == "" {
+				err = fmt.Errorf("fallbackcredentials for registry %s requires credentials to be set", registry.Name)
+			}
+			for _, credentials := range registry.FallbackCredentials {
+				if err != nil {
+					break
+				}
+				if credentials != CredentialsAnonymous {
+					if _, perr := image.ParseCredentialSource(credentials, false); perr != nil {
+						err = fmt.Errorf("invalid fallback credentials for registry %s: %v", registry.Name, perr)
+					}
+				}
+			}
+		}
+
+		for name, definition := range registry.Headers {
+			if err != nil {
+				break
+			}
+			if name == "" {
+				err = fmt.Errorf("invalid header for registry %s: name must not be empty", registry.Name)
+			} else if _, _, perr := parseHeaderSource(definition); perr != nil {
+				err = fmt.Errorf("invalid header %s for registry %s: %v", name, registry.Name, perr)
+			}
+		}
+
+		if err == nil && (registry.MinInterval < 0 || registry.Jitter < 0) {
+			err = fmt.Errorf("min_interval and jitter for registry %s must not be negative", registry.Name)
+		}
+
+		if err == nil {
+			if _, perr := ParseTagListStrategy(registry.TagList); perr != nil {
+				err = fmt.Errorf("invalid tag_list for registry %s: %v", registry.Name, perr)
+			}
+		}
+
+		if err == nil && strings.ContainsAny(registry.UserAgent, "\r\n") {
+			err = fmt.Errorf("user_agent for registry %s must be a single line", registry.Name)
+		}
+
+		if err == nil && registry.Timeout < 0 {
+			err = fmt.Errorf("timeout for registry %s must not be negative", registry.Name)
+		}
+
+		if err == nil && (registry.RateLimitRetries < 0 || registry.RateLimitMaxBackoff < 0) {
+			err = fmt.Errorf("ratelimitretries and ratelimitmaxbackoff for registry %s must not be negative", registry.Name)
+		}
+
+		if err == nil && (registry.CircuitThreshold < 0 || registry.CircuitCooldown < 0) {
+			err = fmt.Errorf("circuitbreakerthreshold and circuitbreakercooldown for registry %s must not be negative", registry.Name)
+		}
+
 		if err == nil {
 			switch registry.TagSortMode {
 			case "latest-first", "latest-last", "none", "":
@@ -91,13 +339,80 @@ func ParseRegistryConfiguration(yamlSource string) (RegistryList, error) {
 				err = fmt.Errorf("unknown tag sort mode for registry %s: %s", registry.Name, registry.TagSortMode)
 			}
 		}
+
+		if err == nil {
+			switch strings.ToLower(registry.Flavor) {
+			case "dockerhub", "gitlab", "quay", "generic", "":
+			default:
+				err = fmt.Errorf("unknown flavor for registry %s: %s", registry.Name, registry.Flavor)
+			}
+		}
+
+		if err == nil {
+			switch strings.ToLower(registry.ArtifactType) {
+			case "image", "helm", "":
+			default:
+				err = fmt.Errorf("unknown artifact type for registry %s: %s", registry.Name, registry.ArtifactType)
+			}
+		}
+
+		if err == nil {
+			if _, perr := ParseCreatedSources(registry.CreatedFrom); perr != nil {
+				err = fmt.Errorf("invalid createdfrom for registry %s: %v", registry.Name, perr)
+			}
+		}
 	}
 
-	if err != nil {
-		return RegistryList{}, err
+	if err == nil {
+		err = validateCredentialsFrom(regList)
 	}
 
-	return regList, nil
+	return err
+}
+
+// validateCredentialsFrom returns an error if a registry in the list uses
+// the credentials of a registry that is not in the list, or of a registry
+// that itself uses the credentials of another registry.
+func validateCredentialsFrom(regList RegistryList) error {
+	byName := make(map[string]RegistryConfiguration, len(regList.Items))
+	for _, registry := range regList.Items {
+		byName[registry.Name] = registry
+	}
+	for _, registry := range regList.Items {
+		if registry.CredentialsFrom == "" {
+			continue
+		}
+		if registry.Credentials != "" || len(registry.FallbackCredentials) > 0 {
+			return fmt.Errorf("credentials_from for registry %s cannot be used along with credentials", registry.Name)
+		}
+		source, ok := byName[registry.CredentialsFrom]
+		if !ok {
+			return fmt.Errorf("registry %s uses credentials of unknown registry %s", registry.Name, registry.CredentialsFrom)
+		}
+		if source.CredentialsFrom != "" {
+			return fmt.Errorf("registry %s uses credentials of registry %s, which uses credentials_from itself", registry.Name, source.Name)
+		}
+	}
+	return nil
+}
+
+// warnOverlappingPrefixes emits a warning for each pair of registries in the
+// list whose prefixes overlap.
+func warnOverlappingPrefixes(regList RegistryList) {
+	for i, a := range regList.Items {
+		for _, b := range regList.Items[i+1:] {
+			pa := strings.TrimSuffix(a.Prefix, "/")
+			pb := strings.TrimSuffix(b.Prefix, "/")
+			switch {
+			case a.Prefix == b.Prefix:
+				log.Warnf("registries %s and %s use the same prefix '%s', %s will be used", a.Name, b.Name, a.Prefix, b.Name)
+			case pa == pb:
+				log.Warnf("registries %s and %s use the same prefix '%s', %s will be used", a.Name, b.Name, pa, a.Name)
+			case prefixMatches(pa, pb) || prefixMatches(pb, pa):
+				log.Warnf("prefixes of registries %s ('%s') and %s ('%s') overlap, the longer prefix will be used", a.Name, a.Prefix, b.Name, b.Prefix)
+			}
+		}
+	}
 }
 
 // RestRestoreDefaultRegistryConfiguration restores the registry configuration
@@ -106,6 +421,8 @@ func RestoreDefaultRegistryConfiguration() {
 	registryLock.Lock()
 	defer registryLock.Unlock()
 	registries = make(map[string]*RegistryEndpoint)
+	searchRegistries = nil
+	searchResolutions = make(map[string]searchResolution)
 	for k, v := range defaultRegistries {
 		registries[k] = v.DeepCopy()
 	}
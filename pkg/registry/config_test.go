@@ -1,6 +1,9 @@
 package registry
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -18,6 +21,21 @@ func Test_ParseRegistryConfFromYaml(t *testing.T) {
 		assert.Len(t, regList.Items, 4)
 	})
 
+	t.Run("Parse search registries", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  prefix: foobar.io
+search:
+- foobar.io
+- ""
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"foobar.io", ""}, regList.Search)
+	})
+
 	t.Run("Parse from invalid YAML: no name found", func(t *testing.T) {
 		registries := `
 registries:
@@ -58,6 +76,58 @@ registries:
 		assert.Len(t, regList.Items, 0)
 	})
 
+	t.Run("Parse registry marked as default", func(t *testing.T) {
+		registries := `
+registries:
+- name: Mirror
+  api_url: https://mirror.example.com
+  prefix: mirror.example.com
+  default: true
+- name: Foobar Registry
+  api_url: https://foobar.io
+  prefix: foobar.io
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 2)
+		assert.True(t, regList.Items[0].Default)
+		assert.False(t, regList.Items[1].Default)
+	})
+
+	t.Run("Parse from invalid YAML: multiple registries marked as default", func(t *testing.T) {
+		registries := `
+registries:
+- name: Mirror
+  api_url: https://mirror.example.com
+  prefix: mirror.example.com
+  default: true
+- name: Foobar Registry
+  api_url: https://foobar.io
+  prefix: foobar.io
+  default: true
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "already is Mirror), Foobar Registry cannot be marked as default")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse from invalid YAML: registry marked as default and registry without prefix", func(t *testing.T) {
+		registries := `
+registries:
+- name: Docker Hub
+  api_url: https://registry-1.docker.io
+- name: Mirror
+  api_url: https://mirror.example.com
+  prefix: mirror.example.com
+  default: true
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "already is Docker Hub), Mirror cannot be marked as default")
+		assert.Len(t, regList.Items, 0)
+	})
+
 	t.Run("Parse from invalid YAML: invalid tag sort mode", func(t *testing.T) {
 		registries := `
 registries:
@@ -72,6 +142,647 @@ registries:
 		assert.Len(t, regList.Items, 0)
 	})
 
+	t.Run("Parse from valid YAML: auth host", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  authhost: auth.foobar.internal
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 1)
+		assert.Equal(t, "auth.foobar.internal", regList.Items[0].AuthHost)
+	})
+
+	t.Run("Parse from invalid YAML: auth host is URL", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  authhost: https://auth.foobar.internal/token
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "must be a host name")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse from valid YAML: host aliases", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://registry.example.com
+  hostaliases:
+    registry.example.com: 10.0.0.5
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 1)
+		assert.Equal(t, map[string]string{"registry.example.com": "10.0.0.5"}, regList.Items[0].HostAliases)
+	})
+
+	t.Run("Parse from invalid YAML: host alias is not an IP", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://registry.example.com
+  hostaliases:
+    registry.example.com: internal.example.com
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "must be an IP address")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse from invalid YAML: unknown allowed media type", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  allowedmediatypes:
+  - application/vnd.oci.image.manifest.v1+json
+  - application/json
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unknown manifest media type")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse from invalid YAML: negative metadata concurrency", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  metadataconcurrency: -1
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "metadataconcurrency for registry Foobar Registry must not be negative")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse from invalid YAML: negative cache TTL", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  negativecachettl: -1m
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "negativecachettl for registry Foobar Registry must not be negative")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse from invalid YAML: client certificate without key", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  tls_cert_file: /etc/tls/client.crt
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "tls_cert_file and tls_key_file for registry Foobar Registry must be given together")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse proxy settings", func(t *testing.T) {
+		registries := `
+registries:
+- name: Proxied Registry
+  api_url: https://proxied.io
+  prefix: proxied.io
+  proxy: socks5://proxy.example.com:1080
+- name: Direct Registry
+  api_url: https://direct.io
+  prefix: direct.io
+  proxy: none
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 2)
+		assert.Equal(t, "socks5://proxy.example.com:1080", regList.Items[0].Proxy)
+		assert.Equal(t, "none", regList.Items[1].Proxy)
+	})
+
+	t.Run("Parse from invalid YAML: unsupported proxy scheme", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  proxy: ftp://proxy.example.com
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid proxy for registry Foobar Registry")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse fallback credentials", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  credentials: env:PRIMARY_CREDS
+  fallbackcredentials:
+  - secret:argocd/fallback#creds
+  - anonymous
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 1)
+		assert.Equal(t, []string{"secret:argocd/fallback#creds", "anonymous"}, regList.Items[0].FallbackCredentials)
+	})
+
+	t.Run("Parse from invalid YAML: fallback credentials without credentials", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  fallbackcredentials:
+  - anonymous
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "fallbackcredentials for registry Foobar Registry requires credentials to be set")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse from invalid YAML: invalid fallback credentials", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  credentials: env:PRIMARY_CREDS
+  fallbackcredentials:
+  - unknown:creds
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid fallback credentials for registry Foobar Registry")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse from invalid YAML: credentials_from errors", func(t *testing.T) {
+		for yaml, expected := range map[string]string{
+			`
+registries:
+- name: Mirror
+  api_url: https://mirror.io
+  prefix: mirror.io
+  credentials_from: Upstream
+`: "registry Mirror uses credentials of unknown registry Upstream",
+			`
+registries:
+- name: Upstream
+  api_url: https://upstream.io
+  prefix: upstream.io
+- name: Mirror
+  api_url: https://mirror.io
+  prefix: mirror.io
+  credentials: env:CREDS
+  credentials_from: Upstream
+`: "credentials_from for registry Mirror cannot be used along with credentials",
+			`
+registries:
+- name: Upstream
+  api_url: https://upstream.io
+  prefix: upstream.io
+  credentials_from: Mirror
+- name: Mirror
+  api_url: https://mirror.io
+  prefix: mirror.io
+  credentials_from: Upstream
+`: "which uses credentials_from itself",
+		} {
+			regList, err := ParseRegistryConfiguration(yaml)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), expected)
+			assert.Len(t, regList.Items, 0)
+		}
+	})
+
+	t.Run("Parse static headers", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  headers:
+    X-Registry-Token: env:REGISTRY_TOKEN
+    X-Tenant: file:/app/config/tenant
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 1)
+		assert.Equal(t, map[string]string{"X-Registry-Token": "env:REGISTRY_TOKEN", "X-Tenant": "file:/app/config/tenant"}, regList.Items[0].Headers)
+	})
+
+	t.Run("Parse from invalid YAML: literal header value", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  headers:
+    X-Registry-Token: s3cr3t
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid header X-Registry-Token for registry Foobar Registry")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse request pacing settings", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  min_interval: 200ms
+  jitter: 1s
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 1)
+		assert.Equal(t, 200*time.Millisecond, regList.Items[0].MinInterval)
+		assert.Equal(t, time.Second, regList.Items[0].Jitter)
+	})
+
+	t.Run("Parse from invalid YAML: negative jitter", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  jitter: -1s
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "min_interval and jitter for registry Foobar Registry must not be negative")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse cache setting", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  prefix: foobar.io
+  cache: false
+- name: Barbar Registry
+  api_url: https://barbar.io
+  prefix: barbar.io
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 2)
+		require.NotNil(t, regList.Items[0].Cache)
+		assert.False(t, *regList.Items[0].Cache)
+		assert.Nil(t, regList.Items[1].Cache)
+	})
+
+	t.Run("Parse circuit breaker settings", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  circuitbreakerthreshold: 5
+  circuitbreakercooldown: 2m
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 1)
+		assert.Equal(t, 5, regList.Items[0].CircuitThreshold)
+		assert.Equal(t, 2*time.Minute, regList.Items[0].CircuitCooldown)
+	})
+
+	t.Run("Parse from invalid YAML: negative circuit breaker threshold", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  circuitbreakerthreshold: -1
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "circuitbreakerthreshold and circuitbreakercooldown for registry Foobar Registry must not be negative")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse request timeout", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  timeout: 60s
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 1)
+		assert.Equal(t, time.Minute, regList.Items[0].Timeout)
+	})
+
+	t.Run("Parse user agent and request ID", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  user_agent: image-updater (team-a)
+  request_id: true
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 1)
+		assert.Equal(t, "image-updater (team-a)", regList.Items[0].UserAgent)
+		assert.True(t, regList.Items[0].RequestID)
+	})
+
+	t.Run("Parse from invalid YAML: multi-line user agent", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  user_agent: "image-updater\nX-Injected: true"
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "user_agent for registry Foobar Registry must be a single line")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse from invalid YAML: negative timeout", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  timeout: -5s
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "timeout for registry Foobar Registry must not be negative")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse from invalid YAML: invalid TLS credentials", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  tls_credentials: argocd/harbor-client
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid tls_credentials for registry Foobar Registry")
+		assert.Len(t, regList.Items, 0)
+
+		registries = `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  tls_credentials: secret:argocd/harbor-client
+  tls_cert_file: /app/config/client.crt
+  tls_key_file: /app/config/client.key
+`
+		regList, err = ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "tls_credentials and tls_cert_file for registry Foobar Registry are mutually exclusive")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse artifact type", func(t *testing.T) {
+		registries := `
+registries:
+- name: Chart Registry
+  api_url: https://charts.example.com
+  prefix: charts.example.com
+  artifacttype: helm
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 1)
+		assert.Equal(t, "helm", regList.Items[0].ArtifactType)
+	})
+
+	t.Run("Parse from invalid YAML: unknown artifact type", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  artifacttype: wasm
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unknown artifact type for registry Foobar Registry: wasm")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse sources of creation time", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  createdfrom:
+  - history-newest
+  - config
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 1)
+		assert.Equal(t, []string{"history-newest", "config"}, regList.Items[0].CreatedFrom)
+	})
+
+	t.Run("Parse from invalid YAML: unknown source of creation time", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  createdfrom: [layer]
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid createdfrom for registry Foobar Registry: unknown source of creation time: layer")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse from valid YAML: tag list strategy", func(t *testing.T) {
+		registries := `
+registries:
+- name: Vendor Registry
+  api_url: https://vendor.example.com
+  tag_list:
+    strategy: search
+    url: /api/v1/search
+    body: '{"repository":"{{name}}"}'
+    path: $.results[*].name
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 1)
+		require.NotNil(t, regList.Items[0].TagList)
+		assert.Equal(t, "search", regList.Items[0].TagList.Strategy)
+		assert.Equal(t, "$.results[*].name", regList.Items[0].TagList.Path)
+	})
+
+	t.Run("Parse from invalid YAML: search strategy without body", func(t *testing.T) {
+		registries := `
+registries:
+- name: Vendor Registry
+  api_url: https://vendor.example.com
+  tag_list:
+    strategy: search
+    url: /api/v1/search
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid tag_list for registry Vendor Registry: body is required for the search strategy")
+		assert.Len(t, regList.Items, 0)
+	})
+
+	t.Run("Parse from invalid YAML: negative rate limit retries", func(t *testing.T) {
+		registries := `
+registries:
+- name: Foobar Registry
+  api_url: https://foobar.io
+  ratelimitretries: -1
+`
+		regList, err := ParseRegistryConfiguration(registries)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "ratelimitretries and ratelimitmaxbackoff for registry Foobar Registry must not be negative")
+		assert.Len(t, regList.Items, 0)
+	})
+
+}
+
+func Test_ParseRegistryConfigurationFromFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registries")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeConf := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+		return path
+	}
+
+	base := writeConf("base.yaml", `
+registries:
+- name: Docker Hub
+  api_url: https://registry-1.docker.io
+  prefix: docker.io
+- name: Quay
+  api_url: https://quay.io
+  prefix: quay.io
+  credentials: env:QUAY_CREDS
+search:
+- docker.io
+`)
+
+	t.Run("Merge registries from multiple files", func(t *testing.T) {
+		other := writeConf("merge.yaml", `
+registries:
+- name: GitHub
+  api_url: https://ghcr.io
+  prefix: ghcr.io
+  credentials_from: Quay
+`)
+		regList, err := ParseRegistryConfigurationFromFiles(base, other)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 3)
+		assert.Equal(t, "Docker Hub", regList.Items[0].Name)
+		assert.Equal(t, "Quay", regList.Items[1].Name)
+		assert.Equal(t, "GitHub", regList.Items[2].Name)
+		assert.Equal(t, []string{"docker.io"}, regList.Search)
+	})
+
+	t.Run("Later files override by name", func(t *testing.T) {
+		other := writeConf("override-name.yaml", `
+registries:
+- name: Quay
+  api_url: https://quay.example.com
+  prefix: quay.example.com
+search:
+- quay.example.com
+`)
+		regList, err := ParseRegistryConfigurationFromFiles(base, other)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 2)
+		assert.Equal(t, "Quay", regList.Items[1].Name)
+		assert.Equal(t, "https://quay.example.com", regList.Items[1].ApiURL)
+		assert.Equal(t, "", regList.Items[1].Credentials)
+		assert.Equal(t, []string{"quay.example.com"}, regList.Search)
+	})
+
+	t.Run("Later files override by prefix", func(t *testing.T) {
+		other := writeConf("override-prefix.yaml", `
+registries:
+- name: Docker Hub Mirror
+  api_url: https://mirror.example.com
+  prefix: docker.io/
+`)
+		regList, err := ParseRegistryConfigurationFromFiles(base, other)
+		require.NoError(t, err)
+		require.Len(t, regList.Items, 2)
+		assert.Equal(t, "Docker Hub Mirror", regList.Items[0].Name)
+		assert.Equal(t, "https://mirror.example.com", regList.Items[0].ApiURL)
+	})
+
+	t.Run("Duplicate prefix in the same file", func(t *testing.T) {
+		other := writeConf("duplicate.yaml", `
+registries:
+- name: GitHub
+  api_url: https://ghcr.io
+  prefix: ghcr.io
+- name: GitHub Mirror
+  api_url: https://ghcr.example.com
+  prefix: ghcr.io
+`)
+		_, err := ParseRegistryConfigurationFromFiles(base, other)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "registries GitHub and GitHub Mirror use the same prefix 'ghcr.io'")
+		assert.Contains(t, err.Error(), other)
+	})
+
+	t.Run("Ambiguous override", func(t *testing.T) {
+		other := writeConf("ambiguous.yaml", `
+registries:
+- name: Quay
+  api_url: https://registry-1.docker.io
+  prefix: docker.io
+`)
+		_, err := ParseRegistryConfigurationFromFiles(base, other)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "registry Quay would override both registries Docker Hub and Quay")
+	})
+
+	t.Run("Merged list is validated", func(t *testing.T) {
+		other := writeConf("invalid.yaml", `
+registries:
+- name: GitHub
+  api_url: https://ghcr.io
+  prefix: ghcr.io
+  credentials_from: GitLab
+`)
+		_, err := ParseRegistryConfigurationFromFiles(base, other)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "registry GitHub uses credentials of unknown registry GitLab")
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		_, err := ParseRegistryConfigurationFromFiles(base, filepath.Join(dir, "missing.yaml"))
+		require.Error(t, err)
+	})
+
+	t.Run("Invalid YAML", func(t *testing.T) {
+		other := writeConf("unknown.yaml", `
+registries:
+- name: GitHub
+  unknown: field
+`)
+		_, err := ParseRegistryConfigurationFromFiles(base, other)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not parse registry configuration from "+other)
+	})
 }
 
 func Test_LoadRegistryConfiguration(t *testing.T) {
@@ -0,0 +1,203 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema1"
+)
+
+// CreatedSource is a field of the image configuration the creation time of an
+// image is read from
+type CreatedSource string
+
+const (
+	// The created field of the image configuration
+	CreatedFromConfig CreatedSource = "config"
+	// The created field of the newest entry of the image's history
+	CreatedFromNewestHistory CreatedSource = "history-newest"
+	// The created field of the oldest entry of the image's history
+	CreatedFromOldestHistory CreatedSource = "history-oldest"
+)
+
+// Sources of the creation time used if none are configured for the endpoint
+var defaultCreatedSources = []CreatedSource{CreatedFromConfig, CreatedFromNewestHistory}
+
+// ParseCreatedSources parses a list of sources of the creation time of images,
+// in the order they are tried
+func ParseCreatedSources(sources []string) ([]CreatedSource, error) {
+	parsed := make([]CreatedSource, 0, len(sources))
+	for _, s := range sources {
+		switch src := CreatedSource(strings.ToLower(s)); src {
+		case CreatedFromConfig, CreatedFromNewestHistory, CreatedFromOldestHistory:
+			parsed = append(parsed, src)
+		default:
+			return nil, fmt.Errorf("unknown source of creation time: %s", s)
+		}
+	}
+	return parsed, nil
+}
+
+// createdSources returns the sources of the creation time configured for the
+// client's endpoint
+func (client *registryClient) createdSources() []CreatedSource {
+	if client.endpoint == nil {
+		return nil
+	}
+	return client.endpoint.CreatedFrom
+}
+
+// imageConfig holds the fields of an image configuration that make up the
+// meta data of a tag
+type imageConfig struct {
+	Arch    string `json:"architecture"`
+	Created string `json:"created"`
+	OS      string `json:"os"`
+	Config  struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+	// History is ordered from the oldest to the newest entry
+	History []struct {
+		Created string `json:"created"`
+	} `json:"history"`
+}
+
+// createdAt returns the creation time from the first of the given sources
+// that holds one. If sources is empty, the default sources are used.
+func (ic *imageConfig) createdAt(sources []CreatedSource) (time.Time, error) {
+	if len(sources) == 0 {
+		sources = defaultCreatedSources
+	}
+	errs := []string{}
+	for _, src := range sources {
+		var created string
+		switch src {
+		case CreatedFromConfig:
+			created = ic.Created
+		case CreatedFromNewestHistory:
+			if len(ic.History) > 0 {
+				created = ic.History[len(ic.History)-1].Created
+			}
+		case CreatedFromOldestHistory:
+			if len(ic.History) > 0 {
+				created = ic.History[0].Created
+			}
+		}
+		if created == "" {
+			errs = append(errs, fmt.Sprintf("%s: not set", src))
+			continue
+		}
+		createdAt, err := time.Parse(time.RFC3339Nano, created)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", src, err))
+			continue
+		}
+		return createdAt, nil
+	}
+	return time.Time{}, fmt.Errorf("no creation time found (%s)", strings.Join(errs, "; "))
+}
+
+// tagInfoFromConfig returns the metadata from the given image configuration
+// blob, with the creation time read from the given sources
+func tagInfoFromConfig(blob []byte, sources []CreatedSource) (*tag.TagInfo, error) {
+	var ic imageConfig
+	if err := json.Unmarshal(blob, &ic); err != nil {
+		return nil, err
+	}
+	return ic.tagInfo(sources)
+}
+
+// tagInfoFromV1 returns the metadata from the given V1 manifest, with the
+// creation time read from the given sources. The V1 compatibility data of the
+// topmost layer takes the place of the image configuration, and the V1
+// compatibility data of all layers the place of its history.
+func tagInfoFromV1(man *schema1.SignedManifest, sources []CreatedSource) (*tag.TagInfo, error) {
+	if len(man.History) == 0 {
+		return nil, fmt.Errorf("no history information found in schema V1")
+	}
+	var ic imageConfig
+	if err := json.Unmarshal([]byte(man.History[0].V1Compatibility), &ic); err != nil {
+		return nil, err
+	}
+	// V1 history is ordered from the newest to the oldest layer
+	ic.History = ic.History[:0]
+	for i := len(man.History) - 1; i >= 0; i-- {
+		var layer struct {
+			Created string `json:"created"`
+		}
+		if err := json.Unmarshal([]byte(man.History[i].V1Compatibility), &layer); err != nil {
+			return nil, err
+		}
+		ic.History = append(ic.History, layer)
+	}
+	return ic.tagInfo(sources)
+}
+
+// tagInfo returns the metadata held by the image configuration
+func (ic *imageConfig) tagInfo(sources []CreatedSource) (*tag.TagInfo, error) {
+	ti := &tag.TagInfo{OS: ic.OS, Arch: ic.Arch, Labels: ic.Config.Labels}
+	createdAt, err := ic.createdAt(sources)
+	if err != nil {
+		return nil, &NoCreationTimeError{TagInfo: ti, Err: err}
+	}
+	ti.CreatedAt = createdAt
+	return ti, nil
+}
+
+// NoCreationTimeError is returned for images whose configuration holds no
+// creation time in any of the sources it is read from. It carries the rest
+// of the meta data, for lookups that do not depend on the creation time.
+type NoCreationTimeError struct {
+	// Meta data of the image, without creation time
+	TagInfo *tag.TagInfo
+	Err     error
+}
+
+func (e *NoCreationTimeError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *NoCreationTimeError) Unwrap() error {
+	return e.Err
+}
+
+// tagMetadataWithoutCreated returns the meta data of the image the given
+// manifest belongs to, like TagMetadata does, but without failing for images
+// that have no creation time
+func tagMetadataWithoutCreated(ctx context.Context, regClient RegistryClient, nameInRegistry string, manifest distribution.Manifest) (*tag.TagInfo, error) {
+	ti, err := regClient.TagMetadata(ctx, nameInRegistry, manifest)
+	var nce *NoCreationTimeError
+	if errors.As(err, &nce) {
+		return nce.TagInfo, nil
+	}
+	return ti, err
+}
+
+// imageTagInfo returns the meta data of the image the given reference points
+// to, like tagMetadataWithoutCreated does. For references pointing to an
+// image index, this is the meta data of the image for the default platform.
+func imageTagInfo(ctx context.Context, regClient RegistryClient, nameInRegistry, reference string) (*tag.TagInfo, error) {
+	ml, _, _, err := tagManifest(ctx, regClient, nameInRegistry, reference)
+	if err != nil {
+		return nil, err
+	}
+	if ml == nil {
+		return nil, fmt.Errorf("manifest list has no manifest for platform %s", DefaultPlatform)
+	}
+	ti, err := tagMetadataWithoutCreated(ctx, regClient, nameInRegistry, ml)
+	if err != nil {
+		return nil, err
+	}
+	if ti == nil {
+		return nil, fmt.Errorf("no meta data found")
+	}
+	return ti, nil
+}
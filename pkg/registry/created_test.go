@@ -0,0 +1,166 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/cache"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseCreatedSources(t *testing.T) {
+	t.Run("Valid sources", func(t *testing.T) {
+		sources, err := ParseCreatedSources([]string{"History-Newest", "config", "history-oldest"})
+		require.NoError(t, err)
+		assert.Equal(t, []CreatedSource{CreatedFromNewestHistory, CreatedFromConfig, CreatedFromOldestHistory}, sources)
+	})
+
+	t.Run("Unknown source", func(t *testing.T) {
+		_, err := ParseCreatedSources([]string{"config", "layer"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unknown source of creation time: layer")
+	})
+}
+
+func Test_TagInfoFromConfig(t *testing.T) {
+	config := []byte(`{"created":"2021-01-01T00:00:00Z","os":"linux","architecture":"amd64","history":[{"created":"2020-01-01T00:00:00Z"},{"created":"2022-01-01T00:00:00Z"}]}`)
+	noCreated := []byte(`{"os":"linux","architecture":"amd64","history":[{"created":"2020-01-01T00:00:00Z"},{"created":"2022-01-01T00:00:00Z"}]}`)
+
+	for _, tc := range []struct {
+		name    string
+		config  []byte
+		sources []CreatedSource
+		created time.Time
+	}{
+		{"Default prefers config", config, nil, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"Default falls back to history", noCreated, nil, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"Newest history entry", config, []CreatedSource{CreatedFromNewestHistory}, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"Oldest history entry", config, []CreatedSource{CreatedFromOldestHistory, CreatedFromConfig}, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ti, err := tagInfoFromConfig(tc.config, tc.sources)
+			require.NoError(t, err)
+			assert.True(t, tc.created.Equal(ti.CreatedAt), ti.CreatedAt.String())
+			assert.Equal(t, "linux/amd64", ti.Platform())
+		})
+	}
+
+	t.Run("No source holds a creation time", func(t *testing.T) {
+		_, err := tagInfoFromConfig([]byte(`{"created":"yesterday"}`), nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no creation time found")
+		assert.Contains(t, err.Error(), "config: parsing time")
+		assert.Contains(t, err.Error(), "history-newest: not set")
+	})
+}
+
+func Test_TagInfoFromV1(t *testing.T) {
+	man := &schema1.SignedManifest{
+		Manifest: schema1.Manifest{
+			History: []schema1.History{
+				{V1Compatibility: `{"created":"2021-03-01T00:00:00Z","os":"linux","architecture":"arm64"}`},
+				{V1Compatibility: `{"created":"2021-02-01T00:00:00Z"}`},
+				{V1Compatibility: `{"created":"2021-01-01T00:00:00Z"}`},
+			},
+		},
+	}
+
+	t.Run("Topmost layer", func(t *testing.T) {
+		ti, err := tagInfoFromV1(man, nil)
+		require.NoError(t, err)
+		assert.True(t, time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC).Equal(ti.CreatedAt))
+		assert.Equal(t, "linux/arm64", ti.Platform())
+	})
+
+	t.Run("Oldest layer", func(t *testing.T) {
+		ti, err := tagInfoFromV1(man, []CreatedSource{CreatedFromOldestHistory})
+		require.NoError(t, err)
+		assert.True(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).Equal(ti.CreatedAt))
+	})
+
+	t.Run("No history", func(t *testing.T) {
+		_, err := tagInfoFromV1(&schema1.SignedManifest{}, nil)
+		require.Error(t, err)
+	})
+}
+
+// writeSchema2Image writes an image with a Docker V2 manifest, whose config
+// has the given creation time and history, to the OCI layout in dir and
+// returns the descriptor of its manifest
+func writeSchema2Image(t *testing.T, dir string, created time.Time, history ...time.Time) map[string]interface{} {
+	t.Helper()
+	entries := []map[string]string{}
+	for _, h := range history {
+		entries = append(entries, map[string]string{"created": h.Format(time.RFC3339Nano)})
+	}
+	config := writeBlob(t, dir, map[string]interface{}{
+		"created":      created.Format(time.RFC3339Nano),
+		"os":           "linux",
+		"architecture": "amd64",
+		"history":      entries,
+	})
+	manifest := writeBlob(t, dir, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     schema2.MediaTypeManifest,
+		"config":        map[string]interface{}{"mediaType": schema2.MediaTypeImageConfig, "digest": config, "size": 1},
+		"layers":        []interface{}{},
+	})
+	return map[string]interface{}{"mediaType": schema2.MediaTypeManifest, "digest": manifest, "size": 1}
+}
+
+func Test_GetTagsCreatedFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oci-layout")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	day := func(month, day int) time.Time { return time.Date(2021, time.Month(month), day, 0, 0, 0, 0, time.UTC) }
+	// 1.0 has the newer config, 1.1 has the newer history entry
+	images := map[string]map[string]interface{}{
+		"1.0": writeSchema2Image(t, dir, day(6, 1), day(1, 1), day(6, 1)),
+		"1.1": writeSchema2Image(t, dir, day(3, 1), day(3, 1), day(9, 1)),
+	}
+	manifests := []interface{}{}
+	for ref, desc := range images {
+		desc["annotations"] = map[string]string{ociRefNameAnnotation: ref}
+		manifests = append(manifests, desc)
+	}
+	b, err := json.Marshal(map[string]interface{}{"schemaVersion": 2, "manifests": manifests})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), b, 0644))
+
+	img := image.NewFromIdentifier("foo/bar:1.0")
+	newest := func(sources ...CreatedSource) string {
+		ep := &RegistryEndpoint{RegistryAPI: OCILayoutScheme + dir, Cache: cache.NewMemCache(), CreatedFrom: sources}
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		vc := &image.VersionConstraint{SortMode: image.VersionSortLatest}
+		tl, err := ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		sorted := tl.SortByDate()
+		require.Len(t, sorted, 2)
+		return sorted[len(sorted)-1].TagName
+	}
+
+	t.Run("Created time of config", func(t *testing.T) {
+		assert.Equal(t, "1.0", newest())
+		assert.Equal(t, "1.0", newest(CreatedFromConfig, CreatedFromNewestHistory))
+	})
+
+	t.Run("Created time of newest history entry", func(t *testing.T) {
+		assert.Equal(t, "1.1", newest(CreatedFromNewestHistory, CreatedFromConfig))
+	})
+
+	t.Run("Created time of oldest history entry", func(t *testing.T) {
+		assert.Equal(t, "1.1", newest(CreatedFromOldestHistory))
+	})
+}
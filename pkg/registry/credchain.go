@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/kube"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+
+	"github.com/nokia/docker-registry-client/registry"
+)
+
+// CredentialsAnonymous can be given as fallback credentials of an endpoint,
+// to access the registry without credentials if none of the preceding
+// credentials can be used
+const CredentialsAnonymous = "anonymous"
+
+// fetchCredentialsFromChain tries the endpoint's credentials, followed by its
+// fallback credentials, in order. Returns the first credentials that can be
+// resolved and are not rejected by the registry, and whether anonymous access
+// has been chosen. Credentials that cannot be checked, i.e. because the
+// registry is unavailable, are used as they are.
+func (ep *RegistryEndpoint) fetchCredentialsFromChain(kubeClient *kube.KubernetesClient) (*image.Credential, bool, error) {
+	chain := append([]string{ep.Credentials}, ep.FallbackCredentials...)
+	errs := make([]string, 0, len(chain))
+	for i, definition := range chain {
+		if definition == CredentialsAnonymous {
+			log.Infof("no credentials for registry %s could be used, accessing it anonymously", ep.RegistryAPI)
+			return &image.Credential{}, true, nil
+		}
+		creds, err := ep.resolveCredentials(definition, kubeClient)
+		if err == nil {
+			err = checkCredentials(ep, creds.Username, creds.Password)
+		}
+		if err != nil {
+			log.Warnf("could not use credentials %s for registry %s: %v", definition, ep.RegistryAPI, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", definition, err))
+			continue
+		}
+		if i > 0 {
+			log.Infof("using fallback credentials %s for registry %s", definition, ep.RegistryAPI)
+		}
+		return creds, false, nil
+	}
+	return nil, false, fmt.Errorf("none of the credentials for registry %s could be used: %s", ep.RegistryAPI, strings.Join(errs, "; "))
+}
+
+// checkCredentials returns an error if the registry rejects the given
+// credentials when requesting the base endpoint of its API. It's a variable
+// so that it can be replaced in tests. It must not be called with the
+// endpoint's lock held.
+var checkCredentials = func(ep *RegistryEndpoint, username, password string) error {
+	ep.lock.RLock()
+	headers := ep.headers
+	ep.lock.RUnlock()
+	reg, err := newRegistry(ep, registry.Options{
+		Logf:     registry.Quiet,
+		Username: username,
+		Password: password,
+		Insecure: ep.Insecure,
+	}, false, headers)
+	if err != nil {
+		return err
+	}
+
+	statusCode, _, err := getBase(reg)
+	if err != nil {
+		log.Debugf("could not check credentials for registry %s: %v", ep.RegistryAPI, err)
+		return nil
+	}
+	if statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden {
+		return &RegistryError{Registry: ep.RegistryAPI, StatusCode: statusCode, Err: fmt.Errorf("credentials rejected by registry: %s", http.StatusText(statusCode)), kind: ErrUnauthorized}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_FallbackCredentials(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if username, password, ok := r.BasicAuth(); !ok || username != "good" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	newEndpoint := func(fallback ...string) *RegistryEndpoint {
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "env:TEST_PRIMARY_CREDS", "", false, SortUnsorted, 0, 0)
+		ep.FallbackCredentials = fallback
+		return ep
+	}
+	defer os.Unsetenv("TEST_PRIMARY_CREDS")
+	defer os.Unsetenv("TEST_FALLBACK_CREDS")
+
+	t.Run("Primary credentials are used if accepted", func(t *testing.T) {
+		os.Setenv("TEST_PRIMARY_CREDS", "good:secret")
+		os.Setenv("TEST_FALLBACK_CREDS", "other:secret")
+		ep := newEndpoint("env:TEST_FALLBACK_CREDS")
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		assert.Equal(t, "good", ep.Username)
+		assert.Equal(t, "secret", ep.Password)
+	})
+
+	t.Run("Fallback credentials are used if primary credentials are missing", func(t *testing.T) {
+		os.Unsetenv("TEST_PRIMARY_CREDS")
+		os.Setenv("TEST_FALLBACK_CREDS", "good:secret")
+		ep := newEndpoint("env:TEST_FALLBACK_CREDS")
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		assert.Equal(t, "good", ep.Username)
+		assert.Equal(t, "secret", ep.Password)
+	})
+
+	t.Run("Fallback credentials are used if primary credentials are rejected", func(t *testing.T) {
+		os.Setenv("TEST_PRIMARY_CREDS", "stale:secret")
+		os.Setenv("TEST_FALLBACK_CREDS", "good:secret")
+		ep := newEndpoint("env:TEST_FALLBACK_CREDS")
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		assert.Equal(t, "good", ep.Username)
+		assert.Equal(t, "secret", ep.Password)
+	})
+
+	t.Run("Anonymous access if no credentials can be used", func(t *testing.T) {
+		os.Setenv("TEST_PRIMARY_CREDS", "stale:secret")
+		os.Unsetenv("TEST_FALLBACK_CREDS")
+		ep := newEndpoint("env:TEST_FALLBACK_CREDS", CredentialsAnonymous)
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		assert.Empty(t, ep.Username)
+		assert.Empty(t, ep.Password)
+
+		// The chain is not evaluated again until the credentials expire
+		atomic.StoreInt32(&requests, 0)
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("Error if no credentials can be used", func(t *testing.T) {
+		os.Setenv("TEST_PRIMARY_CREDS", "stale:secret")
+		os.Setenv("TEST_FALLBACK_CREDS", "other:secret")
+		ep := newEndpoint("env:TEST_FALLBACK_CREDS")
+		err := ep.SetEndpointCredentials(nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "none of the credentials for registry")
+		assert.Contains(t, err.Error(), "env:TEST_FALLBACK_CREDS: credentials rejected by registry")
+		assert.Empty(t, ep.Username)
+	})
+
+	t.Run("Chain is evaluated again once credentials expire", func(t *testing.T) {
+		os.Unsetenv("TEST_PRIMARY_CREDS")
+		os.Setenv("TEST_FALLBACK_CREDS", "good:secret")
+		ep := newEndpoint("env:TEST_FALLBACK_CREDS", CredentialsAnonymous)
+		ep.CredsExpire = time.Minute
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		assert.Equal(t, "good", ep.Username)
+
+		// The rotated secret has been populated in the meantime
+		os.Setenv("TEST_PRIMARY_CREDS", "good:rotated")
+		os.Unsetenv("TEST_FALLBACK_CREDS")
+		ep.CredsUpdated = ep.CredsUpdated.Add(-2 * time.Minute)
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		assert.Empty(t, ep.Username)
+
+		os.Setenv("TEST_PRIMARY_CREDS", "good:secret")
+		ep.CredsUpdated = ep.CredsUpdated.Add(-2 * time.Minute)
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		assert.Equal(t, "good", ep.Username)
+		assert.Equal(t, "secret", ep.Password)
+	})
+
+	t.Run("Credentials that cannot be checked are used", func(t *testing.T) {
+		os.Setenv("TEST_PRIMARY_CREDS", "stale:secret")
+		ep := newEndpoint(CredentialsAnonymous)
+		ep.RegistryAPI = "http://127.0.0.1:1"
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		assert.Equal(t, "stale", ep.Username)
+	})
+
+	t.Run("Endpoint is not locked while credentials are checked", func(t *testing.T) {
+		os.Setenv("TEST_PRIMARY_CREDS", "good:secret")
+		ep := newEndpoint(CredentialsAnonymous)
+		checking := make(chan struct{})
+		release := make(chan struct{})
+		defer func(check func(ep *RegistryEndpoint, username, password string) error) {
+			checkCredentials = check
+		}(checkCredentials)
+		checkCredentials = func(ep *RegistryEndpoint, username, password string) error {
+			close(checking)
+			<-release
+			return nil
+		}
+
+		done := make(chan error)
+		go func() {
+			done <- ep.SetEndpointCredentials(nil)
+		}()
+		<-checking
+		created := make(chan error)
+		go func() {
+			_, err := NewClient(ep, "", "")
+			created <- err
+		}()
+		select {
+		case err := <-created:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Error("client could not be created while credentials were checked")
+		}
+		close(release)
+		require.NoError(t, <-done)
+		assert.Equal(t, "good", ep.Username)
+	})
+}
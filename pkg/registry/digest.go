@@ -0,0 +1,529 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/docker/distribution"
+	"golang.org/x/sync/semaphore"
+)
+
+// Media types we accept when resolving the digest of a manifest, so that the
+// digest is the same a container runtime would pull.
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v1+prettyjws",
+}
+
+// Media types that are dropped from the Accept header, in this order, when a
+// registry refuses to negotiate them. The remaining types are always sent.
+var negotiableMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+// narrowMediaTypes returns types without the first negotiable media type it
+// contains, or nil if it contains none.
+func narrowMediaTypes(types []string) []string {
+	for _, drop := range negotiableMediaTypes {
+		for i, t := range types {
+			if t == drop {
+				narrowed := append([]string{}, types[:i]...)
+				return append(narrowed, types[i+1:]...)
+			}
+		}
+	}
+	return nil
+}
+
+// manifestAccept returns the manifest media types to send to the registry,
+// which are the ones negotiated previously, if any.
+func (client *registryClient) manifestAccept() []string {
+	if client.endpoint == nil {
+		return manifestMediaTypes
+	}
+	client.endpoint.lock.RLock()
+	defer client.endpoint.lock.RUnlock()
+	if client.endpoint.acceptTypes == nil {
+		return manifestMediaTypes
+	}
+	return client.endpoint.acceptTypes
+}
+
+// setManifestAccept remembers the manifest media types that the registry has
+// accepted.
+func (client *registryClient) setManifestAccept(types []string) {
+	if client.endpoint == nil {
+		return
+	}
+	client.endpoint.lock.Lock()
+	defer client.endpoint.lock.Unlock()
+	client.endpoint.acceptTypes = types
+}
+
+// manifestRequest sends a request for the manifest at the given reference. If
+// the registry responds with 406 Not Acceptable, the request is retried with
+// a narrower set of media types until the registry accepts it or no more types
+// can be dropped. The accepted set is remembered for the endpoint.
+func (client *registryClient) manifestRequest(ctx context.Context, method, nameInRepository, reference string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", client.regClient.URL, nameInRepository, reference)
+	types := client.manifestAccept()
+	narrowed := false
+	for {
+		req, err := http.NewRequestWithContext(ctx, method, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(types, ", "))
+		resp, err := client.regClient.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusNotAcceptable {
+			if narrowed && resp.StatusCode == http.StatusOK {
+				client.setManifestAccept(types)
+			}
+			return resp, nil
+		}
+		next := narrowMediaTypes(types)
+		if next == nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+		log.Debugf("registry %s did not accept manifest types, retrying with %s", client.regClient.URL, strings.Join(next, ", "))
+		types, narrowed = next, true
+	}
+}
+
+// DigestClient is implemented by registry clients that are able to resolve
+// the digest of a tag without fetching its manifest.
+type DigestClient interface {
+	// TagDigest returns the digest of the manifest given tag points to
+	TagDigest(ctx context.Context, nameInRepository, tagName string) (string, error)
+}
+
+// TagDigest resolves the digest of given tag using a HEAD request
+func (client *registryClient) TagDigest(ctx context.Context, nameInRepository, tagName string) (_ string, err error) {
+	defer func() { err = client.classifyError(err) }()
+	resp, err := client.manifestRequest(ctx, http.MethodHead, nameInRepository, tagName)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", client.statusError(resp, "could not get digest for %s:%s", nameInRepository, tagName)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry did not return a digest for %s:%s", nameInRepository, tagName)
+	}
+	// The media type of the manifest comes with the digest, so looking it up
+	// by the digest needs no further request
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && isManifestMediaType(mediaType) && client.endpoint != nil {
+		client.endpoint.setDigestResult(mediaTypeLookup, digest, mediaType)
+	}
+	return digest, nil
+}
+
+// ManifestForDigest returns the manifest with the given digest in given
+// repository. The manifest's content is verified against the digest, so the
+// returned manifest is exactly the one the digest references. OCI image
+// manifests are returned as V2 manifests.
+func (client *registryClient) ManifestForDigest(ctx context.Context, repository string, digest string) (_ distribution.Manifest, err error) {
+	defer func() { err = client.classifyError(err); client.recordCall("manifest_digest", err) }()
+	resp, err := client.manifestRequest(ctx, http.MethodGet, repository, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, client.statusError(resp, "could not get manifest %s@%s", repository, digest)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyDigest(digest, body); err != nil {
+		return nil, err
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("registry returned invalid media type for %s@%s: %v", repository, digest, err)
+	}
+	return parseManifest(mediaType, body)
+}
+
+// verifyDigest returns an error if the digest of content does not match the
+// given digest
+func verifyDigest(digest string, content []byte) error {
+	var sum []byte
+	algorithm := strings.SplitN(digest, ":", 2)[0]
+	switch algorithm {
+	case "sha256":
+		s := sha256.Sum256(content)
+		sum = s[:]
+	case "sha512":
+		s := sha512.Sum512(content)
+		sum = s[:]
+	default:
+		return fmt.Errorf("unsupported digest algorithm in %s", digest)
+	}
+	if algorithm+":"+hex.EncodeToString(sum) != digest {
+		return fmt.Errorf("content does not match digest %s", digest)
+	}
+	return nil
+}
+
+// payloadDigest returns the SHA-256 digest of the manifest's payload, or the
+// empty string if it cannot be determined
+func payloadDigest(ml distribution.Manifest) string {
+	if ml == nil {
+		return ""
+	}
+	_, payload, err := ml.Payload()
+	if err != nil || len(payload) == 0 {
+		return ""
+	}
+	return contentDigest(payload)
+}
+
+// contentDigest returns the SHA-256 digest of content
+func contentDigest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// parseManifest parses a manifest of the given media type
+func parseManifest(mediaType string, body []byte) (distribution.Manifest, error) {
+	if mediaType == ociManifestMediaType {
+		return manifestFromOCI(body)
+	}
+	if isIndexMediaType(mediaType) {
+		return parseManifestList(body)
+	}
+	man, _, err := distribution.UnmarshalManifest(mediaType, body)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse manifest of type %s: %v", mediaType, err)
+	}
+	return man, nil
+}
+
+// ResolveTagDigest returns the tag with the given name of img along with the
+// digest it currently points to, so that the image can be referenced by its
+// immutable digest instead of the tag. The manifest is fetched by digest to
+// make sure that the image can be pulled using that reference.
+func (endpoint *RegistryEndpoint) ResolveTagDigest(ctx context.Context, img *image.ContainerImage, tagName string, regClient RegistryClient) (*tag.ImageTag, error) {
+	dc, ok := regClient.(DigestClient)
+	if !ok {
+		return nil, fmt.Errorf("registry client for %s cannot resolve digests", endpoint.RegistryAPI)
+	}
+	nameInRegistry := endpoint.nameInRegistry(img)
+	digest, err := dc.TagDigest(ctx, nameInRegistry, tagName)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve digest of %s:%s: %v", nameInRegistry, tagName, err)
+	}
+	if _, err := regClient.ManifestForDigest(ctx, nameInRegistry, digest); err != nil {
+		return nil, fmt.Errorf("could not get manifest of %s:%s by digest: %v", nameInRegistry, tagName, err)
+	}
+	imgTag := tag.NewImageTag(tagName, time.Unix(0, 0))
+	imgTag.TagDigest = digest
+	return imgTag, nil
+}
+
+// ResolveAlternative returns a copy of the given alternative to the tag
+// selected for img, along with the digest it currently points to and the date
+// its image has been created, so that it can be offered for rollback or manual
+// override. A digest or creation date that is already known for the tag is
+// kept. The creation date is looked up by the digest, so that it is only
+// resolved once for each image. A nil alternative is returned as it is.
+func (endpoint *RegistryEndpoint) ResolveAlternative(ctx context.Context, img *image.ContainerImage, alternative *tag.ImageTag, regClient RegistryClient) (*tag.ImageTag, error) {
+	if alternative == nil {
+		return nil, nil
+	}
+	resolved := alternative.DeepCopy()
+	nameInRegistry := endpoint.nameInRegistry(img)
+
+	if resolved.TagDigest == "" && resolved.TagInfo != nil {
+		resolved.TagDigest = resolved.TagInfo.Digest
+	}
+	if resolved.TagDigest == "" {
+		digest, err := endpoint.tagDigest(ctx, nameInRegistry, resolved.TagName, regClient)
+		if err != nil {
+			return nil, err
+		}
+		resolved.TagDigest = digest
+	}
+
+	if resolved.TagInfo != nil && !resolved.TagInfo.CreatedAt.IsZero() {
+		createdAt := resolved.TagInfo.CreatedAt
+		resolved.TagDate = &createdAt
+		return resolved, nil
+	}
+	created, ok := endpoint.getDigestResult("created", resolved.TagDigest)
+	if !ok {
+		ti, err := imageTagInfo(ctx, regClient, nameInRegistry, resolved.TagDigest)
+		if err != nil {
+			return nil, fmt.Errorf("could not get creation date of %s:%s: %v", nameInRegistry, resolved.TagName, err)
+		}
+		if ti.CreatedAt.IsZero() {
+			return nil, fmt.Errorf("image %s:%s has no creation date", nameInRegistry, resolved.TagName)
+		}
+		created = ti.CreatedAt.Format(time.RFC3339Nano)
+		endpoint.setDigestResult("created", resolved.TagDigest, created)
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, created)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse creation date of %s:%s: %v", nameInRegistry, resolved.TagName, err)
+	}
+	resolved.TagDate = &createdAt
+	return resolved, nil
+}
+
+// GetTagDigests resolves the digests of the given tags in the repository
+// concurrently and returns them as a map of tag names to digests. At most
+// the endpoint's maximum number of streams are in flight at the same time,
+// which are multiplexed over a single connection if the registry speaks
+// HTTP/2. Tags whose digest could not be resolved are not contained in the
+// returned map. Once ctx is done, no new requests are started.
+func (endpoint *RegistryEndpoint) GetTagDigests(ctx context.Context, nameInRepository string, tags []string, regClient RegistryClient) (map[string]string, error) {
+	dc, ok := regClient.(DigestClient)
+	if !ok {
+		return nil, fmt.Errorf("registry client for %s cannot resolve digests", endpoint.RegistryAPI)
+	}
+	return endpoint.resolveTags(ctx, nameInRepository, tags, "digest", dc.TagDigest), nil
+}
+
+// resolveTags calls resolve for each of the given tags concurrently, using at
+// most the endpoint's maximum number of streams, and returns the results as a
+// map of tag names to values. Tags that could not be resolved are logged, and
+// are not contained in the returned map. Once ctx is done, no new requests are
+// started.
+func (endpoint *RegistryEndpoint) resolveTags(ctx context.Context, nameInRepository string, tags []string, what string, resolve func(ctx context.Context, nameInRepository, tagName string) (string, error)) map[string]string {
+	values, _ := endpoint.resolveTagsWithErrors(ctx, nameInRepository, tags, what, resolve)
+	return values
+}
+
+// resolveTagsWithErrors resolves the given tags like resolveTags does, and
+// returns the errors of the tags that could not be resolved as well
+func (endpoint *RegistryEndpoint) resolveTagsWithErrors(ctx context.Context, nameInRepository string, tags []string, what string, resolve func(ctx context.Context, nameInRepository, tagName string) (string, error)) (map[string]string, map[string]error) {
+	maxStreams := endpoint.MaxStreams
+	if maxStreams <= 0 {
+		maxStreams = DefaultMaxStreams
+	}
+
+	values := make(map[string]string, len(tags))
+	errs := make(map[string]error)
+	valueLock := sync.Mutex{}
+	sem := semaphore.NewWeighted(int64(maxStreams))
+	var wg sync.WaitGroup
+	wg.Add(len(tags))
+	for _, tagName := range tags {
+		if err := sem.Acquire(ctx, 1); err != nil {
+			log.Debugf("could not acquire semaphore: %v", err)
+			wg.Done()
+			continue
+		}
+		go func(tagName string) {
+			defer func() {
+				sem.Release(1)
+				wg.Done()
+			}()
+			value, err := resolve(ctx, nameInRepository, tagName)
+			valueLock.Lock()
+			defer valueLock.Unlock()
+			if err != nil {
+				log.Warnf("could not resolve %s for %s:%s: %v", what, nameInRepository, tagName, err)
+				errs[tagName] = err
+				return
+			}
+			values[tagName] = value
+		}(tagName)
+	}
+	wg.Wait()
+
+	return values, errs
+}
+
+// ResolvePinnedTag returns the name of the tag among the given candidates that
+// points to the digest img is pinned to, or the empty string if there is none.
+// The candidates are resolved one after the other in alphabetical order, so
+// that the first of several matching tags is returned, and no more requests
+// are sent once a match is found. The tag that matched is remembered for the
+// digest, and tried first the next time.
+func (endpoint *RegistryEndpoint) ResolvePinnedTag(ctx context.Context, img *image.ContainerImage, candidates []string, regClient RegistryClient) string {
+	if !img.IsDigestPinned() {
+		return ""
+	}
+	if img.ImageTag.TagName != "" {
+		return img.ImageTag.TagName
+	}
+	dc, ok := regClient.(DigestClient)
+	if !ok {
+		log.Debugf("could not resolve tag for %s: registry client for %s cannot resolve digests", img.GetFullNameWithTag(), endpoint.RegistryAPI)
+		return ""
+	}
+	nameInRegistry := endpoint.nameInRegistry(img)
+	pinned := img.ImageTag.TagDigest
+	what := "pinned tag of " + nameInRegistry
+
+	sorted := make([]string, 0, len(candidates))
+	known := ""
+	if endpoint.usesCache(ctx) {
+		known, _ = endpoint.getDigestResult(what, pinned)
+	}
+	for _, t := range candidates {
+		if t != known {
+			sorted = append(sorted, t)
+		}
+	}
+	sort.Strings(sorted)
+	if len(sorted) < len(candidates) {
+		sorted = append([]string{known}, sorted...)
+	}
+
+	for _, t := range sorted {
+		if ctx.Err() != nil {
+			break
+		}
+		digest, err := dc.TagDigest(ctx, nameInRegistry, t)
+		if err != nil {
+			log.Debugf("could not resolve digest of %s:%s: %v", nameInRegistry, t, err)
+			continue
+		}
+		if digest == pinned {
+			if endpoint.usesCache(ctx) {
+				endpoint.setDigestResult(what, pinned, t)
+			}
+			return t
+		}
+	}
+	return ""
+}
+
+// HasSameDigest returns whether the candidate tag points to the same digest
+// as the image currently deployed as img, i.e. because the same image has been
+// tagged under another name.
+//
+// The deployed digest is the digest img is pinned to. If it is not pinned,
+// the digest recorded in the cache for its tag is used, which is the digest
+// the tag pointed to when it was resolved before, and not necessarily the one
+// it points to now. Only if none is recorded, the current digest of the tag
+// is resolved. Likewise, the digest the candidate is pinned to is used if it
+// has one. Digests are resolved with HEAD requests, and are recorded in the
+// cache. The recorded digests of immutable tags are used without asking the
+// registry.
+func (endpoint *RegistryEndpoint) HasSameDigest(ctx context.Context, img *image.ContainerImage, candidate *tag.ImageTag, regClient RegistryClient) (bool, error) {
+	if img.ImageTag == nil || (img.ImageTag.TagName == "" && img.ImageTag.TagDigest == "") {
+		return false, nil
+	}
+	nameInRegistry := endpoint.nameInRegistry(img)
+	current := img.ImageTag.TagDigest
+	if current == "" {
+		current = endpoint.tagCache(ctx).GetDigest(nameInRegistry, img.ImageTag.TagName)
+	}
+	if current == "" {
+		var err error
+		current, err = endpoint.tagDigest(ctx, nameInRegistry, img.ImageTag.TagName, regClient)
+		if err != nil {
+			return false, err
+		}
+	}
+	digest := candidate.TagDigest
+	if digest == "" {
+		var err error
+		digest, err = endpoint.tagDigest(ctx, nameInRegistry, candidate.TagName, regClient)
+		if err != nil {
+			return false, err
+		}
+	}
+	log.Tracef("deployed digest of %s is %s, digest of %s:%s is %s", img.GetFullNameWithTag(), current, nameInRegistry, candidate.TagName, digest)
+	return digest == current, nil
+}
+
+// tagDigest resolves the digest of the given tag and records it in the
+// cache. The recorded digest of an immutable tag is returned as it is.
+func (endpoint *RegistryEndpoint) tagDigest(ctx context.Context, nameInRegistry, tagName string, regClient RegistryClient) (string, error) {
+	if endpoint.IsTagImmutable(tagName) {
+		if digest := endpoint.tagCache(ctx).GetDigest(nameInRegistry, tagName); digest != "" {
+			return digest, nil
+		}
+	}
+	dc, ok := regClient.(DigestClient)
+	if !ok {
+		return "", fmt.Errorf("registry client for %s cannot resolve digests", endpoint.RegistryAPI)
+	}
+	digest, err := dc.TagDigest(ctx, nameInRegistry, tagName)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve digest of %s:%s: %v", nameInRegistry, tagName, err)
+	}
+	endpoint.tagCache(ctx).SetDigest(nameInRegistry, tagName, digest)
+	return digest, nil
+}
+
+// getTagsWithDigests returns a list of the given tags along with the digests
+// they point to. If the constraint names a tag, only that tag is resolved.
+// The digests are resolved with HEAD requests, so no manifests are pulled,
+// and each digest is recorded in the cache. If a digest cannot be resolved,
+// the digest recorded previously is used.
+func (endpoint *RegistryEndpoint) getTagsWithDigests(ctx context.Context, nameInRegistry string, tags []string, regClient RegistryClient, vc *image.VersionConstraint, excluded image.TagExclusions) (*tag.ImageTagList, error) {
+	if vc.Constraint != "" {
+		tracked := []string{}
+		for _, t := range tags {
+			if t == vc.Constraint {
+				tracked = append(tracked, t)
+			} else {
+				excluded.Exclude(t, "digest", "not the tracked tag %s", vc.Constraint)
+			}
+		}
+		tags = tracked
+	}
+
+	digests, err := endpoint.GetTagDigests(ctx, nameInRegistry, tags, regClient)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	tagList := tag.NewImageTagList()
+	for _, t := range tags {
+		previous := endpoint.tagCache(ctx).GetDigest(nameInRegistry, t)
+		digest, ok := digests[t]
+		if !ok {
+			if previous == "" {
+				excluded.Exclude(t, "digest", "could not resolve digest")
+				continue
+			}
+			log.Warnf("could not resolve digest of %s:%s, using last known digest %s", nameInRegistry, t, previous)
+			digest = previous
+		} else if digest != previous && !endpoint.IsTagImmutable(t) {
+			if previous != "" {
+				log.Infof("digest of %s:%s changed from %s to %s", nameInRegistry, t, previous, digest)
+			}
+			endpoint.tagCache(ctx).SetDigest(nameInRegistry, t, digest)
+		}
+		imgTag := tag.NewImageTag(t, time.Unix(0, 0))
+		imgTag.TagDigest = digest
+		tagList.Add(imgTag)
+	}
+	return tagList, nil
+}
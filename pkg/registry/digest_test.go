@@ -0,0 +1,439 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/nokia/docker-registry-client/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/cache"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/mocks"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+// digestRegistryClient is a RegistryClient that resolves digests from a map
+// and keeps track of the maximum number of concurrent requests.
+type digestRegistryClient struct {
+	mocks.RegistryClient
+	digests  map[string]string
+	inFlight int32
+	maxSeen  int32
+	lock     sync.Mutex
+	// requested holds the tags whose digest has been requested, in order
+	requested []string
+}
+
+func (c *digestRegistryClient) TagDigest(ctx context.Context, nameInRepository, tagName string) (string, error) {
+	n := atomic.AddInt32(&c.inFlight, 1)
+	defer atomic.AddInt32(&c.inFlight, -1)
+	c.lock.Lock()
+	if n > c.maxSeen {
+		c.maxSeen = n
+	}
+	c.requested = append(c.requested, tagName)
+	c.lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	if digest, ok := c.digests[tagName]; ok {
+		return digest, nil
+	}
+	return "", fmt.Errorf("not found")
+}
+
+func Test_TagDigest(t *testing.T) {
+	t.Run("Resolve digest with HEAD request", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodHead, r.Method)
+			assert.Equal(t, "/v2/foo/bar/manifests/1.0", r.URL.Path)
+			assert.Contains(t, r.Header.Get("Accept"), "application/vnd.docker.distribution.manifest.list.v2+json")
+			w.Header().Set("Docker-Content-Digest", "sha256:abcdef")
+		}))
+		defer srv.Close()
+		client := &registryClient{regClient: &registry.Registry{URL: srv.URL, Client: srv.Client()}}
+		digest, err := client.TagDigest(context.Background(), "foo/bar", "1.0")
+		require.NoError(t, err)
+		assert.Equal(t, "sha256:abcdef", digest)
+	})
+	t.Run("Missing tag", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer srv.Close()
+		client := &registryClient{regClient: &registry.Registry{URL: srv.URL, Client: srv.Client()}}
+		_, err := client.TagDigest(context.Background(), "foo/bar", "1.0")
+		assert.Error(t, err)
+	})
+}
+
+func Test_ManifestAcceptNegotiation(t *testing.T) {
+	t.Run("Narrow media types after 406 and remember them", func(t *testing.T) {
+		var requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			if strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.") {
+				w.WriteHeader(http.StatusNotAcceptable)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", "sha256:abcdef")
+		}))
+		defer srv.Close()
+		ep := &RegistryEndpoint{RegistryAPI: srv.URL}
+		client := &registryClient{regClient: &registry.Registry{URL: srv.URL, Client: srv.Client()}, endpoint: ep}
+
+		digest, err := client.TagDigest(context.Background(), "foo/bar", "1.0")
+		require.NoError(t, err)
+		assert.Equal(t, "sha256:abcdef", digest)
+		assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+		assert.NotContains(t, ep.acceptTypes, "application/vnd.oci.image.index.v1+json")
+		assert.NotContains(t, ep.acceptTypes, "application/vnd.oci.image.manifest.v1+json")
+		assert.Contains(t, ep.acceptTypes, "application/vnd.docker.distribution.manifest.list.v2+json")
+
+		// The negotiated types are used right away on subsequent requests
+		_, err = client.TagDigest(context.Background(), "foo/bar", "1.1")
+		require.NoError(t, err)
+		assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("Negotiate media types when fetching V2 manifests", func(t *testing.T) {
+		var requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			if strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.") {
+				w.WriteHeader(http.StatusNotAcceptable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			fmt.Fprint(w, `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"mediaType":"application/vnd.docker.container.image.v1+json","digest":"sha256:cfg","size":1},"layers":[]}`)
+		}))
+		defer srv.Close()
+		ep := &RegistryEndpoint{RegistryAPI: srv.URL}
+		client := &registryClient{regClient: &registry.Registry{URL: srv.URL, Client: srv.Client()}, endpoint: ep}
+
+		man, err := client.ManifestV2(context.Background(), "foo/bar", "1.0")
+		require.NoError(t, err)
+		assert.Equal(t, "sha256:cfg", man.Config.Digest.String())
+		assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+		assert.NotContains(t, ep.acceptTypes, "application/vnd.oci.image.manifest.v1+json")
+
+		// V1 manifests are fetched with the negotiated types as well, and a
+		// V2 manifest is not taken for one
+		_, err = client.ManifestV1(context.Background(), "foo/bar", "1.0")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not a V1 manifest")
+		assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("Give up when no more types can be dropped", func(t *testing.T) {
+		var requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(http.StatusNotAcceptable)
+		}))
+		defer srv.Close()
+		ep := &RegistryEndpoint{RegistryAPI: srv.URL}
+		client := &registryClient{regClient: &registry.Registry{URL: srv.URL, Client: srv.Client()}, endpoint: ep}
+
+		_, err := client.TagDigest(context.Background(), "foo/bar", "1.0")
+		assert.Error(t, err)
+		assert.Equal(t, int32(len(negotiableMediaTypes)+1), atomic.LoadInt32(&requests))
+		assert.Nil(t, ep.acceptTypes)
+	})
+}
+
+func Test_ManifestForDigest(t *testing.T) {
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"mediaType":"application/vnd.docker.container.image.v1+json","digest":"sha256:cfg","size":1},"layers":[]}`
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/foo/bar/manifests/" + digest, "/v2/foo/bar/manifests/sha256:other":
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			fmt.Fprint(w, manifest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	client := &registryClient{regClient: &registry.Registry{URL: srv.URL, Client: srv.Client()}}
+
+	t.Run("Get manifest by digest", func(t *testing.T) {
+		ml, err := client.ManifestForDigest(context.Background(), "foo/bar", digest)
+		require.NoError(t, err)
+		man, ok := ml.(*schema2.DeserializedManifest)
+		require.True(t, ok)
+		assert.Equal(t, "sha256:cfg", man.Config.Digest.String())
+	})
+	t.Run("Content does not match digest", func(t *testing.T) {
+		_, err := client.ManifestForDigest(context.Background(), "foo/bar", "sha256:other")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "does not match digest")
+	})
+	t.Run("Manifest does not exist", func(t *testing.T) {
+		_, err := client.ManifestForDigest(context.Background(), "foo/bar", "sha256:missing")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "404")
+	})
+}
+
+func Test_ResolveTagDigest(t *testing.T) {
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+	ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+
+	t.Run("Resolve tag to digest", func(t *testing.T) {
+		regClient := &digestRegistryClient{digests: map[string]string{"1.0": "sha256:abc"}}
+		regClient.On("ManifestForDigest", mock.Anything, "foo/bar", "sha256:abc").Return(&schema2.DeserializedManifest{}, nil)
+		imgTag, err := ep.ResolveTagDigest(context.Background(), img, "1.0", regClient)
+		require.NoError(t, err)
+		assert.Equal(t, "1.0", imgTag.TagName)
+		assert.Equal(t, "sha256:abc", imgTag.TagDigest)
+		assert.Equal(t, "1.0@sha256:abc", imgTag.TagWithDigest())
+	})
+	t.Run("Manifest cannot be fetched by digest", func(t *testing.T) {
+		regClient := &digestRegistryClient{digests: map[string]string{"1.0": "sha256:abc"}}
+		regClient.On("ManifestForDigest", mock.Anything, "foo/bar", "sha256:abc").Return(nil, fmt.Errorf("not found"))
+		imgTag, err := ep.ResolveTagDigest(context.Background(), img, "1.0", regClient)
+		require.Error(t, err)
+		assert.Nil(t, imgTag)
+	})
+	t.Run("Tag does not exist", func(t *testing.T) {
+		regClient := &digestRegistryClient{digests: map[string]string{}}
+		_, err := ep.ResolveTagDigest(context.Background(), img, "1.0", regClient)
+		require.Error(t, err)
+		regClient.AssertNotCalled(t, "ManifestForDigest", mock.Anything, mock.Anything, mock.Anything)
+	})
+	t.Run("Client cannot resolve digests", func(t *testing.T) {
+		_, err := ep.ResolveTagDigest(context.Background(), img, "1.0", &mocks.RegistryClient{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "cannot resolve digests")
+	})
+}
+
+func Test_ResolveAlternative(t *testing.T) {
+	or := newOCIRegistry()
+	created := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	digest := or.addImage("1.0", created, ociManifestMediaType)
+	srv := httptest.NewServer(or)
+	defer srv.Close()
+	ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+	client, err := NewClient(ep, "", "")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("example.com/foo/bar:1.1")
+
+	t.Run("Resolve digest and creation date", func(t *testing.T) {
+		alternative := tag.NewImageTag("1.0", time.Unix(0, 0))
+		resolved, err := ep.ResolveAlternative(context.Background(), img, alternative, client)
+		require.NoError(t, err)
+		assert.Equal(t, "1.0", resolved.TagName)
+		assert.Equal(t, digest, resolved.TagDigest)
+		assert.True(t, created.Equal(*resolved.TagDate))
+		assert.Equal(t, "", alternative.TagDigest)
+	})
+
+	t.Run("Creation date is known by digest", func(t *testing.T) {
+		blobs := or.blobs
+		or.blobs = map[string][]byte{}
+		defer func() { or.blobs = blobs }()
+		resolved, err := ep.ResolveAlternative(context.Background(), img, tag.NewImageTag("1.0", time.Unix(0, 0)), client)
+		require.NoError(t, err)
+		assert.True(t, created.Equal(*resolved.TagDate))
+	})
+
+	t.Run("Known meta data is kept", func(t *testing.T) {
+		alternative := tag.NewImageTag("1.0", time.Unix(0, 0))
+		alternative.TagInfo = &tag.TagInfo{CreatedAt: created.Add(time.Hour), Digest: "sha256:known"}
+		resolved, err := ep.ResolveAlternative(context.Background(), img, alternative, client)
+		require.NoError(t, err)
+		assert.Equal(t, "sha256:known", resolved.TagDigest)
+		assert.True(t, created.Add(time.Hour).Equal(*resolved.TagDate))
+	})
+
+	t.Run("No alternative", func(t *testing.T) {
+		resolved, err := ep.ResolveAlternative(context.Background(), img, nil, client)
+		require.NoError(t, err)
+		assert.Nil(t, resolved)
+	})
+
+	t.Run("Alternative does not exist", func(t *testing.T) {
+		_, err := ep.ResolveAlternative(context.Background(), img, tag.NewImageTag("missing", time.Unix(0, 0)), client)
+		assert.Error(t, err)
+	})
+}
+
+func Test_GetTagDigests(t *testing.T) {
+	t.Run("Resolve digests concurrently", func(t *testing.T) {
+		regClient := &digestRegistryClient{digests: map[string]string{}}
+		tags := []string{}
+		for i := 0; i < 20; i++ {
+			tagName := fmt.Sprintf("1.0.%d", i)
+			tags = append(tags, tagName)
+			regClient.digests[tagName] = "sha256:" + tagName
+		}
+		tags = append(tags, "missing")
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", MaxStreams: 4}
+		digests, err := ep.GetTagDigests(context.Background(), "foo/bar", tags, regClient)
+		require.NoError(t, err)
+		assert.Len(t, digests, 20)
+		assert.Equal(t, "sha256:1.0.7", digests["1.0.7"])
+		assert.LessOrEqual(t, regClient.maxSeen, int32(4))
+		assert.Greater(t, regClient.maxSeen, int32(1))
+	})
+	t.Run("Client without digest support", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com"}
+		_, err := ep.GetTagDigests(context.Background(), "foo/bar", []string{"1.0"}, &mocks.RegistryClient{})
+		assert.Error(t, err)
+	})
+}
+
+func Test_ResolvePinnedTag(t *testing.T) {
+	regClient := &digestRegistryClient{digests: map[string]string{
+		"1.0.0": "sha256:aaa",
+		"1.1.0": "sha256:bbb",
+	}}
+	ep := &RegistryEndpoint{RegistryAPI: "https://example.com"}
+
+	t.Run("Resolve tag of pinned digest", func(t *testing.T) {
+		img := image.NewFromIdentifier("example.com/foo/bar@sha256:bbb")
+		assert.Equal(t, "1.1.0", ep.ResolvePinnedTag(context.Background(), img, []string{"1.0.0", "1.1.0"}, regClient))
+	})
+	t.Run("Digest not pointed to by any tag", func(t *testing.T) {
+		img := image.NewFromIdentifier("example.com/foo/bar@sha256:ccc")
+		assert.Equal(t, "", ep.ResolvePinnedTag(context.Background(), img, []string{"1.0.0", "1.1.0"}, regClient))
+	})
+	t.Run("Tag given along with digest", func(t *testing.T) {
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0.0@sha256:bbb")
+		assert.Equal(t, "1.0.0", ep.ResolvePinnedTag(context.Background(), img, []string{"1.0.0", "1.1.0"}, regClient))
+	})
+	t.Run("Image not pinned", func(t *testing.T) {
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0.0")
+		assert.Equal(t, "", ep.ResolvePinnedTag(context.Background(), img, []string{"1.0.0", "1.1.0"}, regClient))
+	})
+	t.Run("First matching tag in alphabetical order", func(t *testing.T) {
+		regClient := &digestRegistryClient{digests: map[string]string{
+			"1.0.0":  "sha256:aaa",
+			"1.1.0":  "sha256:bbb",
+			"latest": "sha256:bbb",
+			"stable": "sha256:bbb",
+		}}
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com"}
+		img := image.NewFromIdentifier("example.com/foo/bar@sha256:bbb")
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, "1.1.0", ep.ResolvePinnedTag(context.Background(), img, []string{"stable", "latest", "1.1.0", "1.0.0"}, regClient))
+		}
+		// Only the remembered tag is resolved again
+		assert.Equal(t, []string{"1.0.0", "1.1.0", "1.1.0", "1.1.0", "1.1.0", "1.1.0"}, regClient.requested)
+	})
+}
+
+func Test_GetTagsWithDigests(t *testing.T) {
+	t.Run("Resolve digest of tracked tag", func(t *testing.T) {
+		regClient := &digestRegistryClient{digests: map[string]string{"stable": "sha256:aaa", "latest": "sha256:bbb"}}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"stable", "latest"}, nil)
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+		img := image.NewFromIdentifier("example.com/foo/bar:stable")
+		vc := &image.VersionConstraint{Constraint: "stable", SortMode: image.VersionSortDigest}
+
+		tl, err := ep.GetTags(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"stable"}, tl.Tags())
+		assert.Equal(t, "sha256:aaa", tl.Get("stable").TagDigest)
+		assert.Equal(t, "sha256:aaa", ep.Cache.GetDigest("foo/bar", "stable"))
+		regClient.AssertNotCalled(t, "ManifestV2", mock.Anything, mock.Anything, mock.Anything)
+
+		regClient.digests["stable"] = "sha256:ccc"
+		tl, err = ep.GetTags(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		assert.Equal(t, "sha256:ccc", tl.Get("stable").TagDigest)
+		assert.Equal(t, "sha256:ccc", ep.Cache.GetDigest("foo/bar", "stable"))
+	})
+
+	t.Run("Use last known digest if resolving fails", func(t *testing.T) {
+		regClient := &digestRegistryClient{digests: map[string]string{}}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"stable", "other"}, nil)
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+		ep.Cache.SetDigest("foo/bar", "stable", "sha256:aaa")
+		img := image.NewFromIdentifier("example.com/foo/bar:stable")
+		vc := &image.VersionConstraint{SortMode: image.VersionSortDigest}
+
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"stable"}, tl.Tags())
+		assert.Equal(t, "sha256:aaa", tl.Get("stable").TagDigest)
+		assert.Equal(t, "digest: could not resolve digest", excluded["other"])
+	})
+}
+
+func Test_HasSameDigest(t *testing.T) {
+	regClient := &digestRegistryClient{digests: map[string]string{
+		"rc":     "sha256:aaa",
+		"stable": "sha256:aaa",
+		"1.1.0":  "sha256:bbb",
+	}}
+	img := image.NewFromIdentifier("example.com/foo/bar:rc")
+
+	t.Run("Tags pointing to same digest", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+		same, err := ep.HasSameDigest(context.Background(), img, tag.NewImageTag("stable", time.Unix(0, 0)), regClient)
+		require.NoError(t, err)
+		assert.True(t, same)
+		assert.Equal(t, "sha256:aaa", ep.Cache.GetDigest("foo/bar", "rc"))
+		assert.Equal(t, "sha256:aaa", ep.Cache.GetDigest("foo/bar", "stable"))
+	})
+	t.Run("Tags pointing to different digests", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+		same, err := ep.HasSameDigest(context.Background(), img, tag.NewImageTag("1.1.0", time.Unix(0, 0)), regClient)
+		require.NoError(t, err)
+		assert.False(t, same)
+	})
+	t.Run("Recorded digest of immutable tag is used", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache(), ImmutableTags: []string{"1.*"}}
+		ep.Cache.SetDigest("foo/bar", "1.2.0", "sha256:aaa")
+		same, err := ep.HasSameDigest(context.Background(), img, tag.NewImageTag("1.2.0", time.Unix(0, 0)), regClient)
+		require.NoError(t, err)
+		assert.True(t, same)
+	})
+	t.Run("Pinned digest of deployed image is used", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+		pinned := image.NewFromIdentifier("example.com/foo/bar:rc@sha256:bbb")
+		same, err := ep.HasSameDigest(context.Background(), pinned, tag.NewImageTag("1.1.0", time.Unix(0, 0)), regClient)
+		require.NoError(t, err)
+		assert.True(t, same)
+		assert.Empty(t, ep.Cache.GetDigest("foo/bar", "rc"))
+	})
+	t.Run("Recorded digest of deployed tag is used", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+		ep.Cache.SetDigest("foo/bar", "rc", "sha256:bbb")
+		same, err := ep.HasSameDigest(context.Background(), img, tag.NewImageTag("1.1.0", time.Unix(0, 0)), regClient)
+		require.NoError(t, err)
+		assert.True(t, same)
+		assert.Equal(t, "sha256:bbb", ep.Cache.GetDigest("foo/bar", "rc"))
+	})
+	t.Run("Pinned digest of candidate is used", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+		candidate := tag.NewImageTag("missing", time.Unix(0, 0))
+		candidate.TagDigest = "sha256:aaa"
+		same, err := ep.HasSameDigest(context.Background(), img, candidate, regClient)
+		require.NoError(t, err)
+		assert.True(t, same)
+	})
+	t.Run("Digest cannot be resolved", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+		_, err := ep.HasSameDigest(context.Background(), img, tag.NewImageTag("missing", time.Unix(0, 0)), regClient)
+		assert.Error(t, err)
+	})
+	t.Run("Client without digest support", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+		_, err := ep.HasSameDigest(context.Background(), img, tag.NewImageTag("stable", time.Unix(0, 0)), &mocks.RegistryClient{})
+		assert.Error(t, err)
+	})
+}
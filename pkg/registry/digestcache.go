@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"context"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// Maximum number of lookups by digest an endpoint keeps the results of
+const maxDigestResults = 10000
+
+// digestResult is the result of looking up a property of the manifest with a
+// given digest, i.e. the media type of its config. Since a digest always
+// refers to the same content, the result never changes.
+type digestResult struct {
+	value string
+	used  time.Time
+}
+
+// getDigestResult returns the result of looking up what for the manifest with
+// the given digest, if it is known
+func (endpoint *RegistryEndpoint) getDigestResult(what, digest string) (string, bool) {
+	endpoint.digestLock.Lock()
+	defer endpoint.digestLock.Unlock()
+	r, ok := endpoint.digestResults[what+"|"+digest]
+	if !ok {
+		return "", false
+	}
+	r.used = time.Now()
+	return r.value, true
+}
+
+// setDigestResult records the result of looking up what for the manifest with
+// the given digest. If the endpoint already keeps maxDigestResults results,
+// the least recently used one is evicted.
+func (endpoint *RegistryEndpoint) setDigestResult(what, digest, value string) {
+	endpoint.digestLock.Lock()
+	defer endpoint.digestLock.Unlock()
+	if endpoint.digestResults == nil {
+		endpoint.digestResults = make(map[string]*digestResult)
+	}
+	key := what + "|" + digest
+	if _, ok := endpoint.digestResults[key]; !ok && len(endpoint.digestResults) >= maxDigestResults {
+		oldest := ""
+		for k, r := range endpoint.digestResults {
+			if oldest == "" || r.used.Before(endpoint.digestResults[oldest].used) {
+				oldest = k
+			}
+		}
+		delete(endpoint.digestResults, oldest)
+	}
+	endpoint.digestResults[key] = &digestResult{value: value, used: time.Now()}
+}
+
+// resolveTagsByDigest resolves the given tags like resolveTagsWithErrors
+// does, but looks up what by the digest each tag points to. The digests are
+// resolved with HEAD requests, and resolve is only called with the digests
+// whose result is not known yet, instead of the tag. If the registry client
+// cannot resolve digests, or the cache is bypassed for the scan, resolve is
+// called with the tags instead.
+func (endpoint *RegistryEndpoint) resolveTagsByDigest(ctx context.Context, nameInRepository string, tags []string, what string, regClient RegistryClient, resolve func(ctx context.Context, nameInRepository, reference string) (string, error)) (map[string]string, map[string]error) {
+	dc, ok := regClient.(DigestClient)
+	if !ok || !endpoint.usesCache(ctx) {
+		return endpoint.resolveTagsWithErrors(ctx, nameInRepository, tags, what, resolve)
+	}
+	return endpoint.resolveTagsWithErrors(ctx, nameInRepository, tags, what, func(ctx context.Context, nameInRepository, tagName string) (string, error) {
+		digest, err := dc.TagDigest(ctx, nameInRepository, tagName)
+		if err != nil {
+			return "", err
+		}
+		if value, ok := endpoint.getDigestResult(what, digest); ok {
+			log.Tracef("Using known %s of %s:%s (%s)", what, nameInRepository, tagName, digest)
+			return value, nil
+		}
+		value, err := resolve(ctx, nameInRepository, digest)
+		if err != nil {
+			return "", err
+		}
+		endpoint.setDigestResult(what, digest, value)
+		return value, nil
+	})
+}
+
+// filterTagsByDigest resolves what for the given tags by the digests they
+// point to, like resolveTagsByDigest does, for a filter of the given kind.
+// Tags that could not be resolved are removed from the list and recorded in
+// excluded with the error, and their number is logged. The resolved values
+// are returned along with the remaining tags.
+func (endpoint *RegistryEndpoint) filterTagsByDigest(ctx context.Context, nameInRegistry string, tags []string, what, filter string, regClient RegistryClient, excluded image.TagExclusions, resolve func(ctx context.Context, nameInRepository, reference string) (string, error)) ([]string, map[string]string) {
+	values, errs := endpoint.resolveTagsByDigest(ctx, nameInRegistry, tags, what, regClient, resolve)
+	if len(errs) > 0 {
+		log.Warnf("could not determine %s of %d of %d tags of %s, these tags are not considered", what, len(errs), len(tags), nameInRegistry)
+	}
+	resolved := make([]string, 0, len(values))
+	for _, t := range tags {
+		if _, ok := values[t]; ok {
+			resolved = append(resolved, t)
+		} else if err, failed := errs[t]; failed {
+			excluded.Exclude(t, filter, "could not determine %s: %v", what, err)
+		} else {
+			excluded.Exclude(t, filter, "could not determine %s", what)
+		}
+	}
+	return resolved, values
+}
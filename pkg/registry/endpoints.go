@@ -1,14 +1,20 @@
 package registry
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"math"
+	"net/http"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/argoproj-labs/argocd-image-updater/pkg/cache"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/version"
 
 	"go.uber.org/ratelimit"
 )
@@ -27,6 +33,9 @@ const (
 	RateLimitDefault = 10
 )
 
+// Default number of requests that will be issued concurrently to an endpoint
+const DefaultMaxStreams = 20
+
 // IsTimeSorted returns whether a tag list is time sorted
 func (tls TagListSort) IsTimeSorted() bool {
 	return tls == SortLatestFirst || tls == SortLatestLast
@@ -61,10 +70,88 @@ type RegistryEndpoint struct {
 	DefaultNS      string
 	CredsExpire    time.Duration
 	CredsUpdated   time.Time
-	TagListSort    TagListSort
-	Cache          cache.ImageTagCache
-	Limiter        ratelimit.Limiter
-	lock           sync.RWMutex
+	CredsRefresh   time.Duration
+	MaxStreams     int
+	// maximum number of tags whose meta data is fetched concurrently
+	MetadataConcurrency int
+	Singleflight        bool
+	ImmutableTags       []string
+	WriteBackPrefix     string
+	HostAliases         map[string]string
+	AllowedMediaTypes   []string
+	NegativeCacheTTL    time.Duration
+	DisableCache        bool
+	RateLimitRetries    int
+	RateLimitMaxBackoff time.Duration
+	CircuitThreshold    int
+	CircuitCooldown     time.Duration
+	TLSCAFile           string
+	TLSCertFile         string
+	TLSKeyFile          string
+	TLSCredentials      string
+	Proxy               string
+	FallbackCredentials []string
+	MinInterval         time.Duration
+	Jitter              time.Duration
+	Headers             map[string]string
+	CredentialsFrom     string
+	Default             bool
+	Timeout             time.Duration
+	UserAgent           string
+	RequestID           bool
+	ArtifactType        ArtifactType
+	CreatedFrom         []CreatedSource
+	TagList             TagListStrategy
+	TagListSort         TagListSort
+	AuthHost            string
+	Flavor              RegistryFlavor
+	Cache               cache.ImageTagCache
+	Limiter             ratelimit.Limiter
+	lock                sync.RWMutex
+	order               int
+	transportLock       sync.Mutex
+	transport           *http.Transport
+	// whether anonymous access has been chosen from the fallback credentials
+	credsAnonymous bool
+	// time at which credentials that are known to expire are refreshed, zero
+	// if the credentials do not expire by themselves
+	credsExpiresAt time.Time
+	// values of the static headers, once resolved from their sources, and
+	// when they were resolved
+	headers         http.Header
+	headersResolved time.Time
+	// tags that resulted from tag lists with a known ETag, by image and
+	// constraint, protected by resultLock
+	resultLock sync.Mutex
+	tagResults map[string]*tagResult
+	// manifest media types the registry has accepted, once negotiated
+	acceptTypes []string
+	// state of the tag count and immutable tag checks for scans that bypass
+	// the cache, created on first use, protected by lock
+	uncachedState cache.ImageTagCache
+	// results of verifying signatures, by policy and image digest,
+	// protected by signatureLock
+	signatureLock    sync.Mutex
+	signatureResults map[string]*signatureResult
+	// results of looking up properties of manifests, by property and digest,
+	// protected by digestLock
+	digestLock    sync.Mutex
+	digestResults map[string]*digestResult
+	// auth challenge last sent by the registry, protected by challengeLock
+	challengeLock sync.Mutex
+	lastChallenge *AuthChallenge
+	// client certificate and CA certificate loaded from the secret given by
+	// TLSCredentials, protected by transportLock
+	tlsCert    *tls.Certificate
+	tlsCertPEM []byte
+	tlsCAPEM   []byte
+	tlsUpdated time.Time
+	// circuit breaker, created on first use if CircuitThreshold is set
+	breakerLock sync.Mutex
+	breaker     *circuitBreaker
+	// tags that last resulted by image, constraint and credentials, returned
+	// while the circuit is open, protected by resultLock
+	lastResults map[string]*tagResult
 }
 
 // Map of configured registries, pre-filled with some well-known registries
@@ -76,6 +163,7 @@ var defaultRegistries map[string]*RegistryEndpoint = map[string]*RegistryEndpoin
 		Ping:           true,
 		Insecure:       false,
 		DefaultNS:      "library",
+		Flavor:         FlavorDockerHub,
 		Cache:          cache.NewMemCache(),
 		Limiter:        ratelimit.New(RateLimitDefault),
 	},
@@ -119,45 +207,464 @@ var defaultRegistries map[string]*RegistryEndpoint = map[string]*RegistryEndpoin
 
 var registries map[string]*RegistryEndpoint = make(map[string]*RegistryEndpoint)
 
+// CacheFactory creates the tag cache for the registry endpoint with the given
+// prefix
+type CacheFactory func(registryPrefix string) cache.ImageTagCache
+
+// Factory for the tag caches of registry endpoints, protected by cacheLock
+var newCache CacheFactory = func(string) cache.ImageTagCache {
+	return cache.NewMemCache()
+}
+var cacheLock sync.RWMutex
+
 // Simple RW mutex for concurrent access to registries map
 var registryLock sync.RWMutex
 
+// Sequence number for keeping track of the order in which endpoints have been
+// added, protected by registryLock
+var registrySeq int
+
+// Whether ambiguous prefix matches should result in an error
+var strictPrefixMatch bool
+
+// Timeout of requests to endpoints that have no timeout configured, protected
+// by registryLock
+var defaultTimeout time.Duration
+
+// User agent sent to endpoints that have none configured, and whether
+// requests to all endpoints carry a request ID, protected by registryLock
+var (
+	defaultUserAgent = DefaultUserAgent()
+	defaultRequestID bool
+)
+
+// Ordered list of registry prefixes to search for unqualified image names,
+// protected by registryLock
+var searchRegistries []string
+
+// Search registries that unqualified images have been resolved to, by image
+// name, protected by registryLock
+var searchResolutions = make(map[string]searchResolution)
+
+// AddRegistryEndpointFromConfig adds a registry endpoint from the given
+// registry configuration item
 func AddRegistryEndpointFromConfig(epc RegistryConfiguration) error {
-	return AddRegistryEndpoint(epc.Prefix, epc.Name, epc.ApiURL, epc.Credentials, epc.DefaultNS, epc.Insecure, TagListSortFromString(epc.TagSortMode), epc.Limit, epc.CredsExpire)
+	ep := newRegistryEndpoint(epc.Prefix, epc.Name, epc.ApiURL, epc.Credentials, epc.DefaultNS, epc.Insecure, TagListSortFromString(epc.TagSortMode), epc.Limit, epc.CredsExpire)
+	ep.AuthHost = epc.AuthHost
+	ep.Flavor = RegistryFlavorFromString(epc.Flavor)
+	ep.CredsRefresh = epc.CredsRefresh
+	ep.MaxStreams = epc.MaxStreams
+	ep.MetadataConcurrency = epc.MetadataConcurrency
+	ep.Singleflight = epc.Singleflight
+	ep.ImmutableTags = epc.ImmutableTags
+	ep.WriteBackPrefix = strings.TrimSuffix(epc.WriteBackPrefix, "/")
+	ep.AllowedMediaTypes = epc.AllowedMediaTypes
+	ep.NegativeCacheTTL = epc.NegativeCacheTTL
+	ep.DisableCache = epc.Cache != nil && !*epc.Cache
+	ep.RateLimitRetries = epc.RateLimitRetries
+	ep.RateLimitMaxBackoff = epc.RateLimitMaxBackoff
+	ep.CircuitThreshold = epc.CircuitThreshold
+	ep.CircuitCooldown = epc.CircuitCooldown
+	ep.TLSCAFile = epc.TLSCAFile
+	ep.TLSCertFile = epc.TLSCertFile
+	ep.TLSKeyFile = epc.TLSKeyFile
+	ep.TLSCredentials = epc.TLSCredentials
+	ep.Proxy = epc.Proxy
+	ep.FallbackCredentials = epc.FallbackCredentials
+	ep.MinInterval = epc.MinInterval
+	ep.Jitter = epc.Jitter
+	ep.Headers = epc.Headers
+	ep.CredentialsFrom = epc.CredentialsFrom
+	ep.Default = epc.Default
+	ep.Timeout = epc.Timeout
+	ep.UserAgent = epc.UserAgent
+	ep.RequestID = epc.RequestID
+	ep.ArtifactType = ArtifactTypeFromString(epc.ArtifactType)
+	createdFrom, err := ParseCreatedSources(epc.CreatedFrom)
+	if err != nil {
+		return fmt.Errorf("invalid createdfrom for registry %s: %v", epc.Name, err)
+	}
+	ep.CreatedFrom = createdFrom
+	tagList, err := ParseTagListStrategy(epc.TagList)
+	if err != nil {
+		return fmt.Errorf("invalid tag_list for registry %s: %v", epc.Name, err)
+	}
+	ep.TagList = tagList
+	if len(epc.HostAliases) > 0 {
+		ep.HostAliases = make(map[string]string, len(epc.HostAliases))
+		for host, ip := range epc.HostAliases {
+			ep.HostAliases[strings.ToLower(host)] = ip
+		}
+	}
+	return addRegistryEndpoint(ep)
 }
 
 // AddRegistryEndpoint adds registry endpoint information with the given details
 func AddRegistryEndpoint(prefix, name, apiUrl, credentials, defaultNS string, insecure bool, tagListSort TagListSort, limit int, credsExpire time.Duration) error {
-	registryLock.Lock()
-	defer registryLock.Unlock()
+	return addRegistryEndpoint(newRegistryEndpoint(prefix, name, apiUrl, credentials, defaultNS, insecure, tagListSort, limit, credsExpire))
+}
+
+// newRegistryEndpoint creates a new RegistryEndpoint with the given details
+func newRegistryEndpoint(prefix, name, apiUrl, credentials, defaultNS string, insecure bool, tagListSort TagListSort, limit int, credsExpire time.Duration) *RegistryEndpoint {
 	if limit <= 0 {
 		limit = RateLimitNone
 	}
 	log.Debugf("rate limit for %s is %d", apiUrl, limit)
-	registries[prefix] = &RegistryEndpoint{
+	return &RegistryEndpoint{
 		RegistryName:   name,
 		RegistryPrefix: prefix,
 		RegistryAPI:    apiUrl,
 		Credentials:    credentials,
 		CredsExpire:    credsExpire,
-		Cache:          cache.NewMemCache(),
+		Cache:          newEndpointCache(prefix),
 		Insecure:       insecure,
 		DefaultNS:      defaultNS,
 		TagListSort:    tagListSort,
 		Limiter:        ratelimit.New(limit),
 	}
+}
+
+// SetCacheFactory sets the factory that creates the tag caches of registry
+// endpoints, i.e. to share the cache between multiple instances of Argo CD
+// Image Updater. The caches of all registry endpoints configured so far are
+// replaced by new caches created by the factory.
+func SetCacheFactory(factory CacheFactory) {
+	cacheLock.Lock()
+	newCache = factory
+	cacheLock.Unlock()
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	for prefix, ep := range registries {
+		ep.lock.Lock()
+		ep.Cache = factory(prefix)
+		ep.lock.Unlock()
+	}
+}
+
+// imageTagCache returns the tag cache of the endpoint, which may be replaced
+// by SetCacheFactory at any time
+func (ep *RegistryEndpoint) imageTagCache() cache.ImageTagCache {
+	ep.lock.RLock()
+	defer ep.lock.RUnlock()
+	return ep.Cache
+}
+
+// newEndpointCache creates a new tag cache for the registry endpoint with the
+// given prefix
+func newEndpointCache(prefix string) cache.ImageTagCache {
+	cacheLock.RLock()
+	defer cacheLock.RUnlock()
+	return newCache(prefix)
+}
+
+// noCacheKey is the key of the context value that makes all lookups in the
+// cache during a scan miss, and all records in the cache be discarded
+type noCacheKey struct{}
+
+// withoutCache returns a context for a scan that bypasses the cache
+func withoutCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+// usesCache returns whether the cache of the endpoint is used for the scan
+// the given context belongs to. The cache is bypassed if it is disabled for
+// the endpoint, or for the scan.
+func (ep *RegistryEndpoint) usesCache(ctx context.Context) bool {
+	return !ep.DisableCache && ctx.Value(noCacheKey{}) == nil
+}
+
+// tagCache returns the cache to use for the scan the given context belongs
+// to, which records nothing if the cache is bypassed
+func (ep *RegistryEndpoint) tagCache(ctx context.Context) cache.ImageTagCache {
+	if !ep.usesCache(ctx) {
+		return cache.NewNoCache()
+	}
+	return ep.imageTagCache()
+}
+
+// checkState returns where the tag count and immutable tag checks keep their
+// state for the scan the given context belongs to. That is the endpoint's
+// cache, or, if the cache is bypassed, state that the endpoint keeps in
+// memory, so that the checks still work without the cache being touched.
+func (ep *RegistryEndpoint) checkState(ctx context.Context) cache.ImageTagCache {
+	if ep.usesCache(ctx) {
+		return ep.imageTagCache()
+	}
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	if ep.uncachedState == nil {
+		ep.uncachedState = cache.NewMemCache()
+	}
+	return ep.uncachedState
+}
+
+// ClearCacheForRepo removes all cached data of the image with the given name,
+// i.e. after its tags have been pushed again. Besides the entries of the
+// endpoint's cache, this removes the tags that resulted for the image, which
+// the endpoint keeps for unchanged tag lists and while its circuit is open.
+func (ep *RegistryEndpoint) ClearCacheForRepo(nameInRegistry string) {
+	if c := ep.imageTagCache(); c != nil {
+		c.ClearCacheForRepo(nameInRegistry)
+	}
+	ep.clearTagResults(func(name string) bool { return name == nameInRegistry })
+}
+
+// ClearCacheForPrefix removes all cached data of the images whose name starts
+// with the given prefix, like ClearCacheForRepo does for a single image.
+func (ep *RegistryEndpoint) ClearCacheForPrefix(prefix string) {
+	if c := ep.imageTagCache(); c != nil {
+		c.ClearCacheForPrefix(prefix)
+	}
+	ep.clearTagResults(func(name string) bool { return strings.HasPrefix(name, prefix) })
+}
+
+// clearTagResults removes the tags that resulted for the images whose name
+// matches, along with the tag counts rejected as truncated for them
+func (ep *RegistryEndpoint) clearTagResults(matches func(nameInRegistry string) bool) {
+	ep.resultLock.Lock()
+	defer ep.resultLock.Unlock()
+	for key := range ep.tagResults {
+		if matches(strings.SplitN(key, "|", 2)[0]) {
+			delete(ep.tagResults, key)
+		}
+	}
+	for key := range ep.lastResults {
+		if matches(strings.SplitN(key, "|", 2)[0]) {
+			delete(ep.lastResults, key)
+		}
+	}
+	suspectTagCounts.Range(func(key, _ interface{}) bool {
+		if name := strings.TrimPrefix(key.(string), ep.RegistryPrefix+"/"); name != key.(string) && matches(name) {
+			suspectTagCounts.Delete(key)
+		}
+		return true
+	})
+}
+
+// addRegistryEndpoint adds the given endpoint to the list of configured
+// registries, replacing any existing endpoint with the same prefix.
+func addRegistryEndpoint(ep *RegistryEndpoint) error {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registrySeq += 1
+	ep.order = registrySeq
+	registries[normalizePrefix(ep.RegistryPrefix)] = ep
 	return nil
 }
 
-// GetRegistryEndpoint retrieves the endpoint information for the given prefix
+// SetStrictPrefixMatching configures whether GetRegistryEndpoint returns an
+// error when more than one endpoint matches a prefix equally well.
+func SetStrictPrefixMatching(strict bool) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	strictPrefixMatch = strict
+}
+
+// SetDefaultTimeout configures the timeout of requests to endpoints that have
+// no timeout configured. A timeout of 0 means no timeout.
+func SetDefaultTimeout(timeout time.Duration) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	defaultTimeout = timeout
+}
+
+// DefaultUserAgent returns the user agent sent to registries unless
+// configured otherwise, i.e. argocd-image-updater/v0.12.0+abcdef0
+func DefaultUserAgent() string {
+	return version.BinaryName() + "/" + version.Version()
+}
+
+// SetDefaultUserAgent configures the user agent sent to endpoints that have
+// no user agent configured. An empty user agent restores DefaultUserAgent.
+func SetDefaultUserAgent(userAgent string) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if userAgent == "" {
+		userAgent = DefaultUserAgent()
+	}
+	defaultUserAgent = userAgent
+}
+
+// SetDefaultRequestID configures whether requests to all endpoints carry a
+// unique request ID, regardless of the endpoints' configuration
+func SetDefaultRequestID(enabled bool) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	defaultRequestID = enabled
+}
+
+// requestIdentification returns the user agent to send to the endpoint, which
+// is the endpoint's user agent if configured, or the default user agent, and
+// whether requests to the endpoint carry a request ID
+func (ep *RegistryEndpoint) requestIdentification() (string, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	userAgent := ep.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	return userAgent, ep.RequestID || defaultRequestID
+}
+
+// requestTimeout returns the timeout of a single request to the endpoint,
+// which is the endpoint's timeout if configured, or the default timeout
+func (ep *RegistryEndpoint) requestTimeout() time.Duration {
+	if ep.Timeout > 0 {
+		return ep.Timeout
+	}
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return defaultTimeout
+}
+
+// SetSearchRegistries configures the ordered list of registry prefixes that
+// are searched for images which are not qualified with a registry. An empty
+// list disables searching.
+func SetSearchRegistries(prefixes []string) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	searchRegistries = append([]string{}, prefixes...)
+	searchResolutions = make(map[string]searchResolution)
+}
+
+// GetSearchRegistries returns the ordered list of registry prefixes that are
+// searched for images which are not qualified with a registry.
+func GetSearchRegistries() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return append([]string{}, searchRegistries...)
+}
+
+// prefixMatches returns whether the endpoint prefix epPrefix matches the given
+// prefix, i.e. whether it is equal to or a parent path of prefix.
+func prefixMatches(prefix, epPrefix string) bool {
+	return prefix == epPrefix || (epPrefix != "" && strings.HasPrefix(prefix, epPrefix+"/"))
+}
+
+// Host names Docker Hub is known under, which refer to the default registry
+// unless a registry with that prefix is configured
+var dockerHubHosts = []string{"docker.io", "index.docker.io", "registry-1.docker.io"}
+
+// normalizePrefix returns the given prefix with its host in lower case, since
+// host names are case-insensitive. The case of the path is preserved.
+func normalizePrefix(prefix string) string {
+	if i := strings.Index(prefix, "/"); i >= 0 {
+		return strings.ToLower(prefix[:i]) + prefix[i:]
+	}
+	return strings.ToLower(prefix)
+}
+
+// isDockerHubPrefix returns whether the host of the normalized prefix is one
+// of the names Docker Hub is known under
+func isDockerHubPrefix(prefix string) bool {
+	host := strings.SplitN(prefix, "/", 2)[0]
+	for _, h := range dockerHubHosts {
+		if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRegistryEndpoint returns the endpoint with the longest prefix matching
+// the normalized prefix, along with another endpoint matching equally well,
+// if any. Must be called with registryLock held.
+func matchRegistryEndpoint(prefix string) (match *RegistryEndpoint, ambiguous *RegistryEndpoint) {
+	var matchLen int
+	for _, ep := range registries {
+		epPrefix := normalizePrefix(strings.TrimSuffix(ep.RegistryPrefix, "/"))
+		if !prefixMatches(prefix, epPrefix) {
+			continue
+		}
+		switch {
+		case match == nil || len(epPrefix) > matchLen:
+			match, matchLen, ambiguous = ep, len(epPrefix), nil
+		case len(epPrefix) == matchLen:
+			if ep.order < match.order {
+				match, ambiguous = ep, match
+			} else {
+				ambiguous = ep
+			}
+		}
+	}
+	return match, ambiguous
+}
+
+// defaultRegistryEndpoint returns the endpoint marked as default, or nil if
+// there is none. If more than one endpoint is marked, the one configured last
+// is returned. Must be called with registryLock held.
+func defaultRegistryEndpoint() *RegistryEndpoint {
+	var def *RegistryEndpoint
+	for _, ep := range registries {
+		if ep.Default && (def == nil || ep.order > def.order) {
+			def = ep
+		}
+	}
+	return def
+}
+
+// GetRegistryEndpoint retrieves the endpoint information for the given prefix.
+//
+// The endpoint with the longest matching prefix wins. A trailing slash in the
+// configured prefix is not considered, and host names are matched regardless
+// of their case. If two endpoints match with the same length, the one that
+// has been configured first is used, unless strict prefix matching is
+// enabled, in which case an error is returned. Prefixes on docker.io,
+// index.docker.io or registry-1.docker.io that match no endpoint refer to the
+// default registry, i.e. Docker Hub. If an endpoint is marked as default, it
+// replaces the default registry, and is also used for all prefixes that match
+// no endpoint.
 func GetRegistryEndpoint(prefix string) (*RegistryEndpoint, error) {
 	registryLock.RLock()
 	defer registryLock.RUnlock()
-	if registry, ok := registries[prefix]; ok {
-		return registry, nil
-	} else {
+
+	normalized := normalizePrefix(prefix)
+	match, ambiguous := matchRegistryEndpoint(normalized)
+	if match == nil && isDockerHubPrefix(normalized) {
+		match, ambiguous = matchRegistryEndpoint("")
+	}
+	if match == nil || strings.TrimSuffix(match.RegistryPrefix, "/") == "" {
+		if def := defaultRegistryEndpoint(); def != nil {
+			match, ambiguous = def, nil
+		}
+	}
+
+	if match == nil {
 		return nil, fmt.Errorf("no registry with prefix '%s' configured", prefix)
 	}
+
+	if ambiguous != nil {
+		if strictPrefixMatch {
+			return nil, fmt.Errorf("prefix '%s' matches registries %s and %s ambiguously", prefix, match.RegistryName, ambiguous.RegistryName)
+		}
+		log.Debugf("prefix '%s' matches registries %s and %s, using %s", prefix, match.RegistryName, ambiguous.RegistryName, match.RegistryName)
+	}
+
+	return match, nil
+}
+
+// GetRegistryEndpointForImage retrieves the endpoint information for the given
+// image. The image's registry and repository are looked up as the prefix, so
+// that endpoints configured with a path in their prefix match the images
+// below that path. Images without a registry use the default registry.
+func GetRegistryEndpointForImage(img *image.ContainerImage) (*RegistryEndpoint, error) {
+	if img.RegistryURL == "" {
+		return GetRegistryEndpoint("")
+	}
+	return GetRegistryEndpoint(img.RegistryURL + "/" + img.ImageName)
+}
+
+// getRegistryEndpointByName returns the configured endpoint with the given
+// name
+func getRegistryEndpointByName(name string) (*RegistryEndpoint, error) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	for _, ep := range registries {
+		if ep.RegistryName == name {
+			return ep, nil
+		}
+	}
+	return nil, fmt.Errorf("no registry with name '%s' configured", name)
 }
 
 // SetRegistryEndpointCredentials allows to change the credentials used for
@@ -184,6 +691,17 @@ func ConfiguredEndpoints() []string {
 	return r
 }
 
+// IsTagImmutable returns whether the given tag is considered immutable, i.e.
+// whether it matches one of the endpoint's immutable tag patterns.
+func (ep *RegistryEndpoint) IsTagImmutable(tagName string) bool {
+	for _, pattern := range ep.ImmutableTags {
+		if match, err := filepath.Match(pattern, tagName); err == nil && match {
+			return true
+		}
+	}
+	return false
+}
+
 // DeepCopy copies the endpoint to a new object, but creating a new Cache
 func (ep *RegistryEndpoint) DeepCopy() *RegistryEndpoint {
 	ep.lock.RLock()
@@ -192,14 +710,60 @@ func (ep *RegistryEndpoint) DeepCopy() *RegistryEndpoint {
 	newEp.RegistryName = ep.RegistryName
 	newEp.RegistryPrefix = ep.RegistryPrefix
 	newEp.Credentials = ep.Credentials
+	newEp.FallbackCredentials = append([]string{}, ep.FallbackCredentials...)
 	newEp.Ping = ep.Ping
 	newEp.TagListSort = ep.TagListSort
-	newEp.Cache = cache.NewMemCache()
+	newEp.Cache = newEndpointCache(ep.RegistryPrefix)
 	newEp.Insecure = ep.Insecure
 	newEp.DefaultNS = ep.DefaultNS
 	newEp.Limiter = ep.Limiter
 	newEp.CredsExpire = ep.CredsExpire
 	newEp.CredsUpdated = ep.CredsUpdated
+	newEp.credsExpiresAt = ep.credsExpiresAt
+	newEp.CredsRefresh = ep.CredsRefresh
+	newEp.MaxStreams = ep.MaxStreams
+	newEp.MetadataConcurrency = ep.MetadataConcurrency
+	newEp.Singleflight = ep.Singleflight
+	newEp.ImmutableTags = append([]string{}, ep.ImmutableTags...)
+	newEp.WriteBackPrefix = ep.WriteBackPrefix
+	newEp.AllowedMediaTypes = append([]string{}, ep.AllowedMediaTypes...)
+	newEp.NegativeCacheTTL = ep.NegativeCacheTTL
+	newEp.DisableCache = ep.DisableCache
+	newEp.RateLimitRetries = ep.RateLimitRetries
+	newEp.RateLimitMaxBackoff = ep.RateLimitMaxBackoff
+	newEp.CircuitThreshold = ep.CircuitThreshold
+	newEp.CircuitCooldown = ep.CircuitCooldown
+	newEp.TLSCAFile = ep.TLSCAFile
+	newEp.TLSCertFile = ep.TLSCertFile
+	newEp.TLSKeyFile = ep.TLSKeyFile
+	newEp.TLSCredentials = ep.TLSCredentials
+	newEp.Proxy = ep.Proxy
+	newEp.MinInterval = ep.MinInterval
+	newEp.Jitter = ep.Jitter
+	newEp.CredentialsFrom = ep.CredentialsFrom
+	newEp.Default = ep.Default
+	newEp.Timeout = ep.Timeout
+	newEp.UserAgent = ep.UserAgent
+	newEp.RequestID = ep.RequestID
+	newEp.ArtifactType = ep.ArtifactType
+	newEp.CreatedFrom = append([]CreatedSource{}, ep.CreatedFrom...)
+	newEp.TagList = ep.TagList
+	newEp.TagList.Path = append(tagListPath{}, ep.TagList.Path...)
+	if ep.Headers != nil {
+		newEp.Headers = make(map[string]string, len(ep.Headers))
+		for name, definition := range ep.Headers {
+			newEp.Headers[name] = definition
+		}
+	}
+	if ep.HostAliases != nil {
+		newEp.HostAliases = make(map[string]string, len(ep.HostAliases))
+		for host, ip := range ep.HostAliases {
+			newEp.HostAliases[host] = ip
+		}
+	}
+	newEp.AuthHost = ep.AuthHost
+	newEp.Flavor = ep.Flavor
+	newEp.order = ep.order
 	ep.lock.RUnlock()
 	return newEp
 }
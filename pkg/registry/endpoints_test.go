@@ -3,6 +3,11 @@ package registry
 import (
 	"fmt"
 	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/cache"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -57,6 +62,179 @@ func Test_AddEndpoint(t *testing.T) {
 	})
 }
 
+func Test_GetEndpointByPrefix(t *testing.T) {
+	RestoreDefaultRegistryConfiguration()
+	defer RestoreDefaultRegistryConfiguration()
+	require.NoError(t, AddRegistryEndpoint("registry.example.com", "Example", "https://registry.example.com", "", "", false, SortUnsorted, 5, 0))
+	require.NoError(t, AddRegistryEndpoint("registry.example.com/team/", "Team", "https://team.example.com", "", "", false, SortUnsorted, 5, 0))
+	require.NoError(t, AddRegistryEndpoint("registry.example.com/team", "Other team", "https://other.example.com", "", "", false, SortUnsorted, 5, 0))
+
+	t.Run("Longest prefix wins", func(t *testing.T) {
+		ep, err := GetRegistryEndpoint("registry.example.com/team/app")
+		require.NoError(t, err)
+		assert.Equal(t, "Team", ep.RegistryName)
+		ep, err = GetRegistryEndpoint("registry.example.com/other/app")
+		require.NoError(t, err)
+		assert.Equal(t, "Example", ep.RegistryName)
+	})
+	t.Run("Prefix must match on path boundary", func(t *testing.T) {
+		ep, err := GetRegistryEndpoint("registry.example.com/teamfoo")
+		require.NoError(t, err)
+		assert.Equal(t, "Example", ep.RegistryName)
+		_, err = GetRegistryEndpoint("registry.example.community")
+		assert.Error(t, err)
+	})
+	t.Run("Image is matched along with its repository", func(t *testing.T) {
+		ep, err := GetRegistryEndpointForImage(image.NewFromIdentifier("registry.example.com/team/app:1.0"))
+		require.NoError(t, err)
+		assert.Equal(t, "Team", ep.RegistryName)
+		ep, err = GetRegistryEndpointForImage(image.NewFromIdentifier("registry.example.com/other/app:1.0"))
+		require.NoError(t, err)
+		assert.Equal(t, "Example", ep.RegistryName)
+	})
+	t.Run("Ambiguous match in strict mode", func(t *testing.T) {
+		SetStrictPrefixMatching(true)
+		defer SetStrictPrefixMatching(false)
+		_, err := GetRegistryEndpoint("registry.example.com/team/app")
+		assert.Error(t, err)
+		ep, err := GetRegistryEndpoint("registry.example.com/other/app")
+		require.NoError(t, err)
+		assert.Equal(t, "Example", ep.RegistryName)
+	})
+}
+
+func Test_GetEndpointNormalizedPrefix(t *testing.T) {
+	RestoreDefaultRegistryConfiguration()
+	defer RestoreDefaultRegistryConfiguration()
+	require.NoError(t, AddRegistryEndpoint("Registry.Example.com", "Example", "https://registry.example.com", "", "", false, SortUnsorted, 5, 0))
+	require.NoError(t, AddRegistryEndpoint("registry.example.com/Team", "Team", "https://team.example.com", "", "", false, SortUnsorted, 5, 0))
+
+	t.Run("Host is matched regardless of case", func(t *testing.T) {
+		for _, prefix := range []string{"registry.example.com", "REGISTRY.EXAMPLE.COM", "registry.Example.com/other"} {
+			ep, err := GetRegistryEndpoint(prefix)
+			require.NoError(t, err, prefix)
+			assert.Equal(t, "Example", ep.RegistryName, prefix)
+		}
+	})
+	t.Run("Case of path is preserved", func(t *testing.T) {
+		ep, err := GetRegistryEndpoint("Registry.example.com/Team/app")
+		require.NoError(t, err)
+		assert.Equal(t, "Team", ep.RegistryName)
+		ep, err = GetRegistryEndpoint("registry.example.com/team/app")
+		require.NoError(t, err)
+		assert.Equal(t, "Example", ep.RegistryName)
+	})
+	t.Run("Prefixes differing in case of host replace each other", func(t *testing.T) {
+		require.NoError(t, AddRegistryEndpoint("registry.example.COM", "Replaced", "https://registry.example.com", "", "", false, SortUnsorted, 5, 0))
+		SetStrictPrefixMatching(true)
+		defer SetStrictPrefixMatching(false)
+		ep, err := GetRegistryEndpoint("registry.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "Replaced", ep.RegistryName)
+	})
+	t.Run("Docker Hub aliases refer to default registry", func(t *testing.T) {
+		for _, prefix := range []string{"", "docker.io", "Docker.IO", "index.docker.io", "registry-1.docker.io", "docker.io/library"} {
+			ep, err := GetRegistryEndpoint(prefix)
+			require.NoError(t, err, prefix)
+			assert.Equal(t, "Docker Hub", ep.RegistryName, prefix)
+		}
+	})
+	t.Run("Unqualified image resolves to Docker Hub", func(t *testing.T) {
+		img := image.NewFromIdentifier("nginx:1.21")
+		ep, err := GetRegistryEndpointForImage(img)
+		require.NoError(t, err)
+		assert.Equal(t, "Docker Hub", ep.RegistryName)
+		assert.Equal(t, "library/nginx", ep.nameInRegistry(img))
+
+		img = image.NewFromIdentifier("docker.io/nginx:1.21")
+		ep, err = GetRegistryEndpointForImage(img)
+		require.NoError(t, err)
+		assert.Equal(t, "Docker Hub", ep.RegistryName)
+		assert.Equal(t, "library/nginx", ep.nameInRegistry(img))
+	})
+	t.Run("Configured docker.io endpoint takes precedence", func(t *testing.T) {
+		require.NoError(t, AddRegistryEndpoint("docker.io", "Mirror", "https://mirror.example.com", "", "library", false, SortUnsorted, 5, 0))
+		ep, err := GetRegistryEndpoint("docker.io")
+		require.NoError(t, err)
+		assert.Equal(t, "Mirror", ep.RegistryName)
+		ep, err = GetRegistryEndpoint("index.docker.io")
+		require.NoError(t, err)
+		assert.Equal(t, "Docker Hub", ep.RegistryName)
+	})
+}
+
+func Test_GetDefaultEndpoint(t *testing.T) {
+	RestoreDefaultRegistryConfiguration()
+	defer RestoreDefaultRegistryConfiguration()
+
+	t.Run("Unknown prefix without default endpoint", func(t *testing.T) {
+		_, err := GetRegistryEndpoint("unknown.example.com")
+		require.Error(t, err)
+	})
+
+	err := AddRegistryEndpointFromConfig(RegistryConfiguration{Name: "Mirror", ApiURL: "https://mirror.example.com", Prefix: "mirror.example.com", DefaultNS: "library", Default: true})
+	require.NoError(t, err)
+
+	t.Run("Unknown prefixes use default endpoint", func(t *testing.T) {
+		for _, prefix := range []string{"unknown.example.com", "unknown.example.com/team", "mirror.example.com"} {
+			ep, err := GetRegistryEndpoint(prefix)
+			require.NoError(t, err, prefix)
+			assert.Equal(t, "Mirror", ep.RegistryName, prefix)
+		}
+	})
+
+	t.Run("Default endpoint replaces Docker Hub", func(t *testing.T) {
+		for _, prefix := range []string{"", "docker.io", "index.docker.io"} {
+			ep, err := GetRegistryEndpoint(prefix)
+			require.NoError(t, err, prefix)
+			assert.Equal(t, "Mirror", ep.RegistryName, prefix)
+		}
+		img := image.NewFromIdentifier("nginx:1.21")
+		ep, err := GetRegistryEndpointForImage(img)
+		require.NoError(t, err)
+		assert.Equal(t, "library/nginx", ep.nameInRegistry(img))
+	})
+
+	t.Run("Matching prefixes take precedence", func(t *testing.T) {
+		ep, err := GetRegistryEndpoint("gcr.io")
+		require.NoError(t, err)
+		assert.Equal(t, "Google Container Registry", ep.RegistryName)
+	})
+
+	t.Run("Deep copy keeps default marker", func(t *testing.T) {
+		ep, err := GetRegistryEndpoint("")
+		require.NoError(t, err)
+		assert.True(t, ep.DeepCopy().Default)
+	})
+}
+
+func Test_QuayFlavor(t *testing.T) {
+	RestoreDefaultRegistryConfiguration()
+	defer RestoreDefaultRegistryConfiguration()
+
+	t.Run("Default endpoint of quay.io is generic", func(t *testing.T) {
+		ep, err := GetRegistryEndpoint("quay.io")
+		require.NoError(t, err)
+		assert.Equal(t, FlavorGeneric, ep.Flavor)
+	})
+
+	t.Run("Configured endpoint of quay.io is generic", func(t *testing.T) {
+		err := AddRegistryEndpointFromConfig(RegistryConfiguration{Name: "Quay", ApiURL: "https://quay.io", Prefix: "quay.io"})
+		require.NoError(t, err)
+		ep, err := GetRegistryEndpoint("quay.io")
+		require.NoError(t, err)
+		assert.Equal(t, FlavorGeneric, ep.Flavor)
+	})
+
+	t.Run("Quay flavor is configured", func(t *testing.T) {
+		err := AddRegistryEndpointFromConfig(RegistryConfiguration{Name: "Quay", ApiURL: "https://quay.io", Prefix: "quay.io", Flavor: "quay"})
+		require.NoError(t, err)
+		ep, err := GetRegistryEndpoint("quay.io")
+		require.NoError(t, err)
+		assert.Equal(t, FlavorQuay, ep.Flavor)
+	})
+}
+
 func Test_SetEndpointCredentials(t *testing.T) {
 	t.Run("Set credentials on default registry", func(t *testing.T) {
 		err := SetRegistryEndpointCredentials("", "env:FOOBAR")
@@ -119,6 +297,48 @@ func Test_DeepCopy(t *testing.T) {
 	})
 }
 
+func Test_SetCacheFactory(t *testing.T) {
+	t.Run("Endpoints use caches from factory", func(t *testing.T) {
+		defer SetCacheFactory(func(string) cache.ImageTagCache { return cache.NewMemCache() })
+		caches := make(map[string]cache.ImageTagCache)
+		SetCacheFactory(func(prefix string) cache.ImageTagCache {
+			c := cache.NewMemCache()
+			caches[prefix] = c
+			return c
+		})
+
+		ep, err := GetRegistryEndpoint("quay.io")
+		require.NoError(t, err)
+		assert.Same(t, caches["quay.io"], ep.Cache)
+
+		err = AddRegistryEndpoint("example.com", "Example", "https://example.com", "", "", false, SortUnsorted, 0, 0)
+		require.NoError(t, err)
+		ep, err = GetRegistryEndpoint("example.com")
+		require.NoError(t, err)
+		assert.Same(t, caches["example.com"], ep.Cache)
+		newEp := ep.DeepCopy()
+		assert.Same(t, caches["example.com"], newEp.Cache)
+	})
+
+	t.Run("Caches are replaced while endpoints are in use", func(t *testing.T) {
+		defer SetCacheFactory(func(string) cache.ImageTagCache { return cache.NewMemCache() })
+		ep, err := GetRegistryEndpoint("quay.io")
+		require.NoError(t, err)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				ep.ClearCacheForRepo("foo/bar")
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			SetCacheFactory(func(string) cache.ImageTagCache { return cache.NewMemCache() })
+		}
+		<-done
+		assert.NotNil(t, ep.imageTagCache())
+	})
+}
+
 func Test_GetTagListSortFromString(t *testing.T) {
 	t.Run("Get latest-first sorting", func(t *testing.T) {
 		tls := TagListSortFromString("latest-first")
@@ -141,3 +361,76 @@ func Test_GetTagListSortFromString(t *testing.T) {
 		assert.Equal(t, SortUnsorted, tls)
 	})
 }
+
+func Test_GetRegistryFlavorFromString(t *testing.T) {
+	t.Run("Get dockerhub flavor", func(t *testing.T) {
+		assert.Equal(t, FlavorDockerHub, RegistryFlavorFromString("DockerHub"))
+	})
+	t.Run("Get gitlab flavor", func(t *testing.T) {
+		assert.Equal(t, FlavorGitLab, RegistryFlavorFromString("gitlab"))
+		assert.True(t, FlavorGitLab.HasTagDates())
+	})
+	t.Run("Get quay flavor", func(t *testing.T) {
+		assert.Equal(t, FlavorQuay, RegistryFlavorFromString("Quay"))
+		assert.True(t, FlavorQuay.HasTagDates())
+		assert.Equal(t, "quay", FlavorQuay.String())
+	})
+	t.Run("Get generic flavor implicit", func(t *testing.T) {
+		assert.Equal(t, FlavorGeneric, RegistryFlavorFromString(""))
+	})
+	t.Run("Get generic flavor from unknown", func(t *testing.T) {
+		assert.Equal(t, FlavorGeneric, RegistryFlavorFromString("unknown"))
+	})
+}
+
+func Test_LastTagResults(t *testing.T) {
+	ep := &RegistryEndpoint{RegistryPrefix: "example.com"}
+	tl := tag.NewImageTagList()
+	tl.Add(tag.NewImageTag("1.0", time.Now()))
+	for i := 0; i < maxTagResults+1; i++ {
+		ep.setLastTagResult(fmt.Sprintf("foo/bar%d", i), "key", "", tl)
+	}
+	assert.Len(t, ep.lastResults, maxTagResults)
+	assert.NotNil(t, ep.lastTagResult(fmt.Sprintf("foo/bar%d", maxTagResults), "key", ""))
+	assert.Nil(t, ep.lastTagResult(fmt.Sprintf("foo/bar%d", maxTagResults), "key", "other"))
+}
+
+func Test_ClearCacheForRepo(t *testing.T) {
+	newEndpoint := func() *RegistryEndpoint {
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		for _, name := range []string{"foo/bar", "foo/baz", "other/bar"} {
+			ep.Cache.SetTag(name, tag.NewImageTag("1.0", time.Now()))
+			tl := tag.NewImageTagList()
+			tl.Add(tag.NewImageTag("1.0", time.Now()))
+			ep.setTagResult(name, "key", "etag", tl)
+			ep.setLastTagResult(name, "key", "", tl)
+		}
+		return ep
+	}
+
+	t.Run("Clear a single repository", func(t *testing.T) {
+		ep := newEndpoint()
+		ep.ClearCacheForRepo("foo/bar")
+		assert.False(t, ep.Cache.HasTag("foo/bar", "1.0"))
+		assert.Nil(t, ep.getTagResult("foo/bar", "key", "etag"))
+		assert.Nil(t, ep.lastTagResult("foo/bar", "key", ""))
+		for _, name := range []string{"foo/baz", "other/bar"} {
+			assert.True(t, ep.Cache.HasTag(name, "1.0"))
+			assert.NotNil(t, ep.getTagResult(name, "key", "etag"))
+			assert.NotNil(t, ep.lastTagResult(name, "key", ""))
+		}
+	})
+
+	t.Run("Clear repositories by prefix", func(t *testing.T) {
+		ep := newEndpoint()
+		ep.ClearCacheForPrefix("foo/")
+		for _, name := range []string{"foo/bar", "foo/baz"} {
+			assert.False(t, ep.Cache.HasTag(name, "1.0"))
+			assert.Nil(t, ep.getTagResult(name, "key", "etag"))
+			assert.Nil(t, ep.lastTagResult(name, "key", ""))
+		}
+		assert.True(t, ep.Cache.HasTag("other/bar", "1.0"))
+		assert.NotNil(t, ep.getTagResult("other/bar", "key", "etag"))
+		assert.NotNil(t, ep.lastTagResult("other/bar", "key", ""))
+	})
+}
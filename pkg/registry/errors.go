@@ -0,0 +1,126 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/nokia/docker-registry-client/registry"
+)
+
+// Errors returned by registry clients and GetTags can be checked against the
+// following kinds of failures using errors.Is, i.e. to decide whether to try
+// again later.
+var (
+	// ErrManifestNotFound is returned when the registry does not know the
+	// requested manifest, tag or repository
+	ErrManifestNotFound = errors.New("manifest not found")
+	// ErrUnauthorized is returned when the registry rejects the credentials,
+	// or denies access to the requested resource
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrRateLimited is returned when the registry keeps rejecting requests
+	// because its rate limit is exceeded
+	ErrRateLimited = errors.New("rate limited")
+	// ErrRegistryUnavailable is returned when the registry cannot be reached,
+	// or fails with a server error
+	ErrRegistryUnavailable = errors.New("registry unavailable")
+)
+
+// RegistryError is an error returned by a registry, classified by the kind of
+// failure. Its message is the message of the error it wraps.
+type RegistryError struct {
+	// API URL of the registry
+	Registry string
+	// HTTP status returned by the registry, or 0 if there was no response
+	StatusCode int
+	// The error returned by the registry client
+	Err  error
+	kind error
+}
+
+func (e *RegistryError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *RegistryError) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is the kind of failure of e
+func (e *RegistryError) Is(target error) bool {
+	return target == e.kind
+}
+
+// Is returns true for ErrRateLimited
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// errorForStatus returns the kind of failure the given HTTP status indicates,
+// or nil if it is no known failure
+func errorForStatus(statusCode int) error {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case statusCode == http.StatusNotFound:
+		return ErrManifestNotFound
+	case statusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case statusCode >= 500:
+		return ErrRegistryUnavailable
+	default:
+		return nil
+	}
+}
+
+// statusError returns an error for an unexpected HTTP response of the
+// registry, with the given message followed by the response's status
+func (client *registryClient) statusError(resp *http.Response, format string, args ...interface{}) error {
+	err := fmt.Errorf("%s: %s", fmt.Sprintf(format, args...), resp.Status)
+	kind := errorForStatus(resp.StatusCode)
+	if kind == nil {
+		return err
+	}
+	return &RegistryError{Registry: client.registryAPI(), StatusCode: resp.StatusCode, Err: err, kind: kind}
+}
+
+// classifyError wraps err into a RegistryError if it indicates a known kind
+// of failure. Errors that already are of a known kind, and errors caused by
+// the request's context, are returned as they are.
+func (client *registryClient) classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, kind := range []error{ErrManifestNotFound, ErrUnauthorized, ErrRateLimited, ErrRegistryUnavailable} {
+		if errors.Is(err, kind) {
+			return err
+		}
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	var hse *registry.HttpStatusError
+	if errors.As(err, &hse) && hse.Response != nil {
+		if kind := errorForStatus(hse.Response.StatusCode); kind != nil {
+			return &RegistryError{Registry: client.registryAPI(), StatusCode: hse.Response.StatusCode, Err: err, kind: kind}
+		}
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return &RegistryError{Registry: client.registryAPI(), Err: err, kind: ErrRegistryUnavailable}
+	}
+	return err
+}
+
+// registryAPI returns the API URL of the client's registry
+func (client *registryClient) registryAPI() string {
+	if client.endpoint != nil {
+		return client.endpoint.RegistryAPI
+	}
+	return client.regClient.URL
+}
@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RegistryErrors(t *testing.T) {
+	// A registry responding to all requests with the given status
+	newClient := func(t *testing.T, status int) (RegistryClient, func()) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprint(w, `{"errors":[]}`)
+		}))
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		return client, srv.Close
+	}
+
+	for status, kind := range map[int]error{
+		http.StatusUnauthorized:        ErrUnauthorized,
+		http.StatusForbidden:           ErrUnauthorized,
+		http.StatusNotFound:            ErrManifestNotFound,
+		http.StatusTooManyRequests:     ErrRateLimited,
+		http.StatusServiceUnavailable:  ErrRegistryUnavailable,
+		http.StatusInternalServerError: ErrRegistryUnavailable,
+	} {
+		t.Run(fmt.Sprintf("Tags with status %d", status), func(t *testing.T) {
+			client, done := newClient(t, status)
+			defer done()
+			_, err := client.Tags(context.Background(), "foo/bar")
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, kind), "%v is not %v", err, kind)
+		})
+		t.Run(fmt.Sprintf("ManifestV2 with status %d", status), func(t *testing.T) {
+			client, done := newClient(t, status)
+			defer done()
+			_, err := client.ManifestV2(context.Background(), "foo/bar", "1.0")
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, kind), "%v is not %v", err, kind)
+		})
+	}
+
+	t.Run("Status code and message are kept", func(t *testing.T) {
+		client, done := newClient(t, http.StatusNotFound)
+		defer done()
+		_, err := client.Tags(context.Background(), "foo/bar")
+		var re *RegistryError
+		require.True(t, errors.As(err, &re))
+		assert.Equal(t, http.StatusNotFound, re.StatusCode)
+		assert.Equal(t, "could not get tags of foo/bar: 404 Not Found", err.Error())
+		assert.False(t, errors.Is(err, ErrUnauthorized))
+	})
+
+	t.Run("Unreachable registry", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		srv.Close()
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		_, err = client.Tags(context.Background(), "foo/bar")
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrRegistryUnavailable))
+	})
+
+	t.Run("Cancelled context is not classified", func(t *testing.T) {
+		client, done := newClient(t, http.StatusOK)
+		defer done()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := client.Tags(ctx, "foo/bar")
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, context.Canceled))
+		assert.False(t, errors.Is(err, ErrRegistryUnavailable))
+	})
+
+	t.Run("Rate limit errors are rate limited", func(t *testing.T) {
+		err := fmt.Errorf("could not get tags: %w", &RateLimitError{Registry: "https://example.com"})
+		assert.True(t, errors.Is(err, ErrRateLimited))
+		assert.True(t, IsRateLimitError(err))
+	})
+}
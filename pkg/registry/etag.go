@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"context"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+// ETagClient is implemented by registry clients that are able to fetch the
+// list of tags conditionally, so that it is only transferred if it changed
+type ETagClient interface {
+	// TagsIfNoneMatch returns the tags of the repository and the ETag of the
+	// list, if the registry sent one. If the list still has the given ETag,
+	// true is returned instead of the tags.
+	TagsIfNoneMatch(ctx context.Context, nameInRepository string, etag string) ([]string, string, bool, error)
+}
+
+// Maximum number of tag results an endpoint keeps for reuse. Once reached,
+// the least recently used result is evicted.
+const maxTagResults = 1000
+
+// tagResult is the list of tags that resulted from filtering the tag list
+// with the given ETag for a constraint
+type tagResult struct {
+	etag    string
+	tagList *tag.ImageTagList
+	used    time.Time
+}
+
+// listTags returns the tags of the image with the given name in the registry,
+// and the ETag of the list if the registry sent one. If the client is able to
+// fetch the list conditionally, the cached list is returned if it has not
+// changed, along with true. Tags that have been fetched while resolving the
+// image against the search registries are returned without asking the
+// registry again.
+func (endpoint *RegistryEndpoint) listTags(ctx context.Context, nameInRegistry string, regClient RegistryClient) ([]string, string, bool, error) {
+	if tags, ok := endpoint.searchedTags(ctx, nameInRegistry); ok {
+		return tags, "", false, nil
+	}
+	ec, ok := regClient.(ETagClient)
+	if !ok {
+		tags, err := regClient.Tags(ctx, nameInRegistry)
+		return tags, "", false, err
+	}
+
+	cachedETag, cachedTags := endpoint.tagCache(ctx).GetTagList(nameInRegistry)
+	tags, etag, unchanged, err := ec.TagsIfNoneMatch(ctx, nameInRegistry, cachedETag)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if unchanged {
+		log.Debugf("Tag list of %s has not changed, using cached list", nameInRegistry)
+		return cachedTags, cachedETag, true, nil
+	}
+	if etag != "" {
+		endpoint.tagCache(ctx).SetTagList(nameInRegistry, etag, tags)
+	}
+	return tags, etag, false, nil
+}
+
+// reusesTagResults returns whether the tags that resulted from an unchanged
+// tag list can be reused for the given constraint. This is only the case if
+// the result depends on nothing but the tag list and the cached meta data of
+// the tags, and not i.e. on the digests the tags currently point to, on their
+// pull counts, platforms, media types or labels, on a tag filter, or on the
+// current time.
+func (endpoint *RegistryEndpoint) reusesTagResults(vc *image.VersionConstraint) bool {
+	return vc.SortMode != image.VersionSortDigest && vc.MinDownloads == 0 && vc.MaxAge == 0 &&
+		len(vc.RequirePlatforms) == 0 && len(vc.RequireLabels) == 0 && vc.TagFilter == nil &&
+		len(endpoint.ImmutableTags) == 0 && len(endpoint.AllowedMediaTypes) == 0 && endpoint.ArtifactType == ArtifactImage
+}
+
+// getTagResult returns a copy of the tags that resulted from the tag list of
+// the image with the given ETag for the constraint with the given key, or nil
+// if there is none
+func (endpoint *RegistryEndpoint) getTagResult(nameInRegistry, constraintKey, etag string) *tag.ImageTagList {
+	endpoint.resultLock.Lock()
+	defer endpoint.resultLock.Unlock()
+	r, ok := endpoint.tagResults[nameInRegistry+"|"+constraintKey]
+	if !ok || r.etag != etag {
+		return nil
+	}
+	r.used = time.Now()
+	return r.tagList.DeepCopy()
+}
+
+// setTagResult records a copy of the tags that resulted from the tag list of
+// the image with the given ETag for the constraint with the given key. If the
+// endpoint already keeps maxTagResults results, the least recently used one
+// is evicted.
+func (endpoint *RegistryEndpoint) setTagResult(nameInRegistry, constraintKey, etag string, tagList *tag.ImageTagList) {
+	endpoint.resultLock.Lock()
+	defer endpoint.resultLock.Unlock()
+	if endpoint.tagResults == nil {
+		endpoint.tagResults = make(map[string]*tagResult)
+	}
+	storeTagResult(endpoint.tagResults, nameInRegistry+"|"+constraintKey, &tagResult{etag: etag, tagList: tagList.DeepCopy(), used: time.Now()})
+}
+
+// storeTagResult stores the result in results under the given key. If results
+// already holds maxTagResults results, the least recently used one is evicted.
+// Must be called with the result lock held.
+func storeTagResult(results map[string]*tagResult, key string, result *tagResult) {
+	if _, ok := results[key]; !ok && len(results) >= maxTagResults {
+		oldest := ""
+		for k, r := range results {
+			if oldest == "" || r.used.Before(results[oldest].used) {
+				oldest = k
+			}
+		}
+		delete(results, oldest)
+	}
+	results[key] = result
+}
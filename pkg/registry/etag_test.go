@@ -0,0 +1,172 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/cache"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/mocks"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// etagClient is a RegistryClient whose tag list has an ETag
+type etagClient struct {
+	*mocks.RegistryClient
+	etag string
+	tags []string
+}
+
+func (c *etagClient) TagsIfNoneMatch(ctx context.Context, nameInRepository string, etag string) ([]string, string, bool, error) {
+	if etag != "" && etag == c.etag {
+		return nil, etag, true, nil
+	}
+	return c.tags, c.etag, false, nil
+}
+
+// noTagCache is a cache that does not record the meta data of tags
+type noTagCache struct {
+	cache.ImageTagCache
+}
+
+func (noTagCache) SetTag(imageName string, imgTag *tag.ImageTag) {}
+
+func Test_TagsIfNoneMatch(t *testing.T) {
+	var ifNoneMatch []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprint(w, `{"name":"foo/bar","tags":["1.0","1.1"]}`)
+	}))
+	defer srv.Close()
+	ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+	client, err := NewClient(ep, "", "")
+	require.NoError(t, err)
+	ec, ok := client.(ETagClient)
+	require.True(t, ok)
+
+	tags, etag, unchanged, err := ec.TagsIfNoneMatch(context.Background(), "foo/bar", "")
+	require.NoError(t, err)
+	assert.False(t, unchanged)
+	assert.Equal(t, `"v1"`, etag)
+	assert.Equal(t, []string{"1.0", "1.1"}, tags)
+
+	tags, etag, unchanged, err = ec.TagsIfNoneMatch(context.Background(), "foo/bar", `"v1"`)
+	require.NoError(t, err)
+	assert.True(t, unchanged)
+	assert.Equal(t, `"v1"`, etag)
+	assert.Nil(t, tags)
+
+	tags, _, unchanged, err = ec.TagsIfNoneMatch(context.Background(), "foo/bar", `"v0"`)
+	require.NoError(t, err)
+	assert.False(t, unchanged)
+	assert.Equal(t, []string{"1.0", "1.1"}, tags)
+
+	assert.Equal(t, []string{"", `"v1"`, `"v0"`}, ifNoneMatch)
+}
+
+func Test_GetTagsWithETag(t *testing.T) {
+	newClient := func() *etagClient {
+		regClient := &mocks.RegistryClient{}
+		regClient.On("ManifestV2", mock.Anything, mock.Anything, mock.Anything).Return(&schema2.DeserializedManifest{}, nil)
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(&tag.TagInfo{}, nil)
+		return &etagClient{RegistryClient: regClient, etag: `"v1"`, tags: []string{"1.0", "1.1", "1.2"}}
+	}
+	newEndpoint := func() *RegistryEndpoint {
+		ep := newRegistryEndpoint("example.com", "Example", "https://example.com", "", "", false, SortUnsorted, 0, 0)
+		ep.Cache = noTagCache{cache.NewMemCache()}
+		return ep
+	}
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+	vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, FetchMetadata: true}
+
+	t.Run("Tag list and ETag are cached", func(t *testing.T) {
+		ep := newEndpoint()
+		_, err := ep.GetTags(context.Background(), img, newClient(), vc)
+		require.NoError(t, err)
+		etag, tags := ep.Cache.GetTagList("foo/bar")
+		assert.Equal(t, `"v1"`, etag)
+		assert.Equal(t, []string{"1.0", "1.1", "1.2"}, tags)
+	})
+
+	t.Run("Unchanged tag list reuses previous result", func(t *testing.T) {
+		ep := newEndpoint()
+		client := newClient()
+		tl, err := ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		require.Len(t, tl.Tags(), 3)
+		client.AssertNumberOfCalls(t, "ManifestV2", 3)
+
+		tl, err = ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.0", "1.1", "1.2"}, tl.Tags())
+		client.AssertNumberOfCalls(t, "ManifestV2", 3)
+	})
+
+	t.Run("Changed tag list is processed again", func(t *testing.T) {
+		ep := newEndpoint()
+		client := newClient()
+		_, err := ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		client.etag = `"v2"`
+		client.tags = []string{"1.0", "1.1", "1.2", "1.3"}
+		tl, err := ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		assert.Len(t, tl.Tags(), 4)
+		client.AssertNumberOfCalls(t, "ManifestV2", 7)
+	})
+
+	t.Run("Result is not reused when tracking digests", func(t *testing.T) {
+		ep := newEndpoint()
+		assert.False(t, ep.reusesTagResults(&image.VersionConstraint{SortMode: image.VersionSortDigest}))
+		assert.False(t, ep.reusesTagResults(&image.VersionConstraint{MinDownloads: 10}))
+		assert.True(t, ep.reusesTagResults(vc))
+		ep.ImmutableTags = []string{"v*"}
+		assert.False(t, ep.reusesTagResults(vc))
+	})
+
+	t.Run("Result is not reused with per-tag filters", func(t *testing.T) {
+		ep := newEndpoint()
+		assert.False(t, ep.reusesTagResults(&image.VersionConstraint{RequirePlatforms: []string{"linux/arm64"}}))
+		assert.False(t, ep.reusesTagResults(&image.VersionConstraint{RequireLabels: map[string]string{"a": "b"}}))
+		assert.False(t, ep.reusesTagResults(&image.VersionConstraint{TagFilter: image.RegexpTagFilter{Regexp: regexp.MustCompile(`^1`)}}))
+		ep.AllowedMediaTypes = []string{"application/vnd.oci.image.manifest.v1+json"}
+		assert.False(t, ep.reusesTagResults(vc))
+		ep = newEndpoint()
+		ep.ArtifactType = ArtifactHelmChart
+		assert.False(t, ep.reusesTagResults(vc))
+	})
+
+	t.Run("Number of results is bounded", func(t *testing.T) {
+		ep := newEndpoint()
+		for i := 0; i <= maxTagResults; i++ {
+			ep.setTagResult(fmt.Sprintf("foo/bar%d", i), vc.Key(), `"v1"`, tag.NewImageTagList())
+		}
+		assert.Len(t, ep.tagResults, maxTagResults)
+		assert.Nil(t, ep.getTagResult("foo/bar0", vc.Key(), `"v1"`))
+		assert.NotNil(t, ep.getTagResult(fmt.Sprintf("foo/bar%d", maxTagResults), vc.Key(), `"v1"`))
+	})
+
+	t.Run("Explained fetches are not reused", func(t *testing.T) {
+		ep := newEndpoint()
+		client := newClient()
+		_, err := ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		_, _, err = ep.GetTagsExplained(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		client.AssertNumberOfCalls(t, "ManifestV2", 6)
+	})
+}
@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/Masterminds/semver"
+)
+
+// TagExplanation describes the outcome of resolving the tag to update an
+// image to for a single tag in the registry
+type TagExplanation struct {
+	TagName string
+	// Excluded is true if the tag was not considered for update
+	Excluded bool
+	// Selected is true if the tag is the one the image would be updated to
+	Selected bool
+	// Reason describes why the tag was excluded, prefixed by the filter stage
+	// that rejected it, or the role of the tag if it was not excluded.
+	Reason string
+}
+
+// ExplainTags resolves the tag to update img to the same way an update does,
+// without updating anything, and returns the outcome for each tag in the
+// registry, ordered by tag name. The selection is returned as well, along with
+// warnings about a likely misconfiguration of the constraint. This is meant
+// for diagnosing why a tag is or is not picked up.
+func (endpoint *RegistryEndpoint) ExplainTags(ctx context.Context, img *image.ContainerImage, regClient RegistryClient, vc *image.VersionConstraint) ([]TagExplanation, *image.VersionSelection, error) {
+	explainVC := *vc
+	explainVC.Explain = true
+
+	tagList, excluded, err := endpoint.GetTagsExplained(ctx, img, regClient, &explainVC)
+	if err != nil {
+		return nil, nil, err
+	}
+	selection, err := img.SelectVersionFromTags(endpoint.withSignatureVerifier(ctx, img, regClient, &explainVC), tagList)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range selection.Excluded {
+		excluded[k] = v
+	}
+
+	candidates := make(map[string]*tag.ImageTag, len(selection.Candidates))
+	for _, t := range selection.Candidates {
+		candidates[t.TagName] = t
+	}
+
+	names := tagList.Tags()
+	for name := range excluded {
+		if tagList.Get(name) == nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if warning := explainVC.SemverWarning(names); warning != "" {
+		selection.Warnings = append(selection.Warnings, warning)
+	}
+
+	explanations := make([]TagExplanation, 0, len(names))
+	for _, name := range names {
+		e := TagExplanation{TagName: name}
+		switch {
+		case candidates[name] != nil && selection.Selected != nil && name == selection.Selected.TagName:
+			e.Selected = true
+			e.Reason = "selected"
+		case candidates[name] != nil && !isNewerVersion(img, name, &explainVC):
+			e.Excluded = true
+			e.Reason = fmt.Sprintf("current-version: not newer than current version %s", img.ImageTag.TagName)
+		case candidates[name] != nil:
+			e.Reason = "candidate"
+		case excluded[name] != "":
+			e.Excluded = true
+			e.Reason = excluded[name]
+		case candidates[name+vc.VariantSuffix] != nil:
+			e.Reason = fmt.Sprintf("variant: replaced by its variant %s%s", name, vc.VariantSuffix)
+		default:
+			e.Excluded = true
+			e.Reason = "not considered"
+		}
+		explanations = append(explanations, e)
+	}
+	return explanations, selection, nil
+}
+
+// isNewerVersion returns whether tagName is a newer semantic version than the
+// current tag of img. If the versions cannot be compared, it returns true.
+func isNewerVersion(img *image.ContainerImage, tagName string, vc *image.VersionConstraint) bool {
+	c, ok := compareWithCurrent(img, tagName, vc)
+	return !ok || c > 0
+}
+
+// isOlderVersion returns whether tagName is an older semantic version than the
+// current tag of img. If the versions cannot be compared, it returns false.
+func isOlderVersion(img *image.ContainerImage, tagName string, vc *image.VersionConstraint) bool {
+	c, ok := compareWithCurrent(img, tagName, vc)
+	return ok && c < 0
+}
+
+// compareWithCurrent compares the semantic version of tagName with the one of
+// the current tag of img, like semver.Version.Compare does. The second value
+// is false if the versions cannot be compared, i.e. when not sorting by
+// semver or if either tag is no semantic version.
+func compareWithCurrent(img *image.ContainerImage, tagName string, vc *image.VersionConstraint) (int, bool) {
+	if vc.SortMode != image.VersionSortSemVer || img == nil || img.ImageTag == nil {
+		return 0, false
+	}
+	current, _ := image.NormalizeTag(img.ImageTag.TagName, vc)
+	candidate, _ := image.NormalizeTag(tagName, vc)
+	curVer, err := semver.NewVersion(strings.TrimSuffix(current, vc.VariantSuffix))
+	if err != nil {
+		return 0, false
+	}
+	ver, err := semver.NewVersion(strings.TrimSuffix(candidate, vc.VariantSuffix))
+	if err != nil {
+		return 0, false
+	}
+	return ver.Compare(curVer), true
+}
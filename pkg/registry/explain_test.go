@@ -0,0 +1,92 @@
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ExplainTags(t *testing.T) {
+	t.Run("Warn if no tag is a semantic version", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"latest", "stable"}, nil)
+
+		ep, err := GetRegistryEndpoint("")
+		require.NoError(t, err)
+
+		img := image.NewFromIdentifier("foo/bar")
+		explanations, selection, err := ep.ExplainTags(context.Background(), img, &regClient, &image.VersionConstraint{})
+		require.NoError(t, err)
+		assert.Len(t, explanations, 2)
+		require.Len(t, selection.Warnings, 1)
+		assert.Contains(t, selection.Warnings[0], "none of the 2 tags is a semantic version (latest, stable)")
+
+		_, selection, err = ep.ExplainTags(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortName})
+		require.NoError(t, err)
+		assert.Empty(t, selection.Warnings)
+	})
+
+	t.Run("Explain outcome for each tag", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.1.0", "1.2.0", "1.2.1", "1.3.0", "2.0.0", "pr-42", "latest"}, nil)
+
+		ep, err := GetRegistryEndpoint("")
+		require.NoError(t, err)
+
+		img := image.NewFromIdentifier("foo/bar:1.2.0")
+		vc := &image.VersionConstraint{Constraint: "1.x", IgnoreList: []string{"pr-*"}}
+		explanations, selection, err := ep.ExplainTags(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "1.3.0", selection.Selected.TagName)
+		assert.False(t, vc.Explain)
+
+		assert.Equal(t, []TagExplanation{
+			{TagName: "1.1.0", Excluded: true, Reason: "current-version: not newer than current version 1.2.0"},
+			{TagName: "1.2.0", Excluded: true, Reason: "current-version: not newer than current version 1.2.0"},
+			{TagName: "1.2.1", Reason: "candidate"},
+			{TagName: "1.3.0", Selected: true, Reason: "selected"},
+			{TagName: "2.0.0", Excluded: true, Reason: "constraint: does not satisfy constraint 1.x"},
+			{TagName: "latest", Excluded: true, Reason: "semver: not a valid semantic version"},
+			{TagName: "pr-42", Excluded: true, Reason: "ignore-tags: excluded by ignore pattern pr-*"},
+		}, explanations)
+	})
+
+	t.Run("Explain outcome with variants", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.0", "1.0.0-alpine", "1.1.0"}, nil)
+
+		ep, err := GetRegistryEndpoint("")
+		require.NoError(t, err)
+
+		img := image.NewFromIdentifier("foo/bar:1.0.0-alpine")
+		vc := &image.VersionConstraint{VariantSuffix: "-alpine"}
+		explanations, selection, err := ep.ExplainTags(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.Equal(t, "1.0.0-alpine", selection.Selected.TagName)
+		assert.Equal(t, []TagExplanation{
+			{TagName: "1.0.0", Reason: "variant: replaced by its variant 1.0.0-alpine"},
+			{TagName: "1.0.0-alpine", Selected: true, Reason: "selected"},
+			{TagName: "1.1.0", Excluded: true, Reason: "variant: no variant 1.1.0-alpine exists"},
+		}, explanations)
+	})
+
+	t.Run("Error fetching tags", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return(nil, assert.AnError)
+
+		ep, err := GetRegistryEndpoint("")
+		require.NoError(t, err)
+
+		explanations, selection, err := ep.ExplainTags(context.Background(), image.NewFromIdentifier("foo/bar:1.0.0"), &regClient, &image.VersionConstraint{})
+		assert.Error(t, err)
+		assert.Nil(t, explanations)
+		assert.Nil(t, selection)
+	})
+}
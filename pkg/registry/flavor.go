@@ -0,0 +1,214 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// RegistryFlavor defines the kind of registry software that serves an
+// endpoint. Some registries provide additional APIs on top of the Docker
+// registry API, which we can make use of if we know about them.
+type RegistryFlavor int
+
+const (
+	FlavorGeneric   RegistryFlavor = 0
+	FlavorDockerHub RegistryFlavor = 1
+	FlavorGitLab    RegistryFlavor = 2
+	FlavorQuay      RegistryFlavor = 3
+)
+
+// RegistryFlavorFromString gets the RegistryFlavor value from a given string
+func RegistryFlavorFromString(flavor string) RegistryFlavor {
+	switch strings.ToLower(flavor) {
+	case "dockerhub":
+		return FlavorDockerHub
+	case "gitlab":
+		return FlavorGitLab
+	case "quay":
+		return FlavorQuay
+	case "generic", "":
+		return FlavorGeneric
+	default:
+		log.Warnf("unknown registry flavor: %s", flavor)
+		return FlavorGeneric
+	}
+}
+
+// String returns the string representation of a RegistryFlavor
+func (rf RegistryFlavor) String() string {
+	switch rf {
+	case FlavorDockerHub:
+		return "dockerhub"
+	case FlavorGitLab:
+		return "gitlab"
+	case FlavorQuay:
+		return "quay"
+	default:
+		return "generic"
+	}
+}
+
+// HasTagDates returns whether registries of this flavor can list the dates
+// of all tags of a repository at once.
+func (rf RegistryFlavor) HasTagDates() bool {
+	return rf == FlavorGitLab || rf == FlavorQuay
+}
+
+// PullCountClient is implemented by registry clients that are able to provide
+// the number of pulls for the tags of a repository. None of the registry
+// flavors provides it, since e.g. Docker Hub only reports the number of pulls
+// of a whole repository.
+type PullCountClient interface {
+	// TagPullCounts returns a map of tag names to the number of pulls. Tags
+	// for which no pull count is known are not contained in the map.
+	TagPullCounts(ctx context.Context, nameInRepository string) (map[string]int64, error)
+}
+
+// TagDateClient is implemented by registry clients that are able to provide
+// the creation dates for the tags of a repository without fetching the meta
+// data for each tag.
+type TagDateClient interface {
+	// TagDates returns a map of tag names to their dates. Tags for which no
+	// date is known are not contained in the map.
+	TagDates(ctx context.Context, nameInRepository string) (map[string]time.Time, error)
+}
+
+// TagDates returns the dates for the tags in given repository, if the
+// endpoint's flavor supports it.
+func (client *registryClient) TagDates(ctx context.Context, nameInRepository string) (map[string]time.Time, error) {
+	switch client.flavor {
+	case FlavorGitLab:
+		return client.gitlabTagDates(ctx, nameInRepository)
+	case FlavorQuay:
+		return client.quayTagDates(ctx, nameInRepository)
+	default:
+		return nil, fmt.Errorf("registry flavor %s does not provide tag dates", client.flavor)
+	}
+}
+
+// sameHostURL resolves the link to a next page returned for a request to base,
+// and returns an error if the link points to another host than base, so that
+// credentials are never sent to other hosts.
+func sameHostURL(base *url.URL, link string) (string, error) {
+	ref, err := url.Parse(link)
+	if err != nil {
+		return "", fmt.Errorf("invalid link to next page: %v", err)
+	}
+	u := base.ResolveReference(ref)
+	if u.Scheme != base.Scheme || !strings.EqualFold(u.Host, base.Host) {
+		return "", fmt.Errorf("not following link to next page on other host %s://%s", u.Scheme, u.Host)
+	}
+	return u.String(), nil
+}
+
+// linkNextRegexp matches the URL of the next page in a Link header
+var linkNextRegexp = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="next"`)
+
+// gitlabTagDates retrieves the tag dates from the tag list API of the GitLab
+// container registry, following its pagination.
+func (client *registryClient) gitlabTagDates(ctx context.Context, nameInRepository string) (map[string]time.Time, error) {
+	var page []struct {
+		Name        string `json:"name"`
+		CreatedAt   string `json:"created_at"`
+		PublishedAt string `json:"published_at"`
+	}
+
+	dates := make(map[string]time.Time)
+	httpClient := client.withContext(ctx).Client
+	next := fmt.Sprintf("%s/gitlab/v1/repositories/%s/tags/list/?n=1000", client.regClient.URL, nameInRepository)
+	for next != "" {
+		resp, err := httpClient.Get(next)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, client.statusError(resp, "could not get tags from GitLab API")
+		}
+		page = nil
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page {
+			ts := r.PublishedAt
+			if ts == "" {
+				ts = r.CreatedAt
+			}
+			date, err := time.Parse(time.RFC3339Nano, ts)
+			if err != nil {
+				log.Debugf("could not parse date of tag %s: %v", r.Name, err)
+				continue
+			}
+			dates[r.Name] = date
+		}
+		if next, err = nextPageURL(resp); err != nil {
+			return nil, err
+		}
+	}
+	return dates, nil
+}
+
+// Layout of the last_modified field of tags in Quay's tag API
+const quayDateLayout = "Mon, 02 Jan 2006 15:04:05 -0700"
+
+// quayTagDates retrieves the tag dates from Quay's tag API, following its
+// pagination. The API only lists tags of public repositories, unless it is
+// given an OAuth token.
+func (client *registryClient) quayTagDates(ctx context.Context, nameInRepository string) (map[string]time.Time, error) {
+	var page struct {
+		Tags []struct {
+			Name         string `json:"name"`
+			StartTS      int64  `json:"start_ts"`
+			LastModified string `json:"last_modified"`
+		} `json:"tags"`
+		HasAdditional bool `json:"has_additional"`
+	}
+
+	dates := make(map[string]time.Time)
+	httpClient := client.withContext(ctx).Client
+	for pageNum := 1; ; pageNum++ {
+		if pageNum > MaxTagListPages {
+			return nil, fmt.Errorf("tag list of %s has more than %d pages", nameInRepository, MaxTagListPages)
+		}
+		resp, err := httpClient.Get(fmt.Sprintf("%s/api/v1/repository/%s/tag/?onlyActiveTags=true&limit=100&page=%d", client.regClient.URL, nameInRepository, pageNum))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, client.statusError(resp, "could not get tags from Quay API")
+		}
+		page.Tags = nil
+		page.HasAdditional = false
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range page.Tags {
+			if r.StartTS > 0 {
+				dates[r.Name] = time.Unix(r.StartTS, 0).UTC()
+				continue
+			}
+			date, err := time.Parse(quayDateLayout, r.LastModified)
+			if err != nil {
+				log.Debugf("could not parse date of tag %s: %v", r.Name, err)
+				continue
+			}
+			dates[r.Name] = date
+		}
+		if !page.HasAdditional {
+			return dates, nil
+		}
+	}
+}
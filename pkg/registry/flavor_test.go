@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nokia/docker-registry-client/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_GitLabTagDates(t *testing.T) {
+	t.Run("Get tag dates following pagination", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/gitlab/v1/repositories/group/project/tags/list/", r.URL.Path)
+			if r.URL.Query().Get("last") == "" {
+				w.Header().Set("Link", `</gitlab/v1/repositories/group/project/tags/list/?last=1.0.1&n=1000>; rel="next"`)
+				w.Write([]byte(`[{"name":"1.0.0","created_at":"2020-10-01T10:00:00Z"},{"name":"1.0.1","created_at":"2020-10-01T10:00:00Z","published_at":"2020-10-02T10:00:00Z"}]`))
+				return
+			}
+			w.Write([]byte(`[{"name":"1.0.2","created_at":"2020-10-03T10:00:00Z"},{"name":"broken","created_at":""}]`))
+		}))
+		defer srv.Close()
+
+		client := &registryClient{regClient: &registry.Registry{URL: srv.URL, Client: srv.Client()}, flavor: FlavorGitLab}
+		dates, err := client.TagDates(context.Background(), "group/project")
+		require.NoError(t, err)
+		require.Len(t, dates, 3)
+		assert.Equal(t, "2020-10-01T10:00:00Z", dates["1.0.0"].Format("2006-01-02T15:04:05Z07:00"))
+		assert.Equal(t, "2020-10-02T10:00:00Z", dates["1.0.1"].Format("2006-01-02T15:04:05Z07:00"))
+		assert.Equal(t, "2020-10-03T10:00:00Z", dates["1.0.2"].Format("2006-01-02T15:04:05Z07:00"))
+	})
+
+	t.Run("Flavor without tag dates", func(t *testing.T) {
+		client := &registryClient{flavor: FlavorGeneric}
+		_, err := client.TagDates(context.Background(), "group/project")
+		assert.Error(t, err)
+	})
+}
+
+func Test_QuayTagDates(t *testing.T) {
+	t.Run("Get tag dates following pagination", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/api/v1/repository/org/project/tag/", r.URL.Path)
+			assert.Equal(t, "true", r.URL.Query().Get("onlyActiveTags"))
+			if r.URL.Query().Get("page") == "1" {
+				w.Write([]byte(`{"tags":[{"name":"1.0.0","start_ts":1601546400,"last_modified":"Thu, 01 Oct 2020 10:00:00 -0000"},{"name":"1.0.1","last_modified":"Fri, 02 Oct 2020 10:00:00 -0000"}],"page":1,"has_additional":true}`))
+				return
+			}
+			assert.Equal(t, "2", r.URL.Query().Get("page"))
+			w.Write([]byte(`{"tags":[{"name":"1.0.2","start_ts":1601719200},{"name":"broken","last_modified":"yesterday"}],"page":2,"has_additional":false}`))
+		}))
+		defer srv.Close()
+
+		client := &registryClient{regClient: &registry.Registry{URL: srv.URL, Client: srv.Client()}, flavor: FlavorQuay}
+		dates, err := client.TagDates(context.Background(), "org/project")
+		require.NoError(t, err)
+		require.Len(t, dates, 3)
+		assert.Equal(t, "2020-10-01T10:00:00Z", dates["1.0.0"].UTC().Format("2006-01-02T15:04:05Z07:00"))
+		assert.Equal(t, "2020-10-02T10:00:00Z", dates["1.0.1"].UTC().Format("2006-01-02T15:04:05Z07:00"))
+		assert.Equal(t, "2020-10-03T10:00:00Z", dates["1.0.2"].UTC().Format("2006-01-02T15:04:05Z07:00"))
+	})
+
+	t.Run("Error from Quay API", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}))
+		defer srv.Close()
+
+		client := &registryClient{regClient: &registry.Registry{URL: srv.URL, Client: srv.Client()}, flavor: FlavorQuay}
+		_, err := client.TagDates(context.Background(), "org/private")
+		assert.Error(t, err)
+	})
+}
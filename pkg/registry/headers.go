@@ -0,0 +1,164 @@
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// Name of the header carrying the ID of a request
+const requestIDHeader = "X-Request-ID"
+
+// Time after which the values of static headers are read from their sources
+// again, so that rotated values are picked up
+const headerRefreshInterval = time.Minute
+
+// parseHeaderSource parses the definition of a header's value, which is
+// either env:<name> to read it from an environment variable, or file:<path>
+// to read it from a file. Returns the scheme and the variable name or path.
+// As a malformed definition might be a secret given literally, it is not
+// part of returned errors.
+func parseHeaderSource(definition string) (string, string, error) {
+	tokens := strings.SplitN(definition, ":", 2)
+	if len(tokens) != 2 || tokens[1] == "" {
+		return "", "", fmt.Errorf("header source must be env:<name> or file:<path>")
+	}
+	scheme := strings.ToLower(tokens[0])
+	switch scheme {
+	case "env":
+	case "file":
+		if !strings.HasPrefix(tokens[1], "/") {
+			return "", "", fmt.Errorf("path to header file must be absolute, but is '%s'", tokens[1])
+		}
+	default:
+		return "", "", fmt.Errorf("header source must be env:<name> or file:<path>")
+	}
+	return scheme, tokens[1], nil
+}
+
+// resolveHeaders resolves the values of the given headers from their sources.
+// As the values are usually secrets, they are never part of returned errors.
+func resolveHeaders(definitions map[string]string) (http.Header, error) {
+	headers := make(http.Header, len(definitions))
+	for name, definition := range definitions {
+		scheme, ref, err := parseHeaderSource(definition)
+		if err != nil {
+			return nil, fmt.Errorf("invalid header %s: %v", name, err)
+		}
+		var value string
+		switch scheme {
+		case "env":
+			value = os.Getenv(ref)
+			if value == "" {
+				return nil, fmt.Errorf("could not fetch header %s: env '%s' is not set", name, ref)
+			}
+		case "file":
+			data, err := ioutil.ReadFile(ref)
+			if err != nil {
+				return nil, fmt.Errorf("could not read header %s from %s: %v", name, ref, err)
+			}
+			value = strings.TrimSpace(string(data))
+			if value == "" {
+				return nil, fmt.Errorf("could not fetch header %s: %s is empty", name, ref)
+			}
+		}
+		headers.Set(name, value)
+	}
+	return headers, nil
+}
+
+// refreshHeaders reads the values of the endpoint's static headers from their
+// sources, if they have not been read within headerRefreshInterval. If they
+// cannot be read again, the previous values are kept. Callers must hold the
+// endpoint's lock.
+func (ep *RegistryEndpoint) refreshHeaders() error {
+	if len(ep.Headers) == 0 || (ep.headers != nil && time.Since(ep.headersResolved) < headerRefreshInterval) {
+		return nil
+	}
+	headers, err := resolveHeaders(ep.Headers)
+	if err != nil {
+		if ep.headers != nil {
+			log.Warnf("could not refresh headers for registry %s, keeping previous values: %v", ep.RegistryAPI, err)
+			return nil
+		}
+		return fmt.Errorf("could not set headers for registry %s: %v", ep.RegistryAPI, err)
+	}
+	ep.headers = headers
+	ep.headersResolved = time.Now()
+	return nil
+}
+
+// headerTransport sets static headers on all requests sent to the host of a
+// registry endpoint. Requests to other hosts, i.e. to an external token
+// service or to a storage backend the registry redirects to, are sent as
+// they are, so that the headers never leave the endpoint.
+type headerTransport struct {
+	host      string
+	headers   http.Header
+	transport http.RoundTripper
+}
+
+// newHeaderTransport returns a transport setting the given headers on
+// requests to the host of the given registry API URL
+func newHeaderTransport(registryAPI string, headers http.Header, transport http.RoundTripper) (*headerTransport, error) {
+	u, err := url.Parse(registryAPI)
+	if err != nil {
+		return nil, err
+	}
+	return &headerTransport{host: u.Host, headers: headers, transport: transport}, nil
+}
+
+// RoundTrip performs the request, with the transport's headers set if it is
+// sent to the endpoint's host
+func (ht *headerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if !strings.EqualFold(r.URL.Host, ht.host) {
+		return ht.transport.RoundTrip(r)
+	}
+	r = r.Clone(r.Context())
+	for name, values := range ht.headers {
+		r.Header[name] = values
+	}
+	return ht.transport.RoundTrip(r)
+}
+
+// userAgentTransport identifies all requests it sends by the user agent, and
+// optionally by a unique ID per request, so that registry operators can tell
+// our requests apart. Static headers of the endpoint take precedence, so the
+// transport must wrap the headerTransport.
+type userAgentTransport struct {
+	userAgent string
+	requestID bool
+	transport http.RoundTripper
+}
+
+// RoundTrip performs the request with the user agent and request ID set
+func (uat *userAgentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("User-Agent", uat.userAgent)
+	if uat.requestID {
+		id, err := newRequestID()
+		if err != nil {
+			return nil, err
+		}
+		r.Header.Set(requestIDHeader, id)
+		log.Tracef("sending %s request to %s%s with request ID %s", r.Method, r.URL.Host, r.URL.Path, id)
+	}
+	return uat.transport.RoundTrip(r)
+}
+
+// newRequestID returns a random ID for a request
+func newRequestID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("could not generate request ID: %v", err)
+	}
+	return hex.EncodeToString(id), nil
+}
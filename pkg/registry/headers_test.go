@@ -0,0 +1,199 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ResolveHeaders(t *testing.T) {
+	t.Run("Resolve headers from env and file", func(t *testing.T) {
+		os.Setenv("TEST_REGISTRY_TOKEN", "s3cr3t")
+		defer os.Unsetenv("TEST_REGISTRY_TOKEN")
+		dir, err := ioutil.TempDir("", "headers")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "tenant")
+		require.NoError(t, ioutil.WriteFile(path, []byte("acme\n"), 0600))
+
+		headers, err := resolveHeaders(map[string]string{
+			"X-Registry-Token": "env:TEST_REGISTRY_TOKEN",
+			"x-tenant":         "file:" + path,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, "s3cr3t", headers.Get("X-Registry-Token"))
+		assert.Equal(t, "acme", headers.Get("X-Tenant"))
+	})
+
+	t.Run("Unset env variable", func(t *testing.T) {
+		_, err := resolveHeaders(map[string]string{"X-Registry-Token": "env:TEST_REGISTRY_TOKEN_UNSET"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "env 'TEST_REGISTRY_TOKEN_UNSET' is not set")
+	})
+
+	t.Run("Invalid header sources", func(t *testing.T) {
+		for _, definition := range []string{"s3cr3t", "Bearer:s3cr3t", "env:", "file:relative/path"} {
+			_, err := resolveHeaders(map[string]string{"X-Registry-Token": definition})
+			require.Error(t, err, definition)
+			assert.NotContains(t, err.Error(), "s3cr3t")
+		}
+	})
+}
+
+func Test_HeaderTransport(t *testing.T) {
+	var seen []string
+	rt := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		seen = append(seen, r.Header.Get("X-Registry-Token"))
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	})
+	headers := http.Header{}
+	headers.Set("X-Registry-Token", "s3cr3t")
+	ht, err := newHeaderTransport("https://Registry.example.com", headers, rt)
+	require.NoError(t, err)
+
+	req, _ := http.NewRequest(http.MethodGet, "https://registry.example.com/v2/", nil)
+	_, err = ht.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Empty(t, req.Header.Get("X-Registry-Token"), "original request must not be modified")
+
+	req, _ = http.NewRequest(http.MethodGet, "https://auth.example.com/token", nil)
+	_, err = ht.RoundTrip(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"s3cr3t", ""}, seen)
+}
+
+func Test_EndpointHeaders(t *testing.T) {
+	os.Setenv("TEST_REGISTRY_TOKEN", "s3cr3t")
+	defer os.Unsetenv("TEST_REGISTRY_TOKEN")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Registry-Token") != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"name":"foo/bar","tags":["1.0"]}`)
+	}))
+	defer srv.Close()
+
+	t.Run("Headers are sent once resolved", func(t *testing.T) {
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.Headers = map[string]string{"X-Registry-Token": "env:TEST_REGISTRY_TOKEN"}
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		tags, err := client.Tags(context.Background(), "foo/bar")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.0"}, tags)
+	})
+
+	t.Run("Headers are not shared with other endpoints", func(t *testing.T) {
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		_, err = client.Tags(context.Background(), "foo/bar")
+		assert.Error(t, err)
+	})
+
+	t.Run("Headers are read again after refresh interval", func(t *testing.T) {
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.Headers = map[string]string{"X-Registry-Token": "env:TEST_REGISTRY_TOKEN_ROTATED"}
+		os.Setenv("TEST_REGISTRY_TOKEN_ROTATED", "old")
+		defer os.Unsetenv("TEST_REGISTRY_TOKEN_ROTATED")
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		assert.Equal(t, "old", ep.headers.Get("X-Registry-Token"))
+
+		os.Setenv("TEST_REGISTRY_TOKEN_ROTATED", "new")
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		assert.Equal(t, "old", ep.headers.Get("X-Registry-Token"))
+
+		ep.headersResolved = time.Now().Add(-headerRefreshInterval)
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		assert.Equal(t, "new", ep.headers.Get("X-Registry-Token"))
+
+		// Previous values are kept if the source cannot be read
+		os.Unsetenv("TEST_REGISTRY_TOKEN_ROTATED")
+		ep.headersResolved = time.Now().Add(-headerRefreshInterval)
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		assert.Equal(t, "new", ep.headers.Get("X-Registry-Token"))
+	})
+
+	t.Run("Unresolvable headers are reported", func(t *testing.T) {
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.Headers = map[string]string{"X-Registry-Token": "env:TEST_REGISTRY_TOKEN_UNSET"}
+		err := ep.SetEndpointCredentials(nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "X-Registry-Token")
+	})
+}
+
+func Test_EndpointUserAgent(t *testing.T) {
+	var userAgents, requestIDs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		requestIDs = append(requestIDs, r.Header.Get(requestIDHeader))
+		fmt.Fprint(w, `{"name":"foo/bar","tags":["1.0"]}`)
+	}))
+	defer srv.Close()
+	defer SetDefaultUserAgent("")
+	defer SetDefaultRequestID(false)
+
+	fetch := func(ep *RegistryEndpoint) {
+		require.NoError(t, ep.SetEndpointCredentials(nil))
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		_, err = client.Tags(context.Background(), "foo/bar")
+		require.NoError(t, err)
+	}
+
+	t.Run("Default user agent without request ID", func(t *testing.T) {
+		userAgents, requestIDs = nil, nil
+		fetch(newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0))
+		assert.Equal(t, []string{DefaultUserAgent()}, userAgents)
+		assert.Contains(t, DefaultUserAgent(), "argocd-image-updater/")
+		assert.Equal(t, []string{""}, requestIDs)
+	})
+
+	t.Run("User agent and request ID of endpoint", func(t *testing.T) {
+		userAgents, requestIDs = nil, nil
+		SetDefaultUserAgent("global")
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.UserAgent = "team-a"
+		ep.RequestID = true
+		fetch(ep)
+		fetch(ep)
+		assert.Equal(t, []string{"team-a", "team-a"}, userAgents)
+		require.Len(t, requestIDs, 2)
+		assert.Len(t, requestIDs[0], 32)
+		assert.NotEqual(t, requestIDs[0], requestIDs[1])
+	})
+
+	t.Run("Global user agent and request ID", func(t *testing.T) {
+		userAgents, requestIDs = nil, nil
+		SetDefaultUserAgent("global")
+		SetDefaultRequestID(true)
+		fetch(newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0))
+		assert.Equal(t, []string{"global"}, userAgents)
+		assert.NotEmpty(t, requestIDs[0])
+	})
+
+	t.Run("Static header takes precedence", func(t *testing.T) {
+		userAgents, requestIDs = nil, nil
+		os.Setenv("TEST_REGISTRY_USER_AGENT", "static")
+		defer os.Unsetenv("TEST_REGISTRY_USER_AGENT")
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.UserAgent = "team-a"
+		ep.Headers = map[string]string{"User-Agent": "env:TEST_REGISTRY_USER_AGENT"}
+		fetch(ep)
+		assert.Equal(t, []string{"static"}, userAgents)
+	})
+}
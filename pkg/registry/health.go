@@ -0,0 +1,106 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nokia/docker-registry-client/registry"
+)
+
+// HealthClient is implemented by registry clients that are able to request
+// the base endpoint of the registry's API
+type HealthClient interface {
+	// CheckBase requests the base endpoint of the registry's API and returns
+	// the HTTP status, along with the API version advertised by the registry.
+	// An error is only returned if the registry did not respond.
+	CheckBase(ctx context.Context) (int, string, error)
+}
+
+// HealthStatus is the result of checking the health of a registry endpoint
+type HealthStatus struct {
+	// Whether the registry's API responded
+	Reachable bool
+	// Whether the registry granted access to its API, either using the
+	// client's credentials or anonymously
+	Authenticated bool
+	// The API version advertised by the registry, i.e. registry/2.0
+	APIVersion string
+	// The HTTP status the registry responded with, or 0 if it did not
+	StatusCode int
+	// How long it took to check the registry
+	Duration time.Duration
+	// Why the endpoint is not healthy, or nil if it is
+	Err error
+}
+
+// Healthy returns true if the registry is reachable and granted access
+func (hs *HealthStatus) Healthy() bool {
+	return hs.Reachable && hs.Authenticated
+}
+
+// noAnonymousFallbackKey is the key of the context value that disables the
+// anonymous fallback for a request, so that rejected credentials are noticed
+type noAnonymousFallbackKey struct{}
+
+// HealthCheck checks whether the registry can be reached and grants access
+// to its API, by requesting its base endpoint /v2/ using the given client.
+// Authentication is performed as for any other request, except that
+// rejected credentials are reported instead of falling back to anonymous
+// access.
+func (endpoint *RegistryEndpoint) HealthCheck(ctx context.Context, regClient RegistryClient) *HealthStatus {
+	hs := &HealthStatus{}
+	hc, ok := regClient.(HealthClient)
+	if !ok {
+		hs.Err = fmt.Errorf("registry client for %s cannot check the registry's health", endpoint.RegistryAPI)
+		return hs
+	}
+
+	start := time.Now()
+	statusCode, apiVersion, err := hc.CheckBase(context.WithValue(ctx, noAnonymousFallbackKey{}, true))
+	hs.Duration = time.Since(start)
+	if err != nil {
+		hs.Err = fmt.Errorf("registry %s is not reachable: %v", endpoint.RegistryAPI, err)
+		return hs
+	}
+
+	hs.Reachable = true
+	hs.StatusCode = statusCode
+	hs.APIVersion = apiVersion
+	switch {
+	case statusCode == http.StatusOK:
+		hs.Authenticated = true
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		hs.Err = fmt.Errorf("registry %s denied access: %s", endpoint.RegistryAPI, http.StatusText(statusCode))
+	case statusCode == http.StatusNotFound:
+		hs.Err = fmt.Errorf("registry %s has no API at /v2/, check its API URL", endpoint.RegistryAPI)
+	default:
+		hs.Err = fmt.Errorf("registry %s responded with unexpected status: %d %s", endpoint.RegistryAPI, statusCode, http.StatusText(statusCode))
+	}
+	return hs
+}
+
+// CheckBase requests the base endpoint /v2/ of the registry's API
+func (client *registryClient) CheckBase(ctx context.Context) (_ int, _ string, err error) {
+	defer func() { client.recordCall("base", err) }()
+	return getBase(client.withContext(ctx))
+}
+
+// getBase requests the base endpoint /v2/ of the given registry's API and
+// returns the HTTP status, along with the API version advertised by the
+// registry. An error is only returned if the registry did not respond.
+func getBase(reg *registry.Registry) (int, string, error) {
+	resp, err := reg.Client.Get(reg.URL + "/v2/")
+	if err != nil {
+		// Error responses are returned as errors by the registry client
+		var hse *registry.HttpStatusError
+		if errors.As(err, &hse) && hse.Response != nil {
+			return hse.Response.StatusCode, hse.Response.Header.Get("Docker-Distribution-API-Version"), nil
+		}
+		return 0, "", err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, resp.Header.Get("Docker-Distribution-API-Version"), nil
+}
@@ -0,0 +1,89 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/mocks"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_HealthCheck(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/v2/" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		if username, password, ok := r.BasicAuth(); ok && (username != "user" || password != "secret") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	checkHealth := func(apiURL, username, password string) *HealthStatus {
+		ep := newRegistryEndpoint("example.com", "Example", apiURL, "", "", false, SortUnsorted, 0, 0)
+		client, err := NewClient(ep, username, password)
+		require.NoError(t, err)
+		return ep.HealthCheck(context.Background(), client)
+	}
+
+	t.Run("Healthy registry with credentials", func(t *testing.T) {
+		hs := checkHealth(srv.URL, "user", "secret")
+		require.NoError(t, hs.Err)
+		assert.True(t, hs.Healthy())
+		assert.True(t, hs.Reachable)
+		assert.True(t, hs.Authenticated)
+		assert.Equal(t, "registry/2.0", hs.APIVersion)
+		assert.Equal(t, http.StatusOK, hs.StatusCode)
+	})
+
+	t.Run("Healthy registry with anonymous access", func(t *testing.T) {
+		hs := checkHealth(srv.URL, "", "")
+		require.NoError(t, hs.Err)
+		assert.True(t, hs.Healthy())
+	})
+
+	t.Run("Rejected credentials don't fall back to anonymous access", func(t *testing.T) {
+		requests = 0
+		hs := checkHealth(srv.URL, "user", "stale")
+		require.Error(t, hs.Err)
+		assert.Contains(t, hs.Err.Error(), "denied access")
+		assert.False(t, hs.Healthy())
+		assert.True(t, hs.Reachable)
+		assert.False(t, hs.Authenticated)
+		assert.Equal(t, http.StatusUnauthorized, hs.StatusCode)
+		assert.Equal(t, 1, requests)
+	})
+
+	t.Run("Wrong API URL", func(t *testing.T) {
+		hs := checkHealth(srv.URL+"/registry", "", "")
+		require.Error(t, hs.Err)
+		assert.Contains(t, hs.Err.Error(), "check its API URL")
+		assert.True(t, hs.Reachable)
+		assert.False(t, hs.Authenticated)
+	})
+
+	t.Run("Registry not reachable", func(t *testing.T) {
+		hs := checkHealth("http://127.0.0.1:1", "", "")
+		require.Error(t, hs.Err)
+		assert.Contains(t, hs.Err.Error(), "is not reachable")
+		assert.False(t, hs.Reachable)
+		assert.Equal(t, 0, hs.StatusCode)
+	})
+
+	t.Run("Client without health check support", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com"}
+		hs := ep.HealthCheck(context.Background(), &mocks.RegistryClient{})
+		require.Error(t, hs.Err)
+		assert.False(t, hs.Healthy())
+	})
+}
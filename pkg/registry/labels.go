@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// imageLabels returns the labels of the image configuration the given tag
+// points to. For tags pointing to an image index, these are the labels of the
+// image for the default platform. Images without creation time are fine, since
+// only the labels are needed.
+func imageLabels(ctx context.Context, regClient RegistryClient, nameInRegistry, tagName string) (map[string]string, error) {
+	ti, err := imageTagInfo(ctx, regClient, nameInRegistry, tagName)
+	if err != nil {
+		return nil, err
+	}
+	return ti.Labels, nil
+}
+
+// mismatchedLabel returns the name of the first of the required labels, in
+// alphabetical order, that is missing from labels or has another value, or
+// the empty string if all required labels are set
+func mismatchedLabel(labels, required map[string]string) string {
+	names := make([]string, 0, len(required))
+	for name := range required {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if value, ok := labels[name]; !ok || value != required[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// filterByLabels removes all tags from the list whose image configuration
+// does not carry each of the labels required by the constraint with the
+// required value. The labels are taken from the cached meta data of the tags
+// where it is used. The labels of the remaining tags are looked up by the
+// digest they point to, so that the configuration of each image is fetched
+// only once, concurrently and limited by the maximum number of streams of the
+// endpoint. When sorting by semver, tags older than the current tag of img
+// cannot be updated to, and are removed without looking up their labels.
+// Tags whose labels cannot be determined are removed as well. Removed tags
+// are recorded in excluded.
+func (endpoint *RegistryEndpoint) filterByLabels(ctx context.Context, img *image.ContainerImage, nameInRegistry string, tags []string, regClient RegistryClient, vc *image.VersionConstraint, excluded image.TagExclusions) []string {
+	labels := make(map[string]map[string]string, len(tags))
+	candidates := []string{}
+	uncached := []string{}
+	for _, t := range tags {
+		if isOlderVersion(img, t, vc) {
+			log.Tracef("Removing tag %s because it is older than the current version", t)
+			excluded.Exclude(t, "labels", "older than current version %s, labels are not checked", img.ImageTag.TagName)
+			continue
+		}
+		candidates = append(candidates, t)
+		if endpoint.imageTagCache() == nil {
+			uncached = append(uncached, t)
+			continue
+		}
+		imgTag, err := endpoint.tagCache(ctx).GetTag(nameInRegistry, t)
+		if err == nil && imgTag != nil && imgTag.TagInfo != nil && endpoint.usesCachedTag(ctx, nameInRegistry, imgTag) {
+			labels[t] = imgTag.TagInfo.Labels
+		} else {
+			uncached = append(uncached, t)
+		}
+	}
+	_, values := endpoint.filterTagsByDigest(ctx, nameInRegistry, uncached, "labels", "labels", regClient, excluded, func(ctx context.Context, nameInRegistry, reference string) (string, error) {
+		l, err := imageLabels(ctx, regClient, nameInRegistry, reference)
+		if err != nil {
+			return "", err
+		}
+		encoded, err := json.Marshal(l)
+		if err != nil {
+			return "", err
+		}
+		return string(encoded), nil
+	})
+	for t, value := range values {
+		var l map[string]string
+		if err := json.Unmarshal([]byte(value), &l); err != nil {
+			log.Debugf("Could not decode labels of tag %s: %v", t, err)
+		}
+		labels[t] = l
+	}
+
+	kept := []string{}
+	for _, t := range candidates {
+		l, ok := labels[t]
+		if !ok {
+			// Already recorded as excluded by filterTagsByDigest
+			continue
+		}
+		if name := mismatchedLabel(l, vc.RequireLabels); name != "" {
+			log.Debugf("Removing tag %s because its label %s is not %s", t, name, vc.RequireLabels[name])
+			excluded.Exclude(t, "labels", "label %s is not %s", name, vc.RequireLabels[name])
+			continue
+		}
+		kept = append(kept, t)
+	}
+	return kept
+}
@@ -0,0 +1,92 @@
+package registry
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/cache"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/mocks"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MismatchedLabel(t *testing.T) {
+	required := map[string]string{"release.channel": "stable", "team": "core"}
+	assert.Equal(t, "", mismatchedLabel(map[string]string{"release.channel": "stable", "team": "core", "other": "x"}, required))
+	assert.Equal(t, "release.channel", mismatchedLabel(map[string]string{"release.channel": "beta", "team": "core"}, required))
+	assert.Equal(t, "team", mismatchedLabel(map[string]string{"release.channel": "stable"}, required))
+	assert.Equal(t, "release.channel", mismatchedLabel(nil, required))
+}
+
+func Test_GetTagsRequireLabels(t *testing.T) {
+	or := newOCIRegistry()
+	or.addImageWithConfig("1.0", []byte(`{"created":"2021-01-01T00:00:00Z","config":{"Labels":{"release.channel":"stable"}}}`), ociManifestMediaType)
+	or.addImageWithConfig("1.1", []byte(`{"created":"2021-02-01T00:00:00Z","config":{"Labels":{"release.channel":"beta"}}}`), ociManifestMediaType)
+	or.addImageWithConfig("1.2", []byte(`{"created":"2021-03-01T00:00:00Z"}`), ociManifestMediaType)
+	or.addImageWithConfig("1.3", []byte(`{"config":{"Labels":{"release.channel":"stable"}}}`), ociManifestMediaType)
+	srv := httptest.NewServer(or)
+	defer srv.Close()
+	ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+	client, err := NewClient(ep, "", "")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+
+	vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, RequireLabels: map[string]string{"release.channel": "stable"}}
+	tl, excluded, err := ep.GetTagsExplained(context.Background(), img, client, vc)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1.0", "1.3"}, tl.Tags())
+	assert.Equal(t, "labels: label release.channel is not stable", excluded["1.1"])
+	assert.Equal(t, "labels: label release.channel is not stable", excluded["1.2"])
+}
+
+func Test_GetTagsRequireLabelsCached(t *testing.T) {
+	regClient := &mocks.RegistryClient{}
+	regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0", "1.1"}, nil)
+	ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+	for name, channel := range map[string]string{"1.0": "stable", "1.1": "beta"} {
+		imgTag := tag.NewImageTag(name, time.Now())
+		imgTag.TagInfo = &tag.TagInfo{Labels: map[string]string{"release.channel": channel}}
+		ep.Cache.SetTag("foo/bar", imgTag)
+	}
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+
+	// No manifests are fetched, the mock would fail otherwise
+	vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, RequireLabels: map[string]string{"release.channel": "stable"}}
+	tl, excluded, err := ep.GetTagsExplained(context.Background(), img, regClient, vc)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.0"}, tl.Tags())
+	assert.Equal(t, "labels: label release.channel is not stable", excluded["1.1"])
+}
+
+func Test_GetTagsRequireLabelsByDigest(t *testing.T) {
+	or := newOCIRegistry()
+	or.addImageWithConfig("0.9", []byte(`{"config":{"Labels":{"release.channel":"stable"}}}`), ociManifestMediaType)
+	or.addImageWithConfig("1.0", []byte(`{"config":{"Labels":{"release.channel":"stable"}}}`), ociManifestMediaType)
+	or.addImageWithConfig("1.1", []byte(`{"config":{"Labels":{"release.channel":"beta"}}}`), ociManifestMediaType)
+	srv := httptest.NewServer(or)
+	defer srv.Close()
+	ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+	client, err := NewClient(ep, "", "")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+	vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, RequireLabels: map[string]string{"release.channel": "stable"}}
+
+	tl, excluded, err := ep.GetTagsExplained(context.Background(), img, client, vc)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.0"}, tl.Tags())
+	assert.Equal(t, "labels: label release.channel is not stable", excluded["1.1"])
+	assert.Equal(t, "labels: older than current version 1.0, labels are not checked", excluded["0.9"])
+
+	// The labels are known by digest, so no configuration is fetched again
+	or.blobs = map[string][]byte{}
+	tl, excluded, err = ep.GetTagsExplained(context.Background(), img, client, vc)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.0"}, tl.Tags())
+	assert.Equal(t, "labels: label release.channel is not stable", excluded["1.1"])
+}
@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+)
+
+// DefaultPlatform is the platform whose manifest is used from an image index
+// to get the metadata of a multi-platform image
+const DefaultPlatform = "linux/amd64"
+
+// Maximum depth of image indexes nested within each other that is followed
+const maxIndexDepth = 3
+
+// ManifestList returns the image index (manifest list) for a given reference
+// in given repository. An error is returned if the reference does not point
+// to an image index.
+func (client *registryClient) ManifestList(ctx context.Context, repository string, reference string) (_ *manifestlist.DeserializedManifestList, err error) {
+	defer func() { err = client.classifyError(err); client.recordCall("manifest_list", err) }()
+	resp, err := client.manifestRequest(ctx, http.MethodGet, repository, reference)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, client.statusError(resp, "could not get manifest list for %s:%s", repository, reference)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifestList(body)
+}
+
+// ManifestList returns the image index for a given tag or digest in given
+// repository
+func (client *ociLayoutClient) ManifestList(ctx context.Context, repository string, reference string) (*manifestlist.DeserializedManifestList, error) {
+	desc, err := client.descriptor(repository, reference)
+	if err != nil {
+		return nil, err
+	}
+	body, err := client.readBlob(client.layoutDir(repository), desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifestList(body)
+}
+
+// parseManifestList parses an image index, making sure it actually is one
+func parseManifestList(body []byte) (*manifestlist.DeserializedManifestList, error) {
+	list := &manifestlist.DeserializedManifestList{}
+	if err := list.UnmarshalJSON(body); err != nil {
+		return nil, fmt.Errorf("could not parse manifest list: %v", err)
+	}
+	if list.MediaType != "" && !isIndexMediaType(list.MediaType) {
+		return nil, fmt.Errorf("manifest of type %s is not a manifest list", list.MediaType)
+	}
+	if list.MediaType == "" && len(list.Manifests) == 0 {
+		return nil, fmt.Errorf("manifest is not a manifest list")
+	}
+	return list, nil
+}
+
+// platformMatches returns whether the given descriptor is for the platform,
+// which is given as os/arch or os/arch/variant
+func platformMatches(desc manifestlist.ManifestDescriptor, platform string) bool {
+	p := strings.SplitN(platform, "/", 3)
+	if len(p) < 2 || desc.Platform.OS != p[0] || desc.Platform.Architecture != p[1] {
+		return false
+	}
+	return len(p) < 3 || desc.Platform.Variant == p[2]
+}
+
+// platformManifest returns the image manifest for the given platform from the
+// image index that reference points to. Image indexes nested within the index
+// are searched as well. If the index has no manifest for the platform, nil is
+// returned without an error.
+func platformManifest(ctx context.Context, regClient RegistryClient, nameInRegistry, reference, platform string, depth int) (distribution.Manifest, error) {
+	list, err := regClient.ManifestList(ctx, nameInRegistry, reference)
+	if err != nil {
+		return nil, err
+	}
+	return selectPlatformManifest(ctx, regClient, nameInRegistry, reference, list, platform, depth)
+}
+
+// selectPlatformManifest returns the image manifest for the given platform
+// from the image index that reference points to, which has already been
+// fetched, like platformManifest does
+func selectPlatformManifest(ctx context.Context, regClient RegistryClient, nameInRegistry, reference string, list *manifestlist.DeserializedManifestList, platform string, depth int) (distribution.Manifest, error) {
+	for _, desc := range list.Manifests {
+		if isIndexMediaType(desc.MediaType) {
+			if depth >= maxIndexDepth {
+				log.Debugf("not following image index %s nested in %s:%s, too deep", desc.Digest, nameInRegistry, reference)
+				continue
+			}
+			ml, err := platformManifest(ctx, regClient, nameInRegistry, desc.Digest.String(), platform, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if ml != nil {
+				return ml, nil
+			}
+			continue
+		}
+		if platformMatches(desc, platform) {
+			log.Tracef("using manifest %s for platform %s from image index %s:%s", desc.Digest, platform, nameInRegistry, reference)
+			man, _, _, err := imageManifest(ctx, regClient, nameInRegistry, desc.Digest.String())
+			return man, err
+		}
+	}
+	return nil, nil
+}
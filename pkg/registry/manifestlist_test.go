@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/cache"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/mocks"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/nokia/docker-registry-client/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newManifestDescriptor(dgst, mediaType, os, arch string) manifestlist.ManifestDescriptor {
+	desc := manifestlist.ManifestDescriptor{}
+	b, _ := json.Marshal(map[string]interface{}{
+		"mediaType": mediaType,
+		"digest":    dgst,
+		"platform":  map[string]string{"os": os, "architecture": arch},
+	})
+	if err := json.Unmarshal(b, &desc); err != nil {
+		panic(err)
+	}
+	return desc
+}
+
+func newManifestList(descriptors ...manifestlist.ManifestDescriptor) *manifestlist.DeserializedManifestList {
+	list, err := manifestlist.FromDescriptorsWithMediaType(descriptors, "application/vnd.oci.image.index.v1+json")
+	if err != nil {
+		panic(err)
+	}
+	return list
+}
+
+func Test_ManifestList(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/foo/bar/manifests/multi":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			fmt.Fprint(w, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:amd","size":1,"platform":{"architecture":"amd64","os":"linux"}}]}`)
+		case "/v2/foo/bar/manifests/single":
+			w.Header().Set("Content-Type", schema2.MediaTypeManifest)
+			fmt.Fprint(w, `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.v2+json","config":{"digest":"sha256:cfg"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	client := &registryClient{regClient: &registry.Registry{URL: srv.URL, Client: srv.Client()}}
+
+	t.Run("Get manifest list", func(t *testing.T) {
+		list, err := client.ManifestList(context.Background(), "foo/bar", "multi")
+		require.NoError(t, err)
+		require.Len(t, list.Manifests, 1)
+		assert.Equal(t, "sha256:amd", list.Manifests[0].Digest.String())
+		assert.Equal(t, "amd64", list.Manifests[0].Platform.Architecture)
+	})
+	t.Run("Reference is not a manifest list", func(t *testing.T) {
+		_, err := client.ManifestList(context.Background(), "foo/bar", "single")
+		assert.Error(t, err)
+	})
+	t.Run("Reference does not exist", func(t *testing.T) {
+		_, err := client.ManifestList(context.Background(), "foo/bar", "missing")
+		assert.Error(t, err)
+	})
+}
+
+func Test_PlatformManifest(t *testing.T) {
+	amd := &schema2.DeserializedManifest{}
+	t.Run("Select manifest from nested index", func(t *testing.T) {
+		regClient := &mocks.RegistryClient{}
+		regClient.On("ManifestList", mock.Anything, "foo/bar", "1.0").Return(newManifestList(
+			newManifestDescriptor("sha256:arm", "application/vnd.oci.image.manifest.v1+json", "linux", "arm64"),
+			newManifestDescriptor("sha256:nested", "application/vnd.oci.image.index.v1+json", "", ""),
+		), nil)
+		regClient.On("ManifestList", mock.Anything, "foo/bar", "sha256:nested").Return(newManifestList(
+			newManifestDescriptor("sha256:amd", "application/vnd.oci.image.manifest.v1+json", "linux", "amd64"),
+		), nil)
+		regClient.On("ManifestV2", mock.Anything, "foo/bar", "sha256:amd").Return(amd, nil)
+		ml, err := platformManifest(context.Background(), regClient, "foo/bar", "1.0", DefaultPlatform, 0)
+		require.NoError(t, err)
+		assert.Same(t, amd, ml)
+	})
+	t.Run("No manifest for platform", func(t *testing.T) {
+		regClient := &mocks.RegistryClient{}
+		regClient.On("ManifestList", mock.Anything, "foo/bar", "1.0").Return(newManifestList(
+			newManifestDescriptor("sha256:arm", "application/vnd.oci.image.manifest.v1+json", "linux", "arm64"),
+		), nil)
+		ml, err := platformManifest(context.Background(), regClient, "foo/bar", "1.0", DefaultPlatform, 0)
+		require.NoError(t, err)
+		assert.Nil(t, ml)
+	})
+	t.Run("Match platform variant", func(t *testing.T) {
+		desc := newManifestDescriptor("sha256:arm", "application/vnd.oci.image.manifest.v1+json", "linux", "arm")
+		desc.Platform.Variant = "v7"
+		assert.True(t, platformMatches(desc, "linux/arm"))
+		assert.True(t, platformMatches(desc, "linux/arm/v7"))
+		assert.False(t, platformMatches(desc, "linux/arm/v6"))
+		assert.False(t, platformMatches(desc, "linux/amd64"))
+	})
+}
+
+func Test_GetTagsManifestList(t *testing.T) {
+	regClient := &mocks.RegistryClient{}
+	regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0", "1.1", "1.2"}, nil)
+	multi := &schema2.DeserializedManifest{Manifest: schema2.Manifest{Config: distribution.Descriptor{Digest: "sha256:multi"}}}
+	regClient.On("ManifestV2", mock.Anything, "foo/bar", "1.0").Return(&schema2.DeserializedManifest{}, nil)
+	regClient.On("ManifestV2", mock.Anything, "foo/bar", "sha256:amd").Return(multi, nil)
+	regClient.On("ManifestV2", mock.Anything, "foo/bar", mock.Anything).Return(nil, fmt.Errorf("manifest list"))
+	regClient.On("ManifestList", mock.Anything, "foo/bar", "1.1").Return(newManifestList(
+		newManifestDescriptor("sha256:arm", "application/vnd.oci.image.manifest.v1+json", "linux", "arm64"),
+	), nil)
+	regClient.On("ManifestList", mock.Anything, "foo/bar", "1.2").Return(newManifestList(
+		newManifestDescriptor("sha256:arm", "application/vnd.oci.image.manifest.v1+json", "linux", "arm64"),
+		newManifestDescriptor("sha256:amd", "application/vnd.oci.image.manifest.v1+json", "linux", "amd64"),
+	), nil)
+	regClient.On("TagMetadata", mock.Anything, mock.Anything, multi).Return(&tag.TagInfo{CreatedAt: time.Unix(20, 0)}, nil)
+	regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(&tag.TagInfo{CreatedAt: time.Unix(10, 0)}, nil)
+
+	ep := &RegistryEndpoint{RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+	tl, excluded, err := ep.GetTagsExplained(context.Background(), img, regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1.0", "1.2"}, tl.Tags())
+	assert.Equal(t, time.Unix(20, 0), *tl.Get("1.2").TagDate)
+	assert.Equal(t, "metadata: manifest list has no manifest for platform linux/amd64", excluded["1.1"])
+}
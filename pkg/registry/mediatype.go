@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// Name of the lookup of manifest media types by digest
+const mediaTypeLookup = "manifest media type"
+
+// MediaTypeClient is implemented by registry clients that are able to resolve
+// the media type of the manifest a tag points to without fetching it.
+type MediaTypeClient interface {
+	// TagMediaType returns the media type of the manifest given tag points to
+	TagMediaType(ctx context.Context, nameInRepository, tagName string) (string, error)
+}
+
+// TagMediaType resolves the media type of the manifest of given tag using a
+// HEAD request. All manifest media types are accepted, so that the returned
+// type is the one the manifest has been pushed with.
+func (client *registryClient) TagMediaType(ctx context.Context, nameInRepository, tagName string) (_ string, err error) {
+	defer func() { err = client.classifyError(err) }()
+	resp, err := client.manifestRequest(ctx, http.MethodHead, nameInRepository, tagName)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", client.statusError(resp, "could not get media type for %s:%s", nameInRepository, tagName)
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return "", fmt.Errorf("registry returned invalid media type for %s:%s: %v", nameInRepository, tagName, err)
+	}
+	return mediaType, nil
+}
+
+// TagMediaType returns the media type of the manifest given tag or digest
+// points to
+func (client *ociLayoutClient) TagMediaType(ctx context.Context, nameInRepository, tagName string) (string, error) {
+	desc, err := client.descriptor(nameInRepository, tagName)
+	if err != nil {
+		return "", err
+	}
+	return desc.MediaType, nil
+}
+
+// IsMediaTypeAllowed returns whether manifests of the given media type may be
+// used from this endpoint. All media types are allowed if the endpoint has no
+// list of allowed media types.
+func (ep *RegistryEndpoint) IsMediaTypeAllowed(mediaType string) bool {
+	if len(ep.AllowedMediaTypes) == 0 {
+		return true
+	}
+	for _, t := range ep.AllowedMediaTypes {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// filterByMediaType removes all tags from the list whose manifest has a media
+// type that is not allowed for the endpoint. The media types are looked up by
+// the digests the tags point to. Since the registry sends the media type
+// along with the digest, no further request is needed for that. Tags whose
+// media type cannot be determined are removed as well. Removed tags are
+// recorded in excluded.
+func (endpoint *RegistryEndpoint) filterByMediaType(ctx context.Context, nameInRegistry string, tags []string, regClient RegistryClient, excluded image.TagExclusions) []string {
+	mc, ok := regClient.(MediaTypeClient)
+	if !ok {
+		log.Warnf("registry client for %s cannot determine manifest media types, not considering any tags of %s", endpoint.RegistryAPI, nameInRegistry)
+		for _, t := range tags {
+			excluded.Exclude(t, "media-type", "registry client cannot determine manifest media type")
+		}
+		return []string{}
+	}
+
+	tags, mediaTypes := endpoint.filterTagsByDigest(ctx, nameInRegistry, tags, mediaTypeLookup, "media-type", regClient, excluded, mc.TagMediaType)
+	allowed := []string{}
+	for _, t := range tags {
+		mediaType := mediaTypes[t]
+		if !endpoint.IsMediaTypeAllowed(mediaType) {
+			log.Debugf("Removing tag %s because its manifest media type %s is not allowed", t, mediaType)
+			excluded.Exclude(t, "media-type", "manifest media type %s is not allowed", mediaType)
+			continue
+		}
+		allowed = append(allowed, t)
+	}
+	return allowed
+}
+
+// isManifestMediaType returns whether mediaType is one of the manifest media
+// types we know about
+func isManifestMediaType(mediaType string) bool {
+	for _, t := range manifestMediaTypes {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
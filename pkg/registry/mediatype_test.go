@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/cache"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/mocks"
+
+	"github.com/nokia/docker-registry-client/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// mediaTypeRegistryClient is a RegistryClient that resolves media types from
+// a map
+type mediaTypeRegistryClient struct {
+	mocks.RegistryClient
+	mediaTypes map[string]string
+}
+
+func (c *mediaTypeRegistryClient) TagMediaType(ctx context.Context, nameInRepository, tagName string) (string, error) {
+	if mediaType, ok := c.mediaTypes[tagName]; ok {
+		return mediaType, nil
+	}
+	return "", fmt.Errorf("not found")
+}
+
+func Test_TagMediaType(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/manifests/oci"):
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json; charset=utf-8")
+		case strings.HasSuffix(r.URL.Path, "/manifests/legacy"):
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v1+prettyjws")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	client := &registryClient{regClient: &registry.Registry{URL: srv.URL, Client: srv.Client()}}
+
+	mediaType, err := client.TagMediaType(context.Background(), "foo/bar", "oci")
+	require.NoError(t, err)
+	assert.Equal(t, "application/vnd.oci.image.manifest.v1+json", mediaType)
+
+	mediaType, err = client.TagMediaType(context.Background(), "foo/bar", "legacy")
+	require.NoError(t, err)
+	assert.Equal(t, "application/vnd.docker.distribution.manifest.v1+prettyjws", mediaType)
+
+	_, err = client.TagMediaType(context.Background(), "foo/bar", "missing")
+	assert.Error(t, err)
+}
+
+func Test_GetTagsAllowedMediaTypes(t *testing.T) {
+	t.Run("Exclude tags with media types that are not allowed", func(t *testing.T) {
+		regClient := &mediaTypeRegistryClient{mediaTypes: map[string]string{
+			"1.0.0": "application/vnd.docker.distribution.manifest.v1+prettyjws",
+			"1.1.0": "application/vnd.docker.distribution.manifest.v2+json",
+			"1.2.0": "application/vnd.oci.image.manifest.v1+json",
+			"1.3.0": "application/vnd.oci.image.index.v1+json",
+		}}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.0", "1.1.0", "1.2.0", "1.3.0", "1.4.0"}, nil)
+		ep := &RegistryEndpoint{
+			RegistryAPI: "https://example.com",
+			Cache:       cache.NewMemCache(),
+			AllowedMediaTypes: []string{
+				"application/vnd.oci.image.manifest.v1+json",
+				"application/vnd.oci.image.index.v1+json",
+			},
+		}
+
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0.0")
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, regClient, &image.VersionConstraint{})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0", "1.3.0"}, tl.Tags())
+		assert.Equal(t, "media-type: manifest media type application/vnd.docker.distribution.manifest.v1+prettyjws is not allowed", excluded["1.0.0"])
+		assert.Contains(t, excluded["1.1.0"], "is not allowed")
+		assert.Equal(t, "media-type: could not determine manifest media type: not found", excluded["1.4.0"])
+	})
+
+	t.Run("Media type is taken from digest resolution", func(t *testing.T) {
+		or := newOCIRegistry()
+		or.addImage("1.0.0", time.Now(), ociManifestMediaType)
+		or.addImage("1.1.0", time.Now(), ociManifestMediaType)
+		requests := int32(0)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/manifests/") {
+				atomic.AddInt32(&requests, 1)
+			}
+			or.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.AllowedMediaTypes = []string{ociManifestMediaType}
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0.0")
+		tl, err := ep.GetTags(context.Background(), img, client, &image.VersionConstraint{})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.0.0", "1.1.0"}, tl.Tags())
+		// One HEAD request per tag resolves both digest and media type
+		assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("Exclude all tags if client cannot determine media types", func(t *testing.T) {
+		regClient := &mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0.0"}, nil)
+		ep := &RegistryEndpoint{RegistryAPI: "https://example.com", AllowedMediaTypes: []string{"application/vnd.oci.image.manifest.v1+json"}}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0.0")
+		tl, _, err := ep.GetTagsExplained(context.Background(), img, regClient, &image.VersionConstraint{})
+		require.NoError(t, err)
+		assert.Empty(t, tl.Tags())
+	})
+}
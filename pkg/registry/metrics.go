@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives measurements of the traffic to registries. Registries are
+// identified by their API URL. Implementations must be safe for concurrent
+// use. See package prommetrics for an implementation using Prometheus.
+type Metrics interface {
+	// RegistryCall counts a call of a registry client operation, i.e. "tags"
+	// or "manifest_v2"
+	RegistryCall(registryAPI, operation string, failed bool)
+	// RequestLatency observes the duration of an HTTP request to a registry
+	RequestLatency(registryAPI string, duration time.Duration)
+	// CacheLookup counts a lookup of tag metadata in the cache
+	CacheLookup(registryAPI string, hit bool)
+	// CircuitState reports the state of the circuit breaker of a registry,
+	// i.e. "closed", "open" or "half-open", whenever it changes
+	CircuitState(registryAPI string, state string)
+}
+
+// noopMetrics is the default Metrics, which discards all measurements
+type noopMetrics struct{}
+
+func (noopMetrics) RegistryCall(registryAPI, operation string, failed bool)   {}
+func (noopMetrics) RequestLatency(registryAPI string, duration time.Duration) {}
+func (noopMetrics) CacheLookup(registryAPI string, hit bool)                  {}
+func (noopMetrics) CircuitState(registryAPI string, state string)             {}
+
+// metricsHolder wraps Metrics, since atomic.Value requires a consistent type
+type metricsHolder struct {
+	Metrics
+}
+
+var registryMetrics atomic.Value
+
+// SetMetrics sets the Metrics to report to for all registries. Passing nil
+// discards all measurements, which is the default.
+func SetMetrics(m Metrics) {
+	if m == nil {
+		m = noopMetrics{}
+	}
+	registryMetrics.Store(metricsHolder{m})
+}
+
+// getMetrics returns the Metrics to report to
+func getMetrics() Metrics {
+	if h, ok := registryMetrics.Load().(metricsHolder); ok {
+		return h.Metrics
+	}
+	return noopMetrics{}
+}
+
+// recordCall reports a call of a registry client operation to the metrics
+func (client *registryClient) recordCall(operation string, err error) {
+	var registryAPI string
+	if client.endpoint != nil {
+		registryAPI = client.endpoint.RegistryAPI
+	}
+	getMetrics().RegistryCall(registryAPI, operation, err != nil)
+}
@@ -0,0 +1,89 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMetrics records all measurements it receives
+type testMetrics struct {
+	lock      sync.Mutex
+	calls     map[string]int
+	requests  int
+	cacheHits map[bool]int
+	circuits  []string
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{calls: map[string]int{}, cacheHits: map[bool]int{}}
+}
+
+func (m *testMetrics) RegistryCall(registryAPI, operation string, failed bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.calls[fmt.Sprintf("%s %s %t", registryAPI, operation, failed)]++
+}
+
+func (m *testMetrics) RequestLatency(registryAPI string, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.requests++
+}
+
+func (m *testMetrics) CacheLookup(registryAPI string, hit bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.cacheHits[hit]++
+}
+
+func (m *testMetrics) CircuitState(registryAPI string, state string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.circuits = append(m.circuits, state)
+}
+
+func Test_Metrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/foo/bar/tags/list":
+			fmt.Fprint(w, `{"name":"foo/bar","tags":["1.0"]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	m := newTestMetrics()
+	SetMetrics(m)
+	defer SetMetrics(nil)
+
+	ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+	client, err := NewClient(ep, "", "")
+	require.NoError(t, err)
+
+	_, err = client.Tags(context.Background(), "foo/bar")
+	require.NoError(t, err)
+	_, err = client.ManifestList(context.Background(), "foo/bar", "1.0")
+	require.Error(t, err)
+	recordCacheLookup(srv.URL, true)
+
+	assert.Equal(t, map[string]int{
+		srv.URL + " tags false":         1,
+		srv.URL + " manifest_list true": 1,
+	}, m.calls)
+	assert.Equal(t, 2, m.requests)
+	assert.Equal(t, map[bool]int{true: 1}, m.cacheHits)
+}
+
+func Test_DefaultMetrics(t *testing.T) {
+	SetMetrics(nil)
+	assert.Equal(t, noopMetrics{}, getMetrics())
+}
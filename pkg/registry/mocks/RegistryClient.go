@@ -3,9 +3,13 @@
 package mocks
 
 import (
+	context "context"
+
 	distribution "github.com/docker/distribution"
 	mock "github.com/stretchr/testify/mock"
 
+	manifestlist "github.com/docker/distribution/manifest/manifestlist"
+
 	schema1 "github.com/docker/distribution/manifest/schema1"
 
 	schema2 "github.com/docker/distribution/manifest/schema2"
@@ -18,13 +22,59 @@ type RegistryClient struct {
 	mock.Mock
 }
 
-// ManifestV1 provides a mock function with given fields: repository, reference
-func (_m *RegistryClient) ManifestV1(repository string, reference string) (*schema1.SignedManifest, error) {
-	ret := _m.Called(repository, reference)
+// ManifestForDigest provides a mock function with given fields: ctx, repository, digest
+func (_m *RegistryClient) ManifestForDigest(ctx context.Context, repository string, digest string) (distribution.Manifest, error) {
+	ret := _m.Called(ctx, repository, digest)
+
+	var r0 distribution.Manifest
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) distribution.Manifest); ok {
+		r0 = rf(ctx, repository, digest)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(distribution.Manifest)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, repository, digest)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ManifestList provides a mock function with given fields: ctx, repository, reference
+func (_m *RegistryClient) ManifestList(ctx context.Context, repository string, reference string) (*manifestlist.DeserializedManifestList, error) {
+	ret := _m.Called(ctx, repository, reference)
+
+	var r0 *manifestlist.DeserializedManifestList
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) *manifestlist.DeserializedManifestList); ok {
+		r0 = rf(ctx, repository, reference)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*manifestlist.DeserializedManifestList)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, repository, reference)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ManifestV1 provides a mock function with given fields: ctx, repository, reference
+func (_m *RegistryClient) ManifestV1(ctx context.Context, repository string, reference string) (*schema1.SignedManifest, error) {
+	ret := _m.Called(ctx, repository, reference)
 
 	var r0 *schema1.SignedManifest
-	if rf, ok := ret.Get(0).(func(string, string) *schema1.SignedManifest); ok {
-		r0 = rf(repository, reference)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) *schema1.SignedManifest); ok {
+		r0 = rf(ctx, repository, reference)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*schema1.SignedManifest)
@@ -32,8 +82,8 @@ func (_m *RegistryClient) ManifestV1(repository string, reference string) (*sche
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, string) error); ok {
-		r1 = rf(repository, reference)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, repository, reference)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -41,13 +91,13 @@ func (_m *RegistryClient) ManifestV1(repository string, reference string) (*sche
 	return r0, r1
 }
 
-// ManifestV2 provides a mock function with given fields: repository, reference
-func (_m *RegistryClient) ManifestV2(repository string, reference string) (*schema2.DeserializedManifest, error) {
-	ret := _m.Called(repository, reference)
+// ManifestV2 provides a mock function with given fields: ctx, repository, reference
+func (_m *RegistryClient) ManifestV2(ctx context.Context, repository string, reference string) (*schema2.DeserializedManifest, error) {
+	ret := _m.Called(ctx, repository, reference)
 
 	var r0 *schema2.DeserializedManifest
-	if rf, ok := ret.Get(0).(func(string, string) *schema2.DeserializedManifest); ok {
-		r0 = rf(repository, reference)
+	if rf, ok := ret.Get(0).(func(context.Context, string, string) *schema2.DeserializedManifest); ok {
+		r0 = rf(ctx, repository, reference)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*schema2.DeserializedManifest)
@@ -55,8 +105,8 @@ func (_m *RegistryClient) ManifestV2(repository string, reference string) (*sche
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, string) error); ok {
-		r1 = rf(repository, reference)
+	if rf, ok := ret.Get(1).(func(context.Context, string, string) error); ok {
+		r1 = rf(ctx, repository, reference)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -64,13 +114,13 @@ func (_m *RegistryClient) ManifestV2(repository string, reference string) (*sche
 	return r0, r1
 }
 
-// TagMetadata provides a mock function with given fields: repository, manifest
-func (_m *RegistryClient) TagMetadata(repository string, manifest distribution.Manifest) (*tag.TagInfo, error) {
-	ret := _m.Called(repository, manifest)
+// TagMetadata provides a mock function with given fields: ctx, repository, manifest
+func (_m *RegistryClient) TagMetadata(ctx context.Context, repository string, manifest distribution.Manifest) (*tag.TagInfo, error) {
+	ret := _m.Called(ctx, repository, manifest)
 
 	var r0 *tag.TagInfo
-	if rf, ok := ret.Get(0).(func(string, distribution.Manifest) *tag.TagInfo); ok {
-		r0 = rf(repository, manifest)
+	if rf, ok := ret.Get(0).(func(context.Context, string, distribution.Manifest) *tag.TagInfo); ok {
+		r0 = rf(ctx, repository, manifest)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).(*tag.TagInfo)
@@ -78,8 +128,8 @@ func (_m *RegistryClient) TagMetadata(repository string, manifest distribution.M
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string, distribution.Manifest) error); ok {
-		r1 = rf(repository, manifest)
+	if rf, ok := ret.Get(1).(func(context.Context, string, distribution.Manifest) error); ok {
+		r1 = rf(ctx, repository, manifest)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -87,13 +137,13 @@ func (_m *RegistryClient) TagMetadata(repository string, manifest distribution.M
 	return r0, r1
 }
 
-// Tags provides a mock function with given fields: nameInRepository
-func (_m *RegistryClient) Tags(nameInRepository string) ([]string, error) {
-	ret := _m.Called(nameInRepository)
+// Tags provides a mock function with given fields: ctx, nameInRepository
+func (_m *RegistryClient) Tags(ctx context.Context, nameInRepository string) ([]string, error) {
+	ret := _m.Called(ctx, nameInRepository)
 
 	var r0 []string
-	if rf, ok := ret.Get(0).(func(string) []string); ok {
-		r0 = rf(nameInRepository)
+	if rf, ok := ret.Get(0).(func(context.Context, string) []string); ok {
+		r0 = rf(ctx, nameInRepository)
 	} else {
 		if ret.Get(0) != nil {
 			r0 = ret.Get(0).([]string)
@@ -101,8 +151,8 @@ func (_m *RegistryClient) Tags(nameInRepository string) ([]string, error) {
 	}
 
 	var r1 error
-	if rf, ok := ret.Get(1).(func(string) error); ok {
-		r1 = rf(nameInRepository)
+	if rf, ok := ret.Get(1).(func(context.Context, string) error); ok {
+		r1 = rf(ctx, nameInRepository)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -0,0 +1,303 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+)
+
+// OCILayoutScheme is the scheme of API URLs of endpoints that read images
+// from an OCI image layout directory on local disk instead of a registry, i.e.
+// oci-layout:///var/lib/images
+const OCILayoutScheme = "oci-layout://"
+
+// Annotation holding the name of a reference in an OCI image index
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
+// Media type of OCI image manifests
+const ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+
+// Media types of image indexes, which reference a manifest per platform
+var indexMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// ociLayoutClient is a RegistryClient that reads tags and manifests from an
+// OCI image layout on local disk. The layout of a repository is looked up in
+// a sub-directory named like the repository first, and the root directory is
+// used if there is no such layout.
+type ociLayoutClient struct {
+	root        string
+	createdFrom []CreatedSource
+}
+
+// newOCILayoutClient returns a client for the OCI layout directory given in
+// the endpoint's API URL
+func newOCILayoutClient(endpoint *RegistryEndpoint) (RegistryClient, error) {
+	root := strings.TrimPrefix(endpoint.RegistryAPI, OCILayoutScheme)
+	if fi, err := os.Stat(root); err != nil {
+		return nil, fmt.Errorf("could not access OCI layout: %v", err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("OCI layout %s is not a directory", root)
+	}
+	return &ociLayoutClient{root: root, createdFrom: endpoint.CreatedFrom}, nil
+}
+
+// layoutDir returns the directory of the layout for the given repository.
+// Repository names that would lead outside of the root directory, i.e. with
+// a ../ element, are never looked up.
+func (client *ociLayoutClient) layoutDir(nameInRepository string) string {
+	root := filepath.Clean(client.root)
+	dir := filepath.Clean(filepath.Join(root, filepath.FromSlash(nameInRepository)))
+	if rel, err := filepath.Rel(root, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		log.Warnf("not reading OCI layout for %s from outside of %s", nameInRepository, root)
+		return client.root
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); err == nil {
+		return dir
+	}
+	return client.root
+}
+
+// readBlob reads the blob with the given digest from the layout in dir
+func (client *ociLayoutClient) readBlob(dir string, digest string) ([]byte, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(digest, `/\.`) {
+		return nil, fmt.Errorf("invalid digest: %s", digest)
+	}
+	return ioutil.ReadFile(filepath.Join(dir, "blobs", parts[0], parts[1]))
+}
+
+// refs returns the descriptors of all references in the layout of the given
+// repository, by tag. References that are named with a repository, i.e.
+// foo/bar:1.0, are only returned for matching repositories.
+func (client *ociLayoutClient) refs(nameInRepository string) (map[string]ociDescriptor, error) {
+	indexBytes, err := ioutil.ReadFile(filepath.Join(client.layoutDir(nameInRepository), "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var index ociIndex
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return nil, fmt.Errorf("could not parse OCI index: %v", err)
+	}
+
+	refs := make(map[string]ociDescriptor)
+	for _, desc := range index.Manifests {
+		ref := desc.Annotations[ociRefNameAnnotation]
+		if ref == "" {
+			continue
+		}
+		if i := strings.LastIndex(ref, ":"); i >= 0 && !strings.Contains(ref[i:], "/") {
+			repo := ref[:i]
+			if repo != nameInRepository && !strings.HasSuffix(repo, "/"+nameInRepository) {
+				continue
+			}
+			ref = ref[i+1:]
+		}
+		refs[ref] = desc
+	}
+	return refs, nil
+}
+
+// descriptor returns the descriptor of the manifest the given reference
+// points to. A tag is looked up in the layout's index, while the manifest of a
+// digest is read from the layout and verified against the digest.
+func (client *ociLayoutClient) descriptor(repository, reference string) (ociDescriptor, error) {
+	if strings.Contains(reference, ":") {
+		body, err := client.readBlob(client.layoutDir(repository), reference)
+		if err != nil {
+			return ociDescriptor{}, err
+		}
+		if err := verifyDigest(reference, body); err != nil {
+			return ociDescriptor{}, err
+		}
+		mediaType, err := blobMediaType(body)
+		if err != nil {
+			return ociDescriptor{}, fmt.Errorf("could not parse manifest %s: %v", reference, err)
+		}
+		return ociDescriptor{MediaType: mediaType, Digest: reference, Size: int64(len(body))}, nil
+	}
+	refs, err := client.refs(repository)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	desc, ok := refs[reference]
+	if !ok {
+		return ociDescriptor{}, fmt.Errorf("tag %s not found in OCI layout", reference)
+	}
+	return desc, nil
+}
+
+// Tags returns a list of tags for given name in repository
+func (client *ociLayoutClient) Tags(ctx context.Context, nameInRepository string) ([]string, error) {
+	refs, err := client.refs(nameInRepository)
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]string, 0, len(refs))
+	for ref := range refs {
+		tags = append(tags, ref)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// TagDigest returns the digest of the manifest given tag points to
+func (client *ociLayoutClient) TagDigest(ctx context.Context, nameInRepository, tagName string) (string, error) {
+	desc, err := client.descriptor(nameInRepository, tagName)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest, nil
+}
+
+// ManifestV1 is not supported for OCI layouts
+func (client *ociLayoutClient) ManifestV1(ctx context.Context, repository string, reference string) (*schema1.SignedManifest, error) {
+	return nil, fmt.Errorf("V1 manifests are not supported in OCI layouts")
+}
+
+// ManifestV2 returns the manifest for a given tag or digest in given
+// repository. If the reference points to an image index, the manifest for
+// linux/amd64 is returned if it exists, or otherwise the first manifest of the
+// index.
+func (client *ociLayoutClient) ManifestV2(ctx context.Context, repository string, reference string) (*schema2.DeserializedManifest, error) {
+	desc, err := client.descriptor(repository, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := client.layoutDir(repository)
+	if isIndexMediaType(desc.MediaType) {
+		indexBytes, err := client.readBlob(dir, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var index ociIndex
+		if err := json.Unmarshal(indexBytes, &index); err != nil {
+			return nil, fmt.Errorf("could not parse image index for %s: %v", reference, err)
+		}
+		if len(index.Manifests) == 0 {
+			return nil, fmt.Errorf("image index for %s has no manifests", reference)
+		}
+		desc = index.Manifests[0]
+		for _, m := range index.Manifests {
+			if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == "amd64" {
+				desc = m
+				break
+			}
+		}
+		log.Tracef("using manifest %s from image index for %s", desc.Digest, reference)
+	}
+
+	manifestBytes, err := client.readBlob(dir, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	man, err := manifestFromOCI(manifestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse manifest for %s: %v", reference, err)
+	}
+	return man, nil
+}
+
+// ManifestForDigest returns the manifest with the given digest in given
+// repository, verifying its content against the digest. OCI image manifests
+// are returned as V2 manifests.
+func (client *ociLayoutClient) ManifestForDigest(ctx context.Context, repository string, digest string) (distribution.Manifest, error) {
+	body, err := client.readBlob(client.layoutDir(repository), digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyDigest(digest, body); err != nil {
+		return nil, err
+	}
+	mediaType, err := blobMediaType(body)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse manifest %s: %v", digest, err)
+	}
+	return parseManifest(mediaType, body)
+}
+
+// blobMediaType returns the media type of the manifest or index in body. The
+// media type is optional in OCI manifests and indexes, so it is derived from
+// the content if it is missing.
+func blobMediaType(body []byte) (string, error) {
+	var man struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &man); err != nil {
+		return "", err
+	}
+	if man.MediaType != "" {
+		return man.MediaType, nil
+	}
+	if man.Manifests != nil {
+		return indexMediaTypes[0], nil
+	}
+	return ociManifestMediaType, nil
+}
+
+// TagMetadata retrieves metadata for a given manifest of given repository
+func (client *ociLayoutClient) TagMetadata(ctx context.Context, repository string, manifest distribution.Manifest) (*tag.TagInfo, error) {
+	deserialized, ok := manifest.(*schema2.DeserializedManifest)
+	if !ok {
+		return nil, fmt.Errorf("invalid manifest type")
+	}
+	blob, err := client.readBlob(client.layoutDir(repository), deserialized.Config.Digest.String())
+	if err != nil {
+		return nil, fmt.Errorf("could not get metadata: %v", err)
+	}
+	return tagInfoFromConfig(blob, client.createdFrom)
+}
+
+// manifestFromOCI parses an OCI image manifest into a Docker V2 manifest,
+// which it is compatible with
+func manifestFromOCI(body []byte) (*schema2.DeserializedManifest, error) {
+	var man schema2.Manifest
+	if err := json.Unmarshal(body, &man); err != nil {
+		return nil, err
+	}
+	if man.MediaType != "" && man.MediaType != ociManifestMediaType && man.MediaType != schema2.MediaTypeManifest {
+		return nil, fmt.Errorf("manifest of type %s is not an image manifest", man.MediaType)
+	}
+	man.MediaType = schema2.MediaTypeManifest
+	return schema2.FromStruct(man)
+}
+
+func isIndexMediaType(mediaType string) bool {
+	for _, t := range indexMediaTypes {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/cache"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeBlob writes data as a blob to the OCI layout in dir and returns its
+// digest
+func writeBlob(t *testing.T, dir string, data interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(data)
+	require.NoError(t, err)
+	hex := fmt.Sprintf("%x", sha256.Sum256(b))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "blobs", "sha256", hex), b, 0644))
+	return "sha256:" + hex
+}
+
+// writeImage writes an image with given creation date and platform to the
+// OCI layout in dir and returns the descriptor of its manifest
+func writeImage(t *testing.T, dir string, created time.Time, osName, arch string) map[string]interface{} {
+	t.Helper()
+	config := writeBlob(t, dir, map[string]interface{}{
+		"created":      created.Format(time.RFC3339Nano),
+		"os":           osName,
+		"architecture": arch,
+	})
+	manifest := writeBlob(t, dir, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]interface{}{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": config, "size": 1},
+		"layers":        []interface{}{},
+	})
+	return map[string]interface{}{
+		"mediaType": "application/vnd.oci.image.manifest.v1+json",
+		"digest":    manifest,
+		"size":      1,
+		"platform":  map[string]string{"os": osName, "architecture": arch},
+	}
+}
+
+func newTestOCILayout(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "oci-layout")
+	require.NoError(t, err)
+
+	withRef := func(desc map[string]interface{}, ref string) map[string]interface{} {
+		desc["annotations"] = map[string]string{ociRefNameAnnotation: ref}
+		return desc
+	}
+
+	v1 := writeImage(t, dir, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), "linux", "amd64")
+	v2 := writeImage(t, dir, time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC), "linux", "amd64")
+	arm := writeImage(t, dir, time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), "linux", "arm64")
+	amd := writeImage(t, dir, time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC), "linux", "amd64")
+	multi := writeBlob(t, dir, map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     []interface{}{arm, amd},
+	})
+
+	index := map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []interface{}{
+			withRef(v1, "1.0.0"),
+			withRef(v2, "foo/bar:1.1.0"),
+			withRef(map[string]interface{}{"mediaType": "application/vnd.oci.image.index.v1+json", "digest": multi, "size": 1}, "1.2.0"),
+			withRef(writeImage(t, dir, time.Now(), "linux", "amd64"), "other/image:9.9.9"),
+		},
+	}
+	b, err := json.Marshal(index)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "index.json"), b, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644))
+	return dir
+}
+
+func Test_OCILayoutClient(t *testing.T) {
+	dir := newTestOCILayout(t)
+	defer os.RemoveAll(dir)
+	ep := &RegistryEndpoint{RegistryAPI: OCILayoutScheme + dir, Cache: cache.NewMemCache()}
+
+	t.Run("List tags", func(t *testing.T) {
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		tags, err := client.Tags(context.Background(), "foo/bar")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.0.0", "1.1.0", "1.2.0"}, tags)
+	})
+
+	t.Run("Resolve digest", func(t *testing.T) {
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		dc, ok := client.(DigestClient)
+		require.True(t, ok)
+		digest, err := dc.TagDigest(context.Background(), "foo/bar", "1.0.0")
+		require.NoError(t, err)
+		assert.Contains(t, digest, "sha256:")
+	})
+
+	t.Run("Get manifest by digest", func(t *testing.T) {
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		imgTag, err := ep.ResolveTagDigest(context.Background(), image.NewFromIdentifier("foo/bar"), "1.2.0", client)
+		require.NoError(t, err)
+		manifest, err := client.ManifestForDigest(context.Background(), "foo/bar", imgTag.TagDigest)
+		require.NoError(t, err)
+		_, ok := manifest.(*manifestlist.DeserializedManifestList)
+		assert.True(t, ok)
+
+		imgTag, err = ep.ResolveTagDigest(context.Background(), image.NewFromIdentifier("foo/bar"), "1.0.0", client)
+		require.NoError(t, err)
+		manifest, err = client.ManifestForDigest(context.Background(), "foo/bar", imgTag.TagDigest)
+		require.NoError(t, err)
+		_, ok = manifest.(*schema2.DeserializedManifest)
+		assert.True(t, ok)
+	})
+
+	t.Run("Get metadata from image index", func(t *testing.T) {
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		manifest, err := client.ManifestV2(context.Background(), "foo/bar", "1.2.0")
+		require.NoError(t, err)
+		ti, err := client.TagMetadata(context.Background(), "foo/bar", manifest)
+		require.NoError(t, err)
+		assert.Equal(t, "linux/amd64", ti.Platform())
+		assert.Equal(t, time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC), ti.CreatedAt.UTC())
+	})
+
+	t.Run("Select latest tag", func(t *testing.T) {
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		img := image.NewFromIdentifier("foo/bar:1.0.0")
+		vc := &image.VersionConstraint{SortMode: image.VersionSortLatest}
+		tl, err := ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		newTag, err := img.GetNewestVersionFromTags(vc, tl)
+		require.NoError(t, err)
+		require.NotNil(t, newTag)
+		assert.Equal(t, "1.2.0", newTag.TagName)
+	})
+
+	t.Run("Filter tags by digest", func(t *testing.T) {
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		img := image.NewFromIdentifier("foo/bar:1.0.0")
+
+		vc := &image.VersionConstraint{RequirePlatforms: []string{"linux/arm64"}}
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.2.0"}, tl.Tags())
+		assert.Equal(t, "platform: not available for platform linux/arm64", excluded["1.0.0"])
+
+		mediaTypeEp := &RegistryEndpoint{RegistryAPI: ep.RegistryAPI, Cache: cache.NewMemCache(), AllowedMediaTypes: []string{ociManifestMediaType}}
+		tl, excluded, err = mediaTypeEp.GetTagsExplained(context.Background(), img, client, &image.VersionConstraint{})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.0.0", "1.1.0"}, tl.Tags())
+		assert.Equal(t, "media-type: manifest media type application/vnd.oci.image.index.v1+json is not allowed", excluded["1.2.0"])
+
+		helmEp := &RegistryEndpoint{RegistryAPI: ep.RegistryAPI, Cache: cache.NewMemCache(), ArtifactType: ArtifactHelmChart}
+		tl, excluded, err = helmEp.GetTagsExplained(context.Background(), img, client, &image.VersionConstraint{})
+		require.NoError(t, err)
+		assert.Empty(t, tl.Tags())
+		assert.Equal(t, "artifact-type: config media type application/vnd.oci.image.config.v1+json is not "+HelmChartConfigMediaType, excluded["1.0.0"])
+		assert.Equal(t, "artifact-type: tag points to an index", excluded["1.2.0"])
+	})
+
+	t.Run("Layouts outside of the root directory are not read", func(t *testing.T) {
+		outside := newTestOCILayout(t)
+		defer os.RemoveAll(outside)
+		root := filepath.Join(dir, "root")
+		require.NoError(t, os.MkdirAll(root, 0755))
+		defer os.RemoveAll(root)
+		rel, err := filepath.Rel(root, outside)
+		require.NoError(t, err)
+
+		client, err := NewClient(&RegistryEndpoint{RegistryAPI: OCILayoutScheme + root, Cache: cache.NewMemCache()}, "", "")
+		require.NoError(t, err)
+		_, err = client.Tags(context.Background(), filepath.ToSlash(rel))
+		assert.Error(t, err)
+		_, err = client.Tags(context.Background(), "foo/../"+filepath.ToSlash(rel))
+		assert.Error(t, err)
+	})
+
+	t.Run("Invalid layout directory", func(t *testing.T) {
+		_, err := NewClient(&RegistryEndpoint{RegistryAPI: OCILayoutScheme + filepath.Join(dir, "missing")}, "", "")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,112 @@
+package registry
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hostPacer spaces out the requests sent to a host, so that at least the
+// minimum interval plus a random jitter passes between the start of two
+// requests
+type hostPacer struct {
+	lock     sync.Mutex
+	interval time.Duration
+	jitter   time.Duration
+	next     time.Time
+}
+
+// Pacers of the hosts requests are sent to, shared by all endpoints on the
+// same host, protected by pacerLock
+var (
+	pacerLock  sync.Mutex
+	hostPacers = make(map[string]*hostPacer)
+)
+
+// getHostPacer returns the pacer for the given host. If endpoints on the same
+// host have different settings, the longest interval and jitter apply.
+func getHostPacer(host string, interval, jitter time.Duration) *hostPacer {
+	host = strings.ToLower(host)
+	pacerLock.Lock()
+	defer pacerLock.Unlock()
+	p, ok := hostPacers[host]
+	if !ok {
+		p = &hostPacer{}
+		hostPacers[host] = p
+	}
+	p.lock.Lock()
+	if interval > p.interval {
+		p.interval = interval
+	}
+	if jitter > p.jitter {
+		p.jitter = jitter
+	}
+	p.lock.Unlock()
+	return p
+}
+
+// pacerSlot is a slot reserved for a request, starting at the time the
+// request may be sent, and ending when the next request may be sent
+type pacerSlot struct {
+	start time.Time
+	end   time.Time
+}
+
+// reserve reserves the next slot for a request and returns it, along with
+// how long to wait for it
+func (p *hostPacer) reserve() (pacerSlot, time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	at := p.next
+	if at.Before(now) {
+		at = now
+	}
+	delay := p.interval
+	if p.jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(p.jitter)))
+	}
+	p.next = at.Add(delay)
+	return pacerSlot{start: at, end: p.next}, at.Sub(now)
+}
+
+// release gives back a slot whose request has not been sent, so that the next
+// request may take it. Slots reserved after it are already being waited for,
+// so the slot can only be given back if it is the last one reserved.
+func (p *hostPacer) release(slot pacerSlot) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.next.Equal(slot.end) {
+		p.next = slot.start
+	}
+}
+
+// pacingTransport delays requests so that requests to the same host are
+// spread out by the endpoint's minimum interval and jitter
+type pacingTransport struct {
+	interval  time.Duration
+	jitter    time.Duration
+	transport http.RoundTripper
+}
+
+// RoundTrip waits for the next slot of the request's host and performs the
+// request. If the request's context is done while waiting, the slot is
+// released and the context's error is returned.
+func (pt *pacingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	pacer := getHostPacer(r.URL.Host, pt.interval, pt.jitter)
+	slot, wait := pacer.reserve()
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			pacer.release(slot)
+			return nil, r.Context().Err()
+		}
+		recordRateLimitWait(wait)
+	}
+	return pt.transport.RoundTrip(r)
+}
@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_HostPacer(t *testing.T) {
+	t.Run("Requests are spaced by the interval", func(t *testing.T) {
+		p := &hostPacer{interval: time.Second}
+		_, wait := p.reserve()
+		assert.Equal(t, time.Duration(0), wait)
+		_, wait = p.reserve()
+		assert.InDelta(t, float64(time.Second), float64(wait), float64(50*time.Millisecond))
+		_, wait = p.reserve()
+		assert.InDelta(t, float64(2*time.Second), float64(wait), float64(50*time.Millisecond))
+	})
+
+	t.Run("Released slot is taken by the next request", func(t *testing.T) {
+		p := &hostPacer{interval: time.Second}
+		p.reserve()
+		slot, _ := p.reserve()
+		p.release(slot)
+		_, wait := p.reserve()
+		assert.InDelta(t, float64(time.Second), float64(wait), float64(50*time.Millisecond))
+	})
+
+	t.Run("Slot is kept if later slots are reserved", func(t *testing.T) {
+		p := &hostPacer{interval: time.Second}
+		p.reserve()
+		slot, _ := p.reserve()
+		p.reserve()
+		p.release(slot)
+		_, wait := p.reserve()
+		assert.InDelta(t, float64(3*time.Second), float64(wait), float64(50*time.Millisecond))
+	})
+
+	t.Run("Jitter is added to the interval", func(t *testing.T) {
+		p := &hostPacer{interval: time.Second, jitter: time.Second}
+		p.reserve()
+		for i := 1; i <= 10; i++ {
+			_, wait := p.reserve()
+			assert.GreaterOrEqual(t, int64(wait), int64(time.Duration(i)*time.Second-50*time.Millisecond))
+			assert.Less(t, int64(wait), int64(time.Duration(2*i)*time.Second))
+		}
+	})
+
+	t.Run("Pacers are shared by host", func(t *testing.T) {
+		a := getHostPacer("Pacer.Example.com:443", time.Second, 0)
+		b := getHostPacer("pacer.example.com:443", 2*time.Second, time.Second)
+		c := getHostPacer("other.example.com:443", time.Second, 0)
+		assert.Same(t, a, b)
+		assert.NotSame(t, a, c)
+		assert.Equal(t, 2*time.Second, a.interval)
+		assert.Equal(t, time.Second, a.jitter)
+	})
+}
+
+func Test_PacingTransport(t *testing.T) {
+	// Each test uses its own server, so that they don't share a pacer
+	newServer := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"name":"foo/bar","tags":["1.0"]}`)
+		}))
+	}
+
+	t.Run("Requests to the same host are spread out", func(t *testing.T) {
+		srv := newServer()
+		defer srv.Close()
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.MinInterval = 50 * time.Millisecond
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			_, err := client.Tags(context.Background(), "foo/bar")
+			require.NoError(t, err)
+		}
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+	})
+
+	t.Run("Waiting is aborted once context is done", func(t *testing.T) {
+		srv := newServer()
+		defer srv.Close()
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.MinInterval = time.Hour
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err = client.Tags(ctx, "foo/bar")
+		require.NoError(t, err)
+		_, err = client.Tags(ctx, "foo/bar")
+		require.Error(t, err)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// The slot of the aborted request is released
+		_, wait := getHostPacer(strings.TrimPrefix(srv.URL, "http://"), 0, 0).reserve()
+		assert.InDelta(t, float64(time.Hour), float64(wait), float64(time.Second))
+	})
+}
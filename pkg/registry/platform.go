@@ -0,0 +1,179 @@
+package registry
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+)
+
+// GetPlatforms returns the platforms the given tag of img is available for,
+// as os/arch or os/arch/variant, sorted by name. For an image index, these
+// are the platforms of all images in the index, including those of nested
+// indexes. For a single-platform image, it is the platform of the image.
+func (endpoint *RegistryEndpoint) GetPlatforms(ctx context.Context, img *image.ContainerImage, tagName string, regClient RegistryClient) ([]string, error) {
+	return tagPlatforms(ctx, regClient, endpoint.nameInRegistry(img), tagName)
+}
+
+// ResolvePlatform returns the platform, as os/arch, of the image the given tag
+// of img points to. For an image index, this is the platform of the image for
+// the default platform. The platform is taken from the cached meta data of the
+// tag if it is known, and looked up by the digest the tag points to otherwise,
+// so that it is only resolved once for each image.
+func (endpoint *RegistryEndpoint) ResolvePlatform(ctx context.Context, img *image.ContainerImage, tagName string, regClient RegistryClient) (string, error) {
+	nameInRegistry := endpoint.nameInRegistry(img)
+	if endpoint.imageTagCache() != nil {
+		imgTag, err := endpoint.tagCache(ctx).GetTag(nameInRegistry, tagName)
+		if err == nil && imgTag != nil && imgTag.TagPlatform != "" && endpoint.usesCachedTag(ctx, nameInRegistry, imgTag) {
+			return imgTag.TagPlatform, nil
+		}
+	}
+	platforms, errs := endpoint.resolveTagsByDigest(ctx, nameInRegistry, []string{tagName}, "platform", regClient, func(ctx context.Context, nameInRegistry, reference string) (string, error) {
+		ti, err := imageTagInfo(ctx, regClient, nameInRegistry, reference)
+		if err != nil {
+			return "", err
+		}
+		return ti.Platform(), nil
+	})
+	if err := errs[tagName]; err != nil {
+		return "", err
+	}
+	return platforms[tagName], nil
+}
+
+// tagPlatforms returns the platforms reference is available for
+func tagPlatforms(ctx context.Context, regClient RegistryClient, nameInRegistry, reference string) ([]string, error) {
+	found := map[string]bool{}
+	list, err := regClient.ManifestList(ctx, nameInRegistry, reference)
+	if err == nil {
+		err = indexPlatforms(ctx, regClient, nameInRegistry, list, found, 0)
+	} else {
+		log.Tracef("No manifest list for %s:%s, getting platform of image (%v)", nameInRegistry, reference, err)
+		var platform string
+		platform, err = imagePlatform(ctx, regClient, nameInRegistry, reference)
+		if platform != "" {
+			found[platform] = true
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	platforms := make([]string, 0, len(found))
+	for p := range found {
+		platforms = append(platforms, p)
+	}
+	sort.Strings(platforms)
+	return platforms, nil
+}
+
+// indexPlatforms adds the platforms of all images in the image index to found
+func indexPlatforms(ctx context.Context, regClient RegistryClient, nameInRegistry string, list *manifestlist.DeserializedManifestList, found map[string]bool, depth int) error {
+	for _, desc := range list.Manifests {
+		if isIndexMediaType(desc.MediaType) {
+			if depth >= maxIndexDepth {
+				log.Debugf("not following image index %s nested in %s, too deep", desc.Digest, nameInRegistry)
+				continue
+			}
+			nested, err := regClient.ManifestList(ctx, nameInRegistry, desc.Digest.String())
+			if err != nil {
+				return err
+			}
+			if err := indexPlatforms(ctx, regClient, nameInRegistry, nested, found, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		// Attestations and other artifacts are stored with an unknown platform
+		if desc.Platform.OS == "" || desc.Platform.OS == "unknown" {
+			continue
+		}
+		platform := desc.Platform.OS + "/" + desc.Platform.Architecture
+		if desc.Platform.Variant != "" {
+			platform += "/" + desc.Platform.Variant
+		}
+		found[platform] = true
+	}
+	return nil
+}
+
+// imagePlatform returns the platform of a single-platform image
+func imagePlatform(ctx context.Context, regClient RegistryClient, nameInRegistry, reference string) (string, error) {
+	var ml distribution.Manifest
+	if v2, _, _, err := imageManifest(ctx, regClient, nameInRegistry, reference); err == nil {
+		ml = v2
+	} else if v1, err := regClient.ManifestV1(ctx, nameInRegistry, reference); err == nil {
+		ml = v1
+	} else {
+		return "", err
+	}
+	ti, err := tagMetadataWithoutCreated(ctx, regClient, nameInRegistry, ml)
+	if err != nil || ti == nil {
+		return "", err
+	}
+	return ti.Platform(), nil
+}
+
+// platformSatisfies returns whether an image for the available platform can
+// be used where the required platform is needed. The required platform may
+// omit the variant, i.e. linux/arm64 is satisfied by linux/arm64/v8.
+func platformSatisfies(available, required string) bool {
+	a := strings.Split(available, "/")
+	r := strings.Split(required, "/")
+	if len(r) > len(a) {
+		return false
+	}
+	for i := range r {
+		if a[i] != r[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// filterByPlatforms removes all tags from the list that are not available for
+// each of the platforms required by the constraint. The platforms are looked
+// up by the digests the tags point to, so that the manifests are only fetched
+// once for each digest. Tags whose platforms cannot be determined are removed
+// as well. Removed tags are recorded in excluded.
+func (endpoint *RegistryEndpoint) filterByPlatforms(ctx context.Context, nameInRegistry string, tags []string, regClient RegistryClient, vc *image.VersionConstraint, excluded image.TagExclusions) []string {
+	tags, resolved := endpoint.filterTagsByDigest(ctx, nameInRegistry, tags, "platforms", "platform", regClient, excluded, func(ctx context.Context, nameInRegistry, reference string) (string, error) {
+		platforms, err := tagPlatforms(ctx, regClient, nameInRegistry, reference)
+		return strings.Join(platforms, ","), err
+	})
+
+	kept := []string{}
+	for _, t := range tags {
+		platforms := resolved[t]
+		if missing := missingPlatform(strings.Split(platforms, ","), vc.RequirePlatforms); missing != "" {
+			log.Debugf("Removing tag %s because it is not available for platform %s", t, missing)
+			excluded.Exclude(t, "platform", "not available for platform %s", missing)
+			continue
+		}
+		kept = append(kept, t)
+	}
+	return kept
+}
+
+// missingPlatform returns the first of the required platforms that none of
+// the available platforms satisfies, or the empty string if all are satisfied
+func missingPlatform(available, required []string) string {
+	for _, r := range required {
+		satisfied := false
+		for _, a := range available {
+			if platformSatisfies(a, r) {
+				satisfied = true
+				break
+			}
+		}
+		if !satisfied {
+			return r
+		}
+	}
+	return ""
+}
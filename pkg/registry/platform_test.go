@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/mocks"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// newPlatformRegistryClient returns a registry client with tag 1.0 being a
+// single-platform image for linux/amd64, and tag 1.1 being an image index
+// for multiple platforms
+func newPlatformRegistryClient() *mocks.RegistryClient {
+	single := &schema2.DeserializedManifest{}
+	armV7 := newManifestDescriptor("sha256:armv7", "application/vnd.oci.image.manifest.v1+json", "linux", "arm")
+	armV7.Platform.Variant = "v7"
+	regClient := &mocks.RegistryClient{}
+	regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0", "1.1", "1.2"}, nil)
+	regClient.On("ManifestList", mock.Anything, "foo/bar", "1.1").Return(newManifestList(
+		newManifestDescriptor("sha256:amd", "application/vnd.oci.image.manifest.v1+json", "linux", "amd64"),
+		newManifestDescriptor("sha256:nested", "application/vnd.oci.image.index.v1+json", "", ""),
+		newManifestDescriptor("sha256:attestation", "application/vnd.oci.image.manifest.v1+json", "unknown", "unknown"),
+	), nil)
+	regClient.On("ManifestList", mock.Anything, "foo/bar", "sha256:nested").Return(newManifestList(
+		newManifestDescriptor("sha256:arm", "application/vnd.oci.image.manifest.v1+json", "linux", "arm64"),
+		armV7,
+	), nil)
+	regClient.On("ManifestList", mock.Anything, "foo/bar", mock.Anything).Return(nil, fmt.Errorf("not a manifest list"))
+	regClient.On("ManifestV2", mock.Anything, "foo/bar", "1.0").Return(single, nil)
+	regClient.On("ManifestV2", mock.Anything, "foo/bar", mock.Anything).Return(nil, fmt.Errorf("not found"))
+	regClient.On("ManifestV1", mock.Anything, "foo/bar", mock.Anything).Return(nil, fmt.Errorf("not found"))
+	regClient.On("TagMetadata", mock.Anything, "foo/bar", single).Return(&tag.TagInfo{OS: "linux", Arch: "amd64"}, nil)
+	return regClient
+}
+
+// platformDigestRegistryClient is a RegistryClient that resolves the digests
+// of tags from a map
+type platformDigestRegistryClient struct {
+	*mocks.RegistryClient
+	digests map[string]string
+}
+
+func (c *platformDigestRegistryClient) TagDigest(ctx context.Context, nameInRepository, tagName string) (string, error) {
+	if digest, ok := c.digests[tagName]; ok {
+		return digest, nil
+	}
+	return "", fmt.Errorf("not found")
+}
+
+func Test_GetPlatforms(t *testing.T) {
+	ep, err := GetRegistryEndpoint("")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("foo/bar:1.0")
+
+	t.Run("Platforms of image index", func(t *testing.T) {
+		platforms, err := ep.GetPlatforms(context.Background(), img, "1.1", newPlatformRegistryClient())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"linux/amd64", "linux/arm/v7", "linux/arm64"}, platforms)
+	})
+
+	t.Run("Platform of single-platform image", func(t *testing.T) {
+		platforms, err := ep.GetPlatforms(context.Background(), img, "1.0", newPlatformRegistryClient())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"linux/amd64"}, platforms)
+	})
+
+	t.Run("Tag does not exist", func(t *testing.T) {
+		platforms, err := ep.GetPlatforms(context.Background(), img, "1.2", newPlatformRegistryClient())
+		assert.Error(t, err)
+		assert.Nil(t, platforms)
+	})
+}
+
+func Test_GetTagsRequirePlatforms(t *testing.T) {
+	ep, err := GetRegistryEndpoint("")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("foo/bar:1.0")
+
+	t.Run("Tags must be available for all required platforms", func(t *testing.T) {
+		vc := &image.VersionConstraint{RequirePlatforms: []string{"linux/amd64", "linux/arm64"}}
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, newPlatformRegistryClient(), vc)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.1"}, tl.Tags())
+		assert.Equal(t, "platform: not available for platform linux/arm64", excluded["1.0"])
+		assert.Equal(t, "platform: could not determine platforms: not found", excluded["1.2"])
+	})
+
+	t.Run("Required platform with variant", func(t *testing.T) {
+		vc := &image.VersionConstraint{RequirePlatforms: []string{"linux/arm/v6"}}
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, newPlatformRegistryClient(), vc)
+		require.NoError(t, err)
+		assert.Empty(t, tl.Tags())
+		assert.Equal(t, "platform: not available for platform linux/arm/v6", excluded["1.1"])
+	})
+
+	t.Run("Platforms are looked up once per digest", func(t *testing.T) {
+		regClient := &mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.1", "1.3"}, nil)
+		regClient.On("ManifestList", mock.Anything, "foo/bar", "sha256:index").Return(newManifestList(
+			newManifestDescriptor("sha256:amd", "application/vnd.oci.image.manifest.v1+json", "linux", "amd64"),
+			newManifestDescriptor("sha256:arm", "application/vnd.oci.image.manifest.v1+json", "linux", "arm64"),
+		), nil)
+		client := &platformDigestRegistryClient{RegistryClient: regClient, digests: map[string]string{"1.1": "sha256:index", "1.3": "sha256:index"}}
+		// Tags are resolved one after another, so that tags pointing to the same
+		// digest are not looked up concurrently
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", MaxStreams: 1}
+		vc := &image.VersionConstraint{RequirePlatforms: []string{"linux/arm64"}}
+
+		for i := 0; i < 2; i++ {
+			tl, err := ep.GetTags(context.Background(), img, client, vc)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{"1.1", "1.3"}, tl.Tags())
+		}
+		regClient.AssertNumberOfCalls(t, "ManifestList", 1)
+	})
+}
+
+func Test_PlatformSatisfies(t *testing.T) {
+	assert.True(t, platformSatisfies("linux/amd64", "linux/amd64"))
+	assert.True(t, platformSatisfies("linux/arm64/v8", "linux/arm64"))
+	assert.False(t, platformSatisfies("linux/arm64", "linux/arm64/v8"))
+	assert.False(t, platformSatisfies("linux/arm/v6", "linux/arm/v7"))
+	assert.False(t, platformSatisfies("windows/amd64", "linux/amd64"))
+}
@@ -0,0 +1,74 @@
+package registry
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// Number of images whose tags are prefetched concurrently
+const PrefetchConcurrency = 4
+
+// Prefetch fetches the tags of the given images from the registry, the same
+// way GetTags does, so that the meta data of their tags is cached before the
+// first update cycle. This also surfaces misconfigured registries early. The
+// images are fetched concurrently, each repository only once. If vc is nil,
+// only the tag lists are fetched, otherwise vc determines which tags' meta
+// data is fetched and cached, i.e. all of them when sorting by creation date.
+//
+// The returned map holds the error for each image, by its name, whose tags
+// could not be fetched. Images that were prefetched successfully have no
+// entry. Once ctx is done, no further images are fetched, and the remaining
+// images get the context's error.
+func (endpoint *RegistryEndpoint) Prefetch(ctx context.Context, images []*image.ContainerImage, regClient RegistryClient, vc *image.VersionConstraint) map[string]error {
+	if vc == nil {
+		vc = &image.VersionConstraint{SortMode: image.VersionSortSemVer}
+	}
+
+	errs := make(map[string]error)
+	errLock := sync.Mutex{}
+	setErr := func(name string, err error) {
+		errLock.Lock()
+		errs[name] = err
+		errLock.Unlock()
+	}
+
+	start := time.Now()
+	seen := make(map[string]bool, len(images))
+	sem := semaphore.NewWeighted(PrefetchConcurrency)
+	var wg sync.WaitGroup
+	for _, img := range images {
+		name := endpoint.nameInRegistry(img)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if err := sem.Acquire(ctx, 1); err != nil {
+			setErr(img.GetFullNameWithoutTag(), err)
+			continue
+		}
+		wg.Add(1)
+		go func(img *image.ContainerImage) {
+			defer func() {
+				sem.Release(1)
+				wg.Done()
+			}()
+			tags, err := endpoint.GetTags(ctx, img, regClient, vc)
+			if err != nil {
+				log.Debugf("could not prefetch tags of %s: %v", img.GetFullNameWithoutTag(), err)
+				setErr(img.GetFullNameWithoutTag(), err)
+				return
+			}
+			log.Debugf("prefetched %d tags of %s", len(tags.Tags()), img.GetFullNameWithoutTag())
+		}(img)
+	}
+	wg.Wait()
+
+	log.Infof("Prefetched tags of %d images from registry %s in %s, %d failed", len(seen), endpoint.RegistryAPI, time.Since(start).Round(time.Millisecond), len(errs))
+	return errs
+}
@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/cache"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/mocks"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Prefetch(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	newClient := func() *mocks.RegistryClient {
+		regClient := &mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, "foo/bar").Return([]string{"1.0", "1.1"}, nil)
+		regClient.On("Tags", mock.Anything, "foo/baz").Return([]string{"2.0"}, nil)
+		regClient.On("Tags", mock.Anything, "foo/broken").Return(nil, fmt.Errorf("name unknown"))
+		regClient.On("ManifestV2", mock.Anything, mock.Anything, mock.Anything).Return(&schema2.DeserializedManifest{}, nil)
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(&tag.TagInfo{CreatedAt: created}, nil)
+		return regClient
+	}
+	images := []*image.ContainerImage{
+		image.NewFromIdentifier("example.com/foo/bar:1.0"),
+		image.NewFromIdentifier("example.com/foo/baz:2.0"),
+		image.NewFromIdentifier("example.com/foo/broken:1.0"),
+		image.NewFromIdentifier("other=example.com/foo/bar:1.1"),
+	}
+
+	t.Run("Prefetch populates the cache", func(t *testing.T) {
+		regClient := newClient()
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+		errs := ep.Prefetch(context.Background(), images, regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
+		require.Len(t, errs, 1)
+		assert.EqualError(t, errs["example.com/foo/broken"], "name unknown")
+
+		for _, t2 := range []string{"foo/bar:1.0", "foo/bar:1.1", "foo/baz:2.0"} {
+			name, tagName := t2[:7], t2[8:]
+			cached, err := ep.Cache.GetTag(name, tagName)
+			require.NoError(t, err)
+			require.NotNil(t, cached, t2)
+			assert.Equal(t, created, *cached.TagDate)
+		}
+		// Each repository is fetched once
+		regClient.AssertNumberOfCalls(t, "Tags", 3)
+	})
+
+	t.Run("Prefetch without constraint only fetches tag lists", func(t *testing.T) {
+		regClient := newClient()
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+		errs := ep.Prefetch(context.Background(), images[:2], regClient, nil)
+		assert.Empty(t, errs)
+		regClient.AssertNotCalled(t, "TagMetadata", mock.Anything, mock.Anything, mock.Anything)
+		assert.Equal(t, 2, ep.Cache.GetTagCount("foo/bar"))
+	})
+
+	t.Run("Prefetch stops once context is done", func(t *testing.T) {
+		regClient := newClient()
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", RegistryAPI: "https://example.com", Cache: cache.NewMemCache()}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		errs := ep.Prefetch(ctx, images, regClient, nil)
+		assert.Len(t, errs, 3)
+		for _, err := range errs {
+			assert.Equal(t, context.Canceled, err)
+		}
+	})
+}
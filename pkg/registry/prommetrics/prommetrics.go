@@ -0,0 +1,93 @@
+// Package prommetrics implements registry.Metrics using Prometheus collectors
+package prommetrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics holds the Prometheus collectors for the traffic to registries. It
+// implements both, registry.Metrics and prometheus.Collector, so it needs to
+// be registered with a Prometheus registry before its values are exported.
+type Metrics struct {
+	calls        *prometheus.CounterVec
+	latency      *prometheus.HistogramVec
+	cacheLookups *prometheus.CounterVec
+	circuits     *prometheus.GaugeVec
+}
+
+// New returns a new Metrics object
+func New() *Metrics {
+	m := &Metrics{}
+
+	m.calls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "argocd_image_updater_registry_calls_total",
+		Help: "The number of registry operations performed, such as fetching tags or manifests",
+	}, []string{"registry", "operation", "failed"})
+	m.latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "argocd_image_updater_registry_request_duration_seconds",
+		Help:    "The duration of HTTP requests to registries",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"registry"})
+	m.cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "argocd_image_updater_registry_cache_lookups_total",
+		Help: "The number of lookups of tag metadata in the cache",
+	}, []string{"registry", "result"})
+	m.circuits = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "argocd_image_updater_registry_circuit_state",
+		Help: "The state of the circuit breaker of registries, 1 for the current state and 0 for the others",
+	}, []string{"registry", "state"})
+
+	return m
+}
+
+// Describe sends the descriptors of all collectors to ch
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.calls.Describe(ch)
+	m.latency.Describe(ch)
+	m.cacheLookups.Describe(ch)
+	m.circuits.Describe(ch)
+}
+
+// Collect sends the current values of all collectors to ch
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.calls.Collect(ch)
+	m.latency.Collect(ch)
+	m.cacheLookups.Collect(ch)
+	m.circuits.Collect(ch)
+}
+
+// RegistryCall counts a call of a registry client operation
+func (m *Metrics) RegistryCall(registryAPI, operation string, failed bool) {
+	m.calls.WithLabelValues(registryAPI, operation, strconv.FormatBool(failed)).Inc()
+}
+
+// RequestLatency observes the duration of an HTTP request to a registry
+func (m *Metrics) RequestLatency(registryAPI string, duration time.Duration) {
+	m.latency.WithLabelValues(registryAPI).Observe(duration.Seconds())
+}
+
+// CacheLookup counts a lookup of tag metadata in the cache
+func (m *Metrics) CacheLookup(registryAPI string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(registryAPI, result).Inc()
+}
+
+// States of the circuit breaker of a registry
+var circuitStates = []string{"closed", "open", "half-open"}
+
+// CircuitState sets the state of the circuit breaker of a registry
+func (m *Metrics) CircuitState(registryAPI string, state string) {
+	for _, s := range circuitStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		m.circuits.WithLabelValues(registryAPI, s).Set(value)
+	}
+}
@@ -0,0 +1,51 @@
+package prommetrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Metrics(t *testing.T) {
+	m := New()
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(m))
+
+	m.RegistryCall("https://registry-1.docker.io", "tags", false)
+	m.RegistryCall("https://registry-1.docker.io", "tags", false)
+	m.RegistryCall("https://registry-1.docker.io", "manifest_v2", true)
+	m.RequestLatency("https://registry-1.docker.io", 200*time.Millisecond)
+	m.CacheLookup("https://registry-1.docker.io", true)
+	m.CacheLookup("https://registry-1.docker.io", false)
+	m.CacheLookup("https://registry-1.docker.io", false)
+	m.CircuitState("https://registry-1.docker.io", "closed")
+	m.CircuitState("https://registry-1.docker.io", "open")
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.calls.WithLabelValues("https://registry-1.docker.io", "tags", "false")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.calls.WithLabelValues("https://registry-1.docker.io", "manifest_v2", "true")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.cacheLookups.WithLabelValues("https://registry-1.docker.io", "hit")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.cacheLookups.WithLabelValues("https://registry-1.docker.io", "miss")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.circuits.WithLabelValues("https://registry-1.docker.io", "open")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.circuits.WithLabelValues("https://registry-1.docker.io", "closed")))
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	names := []string{}
+	for _, f := range families {
+		names = append(names, f.GetName())
+		if f.GetName() == "argocd_image_updater_registry_request_duration_seconds" {
+			require.Len(t, f.GetMetric(), 1)
+			assert.Equal(t, uint64(1), f.GetMetric()[0].GetHistogram().GetSampleCount())
+		}
+	}
+	assert.ElementsMatch(t, []string{
+		"argocd_image_updater_registry_cache_lookups_total",
+		"argocd_image_updater_registry_calls_total",
+		"argocd_image_updater_registry_circuit_state",
+		"argocd_image_updater_registry_request_duration_seconds",
+	}, names)
+}
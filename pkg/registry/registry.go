@@ -7,57 +7,422 @@ package registry
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/docker/distribution"
+	"github.com/Masterminds/semver"
 	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/kube"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/metrics"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
 )
 
+// Default number of tags whose meta data is fetched concurrently
 const (
 	MaxMetadataConcurrency = 20
 )
 
-// GetTags returns a list of available tags for the given image
-func (endpoint *RegistryEndpoint) GetTags(img *image.ContainerImage, regClient RegistryClient, vc *image.VersionConstraint) (*tag.ImageTagList, error) {
-	var tagList *tag.ImageTagList = tag.NewImageTagList()
-	var imgTag *tag.ImageTag
-	var err error
+// Group for de-duplicating concurrent fetches of the same tag list
+var tagFetchGroup singleflight.Group
+
+// GetTags returns a list of available tags for the given image. Once ctx is
+// done, requests to the registry in flight are aborted, no new requests are
+// started, and the context's error is returned.
+//
+// If the endpoint has singleflight enabled, concurrent calls for the same
+// repository, constraint and credentials share a single fetch, and each
+// caller receives its own copy of the result. Shared fetches carry the values
+// of the context of the caller that started the fetch, but are not cancelled
+// along with it. Each caller stops waiting for a shared fetch once its own
+// context is done.
+func (endpoint *RegistryEndpoint) GetTags(ctx context.Context, img *image.ContainerImage, regClient RegistryClient, vc *image.VersionConstraint) (*tag.ImageTagList, error) {
+	if !endpoint.Singleflight || !vc.HasStableKey() {
+		return endpoint.getTags(ctx, img, regClient, vc, nil)
+	}
+
+	key := endpoint.RegistryPrefix + "/" + img.ImageName + "|" + vc.Key()
+	if _, ok := regClient.(credentialsIdentifier); ok {
+		key += "|creds=" + clientCredentialsKey(regClient)
+	}
+	fetched := false
+	ch := tagFetchGroup.DoChan(key, func() (interface{}, error) {
+		fetched = true
+		return endpoint.getTags(detachedContext{parent: ctx}, img, regClient, vc, nil)
+	})
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	v, err, shared := res.Val, res.Err, res.Shared
+	if shared {
+		log.Debugf("Shared tag list fetch for %s", key)
+	}
+	if shared && !fetched {
+		scanCollectorFrom(ctx).setSource(ScanFromSharedFetch)
+	}
+	tagList, _ := v.(*tag.ImageTagList)
+	if tagList != nil {
+		tagList = tagList.DeepCopy()
+	}
+	return tagList, err
+}
+
+// detachedContext is a context that carries the values of its parent, but is
+// neither cancelled along with its parent nor has its deadline
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// GetTagsExplained returns a list of available tags for the given image just
+// like GetTags, and additionally the reason for each tag that was filtered
+// out, referencing the filter stage that rejected it.
+func (endpoint *RegistryEndpoint) GetTagsExplained(ctx context.Context, img *image.ContainerImage, regClient RegistryClient, vc *image.VersionConstraint) (*tag.ImageTagList, image.TagExclusions, error) {
+	excluded := image.TagExclusions{}
+	tagList, err := endpoint.getTags(ctx, img, regClient, vc, excluded)
+	return tagList, excluded, err
+}
+
+// GetNewestTags returns up to n of the newest tags the image could be updated
+// to, ordered from oldest to newest, so that the last one is the tag an update
+// would select. The tags are fetched like GetTags does, and sorted and
+// filtered like an update does. Tags that are not newer than the current
+// version of the image are among them if there are fewer than n newer ones.
+// If a signature is required, only the newest tag is verified.
+//
+// Unless the tags are sorted by their creation time and the registry does not
+// return them in that order, or tags are filtered by their age, the tags are
+// ordered without their meta data, and meta data requested by the constraint
+// is only fetched for the newest tags that are returned.
+func (endpoint *RegistryEndpoint) GetNewestTags(ctx context.Context, img *image.ContainerImage, regClient RegistryClient, vc *image.VersionConstraint, n int) (tag.SortableImageTagList, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("number of tags must be positive, got %d", n)
+	}
+	lookup := vc
+	deferMetadata := (vc.FetchMetadata || vc.IncludePlatform) && vc.MaxAge == 0 && (vc.SortMode != image.VersionSortLatest || endpoint.TagListSort.IsTimeSorted())
+	if deferMetadata {
+		withoutMetadata := *vc
+		withoutMetadata.FetchMetadata = false
+		withoutMetadata.IncludePlatform = false
+		lookup = &withoutMetadata
+	}
+	tagList, err := endpoint.GetTags(ctx, img, regClient, lookup)
+	if err != nil {
+		return nil, err
+	}
+	selection, err := img.SelectVersionFromTags(endpoint.withSignatureVerifier(ctx, img, regClient, lookup), tagList)
+	if err != nil {
+		return nil, err
+	}
+	if deferMetadata {
+		return endpoint.newestWithMetadata(ctx, endpoint.nameInRegistry(img), selection.Candidates, regClient, n), nil
+	}
+	candidates := selection.Candidates
+	if len(candidates) > n {
+		candidates = candidates[len(candidates)-n:]
+	}
+	return candidates, nil
+}
+
+// newestWithMetadata returns up to n of the newest of the given candidates,
+// which are ordered from oldest to newest, with their meta data attached. The
+// meta data is taken from the cache where the endpoint uses it, and fetched
+// for the newest candidates otherwise. Candidates whose meta data cannot be
+// fetched are skipped, so that older ones take their place.
+func (endpoint *RegistryEndpoint) newestWithMetadata(ctx context.Context, nameInRegistry string, candidates tag.SortableImageTagList, regClient RegistryClient, n int) tag.SortableImageTagList {
+	tagCache := endpoint.tagCache(ctx)
+	withMetadata := make(map[string]*tag.ImageTag, n)
+	metadataLock := sync.Mutex{}
+	newest := tag.SortableImageTagList{}
+	for end := len(candidates); end > 0 && len(newest) < n && ctx.Err() == nil; {
+		start := end - (n - len(newest))
+		if start < 0 {
+			start = 0
+		}
+		batch := candidates[start:end]
+		known := make(map[string]*tag.ImageTag, len(batch))
+		uncached := []string{}
+		for _, t := range batch {
+			known[t.TagName] = t
+			if cached, err := tagCache.GetTag(nameInRegistry, t.TagName); err == nil && cached != nil && cached.TagInfo != nil && endpoint.usesCachedTag(ctx, nameInRegistry, cached) {
+				withMetadata[t.TagName] = withTagInfo(known, cached)
+			} else {
+				uncached = append(uncached, t.TagName)
+			}
+		}
+		endpoint.resolveTags(ctx, nameInRegistry, uncached, "meta data", func(ctx context.Context, nameInRegistry, tagName string) (string, error) {
+			imgTag, reason, _ := fetchTagMetadata(ctx, nameInRegistry, tagName, regClient)
+			if imgTag == nil {
+				return "", fmt.Errorf("%s", reason)
+			}
+			tagCache.SetTag(nameInRegistry, imgTag)
+			metadataLock.Lock()
+			withMetadata[tagName] = withTagInfo(known, imgTag)
+			metadataLock.Unlock()
+			return "", nil
+		})
+		for i := len(batch) - 1; i >= 0 && len(newest) < n; i-- {
+			if t, ok := withMetadata[batch[i].TagName]; ok {
+				newest = append(newest, t)
+			}
+		}
+		end = start
+	}
+	for i, j := 0, len(newest)-1; i < j; i, j = i+1, j-1 {
+		newest[i], newest[j] = newest[j], newest[i]
+	}
+	return newest
+}
 
+// getTags retrieves the list of available tags for the given image, and
+// records the reason for excluding tags in excluded, if it is non-nil.
+//
+// If the endpoint has a negative cache TTL, the fact that no tags were found
+// for a constraint is cached for that long, and the registry is not queried
+// again for the constraint until the cache entry expires. The same goes for
+// lookups the registry failed with not found, i.e. for a repository that does
+// not exist, for which the not found error is returned again. Other errors are
+// not cached. Explained fetches always query the registry, so that the reasons
+// for exclusion are known.
+//
+// If the endpoint has a circuit breaker and its circuit is open, the registry
+// is not queried, and the tags that last resulted for the constraint are
+// returned instead. If there are none, a CircuitOpenError is returned.
+func (endpoint *RegistryEndpoint) getTags(ctx context.Context, img *image.ContainerImage, regClient RegistryClient, vc *image.VersionConstraint, excluded image.TagExclusions) (*tag.ImageTagList, error) {
 	// Some registries have a default namespace that is used when the image name
 	// doesn't specify one. For example at Docker Hub, this is 'library'.
-	var nameInRegistry string
-	if len := len(strings.Split(img.ImageName, "/")); len == 1 && endpoint.DefaultNS != "" {
-		nameInRegistry = endpoint.DefaultNS + "/" + img.ImageName
-		log.Debugf("Using canonical image name '%s' for image '%s'", nameInRegistry, img.ImageName)
+	nameInRegistry := endpoint.nameInRegistry(img)
+	if vc.NoCache {
+		ctx = withoutCache(ctx)
+	}
+	// Results for constraints without a stable key cannot be told apart
+	keyed := vc.HasStableKey()
+	useNegativeCache := endpoint.NegativeCacheTTL > 0 && excluded == nil && keyed && endpoint.usesCache(ctx)
+	if useNegativeCache && endpoint.imageTagCache().HasNoTags(nameInRegistry, vc.Key()) {
+		log.Debugf("No matching tags for %s cached, not querying registry", nameInRegistry)
+		recordScanCacheLookup(ctx, endpoint.RegistryAPI, true)
+		scanCollectorFrom(ctx).setSource(ScanFromNegativeCache)
+		return tag.NewImageTagList(), nil
+	}
+	if useNegativeCache && endpoint.imageTagCache().HasNoTags(nameInRegistry, notFoundKey(vc.Key(), clientCredentialsKey(regClient))) {
+		log.Debugf("Failed lookup of %s cached, not querying registry", nameInRegistry)
+		recordScanCacheLookup(ctx, endpoint.RegistryAPI, true)
+		scanCollectorFrom(ctx).setSource(ScanFromNegativeCache)
+		return nil, &RegistryError{
+			Registry:   endpoint.RegistryAPI,
+			StatusCode: http.StatusNotFound,
+			Err:        fmt.Errorf("%s not found in registry %s (cached)", nameInRegistry, endpoint.RegistryAPI),
+			kind:       ErrManifestNotFound,
+		}
+	}
+
+	var tagList *tag.ImageTagList
+	var err error
+	cb := endpoint.circuitBreaker()
+	if blocked, until := cb.blocked(); blocked {
+		err = &CircuitOpenError{Registry: endpoint.RegistryAPI, Until: until}
 	} else {
-		nameInRegistry = img.ImageName
+		tagList, err = endpoint.fetchTags(ctx, img, nameInRegistry, regClient, vc, excluded)
+	}
+	if cb != nil && excluded == nil && keyed && endpoint.usesCache(ctx) {
+		if err == nil {
+			endpoint.setLastTagResult(nameInRegistry, vc.Key(), clientCredentialsKey(regClient), tagList)
+		} else if IsCircuitOpenError(err) {
+			if last := endpoint.lastTagResult(nameInRegistry, vc.Key(), clientCredentialsKey(regClient)); last != nil {
+				log.Debugf("Circuit for registry %s is open, using last known tags of %s", endpoint.RegistryAPI, nameInRegistry)
+				scanCollectorFrom(ctx).setSource(ScanFromLastKnown)
+				return last, nil
+			}
+		}
+	}
+	if err == nil && useNegativeCache && len(tagList.Tags()) == 0 {
+		log.Debugf("No matching tags for %s, caching for %s", nameInRegistry, endpoint.NegativeCacheTTL)
+		endpoint.imageTagCache().SetNoTags(nameInRegistry, vc.Key(), endpoint.NegativeCacheTTL)
+	}
+	if useNegativeCache && errors.Is(err, ErrManifestNotFound) {
+		log.Debugf("Lookup of %s failed with not found, caching for %s", nameInRegistry, endpoint.NegativeCacheTTL)
+		endpoint.imageTagCache().SetNoTags(nameInRegistry, notFoundKey(vc.Key(), clientCredentialsKey(regClient)), endpoint.NegativeCacheTTL)
+	}
+	return tagList, err
+}
+
+// notFoundKey returns the key under which a failed lookup for the constraint
+// with the given key is recorded in the negative cache. Since a registry may
+// answer not found for a repository the credentials have no access to, the
+// lookup is only recorded for the same credentials.
+func notFoundKey(constraintKey, credsKey string) string {
+	return constraintKey + "|creds=" + credsKey + "|not-found"
+}
+
+// fetchTags retrieves the list of available tags for the image with the given
+// name in the registry. It stops early with the context's error once ctx is
+// done.
+//
+// If the registry sends an ETag for the tag list and the list has not changed
+// since, the tags that resulted from it before are returned without filtering
+// them or looking at their meta data again.
+//
+// If the number of tags to consider is limited, and the registry client can
+// list the tags page by page, no more pages are fetched once enough tags
+// passed all filters.
+func (endpoint *RegistryEndpoint) fetchTags(ctx context.Context, img *image.ContainerImage, nameInRegistry string, regClient RegistryClient, vc *image.VersionConstraint, excluded image.TagExclusions) (tagList *tag.ImageTagList, err error) {
+	tagList = tag.NewImageTagList()
+	var imgTag *tag.ImageTag
+	if vc.NoCache {
+		ctx = withoutCache(ctx)
+	}
+	tagCache := endpoint.tagCache(ctx)
+
+	// The creation date of tags is only known from their meta data
+	fetchMetadata := vc.FetchMetadata || vc.MaxAge > 0
+	createdAfter := time.Now().Add(-vc.MaxAge)
+
+	// Callers must hold tagListLock once meta data is fetched concurrently
+	failed := 0
+	add := func(t *tag.ImageTag) {
+		if vc.MaxAge > 0 && !isTagRecent(t, createdAfter, vc, excluded) {
+			return
+		}
+		tagList.Add(t)
 	}
-	tTags, err := regClient.Tags(nameInRegistry)
+
+	// An invalid constraint is a configuration error, no need to ask the
+	// registry in that case
+	semverConstraint, err := vc.SemverConstraint()
 	if err != nil {
 		return nil, err
 	}
+	if _, ok := regClient.(PullCountClient); vc.MinDownloads > 0 && !ok {
+		return nil, fmt.Errorf("registry %s does not report pull counts of tags, min-downloads cannot be used for %s", endpoint.RegistryAPI, nameInRegistry)
+	}
 
-	tags := []string{}
+	var tags []string
+	_, searched := endpoint.searchedTags(ctx, nameInRegistry)
+	if pc, ok := regClient.(PagedTagsClient); ok && vc.MaxTags > 0 && vc.MinTags == 0 && !searched {
+		tags, err = endpoint.listTagsUpTo(ctx, img, nameInRegistry, pc, regClient, vc, semverConstraint, excluded)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var tTags []string
+		var etag string
+		var unchanged bool
+		tTags, etag, unchanged, err = endpoint.listTags(ctx, nameInRegistry, regClient)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
 
-	// Loop through tags, removing those we do not want
-	if vc.MatchFunc != nil || len(vc.IgnoreList) > 0 {
-		for _, t := range tTags {
-			if (vc.MatchFunc != nil && !vc.MatchFunc(t, vc.MatchArgs)) || vc.IsTagIgnored(t) {
-				log.Tracef("Removing tag %s because it either didn't match defined pattern or is ignored", t)
-			} else {
-				tags = append(tags, t)
+		// Turn a silent lack of candidates into an actionable message
+		if warning := vc.SemverWarning(tTags); warning != "" {
+			log.WithContext().AddField("image", nameInRegistry).Warnf("%s", warning)
+		}
+
+		// Results of explained fetches are neither reused nor recorded, and
+		// neither are results with tags whose meta data could not be fetched.
+		if etag != "" && excluded == nil && endpoint.reusesTagResults(vc) && endpoint.usesCache(ctx) {
+			if unchanged {
+				if cached := endpoint.getTagResult(nameInRegistry, vc.Key(), etag); cached != nil {
+					log.Debugf("Reusing tags of %s from unchanged tag list", nameInRegistry)
+					recordScanCacheLookup(ctx, endpoint.RegistryAPI, true)
+					scanCollectorFrom(ctx).setSource(ScanFromUnchangedTagList)
+					return cached, nil
+				}
 			}
+			defer func() {
+				if err == nil && failed == 0 && tagList != nil {
+					endpoint.setTagResult(nameInRegistry, vc.Key(), etag, tagList)
+				}
+			}()
 		}
-	} else {
-		tags = tTags
+
+		// Guard against tag lists truncated by the registry, which could hide the
+		// newest tags
+		if err := endpoint.checkTagCount(ctx, nameInRegistry, len(tTags), vc.MinTags); err != nil {
+			return nil, err
+		}
+
+		tags = endpoint.filterTags(ctx, img, nameInRegistry, tTags, regClient, vc, semverConstraint, excluded)
+	}
+
+	// Only consider the first tags up to the maximum, if one is set
+	if vc.MaxTags > 0 && len(tags) > vc.MaxTags {
+		for _, t := range tags[vc.MaxTags:] {
+			excluded.Exclude(t, "max-tags", "exceeds the maximum of %d tags", vc.MaxTags)
+		}
+		log.Debugf("Considering only the first %d of %d tags of %s", vc.MaxTags, len(tags), nameInRegistry)
+		tags = tags[:vc.MaxTags]
+	}
+
+	// Tags whose date and digest are already known from the sort mode. If
+	// meta data is requested, it is only attached to them.
+	var known map[string]*tag.ImageTag
+
+	// When tracking a tag by its digest, we need no other meta data
+	if vc.SortMode == image.VersionSortDigest {
+		digestList, err := endpoint.getTagsWithDigests(ctx, nameInRegistry, tags, regClient, vc, excluded)
+		if err != nil || !fetchMetadata {
+			return digestList, err
+		}
+		known = map[string]*tag.ImageTag{}
+		resolved := []string{}
+		for _, t := range tags {
+			if imgTag := digestList.Get(t); imgTag != nil {
+				known[t] = imgTag
+				resolved = append(resolved, t)
+			}
+		}
+		tags = resolved
+	}
+
+	// Dates embedded in the tag names are used instead of the meta data
+	if vc.SortMode == image.VersionSortDate {
+		known = map[string]*tag.ImageTag{}
+		dated := []string{}
+		for _, t := range tags {
+			date, ok := vc.TagDate(t)
+			if !ok {
+				log.Tracef("Removing tag %s because it does not contain a date", t)
+				excluded.Exclude(t, "tag-date", "does not contain a date matching %v", vc.DatePattern)
+				continue
+			}
+			known[t] = tag.NewImageTag(t, date)
+			dated = append(dated, t)
+		}
+		tags = dated
+	}
+
+	if known != nil && !fetchMetadata {
+		for _, t := range tags {
+			add(known[t])
+		}
+		return tagList, nil
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
 
 	// In some cases, we don't need to fetch the metadata to get the creation time
@@ -68,7 +433,8 @@ func (endpoint *RegistryEndpoint) GetTags(img *image.ContainerImage, regClient R
 	//
 	// We just create a dummy time stamp according to the registry's sort mode, if
 	// set.
-	if vc.SortMode != image.VersionSortLatest || endpoint.TagListSort.IsTimeSorted() {
+	// If the meta data of the tags was requested, we always need it.
+	if !fetchMetadata && (vc.SortMode != image.VersionSortLatest || endpoint.TagListSort.IsTimeSorted()) {
 		for i, tagStr := range tags {
 			var ts int
 			if endpoint.TagListSort == SortLatestFirst {
@@ -77,12 +443,18 @@ func (endpoint *RegistryEndpoint) GetTags(img *image.ContainerImage, regClient R
 				ts = i
 			}
 			imgTag = tag.NewImageTag(tagStr, time.Unix(int64(ts), 0))
-			tagList.Add(imgTag)
+			add(imgTag)
 		}
 		return tagList, nil
 	}
 
-	sem := semaphore.NewWeighted(int64(MaxMetadataConcurrency))
+	// Some registry flavors can tell us the dates of all tags at once, so we
+	// only need to fetch the meta data for tags without a known date.
+	if endpoint.Flavor.HasTagDates() && !fetchMetadata {
+		tags = addTagsWithDates(ctx, nameInRegistry, tags, regClient, add)
+	}
+
+	sem := semaphore.NewWeighted(int64(endpoint.metadataConcurrency()))
 	tagListLock := &sync.RWMutex{}
 
 	var wg sync.WaitGroup
@@ -93,26 +465,34 @@ func (endpoint *RegistryEndpoint) GetTags(img *image.ContainerImage, regClient R
 	i := 0
 	for _, tagStr := range tags {
 		i += 1
+		// Don't start any new requests once we have been cancelled
+		if ctx.Err() != nil {
+			wg.Done()
+			continue
+		}
+
 		// Look into the cache first and re-use any found item. If GetTag() returns
 		// an error, we treat it as a cache miss and just go ahead to invalidate
 		// the entry.
-		imgTag, err = endpoint.Cache.GetTag(nameInRegistry, tagStr)
+		imgTag, err = tagCache.GetTag(nameInRegistry, tagStr)
 		if err != nil {
 			log.Warnf("invalid entry for %s:%s in cache, invalidating.", nameInRegistry, imgTag.TagName)
-		} else if imgTag != nil {
+		} else if imgTag != nil && (!fetchMetadata || imgTag.TagInfo != nil) && endpoint.usesCachedTag(ctx, nameInRegistry, imgTag) {
 			log.Debugf("Cache hit for %s:%s", nameInRegistry, imgTag.TagName)
+			recordScanCacheLookup(ctx, endpoint.RegistryAPI, true)
 			tagListLock.Lock()
-			tagList.Add(imgTag)
+			add(withTagInfo(known, imgTag))
 			tagListLock.Unlock()
 			wg.Done()
 			continue
 		}
 
 		log.Tracef("Getting manifest for image %s:%s (operation %d/%d)", nameInRegistry, tagStr, i, len(tags))
+		recordScanCacheLookup(ctx, endpoint.RegistryAPI, false)
 
-		lockErr := sem.Acquire(context.TODO(), 1)
+		lockErr := sem.Acquire(ctx, 1)
 		if lockErr != nil {
-			log.Warnf("could not acquire semaphore: %v", lockErr)
+			log.Debugf("could not acquire semaphore: %v", lockErr)
 			wg.Done()
 			continue
 		}
@@ -125,83 +505,763 @@ func (endpoint *RegistryEndpoint) GetTags(img *image.ContainerImage, regClient R
 				log.Tracef("released semaphore and terminated waitgroup")
 			}()
 
-			var ml distribution.Manifest
-			var err error
-
-			// We first try to fetch a V2 manifest, and if that's not available we fall
-			// back to fetching V1 manifest. If that fails also, we just skip this tag.
-			if ml, err = regClient.ManifestV2(nameInRegistry, tagStr); err != nil {
-				log.Debugf("No V2 manifest for %s:%s, fetching V1 (%v)", nameInRegistry, tagStr, err)
-				if ml, err = regClient.ManifestV1(nameInRegistry, tagStr); err != nil {
-					log.Errorf("Error fetching metadata for %s:%s - neither V1 or V2 manifest returned by registry: %v", nameInRegistry, tagStr, err)
-					return
+			imgTag, reason, fetchFailed := fetchTagMetadata(ctx, nameInRegistry, tagStr, regClient)
+			if imgTag == nil {
+				tagListLock.Lock()
+				excluded.Exclude(tagStr, "metadata", "%s", reason)
+				if fetchFailed {
+					failed += 1
 				}
-			}
-
-			// Parse required meta data from the manifest. The metadata contains all
-			// information needed to decide whether to consider this tag or not.
-			ti, err := regClient.TagMetadata(nameInRegistry, ml)
-			if err != nil {
-				log.Errorf("error fetching metadata for %s:%s: %v", nameInRegistry, tagStr, err)
-				return
-			}
-			if ti == nil {
-				log.Debugf("No metadata found for %s:%s", nameInRegistry, tagStr)
+				tagListLock.Unlock()
 				return
 			}
-
-			log.Tracef("Found date %s", ti.CreatedAt.String())
-
-			imgTag = tag.NewImageTag(tagStr, ti.CreatedAt)
 			tagListLock.Lock()
-			tagList.Add(imgTag)
+			add(withTagInfo(known, imgTag))
 			tagListLock.Unlock()
-			endpoint.Cache.SetTag(nameInRegistry, imgTag)
+			tagCache.SetTag(nameInRegistry, imgTag)
 		}(tagStr)
 	}
 
 	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if failed > 0 {
+		log.Warnf("could not fetch meta data for %d of %d tags of %s, these tags are not considered", failed, len(tags), nameInRegistry)
+	}
 	return tagList, err
 }
 
+// filterTags returns the tags from tTags that pass all filters of the
+// constraint and the endpoint, in the order of tTags. Removed tags are
+// recorded in excluded.
+func (endpoint *RegistryEndpoint) filterTags(ctx context.Context, img *image.ContainerImage, nameInRegistry string, tTags []string, regClient RegistryClient, vc *image.VersionConstraint, semverConstraint *semver.Constraints, excluded image.TagExclusions) []string {
+	tags := []string{}
+	filters := vc.TagFilters()
+
+	// Loop through tags, removing those we do not want
+	if len(filters) > 0 || len(vc.IgnoreList) > 0 || vc.Normalization != nil || vc.IgnorePrerelease || len(vc.AllowTags) > 0 || len(vc.DenyTags) > 0 || semverConstraint != nil || vc.Track != "" {
+		for _, t := range tTags {
+			key, _ := image.NormalizeTag(t, vc)
+			if vc.IsTagDenied(t) {
+				log.Tracef("Removing tag %s because it is denied", t)
+				excluded.Exclude(t, "deny-tags", "tag is denied")
+			} else if vc.IsTagAllowed(t) {
+				log.Tracef("Keeping tag %s because it is explicitly allowed", t)
+				tags = append(tags, t)
+			} else if key == "" {
+				log.Tracef("Removing tag %s because it does not match the normalization pattern", t)
+				excluded.Exclude(t, "normalize", "%v", image.NormalizationError(t, vc))
+			} else if filter := endpoint.rejectingTagFilter(ctx, nameInRegistry, t, key, filters); filter != nil {
+				if mf, ok := filter.(image.MatchTagFilter); ok {
+					log.Tracef("Removing tag %s because it didn't match defined pattern", t)
+					excluded.Exclude(t, "allow-tags", "does not match %v", mf.Args)
+				} else {
+					log.Tracef("Removing tag %s because it was not accepted by the tag filter", t)
+					excluded.Exclude(t, "tag-filter", "not accepted by tag filter")
+				}
+			} else if pattern := vc.IgnorePatternFor(key); pattern != "" {
+				log.Tracef("Removing tag %s because it is ignored", t)
+				excluded.Exclude(t, "ignore-tags", "excluded by ignore pattern %s", pattern)
+			} else if vc.IsPrereleaseIgnored(key) {
+				log.Tracef("Removing tag %s because it is a pre-release", t)
+				excluded.Exclude(t, "prerelease", "pre-release versions are ignored")
+			} else if !satisfiesConstraint(semverConstraint, strings.TrimSuffix(key, vc.VariantSuffix)) {
+				log.Tracef("Removing tag %s because it does not satisfy constraint %s", t, vc.Constraint)
+				excluded.Exclude(t, "constraint", "does not satisfy constraint %s", vc.Constraint)
+			} else if vc.IsOffTrack(key) {
+				log.Tracef("Removing tag %s because it is not on track %s", t, vc.Track)
+				excluded.Exclude(t, "lock", "not on track %s of current version", vc.Track)
+			} else {
+				tags = append(tags, t)
+			}
+		}
+	} else {
+		tags = tTags
+	}
+
+	// Remove tags that were not pulled often enough, if requested
+	if vc.MinDownloads > 0 {
+		tags = filterByPullCount(ctx, nameInRegistry, tags, regClient.(PullCountClient), vc, excluded)
+	}
+
+	// Make sure that none of the tags considered immutable has changed
+	if len(endpoint.ImmutableTags) > 0 {
+		tags = endpoint.verifyImmutableTags(ctx, nameInRegistry, tags, regClient, excluded)
+	}
+
+	// Remove tags that are not artifacts of the endpoint's type, i.e. images
+	// in a repository of Helm charts
+	if endpoint.ArtifactType != ArtifactImage {
+		tags = endpoint.filterByArtifactType(ctx, nameInRegistry, tags, regClient, excluded)
+	}
+
+	// Remove tags whose manifest is of a media type that is not allowed
+	if len(endpoint.AllowedMediaTypes) > 0 {
+		tags = endpoint.filterByMediaType(ctx, nameInRegistry, tags, regClient, excluded)
+	}
+
+	// Remove tags that are not available for all required platforms
+	if len(vc.RequirePlatforms) > 0 {
+		tags = endpoint.filterByPlatforms(ctx, nameInRegistry, tags, regClient, vc, excluded)
+	}
+
+	// Remove tags whose image configuration does not carry the required labels
+	if len(vc.RequireLabels) > 0 {
+		tags = endpoint.filterByLabels(ctx, img, nameInRegistry, tags, regClient, vc, excluded)
+	}
+
+	return tags
+}
+
+// listTagsUpTo lists the tags of the image with the given name page by page,
+// and filters the tags of each page as it arrives, until at least
+// vc.MaxTags tags passed all filters. The remaining pages are not fetched.
+func (endpoint *RegistryEndpoint) listTagsUpTo(ctx context.Context, img *image.ContainerImage, nameInRegistry string, pc PagedTagsClient, regClient RegistryClient, vc *image.VersionConstraint, semverConstraint *semver.Constraints, excluded image.TagExclusions) ([]string, error) {
+	listed := []string{}
+	tags := []string{}
+	err := pc.TagPages(ctx, nameInRegistry, func(page []string) bool {
+		listed = append(listed, page...)
+		tags = append(tags, endpoint.filterTags(ctx, img, nameInRegistry, page, regClient, vc, semverConstraint, excluded)...)
+		return len(tags) < vc.MaxTags && ctx.Err() == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) >= vc.MaxTags {
+		log.Debugf("Stopped listing tags of %s after %d tags, enough of them passed all filters", nameInRegistry, len(listed))
+	}
+	// Turn a silent lack of candidates into an actionable message
+	if warning := vc.SemverWarning(listed); warning != "" {
+		log.WithContext().AddField("image", nameInRegistry).Warnf("%s", warning)
+	}
+	return tags, nil
+}
+
+// fetchTagMetadata fetches the manifest and meta data of the tag from the
+// registry. If the tag cannot be considered, nil is returned along with the
+// reason, and failed is true if the registry failed to return them.
+func fetchTagMetadata(ctx context.Context, nameInRegistry, tagStr string, regClient RegistryClient) (_ *tag.ImageTag, reason string, failed bool) {
+	// We try the manifest schemas in turn, and only skip this tag if the
+	// registry returned none of them.
+	ml, schema, manifestDigest, err := tagManifest(ctx, regClient, nameInRegistry, tagStr)
+	if err != nil {
+		log.Errorf("Error fetching metadata for %s:%s - no manifest returned by registry: %v", nameInRegistry, tagStr, err)
+		return nil, fmt.Sprintf("no manifest returned by registry: %v", err), true
+	}
+	if ml == nil {
+		log.Debugf("Manifest list for %s:%s has no manifest for platform %s, skipping", nameInRegistry, tagStr, DefaultPlatform)
+		return nil, fmt.Sprintf("manifest list has no manifest for platform %s", DefaultPlatform), false
+	}
+	log.Tracef("Using %s manifest for %s:%s", schema, nameInRegistry, tagStr)
+
+	// Parse required meta data from the manifest. The metadata contains all
+	// information needed to decide whether to consider this tag or not.
+	ti, err := regClient.TagMetadata(ctx, nameInRegistry, ml)
+	if err != nil {
+		log.Errorf("error fetching metadata for %s:%s: %v", nameInRegistry, tagStr, err)
+		return nil, fmt.Sprintf("could not fetch metadata: %v", err), true
+	}
+	if ti == nil {
+		log.Debugf("No metadata found for %s:%s", nameInRegistry, tagStr)
+		return nil, "no metadata found", false
+	}
+
+	log.Tracef("Found date %s", ti.CreatedAt.String())
+
+	if ti.Digest == "" {
+		ti.Digest = manifestDigest
+	}
+	ti.Schema = string(schema)
+	imgTag := tag.NewImageTag(tagStr, ti.CreatedAt)
+	imgTag.TagPlatform = ti.Platform()
+	imgTag.TagInfo = ti
+	return imgTag, "", false
+}
+
+// usesCachedTag returns whether the cached meta data of the given tag is used
+// instead of fetching its manifest again. Without immutable tags configured
+// for the endpoint, cached meta data is always used. Otherwise, only the meta
+// data of immutable tags is used, and only if it belongs to the digest that
+// has been recorded for the tag. All other tags are considered mutable, i.e.
+// latest, and their meta data is fetched on every check.
+func (endpoint *RegistryEndpoint) usesCachedTag(ctx context.Context, nameInRegistry string, imgTag *tag.ImageTag) bool {
+	if len(endpoint.ImmutableTags) == 0 {
+		return true
+	}
+	if !endpoint.IsTagImmutable(imgTag.TagName) {
+		log.Tracef("Not using cached meta data of mutable tag %s:%s", nameInRegistry, imgTag.TagName)
+		return false
+	}
+	digest := endpoint.tagCache(ctx).GetDigest(nameInRegistry, imgTag.TagName)
+	if digest == "" {
+		return false
+	}
+	return imgTag.TagInfo == nil || imgTag.TagInfo.Digest == "" || imgTag.TagInfo.Digest == digest
+}
+
+// rejectingTagFilter returns the first of filters that does not accept the
+// tag with the given name, whose normalized name is key, or nil if all of
+// them accept it. The meta data of the tag is only looked up in the cache for
+// filters other than the built-in match function, which does not use it.
+func (endpoint *RegistryEndpoint) rejectingTagFilter(ctx context.Context, nameInRegistry, tagName, key string, filters []image.TagFilter) image.TagFilter {
+	var info *tag.TagInfo
+	infoKnown := false
+	for _, filter := range filters {
+		if _, builtin := filter.(image.MatchTagFilter); !builtin && !infoKnown {
+			info, infoKnown = endpoint.cachedTagInfo(ctx, nameInRegistry, tagName), true
+		}
+		if !filter.Accept(key, info) {
+			return filter
+		}
+	}
+	return nil
+}
+
+// cachedTagInfo returns the meta data of the tag from the cache, or nil if it
+// is not cached or must not be used, like for any other tag whose meta data
+// is fetched, because the tag is mutable or the cache is bypassed
+func (endpoint *RegistryEndpoint) cachedTagInfo(ctx context.Context, nameInRegistry, tagName string) *tag.TagInfo {
+	if !endpoint.usesCache(ctx) || endpoint.imageTagCache() == nil {
+		return nil
+	}
+	imgTag, err := endpoint.tagCache(ctx).GetTag(nameInRegistry, tagName)
+	if err != nil || imgTag == nil || imgTag.TagInfo == nil {
+		return nil
+	}
+	if !endpoint.usesCachedTag(ctx, nameInRegistry, imgTag) {
+		return nil
+	}
+	return imgTag.TagInfo
+}
+
+// withTagInfo returns the tag from known with the same name as imgTag, with
+// the meta data of imgTag attached, or imgTag itself if there is none
+func withTagInfo(known map[string]*tag.ImageTag, imgTag *tag.ImageTag) *tag.ImageTag {
+	base, ok := known[imgTag.TagName]
+	if !ok {
+		return imgTag
+	}
+	t := *base
+	t.TagInfo = imgTag.TagInfo
+	if t.TagPlatform == "" {
+		t.TagPlatform = imgTag.TagPlatform
+	}
+	return &t
+}
+
+// metadataConcurrency returns the number of tags of the endpoint whose meta
+// data may be fetched concurrently
+func (endpoint *RegistryEndpoint) metadataConcurrency() int {
+	if endpoint.MetadataConcurrency <= 0 || endpoint.MetadataConcurrency > MaxMetadataConcurrency {
+		return MaxMetadataConcurrency
+	}
+	return endpoint.MetadataConcurrency
+}
+
+// addTagsWithDates passes all tags whose dates are provided by the registry to
+// add, and returns the remaining tags for which the date is unknown.
+func addTagsWithDates(ctx context.Context, nameInRegistry string, tags []string, regClient RegistryClient, add func(*tag.ImageTag)) []string {
+	tdc, ok := regClient.(TagDateClient)
+	if !ok {
+		log.Debugf("registry client does not provide tag dates for %s", nameInRegistry)
+		return tags
+	}
+	dates, err := tdc.TagDates(ctx, nameInRegistry)
+	if err != nil {
+		log.Warnf("could not get tag dates for %s, fetching meta data instead: %v", nameInRegistry, err)
+		return tags
+	}
+
+	remaining := []string{}
+	for _, t := range tags {
+		if date, ok := dates[t]; ok {
+			add(tag.NewImageTag(t, date))
+		} else {
+			remaining = append(remaining, t)
+		}
+	}
+	log.Debugf("Got dates for %d of %d tags of %s from registry", len(tags)-len(remaining), len(tags), nameInRegistry)
+	return remaining
+}
+
+// nameInRegistry returns the name of the image in the registry, which takes
+// the default namespace of the endpoint into account.
+func (endpoint *RegistryEndpoint) nameInRegistry(img *image.ContainerImage) string {
+	if len := len(strings.Split(img.ImageName, "/")); len == 1 && endpoint.DefaultNS != "" {
+		nameInRegistry := endpoint.DefaultNS + "/" + img.ImageName
+		log.Debugf("Using canonical image name '%s' for image '%s'", nameInRegistry, img.ImageName)
+		return nameInRegistry
+	}
+	return img.ImageName
+}
+
+// WriteBackImage returns the image that should be written back for img. If the
+// endpoint has a write-back prefix configured, the registry of the returned
+// image is replaced by that prefix, while its repository and tag are kept.
+// Otherwise, img is returned unchanged.
+func (endpoint *RegistryEndpoint) WriteBackImage(img *image.ContainerImage) *image.ContainerImage {
+	if endpoint.WriteBackPrefix == "" {
+		return img
+	}
+	nimg := img.WithTag(img.ImageTag)
+	nimg.RegistryURL = endpoint.WriteBackPrefix
+	nimg.ImageName = endpoint.nameInRegistry(img)
+	nimg.RewrittenFrom = img.GetFullNameWithoutTag()
+	return nimg
+}
+
+// Time for which the search registry an image has been resolved to is reused
+// before the search registries are queried again
+const searchResolutionTTL = time.Hour
+
+// searchResolution is the prefix of the search registry an unqualified image
+// has been resolved to, and when it was resolved
+type searchResolution struct {
+	prefix   string
+	resolved time.Time
+}
+
+// searchTagsKey is the key of the context value that holds the tags fetched
+// while resolving an image against the search registries
+type searchTagsKey struct{}
+
+// searchTags are the tags of an image fetched from a search registry
+type searchTags struct {
+	prefix         string
+	nameInRegistry string
+	tags           []string
+}
+
+// searchedTags returns the tags of the image with the given name that were
+// fetched from this endpoint while resolving it against the search
+// registries, so that they need not be listed again for the scan the given
+// context belongs to
+func (endpoint *RegistryEndpoint) searchedTags(ctx context.Context, nameInRegistry string) ([]string, bool) {
+	st, ok := ctx.Value(searchTagsKey{}).(*searchTags)
+	if !ok || st.prefix != endpoint.RegistryPrefix || st.nameInRegistry != nameInRegistry {
+		return nil, false
+	}
+	return st.tags, true
+}
+
+// getSearchResolution returns the prefix of the search registry the image
+// with the given name has been resolved to within searchResolutionTTL
+func getSearchResolution(imageName string) (string, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	r, ok := searchResolutions[imageName]
+	if !ok || time.Since(r.resolved) > searchResolutionTTL {
+		return "", false
+	}
+	return r.prefix, true
+}
+
+// setSearchResolution records the prefix of the search registry the image
+// with the given name has been resolved to
+func setSearchResolution(imageName, prefix string) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	searchResolutions[imageName] = searchResolution{prefix: prefix, resolved: time.Now()}
+}
+
+// ResolveSearchRegistry resolves an image that is not qualified with a
+// registry against the configured search registries. The registries are tried
+// in order, and the endpoint of the first registry that has tags for the image
+// is returned. If the image exists in more than one registry, a message is
+// logged, but the first registry still wins. newClient is called to create a
+// client for each of the registries tried.
+//
+// The registry an image has been resolved to is reused for an hour without
+// querying the search registries again. After a fresh resolution, the
+// returned context carries the tags fetched from the matching registry, so
+// that GetTags does not list them a second time when called with it.
+func ResolveSearchRegistry(ctx context.Context, img *image.ContainerImage, newClient func(ep *RegistryEndpoint) (RegistryClient, error)) (*RegistryEndpoint, context.Context, error) {
+	if prefix, ok := getSearchResolution(img.ImageName); ok {
+		if ep, err := GetRegistryEndpoint(prefix); err == nil {
+			log.Tracef("using search registry %s for image %s from previous resolution", prefix, img.ImageName)
+			return ep, ctx, nil
+		}
+	}
+
+	var match *RegistryEndpoint
+	var matchTags []string
+	for _, prefix := range GetSearchRegistries() {
+		ep, err := GetRegistryEndpoint(prefix)
+		if err != nil {
+			log.Warnf("search registry %s is not configured: %v", prefix, err)
+			continue
+		}
+		regClient, err := newClient(ep)
+		if err != nil {
+			log.Debugf("could not create client for search registry %s: %v", prefix, err)
+			continue
+		}
+		tags, err := regClient.Tags(ctx, ep.nameInRegistry(img))
+		if err != nil || len(tags) == 0 {
+			log.Tracef("image %s not found in search registry %s", img.ImageName, prefix)
+			continue
+		}
+		if match != nil {
+			log.Infof("image %s exists in search registries %s and %s, using %s", img.ImageName, match.RegistryPrefix, ep.RegistryPrefix, match.RegistryPrefix)
+			continue
+		}
+		log.Debugf("resolved image %s to search registry %s", img.ImageName, prefix)
+		match = ep
+		matchTags = tags
+	}
+	if match == nil {
+		return nil, ctx, fmt.Errorf("image %s not found in any search registry", img.ImageName)
+	}
+	setSearchResolution(img.ImageName, match.RegistryPrefix)
+	return match, context.WithValue(ctx, searchTagsKey{}, &searchTags{
+		prefix:         match.RegistryPrefix,
+		nameInRegistry: match.nameInRegistry(img),
+		tags:           matchTags,
+	}), nil
+}
+
+// verifyImmutableTags compares the current digests of all immutable tags with
+// the digests observed first, and removes tags whose digest has changed. The
+// digests are resolved with HEAD requests and recorded in the cache. If the
+// cache is bypassed for the scan or the endpoint, they are recorded by the
+// endpoint instead.
+func (endpoint *RegistryEndpoint) verifyImmutableTags(ctx context.Context, nameInRegistry string, tags []string, regClient RegistryClient, excluded image.TagExclusions) []string {
+	immutable := []string{}
+	for _, t := range tags {
+		if endpoint.IsTagImmutable(t) {
+			immutable = append(immutable, t)
+		}
+	}
+	if len(immutable) == 0 {
+		return tags
+	}
+
+	digests, err := endpoint.GetTagDigests(ctx, nameInRegistry, immutable, regClient)
+	if err != nil {
+		log.Warnf("could not verify immutable tags of %s: %v", nameInRegistry, err)
+		return tags
+	}
+
+	tagCache := endpoint.checkState(ctx)
+	verified := []string{}
+	for _, t := range tags {
+		digest, ok := digests[t]
+		if !ok {
+			verified = append(verified, t)
+			continue
+		}
+		previous := tagCache.GetDigest(nameInRegistry, t)
+		if previous == "" {
+			tagCache.SetDigest(nameInRegistry, t, digest)
+		} else if previous != digest {
+			log.WithContext().
+				AddField("registry", endpoint.RegistryAPI).
+				AddField("image_name", nameInRegistry).
+				AddField("image_tag", t).
+				Errorf("IMMUTABLE TAG CHANGED: digest of %s:%s changed from %s to %s", nameInRegistry, t, previous, digest)
+			metrics.Endpoint().IncreaseImmutableTagViolation(endpoint.RegistryAPI)
+			excluded.Exclude(t, "immutable", "digest changed from %s to %s", previous, digest)
+			continue
+		}
+		verified = append(verified, t)
+	}
+	return verified
+}
+
+// filterByPullCount removes all tags from the list that have less pulls than
+// required by the constraint. Tags without known pull count are treated
+// according to the constraint's policy for missing data. If the pull counts
+// cannot be retrieved, all tags are kept. Removed tags are recorded in
+// excluded.
+func filterByPullCount(ctx context.Context, nameInRegistry string, tags []string, pcc PullCountClient, vc *image.VersionConstraint, excluded image.TagExclusions) []string {
+	counts, err := pcc.TagPullCounts(ctx, nameInRegistry)
+	if err != nil {
+		// A failure to get the pull counts must not leave the image
+		// without any candidates
+		log.Warnf("could not get pull counts for %s, not filtering by pull count: %v", nameInRegistry, err)
+		return tags
+	}
+
+	filtered := []string{}
+	for _, t := range tags {
+		count, ok := counts[t]
+		if !ok {
+			if vc.MissingDownloads == image.MissingDataDrop {
+				log.Tracef("Removing tag %s because its pull count is unknown", t)
+				excluded.Exclude(t, "min-downloads", "pull count is unknown")
+				continue
+			}
+		} else if count < vc.MinDownloads {
+			log.Tracef("Removing tag %s because it has only %d pulls (required: %d)", t, count, vc.MinDownloads)
+			excluded.Exclude(t, "min-downloads", "only %d pulls (required: %d)", count, vc.MinDownloads)
+			continue
+		}
+		filtered = append(filtered, t)
+	}
+	return filtered
+}
+
+// isTagRecent returns true if the tag was created after the given point in
+// time according to its meta data. Tags without known creation date are
+// treated according to the constraint's policy for missing data. Removed
+// tags are recorded in excluded.
+func isTagRecent(t *tag.ImageTag, createdAfter time.Time, vc *image.VersionConstraint, excluded image.TagExclusions) bool {
+	if t.TagInfo == nil || t.TagInfo.CreatedAt.IsZero() {
+		if vc.MissingAge == image.MissingDataDrop {
+			log.Tracef("Removing tag %s because its creation date is unknown", t.TagName)
+			excluded.Exclude(t.TagName, "max-age", "creation date is unknown")
+			return false
+		}
+		return true
+	}
+	if t.TagInfo.CreatedAt.Before(createdAfter) {
+		log.Tracef("Removing tag %s because it was created at %s", t.TagName, t.TagInfo.CreatedAt)
+		excluded.Exclude(t.TagName, "max-age", "created at %s, more than %s ago", t.TagInfo.CreatedAt.Format(time.RFC3339), vc.MaxAge)
+		return false
+	}
+	return true
+}
+
+// How often the credential refresher checks for credentials to refresh
+const CredsRefreshCheckInterval = 10 * time.Second
+
+// Credentials that are known to expire, i.e. ECR tokens, are refreshed this
+// long before they do, or after half of their remaining lifetime if that is
+// shorter
+const CredsExpiryMargin = 5 * time.Minute
+
 func (ep *RegistryEndpoint) expireCredentials() bool {
-	if ep.Credentials != "" && !ep.CredsUpdated.IsZero() && ep.CredsExpire > 0 && time.Since(ep.CredsUpdated) >= ep.CredsExpire {
+	if ep.Credentials == "" || ep.CredsUpdated.IsZero() {
+		return false
+	}
+	configured := ep.CredsExpire > 0 && time.Since(ep.CredsUpdated) >= ep.CredsExpire
+	known := !ep.credsExpiresAt.IsZero() && !time.Now().Before(ep.credsExpiresAt)
+	if configured || known {
 		ep.Username = ""
 		ep.Password = ""
+		ep.credsAnonymous = false
+		ep.headers = nil
 		return true
 	}
 	return false
 }
 
+// credsRefreshDue returns whether the credentials of the endpoint are about to
+// expire within the configured refresh lead time.
+func (ep *RegistryEndpoint) credsRefreshDue() bool {
+	if ep.Credentials == "" || ep.CredsUpdated.IsZero() || ep.CredsRefresh <= 0 {
+		return false
+	}
+	if !ep.credsExpiresAt.IsZero() && time.Until(ep.credsExpiresAt) <= ep.CredsRefresh {
+		return true
+	}
+	return ep.CredsExpire > 0 && time.Since(ep.CredsUpdated) >= ep.CredsExpire-ep.CredsRefresh
+}
+
+// credsRefreshTime returns the time at which credentials that expire at the
+// given time are refreshed, which is CredsExpiryMargin before they expire,
+// or after half of their remaining lifetime if that is shorter. Credentials
+// that have already expired, i.e. due to clock skew, are refreshed right
+// away.
+func credsRefreshTime(now, expiresAt time.Time) time.Time {
+	lifetime := expiresAt.Sub(now)
+	if lifetime <= 0 {
+		return now
+	}
+	margin := CredsExpiryMargin
+	if margin > lifetime/2 {
+		margin = lifetime / 2
+	}
+	return expiresAt.Add(-margin)
+}
+
+// fetchCredentials resolves the credentials for this registry from the
+// endpoint's credential source. If fallback credentials are configured, the
+// first credentials of the chain that can be used are returned, along with
+// whether anonymous access has been chosen. Since resolving credentials may
+// take a while, i.e. when running a credential helper, it must not be called
+// with the endpoint's lock held.
+func (ep *RegistryEndpoint) fetchCredentials(kubeClient *kube.KubernetesClient) (*image.Credential, bool, error) {
+	if len(ep.FallbackCredentials) > 0 {
+		return ep.fetchCredentialsFromChain(kubeClient)
+	}
+	creds, err := ep.resolveCredentials(ep.Credentials, kubeClient)
+	return creds, false, err
+}
+
+// storeCredentials stores the given credentials in the endpoint. The caller
+// must hold the endpoint's lock.
+func (ep *RegistryEndpoint) storeCredentials(creds *image.Credential, anonymous bool) {
+	ep.CredsUpdated = time.Now()
+
+	// Credentials that are known to expire, i.e. ECR tokens, must not be
+	// used beyond their expiry, regardless of the configured expiry, so they
+	// are refreshed ahead of it.
+	ep.credsExpiresAt = time.Time{}
+	if !creds.ExpiresAt.IsZero() {
+		ep.credsExpiresAt = credsRefreshTime(ep.CredsUpdated, creds.ExpiresAt)
+		if !creds.ExpiresAt.After(ep.CredsUpdated) {
+			log.Warnf("credentials for registry %s expired at %s already, they will be fetched again on next use", ep.RegistryAPI, creds.ExpiresAt)
+		} else {
+			log.Debugf("credentials for registry %s expire at %s, refreshing at %s", ep.RegistryAPI, creds.ExpiresAt, ep.credsExpiresAt)
+		}
+	}
+
+	ep.Username = creds.Username
+	ep.Password = creds.Password
+	ep.credsAnonymous = anonymous
+}
+
+// resolveCredentials resolves the credentials from the given credential
+// source definition
+func (ep *RegistryEndpoint) resolveCredentials(definition string, kubeClient *kube.KubernetesClient) (*image.Credential, error) {
+	credSrc, err := image.ParseCredentialSource(definition, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// For fetching credentials, we must have working Kubernetes client.
+	if (credSrc.Type == image.CredentialSourcePullSecret || credSrc.Type == image.CredentialSourceSecret) && kubeClient == nil {
+		log.WithContext().
+			AddField("registry", ep.RegistryAPI).
+			Warnf("cannot user K8s credentials without Kubernetes client")
+		return nil, fmt.Errorf("could not fetch image tags")
+	}
+
+	return credSrc.FetchCredentials(ep.RegistryAPI, kubeClient)
+}
+
 // Sets endpoint credentials for this registry from a reference to a K8s secret
+// and resolves the values of the endpoint's static headers. If the endpoint
+// uses the credentials of another endpoint, the credentials of that endpoint
+// are set and copied instead, so that they expire along with the source. The
+// TLS client certificate is loaded from its secret as well, independent of
+// the credentials.
 func (ep *RegistryEndpoint) SetEndpointCredentials(kubeClient *kube.KubernetesClient) error {
-	if ep.expireCredentials() {
-		log.Debugf("expired credentials for registry %s (updated:%s, expiry:%0fs)", ep.RegistryAPI, ep.CredsUpdated, ep.CredsExpire.Seconds())
+	if err := ep.setTLSCredentials(kubeClient); err != nil {
+		return err
 	}
-	if ep.Username == "" && ep.Password == "" && ep.Credentials != "" {
-		credSrc, err := image.ParseCredentialSource(ep.Credentials, false)
-		if err != nil {
-			return err
-		}
 
-		// For fetching credentials, we must have working Kubernetes client.
-		if (credSrc.Type == image.CredentialSourcePullSecret || credSrc.Type == image.CredentialSourceSecret) && kubeClient == nil {
-			log.WithContext().
-				AddField("registry", ep.RegistryAPI).
-				Warnf("cannot user K8s credentials without Kubernetes client")
-			return fmt.Errorf("could not fetch image tags")
+	var source *RegistryEndpoint
+	if ep.CredentialsFrom != "" {
+		var err error
+		source, err = getRegistryEndpointByName(ep.CredentialsFrom)
+		if err == nil && source.CredentialsFrom != "" {
+			err = fmt.Errorf("registry %s uses credentials_from itself", source.RegistryName)
+		}
+		if err == nil {
+			err = source.SetEndpointCredentials(kubeClient)
 		}
-
-		creds, err := credSrc.FetchCredentials(ep.RegistryAPI, kubeClient)
 		if err != nil {
-			return err
+			return fmt.Errorf("could not set credentials for registry %s from registry %s: %v", ep.RegistryAPI, ep.CredentialsFrom, err)
 		}
+	}
 
-		ep.CredsUpdated = time.Now()
-
-		ep.Username = creds.Username
-		ep.Password = creds.Password
+	ep.lock.Lock()
+	if ep.expireCredentials() {
+		log.Debugf("expired credentials for registry %s (updated:%s, expiry:%0fs)", ep.RegistryAPI, ep.CredsUpdated, ep.CredsExpire.Seconds())
+	}
+	if err := ep.refreshHeaders(); err != nil {
+		ep.lock.Unlock()
+		return err
+	}
+	if source != nil {
+		source.lock.RLock()
+		ep.Username = source.Username
+		ep.Password = source.Password
+		ep.credsAnonymous = source.credsAnonymous
+		source.lock.RUnlock()
+		ep.lock.Unlock()
+		return nil
+	}
+	needed := ep.Username == "" && ep.Password == "" && !ep.credsAnonymous && ep.Credentials != ""
+	ep.lock.Unlock()
+	if !needed {
+		return nil
 	}
 
+	// The credentials are fetched without holding the lock, so that clients
+	// for the endpoint can still be created while that takes a while.
+	creds, anonymous, err := ep.fetchCredentials(kubeClient)
+	if err != nil {
+		return err
+	}
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	ep.storeCredentials(creds, anonymous)
 	return nil
 }
+
+// RefreshCredentials re-resolves the credentials for this registry if they
+// are about to expire within the endpoint's refresh lead time. Returns true
+// if the credentials have been refreshed. On error, the current credentials
+// are kept until they expire.
+func (ep *RegistryEndpoint) RefreshCredentials(kubeClient *kube.KubernetesClient) (bool, error) {
+	ep.lock.RLock()
+	due := ep.credsRefreshDue()
+	if due {
+		log.Debugf("refreshing credentials for registry %s (updated:%s, expiry:%0fs)", ep.RegistryAPI, ep.CredsUpdated, ep.CredsExpire.Seconds())
+	}
+	ep.lock.RUnlock()
+	if !due {
+		return false, nil
+	}
+	creds, anonymous, err := ep.fetchCredentials(kubeClient)
+	if err != nil {
+		return false, err
+	}
+	ep.lock.Lock()
+	defer ep.lock.Unlock()
+	ep.storeCredentials(creds, anonymous)
+	return true, nil
+}
+
+// RefreshAllCredentials refreshes the credentials of all configured endpoints
+// that are about to expire.
+func RefreshAllCredentials(kubeClient *kube.KubernetesClient) {
+	registryLock.RLock()
+	eps := make([]*RegistryEndpoint, 0, len(registries))
+	for _, ep := range registries {
+		eps = append(eps, ep)
+	}
+	registryLock.RUnlock()
+
+	for _, ep := range eps {
+		if _, err := ep.RefreshCredentials(kubeClient); err != nil {
+			log.Warnf("could not refresh credentials for registry %s: %v", ep.RegistryAPI, err)
+		}
+	}
+}
+
+// StartCredentialRefresher starts a go routine that proactively refreshes
+// the credentials of endpoints which have a refresh lead time configured,
+// until the given context is done.
+func StartCredentialRefresher(ctx context.Context, kubeClient *kube.KubernetesClient) {
+	go func() {
+		ticker := time.NewTicker(CredsRefreshCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				RefreshAllCredentials(kubeClient)
+			}
+		}
+	}()
+}
+
+// satisfiesConstraint returns whether tag is a version within the semver range
+// c. Tags that are not semantic versions, and all tags if there is no range,
+// satisfy the constraint, and are left to be sorted out later.
+func satisfiesConstraint(c *semver.Constraints, tag string) bool {
+	if c == nil {
+		return true
+	}
+	ver, err := semver.NewVersion(tag)
+	if err != nil {
+		return true
+	}
+	return c.Check(ver)
+}
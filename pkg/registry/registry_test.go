@@ -1,17 +1,29 @@
 package registry
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/argoproj-labs/argocd-image-updater/pkg/cache"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/mocks"
 	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
 
+	"github.com/docker/distribution"
 	"github.com/docker/distribution/manifest/schema1"
 	"github.com/docker/distribution/manifest/schema2"
+	"github.com/nokia/docker-registry-client/registry"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -21,14 +33,14 @@ func Test_GetTags(t *testing.T) {
 
 	t.Run("Check for correctly returned tags with semver sort", func(t *testing.T) {
 		regClient := mocks.RegistryClient{}
-		regClient.On("Tags", mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
 
 		ep, err := GetRegistryEndpoint("")
 		require.NoError(t, err)
 
 		img := image.NewFromIdentifier("foo/bar:1.2.0")
 
-		tl, err := ep.GetTags(img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortSemVer})
+		tl, err := ep.GetTags(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortSemVer})
 		require.NoError(t, err)
 		assert.NotEmpty(t, tl)
 
@@ -39,14 +51,14 @@ func Test_GetTags(t *testing.T) {
 
 	t.Run("Check for correctly returned tags with filter function applied", func(t *testing.T) {
 		regClient := mocks.RegistryClient{}
-		regClient.On("Tags", mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
 
 		ep, err := GetRegistryEndpoint("")
 		require.NoError(t, err)
 
 		img := image.NewFromIdentifier("foo/bar:1.2.0")
 
-		tl, err := ep.GetTags(img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortSemVer, MatchFunc: image.MatchFuncNone})
+		tl, err := ep.GetTags(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortSemVer, MatchFunc: image.MatchFuncNone})
 		require.NoError(t, err)
 		assert.Empty(t, tl.Tags())
 
@@ -55,17 +67,132 @@ func Test_GetTags(t *testing.T) {
 		assert.Nil(t, tag)
 	})
 
+	t.Run("Check for correctly returned tags with glob filter function applied", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.3.0"}, nil)
+
+		ep, err := GetRegistryEndpoint("")
+		require.NoError(t, err)
+
+		img := image.NewFromIdentifier("foo/bar:1.2.0")
+
+		matchFunc, matchArgs := image.ParseMatchfunc("glob:1.2.*")
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortSemVer, MatchFunc: matchFunc, MatchArgs: matchArgs})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0", "1.2.1"}, tl.Tags())
+		assert.Equal(t, "allow-tags: does not match 1.2.*", excluded["1.3.0"])
+	})
+
+	t.Run("Check for correctly returned tags with tag filter applied", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.3.0"}, nil)
+
+		ep, err := GetRegistryEndpoint("")
+		require.NoError(t, err)
+		ep.Cache.SetTag("foo/bar", &tag.ImageTag{TagName: "1.2.1", TagInfo: &tag.TagInfo{OS: "windows", Arch: "amd64"}})
+		defer ep.Cache.ClearCache()
+
+		img := image.NewFromIdentifier("foo/bar:1.2.0")
+
+		filter := image.TagFilterFunc(func(tagName string, info *tag.TagInfo) bool {
+			return tagName != "1.3.0" && (info == nil || info.OS == "linux")
+		})
+		vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, TagFilter: filter}
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.2.0"}, tl.Tags())
+		assert.Equal(t, "tag-filter: not accepted by tag filter", excluded["1.2.1"])
+		assert.Equal(t, "tag-filter: not accepted by tag filter", excluded["1.3.0"])
+	})
+
+	t.Run("Tag filter is not passed cached meta data of mutable tags", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1"}, nil)
+
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", ImmutableTags: []string{"1.2.0"}, Cache: cache.NewMemCache()}
+		ep.Cache.SetTag("foo/bar", &tag.ImageTag{TagName: "1.2.0", TagInfo: &tag.TagInfo{OS: "linux"}})
+		ep.Cache.SetDigest("foo/bar", "1.2.0", "sha256:aaa")
+		ep.Cache.SetTag("foo/bar", &tag.ImageTag{TagName: "1.2.1", TagInfo: &tag.TagInfo{OS: "linux"}})
+
+		img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+		seen := map[string]*tag.TagInfo{}
+		filter := image.TagFilterFunc(func(tagName string, info *tag.TagInfo) bool {
+			seen[tagName] = info
+			return true
+		})
+		vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, TagFilter: filter}
+		tags := ep.filterTags(context.Background(), img, "foo/bar", []string{"1.2.0", "1.2.1"}, &regClient, vc, nil, image.TagExclusions{})
+		assert.Equal(t, []string{"1.2.0", "1.2.1"}, tags)
+		require.Contains(t, seen, "1.2.0")
+		assert.Equal(t, "linux", seen["1.2.0"].OS)
+		require.Contains(t, seen, "1.2.1")
+		assert.Nil(t, seen["1.2.1"])
+	})
+
+	t.Run("Check for correctly returned tags with pre-releases ignored", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.3.0-rc1", "1.3.0", "1.4.0-beta.1", "2.0.0-rc1"}, nil)
+
+		ep, err := GetRegistryEndpoint("")
+		require.NoError(t, err)
+
+		img := image.NewFromIdentifier("foo/bar:1.2.0")
+
+		vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, IgnorePrerelease: true}
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0", "1.3.0"}, tl.Tags())
+		assert.Equal(t, "prerelease: pre-release versions are ignored", excluded["1.4.0-beta.1"])
+
+		newest, err := img.GetNewestVersionFromTags(vc, tl)
+		require.NoError(t, err)
+		assert.Equal(t, "1.3.0", newest.TagName)
+
+		vc = &image.VersionConstraint{SortMode: image.VersionSortSemVer, IgnorePrerelease: true, AllowPrereleaseFor: "^2.0"}
+		tl, err = ep.GetTags(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0", "1.3.0", "2.0.0-rc1"}, tl.Tags())
+	})
+
+	t.Run("Check for correctly returned tags locked to the current track", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.3.9", "1.4.0", "1.4.3", "1.5.0", "2.0.0", "latest"}, nil)
+
+		ep, err := GetRegistryEndpoint("")
+		require.NoError(t, err)
+
+		img := image.NewFromIdentifier("foo/bar:1.4.0")
+
+		vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, Lock: image.LockMinor}
+		vc.SetTrack(tag.NewImageTag("1.4.0", time.Unix(0, 0)))
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.4.0", "1.4.3"}, tl.Tags())
+		assert.Equal(t, "lock: not on track 1.4 of current version", excluded["1.5.0"])
+
+		vc = &image.VersionConstraint{SortMode: image.VersionSortSemVer, Lock: image.LockMajor}
+		vc.SetTrack(tag.NewImageTag("1.4.0", time.Unix(0, 0)))
+		tl, excluded, err = ep.GetTagsExplained(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.3.9", "1.4.0", "1.4.3", "1.5.0"}, tl.Tags())
+		assert.Equal(t, "lock: not on track 1 of current version", excluded["2.0.0"])
+
+		newest, err := img.GetNewestVersionFromTags(vc, tl)
+		require.NoError(t, err)
+		assert.Equal(t, "1.5.0", newest.TagName)
+	})
+
 	t.Run("Check for correctly returned tags with name sort", func(t *testing.T) {
 
 		regClient := mocks.RegistryClient{}
-		regClient.On("Tags", mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
 
 		ep, err := GetRegistryEndpoint("")
 		require.NoError(t, err)
 
 		img := image.NewFromIdentifier("foo/bar:1.2.0")
 
-		tl, err := ep.GetTags(img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortName})
+		tl, err := ep.GetTags(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortName})
 		require.NoError(t, err)
 		assert.NotEmpty(t, tl)
 
@@ -90,17 +217,17 @@ func Test_GetTags(t *testing.T) {
 		}
 
 		regClient := mocks.RegistryClient{}
-		regClient.On("Tags", mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
-		regClient.On("ManifestV1", mock.Anything, mock.Anything).Return(meta1, nil)
-		regClient.On("ManifestV2", mock.Anything, mock.Anything).Return(meta2, nil)
-		regClient.On("TagMetadata", mock.Anything, mock.Anything).Return(&tag.TagInfo{}, nil)
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
+		regClient.On("ManifestV1", mock.Anything, mock.Anything, mock.Anything).Return(meta1, nil)
+		regClient.On("ManifestV2", mock.Anything, mock.Anything, mock.Anything).Return(meta2, nil)
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(&tag.TagInfo{}, nil)
 
 		ep, err := GetRegistryEndpoint("")
 		require.NoError(t, err)
 		ep.Cache.ClearCache()
 
 		img := image.NewFromIdentifier("foo/bar:1.2.0")
-		tl, err := ep.GetTags(img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
+		tl, err := ep.GetTags(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
 		require.NoError(t, err)
 		assert.NotEmpty(t, tl)
 
@@ -121,17 +248,18 @@ func Test_GetTags(t *testing.T) {
 		}
 
 		regClient := mocks.RegistryClient{}
-		regClient.On("Tags", mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
-		regClient.On("ManifestV1", mock.Anything, mock.Anything).Return(meta1, nil)
-		regClient.On("ManifestV2", mock.Anything, mock.Anything).Return(meta2, fmt.Errorf("not implemented"))
-		regClient.On("TagMetadata", mock.Anything, mock.Anything).Return(nil, nil)
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
+		regClient.On("ManifestV1", mock.Anything, mock.Anything, mock.Anything).Return(meta1, nil)
+		regClient.On("ManifestV2", mock.Anything, mock.Anything, mock.Anything).Return(meta2, fmt.Errorf("not implemented"))
+		regClient.On("ManifestList", mock.Anything, mock.Anything, mock.Anything).Return(nil, fmt.Errorf("not implemented"))
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(nil, nil)
 
 		ep, err := GetRegistryEndpoint("")
 		require.NoError(t, err)
 		ep.Cache.ClearCache()
 
 		img := image.NewFromIdentifier("foo/bar:1.2.0")
-		tl, err := ep.GetTags(img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
+		tl, err := ep.GetTags(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
 		require.NoError(t, err)
 		assert.Empty(t, tl.Tags())
 
@@ -155,17 +283,18 @@ func Test_GetTags(t *testing.T) {
 		}
 
 		regClient := mocks.RegistryClient{}
-		regClient.On("Tags", mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
-		regClient.On("ManifestV1", mock.Anything, mock.Anything).Return(meta1, nil)
-		regClient.On("ManifestV2", mock.Anything, mock.Anything).Return(meta2, fmt.Errorf("not implemented"))
-		regClient.On("TagMetadata", mock.Anything, mock.Anything).Return(nil, nil)
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
+		regClient.On("ManifestV1", mock.Anything, mock.Anything, mock.Anything).Return(meta1, nil)
+		regClient.On("ManifestV2", mock.Anything, mock.Anything, mock.Anything).Return(meta2, fmt.Errorf("not implemented"))
+		regClient.On("ManifestList", mock.Anything, mock.Anything, mock.Anything).Return(nil, fmt.Errorf("not implemented"))
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(nil, nil)
 
 		ep, err := GetRegistryEndpoint("")
 		require.NoError(t, err)
 		ep.Cache.ClearCache()
 
 		img := image.NewFromIdentifier("foo/bar:1.2.0")
-		tl, err := ep.GetTags(img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
+		tl, err := ep.GetTags(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
 		require.NoError(t, err)
 		assert.Empty(t, tl.Tags())
 
@@ -189,17 +318,18 @@ func Test_GetTags(t *testing.T) {
 		}
 
 		regClient := mocks.RegistryClient{}
-		regClient.On("Tags", mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
-		regClient.On("ManifestV1", mock.Anything, mock.Anything).Return(meta1, nil)
-		regClient.On("ManifestV2", mock.Anything, mock.Anything).Return(meta2, fmt.Errorf("not implemented"))
-		regClient.On("TagMetadata", mock.Anything, mock.Anything).Return(nil, nil)
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
+		regClient.On("ManifestV1", mock.Anything, mock.Anything, mock.Anything).Return(meta1, nil)
+		regClient.On("ManifestV2", mock.Anything, mock.Anything, mock.Anything).Return(meta2, fmt.Errorf("not implemented"))
+		regClient.On("ManifestList", mock.Anything, mock.Anything, mock.Anything).Return(nil, fmt.Errorf("not implemented"))
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(nil, nil)
 
 		ep, err := GetRegistryEndpoint("")
 		require.NoError(t, err)
 		ep.Cache.ClearCache()
 
 		img := image.NewFromIdentifier("foo/bar:1.2.0")
-		tl, err := ep.GetTags(img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
+		tl, err := ep.GetTags(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
 		require.NoError(t, err)
 		assert.Empty(t, tl.Tags())
 
@@ -224,17 +354,18 @@ func Test_GetTags(t *testing.T) {
 		}
 
 		regClient := mocks.RegistryClient{}
-		regClient.On("Tags", mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
-		regClient.On("ManifestV1", mock.Anything, mock.Anything).Return(meta1, nil)
-		regClient.On("ManifestV2", mock.Anything, mock.Anything).Return(meta2, fmt.Errorf("not implemented"))
-		regClient.On("TagMetadata", mock.Anything, mock.Anything).Return(nil, nil)
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
+		regClient.On("ManifestV1", mock.Anything, mock.Anything, mock.Anything).Return(meta1, nil)
+		regClient.On("ManifestV2", mock.Anything, mock.Anything, mock.Anything).Return(meta2, fmt.Errorf("not implemented"))
+		regClient.On("ManifestList", mock.Anything, mock.Anything, mock.Anything).Return(nil, fmt.Errorf("not implemented"))
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(nil, nil)
 
 		ep, err := GetRegistryEndpoint("")
 		require.NoError(t, err)
 		ep.Cache.ClearCache()
 
 		img := image.NewFromIdentifier("foo/bar:1.2.0")
-		tl, err := ep.GetTags(img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
+		tl, err := ep.GetTags(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
 		require.NoError(t, err)
 		assert.Empty(t, tl.Tags())
 
@@ -245,6 +376,97 @@ func Test_GetTags(t *testing.T) {
 
 }
 
+// pullCountRegistryClient is a mock registry client that provides pull counts
+type pullCountRegistryClient struct {
+	mocks.RegistryClient
+	counts map[string]int64
+	err    error
+}
+
+func (c *pullCountRegistryClient) TagPullCounts(ctx context.Context, nameInRepository string) (map[string]int64, error) {
+	return c.counts, c.err
+}
+
+func Test_GetTagsWithMinDownloads(t *testing.T) {
+	newClient := func() *pullCountRegistryClient {
+		regClient := &pullCountRegistryClient{counts: map[string]int64{"1.2.0": 500, "1.2.1": 5}}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
+		return regClient
+	}
+
+	ep, err := GetRegistryEndpoint("")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("foo/bar:1.2.0")
+
+	t.Run("Keep tags with unknown pull count", func(t *testing.T) {
+		tl, err := ep.GetTags(context.Background(), img, newClient(), &image.VersionConstraint{SortMode: image.VersionSortSemVer, MinDownloads: 100})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0", "1.2.2"}, tl.Tags())
+	})
+
+	t.Run("Drop tags with unknown pull count", func(t *testing.T) {
+		tl, err := ep.GetTags(context.Background(), img, newClient(), &image.VersionConstraint{SortMode: image.VersionSortSemVer, MinDownloads: 100, MissingDownloads: image.MissingDataDrop})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0"}, tl.Tags())
+	})
+
+	t.Run("Keep all tags if pull counts cannot be retrieved", func(t *testing.T) {
+		regClient := newClient()
+		regClient.counts, regClient.err = nil, fmt.Errorf("503 Service Unavailable")
+		tl, err := ep.GetTags(context.Background(), img, regClient, &image.VersionConstraint{SortMode: image.VersionSortSemVer, MinDownloads: 100, MissingDownloads: image.MissingDataDrop})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0", "1.2.1", "1.2.2"}, tl.Tags())
+	})
+
+	t.Run("Client without pull counts", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
+		_, err := ep.GetTags(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortSemVer, MinDownloads: 100})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "does not report pull counts of tags, min-downloads cannot be used")
+	})
+}
+
+func Test_CredsRefreshTime(t *testing.T) {
+	now := time.Now()
+	t.Run("Refresh ahead of expiry", func(t *testing.T) {
+		assert.Equal(t, now.Add(12*time.Hour-CredsExpiryMargin), credsRefreshTime(now, now.Add(12*time.Hour)))
+	})
+	t.Run("Refresh short-lived credentials after half their lifetime", func(t *testing.T) {
+		assert.Equal(t, now.Add(2*time.Minute), credsRefreshTime(now, now.Add(4*time.Minute)))
+	})
+	t.Run("Refresh expired credentials right away", func(t *testing.T) {
+		assert.Equal(t, now, credsRefreshTime(now, now.Add(-time.Minute)))
+	})
+}
+
+func Test_ExpireKnownExpiry(t *testing.T) {
+	newEndpoint := func(expiresAt time.Time) *RegistryEndpoint {
+		ep := newRegistryEndpoint("example.com", "Example", "https://example.com", "env:TEST_CREDS", "", false, SortUnsorted, 0, time.Hour)
+		ep.Username, ep.Password = "foo", "bar"
+		ep.CredsUpdated = time.Now()
+		ep.credsExpiresAt = expiresAt
+		return ep
+	}
+	t.Run("Credentials are kept until their refresh time", func(t *testing.T) {
+		ep := newEndpoint(time.Now().Add(time.Minute))
+		assert.False(t, ep.expireCredentials())
+		assert.Equal(t, "foo", ep.Username)
+	})
+	t.Run("Credentials expire at their refresh time, regardless of credsexpire", func(t *testing.T) {
+		ep := newEndpoint(time.Now().Add(-time.Second))
+		assert.True(t, ep.expireCredentials())
+		assert.Empty(t, ep.Username)
+	})
+	t.Run("Refresh is due ahead of the refresh time", func(t *testing.T) {
+		ep := newEndpoint(time.Now().Add(time.Minute))
+		ep.CredsRefresh = 2 * time.Minute
+		assert.True(t, ep.credsRefreshDue())
+		ep.CredsRefresh = 30 * time.Second
+		assert.False(t, ep.credsRefreshDue())
+	})
+}
+
 func Test_ExpireCredentials(t *testing.T) {
 	epYAML := `
 registries:
@@ -290,3 +512,1366 @@ registries:
 		assert.Equal(t, "foo", ep.Password)
 	})
 }
+
+func Test_CredentialsFrom(t *testing.T) {
+	epYAML := `
+registries:
+- name: Upstream Registry
+  api_url: https://upstream.example.com
+  prefix: upstream.example.com
+  credentials: env:TEST_UPSTREAM_CREDS
+  credsexpire: 3s
+- name: Mirror Registry
+  api_url: https://mirror.example.com
+  prefix: mirror.example.com
+  credentials_from: Upstream Registry
+`
+	epl, err := ParseRegistryConfiguration(epYAML)
+	require.NoError(t, err)
+	require.Len(t, epl.Items, 2)
+	for _, epc := range epl.Items {
+		require.NoError(t, AddRegistryEndpointFromConfig(epc))
+	}
+	upstream, err := GetRegistryEndpoint("upstream.example.com")
+	require.NoError(t, err)
+	mirror, err := GetRegistryEndpoint("mirror.example.com")
+	require.NoError(t, err)
+	defer os.Unsetenv("TEST_UPSTREAM_CREDS")
+
+	t.Run("Credentials are copied from source", func(t *testing.T) {
+		os.Setenv("TEST_UPSTREAM_CREDS", "foo:bar")
+		require.NoError(t, mirror.SetEndpointCredentials(nil))
+		assert.Equal(t, "foo", mirror.Username)
+		assert.Equal(t, "bar", mirror.Password)
+		assert.Equal(t, "foo", upstream.Username)
+	})
+
+	t.Run("Credentials expire along with source", func(t *testing.T) {
+		os.Setenv("TEST_UPSTREAM_CREDS", "bar:foo")
+		require.NoError(t, mirror.SetEndpointCredentials(nil))
+		assert.Equal(t, "foo", mirror.Username)
+
+		upstream.CredsUpdated = upstream.CredsUpdated.Add(-5 * time.Minute)
+		require.NoError(t, mirror.SetEndpointCredentials(nil))
+		assert.Equal(t, "bar", mirror.Username)
+		assert.Equal(t, "foo", mirror.Password)
+	})
+
+	t.Run("Error from source is returned", func(t *testing.T) {
+		os.Unsetenv("TEST_UPSTREAM_CREDS")
+		upstream.CredsUpdated = upstream.CredsUpdated.Add(-5 * time.Minute)
+		err := mirror.SetEndpointCredentials(nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "from registry Upstream Registry")
+	})
+
+	t.Run("Unknown source", func(t *testing.T) {
+		ep := newRegistryEndpoint("other.example.com", "Other", "https://other.example.com", "", "", false, SortUnsorted, 0, 0)
+		ep.CredentialsFrom = "Unknown Registry"
+		err := ep.SetEndpointCredentials(nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no registry with name 'Unknown Registry' configured")
+	})
+}
+
+func Test_ExpireCredentialsFromFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "creds")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+	credsFile := filepath.Join(tempDir, "creds")
+
+	epYAML := fmt.Sprintf(`
+registries:
+- name: GitHub Container Registry
+  api_url: https://ghcr.io
+  ping: no
+  prefix: ghcr.io
+  credentials: file:%s
+  credsexpire: 3s
+`, credsFile)
+	t.Run("Expire credentials", func(t *testing.T) {
+		epl, err := ParseRegistryConfiguration(epYAML)
+		require.NoError(t, err)
+		require.Len(t, epl.Items, 1)
+
+		err = AddRegistryEndpointFromConfig(epl.Items[0])
+		require.NoError(t, err)
+		ep, err := GetRegistryEndpoint("ghcr.io")
+		require.NoError(t, err)
+
+		// Initial creds
+		require.NoError(t, ioutil.WriteFile(credsFile, []byte("foo:bar"), 0600))
+		err = ep.SetEndpointCredentials(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "foo", ep.Username)
+		assert.Equal(t, "bar", ep.Password)
+
+		// Creds should still be cached
+		require.NoError(t, ioutil.WriteFile(credsFile, []byte("bar:foo"), 0600))
+		err = ep.SetEndpointCredentials(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "foo", ep.Username)
+		assert.Equal(t, "bar", ep.Password)
+
+		// Pretend 5 minutes have passed - creds have expired and are re-read from file
+		ep.CredsUpdated = ep.CredsUpdated.Add(time.Minute * -5)
+		err = ep.SetEndpointCredentials(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "bar", ep.Username)
+		assert.Equal(t, "foo", ep.Password)
+
+		// Malformed file after expiry
+		require.NoError(t, ioutil.WriteFile(credsFile, []byte("foobar"), 0600))
+		ep.CredsUpdated = ep.CredsUpdated.Add(time.Minute * -5)
+		err = ep.SetEndpointCredentials(nil)
+		assert.Error(t, err)
+	})
+}
+
+func Test_RefreshCredentials(t *testing.T) {
+	epYAML := `
+registries:
+- name: GitHub Container Registry
+  api_url: https://ghcr.io
+  ping: no
+  prefix: ghcr.io
+  credentials: env:TEST_CREDS
+  credsexpire: 1h
+  credsrefresh: 5m
+`
+	t.Run("Refresh credentials before they expire", func(t *testing.T) {
+		epl, err := ParseRegistryConfiguration(epYAML)
+		require.NoError(t, err)
+		require.Len(t, epl.Items, 1)
+
+		err = AddRegistryEndpointFromConfig(epl.Items[0])
+		require.NoError(t, err)
+		ep, err := GetRegistryEndpoint("ghcr.io")
+		require.NoError(t, err)
+		require.Equal(t, 5*time.Minute, ep.CredsRefresh)
+
+		// Nothing to refresh before credentials have been fetched
+		os.Setenv("TEST_CREDS", "foo:bar")
+		refreshed, err := ep.RefreshCredentials(nil)
+		require.NoError(t, err)
+		assert.False(t, refreshed)
+
+		err = ep.SetEndpointCredentials(nil)
+		require.NoError(t, err)
+		assert.Equal(t, "foo", ep.Username)
+
+		// Credentials are not yet within the refresh lead time
+		os.Setenv("TEST_CREDS", "bar:foo")
+		refreshed, err = ep.RefreshCredentials(nil)
+		require.NoError(t, err)
+		assert.False(t, refreshed)
+		assert.Equal(t, "foo", ep.Username)
+
+		// Pretend 56 minutes have passed - creds are refreshed before expiry
+		ep.CredsUpdated = ep.CredsUpdated.Add(time.Minute * -56)
+		refreshed, err = ep.RefreshCredentials(nil)
+		require.NoError(t, err)
+		assert.True(t, refreshed)
+		assert.Equal(t, "bar", ep.Username)
+		assert.Equal(t, "foo", ep.Password)
+		assert.Less(t, time.Since(ep.CredsUpdated), time.Minute)
+	})
+
+	t.Run("Keep credentials on refresh error", func(t *testing.T) {
+		ep, err := GetRegistryEndpoint("ghcr.io")
+		require.NoError(t, err)
+		ep.CredsUpdated = ep.CredsUpdated.Add(time.Minute * -56)
+		os.Setenv("TEST_CREDS", "invalid")
+		refreshed, err := ep.RefreshCredentials(nil)
+		assert.Error(t, err)
+		assert.False(t, refreshed)
+		assert.Equal(t, "bar", ep.Username)
+		assert.Equal(t, "foo", ep.Password)
+	})
+
+	t.Run("Refresh lead time must be less than expiry", func(t *testing.T) {
+		_, err := ParseRegistryConfiguration(`
+registries:
+- name: GitHub Container Registry
+  api_url: https://ghcr.io
+  prefix: ghcr.io
+  credentials: env:TEST_CREDS
+  credsexpire: 5m
+  credsrefresh: 5m
+`)
+		assert.Error(t, err)
+	})
+}
+
+func Test_GetTagsWithPlatform(t *testing.T) {
+	t.Run("Meta data is not fetched for the platform", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1"}, nil)
+
+		ep, err := GetRegistryEndpoint("")
+		require.NoError(t, err)
+		ep.Cache.ClearCache()
+
+		img := image.NewFromIdentifier("foo/bar:1.2.0")
+		tl, err := ep.GetTags(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortSemVer, IncludePlatform: true})
+		require.NoError(t, err)
+		require.NotNil(t, tl.Get("1.2.1"))
+		regClient.AssertNotCalled(t, "TagMetadata", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func Test_ResolvePlatform(t *testing.T) {
+	or := newOCIRegistry()
+	or.addImageWithConfig("1.0", []byte(`{"os":"linux","architecture":"arm64"}`), ociManifestMediaType)
+	srv := httptest.NewServer(or)
+	defer srv.Close()
+	ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+	client, err := NewClient(ep, "", "")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("example.com/foo/bar:0.9")
+
+	t.Run("Platform is resolved from the image configuration", func(t *testing.T) {
+		platform, err := ep.ResolvePlatform(context.Background(), img, "1.0", client)
+		require.NoError(t, err)
+		assert.Equal(t, "linux/arm64", platform)
+	})
+
+	t.Run("Platform is known by digest", func(t *testing.T) {
+		blobs := or.blobs
+		or.blobs = map[string][]byte{}
+		defer func() { or.blobs = blobs }()
+		platform, err := ep.ResolvePlatform(context.Background(), img, "1.0", client)
+		require.NoError(t, err)
+		assert.Equal(t, "linux/arm64", platform)
+	})
+
+	t.Run("Platform of missing tag", func(t *testing.T) {
+		_, err := ep.ResolvePlatform(context.Background(), img, "missing", client)
+		assert.Error(t, err)
+	})
+}
+
+func Test_GetTagsExplained(t *testing.T) {
+	t.Run("Record reasons for filtered tags", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "pr-42", "nightly"}, nil)
+
+		ep, err := GetRegistryEndpoint("")
+		require.NoError(t, err)
+
+		img := image.NewFromIdentifier("foo/bar:1.2.0")
+		vc := &image.VersionConstraint{
+			IgnoreList: []string{"pr-*"},
+			MatchFunc:  image.MatchFuncRegexp,
+			MatchArgs:  regexp.MustCompile(`^(\d|pr)`),
+		}
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0", "1.2.1"}, tl.Tags())
+		assert.Equal(t, "ignore-tags: excluded by ignore pattern pr-*", excluded["pr-42"])
+		assert.Equal(t, "allow-tags: does not match ^(\\d|pr)", excluded["nightly"])
+		assert.Len(t, excluded, 2)
+	})
+}
+
+func Test_GetTagsAllowDeny(t *testing.T) {
+	regClient := mocks.RegistryClient{}
+	regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "9.9.9", "canary", "edge", "nightly"}, nil)
+
+	ep, err := GetRegistryEndpoint("")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("foo/bar:1.2.0")
+
+	t.Run("Denied tag is removed even if it is the highest version", func(t *testing.T) {
+		vc := &image.VersionConstraint{DenyTags: []string{"9.9.9"}}
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.NotContains(t, tl.Tags(), "9.9.9")
+		assert.Equal(t, "deny-tags: tag is denied", excluded["9.9.9"])
+
+		newest, err := img.GetNewestVersionFromTags(vc, tl)
+		require.NoError(t, err)
+		assert.Equal(t, "1.2.1", newest.TagName)
+	})
+
+	t.Run("Allowed tags bypass the match function", func(t *testing.T) {
+		vc := &image.VersionConstraint{
+			MatchFunc: image.MatchFuncRegexp,
+			MatchArgs: regexp.MustCompile(`^\d`),
+			AllowTags: []string{"canary", "edge"},
+			DenyTags:  []string{"edge"},
+		}
+		tl, err := ep.GetTags(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0", "1.2.1", "9.9.9", "canary"}, tl.Tags())
+	})
+}
+
+func Test_GetTagsWithEmbeddedDate(t *testing.T) {
+	regClient := mocks.RegistryClient{}
+	regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"app-20240115-1", "app-20231231-7", "latest"}, nil)
+
+	ep, err := GetRegistryEndpoint("")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("foo/bar:app-20231231-7")
+	vc := &image.VersionConstraint{SortMode: image.VersionSortDate, DatePattern: regexp.MustCompile(`^app-(\d{8})-\d+$`)}
+
+	tl, excluded, err := ep.GetTagsExplained(context.Background(), img, &regClient, vc)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"app-20240115-1", "app-20231231-7"}, tl.Tags())
+	assert.Equal(t, time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), *tl.Get("app-20240115-1").TagDate)
+	assert.Equal(t, "tag-date: does not contain a date matching ^app-(\\d{8})-\\d+$", excluded["latest"])
+	regClient.AssertNotCalled(t, "ManifestV2", mock.Anything, mock.Anything, mock.Anything)
+	regClient.AssertNotCalled(t, "ManifestV1", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func Test_GetTagsSemverRange(t *testing.T) {
+	regClient := mocks.RegistryClient{}
+	regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.3.9", "1.4.0", "1.9.2", "2.0.0", "2.1.0", "latest"}, nil)
+
+	ep, err := GetRegistryEndpoint("")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("foo/bar:1.4.0")
+
+	t.Run("Only tags within range are returned", func(t *testing.T) {
+		vc := &image.VersionConstraint{Constraint: ">= 1.4, < 2.0"}
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.4.0", "1.9.2", "latest"}, tl.Tags())
+		assert.Equal(t, "constraint: does not satisfy constraint >= 1.4, < 2.0", excluded["2.0.0"])
+
+		newest, err := img.GetNewestVersionFromTags(vc, tl)
+		require.NoError(t, err)
+		assert.Equal(t, "1.9.2", newest.TagName)
+	})
+
+	t.Run("Constraint is no range for other strategies", func(t *testing.T) {
+		vc := &image.VersionConstraint{Constraint: "latest", SortMode: image.VersionSortName}
+		tl, err := ep.GetTags(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.Len(t, tl.Tags(), 6)
+	})
+
+	t.Run("Invalid range", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		vc := &image.VersionConstraint{Constraint: ">= 1.4, <"}
+		_, err := ep.GetTags(context.Background(), img, &regClient, vc)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid semver constraint '>= 1.4, <'")
+		regClient.AssertNotCalled(t, "Tags", mock.Anything, mock.Anything)
+	})
+}
+
+// tagDateRegistryClient is a RegistryClient that provides tag dates
+type tagDateRegistryClient struct {
+	mocks.RegistryClient
+	dates map[string]time.Time
+	err   error
+}
+
+func (c *tagDateRegistryClient) TagDates(ctx context.Context, nameInRepository string) (map[string]time.Time, error) {
+	return c.dates, c.err
+}
+
+func Test_GetTagsWithTagDates(t *testing.T) {
+	t.Run("Use tag dates from registry", func(t *testing.T) {
+		now := time.Now()
+		regClient := &tagDateRegistryClient{dates: map[string]time.Time{"1.2.0": now.Add(-time.Hour), "1.2.1": now}}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "1.2.2"}, nil)
+		regClient.On("ManifestV2", mock.Anything, mock.Anything, "1.2.2").Return(&schema2.DeserializedManifest{}, nil)
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(&tag.TagInfo{CreatedAt: now.Add(-2 * time.Hour)}, nil)
+
+		ep := &RegistryEndpoint{RegistryAPI: "https://gitlab.example.com", Flavor: FlavorGitLab, Cache: cache.NewMemCache()}
+		img := image.NewFromIdentifier("group/project:1.2.0")
+		tl, err := ep.GetTags(context.Background(), img, regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
+		require.NoError(t, err)
+		sorted := tl.SortByDate()
+		assert.Equal(t, []string{"1.2.2", "1.2.0", "1.2.1"}, sorted.Tags())
+		regClient.AssertNumberOfCalls(t, "ManifestV2", 1)
+	})
+
+	t.Run("Fall back to meta data if tag dates cannot be listed", func(t *testing.T) {
+		now := time.Now()
+		regClient := &tagDateRegistryClient{err: fmt.Errorf("401 Unauthorized")}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1"}, nil)
+		regClient.On("ManifestV2", mock.Anything, mock.Anything, mock.Anything).Return(&schema2.DeserializedManifest{}, nil)
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(&tag.TagInfo{CreatedAt: now}, nil)
+
+		ep := &RegistryEndpoint{RegistryAPI: "https://quay.io", Flavor: FlavorQuay, Cache: cache.NewMemCache()}
+		img := image.NewFromIdentifier("quay.io/org/private:1.2.0")
+		tl, err := ep.GetTags(context.Background(), img, regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0", "1.2.1"}, tl.Tags())
+		regClient.AssertNumberOfCalls(t, "ManifestV2", 2)
+	})
+}
+
+func Test_GetTagsSingleflight(t *testing.T) {
+	t.Run("Concurrent fetches for the same repository are shared", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).After(100*time.Millisecond).Return([]string{"1.2.0", "1.2.1"}, nil)
+
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Singleflight: true, Cache: cache.NewMemCache()}
+		vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+
+		results := make([]*tag.ImageTagList, 2)
+		var wg sync.WaitGroup
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				tl, err := ep.GetTags(context.Background(), img, &regClient, vc)
+				assert.NoError(t, err)
+				results[i] = tl
+			}(i)
+		}
+		wg.Wait()
+
+		regClient.AssertNumberOfCalls(t, "Tags", 1)
+		require.NotNil(t, results[0])
+		require.NotNil(t, results[1])
+		assert.ElementsMatch(t, results[0].Tags(), results[1].Tags())
+
+		// Each caller must get its own copy
+		results[0].Get("1.2.0").TagDigest = "sha256:abc"
+		assert.Equal(t, "", results[1].Get("1.2.0").TagDigest)
+	})
+}
+
+func Test_GetTagsSingleflightCancel(t *testing.T) {
+	regClient := mocks.RegistryClient{}
+	regClient.On("Tags", mock.Anything, mock.Anything).After(200*time.Millisecond).Return([]string{"1.2.0", "1.2.1"}, nil)
+
+	ep := &RegistryEndpoint{RegistryPrefix: "example.com", Singleflight: true, Cache: cache.NewMemCache()}
+	vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer}
+	img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	var firstErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, firstErr = ep.GetTags(ctx, img, &regClient, vc)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// The second caller must not be affected by the first caller's timeout
+	tl, err := ep.GetTags(context.Background(), img, &regClient, vc)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"1.2.0", "1.2.1"}, tl.Tags())
+	wg.Wait()
+	assert.Equal(t, context.DeadlineExceeded, firstErr)
+	regClient.AssertNumberOfCalls(t, "Tags", 1)
+}
+
+func Test_GetTagsSingleflightUnkeyedFilter(t *testing.T) {
+	regClient := mocks.RegistryClient{}
+	regClient.On("Tags", mock.Anything, mock.Anything).After(100*time.Millisecond).Return([]string{"1.2.0", "1.2.1"}, nil)
+
+	ep := &RegistryEndpoint{RegistryPrefix: "example.com", Singleflight: true, Cache: cache.NewMemCache()}
+	img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+
+	results := make([]*tag.ImageTagList, 2)
+	var wg sync.WaitGroup
+	for i, want := range []string{"1.2.0", "1.2.1"} {
+		wg.Add(1)
+		go func(i int, want string) {
+			defer wg.Done()
+			filter := image.TagFilterFunc(func(tagName string, info *tag.TagInfo) bool { return tagName == want })
+			tl, err := ep.GetTags(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortSemVer, TagFilter: filter})
+			assert.NoError(t, err)
+			results[i] = tl
+		}(i, want)
+	}
+	wg.Wait()
+
+	// Closures cannot be told apart, so their fetches must not be shared
+	regClient.AssertNumberOfCalls(t, "Tags", 2)
+	assert.Equal(t, []string{"1.2.0"}, results[0].Tags())
+	assert.Equal(t, []string{"1.2.1"}, results[1].Tags())
+}
+
+// credentialsMockClient is a mocked registry client that identifies the
+// credentials it uses by the given key
+type credentialsMockClient struct {
+	*mocks.RegistryClient
+	key string
+}
+
+func (c *credentialsMockClient) credentialsKey() string {
+	return c.key
+}
+
+func Test_GetTagsSingleflightCredentials(t *testing.T) {
+	regClient := mocks.RegistryClient{}
+	regClient.On("Tags", mock.Anything, mock.Anything).After(100*time.Millisecond).Return([]string{"1.2.0", "1.2.1"}, nil)
+
+	ep := &RegistryEndpoint{RegistryPrefix: "example.com", Singleflight: true, Cache: cache.NewMemCache()}
+	vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer}
+	img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"one", "two"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			_, err := ep.GetTags(context.Background(), img, &credentialsMockClient{RegistryClient: &regClient, key: key}, vc)
+			assert.NoError(t, err)
+		}(key)
+	}
+	wg.Wait()
+
+	// Fetches with different credentials must not be shared
+	regClient.AssertNumberOfCalls(t, "Tags", 2)
+}
+
+func Test_NewCredentialsKey(t *testing.T) {
+	assert.Empty(t, newCredentialsKey("", ""))
+	assert.NotEmpty(t, newCredentialsKey("user", "pass"))
+	assert.NotEqual(t, newCredentialsKey("user", "pass"), newCredentialsKey("user", "other"))
+	assert.NotContains(t, newCredentialsKey("user", "pass"), "pass")
+}
+
+func Test_GetTagsNegativeCache(t *testing.T) {
+	img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+	vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, MatchFunc: image.MatchFuncRegexp, MatchArgs: regexp.MustCompile(`^2\.`)}
+
+	t.Run("Empty result is cached until TTL expires", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1"}, nil).Twice()
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1", "2.0.0"}, nil)
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", NegativeCacheTTL: 100 * time.Millisecond, Cache: cache.NewMemCache()}
+
+		tl, err := ep.GetTags(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.Empty(t, tl.Tags())
+		tl, err = ep.GetTags(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.Empty(t, tl.Tags())
+		regClient.AssertNumberOfCalls(t, "Tags", 1)
+
+		// Other constraints are not affected by the cached result
+		tl, err = ep.GetTags(context.Background(), img, &regClient, &image.VersionConstraint{SortMode: image.VersionSortSemVer})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0", "1.2.1"}, tl.Tags())
+		regClient.AssertNumberOfCalls(t, "Tags", 2)
+
+		// A new tag is picked up once the cached result has expired
+		time.Sleep(200 * time.Millisecond)
+		tl, err = ep.GetTags(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"2.0.0"}, tl.Tags())
+		regClient.AssertNumberOfCalls(t, "Tags", 3)
+	})
+
+	t.Run("Empty result is not cached without TTL", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0"}, nil)
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		for i := 0; i < 2; i++ {
+			tl, err := ep.GetTags(context.Background(), img, &regClient, vc)
+			require.NoError(t, err)
+			assert.Empty(t, tl.Tags())
+		}
+		regClient.AssertNumberOfCalls(t, "Tags", 2)
+	})
+
+	t.Run("Errors are not cached", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return(nil, fmt.Errorf("unavailable"))
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", NegativeCacheTTL: time.Minute, Cache: cache.NewMemCache()}
+		for i := 0; i < 2; i++ {
+			_, err := ep.GetTags(context.Background(), img, &regClient, vc)
+			require.Error(t, err)
+		}
+		regClient.AssertNumberOfCalls(t, "Tags", 2)
+	})
+
+	t.Run("Failed lookups are cached until TTL expires", func(t *testing.T) {
+		notFound := &RegistryError{Registry: "https://example.com", StatusCode: http.StatusNotFound, Err: fmt.Errorf("name unknown"), kind: ErrManifestNotFound}
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return(nil, notFound).Once()
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"2.0.0"}, nil)
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", NegativeCacheTTL: 100 * time.Millisecond, Cache: cache.NewMemCache()}
+		for i := 0; i < 2; i++ {
+			_, err := ep.GetTags(context.Background(), img, &regClient, vc)
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, ErrManifestNotFound))
+		}
+		regClient.AssertNumberOfCalls(t, "Tags", 1)
+
+		time.Sleep(200 * time.Millisecond)
+		tl, err := ep.GetTags(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"2.0.0"}, tl.Tags())
+		regClient.AssertNumberOfCalls(t, "Tags", 2)
+	})
+
+	t.Run("Failed lookups are not shared between credentials", func(t *testing.T) {
+		notFound := &RegistryError{Registry: "https://example.com", StatusCode: http.StatusNotFound, Err: fmt.Errorf("name unknown"), kind: ErrManifestNotFound}
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return(nil, notFound).Once()
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"2.0.0"}, nil)
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", NegativeCacheTTL: time.Minute, Cache: cache.NewMemCache()}
+		_, err := ep.GetTags(context.Background(), img, &credentialsMockClient{RegistryClient: &regClient, key: "one"}, vc)
+		require.Error(t, err)
+		tl, err := ep.GetTags(context.Background(), img, &credentialsMockClient{RegistryClient: &regClient, key: "two"}, vc)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"2.0.0"}, tl.Tags())
+		regClient.AssertNumberOfCalls(t, "Tags", 2)
+	})
+
+	t.Run("Explained fetches bypass the cache", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0"}, nil)
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", NegativeCacheTTL: time.Minute, Cache: cache.NewMemCache()}
+		_, err := ep.GetTags(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		_, excluded, err := ep.GetTagsExplained(context.Background(), img, &regClient, vc)
+		require.NoError(t, err)
+		assert.Contains(t, excluded, "1.2.0")
+		regClient.AssertNumberOfCalls(t, "Tags", 2)
+	})
+}
+
+func Test_GetTagsImmutable(t *testing.T) {
+	t.Run("Changed digest of immutable tag is detected", func(t *testing.T) {
+		regClient := &digestRegistryClient{digests: map[string]string{
+			"1.2.0": "sha256:aaa",
+			"1.2.1": "sha256:bbb",
+		}}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1"}, nil)
+
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", ImmutableTags: []string{"1.2.*"}, Cache: cache.NewMemCache()}
+		vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0", "1.2.1"}, tl.Tags())
+		assert.Empty(t, excluded)
+		assert.Equal(t, "sha256:bbb", ep.Cache.GetDigest("foo/bar", "1.2.1"))
+
+		regClient.digests["1.2.1"] = "sha256:ccc"
+		tl, excluded, err = ep.GetTagsExplained(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0"}, tl.Tags())
+		assert.Equal(t, "immutable: digest changed from sha256:bbb to sha256:ccc", excluded["1.2.1"])
+
+		// The first observed digest is kept, so the violation persists
+		assert.Equal(t, "sha256:bbb", ep.Cache.GetDigest("foo/bar", "1.2.1"))
+	})
+
+	t.Run("Changed digest is detected with cache disabled", func(t *testing.T) {
+		regClient := &digestRegistryClient{digests: map[string]string{"1.2.0": "sha256:aaa"}}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0"}, nil)
+
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", ImmutableTags: []string{"1.2.*"}, Cache: cache.NewMemCache(), DisableCache: true}
+		vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, NoCache: true}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+
+		_, err := ep.GetTags(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		regClient.digests["1.2.0"] = "sha256:bbb"
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		assert.Empty(t, tl.Tags())
+		assert.Equal(t, "immutable: digest changed from sha256:aaa to sha256:bbb", excluded["1.2.0"])
+		assert.Equal(t, 0, ep.Cache.NumEntries())
+	})
+
+	t.Run("Tags not matching the patterns are not verified", func(t *testing.T) {
+		regClient := &digestRegistryClient{digests: map[string]string{}}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "latest"}, nil)
+
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", ImmutableTags: []string{"v*"}, Cache: cache.NewMemCache()}
+		vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+
+		tl, err := ep.GetTags(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.2.0", "latest"}, tl.Tags())
+		assert.Equal(t, "", ep.Cache.GetDigest("foo/bar", "1.2.0"))
+	})
+}
+
+func Test_GetTagsCachedImmutable(t *testing.T) {
+	img := image.NewFromIdentifier("example.com/foo/bar:v1")
+	vc := &image.VersionConstraint{SortMode: image.VersionSortLatest}
+	newClient := func() *digestRegistryClient {
+		regClient := &digestRegistryClient{digests: map[string]string{"v1": "sha256:aaa", "v2": "sha256:aaa", "latest": "sha256:aaa"}}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"v1", "v2", "latest"}, nil)
+		regClient.On("ManifestV2", mock.Anything, mock.Anything, mock.Anything).Return(&schema2.DeserializedManifest{}, nil)
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(&tag.TagInfo{CreatedAt: time.Now(), Digest: "sha256:aaa"}, nil)
+		return regClient
+	}
+
+	t.Run("Only mutable tags are fetched again", func(t *testing.T) {
+		regClient := newClient()
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", ImmutableTags: []string{"v*"}, Cache: cache.NewMemCache()}
+		tl, err := ep.GetTags(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"v1", "v2", "latest"}, tl.Tags())
+		regClient.AssertNumberOfCalls(t, "ManifestV2", 3)
+
+		tl, err = ep.GetTags(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"v1", "v2", "latest"}, tl.Tags())
+		regClient.AssertNumberOfCalls(t, "ManifestV2", 4)
+		regClient.AssertCalled(t, "ManifestV2", mock.Anything, "foo/bar", "latest")
+	})
+
+	t.Run("Cached meta data of another digest is not used", func(t *testing.T) {
+		regClient := newClient()
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", ImmutableTags: []string{"v*"}, Cache: cache.NewMemCache()}
+		ep.Cache.SetTag("foo/bar", &tag.ImageTag{TagName: "v1", TagInfo: &tag.TagInfo{Digest: "sha256:bbb"}})
+		ep.Cache.SetTag("foo/bar", &tag.ImageTag{TagName: "v2", TagInfo: &tag.TagInfo{Digest: "sha256:aaa"}})
+		_, err := ep.GetTags(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		regClient.AssertCalled(t, "ManifestV2", mock.Anything, "foo/bar", "v1")
+		regClient.AssertNotCalled(t, "ManifestV2", mock.Anything, "foo/bar", "v2")
+	})
+
+	t.Run("All cached meta data is used without immutable tags", func(t *testing.T) {
+		regClient := newClient()
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		_, err := ep.GetTags(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		_, err = ep.GetTags(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		regClient.AssertNumberOfCalls(t, "ManifestV2", 3)
+	})
+}
+
+func Test_ResolveSearchRegistry(t *testing.T) {
+	RestoreDefaultRegistryConfiguration()
+	defer RestoreDefaultRegistryConfiguration()
+	require.NoError(t, AddRegistryEndpoint("new.example.com", "new", "https://new.example.com", "", "", false, SortUnsorted, 0, 0))
+	require.NoError(t, AddRegistryEndpoint("old.example.com", "old", "https://old.example.com", "", "", false, SortUnsorted, 0, 0))
+	require.NoError(t, AddRegistryEndpoint("other.example.com", "other", "https://other.example.com", "", "", false, SortUnsorted, 0, 0))
+
+	clients := map[string][]string{
+		"new.example.com":   {"1.0.0"},
+		"old.example.com":   {"0.9.0", "1.0.0"},
+		"other.example.com": {},
+	}
+	newClient := func(ep *RegistryEndpoint) (RegistryClient, error) {
+		regClient := &mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, "myapp").Return(clients[ep.RegistryPrefix], nil)
+		return regClient, nil
+	}
+	img := image.NewFromIdentifier("myapp")
+
+	t.Run("First registry having the image wins", func(t *testing.T) {
+		SetSearchRegistries([]string{"other.example.com", "new.example.com", "old.example.com"})
+		ep, _, err := ResolveSearchRegistry(context.Background(), img, newClient)
+		require.NoError(t, err)
+		assert.Equal(t, "new.example.com", ep.RegistryPrefix)
+	})
+
+	t.Run("Unconfigured search registries are skipped", func(t *testing.T) {
+		SetSearchRegistries([]string{"unknown.example.com", "old.example.com"})
+		ep, _, err := ResolveSearchRegistry(context.Background(), img, newClient)
+		require.NoError(t, err)
+		assert.Equal(t, "old.example.com", ep.RegistryPrefix)
+	})
+
+	t.Run("Image not found in any search registry", func(t *testing.T) {
+		SetSearchRegistries([]string{"other.example.com"})
+		_, _, err := ResolveSearchRegistry(context.Background(), img, newClient)
+		assert.Error(t, err)
+	})
+
+	t.Run("Resolved registry is reused", func(t *testing.T) {
+		SetSearchRegistries([]string{"other.example.com", "new.example.com"})
+		ep, _, err := ResolveSearchRegistry(context.Background(), img, newClient)
+		require.NoError(t, err)
+		assert.Equal(t, "new.example.com", ep.RegistryPrefix)
+		calls := 0
+		countingClient := func(ep *RegistryEndpoint) (RegistryClient, error) {
+			calls++
+			return newClient(ep)
+		}
+		ep, _, err = ResolveSearchRegistry(context.Background(), img, countingClient)
+		require.NoError(t, err)
+		assert.Equal(t, "new.example.com", ep.RegistryPrefix)
+		assert.Equal(t, 0, calls)
+	})
+
+	t.Run("Resolved tags are not listed again", func(t *testing.T) {
+		SetSearchRegistries([]string{"old.example.com"})
+		ep, ctx, err := ResolveSearchRegistry(context.Background(), img, newClient)
+		require.NoError(t, err)
+		regClient := &mocks.RegistryClient{}
+		tl, err := ep.GetTags(ctx, img, regClient, &image.VersionConstraint{SortMode: image.VersionSortSemVer})
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"0.9.0", "1.0.0"}, tl.Tags())
+		regClient.AssertNotCalled(t, "Tags", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Search list is reset with the configuration", func(t *testing.T) {
+		SetSearchRegistries([]string{"other.example.com"})
+		RestoreDefaultRegistryConfiguration()
+		assert.Empty(t, GetSearchRegistries())
+	})
+}
+
+func Test_WriteBackImage(t *testing.T) {
+	t.Run("Registry is rewritten", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryPrefix: "mirror.example.com", WriteBackPrefix: "cache.example.com"}
+		img := image.NewFromIdentifier("foo=mirror.example.com/foo/bar:1.0.0")
+		img.ImageTag.TagDigest = "sha256:abc"
+		nimg := ep.WriteBackImage(img)
+		assert.Equal(t, "cache.example.com/foo/bar:1.0.0@sha256:abc", nimg.GetFullNameWithTag())
+		assert.Equal(t, "sha256:abc", nimg.ImageTag.TagDigest)
+		assert.Equal(t, "foo", nimg.ImageAlias)
+		assert.Equal(t, "mirror.example.com/foo/bar", nimg.RewrittenFrom)
+		assert.Equal(t, "mirror.example.com", img.RegistryURL)
+	})
+
+	t.Run("Default namespace is made explicit", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryPrefix: "", DefaultNS: "library", WriteBackPrefix: "cache.example.com/dockerhub"}
+		nimg := ep.WriteBackImage(image.NewFromIdentifier("nginx:1.19"))
+		assert.Equal(t, "cache.example.com/dockerhub/library/nginx:1.19", nimg.GetFullNameWithTag())
+		assert.Equal(t, "nginx", nimg.RewrittenFrom)
+	})
+
+	t.Run("No write-back prefix configured", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryPrefix: "mirror.example.com"}
+		img := image.NewFromIdentifier("mirror.example.com/foo/bar:1.0.0")
+		assert.Same(t, img, ep.WriteBackImage(img))
+	})
+}
+
+func Test_GetTagsWithContext(t *testing.T) {
+	t.Run("Cancelled context stops fetching metadata", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.0", "1.2.1"}, nil)
+
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		vc := &image.VersionConstraint{SortMode: image.VersionSortLatest}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		tl, err := ep.GetTags(ctx, img, &regClient, vc)
+		assert.Equal(t, context.Canceled, err)
+		assert.Nil(t, tl)
+		regClient.AssertNotCalled(t, "ManifestV2", mock.Anything, mock.Anything, mock.Anything)
+	})
+	t.Run("Cancelled context aborts requests in flight", func(t *testing.T) {
+		done := make(chan struct{})
+		defer close(done)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-done:
+			}
+		}))
+		defer srv.Close()
+		regClient := &registryClient{regClient: &registry.Registry{URL: srv.URL, Client: srv.Client()}}
+
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		vc := &image.VersionConstraint{SortMode: image.VersionSortLatest}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+		start := time.Now()
+		tl, err := ep.GetTags(ctx, img, regClient, vc)
+		assert.Equal(t, context.Canceled, err)
+		assert.Nil(t, tl)
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	})
+}
+
+// concurrencyRegistryClient is a RegistryClient that records the maximum
+// number of manifests fetched concurrently, and fails for some tags
+type concurrencyRegistryClient struct {
+	mocks.RegistryClient
+	lock     sync.Mutex
+	inFlight int
+	max      int
+	failing  map[string]bool
+}
+
+func (c *concurrencyRegistryClient) ManifestV2(ctx context.Context, nameInRepository string, reference string) (*schema2.DeserializedManifest, error) {
+	c.lock.Lock()
+	c.inFlight += 1
+	if c.inFlight > c.max {
+		c.max = c.inFlight
+	}
+	c.lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.lock.Lock()
+	c.inFlight -= 1
+	c.lock.Unlock()
+	if c.failing[reference] {
+		return nil, fmt.Errorf("connection reset")
+	}
+	return &schema2.DeserializedManifest{}, nil
+}
+
+func Test_GetTagsMetadataConcurrency(t *testing.T) {
+	tags := []string{"1.0", "1.1", "1.2", "1.3", "1.4", "1.5", "1.6", "1.7"}
+
+	t.Run("Concurrent metadata fetches are limited", func(t *testing.T) {
+		regClient := &concurrencyRegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return(tags, nil)
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(&tag.TagInfo{CreatedAt: time.Now()}, nil)
+
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", MetadataConcurrency: 2, Cache: cache.NewMemCache()}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+		tl, err := ep.GetTags(context.Background(), img, regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
+		require.NoError(t, err)
+		assert.Len(t, tl.Tags(), len(tags))
+		assert.LessOrEqual(t, regClient.max, 2)
+	})
+
+	t.Run("Failing tags do not abort the batch", func(t *testing.T) {
+		regClient := &concurrencyRegistryClient{failing: map[string]bool{"1.2": true, "1.5": true}}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return(tags, nil)
+		regClient.On("ManifestList", mock.Anything, mock.Anything, mock.Anything).Return(nil, fmt.Errorf("not a manifest list"))
+		regClient.On("ManifestV1", mock.Anything, mock.Anything, mock.Anything).Return(nil, fmt.Errorf("not found"))
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(&tag.TagInfo{CreatedAt: time.Now()}, nil)
+
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", MetadataConcurrency: 3, Cache: cache.NewMemCache()}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
+		require.NoError(t, err)
+		assert.Len(t, tl.Tags(), len(tags)-2)
+		assert.Contains(t, excluded["1.2"], "metadata: no manifest returned by registry")
+		assert.Contains(t, excluded["1.5"], "metadata: no manifest returned by registry")
+	})
+
+	t.Run("Concurrency defaults to and is capped at maximum", func(t *testing.T) {
+		assert.Equal(t, MaxMetadataConcurrency, (&RegistryEndpoint{}).metadataConcurrency())
+		assert.Equal(t, MaxMetadataConcurrency, (&RegistryEndpoint{MetadataConcurrency: 100}).metadataConcurrency())
+		assert.Equal(t, 5, (&RegistryEndpoint{MetadataConcurrency: 5}).metadataConcurrency())
+	})
+}
+
+// pagedRegistryClient is a RegistryClient that lists the tags in the given
+// pages and counts the pages listed
+type pagedRegistryClient struct {
+	mocks.RegistryClient
+	pages  [][]string
+	listed int
+}
+
+func (c *pagedRegistryClient) TagPages(ctx context.Context, nameInRepository string, fn func(tags []string) bool) error {
+	for _, page := range c.pages {
+		c.listed++
+		if !fn(page) {
+			break
+		}
+	}
+	return nil
+}
+
+func Test_GetTagsMaxTags(t *testing.T) {
+	tags := []string{"1.7", "1.6", "1.5", "1.4", "1.3", "1.2", "1.1", "1.0"}
+
+	t.Run("Only the first tags are considered", func(t *testing.T) {
+		regClient := &concurrencyRegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return(tags, nil)
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(&tag.TagInfo{CreatedAt: time.Now()}, nil)
+
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+		vc := &image.VersionConstraint{SortMode: image.VersionSortLatest, IgnoreList: []string{"1.6"}, MaxTags: 3}
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.7", "1.5", "1.4"}, tl.Tags())
+		assert.Equal(t, "max-tags: exceeds the maximum of 3 tags", excluded["1.3"])
+		assert.Equal(t, "max-tags: exceeds the maximum of 3 tags", excluded["1.0"])
+		regClient.AssertNumberOfCalls(t, "TagMetadata", 3)
+	})
+
+	t.Run("Remaining pages are not listed", func(t *testing.T) {
+		regClient := &pagedRegistryClient{pages: [][]string{{"1.7", "1.6"}, {"1.5", "1.4"}, {"1.3", "1.2"}, {"1.1", "1.0"}}}
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+		vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, IgnoreList: []string{"1.6"}, MaxTags: 2}
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.7", "1.5"}, tl.Tags())
+		assert.Equal(t, "max-tags: exceeds the maximum of 2 tags", excluded["1.4"])
+		assert.Equal(t, 2, regClient.listed)
+		regClient.AssertNotCalled(t, "Tags", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Limit is part of the constraint key", func(t *testing.T) {
+		assert.NotEqual(t, (&image.VersionConstraint{}).Key(), (&image.VersionConstraint{MaxTags: 3}).Key())
+	})
+}
+
+func Test_GetNewestTags(t *testing.T) {
+	names := func(tags tag.SortableImageTagList) []string {
+		result := []string{}
+		for _, t := range tags {
+			result = append(result, t.TagName)
+		}
+		return result
+	}
+
+	t.Run("Newest semver tags in ascending order", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.2.3", "1.2.0", "1.2.2", "latest", "1.2.1", "2.0.0"}, nil)
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+
+		newest, err := ep.GetNewestTags(context.Background(), img, &regClient, &image.VersionConstraint{Constraint: "1.2.x", SortMode: image.VersionSortSemVer}, 3)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.2.1", "1.2.2", "1.2.3"}, names(newest))
+
+		newest, err = ep.GetNewestTags(context.Background(), img, &regClient, &image.VersionConstraint{Constraint: "1.2.x", SortMode: image.VersionSortSemVer}, 10)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.2.0", "1.2.1", "1.2.2", "1.2.3"}, names(newest))
+	})
+
+	t.Run("Newest tags by embedded date without meta data", func(t *testing.T) {
+		regClient := mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"app-20240115-1", "app-20231231-7", "app-20240201-2", "latest"}, nil)
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		img := image.NewFromIdentifier("example.com/foo/bar:app-20231231-7")
+		vc := &image.VersionConstraint{SortMode: image.VersionSortDate, DatePattern: regexp.MustCompile(`^app-(\d{8})-\d+$`)}
+
+		newest, err := ep.GetNewestTags(context.Background(), img, &regClient, vc, 2)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"app-20240115-1", "app-20240201-2"}, names(newest))
+		regClient.AssertNotCalled(t, "ManifestV2", mock.Anything, mock.Anything, mock.Anything)
+		regClient.AssertNotCalled(t, "TagMetadata", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Meta data is only fetched for the newest tags", func(t *testing.T) {
+		or := newOCIRegistry()
+		for _, name := range []string{"app-20240101-1", "app-20240102-1", "app-20240103-1", "app-20240104-1"} {
+			or.addImageWithConfig(name, []byte(`{"created":"2021-01-01T00:00:00Z","os":"linux","architecture":"arm64","config":{"Labels":{"tag":"`+name+`"}}}`), ociManifestMediaType)
+		}
+		// The meta data of the newest tag cannot be fetched
+		or.addImageWithConfig("app-20240105-1", []byte(`{}`), ociManifestMediaType)
+		delete(or.blobs, contentDigest([]byte(`{}`)))
+		requested := sync.Map{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if name := strings.TrimPrefix(r.URL.Path, "/v2/foo/bar/manifests/"); name != r.URL.Path {
+				requested.Store(name, true)
+			}
+			or.ServeHTTP(w, r)
+		}))
+		defer srv.Close()
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.Cache = cache.NewMemCache()
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		img := image.NewFromIdentifier("example.com/foo/bar:app-20240101-1")
+		vc := &image.VersionConstraint{SortMode: image.VersionSortDate, DatePattern: regexp.MustCompile(`^app-(\d{8})-\d+$`), FetchMetadata: true}
+
+		newest, err := ep.GetNewestTags(context.Background(), img, client, vc, 2)
+		require.NoError(t, err)
+		require.Equal(t, []string{"app-20240103-1", "app-20240104-1"}, names(newest))
+		for _, t2 := range newest {
+			require.NotNil(t, t2.TagInfo)
+			assert.Equal(t, t2.TagName, t2.TagInfo.Labels["tag"])
+			assert.Equal(t, "linux/arm64", t2.TagPlatform)
+		}
+		// Dates are still the ones embedded in the tag names
+		assert.True(t, time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC).Equal(*newest[1].TagDate))
+		for _, name := range []string{"app-20240101-1", "app-20240102-1"} {
+			_, ok := requested.Load(name)
+			assert.False(t, ok, name)
+		}
+	})
+
+	t.Run("Number of tags must be positive", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+		_, err := ep.GetNewestTags(context.Background(), img, &mocks.RegistryClient{}, &image.VersionConstraint{}, 0)
+		assert.Error(t, err)
+	})
+}
+
+// tagCountRecorder is a cache that counts how often a number of tags is
+// recorded
+type tagCountRecorder struct {
+	cache.ImageTagCache
+	recorded int
+}
+
+func (c *tagCountRecorder) SetTagCount(imageName string, count int) {
+	c.recorded++
+	c.ImageTagCache.SetTagCount(imageName, count)
+}
+
+func Test_GetTagsMinTags(t *testing.T) {
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+	vc := &image.VersionConstraint{SortMode: image.VersionSortName, MinTags: 0.9}
+	newClient := func(tags []string) *mocks.RegistryClient {
+		regClient := &mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return(tags, nil)
+		return regClient
+	}
+	all := []string{"1.0", "1.1", "1.2", "1.3", "1.4", "1.5", "1.6", "1.7", "1.8", "1.9"}
+
+	t.Run("Truncated tag list is rejected", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		tl, err := ep.GetTags(context.Background(), img, newClient(all), vc)
+		require.NoError(t, err)
+		assert.Len(t, tl.Tags(), 10)
+		assert.Equal(t, 10, ep.Cache.GetTagCount("foo/bar"))
+
+		_, err = ep.GetTags(context.Background(), img, newClient(all[:5]), vc)
+		require.Error(t, err)
+		assert.True(t, IsTruncatedTagListError(err))
+		assert.Equal(t, "registry returned only 5 of 10 previously known tags of foo/bar, the tag list may be truncated", err.Error())
+
+		// Transient truncation does not change the known number of tags
+		tl, err = ep.GetTags(context.Background(), img, newClient(all), vc)
+		require.NoError(t, err)
+		assert.Len(t, tl.Tags(), 10)
+		_, err = ep.GetTags(context.Background(), img, newClient(all[:8]), vc)
+		assert.True(t, IsTruncatedTagListError(err))
+	})
+
+	t.Run("Truncated tag list is rejected with cache disabled", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache(), DisableCache: true}
+		_, err := ep.GetTags(context.Background(), img, newClient(all), vc)
+		require.NoError(t, err)
+		_, err = ep.GetTags(context.Background(), img, newClient(all[:5]), &image.VersionConstraint{SortMode: image.VersionSortName, MinTags: 0.9, NoCache: true})
+		assert.True(t, IsTruncatedTagListError(err))
+		assert.Equal(t, 0, ep.Cache.NumEntries())
+	})
+
+	t.Run("Small decrease is accepted", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		ep.Cache.SetTagCount("foo/bar", 10)
+		tl, err := ep.GetTags(context.Background(), img, newClient(all[:9]), vc)
+		require.NoError(t, err)
+		assert.Len(t, tl.Tags(), 9)
+		assert.Equal(t, 9, ep.Cache.GetTagCount("foo/bar"))
+	})
+
+	t.Run("Lower count is accepted once it persists", func(t *testing.T) {
+		defer func(period time.Duration) { tagCountConfirmPeriod = period }(tagCountConfirmPeriod)
+		tagCountConfirmPeriod = 100 * time.Millisecond
+		ep := &RegistryEndpoint{RegistryPrefix: "example.org", Cache: cache.NewMemCache()}
+		ep.Cache.SetTagCount("foo/bar", 10)
+		_, err := ep.GetTags(context.Background(), img, newClient(all[:5]), vc)
+		assert.True(t, IsTruncatedTagListError(err))
+
+		// The same count returned again right away is still rejected
+		_, err = ep.GetTags(context.Background(), img, newClient(all[:5]), vc)
+		assert.True(t, IsTruncatedTagListError(err))
+		assert.Equal(t, 10, ep.Cache.GetTagCount("foo/bar"))
+
+		time.Sleep(200 * time.Millisecond)
+		tl, err := ep.GetTags(context.Background(), img, newClient(all[:5]), vc)
+		require.NoError(t, err)
+		assert.Len(t, tl.Tags(), 5)
+		assert.Equal(t, 5, ep.Cache.GetTagCount("foo/bar"))
+	})
+
+	t.Run("Unchanged count is not recorded again", func(t *testing.T) {
+		tagCache := &tagCountRecorder{ImageTagCache: cache.NewMemCache()}
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: tagCache}
+		for i := 0; i < 3; i++ {
+			_, err := ep.GetTags(context.Background(), img, newClient(all), &image.VersionConstraint{SortMode: image.VersionSortName})
+			require.NoError(t, err)
+		}
+		assert.Equal(t, 1, tagCache.recorded)
+	})
+
+	t.Run("Count is not checked without constraint", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryPrefix: "example.net", Cache: cache.NewMemCache()}
+		ep.Cache.SetTagCount("foo/bar", 10)
+		tl, err := ep.GetTags(context.Background(), img, newClient(all[:1]), &image.VersionConstraint{SortMode: image.VersionSortName})
+		require.NoError(t, err)
+		assert.Len(t, tl.Tags(), 1)
+		assert.Equal(t, 1, ep.Cache.GetTagCount("foo/bar"))
+	})
+}
+
+func Test_GetTagsFetchMetadata(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+	newClient := func(tags []string) *mocks.RegistryClient {
+		regClient := &mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return(tags, nil)
+		regClient.On("ManifestV2", mock.Anything, mock.Anything, mock.Anything).Return(&schema2.DeserializedManifest{}, nil)
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, mock.Anything).Return(&tag.TagInfo{CreatedAt: created, OS: "linux", Arch: "amd64", Digest: "sha256:abc"}, nil)
+		return regClient
+	}
+
+	t.Run("Meta data is not fetched by default", func(t *testing.T) {
+		regClient := newClient([]string{"1.0", "1.1"})
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		tl, err := ep.GetTags(context.Background(), img, regClient, &image.VersionConstraint{})
+		require.NoError(t, err)
+		assert.Nil(t, tl.Get("1.1").TagInfo)
+		regClient.AssertNotCalled(t, "TagMetadata", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Meta data is fetched for semver strategy", func(t *testing.T) {
+		regClient := newClient([]string{"1.0", "1.1"})
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		vc := &image.VersionConstraint{FetchMetadata: true}
+		tl, err := ep.GetTags(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		ti := tl.Get("1.1").TagInfo
+		require.NotNil(t, ti)
+		assert.Equal(t, created, ti.CreatedAt)
+		assert.Equal(t, "sha256:abc", ti.Digest)
+		assert.Equal(t, "linux/amd64", tl.Get("1.1").TagPlatform)
+
+		selected, err := img.GetNewestVersionFromTags(vc, tl)
+		require.NoError(t, err)
+		require.NotNil(t, selected.TagInfo)
+		assert.Equal(t, created, selected.TagInfo.CreatedAt)
+	})
+
+	t.Run("Tags without meta data in cache are fetched again", func(t *testing.T) {
+		regClient := newClient([]string{"1.0"})
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		ep.Cache.SetTag("foo/bar", tag.NewImageTag("1.0", created))
+		tl, err := ep.GetTags(context.Background(), img, regClient, &image.VersionConstraint{FetchMetadata: true})
+		require.NoError(t, err)
+		require.NotNil(t, tl.Get("1.0").TagInfo)
+		regClient.AssertNumberOfCalls(t, "TagMetadata", 1)
+	})
+
+	t.Run("Dates from tag names are kept", func(t *testing.T) {
+		regClient := newClient([]string{"app-20240115-1", "latest"})
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		vc := &image.VersionConstraint{SortMode: image.VersionSortDate, DatePattern: regexp.MustCompile(`^app-(\d{8})-\d+$`), FetchMetadata: true}
+		tl, err := ep.GetTags(context.Background(), img, regClient, vc)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"app-20240115-1"}, tl.Tags())
+		imgTag := tl.Get("app-20240115-1")
+		assert.Equal(t, time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), *imgTag.TagDate)
+		require.NotNil(t, imgTag.TagInfo)
+		assert.Equal(t, created, imgTag.TagInfo.CreatedAt)
+		regClient.AssertNumberOfCalls(t, "TagMetadata", 1)
+	})
+}
+
+func Test_GetTagsMaxAge(t *testing.T) {
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+	newClient := func() *mocks.RegistryClient {
+		regClient := &mocks.RegistryClient{}
+		regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0", "1.1", "1.2"}, nil)
+		for i, tagName := range []string{"1.0", "1.1", "1.2"} {
+			ml := &schema2.DeserializedManifest{Manifest: schema2.Manifest{Config: distribution.Descriptor{Size: int64(i)}}}
+			regClient.On("ManifestV2", mock.Anything, mock.Anything, tagName).Return(ml, nil)
+		}
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, &schema2.DeserializedManifest{Manifest: schema2.Manifest{Config: distribution.Descriptor{Size: 0}}}).
+			Return(&tag.TagInfo{CreatedAt: time.Now().Add(-200 * 24 * time.Hour)}, nil)
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, &schema2.DeserializedManifest{Manifest: schema2.Manifest{Config: distribution.Descriptor{Size: 1}}}).
+			Return(&tag.TagInfo{CreatedAt: time.Now().Add(-10 * 24 * time.Hour)}, nil)
+		regClient.On("TagMetadata", mock.Anything, mock.Anything, &schema2.DeserializedManifest{Manifest: schema2.Manifest{Config: distribution.Descriptor{Size: 2}}}).
+			Return(&tag.TagInfo{}, nil)
+		return regClient
+	}
+
+	t.Run("Drop tags older than the maximum age", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, MaxAge: 180 * 24 * time.Hour}
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, newClient(), vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.1", "1.2"}, tl.Tags())
+		assert.Contains(t, excluded["1.0"], "max-age")
+	})
+
+	t.Run("Drop tags with unknown creation date", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, MaxAge: 180 * 24 * time.Hour, MissingAge: image.MissingDataDrop}
+		tl, excluded, err := ep.GetTagsExplained(context.Background(), img, newClient(), vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"1.1"}, tl.Tags())
+		assert.Contains(t, excluded["1.2"], "creation date is unknown")
+	})
+
+	t.Run("Meta data is not fetched without maximum age", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryPrefix: "example.com", Cache: cache.NewMemCache()}
+		regClient := newClient()
+		tl, err := ep.GetTags(context.Background(), img, regClient, &image.VersionConstraint{SortMode: image.VersionSortSemVer})
+		require.NoError(t, err)
+		assert.Len(t, tl.Tags(), 3)
+		regClient.AssertNotCalled(t, "TagMetadata", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Maximum age is part of the constraint's key", func(t *testing.T) {
+		vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer}
+		key := vc.Key()
+		vc.MaxAge = time.Hour
+		assert.NotEqual(t, key, vc.Key())
+	})
+}
+
+func Test_GetTagsNoCache(t *testing.T) {
+	or := newOCIRegistry()
+	or.addImage("1.0", time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC), ociManifestMediaType)
+	or.addImage("1.1", time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC), ociManifestMediaType)
+	srv := httptest.NewServer(or)
+	defer srv.Close()
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+
+	newEndpoint := func(t *testing.T) (*RegistryEndpoint, RegistryClient) {
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.Cache = cache.NewMemCache()
+		ep.NegativeCacheTTL = time.Hour
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		return ep, client
+	}
+
+	t.Run("Constraint bypasses the cache", func(t *testing.T) {
+		ep, client := newEndpoint(t)
+		vc := &image.VersionConstraint{SortMode: image.VersionSortLatest, NoCache: true}
+		tl, err := ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		require.NotNil(t, tl.Get("1.1"))
+		assert.True(t, time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC).Equal(*tl.Get("1.1").TagDate))
+		assert.Equal(t, 0, ep.Cache.NumEntries())
+
+		vc = &image.VersionConstraint{SortMode: image.VersionSortSemVer, Constraint: "~2.0", NoCache: true}
+		_, err = ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		assert.False(t, ep.Cache.HasNoTags("foo/bar", vc.Key()))
+		assert.Equal(t, 0, ep.Cache.NumEntries())
+	})
+
+	t.Run("Cached meta data is not read", func(t *testing.T) {
+		ep, client := newEndpoint(t)
+		ep.Cache.SetTag("foo/bar", tag.NewImageTag("1.0", time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)))
+		vc := &image.VersionConstraint{SortMode: image.VersionSortLatest, NoCache: true}
+		tl, err := ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		assert.True(t, time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC).Equal(*tl.Get("1.0").TagDate))
+		assert.Equal(t, 1, ep.Cache.NumEntries())
+	})
+
+	t.Run("Endpoint with cache disabled", func(t *testing.T) {
+		ep, client := newEndpoint(t)
+		ep.DisableCache = true
+		vc := &image.VersionConstraint{SortMode: image.VersionSortLatest}
+		tl, err := ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		assert.Len(t, tl.Tags(), 2)
+		assert.Equal(t, 0, ep.Cache.NumEntries())
+	})
+
+	t.Run("Cache is used by default", func(t *testing.T) {
+		ep, client := newEndpoint(t)
+		vc := &image.VersionConstraint{SortMode: image.VersionSortLatest}
+		_, err := ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		assert.True(t, ep.Cache.HasTag("foo/bar", "1.0"))
+		assert.True(t, ep.Cache.HasTag("foo/bar", "1.1"))
+	})
+}
@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// Default for the maximum time to wait before retrying a request that was
+// rejected by the registry's rate limit
+const DefaultRateLimitMaxBackoff = time.Minute
+
+// Time to wait before the first retry of a rate limited request, if the
+// registry does not tell us how long to wait. The wait time is doubled for
+// each further retry.
+var rateLimitInitialBackoff = time.Second
+
+// RateLimitError is returned when a registry keeps rejecting requests with
+// 429 Too Many Requests. Callers can use IsRateLimitError to detect it, and
+// try again later.
+type RateLimitError struct {
+	// API URL of the registry
+	Registry string
+	// How long the registry asked us to wait, if it told us
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("rate limit of registry %s exceeded, retry after %s", e.Registry, e.RetryAfter)
+	}
+	return fmt.Sprintf("rate limit of registry %s exceeded", e.Registry)
+}
+
+// IsRateLimitError returns true if err is or wraps a RateLimitError
+func IsRateLimitError(err error) bool {
+	var rle *RateLimitError
+	return errors.As(err, &rle)
+}
+
+// retryTransport retries requests that are rejected with 429 Too Many
+// Requests, waiting for the time given in the response's Retry-After header,
+// or with exponential backoff of at most maxBackoff if there is none. Once the
+// retries are used up, or the registry asks us to wait longer than maxBackoff,
+// a RateLimitError is returned. Each retry is sent as a copy of the request,
+// with its body read again.
+type retryTransport struct {
+	transport  http.RoundTripper
+	maxRetries int
+	maxBackoff time.Duration
+	endpoint   string
+}
+
+// RoundTrip performs the request, retrying it while it is rate limited
+func (rt *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	backoff := rateLimitInitialBackoff
+	req := r
+	for attempt := 0; ; attempt++ {
+		resp, err := rt.transport.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
+		resp.Body.Close()
+
+		wait := backoff
+		if wait > rt.maxBackoff {
+			wait = rt.maxBackoff
+		}
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		// Requests with a body can only be sent again if it can be re-read
+		if attempt >= rt.maxRetries || retryAfter > rt.maxBackoff || (r.Body != nil && r.Body != http.NoBody && r.GetBody == nil) {
+			return nil, &RateLimitError{Registry: rt.endpoint, RetryAfter: retryAfter}
+		}
+		req = r.Clone(r.Context())
+		if r.GetBody != nil {
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		log.Debugf("rate limit of registry %s exceeded, retrying %s in %s (retry %d/%d)", rt.endpoint, r.URL, wait, attempt+1, rt.maxRetries)
+		select {
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-time.After(wait):
+		}
+		if backoff < rt.maxBackoff {
+			backoff *= 2
+		}
+	}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP date. Returns 0 if the value is invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
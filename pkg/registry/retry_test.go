@@ -0,0 +1,168 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRateLimitedServer returns a test registry that rejects the first
+// limited requests with 429, sending the given Retry-After header
+func newRateLimitedServer(limited int32, retryAfter string) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= limited {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"name":"foo/bar","tags":["1.0"]}`)
+	}))
+	return srv, &requests
+}
+
+func Test_RateLimitRetry(t *testing.T) {
+	initialBackoff := rateLimitInitialBackoff
+	rateLimitInitialBackoff = 10 * time.Millisecond
+	defer func() { rateLimitInitialBackoff = initialBackoff }()
+
+	t.Run("Rate limited request is retried", func(t *testing.T) {
+		srv, requests := newRateLimitedServer(2, "")
+		defer srv.Close()
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.RateLimitRetries = 3
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		tags, err := client.Tags(context.Background(), "foo/bar")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.0"}, tags)
+		assert.Equal(t, int32(3), atomic.LoadInt32(requests))
+	})
+
+	t.Run("Retry-After header is honored", func(t *testing.T) {
+		srv, requests := newRateLimitedServer(1, "1")
+		defer srv.Close()
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.RateLimitRetries = 1
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		start := time.Now()
+		_, err = client.Tags(context.Background(), "foo/bar")
+		require.NoError(t, err)
+		assert.True(t, time.Since(start) >= time.Second)
+		assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+	})
+
+	t.Run("Retries are exhausted", func(t *testing.T) {
+		srv, requests := newRateLimitedServer(10, "")
+		defer srv.Close()
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.RateLimitRetries = 2
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		_, err = client.Tags(context.Background(), "foo/bar")
+		require.Error(t, err)
+		assert.True(t, IsRateLimitError(err))
+		assert.Equal(t, int32(3), atomic.LoadInt32(requests))
+	})
+
+	t.Run("No retries by default", func(t *testing.T) {
+		srv, requests := newRateLimitedServer(10, "")
+		defer srv.Close()
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		_, err = client.Tags(context.Background(), "foo/bar")
+		require.Error(t, err)
+		assert.True(t, IsRateLimitError(err))
+		assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+	})
+
+	t.Run("Registry asks to wait longer than maximum backoff", func(t *testing.T) {
+		srv, requests := newRateLimitedServer(10, "3600")
+		defer srv.Close()
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.RateLimitRetries = 3
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		_, err = client.Tags(context.Background(), "foo/bar")
+		require.Error(t, err)
+		assert.True(t, IsRateLimitError(err))
+		assert.Contains(t, err.Error(), "retry after 1h0m0s")
+		assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+	})
+
+	t.Run("Backoff is capped at maximum backoff", func(t *testing.T) {
+		srv, requests := newRateLimitedServer(5, "")
+		defer srv.Close()
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.RateLimitRetries = 5
+		ep.RateLimitMaxBackoff = 20 * time.Millisecond
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		_, err = client.Tags(context.Background(), "foo/bar")
+		require.NoError(t, err)
+		assert.Equal(t, int32(6), atomic.LoadInt32(requests))
+	})
+
+	t.Run("Body is sent again with each retry", func(t *testing.T) {
+		var requests int32
+		bodies := make(chan string, 3)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies <- string(body)
+			if atomic.AddInt32(&requests, 1) <= 2 {
+				w.WriteHeader(http.StatusTooManyRequests)
+			}
+		}))
+		defer srv.Close()
+		rt := &retryTransport{transport: http.DefaultTransport, maxRetries: 2, maxBackoff: time.Second, endpoint: srv.URL}
+		req, err := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader("query"))
+		require.NoError(t, err)
+		resp, err := rt.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		close(bodies)
+		for body := range bodies {
+			assert.Equal(t, "query", body)
+		}
+		assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	})
+
+	t.Run("Backoff is aborted when context is done", func(t *testing.T) {
+		srv, _ := newRateLimitedServer(10, "30")
+		defer srv.Close()
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		ep.RateLimitRetries = 3
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err = client.Tags(ctx, "foo/bar")
+		require.Error(t, err)
+		assert.False(t, IsRateLimitError(err))
+		assert.True(t, time.Since(start) < 5*time.Second)
+	})
+}
+
+func Test_ParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-1"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Wed, 21 Oct 2015 07:28:00 GMT"))
+	wait := parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, wait > 59*time.Minute && wait <= time.Hour)
+}
@@ -0,0 +1,260 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+)
+
+// ManifestSchema is the schema of the manifest the meta data of a tag has been
+// read from
+type ManifestSchema string
+
+const (
+	SchemaV2    ManifestSchema = "schema2"
+	SchemaOCI   ManifestSchema = "oci"
+	SchemaIndex ManifestSchema = "index"
+	SchemaV1    ManifestSchema = "schema1"
+)
+
+// OCIManifestClient is implemented by registry clients that are able to fetch
+// OCI image manifests, in addition to Docker V2 manifests.
+type OCIManifestClient interface {
+	// ManifestOCI returns the OCI image manifest for a given tag in given
+	// repository, as V2 manifest it is compatible with, along with the
+	// digest of the manifest as served by the registry
+	ManifestOCI(ctx context.Context, repository string, reference string) (*schema2.DeserializedManifest, string, error)
+}
+
+// ManifestClient is implemented by registry clients that are able to fetch the
+// manifest at a reference in whichever schema the registry serves it, with a
+// single request. Registries such as Docker Hub count each request for a
+// manifest as a pull, so trying one schema after another is expensive.
+type ManifestClient interface {
+	// Manifest returns the manifest at the given reference along with its
+	// schema and the digest of the manifest as served by the registry. The
+	// digest is empty for image indexes and V1 manifests.
+	Manifest(ctx context.Context, repository string, reference string) (distribution.Manifest, ManifestSchema, string, error)
+}
+
+// Content types some registries serve manifests with instead of their media
+// type. The media type is then read from the manifest itself.
+var genericContentTypes = []string{"", "application/json", "application/octet-stream", "text/plain"}
+
+// ManifestOCI returns the OCI image manifest for a given tag in given
+// repository. The manifest is returned as V2 manifest, which it is compatible
+// with, along with its digest. Converting the manifest changes its payload,
+// so the digest is the one of the manifest as served.
+func (client *registryClient) ManifestOCI(ctx context.Context, repository string, reference string) (_ *schema2.DeserializedManifest, _ string, err error) {
+	defer func() { err = client.classifyError(err); client.recordCall("manifest_oci", err) }()
+	resp, err := client.manifestRequest(ctx, http.MethodGet, repository, reference)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", client.statusError(resp, "could not fetch manifest for %s:%s", repository, reference)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if mediaType := manifestMediaType(resp.Header.Get("Content-Type"), body); mediaType != ociManifestMediaType {
+		return nil, "", fmt.Errorf("manifest for %s:%s is of type %s, not an OCI image manifest", repository, reference, mediaType)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		digest = contentDigest(body)
+	} else if err := verifyDigest(digest, body); err != nil {
+		return nil, "", err
+	}
+	man, err := manifestFromOCI(body)
+	if err != nil {
+		return nil, "", err
+	}
+	return man, digest, nil
+}
+
+// Manifest returns the manifest at the given reference in given repository,
+// accepting all schemas we know about and parsing the manifest according to
+// the media type the registry serves it with. OCI image manifests are returned
+// as V2 manifests, which they are compatible with.
+func (client *registryClient) Manifest(ctx context.Context, repository string, reference string) (_ distribution.Manifest, _ ManifestSchema, _ string, err error) {
+	defer func() { err = client.classifyError(err); client.recordCall("manifest", err) }()
+	resp, err := client.manifestRequest(ctx, http.MethodGet, repository, reference)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", client.statusError(resp, "could not get manifest for %s:%s", repository, reference)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	mediaType := manifestMediaType(resp.Header.Get("Content-Type"), body)
+	switch {
+	case isIndexMediaType(mediaType):
+		list, err := parseManifestList(body)
+		if err != nil {
+			return nil, "", "", err
+		}
+		return list, SchemaIndex, "", nil
+	// Registries serving V1 manifests often do so with a generic content type
+	case mediaType == schema1.MediaTypeSignedManifest || mediaType == schema1.MediaTypeManifest || mediaType == "":
+		man := &schema1.SignedManifest{}
+		if err := man.UnmarshalJSON(body); err != nil {
+			return nil, "", "", fmt.Errorf("could not parse V1 manifest for %s:%s: %v", repository, reference, err)
+		}
+		return man, SchemaV1, "", nil
+	case mediaType != schema2.MediaTypeManifest && mediaType != ociManifestMediaType:
+		return nil, "", "", fmt.Errorf("manifest for %s:%s is of unsupported type %s", repository, reference, mediaType)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		digest = contentDigest(body)
+	} else if err := verifyDigest(digest, body); err != nil {
+		return nil, "", "", err
+	}
+	if mediaType == ociManifestMediaType {
+		man, err := manifestFromOCI(body)
+		if err != nil {
+			return nil, "", "", err
+		}
+		return man, SchemaOCI, digest, nil
+	}
+	man := &schema2.DeserializedManifest{}
+	if err := man.UnmarshalJSON(body); err != nil {
+		return nil, "", "", fmt.Errorf("could not parse V2 manifest for %s:%s: %v", repository, reference, err)
+	}
+	return man, SchemaV2, digest, nil
+}
+
+// manifestMediaType returns the media type of a manifest served with the given
+// content type. If the content type is generic, the media type is read from
+// the manifest, which OCI image manifests may omit.
+func manifestMediaType(contentType string, body []byte) string {
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	for _, generic := range genericContentTypes {
+		if mediaType != generic {
+			continue
+		}
+		var man struct {
+			SchemaVersion int             `json:"schemaVersion"`
+			MediaType     string          `json:"mediaType"`
+			Config        json.RawMessage `json:"config"`
+		}
+		if err := json.Unmarshal(body, &man); err != nil {
+			return mediaType
+		}
+		if man.MediaType == "" && man.SchemaVersion == 2 && man.Config != nil {
+			return ociManifestMediaType
+		}
+		return man.MediaType
+	}
+	return mediaType
+}
+
+// imageManifest returns the image manifest given reference points to, along
+// with its schema and digest. If the registry client can fetch a manifest in
+// any schema, a single request is sent. Otherwise, a Docker V2 manifest is
+// tried first, and then an OCI image manifest if the registry client supports
+// them.
+func imageManifest(ctx context.Context, regClient RegistryClient, nameInRegistry, reference string) (*schema2.DeserializedManifest, ManifestSchema, string, error) {
+	if mc, ok := regClient.(ManifestClient); ok {
+		man, schema, digest, err := mc.Manifest(ctx, nameInRegistry, reference)
+		if err != nil {
+			return nil, "", "", err
+		}
+		v2, ok := man.(*schema2.DeserializedManifest)
+		if !ok {
+			return nil, "", "", fmt.Errorf("manifest for %s:%s is of schema %s, not an image manifest", nameInRegistry, reference, schema)
+		}
+		return v2, schema, digest, nil
+	}
+
+	man, err := regClient.ManifestV2(ctx, nameInRegistry, reference)
+	if err == nil {
+		return man, SchemaV2, payloadDigest(man), nil
+	}
+	oc, ok := regClient.(OCIManifestClient)
+	if !ok || ctx.Err() != nil {
+		return nil, "", "", err
+	}
+	log.Tracef("No V2 manifest for %s:%s, fetching OCI manifest (%v)", nameInRegistry, reference, err)
+	man, digest, oerr := oc.ManifestOCI(ctx, nameInRegistry, reference)
+	if oerr != nil {
+		return nil, "", "", fmt.Errorf("%v; %v", err, oerr)
+	}
+	return man, SchemaOCI, digest, nil
+}
+
+// tagManifest returns the manifest to read the meta data of given tag from,
+// along with the schema it has and its digest, if known. If the tag points to
+// an image index, the manifest for the default platform from the index is
+// returned. If the registry client can fetch a manifest in any schema, the
+// tag's manifest is fetched with a single request. Otherwise, the manifest
+// schemas are tried in turn: a Docker V2 manifest, an OCI image manifest, an
+// image index, and finally a V1 manifest. An error is only returned if none
+// of them could be fetched, and it holds the errors of all attempts. If the
+// tag points to an image index without a manifest for the default platform,
+// nil is returned without an error.
+func tagManifest(ctx context.Context, regClient RegistryClient, nameInRegistry, tagStr string) (distribution.Manifest, ManifestSchema, string, error) {
+	if mc, ok := regClient.(ManifestClient); ok {
+		man, schema, digest, err := mc.Manifest(ctx, nameInRegistry, tagStr)
+		if err != nil {
+			return nil, "", "", err
+		}
+		if list, ok := man.(*manifestlist.DeserializedManifestList); ok {
+			ml, err := selectPlatformManifest(ctx, regClient, nameInRegistry, tagStr, list, DefaultPlatform, 0)
+			if err != nil {
+				return nil, "", "", err
+			}
+			return ml, SchemaIndex, "", nil
+		}
+		return man, schema, digest, nil
+	}
+
+	errs := []string{}
+
+	man, schema, digest, err := imageManifest(ctx, regClient, nameInRegistry, tagStr)
+	if err == nil {
+		return man, schema, digest, nil
+	}
+	errs = append(errs, fmt.Sprintf("image manifest: %v", err))
+	if ctx.Err() != nil {
+		return nil, "", "", ctx.Err()
+	}
+
+	log.Debugf("No image manifest for %s:%s, fetching manifest list (%v)", nameInRegistry, tagStr, err)
+	ml, err := platformManifest(ctx, regClient, nameInRegistry, tagStr, DefaultPlatform, 0)
+	if err == nil {
+		return ml, SchemaIndex, "", nil
+	}
+	errs = append(errs, fmt.Sprintf("manifest list: %v", err))
+	if ctx.Err() != nil {
+		return nil, "", "", ctx.Err()
+	}
+
+	log.Debugf("No manifest list for %s:%s, fetching V1 (%v)", nameInRegistry, tagStr, err)
+	v1, err := regClient.ManifestV1(ctx, nameInRegistry, tagStr)
+	if err == nil {
+		return v1, SchemaV1, "", nil
+	}
+	errs = append(errs, fmt.Sprintf("V1 manifest: %v", err))
+
+	return nil, "", "", fmt.Errorf("%s", strings.Join(errs, "; "))
+}
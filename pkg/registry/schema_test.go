@@ -0,0 +1,352 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/registry/mocks"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// ociRegistryClient is a RegistryClient that serves OCI image manifests from
+// a map
+type ociRegistryClient struct {
+	mocks.RegistryClient
+	oci map[string]*schema2.DeserializedManifest
+}
+
+func (c *ociRegistryClient) ManifestOCI(ctx context.Context, repository string, reference string) (*schema2.DeserializedManifest, string, error) {
+	if man, ok := c.oci[reference]; ok {
+		return man, "sha256:" + reference, nil
+	}
+	return nil, "", fmt.Errorf("no OCI manifest")
+}
+
+// v1RegistryClient is a RegistryClient that reads the meta data of V1
+// manifests the way the registry client does
+type v1RegistryClient struct {
+	mocks.RegistryClient
+}
+
+func (c *v1RegistryClient) TagMetadata(ctx context.Context, repository string, manifest distribution.Manifest) (*tag.TagInfo, error) {
+	return (&registryClient{}).TagMetadata(ctx, repository, manifest)
+}
+
+func newV1Manifest(created string) *schema1.SignedManifest {
+	return &schema1.SignedManifest{
+		Manifest: schema1.Manifest{
+			History: []schema1.History{{V1Compatibility: `{"created":"` + created + `","os":"linux","architecture":"amd64"}`}},
+		},
+	}
+}
+
+func Test_TagManifest(t *testing.T) {
+	v2 := &schema2.DeserializedManifest{}
+	oci := &schema2.DeserializedManifest{}
+	v1 := newV1Manifest("2021-03-02T00:00:00Z")
+	newClient := func() *ociRegistryClient {
+		regClient := &ociRegistryClient{oci: map[string]*schema2.DeserializedManifest{"oci": oci}}
+		regClient.On("ManifestV2", mock.Anything, "foo/bar", "v2").Return(v2, nil)
+		regClient.On("ManifestV2", mock.Anything, "foo/bar", "sha256:amd").Return(v2, nil)
+		regClient.On("ManifestV2", mock.Anything, "foo/bar", mock.Anything).Return(nil, fmt.Errorf("no V2 manifest"))
+		regClient.On("ManifestList", mock.Anything, "foo/bar", "index").Return(newManifestList(
+			newManifestDescriptor("sha256:amd", "application/vnd.oci.image.manifest.v1+json", "linux", "amd64"),
+		), nil)
+		regClient.On("ManifestList", mock.Anything, "foo/bar", "arm").Return(newManifestList(
+			newManifestDescriptor("sha256:arm", "application/vnd.oci.image.manifest.v1+json", "linux", "arm64"),
+		), nil)
+		regClient.On("ManifestList", mock.Anything, "foo/bar", mock.Anything).Return(nil, fmt.Errorf("no manifest list"))
+		regClient.On("ManifestV1", mock.Anything, "foo/bar", "v1").Return(v1, nil)
+		regClient.On("ManifestV1", mock.Anything, "foo/bar", mock.Anything).Return(nil, fmt.Errorf("no V1 manifest"))
+		return regClient
+	}
+
+	t.Run("Schemas are tried in turn", func(t *testing.T) {
+		for _, tc := range []struct {
+			tag      string
+			manifest distribution.Manifest
+			schema   ManifestSchema
+		}{
+			{"v2", v2, SchemaV2},
+			{"oci", oci, SchemaOCI},
+			{"index", v2, SchemaIndex},
+			{"v1", v1, SchemaV1},
+		} {
+			man, schema, digest, err := tagManifest(context.Background(), newClient(), "foo/bar", tc.tag)
+			require.NoError(t, err, tc.tag)
+			assert.Same(t, tc.manifest, man, tc.tag)
+			assert.Equal(t, tc.schema, schema, tc.tag)
+			if tc.schema == SchemaOCI {
+				assert.Equal(t, "sha256:oci", digest)
+			}
+		}
+	})
+
+	t.Run("Index without manifest for default platform", func(t *testing.T) {
+		man, schema, _, err := tagManifest(context.Background(), newClient(), "foo/bar", "arm")
+		require.NoError(t, err)
+		assert.Nil(t, man)
+		assert.Equal(t, SchemaIndex, schema)
+	})
+
+	t.Run("Error holds all attempts", func(t *testing.T) {
+		_, _, _, err := tagManifest(context.Background(), newClient(), "foo/bar", "missing")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no V2 manifest")
+		assert.Contains(t, err.Error(), "no OCI manifest")
+		assert.Contains(t, err.Error(), "no manifest list")
+		assert.Contains(t, err.Error(), "no V1 manifest")
+	})
+
+	t.Run("OCI manifest is not tried without support", func(t *testing.T) {
+		regClient := &mocks.RegistryClient{}
+		regClient.On("ManifestV2", mock.Anything, mock.Anything, mock.Anything).Return(nil, fmt.Errorf("no V2 manifest"))
+		regClient.On("ManifestList", mock.Anything, mock.Anything, mock.Anything).Return(nil, fmt.Errorf("no manifest list"))
+		regClient.On("ManifestV1", mock.Anything, mock.Anything, mock.Anything).Return(v1, nil)
+		man, schema, _, err := tagManifest(context.Background(), regClient, "foo/bar", "oci")
+		require.NoError(t, err)
+		assert.Same(t, v1, man)
+		assert.Equal(t, SchemaV1, schema)
+	})
+}
+
+func Test_GetTagsSchemaV1Fallback(t *testing.T) {
+	regClient := &v1RegistryClient{}
+	regClient.On("Tags", mock.Anything, mock.Anything).Return([]string{"1.0", "1.1"}, nil)
+	regClient.On("ManifestV2", mock.Anything, mock.Anything, mock.Anything).Return(nil, fmt.Errorf("not implemented"))
+	regClient.On("ManifestList", mock.Anything, mock.Anything, mock.Anything).Return(nil, fmt.Errorf("not implemented"))
+	regClient.On("ManifestV1", mock.Anything, "foo/bar", "1.0").Return(newV1Manifest("2021-03-02T00:00:00Z"), nil)
+	regClient.On("ManifestV1", mock.Anything, "foo/bar", "1.1").Return(newV1Manifest("2020-03-02T00:00:00Z"), nil)
+
+	ep := newRegistryEndpoint("example.com", "Example", "https://example.com", "", "", false, SortUnsorted, 0, 0)
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+	tl, err := ep.GetTags(context.Background(), img, regClient, &image.VersionConstraint{SortMode: image.VersionSortLatest})
+	require.NoError(t, err)
+
+	sorted := tl.SortByDate()
+	require.Len(t, sorted, 2)
+	assert.Equal(t, "1.1", sorted[0].TagName)
+	assert.Equal(t, "1.0", sorted[1].TagName)
+	require.NotNil(t, sorted[1].TagDate)
+	assert.True(t, time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC).Equal(*sorted[1].TagDate))
+	require.NotNil(t, sorted[1].TagInfo)
+	assert.Equal(t, "schema1", sorted[1].TagInfo.Schema)
+	assert.Equal(t, "linux/amd64", sorted[1].TagPlatform)
+}
+
+// ociRegistry serves OCI image manifests of the image foo/bar, whose configs
+// carry the creation time of the image, like images built by Buildah
+type ociRegistry struct {
+	manifests map[string][]byte
+	blobs     map[string][]byte
+	// contentType is sent for manifests instead of their media type if set
+	contentType string
+	// manifestRequests counts the requests for manifests
+	manifestRequests int32
+}
+
+// addImage adds a tag pointing to an OCI image manifest whose config has the
+// given creation time, and returns the digest of the manifest
+func (or *ociRegistry) addImage(name string, created time.Time, mediaType string) string {
+	return or.addImageWithConfig(name, []byte(fmt.Sprintf(`{"created":"%s","os":"linux","architecture":"amd64"}`, created.Format(time.RFC3339Nano))), mediaType)
+}
+
+// addImageWithConfig adds a tag pointing to an OCI image manifest with the
+// given config, and returns the digest of the manifest
+func (or *ociRegistry) addImageWithConfig(name string, config []byte, mediaType string) string {
+	configDigest := contentDigest(config)
+	or.blobs[configDigest] = config
+	mediaTypeField := ""
+	if mediaType != "" {
+		mediaTypeField = fmt.Sprintf(`"mediaType":"%s",`, mediaType)
+	}
+	man := []byte(fmt.Sprintf(`{"schemaVersion":2,%s"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"%s","size":%d},"layers":[]}`, mediaTypeField, configDigest, len(config)))
+	or.manifests[name] = man
+	return contentDigest(man)
+}
+
+func (or *ociRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v2/foo/bar/")
+	switch {
+	case path == "tags/list":
+		tags := []string{}
+		for t := range or.manifests {
+			tags = append(tags, t)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": "foo/bar", "tags": tags})
+	case strings.HasPrefix(path, "manifests/"):
+		atomic.AddInt32(&or.manifestRequests, 1)
+		man, ok := or.manifest(strings.TrimPrefix(path, "manifests/"))
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if or.contentType != "" {
+			w.Header().Set("Content-Type", or.contentType)
+		} else {
+			w.Header().Set("Content-Type", ociManifestMediaType)
+		}
+		w.Header().Set("Docker-Content-Digest", contentDigest(man))
+		w.Write(man)
+	case strings.HasPrefix(path, "blobs/"):
+		blob, ok := or.blobs[strings.TrimPrefix(path, "blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(blob)))
+		w.Write(blob)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// manifest returns the manifest the given tag or digest refers to
+func (or *ociRegistry) manifest(reference string) ([]byte, bool) {
+	if man, ok := or.manifests[reference]; ok {
+		return man, true
+	}
+	for _, man := range or.manifests {
+		if contentDigest(man) == reference {
+			return man, true
+		}
+	}
+	return nil, false
+}
+
+func newOCIRegistry() *ociRegistry {
+	return &ociRegistry{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+}
+
+func Test_ManifestOCI(t *testing.T) {
+	or := newOCIRegistry()
+	srv := httptest.NewServer(or)
+	defer srv.Close()
+	ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+	client, err := NewClient(ep, "", "")
+	require.NoError(t, err)
+	oc, ok := client.(OCIManifestClient)
+	require.True(t, ok)
+
+	t.Run("OCI image manifest", func(t *testing.T) {
+		digest := or.addImage("oci", time.Now(), ociManifestMediaType)
+		man, manDigest, err := oc.ManifestOCI(context.Background(), "foo/bar", "oci")
+		require.NoError(t, err)
+		assert.Equal(t, "application/vnd.oci.image.config.v1+json", man.Config.MediaType)
+		// The digest is the one of the manifest as served, not as converted
+		assert.Equal(t, digest, manDigest)
+		assert.NotEqual(t, digest, payloadDigest(man))
+	})
+
+	t.Run("Docker manifest is no OCI manifest", func(t *testing.T) {
+		or.addImage("docker", time.Now(), schema2.MediaTypeManifest)
+		or.contentType = schema2.MediaTypeManifest
+		defer func() { or.contentType = "" }()
+		_, _, err := oc.ManifestOCI(context.Background(), "foo/bar", "docker")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not an OCI image manifest")
+	})
+
+	t.Run("OCI image manifest without media type served as JSON", func(t *testing.T) {
+		or.addImage("generic", time.Now(), "")
+		or.contentType = "application/json"
+		defer func() { or.contentType = "" }()
+		_, _, err := oc.ManifestOCI(context.Background(), "foo/bar", "generic")
+		require.NoError(t, err)
+	})
+
+	t.Run("Missing manifest", func(t *testing.T) {
+		_, _, err := oc.ManifestOCI(context.Background(), "foo/bar", "missing")
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrManifestNotFound)
+	})
+}
+
+func Test_GetTagsOCIManifest(t *testing.T) {
+	or := newOCIRegistry()
+	digest := or.addImage("1.0", time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC), ociManifestMediaType)
+	or.addImage("1.1", time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC), ociManifestMediaType)
+	srv := httptest.NewServer(or)
+	defer srv.Close()
+	ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+	client, err := NewClient(ep, "", "")
+	require.NoError(t, err)
+
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+	tl, err := ep.GetTags(context.Background(), img, client, &image.VersionConstraint{SortMode: image.VersionSortLatest})
+	require.NoError(t, err)
+	sorted := tl.SortByDate()
+	require.Len(t, sorted, 2)
+	assert.Equal(t, "1.1", sorted[0].TagName)
+	assert.Equal(t, "1.0", sorted[1].TagName)
+	require.NotNil(t, sorted[1].TagDate)
+	assert.True(t, time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC).Equal(*sorted[1].TagDate))
+	require.NotNil(t, sorted[1].TagInfo)
+	assert.Equal(t, "oci", sorted[1].TagInfo.Schema)
+	assert.Equal(t, digest, sorted[1].TagInfo.Digest)
+	// A single request is sent for the manifest of each tag
+	assert.Equal(t, int32(2), atomic.LoadInt32(&or.manifestRequests))
+}
+
+func Test_Manifest(t *testing.T) {
+	or := newOCIRegistry()
+	srv := httptest.NewServer(or)
+	defer srv.Close()
+	ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+	client, err := NewClient(ep, "", "")
+	require.NoError(t, err)
+	mc, ok := client.(ManifestClient)
+	require.True(t, ok)
+
+	t.Run("OCI image manifest", func(t *testing.T) {
+		digest := or.addImage("oci", time.Now(), ociManifestMediaType)
+		man, schema, manDigest, err := mc.Manifest(context.Background(), "foo/bar", "oci")
+		require.NoError(t, err)
+		assert.IsType(t, &schema2.DeserializedManifest{}, man)
+		assert.Equal(t, SchemaOCI, schema)
+		assert.Equal(t, digest, manDigest)
+	})
+
+	t.Run("Docker V2 manifest", func(t *testing.T) {
+		digest := or.addImage("docker", time.Now(), schema2.MediaTypeManifest)
+		or.contentType = schema2.MediaTypeManifest
+		defer func() { or.contentType = "" }()
+		man, schema, manDigest, err := mc.Manifest(context.Background(), "foo/bar", "docker")
+		require.NoError(t, err)
+		assert.IsType(t, &schema2.DeserializedManifest{}, man)
+		assert.Equal(t, SchemaV2, schema)
+		assert.Equal(t, digest, manDigest)
+	})
+
+	t.Run("Image index", func(t *testing.T) {
+		or.manifests["index"] = []byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[]}`)
+		or.contentType = "application/vnd.oci.image.index.v1+json"
+		defer func() { or.contentType = "" }()
+		man, schema, _, err := mc.Manifest(context.Background(), "foo/bar", "index")
+		require.NoError(t, err)
+		assert.IsType(t, &manifestlist.DeserializedManifestList{}, man)
+		assert.Equal(t, SchemaIndex, schema)
+	})
+
+	t.Run("Missing manifest", func(t *testing.T) {
+		_, _, _, err := mc.Manifest(context.Background(), "foo/bar", "missing")
+		require.Error(t, err)
+		assert.ErrorIs(t, err, ErrManifestNotFound)
+	})
+}
@@ -0,0 +1,495 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sigstore/sigstore/pkg/cryptoutils"
+	"github.com/sigstore/sigstore/pkg/signature"
+	"github.com/sigstore/sigstore/pkg/signature/payload"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+// ErrNoValidSignature is returned when an image carries no signature that
+// satisfies the signature policy, either because it is not signed at all, or
+// because none of its signatures can be verified
+var ErrNoValidSignature = errors.New("no valid signature")
+
+// Annotations of the layers of a cosign signature manifest
+const (
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+)
+
+// Extensions of Fulcio certificates holding the OIDC issuer, either as raw
+// string or as DER-encoded UTF8String
+var (
+	fulcioIssuerOID   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	fulcioIssuerV2OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// maxSignatureSize is the maximum size of signature manifests and payloads
+// that are read from the registry
+const maxSignatureSize = 4 * 1024 * 1024
+
+// Maximum number of signature verification results an endpoint keeps. Once
+// reached, the least recently used result is evicted.
+const maxSignatureResults = 1000
+
+// Images without a valid signature may be signed later on, so that this is
+// only remembered for a limited time. Valid signatures are remembered as long
+// as the result is kept.
+const invalidSignatureTTL = 10 * time.Minute
+
+// signatureResult is the result of verifying the signatures of an image's
+// digest against a policy. The reason is empty if a valid signature was found.
+type signatureResult struct {
+	reason   string
+	verified time.Time
+	used     time.Time
+}
+
+// SignatureClient is implemented by registry clients that are able to fetch
+// the manifests and blobs cosign signatures are stored in
+type SignatureClient interface {
+	// RawManifest returns the manifest for the reference as it is stored in
+	// the registry
+	RawManifest(ctx context.Context, nameInRepository, reference string) ([]byte, error)
+	// Blob returns the content of the blob with the given digest, which is
+	// verified against the digest
+	Blob(ctx context.Context, nameInRepository, digest string) ([]byte, error)
+}
+
+// RawManifest returns the manifest for the reference as it is stored in the
+// registry
+func (client *registryClient) RawManifest(ctx context.Context, nameInRepository, reference string) (_ []byte, err error) {
+	defer func() { err = client.classifyError(err); client.recordCall("manifest_raw", err) }()
+	resp, err := client.manifestRequest(ctx, http.MethodGet, nameInRepository, reference)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, client.statusError(resp, "could not get manifest %s:%s", nameInRepository, reference)
+	}
+	return readLimited(resp.Body, maxSignatureSize)
+}
+
+// Blob returns the content of the blob with the given digest
+func (client *registryClient) Blob(ctx context.Context, nameInRepository, digest string) (_ []byte, err error) {
+	defer func() { err = client.classifyError(err); client.recordCall("blob", err) }()
+	reg := client.withContext(ctx)
+	resp, err := reg.Client.Get(fmt.Sprintf("%s/v2/%s/blobs/%s", reg.URL, nameInRepository, digest))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, client.statusError(resp, "could not get blob %s@%s", nameInRepository, digest)
+	}
+	body, err := readLimited(resp.Body, maxSignatureSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyDigest(digest, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// readLimited reads all of r, returning an error if it is larger than limit
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("response is larger than %d bytes", limit)
+	}
+	return body, nil
+}
+
+// signatureTag returns the tag cosign stores the signatures of the manifest
+// with the given digest under
+func signatureTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + ".sig"
+}
+
+// VerifySignature verifies that the image with the given tag, which points
+// to the manifest with the given digest, carries a cosign signature that
+// satisfies policy. If digest is empty, it is resolved from the tag. Returns
+// an error of kind ErrNoValidSignature if there is no such signature.
+func (endpoint *RegistryEndpoint) VerifySignature(ctx context.Context, img *image.ContainerImage, tagName, digest string, regClient RegistryClient, policy *image.SignaturePolicy) error {
+	return endpoint.verifySignature(ctx, endpoint.nameInRegistry(img), tagName, digest, regClient, policy)
+}
+
+// verifySignature verifies the signature of the tag of the image with the
+// given name in the registry. The result is remembered by digest, so that
+// neither valid nor invalid signatures are fetched and verified again every
+// cycle.
+func (endpoint *RegistryEndpoint) verifySignature(ctx context.Context, nameInRegistry, tagName, digest string, regClient RegistryClient, policy *image.SignaturePolicy) error {
+	sc, ok := regClient.(SignatureClient)
+	if !ok {
+		return fmt.Errorf("registry client for %s cannot fetch signatures", endpoint.RegistryAPI)
+	}
+	if digest == "" {
+		dc, ok := regClient.(DigestClient)
+		if !ok {
+			return fmt.Errorf("registry client for %s cannot resolve digests", endpoint.RegistryAPI)
+		}
+		var err error
+		if digest, err = dc.TagDigest(ctx, nameInRegistry, tagName); err != nil {
+			return fmt.Errorf("could not resolve digest of %s:%s: %v", nameInRegistry, tagName, err)
+		}
+	}
+
+	key := policy.Key() + "|" + nameInRegistry + "@" + digest
+	if result := endpoint.getSignatureResult(key); result != nil {
+		if result.reason == "" {
+			log.Tracef("Signature of %s@%s already verified", nameInRegistry, digest)
+			return nil
+		}
+		log.Tracef("Signature of %s@%s already found invalid", nameInRegistry, digest)
+		return endpoint.signatureError("%s", result.reason)
+	}
+
+	err := endpoint.fetchAndVerifySignature(ctx, sc, nameInRegistry, tagName, digest, policy)
+	if err == nil {
+		endpoint.setSignatureResult(key, "")
+	} else if errors.Is(err, ErrNoValidSignature) {
+		var regErr *RegistryError
+		if errors.As(err, &regErr) {
+			endpoint.setSignatureResult(key, regErr.Err.Error())
+		}
+	}
+	return err
+}
+
+// fetchAndVerifySignature fetches the signatures of the digest the tag of
+// the image points to from the registry, and verifies them against policy
+func (endpoint *RegistryEndpoint) fetchAndVerifySignature(ctx context.Context, sc SignatureClient, nameInRegistry, tagName, digest string, policy *image.SignaturePolicy) error {
+	raw, err := sc.RawManifest(ctx, nameInRegistry, signatureTag(digest))
+	if errors.Is(err, ErrManifestNotFound) {
+		return endpoint.signatureError("%s:%s is not signed", nameInRegistry, tagName)
+	} else if err != nil {
+		return fmt.Errorf("could not get signatures of %s:%s: %v", nameInRegistry, tagName, err)
+	}
+	var man struct {
+		Layers []struct {
+			Digest      string            `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(raw, &man); err != nil {
+		return endpoint.signatureError("invalid signature manifest for %s:%s: %v", nameInRegistry, tagName, err)
+	}
+
+	reasons := []string{}
+	for _, layer := range man.Layers {
+		if layer.Annotations[cosignSignatureAnnotation] == "" {
+			continue
+		}
+		payload, err := sc.Blob(ctx, nameInRegistry, layer.Digest)
+		if err != nil {
+			return fmt.Errorf("could not get signature payload of %s:%s: %v", nameInRegistry, tagName, err)
+		}
+		if err := verifyCosignSignature(payload, layer.Annotations, digest, policy); err != nil {
+			log.Debugf("Signature %s of %s:%s is not valid: %v", layer.Digest, nameInRegistry, tagName, err)
+			reasons = append(reasons, err.Error())
+			continue
+		}
+		return nil
+	}
+	if len(reasons) == 0 {
+		return endpoint.signatureError("%s:%s is not signed", nameInRegistry, tagName)
+	}
+	return endpoint.signatureError("signatures of %s:%s cannot be verified: %s", nameInRegistry, tagName, strings.Join(reasons, "; "))
+}
+
+// getSignatureResult returns the result of verifying the signatures with the
+// given key, or nil if it is not known. Results for images without a valid
+// signature are discarded after invalidSignatureTTL.
+func (endpoint *RegistryEndpoint) getSignatureResult(key string) *signatureResult {
+	endpoint.signatureLock.Lock()
+	defer endpoint.signatureLock.Unlock()
+	result, ok := endpoint.signatureResults[key]
+	if !ok {
+		return nil
+	}
+	if result.reason != "" && time.Since(result.verified) >= invalidSignatureTTL {
+		delete(endpoint.signatureResults, key)
+		return nil
+	}
+	result.used = time.Now()
+	c := *result
+	return &c
+}
+
+// setSignatureResult records the result of verifying the signatures with the
+// given key. If the endpoint already keeps maxSignatureResults results, the
+// least recently used one is evicted.
+func (endpoint *RegistryEndpoint) setSignatureResult(key, reason string) {
+	endpoint.signatureLock.Lock()
+	defer endpoint.signatureLock.Unlock()
+	if endpoint.signatureResults == nil {
+		endpoint.signatureResults = make(map[string]*signatureResult)
+	}
+	if _, ok := endpoint.signatureResults[key]; !ok && len(endpoint.signatureResults) >= maxSignatureResults {
+		oldest := ""
+		for k, r := range endpoint.signatureResults {
+			if oldest == "" || r.used.Before(endpoint.signatureResults[oldest].used) {
+				oldest = k
+			}
+		}
+		delete(endpoint.signatureResults, oldest)
+	}
+	now := time.Now()
+	endpoint.signatureResults[key] = &signatureResult{reason: reason, verified: now, used: now}
+}
+
+// signatureError returns an error of kind ErrNoValidSignature with the given
+// message
+func (endpoint *RegistryEndpoint) signatureError(format string, args ...interface{}) error {
+	return &RegistryError{Registry: endpoint.RegistryAPI, Err: fmt.Errorf(format, args...), kind: ErrNoValidSignature}
+}
+
+// SignatureVerifier returns a function for VersionConstraint.VerifyCandidate
+// that verifies the signature of a candidate tag of the image against policy.
+// The digest of the tag is taken from its meta data if known, and resolved
+// otherwise. Candidates without a valid signature are rejected with the
+// reason, while other errors, i.e. if the registry cannot be reached, are
+// returned.
+func (endpoint *RegistryEndpoint) SignatureVerifier(ctx context.Context, img *image.ContainerImage, regClient RegistryClient, policy *image.SignaturePolicy) func(*tag.ImageTag) (string, error) {
+	nameInRegistry := endpoint.nameInRegistry(img)
+	return func(t *tag.ImageTag) (string, error) {
+		digest := t.TagDigest
+		if digest == "" && t.TagInfo != nil {
+			digest = t.TagInfo.Digest
+		}
+		err := endpoint.verifySignature(ctx, nameInRegistry, t.TagName, digest, regClient, policy)
+		if errors.Is(err, ErrNoValidSignature) {
+			var regErr *RegistryError
+			if errors.As(err, &regErr) {
+				return regErr.Err.Error(), nil
+			}
+			return err.Error(), nil
+		}
+		return "", err
+	}
+}
+
+// withSignatureVerifier returns vc with the endpoint's SignatureVerifier
+// set, if vc requires a signature and has no verifier yet. Otherwise, vc is
+// returned as is.
+func (endpoint *RegistryEndpoint) withSignatureVerifier(ctx context.Context, img *image.ContainerImage, regClient RegistryClient, vc *image.VersionConstraint) *image.VersionConstraint {
+	if vc.RequireSignature == nil || vc.VerifyCandidate != nil {
+		return vc
+	}
+	verifying := *vc
+	verifying.VerifyCandidate = endpoint.SignatureVerifier(ctx, img, regClient, vc.RequireSignature)
+	return &verifying
+}
+
+// verifyCosignSignature verifies the signature payload of a cosign signature
+// layer with the given annotations against the image's digest and the policy
+func verifyCosignSignature(payloadData []byte, annotations map[string]string, digest string, policy *image.SignaturePolicy) error {
+	var simpleSigning payload.SimpleContainerImage
+	if err := json.Unmarshal(payloadData, &simpleSigning); err != nil {
+		return fmt.Errorf("invalid payload: %v", err)
+	}
+	if simpleSigning.Critical.Type != payload.CosignSignatureType {
+		return fmt.Errorf("unknown payload type %s", simpleSigning.Critical.Type)
+	}
+	if simpleSigning.Critical.Image.DockerManifestDigest != digest {
+		return fmt.Errorf("payload is for digest %s", simpleSigning.Critical.Image.DockerManifestDigest)
+	}
+	sig, err := base64.StdEncoding.DecodeString(annotations[cosignSignatureAnnotation])
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+
+	if !policy.Keyless() {
+		pub, err := cryptoutils.UnmarshalPEMToPublicKey(policy.PublicKey)
+		if err != nil {
+			return fmt.Errorf("invalid public key: %v", err)
+		}
+		return verifyPayload(pub, payloadData, sig)
+	}
+	return verifyKeyless(payloadData, sig, annotations, policy)
+}
+
+// verifyKeyless verifies a signature using the certificate it was made with.
+// The certificate must have been valid when the signature was recorded in the
+// transparency log, which is proven by the log's signed entry timestamp.
+func verifyKeyless(payload, sig []byte, annotations map[string]string, policy *image.SignaturePolicy) error {
+	if policy.Identity == "" || len(policy.Roots) == 0 || len(policy.RekorPublicKey) == 0 {
+		return fmt.Errorf("signature policy has neither a public key nor trust roots")
+	}
+	certs, err := cryptoutils.UnmarshalCertificatesFromPEM([]byte(annotations[cosignCertificateAnnotation]))
+	if err != nil || len(certs) == 0 {
+		return fmt.Errorf("invalid signing certificate: %v", err)
+	}
+	cert := certs[0]
+	integratedTime, err := verifyBundle([]byte(annotations[cosignBundleAnnotation]), payload, sig, policy.RekorPublicKey)
+	if err != nil {
+		return fmt.Errorf("invalid transparency log bundle: %v", err)
+	}
+
+	rootCerts, err := cryptoutils.UnmarshalCertificatesFromPEM(policy.Roots)
+	if err != nil || len(rootCerts) == 0 {
+		return fmt.Errorf("no valid root certificates configured")
+	}
+	roots := x509.NewCertPool()
+	for _, c := range rootCerts {
+		roots.AddCert(c)
+	}
+	intermediates := x509.NewCertPool()
+	if chain, err := cryptoutils.UnmarshalCertificatesFromPEM([]byte(annotations[cosignChainAnnotation])); err == nil {
+		for _, c := range chain {
+			intermediates.AddCert(c)
+		}
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   integratedTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return fmt.Errorf("untrusted signing certificate: %v", err)
+	}
+	if !certificateHasIdentity(cert, policy.Identity) {
+		return fmt.Errorf("signing certificate is not issued to %s", policy.Identity)
+	}
+	if issuer := certificateIssuer(cert); issuer != policy.Issuer {
+		return fmt.Errorf("signing certificate is issued by %s, not %s", issuer, policy.Issuer)
+	}
+	return verifyPayload(cert.PublicKey, payload, sig)
+}
+
+// verifyBundle verifies the signed entry timestamp of the transparency log
+// in the bundle, and that the log entry is for the given payload and
+// signature. Returns the time the entry has been recorded.
+func verifyBundle(data, payload, sig, rekorKey []byte) (time.Time, error) {
+	if len(data) == 0 {
+		return time.Time{}, fmt.Errorf("signature has no bundle")
+	}
+	var bundle struct {
+		SignedEntryTimestamp []byte `json:"SignedEntryTimestamp"`
+		Payload              struct {
+			Body           string `json:"body"`
+			IntegratedTime int64  `json:"integratedTime"`
+			LogID          string `json:"logID"`
+			LogIndex       int64  `json:"logIndex"`
+		} `json:"Payload"`
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return time.Time{}, err
+	}
+
+	// The timestamp signs the canonical JSON of the payload, whose keys are
+	// sorted as in the struct above
+	canonical := &bytes.Buffer{}
+	enc := json.NewEncoder(canonical)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(bundle.Payload); err != nil {
+		return time.Time{}, err
+	}
+	pub, err := cryptoutils.UnmarshalPEMToPublicKey(rekorKey)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid transparency log key: %v", err)
+	}
+	if err := verifyPayload(pub, bytes.TrimSuffix(canonical.Bytes(), []byte("\n")), bundle.SignedEntryTimestamp); err != nil {
+		return time.Time{}, fmt.Errorf("signed entry timestamp: %v", err)
+	}
+
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid entry body: %v", err)
+	}
+	var entry struct {
+		Spec struct {
+			Data struct {
+				Hash struct {
+					Algorithm string `json:"algorithm"`
+					Value     string `json:"value"`
+				} `json:"hash"`
+			} `json:"data"`
+			Signature struct {
+				Content []byte `json:"content"`
+			} `json:"signature"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, fmt.Errorf("invalid entry body: %v", err)
+	}
+	sum := sha256.Sum256(payload)
+	if entry.Spec.Data.Hash.Algorithm != "sha256" || entry.Spec.Data.Hash.Value != hex.EncodeToString(sum[:]) {
+		return time.Time{}, fmt.Errorf("log entry is not for the signed payload")
+	}
+	if !bytes.Equal(entry.Spec.Signature.Content, sig) {
+		return time.Time{}, fmt.Errorf("log entry is not for the signature")
+	}
+	return time.Unix(bundle.Payload.IntegratedTime, 0), nil
+}
+
+// verifyPayload verifies the signature of payload, which is made over its
+// SHA-256 digest
+func verifyPayload(pub crypto.PublicKey, payload, sig []byte) error {
+	verifier, err := signature.LoadVerifier(pub, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	if err := verifier.VerifySignature(bytes.NewReader(sig), bytes.NewReader(payload)); err != nil {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+// certificateHasIdentity returns true if the certificate is issued to the
+// given identity, i.e. an email address or URI
+func certificateHasIdentity(cert *x509.Certificate, identity string) bool {
+	for _, name := range cryptoutils.GetSubjectAlternateNames(cert) {
+		if name == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// certificateIssuer returns the OIDC issuer recorded in a Fulcio certificate
+func certificateIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(fulcioIssuerV2OID) {
+			var issuer string
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &issuer, "utf8"); err == nil {
+				return issuer
+			}
+		}
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(fulcioIssuerOID) {
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,430 @@
+package registry
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signedRegistry serves tags of the image foo/bar along with their cosign
+// signatures
+type signedRegistry struct {
+	lock       sync.Mutex
+	digests    map[string]string
+	signatures map[string][]byte
+	blobs      map[string][]byte
+}
+
+func newSignedRegistry() *signedRegistry {
+	return &signedRegistry{digests: map[string]string{}, signatures: map[string][]byte{}, blobs: map[string][]byte{}}
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// addTag adds a tag pointing to a digest derived from its name, and returns
+// the digest
+func (sr *signedRegistry) addTag(name string) string {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	digest := sha256Digest([]byte(name))
+	sr.digests[name] = digest
+	return digest
+}
+
+// addSignature adds a signature layer with the given payload and annotations
+// for the given digest
+func (sr *signedRegistry) addSignature(digest string, payload []byte, annotations map[string]string) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	blobDigest := sha256Digest(payload)
+	sr.blobs[blobDigest] = payload
+	man, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestMediaType,
+		"layers": []map[string]interface{}{{
+			"mediaType":   "application/vnd.dev.cosign.simplesigning.v1+json",
+			"digest":      blobDigest,
+			"size":        len(payload),
+			"annotations": annotations,
+		}},
+	})
+	sr.signatures[signatureTag(digest)] = man
+}
+
+func (sr *signedRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/v2/foo/bar/")
+	switch {
+	case r.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case path == "tags/list":
+		tags := []string{}
+		for t := range sr.digests {
+			tags = append(tags, t)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": "foo/bar", "tags": tags})
+	case strings.HasPrefix(path, "manifests/"):
+		ref := strings.TrimPrefix(path, "manifests/")
+		if man, ok := sr.signatures[ref]; ok {
+			w.Header().Set("Content-Type", ociManifestMediaType)
+			w.Header().Set("Docker-Content-Digest", sha256Digest(man))
+			w.Write(man)
+			return
+		}
+		digest, ok := sr.digests[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", ociManifestMediaType)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Write([]byte(ref))
+	case strings.HasPrefix(path, "blobs/"):
+		blob, ok := sr.blobs[strings.TrimPrefix(path, "blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(blob)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func cosignPayload(digest string) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"example.com/foo/bar"},"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":null}`, digest))
+}
+
+func signData(t *testing.T, key crypto.Signer, data []byte) []byte {
+	sum := sha256.Sum256(data)
+	sig, err := key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	require.NoError(t, err)
+	return sig
+}
+
+func newECDSAKey(t *testing.T) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// keylessSigner issues signing certificates and records signatures in a
+// transparency log, like Fulcio and Rekor do
+type keylessSigner struct {
+	caKey    *ecdsa.PrivateKey
+	caCert   *x509.Certificate
+	rootsPEM []byte
+	rekorKey *ecdsa.PrivateKey
+	rekorPEM []byte
+}
+
+func newKeylessSigner(t *testing.T) *keylessSigner {
+	caKey, _ := newECDSAKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, caKey.Public(), caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	rekorKey, rekorPEM := newECDSAKey(t)
+	return &keylessSigner{
+		caKey:    caKey,
+		caCert:   caCert,
+		rootsPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		rekorKey: rekorKey,
+		rekorPEM: rekorPEM,
+	}
+}
+
+// sign signs the payload with a certificate issued to identity by issuer,
+// which is valid around notBefore, and returns the annotations of the
+// signature layer
+func (ks *keylessSigner) sign(t *testing.T, payload []byte, identity, issuer string, notBefore time.Time) map[string]string {
+	key, _ := newECDSAKey(t)
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       notBefore,
+		NotAfter:        notBefore.Add(10 * time.Minute),
+		EmailAddresses:  []string{identity},
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		ExtraExtensions: []pkix.Extension{{Id: fulcioIssuerOID, Value: []byte(issuer)}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ks.caCert, key.Public(), ks.caKey)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	sig := signData(t, key, payload)
+
+	sum := sha256.Sum256(payload)
+	body, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": "0.0.1",
+		"kind":       "hashedrekord",
+		"spec": map[string]interface{}{
+			"data":      map[string]interface{}{"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(sum[:])}},
+			"signature": map[string]interface{}{"content": sig, "publicKey": map[string]interface{}{"content": certPEM}},
+		},
+	})
+	entry := map[string]interface{}{
+		"body":           base64.StdEncoding.EncodeToString(body),
+		"integratedTime": time.Now().Unix(),
+		"logID":          "c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d",
+		"logIndex":       42,
+	}
+	canonical, _ := json.Marshal(entry)
+	bundle, _ := json.Marshal(map[string]interface{}{
+		"SignedEntryTimestamp": signData(t, ks.rekorKey, canonical),
+		"Payload":              entry,
+	})
+	return map[string]string{
+		cosignSignatureAnnotation:   base64.StdEncoding.EncodeToString(sig),
+		cosignCertificateAnnotation: string(certPEM),
+		cosignChainAnnotation:       string(ks.rootsPEM),
+		cosignBundleAnnotation:      string(bundle),
+	}
+}
+
+func Test_VerifySignature(t *testing.T) {
+	sr := newSignedRegistry()
+	srv := httptest.NewServer(sr)
+	defer srv.Close()
+	ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+	client, err := NewClient(ep, "", "")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+
+	key, keyPEM := newECDSAKey(t)
+	_, otherPEM := newECDSAKey(t)
+	keyPolicy := &image.SignaturePolicy{PublicKey: keyPEM}
+
+	t.Run("Valid signature made with key", func(t *testing.T) {
+		digest := sr.addTag("signed")
+		payload := cosignPayload(digest)
+		sr.addSignature(digest, payload, map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signData(t, key, payload))})
+		err := ep.VerifySignature(context.Background(), img, "signed", digest, client, keyPolicy)
+		require.NoError(t, err)
+		// The digest is resolved if not given
+		err = ep.VerifySignature(context.Background(), img, "signed", "", client, keyPolicy)
+		require.NoError(t, err)
+	})
+
+	t.Run("Signature made with other key", func(t *testing.T) {
+		digest := sr.addTag("other-key")
+		payload := cosignPayload(digest)
+		sr.addSignature(digest, payload, map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signData(t, key, payload))})
+		err := ep.VerifySignature(context.Background(), img, "other-key", digest, client, &image.SignaturePolicy{PublicKey: otherPEM})
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrNoValidSignature))
+		assert.Contains(t, err.Error(), "signature does not match")
+	})
+
+	t.Run("Unsigned image", func(t *testing.T) {
+		digest := sr.addTag("unsigned")
+		err := ep.VerifySignature(context.Background(), img, "unsigned", digest, client, keyPolicy)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrNoValidSignature))
+		assert.Contains(t, err.Error(), "is not signed")
+	})
+
+	t.Run("Signature of other image", func(t *testing.T) {
+		digest := sr.addTag("copied")
+		payload := cosignPayload(sha256Digest([]byte("other")))
+		sr.addSignature(digest, payload, map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signData(t, key, payload))})
+		err := ep.VerifySignature(context.Background(), img, "copied", digest, client, keyPolicy)
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrNoValidSignature))
+		assert.Contains(t, err.Error(), "payload is for digest")
+	})
+
+	t.Run("Empty policy is never satisfied", func(t *testing.T) {
+		digest := sr.addTag("empty-policy")
+		payload := cosignPayload(digest)
+		sr.addSignature(digest, payload, map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signData(t, key, payload))})
+		err := ep.VerifySignature(context.Background(), img, "empty-policy", digest, client, &image.SignaturePolicy{})
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrNoValidSignature))
+	})
+
+	ks := newKeylessSigner(t)
+	keylessPolicy := &image.SignaturePolicy{Identity: "dev@example.com", Issuer: "https://issuer.example.com", Roots: ks.rootsPEM, RekorPublicKey: ks.rekorPEM}
+
+	t.Run("Valid keyless signature", func(t *testing.T) {
+		digest := sr.addTag("keyless")
+		payload := cosignPayload(digest)
+		sr.addSignature(digest, payload, ks.sign(t, payload, "dev@example.com", "https://issuer.example.com", time.Now().Add(-time.Minute)))
+		err := ep.VerifySignature(context.Background(), img, "keyless", digest, client, keylessPolicy)
+		require.NoError(t, err)
+	})
+
+	t.Run("Keyless signature of other identity", func(t *testing.T) {
+		digest := sr.addTag("keyless-identity")
+		payload := cosignPayload(digest)
+		sr.addSignature(digest, payload, ks.sign(t, payload, "mallory@example.com", "https://issuer.example.com", time.Now().Add(-time.Minute)))
+		err := ep.VerifySignature(context.Background(), img, "keyless-identity", digest, client, keylessPolicy)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not issued to dev@example.com")
+	})
+
+	t.Run("Keyless signature of other issuer", func(t *testing.T) {
+		digest := sr.addTag("keyless-issuer")
+		payload := cosignPayload(digest)
+		sr.addSignature(digest, payload, ks.sign(t, payload, "dev@example.com", "https://other.example.com", time.Now().Add(-time.Minute)))
+		err := ep.VerifySignature(context.Background(), img, "keyless-issuer", digest, client, keylessPolicy)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "issued by https://other.example.com")
+	})
+
+	t.Run("Keyless signature recorded after certificate expired", func(t *testing.T) {
+		digest := sr.addTag("keyless-expired")
+		payload := cosignPayload(digest)
+		sr.addSignature(digest, payload, ks.sign(t, payload, "dev@example.com", "https://issuer.example.com", time.Now().Add(-30*time.Minute)))
+		err := ep.VerifySignature(context.Background(), img, "keyless-expired", digest, client, keylessPolicy)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "untrusted signing certificate")
+	})
+
+	t.Run("Keyless signature with forged log entry", func(t *testing.T) {
+		digest := sr.addTag("keyless-forged")
+		payload := cosignPayload(digest)
+		annotations := ks.sign(t, payload, "dev@example.com", "https://issuer.example.com", time.Now().Add(-time.Minute))
+		policy := *keylessPolicy
+		_, policy.RekorPublicKey = newECDSAKey(t)
+		sr.addSignature(digest, payload, annotations)
+		err := ep.VerifySignature(context.Background(), img, "keyless-forged", digest, client, &policy)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "signed entry timestamp")
+	})
+
+	t.Run("Keyless signature from untrusted CA", func(t *testing.T) {
+		digest := sr.addTag("keyless-untrusted")
+		payload := cosignPayload(digest)
+		sr.addSignature(digest, payload, ks.sign(t, payload, "dev@example.com", "https://issuer.example.com", time.Now().Add(-time.Minute)))
+		policy := *keylessPolicy
+		policy.Roots = newKeylessSigner(t).rootsPEM
+		err := ep.VerifySignature(context.Background(), img, "keyless-untrusted", digest, client, &policy)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "untrusted signing certificate")
+	})
+}
+
+func Test_SelectRequireSignature(t *testing.T) {
+	sr := newSignedRegistry()
+	srv := httptest.NewServer(sr)
+	defer srv.Close()
+	ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+	client, err := NewClient(ep, "", "")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("example.com/foo/bar:0.9")
+
+	key, keyPEM := newECDSAKey(t)
+	otherKey, _ := newECDSAKey(t)
+	for name, signer := range map[string]*ecdsa.PrivateKey{"0.9": nil, "1.0": key, "1.1": nil, "1.2": otherKey} {
+		digest := sr.addTag(name)
+		if signer != nil {
+			payload := cosignPayload(digest)
+			sr.addSignature(digest, payload, map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signData(t, signer, payload))})
+		}
+	}
+
+	policy := &image.SignaturePolicy{PublicKey: keyPEM}
+	vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, RequireSignature: policy, Explain: true}
+
+	t.Run("Tags are not filtered by signature", func(t *testing.T) {
+		tl, err := ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"0.9", "1.0", "1.1", "1.2"}, tl.Tags())
+	})
+
+	t.Run("Selection requires a verifier", func(t *testing.T) {
+		tl, err := ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		_, err = img.SelectVersionFromTags(vc, tl)
+		assert.Error(t, err)
+	})
+
+	t.Run("Newest tag with valid signature is selected", func(t *testing.T) {
+		tl, err := ep.GetTags(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		verifying := *vc
+		verifying.VerifyCandidate = ep.SignatureVerifier(context.Background(), img, client, policy)
+		selection, err := img.SelectVersionFromTags(&verifying, tl)
+		require.NoError(t, err)
+		require.NotNil(t, selection.Selected)
+		assert.Equal(t, "1.0", selection.Selected.TagName)
+		assert.Contains(t, selection.Excluded["1.1"], "signature: ")
+		assert.Contains(t, selection.Excluded["1.1"], "is not signed")
+		assert.Contains(t, selection.Excluded["1.2"], "signature does not match")
+		// Tags older than the selected one are never verified
+		assert.NotContains(t, selection.Excluded, "0.9")
+		assert.Nil(t, ep.getSignatureResult(policy.Key()+"|foo/bar@"+sha256Digest([]byte("0.9"))))
+	})
+
+	t.Run("Invalid signatures are remembered by digest", func(t *testing.T) {
+		digest := sha256Digest([]byte("1.2"))
+		result := ep.getSignatureResult(policy.Key() + "|foo/bar@" + digest)
+		require.NotNil(t, result)
+		assert.Contains(t, result.reason, "signature does not match")
+
+		// Signing the image with the right key is picked up once the result
+		// has expired
+		payload := cosignPayload(digest)
+		sr.addSignature(digest, payload, map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signData(t, key, payload))})
+		assert.Error(t, ep.VerifySignature(context.Background(), img, "1.2", digest, client, policy))
+		ep.signatureLock.Lock()
+		ep.signatureResults[policy.Key()+"|foo/bar@"+digest].verified = time.Now().Add(-invalidSignatureTTL)
+		ep.signatureLock.Unlock()
+		assert.NoError(t, ep.VerifySignature(context.Background(), img, "1.2", digest, client, policy))
+	})
+}
+
+func Test_SignatureResultsBounded(t *testing.T) {
+	ep := newRegistryEndpoint("example.com", "Example", "https://example.com", "", "", false, SortUnsorted, 0, 0)
+	for i := 0; i < maxSignatureResults; i++ {
+		ep.setSignatureResult(fmt.Sprintf("key%d", i), "")
+	}
+	// Using the first result keeps it from being evicted
+	ep.signatureLock.Lock()
+	ep.signatureResults["key1"].used = time.Now().Add(-time.Hour)
+	ep.signatureResults["key0"].used = time.Now().Add(time.Hour)
+	ep.signatureLock.Unlock()
+	ep.setSignatureResult("new", "not signed")
+	assert.Len(t, ep.signatureResults, maxSignatureResults)
+	assert.NotNil(t, ep.getSignatureResult("key0"))
+	assert.Nil(t, ep.getSignatureResult("key1"))
+	assert.NotNil(t, ep.getSignatureResult("new"))
+}
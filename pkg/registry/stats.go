@@ -0,0 +1,199 @@
+package registry
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+// CycleStats holds statistics about the access to registries during an update
+// cycle
+type CycleStats struct {
+	CacheHits      int64
+	CacheMisses    int64
+	RateLimitWaits int64
+	RateLimitDelay time.Duration
+}
+
+// Counters for the current cycle, must only be accessed atomically
+var cycleCacheHits, cycleCacheMisses, cycleRateLimitWaits, cycleRateLimitDelay int64
+
+// Waits on the rate limiter shorter than this are not counted
+const rateLimitWaitThreshold = time.Millisecond
+
+// CacheHitRatio returns the ratio of tag metadata lookups that were served
+// from the cache, or 0 if there were no lookups.
+func (cs CycleStats) CacheHitRatio() float64 {
+	total := cs.CacheHits + cs.CacheMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(cs.CacheHits) / float64(total)
+}
+
+// TakeCycleStats returns the statistics gathered since the last call, and
+// starts gathering new statistics.
+func TakeCycleStats() CycleStats {
+	return CycleStats{
+		CacheHits:      atomic.SwapInt64(&cycleCacheHits, 0),
+		CacheMisses:    atomic.SwapInt64(&cycleCacheMisses, 0),
+		RateLimitWaits: atomic.SwapInt64(&cycleRateLimitWaits, 0),
+		RateLimitDelay: time.Duration(atomic.SwapInt64(&cycleRateLimitDelay, 0)),
+	}
+}
+
+func recordCacheLookup(registryAPI string, hit bool) {
+	getMetrics().CacheLookup(registryAPI, hit)
+	if hit {
+		atomic.AddInt64(&cycleCacheHits, 1)
+	} else {
+		atomic.AddInt64(&cycleCacheMisses, 1)
+	}
+}
+
+func recordRateLimitWait(waited time.Duration) {
+	if waited < rateLimitWaitThreshold {
+		return
+	}
+	atomic.AddInt64(&cycleRateLimitWaits, 1)
+	atomic.AddInt64(&cycleRateLimitDelay, int64(waited))
+}
+
+// ScanSource is where the tags resulting from a scan of an image's tags came
+// from
+type ScanSource string
+
+const (
+	// The tag list was fetched from the registry and filtered
+	ScanFromRegistry ScanSource = "registry"
+	// The negative cache recorded that no tags match the constraint
+	ScanFromNegativeCache ScanSource = "negative-cache"
+	// The tag list has not changed, and the tags that resulted from it
+	// before were reused
+	ScanFromUnchangedTagList ScanSource = "unchanged-tag-list"
+	// The circuit of the endpoint is open, and the tags that last resulted
+	// were returned
+	ScanFromLastKnown ScanSource = "last-known"
+	// The result of a concurrent scan of the same image was shared
+	ScanFromSharedFetch ScanSource = "shared"
+)
+
+// ScanStats holds statistics about how the result of a scan of an image's
+// tags was produced
+type ScanStats struct {
+	// Where the resulting tags came from
+	Source ScanSource
+	// Number of HTTP requests sent to the registry, excluding requests for
+	// tokens. Requests sent for a shared scan are only counted for the caller
+	// that started it.
+	Requests int64
+	// Number of lookups of tag meta data that were served from the cache,
+	// and that were not
+	CacheHits   int64
+	CacheMisses int64
+	// Number of resulting tags whose meta data was read from a manifest of
+	// each schema, i.e. "schema2" or "oci"
+	Schemas map[string]int
+	// Number of resulting tags
+	Tags int
+	// How long the scan took
+	Duration time.Duration
+}
+
+// FromCache returns whether the resulting tags came from a cache, without
+// the tag list being filtered
+func (ss *ScanStats) FromCache() bool {
+	switch ss.Source {
+	case ScanFromNegativeCache, ScanFromUnchangedTagList, ScanFromLastKnown:
+		return true
+	default:
+		return false
+	}
+}
+
+// scanCollector gathers the statistics of a scan, while it is passed along in
+// the scan's context
+type scanCollector struct {
+	lock        sync.Mutex
+	source      ScanSource
+	requests    int64
+	cacheHits   int64
+	cacheMisses int64
+}
+
+// scanCollectorKey is the key of the context value holding the scanCollector
+type scanCollectorKey struct{}
+
+// scanCollectorFrom returns the collector of the scan the given context
+// belongs to, or nil if none is collecting statistics
+func scanCollectorFrom(ctx context.Context) *scanCollector {
+	sc, _ := ctx.Value(scanCollectorKey{}).(*scanCollector)
+	return sc
+}
+
+// setSource records where the tags resulting from the scan came from
+func (sc *scanCollector) setSource(source ScanSource) {
+	if sc == nil {
+		return
+	}
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	sc.source = source
+}
+
+// countRequest counts a request sent to the registry
+func (sc *scanCollector) countRequest() {
+	if sc != nil {
+		atomic.AddInt64(&sc.requests, 1)
+	}
+}
+
+// recordScanCacheLookup records a lookup in the cache for the metrics, the
+// cycle statistics and the statistics of the scan ctx belongs to
+func recordScanCacheLookup(ctx context.Context, registryAPI string, hit bool) {
+	recordCacheLookup(registryAPI, hit)
+	sc := scanCollectorFrom(ctx)
+	if sc == nil {
+		return
+	}
+	if hit {
+		atomic.AddInt64(&sc.cacheHits, 1)
+	} else {
+		atomic.AddInt64(&sc.cacheMisses, 1)
+	}
+}
+
+// GetTagsWithStats returns a list of available tags for the given image just
+// like GetTags, along with statistics about how the list was produced.
+// Statistics are returned even if fetching the tags failed.
+func (endpoint *RegistryEndpoint) GetTagsWithStats(ctx context.Context, img *image.ContainerImage, regClient RegistryClient, vc *image.VersionConstraint) (*tag.ImageTagList, *ScanStats, error) {
+	sc := &scanCollector{source: ScanFromRegistry}
+	start := time.Now()
+	tagList, err := endpoint.GetTags(context.WithValue(ctx, scanCollectorKey{}, sc), img, regClient, vc)
+
+	sc.lock.Lock()
+	stats := &ScanStats{
+		Source:      sc.source,
+		Requests:    atomic.LoadInt64(&sc.requests),
+		CacheHits:   atomic.LoadInt64(&sc.cacheHits),
+		CacheMisses: atomic.LoadInt64(&sc.cacheMisses),
+		Schemas:     map[string]int{},
+		Duration:    time.Since(start),
+	}
+	sc.lock.Unlock()
+	if tagList != nil {
+		for _, t := range tagList.Tags() {
+			stats.Tags++
+			if it := tagList.Get(t); it != nil && it.TagInfo != nil && it.TagInfo.Schema != "" {
+				stats.Schemas[it.TagInfo.Schema]++
+			}
+		}
+	}
+	log.Debugf("Scanned tags of %s from %s in %s: %d tags, %d requests", img.GetFullNameWithoutTag(), stats.Source, stats.Duration, stats.Tags, stats.Requests)
+	return tagList, stats, err
+}
@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_CycleStats(t *testing.T) {
+	t.Run("Take statistics and reset", func(t *testing.T) {
+		TakeCycleStats()
+		recordCacheLookup("https://registry.example.com", true)
+		recordCacheLookup("https://registry.example.com", true)
+		recordCacheLookup("https://registry.example.com", true)
+		recordCacheLookup("https://registry.example.com", false)
+		recordRateLimitWait(time.Microsecond)
+		recordRateLimitWait(50 * time.Millisecond)
+		stats := TakeCycleStats()
+		assert.Equal(t, int64(3), stats.CacheHits)
+		assert.Equal(t, int64(1), stats.CacheMisses)
+		assert.Equal(t, 0.75, stats.CacheHitRatio())
+		assert.Equal(t, int64(1), stats.RateLimitWaits)
+		assert.Equal(t, 50*time.Millisecond, stats.RateLimitDelay)
+		assert.Equal(t, CycleStats{}, TakeCycleStats())
+	})
+	t.Run("Cache hit ratio without lookups", func(t *testing.T) {
+		assert.Equal(t, float64(0), CycleStats{}.CacheHitRatio())
+	})
+}
+
+func Test_GetTagsWithStats(t *testing.T) {
+	or := newOCIRegistry()
+	or.addImage("1.0", time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC), ociManifestMediaType)
+	or.addImage("1.1", time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC), ociManifestMediaType)
+	srv := httptest.NewServer(or)
+	defer srv.Close()
+	ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+	ep.NegativeCacheTTL = time.Hour
+	client, err := NewClient(ep, "", "")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("example.com/foo/bar:1.0")
+	vc := &image.VersionConstraint{SortMode: image.VersionSortLatest}
+
+	t.Run("Tags fetched from the registry", func(t *testing.T) {
+		tl, stats, err := ep.GetTagsWithStats(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		assert.Len(t, tl.Tags(), 2)
+		assert.Equal(t, ScanFromRegistry, stats.Source)
+		assert.False(t, stats.FromCache())
+		assert.Equal(t, 2, stats.Tags)
+		assert.Equal(t, map[string]int{"oci": 2}, stats.Schemas)
+		assert.Equal(t, int64(0), stats.CacheHits)
+		assert.Equal(t, int64(2), stats.CacheMisses)
+		// The tag list, and a manifest and config for each tag
+		assert.True(t, stats.Requests >= 5, "%d requests", stats.Requests)
+		assert.True(t, stats.Duration > 0)
+	})
+
+	t.Run("Meta data of tags found in cache", func(t *testing.T) {
+		_, stats, err := ep.GetTagsWithStats(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		assert.Equal(t, ScanFromRegistry, stats.Source)
+		assert.Equal(t, int64(2), stats.CacheHits)
+		assert.Equal(t, int64(0), stats.CacheMisses)
+		assert.Equal(t, int64(1), stats.Requests)
+	})
+
+	t.Run("No matching tags found in negative cache", func(t *testing.T) {
+		vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer, Constraint: "~2.0"}
+		_, stats, err := ep.GetTagsWithStats(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		assert.Equal(t, ScanFromRegistry, stats.Source)
+		assert.Equal(t, 0, stats.Tags)
+
+		_, stats, err = ep.GetTagsWithStats(context.Background(), img, client, vc)
+		require.NoError(t, err)
+		assert.Equal(t, ScanFromNegativeCache, stats.Source)
+		assert.True(t, stats.FromCache())
+		assert.Equal(t, int64(0), stats.Requests)
+	})
+}
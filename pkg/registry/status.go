@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+
+	"github.com/Masterminds/semver"
+)
+
+// UpdateStatusReason is the reason for the result of checking an image for
+// updates
+type UpdateStatusReason string
+
+const (
+	// UpdateStatusUpToDate means the image already runs the selected version
+	UpdateStatusUpToDate UpdateStatusReason = "UpToDate"
+	// UpdateStatusUpdateAvailable means a newer version has been selected
+	UpdateStatusUpdateAvailable UpdateStatusReason = "UpdateAvailable"
+	// UpdateStatusNoCandidates means no tag was eligible for update
+	UpdateStatusNoCandidates UpdateStatusReason = "NoCandidates"
+	// UpdateStatusError means the image could not be checked for updates
+	UpdateStatusError UpdateStatusReason = "Error"
+)
+
+// ImageUpdateStatus is the result of checking a single image for updates, in
+// a form that can be written to the status of a Kubernetes resource.
+type ImageUpdateStatus struct {
+	// Image is the name of the image, without tag
+	Image string `json:"image"`
+	// Current is the tag the image is currently running
+	Current string `json:"current,omitempty"`
+	// Selected is the tag that has been selected for update
+	Selected string `json:"selected,omitempty"`
+	// Candidates are all tags that were eligible for update, from lowest to
+	// highest
+	Candidates []string `json:"candidates,omitempty"`
+	// AvailableHigher is the number of candidates that rank above the
+	// current tag
+	AvailableHigher int `json:"availableHigher"`
+	// LastChecked is the time the image has been checked
+	LastChecked time.Time `json:"lastChecked"`
+	// Reason is a machine readable reason for the status
+	Reason UpdateStatusReason `json:"reason"`
+	// Message is a human readable description of the status
+	Message string `json:"message,omitempty"`
+	// Pinned is true if the image is pinned to a digest, in which case it is
+	// never updated and Selected is the version it would be updated to
+	Pinned bool `json:"pinned,omitempty"`
+	// Digest is the digest the image is pinned to
+	Digest string `json:"digest,omitempty"`
+}
+
+// NewImageUpdateStatus populates an ImageUpdateStatus for img from the given
+// selection, which has been made at checked. If err is not nil, the status
+// records the error instead, and selection may be nil.
+func NewImageUpdateStatus(img *image.ContainerImage, selection *image.VersionSelection, checked time.Time, err error) *ImageUpdateStatus {
+	status := &ImageUpdateStatus{
+		Image:       img.GetFullNameWithoutTag(),
+		LastChecked: checked,
+	}
+	if img.ImageTag != nil {
+		status.Current = img.ImageTag.TagName
+	}
+	if img.IsDigestPinned() {
+		status.Pinned = true
+		status.Digest = img.ImageTag.TagDigest
+	}
+
+	if err != nil {
+		status.Reason = UpdateStatusError
+		status.Message = err.Error()
+		return status
+	}
+
+	for _, t := range selection.Candidates {
+		status.Candidates = append(status.Candidates, t.TagName)
+	}
+	status.AvailableHigher = countHigher(status.Current, status.Candidates)
+
+	switch {
+	case len(status.Candidates) == 0 || selection.Selected == nil:
+		status.Reason = UpdateStatusNoCandidates
+		status.Message = "no tag is eligible for update"
+	case selection.Selected.TagName == status.Current && (selection.Selected.TagDigest == "" || (img.ImageTag != nil && img.ImageTag.TagDigest == selection.Selected.TagDigest)):
+		status.Selected = selection.Selected.TagName
+		status.Reason = UpdateStatusUpToDate
+		status.Message = "image is running the selected version"
+	default:
+		status.Selected = selection.Selected.TagName
+		status.Reason = UpdateStatusUpdateAvailable
+		status.Message = "image can be updated to " + status.Selected
+		if status.Pinned {
+			status.Message = "image is pinned to a digest, newest version is " + status.Selected
+		}
+	}
+	return status
+}
+
+// countHigher returns the number of candidates that rank above current. If
+// current is not a candidate itself, it is compared to the candidates as a
+// semantic version if possible, and otherwise all candidates are counted.
+func countHigher(current string, candidates []string) int {
+	for i, c := range candidates {
+		if c == current {
+			return len(candidates) - i - 1
+		}
+	}
+	curVer, err := semver.NewVersion(current)
+	if err != nil {
+		return len(candidates)
+	}
+	higher := 0
+	for _, c := range candidates {
+		if ver, err := semver.NewVersion(c); err == nil && ver.GreaterThan(curVer) {
+			higher += 1
+		}
+	}
+	return higher
+}
@@ -0,0 +1,95 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_NewImageUpdateStatus(t *testing.T) {
+	checked := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	newSelection := func(selected string, candidates ...string) *image.VersionSelection {
+		selection := &image.VersionSelection{}
+		for _, c := range candidates {
+			selection.Candidates = append(selection.Candidates, tag.NewImageTag(c, time.Unix(0, 0)))
+		}
+		if selected != "" {
+			selection.Selected = tag.NewImageTag(selected, time.Unix(0, 0))
+		}
+		return selection
+	}
+
+	t.Run("Update available", func(t *testing.T) {
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0.0")
+		status := NewImageUpdateStatus(img, newSelection("1.2.0", "1.0.0", "1.1.0", "1.2.0"), checked, nil)
+		assert.Equal(t, "example.com/foo/bar", status.Image)
+		assert.Equal(t, "1.0.0", status.Current)
+		assert.Equal(t, "1.2.0", status.Selected)
+		assert.Equal(t, []string{"1.0.0", "1.1.0", "1.2.0"}, status.Candidates)
+		assert.Equal(t, 2, status.AvailableHigher)
+		assert.Equal(t, UpdateStatusUpdateAvailable, status.Reason)
+		assert.Equal(t, checked, status.LastChecked)
+	})
+
+	t.Run("Up to date", func(t *testing.T) {
+		img := image.NewFromIdentifier("example.com/foo/bar:1.2.0")
+		status := NewImageUpdateStatus(img, newSelection("1.2.0", "1.1.0", "1.2.0"), checked, nil)
+		assert.Equal(t, 0, status.AvailableHigher)
+		assert.Equal(t, UpdateStatusUpToDate, status.Reason)
+	})
+
+	t.Run("Current version is not a candidate", func(t *testing.T) {
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0.5")
+		status := NewImageUpdateStatus(img, newSelection("1.2.0", "1.0.0", "1.1.0", "1.2.0"), checked, nil)
+		assert.Equal(t, 2, status.AvailableHigher)
+	})
+
+	t.Run("No candidates", func(t *testing.T) {
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0.0")
+		status := NewImageUpdateStatus(img, newSelection("1.0.0"), checked, nil)
+		assert.Equal(t, UpdateStatusNoCandidates, status.Reason)
+		assert.Empty(t, status.Selected)
+	})
+
+	t.Run("Pinned to digest", func(t *testing.T) {
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0.0@sha256:abc")
+		status := NewImageUpdateStatus(img, newSelection("1.2.0", "1.0.0", "1.1.0", "1.2.0"), checked, nil)
+		assert.True(t, status.Pinned)
+		assert.Equal(t, "sha256:abc", status.Digest)
+		assert.Equal(t, "1.2.0", status.Selected)
+		assert.Equal(t, 2, status.AvailableHigher)
+		assert.Equal(t, "image is pinned to a digest, newest version is 1.2.0", status.Message)
+	})
+
+	t.Run("Digest of tracked tag changed", func(t *testing.T) {
+		img := image.NewFromIdentifier("example.com/foo/bar:stable")
+		img.ImageTag.TagDigest = "sha256:old"
+		selection := newSelection("stable", "stable")
+		selection.Candidates[0].TagDigest = "sha256:new"
+		selection.Selected = selection.Candidates[0]
+		status := NewImageUpdateStatus(img, selection, checked, nil)
+		assert.Equal(t, UpdateStatusUpdateAvailable, status.Reason)
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0.0")
+		status := NewImageUpdateStatus(img, nil, checked, fmt.Errorf("registry unavailable"))
+		assert.Equal(t, UpdateStatusError, status.Reason)
+		assert.Equal(t, "registry unavailable", status.Message)
+	})
+
+	t.Run("Serialize to JSON", func(t *testing.T) {
+		img := image.NewFromIdentifier("example.com/foo/bar:1.0.0")
+		status := NewImageUpdateStatus(img, newSelection("1.1.0", "1.0.0", "1.1.0"), checked, nil)
+		data, err := json.Marshal(status)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"image":"example.com/foo/bar","current":"1.0.0","selected":"1.1.0","candidates":["1.0.0","1.1.0"],"availableHigher":1,"lastChecked":"2021-01-01T00:00:00Z","reason":"UpdateAvailable","message":"image can be updated to 1.1.0"}`, string(data))
+	})
+}
@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// TruncatedTagListError is returned when a registry returns fewer tags for a
+// repository than required relative to the last known number of tags, which
+// indicates that the tag list was truncated, i.e. by a failing page of the
+// tag list. Callers can use IsTruncatedTagListError to detect it, and try
+// again later.
+type TruncatedTagListError struct {
+	Repository string
+	// Number of tags returned by the registry
+	Count int
+	// Last known number of tags
+	Known int
+}
+
+func (e *TruncatedTagListError) Error() string {
+	return fmt.Sprintf("registry returned only %d of %d previously known tags of %s, the tag list may be truncated", e.Count, e.Known, e.Repository)
+}
+
+// IsTruncatedTagListError returns true if err is or wraps a
+// TruncatedTagListError
+func IsTruncatedTagListError(err error) bool {
+	var tte *TruncatedTagListError
+	return errors.As(err, &tte)
+}
+
+// How long a registry must keep returning the same lower number of tags for a
+// repository until it is accepted as the new number of tags
+var tagCountConfirmPeriod = time.Hour
+
+// suspectTagCount is a number of tags that was rejected as truncated, and
+// since when the registry has returned it
+type suspectTagCount struct {
+	count int
+	since time.Time
+}
+
+// Tag counts that were rejected as truncated, keyed by endpoint and
+// repository
+var suspectTagCounts sync.Map
+
+// checkTagCount verifies that count, the number of tags the registry returned
+// for the repository, is at least minTags times the last known number of
+// tags, and records count as the last known number otherwise. Since tags may
+// have been deleted, a lower count is accepted once the registry has returned
+// the same count for tagCountConfirmPeriod, so that a page of the tag list
+// that fails for a while is not mistaken for deleted tags. The count is only
+// recorded if it has changed. If the cache is bypassed for the scan or the
+// endpoint, the last known number is kept by the endpoint instead.
+func (endpoint *RegistryEndpoint) checkTagCount(ctx context.Context, nameInRegistry string, count int, minTags float64) error {
+	tagCache := endpoint.checkState(ctx)
+	if tagCache == nil {
+		return nil
+	}
+	key := endpoint.RegistryPrefix + "/" + nameInRegistry
+	known := tagCache.GetTagCount(nameInRegistry)
+	if minTags > 0 && known > 0 && float64(count) < minTags*float64(known) {
+		prev, ok := suspectTagCounts.Load(key)
+		if !ok || prev.(suspectTagCount).count != count {
+			suspectTagCounts.Store(key, suspectTagCount{count: count, since: time.Now()})
+			return &TruncatedTagListError{Repository: nameInRegistry, Count: count, Known: known}
+		}
+		if time.Since(prev.(suspectTagCount).since) < tagCountConfirmPeriod {
+			return &TruncatedTagListError{Repository: nameInRegistry, Count: count, Known: known}
+		}
+		log.Infof("registry returned %d of %d previously known tags of %s for %s, accepting the new number of tags", count, known, nameInRegistry, tagCountConfirmPeriod)
+	}
+	suspectTagCounts.Delete(key)
+	if count != known {
+		tagCache.SetTagCount(nameInRegistry, count)
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// TagListMethod defines how the tags of a repository are enumerated
+type TagListMethod int
+
+const (
+	// GET request to the standard /v2/<name>/tags/list API
+	TagListStandard TagListMethod = 0
+	// POST request with a body to a search API
+	TagListSearch TagListMethod = 1
+	// GET request to a custom URL
+	TagListCustom TagListMethod = 2
+)
+
+// String returns the string representation of a TagListMethod
+func (m TagListMethod) String() string {
+	switch m {
+	case TagListSearch:
+		return "search"
+	case TagListCustom:
+		return "custom"
+	default:
+		return "standard"
+	}
+}
+
+// Placeholder in the URL and body templates that is replaced with the name of
+// the repository
+const tagListNamePlaceholder = "{{name}}"
+
+// Path to the tags in responses if none is configured
+const defaultTagListPath = "$.tags[*]"
+
+// Content type of the body of search requests if none is configured
+const defaultTagListContentType = "application/json"
+
+// TagListConfiguration is the configuration of the tag list strategy of a
+// registry, as unmarshaled from YAML
+type TagListConfiguration struct {
+	Strategy    string `yaml:"strategy"`
+	URL         string `yaml:"url,omitempty"`
+	Body        string `yaml:"body,omitempty"`
+	ContentType string `yaml:"content_type,omitempty"`
+	Path        string `yaml:"path,omitempty"`
+}
+
+// TagListStrategy defines how the tags of a repository are enumerated for
+// registries that do not provide the standard tag list API
+type TagListStrategy struct {
+	Method TagListMethod
+	// URL template, either absolute or relative to the registry's API URL
+	URL string
+	// Body template of search requests
+	Body        string
+	ContentType string
+	// Path to the tags in the JSON response
+	Path tagListPath
+}
+
+// ParseTagListStrategy parses and validates the configuration of a tag list
+// strategy. A nil configuration yields the standard strategy.
+func ParseTagListStrategy(cfg *TagListConfiguration) (TagListStrategy, error) {
+	if cfg == nil {
+		return TagListStrategy{}, nil
+	}
+	var s TagListStrategy
+	switch strings.ToLower(cfg.Strategy) {
+	case "standard", "":
+		if cfg.URL != "" || cfg.Body != "" || cfg.ContentType != "" || cfg.Path != "" {
+			return s, fmt.Errorf("url, body, content_type and path require the search or custom strategy")
+		}
+		return s, nil
+	case "search":
+		s.Method = TagListSearch
+		if cfg.Body == "" {
+			return s, fmt.Errorf("body is required for the search strategy")
+		}
+	case "custom":
+		s.Method = TagListCustom
+		if cfg.Body != "" || cfg.ContentType != "" {
+			return s, fmt.Errorf("body and content_type require the search strategy")
+		}
+	default:
+		return s, fmt.Errorf("unknown strategy: %s", cfg.Strategy)
+	}
+	if cfg.URL == "" {
+		return s, fmt.Errorf("url is required for the %s strategy", s.Method)
+	}
+	if _, err := url.Parse(strings.Replace(cfg.URL, tagListNamePlaceholder, "name", -1)); err != nil {
+		return s, fmt.Errorf("invalid url: %v", err)
+	}
+	s.URL = cfg.URL
+	s.Body = cfg.Body
+	s.ContentType = cfg.ContentType
+	if s.Method == TagListSearch && s.ContentType == "" {
+		s.ContentType = defaultTagListContentType
+	}
+	path := cfg.Path
+	if path == "" {
+		path = defaultTagListPath
+	}
+	var err error
+	if s.Path, err = parseTagListPath(path); err != nil {
+		return s, fmt.Errorf("invalid path %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// tagListURL returns the URL to request the tags of the repository from,
+// resolved against the registry's API URL. An absolute URL must point to the
+// registry's host, so that its credentials are never sent to another host.
+func (s *TagListStrategy) tagListURL(apiURL string, nameInRepository string) (string, error) {
+	base, err := url.Parse(strings.TrimSuffix(apiURL, "/") + "/")
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(strings.Replace(s.URL, tagListNamePlaceholder, nameInRepository, -1))
+	if err != nil {
+		return "", fmt.Errorf("invalid tag list url: %v", err)
+	}
+	u := base.ResolveReference(ref)
+	if u.Scheme != base.Scheme || !strings.EqualFold(u.Host, base.Host) {
+		return "", fmt.Errorf("tag list url must be on the registry's host %s://%s, not on %s://%s", base.Scheme, base.Host, u.Scheme, u.Host)
+	}
+	return u.String(), nil
+}
+
+// tagListBody returns the body of a search request for the repository. The
+// name is escaped for use within a JSON string.
+func (s *TagListStrategy) tagListBody(nameInRepository string) string {
+	quoted, _ := json.Marshal(nameInRepository)
+	return strings.Replace(s.Body, tagListNamePlaceholder, string(quoted[1:len(quoted)-1]), -1)
+}
+
+// customTags returns the tags of the repository using the tag list strategy
+// of the client's endpoint. Paginated responses of custom URLs are followed
+// via their Link headers like for the standard API. Search APIs page by their
+// request body, if at all, so only the first response of a search request is
+// used, and an error is returned if it links to a next page.
+func (client *registryClient) customTags(ctx context.Context, nameInRepository string) ([]string, error) {
+	s := client.endpoint.TagList
+	next, err := s.tagListURL(client.regClient.URL, nameInRepository)
+	if err != nil {
+		return nil, err
+	}
+	method := http.MethodGet
+	body := ""
+	if s.Method == TagListSearch {
+		method = http.MethodPost
+		body = s.tagListBody(nameInRepository)
+	}
+
+	tags := []string{}
+	httpClient := client.withContext(ctx).Client
+	for pages := 0; next != ""; pages++ {
+		if pages >= MaxTagListPages {
+			return nil, fmt.Errorf("tag list of %s has more than %d pages", nameInRepository, MaxTagListPages)
+		}
+		var reqBody io.Reader
+		if method == http.MethodPost {
+			reqBody = strings.NewReader(body)
+		}
+		req, err := http.NewRequest(method, next, reqBody)
+		if err != nil {
+			return nil, err
+		}
+		if method == http.MethodPost {
+			req.Header.Set("Content-Type", s.ContentType)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, client.statusError(resp, "could not get tags of %s", nameInRepository)
+		}
+		var doc interface{}
+		d := json.NewDecoder(resp.Body)
+		d.UseNumber()
+		err = d.Decode(&doc)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag list response for %s: %v", nameInRepository, err)
+		}
+		pageTags, err := s.Path.tags(doc)
+		if err != nil {
+			return nil, fmt.Errorf("could not read tags of %s from response: %v", nameInRepository, err)
+		}
+		tags = append(tags, pageTags...)
+		if next, err = nextPageURL(resp); err != nil {
+			return nil, err
+		}
+		if method == http.MethodPost {
+			// Silently using the first page could hide the newest tags
+			if next != "" {
+				return nil, fmt.Errorf("search for tags of %s returned more than one page, the search body must request all tags at once", nameInRepository)
+			}
+			break
+		}
+		if next != "" {
+			log.Tracef("fetching next page of tags of %s: %s", nameInRepository, next)
+		}
+	}
+	return tags, nil
+}
+
+// tagListPathStep is a single step of a tagListPath, selecting either a
+// member of an object, an element of an array, or all elements of an array
+type tagListPathStep struct {
+	member   string
+	index    int
+	wildcard bool
+}
+
+// tagListPath is a simple JSONPath expression selecting the tags in a JSON
+// document. It starts with $ and consists of member accessors (.name or
+// ['name']), array indices ([0]) and array wildcards ([*]).
+type tagListPath []tagListPathStep
+
+// parseTagListPath parses a JSONPath expression into a tagListPath
+func parseTagListPath(expr string) (tagListPath, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("must start with $")
+	}
+	path := tagListPath{}
+	rest := expr[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			member := rest[1 : end+1]
+			if member == "" {
+				return nil, fmt.Errorf("empty member name")
+			}
+			if member == "*" {
+				path = append(path, tagListPathStep{wildcard: true})
+			} else {
+				path = append(path, tagListPathStep{member: member, index: -1})
+			}
+			rest = rest[end+1:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [")
+			}
+			sel := rest[1:end]
+			switch {
+			case sel == "*":
+				path = append(path, tagListPathStep{wildcard: true})
+			case len(sel) > 2 && (sel[0] == '\'' || sel[0] == '"') && sel[len(sel)-1] == sel[0]:
+				path = append(path, tagListPathStep{member: sel[1 : len(sel)-1], index: -1})
+			default:
+				index, err := strconv.Atoi(sel)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid selector [%s]", sel)
+				}
+				path = append(path, tagListPathStep{index: index})
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q", rest[0])
+		}
+	}
+	return path, nil
+}
+
+// tags returns the tags selected by the path in the given JSON document,
+// which must be strings. A member missing from an object selects no tags, so
+// that empty result pages which omit their list are handled gracefully.
+func (path tagListPath) tags(doc interface{}) ([]string, error) {
+	values := []interface{}{doc}
+	for _, step := range path {
+		selected := []interface{}{}
+		for _, v := range values {
+			switch {
+			case step.wildcard:
+				switch t := v.(type) {
+				case []interface{}:
+					selected = append(selected, t...)
+				case map[string]interface{}:
+					for _, e := range t {
+						selected = append(selected, e)
+					}
+				case nil:
+				default:
+					return nil, fmt.Errorf("cannot select elements of %T", v)
+				}
+			case step.member != "":
+				switch t := v.(type) {
+				case map[string]interface{}:
+					if e, ok := t[step.member]; ok {
+						selected = append(selected, e)
+					}
+				case nil:
+				default:
+					return nil, fmt.Errorf("cannot select member %s of %T", step.member, v)
+				}
+			default:
+				switch t := v.(type) {
+				case []interface{}:
+					if step.index < len(t) {
+						selected = append(selected, t[step.index])
+					}
+				case nil:
+				default:
+					return nil, fmt.Errorf("cannot select element %d of %T", step.index, v)
+				}
+			}
+		}
+		values = selected
+	}
+
+	tags := make([]string, 0, len(values))
+	for _, v := range values {
+		switch t := v.(type) {
+		case string:
+			tags = append(tags, t)
+		case json.Number:
+			tags = append(tags, t.String())
+		case nil:
+		default:
+			return nil, fmt.Errorf("expected tag name to be a string, got %T", v)
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,202 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseTagListStrategy(t *testing.T) {
+	t.Run("No configuration", func(t *testing.T) {
+		s, err := ParseTagListStrategy(nil)
+		require.NoError(t, err)
+		assert.Equal(t, TagListStandard, s.Method)
+	})
+
+	t.Run("Search strategy with defaults", func(t *testing.T) {
+		s, err := ParseTagListStrategy(&TagListConfiguration{Strategy: "search", URL: "/api/search", Body: `{"repo":"{{name}}"}`})
+		require.NoError(t, err)
+		assert.Equal(t, TagListSearch, s.Method)
+		assert.Equal(t, "application/json", s.ContentType)
+		assert.Equal(t, tagListPath{{member: "tags", index: -1}, {wildcard: true}}, s.Path)
+	})
+
+	t.Run("Custom strategy", func(t *testing.T) {
+		s, err := ParseTagListStrategy(&TagListConfiguration{Strategy: "Custom", URL: "/api/repos/{{name}}/tags", Path: "$.data.items[*]['tag name']"})
+		require.NoError(t, err)
+		assert.Equal(t, TagListCustom, s.Method)
+		assert.Equal(t, "custom", s.Method.String())
+		assert.Len(t, s.Path, 4)
+	})
+
+	t.Run("Invalid configurations", func(t *testing.T) {
+		for _, cfg := range []TagListConfiguration{
+			{Strategy: "graphql", URL: "/api"},
+			{Strategy: "standard", URL: "/api"},
+			{Strategy: "custom"},
+			{Strategy: "custom", URL: "/api", Body: "{}"},
+			{Strategy: "search", URL: "/api"},
+			{Strategy: "custom", URL: "/api", Path: "tags[*]"},
+			{Strategy: "custom", URL: "/api", Path: "$.tags[x]"},
+			{Strategy: "custom", URL: "/api", Path: "$.tags[*"},
+			{Strategy: "custom", URL: "/api", Path: "$..tags"},
+		} {
+			_, err := ParseTagListStrategy(&cfg)
+			assert.Error(t, err, "%+v", cfg)
+		}
+	})
+}
+
+func Test_TagListPath(t *testing.T) {
+	var doc interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{"results":[{"name":"1.0"},{"name":"1.1"},{"other":true}],"first":[["a","b"]],"count":2}`), &doc))
+
+	tags := func(expr string) ([]string, error) {
+		path, err := parseTagListPath(expr)
+		require.NoError(t, err)
+		return path.tags(doc)
+	}
+
+	t.Run("Members of all array elements", func(t *testing.T) {
+		result, err := tags("$.results[*].name")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.0", "1.1"}, result)
+	})
+
+	t.Run("Array index and quoted member", func(t *testing.T) {
+		result, err := tags("$['first'][0][*]")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a", "b"}, result)
+	})
+
+	t.Run("Missing member", func(t *testing.T) {
+		result, err := tags("$.tags[*]")
+		require.NoError(t, err)
+		assert.Empty(t, result)
+	})
+
+	t.Run("Values that are no tag names", func(t *testing.T) {
+		_, err := tags("$.results[*]")
+		assert.Error(t, err)
+		_, err = tags("$.count[*]")
+		assert.Error(t, err)
+	})
+}
+
+func Test_CustomTags(t *testing.T) {
+	var bodies, contentTypes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/search":
+			body, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			contentTypes = append(contentTypes, r.Header.Get("Content-Type"))
+			if strings.Contains(string(body), "foo/paged") {
+				w.Header().Set("Link", `</api/search?page=2>; rel="next"`)
+			}
+			fmt.Fprint(w, `{"results":[{"name":"1.0"},{"name":"1.1"}]}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/repos/foo/bar/tags":
+			fmt.Fprint(w, `{"data":[{"tag":"2.0"},{"tag":"2.1"}]}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/repos/foo/paged/tags":
+			if r.URL.Query().Get("page") == "" {
+				w.Header().Set("Link", `</api/repos/foo/paged/tags?page=2>; rel="next"`)
+				fmt.Fprint(w, `{"data":[{"tag":"3.0"}]}`)
+			} else {
+				fmt.Fprint(w, `{"data":[{"tag":"3.1"}]}`)
+			}
+		case r.Method == http.MethodGet && r.URL.Path == "/api/repos/foo/elsewhere/tags":
+			w.Header().Set("Link", `<https://other.example.com/api/repos/foo/elsewhere/tags?page=2>; rel="next"`)
+			fmt.Fprint(w, `{"data":[{"tag":"4.0"}]}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/repos/foo/missing/tags":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	newClient := func(cfg *TagListConfiguration) RegistryClient {
+		ep := newRegistryEndpoint("example.com", "Example", srv.URL, "", "", false, SortUnsorted, 0, 0)
+		var err error
+		ep.TagList, err = ParseTagListStrategy(cfg)
+		require.NoError(t, err)
+		client, err := NewClient(ep, "", "")
+		require.NoError(t, err)
+		return client
+	}
+
+	t.Run("Search with POST", func(t *testing.T) {
+		bodies, contentTypes = nil, nil
+		client := newClient(&TagListConfiguration{Strategy: "search", URL: "/api/search", Body: `{"repository":"{{name}}"}`, Path: "$.results[*].name"})
+		tags, err := client.Tags(context.Background(), "foo/bar")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.0", "1.1"}, tags)
+		assert.Equal(t, []string{`{"repository":"foo/bar"}`}, bodies)
+		assert.Equal(t, []string{"application/json"}, contentTypes)
+	})
+
+	t.Run("Search with POST is not truncated to the first page", func(t *testing.T) {
+		bodies = nil
+		client := newClient(&TagListConfiguration{Strategy: "search", URL: "/api/search", Body: `{"repository":"{{name}}"}`, Path: "$.results[*].name"})
+		_, err := client.Tags(context.Background(), "foo/paged")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "more than one page")
+		assert.Len(t, bodies, 1)
+	})
+
+	t.Run("Custom URL across pages", func(t *testing.T) {
+		client := newClient(&TagListConfiguration{Strategy: "custom", URL: "/api/repos/{{name}}/tags", Path: "$.data[*].tag"})
+		tags, err := client.Tags(context.Background(), "foo/paged")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"3.0", "3.1"}, tags)
+	})
+
+	t.Run("Next page on other host is not followed", func(t *testing.T) {
+		client := newClient(&TagListConfiguration{Strategy: "custom", URL: "/api/repos/{{name}}/tags", Path: "$.data[*].tag"})
+		_, err := client.Tags(context.Background(), "foo/elsewhere")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "other.example.com")
+	})
+
+	t.Run("Tag list URL on other host is rejected", func(t *testing.T) {
+		client := newClient(&TagListConfiguration{Strategy: "custom", URL: "https://other.example.com/api/repos/{{name}}/tags", Path: "$.data[*].tag"})
+		_, err := client.Tags(context.Background(), "foo/bar")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "registry's host")
+	})
+
+	t.Run("Custom URL template", func(t *testing.T) {
+		client := newClient(&TagListConfiguration{Strategy: "custom", URL: "/api/repos/{{name}}/tags", Path: "$.data[*].tag"})
+		tags, err := client.Tags(context.Background(), "foo/bar")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"2.0", "2.1"}, tags)
+	})
+
+	t.Run("No ETag for custom strategy", func(t *testing.T) {
+		client := newClient(&TagListConfiguration{Strategy: "custom", URL: "/api/repos/{{name}}/tags", Path: "$.data[*].tag"})
+		tags, etag, unchanged, err := client.(ETagClient).TagsIfNoneMatch(context.Background(), "foo/bar", `"abc"`)
+		require.NoError(t, err)
+		assert.Len(t, tags, 2)
+		assert.Empty(t, etag)
+		assert.False(t, unchanged)
+	})
+
+	t.Run("Error status", func(t *testing.T) {
+		client := newClient(&TagListConfiguration{Strategy: "custom", URL: "/api/repos/{{name}}/tags"})
+		_, err := client.Tags(context.Background(), "foo/missing")
+		assert.Error(t, err)
+	})
+
+	t.Run("Body escapes name", func(t *testing.T) {
+		s := TagListStrategy{Body: `{"q":"{{name}}"}`}
+		assert.Equal(t, `{"q":"a\"b"}`, s.tagListBody(`a"b`))
+	})
+}
@@ -0,0 +1,128 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+)
+
+// TagListJSON is a page of the tags of an image that are eligible for update,
+// newest first, in a form that can be serialized
+type TagListJSON struct {
+	// Image is the name of the image, without tag
+	Image string `json:"image"`
+	// Current is the tag the image is currently running
+	Current string `json:"current,omitempty"`
+	// Selected is the tag the image would be updated to
+	Selected string `json:"selected,omitempty"`
+	// Total is the number of eligible tags across all pages
+	Total int `json:"total"`
+	// Offset is the position of the first tag of the page among all
+	// eligible tags
+	Offset int `json:"offset"`
+	// Tags are the tags on the page
+	Tags []TagJSON `json:"tags"`
+}
+
+// TagJSON describes a single tag in a form that can be serialized
+type TagJSON struct {
+	// Name is the name of the tag
+	Name string `json:"name"`
+	// Digest is the digest of the manifest the tag points to, if known
+	Digest string `json:"digest,omitempty"`
+	// CreatedAt is the time the image was created at, if known
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	// Platforms are the platforms the tag is available for, as os/arch or
+	// os/arch/variant, if known
+	Platforms []string `json:"platforms,omitempty"`
+}
+
+// TagPage selects the page of tags returned by GetTagsJSON
+type TagPage struct {
+	// Offset is the number of tags to skip
+	Offset int
+	// Limit is the maximum number of tags on the page. Zero means no limit.
+	Limit int
+	// Platforms enables fetching the platforms of each tag on the page from
+	// the registry. Otherwise, only the platform of the tag's meta data is
+	// returned, if known.
+	Platforms bool
+}
+
+// GetTagsJSON returns a page of the tags of img that are eligible for update
+// according to the constraint, newest first. The tags are ordered and
+// selected the same way an update does, so the tag an update would select is
+// returned as well. The platforms of the tags on the page are fetched from
+// the registry only if requested by the page.
+func (endpoint *RegistryEndpoint) GetTagsJSON(ctx context.Context, img *image.ContainerImage, regClient RegistryClient, vc *image.VersionConstraint, page TagPage) (*TagListJSON, error) {
+	if page.Offset < 0 || page.Limit < 0 {
+		return nil, fmt.Errorf("offset and limit of page must not be negative")
+	}
+	tagList, err := endpoint.GetTags(ctx, img, regClient, vc)
+	if err != nil {
+		return nil, err
+	}
+	selection, err := img.SelectVersionFromTags(endpoint.withSignatureVerifier(ctx, img, regClient, vc), tagList)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &TagListJSON{
+		Image:  img.GetFullNameWithoutTag(),
+		Total:  len(selection.Candidates),
+		Offset: page.Offset,
+		Tags:   []TagJSON{},
+	}
+	if img.ImageTag != nil {
+		result.Current = img.ImageTag.TagName
+	}
+	if selection.Selected != nil {
+		result.Selected = selection.Selected.TagName
+	}
+
+	end := len(selection.Candidates) - page.Offset
+	start := 0
+	if page.Limit > 0 && end-page.Limit > start {
+		start = end - page.Limit
+	}
+	for i := end - 1; i >= start; i-- {
+		t := newTagJSON(selection.Candidates[i])
+		if page.Platforms {
+			platforms, err := tagPlatforms(ctx, regClient, endpoint.nameInRegistry(img), t.Name)
+			if err != nil {
+				return nil, fmt.Errorf("could not get platforms of tag %s: %v", t.Name, err)
+			}
+			t.Platforms = platforms
+		}
+		result.Tags = append(result.Tags, t)
+	}
+	return result, nil
+}
+
+// newTagJSON returns the serializable description of the given tag
+func newTagJSON(t *tag.ImageTag) TagJSON {
+	tj := TagJSON{Name: t.TagName, Digest: t.TagDigest}
+	if t.TagPlatform != "" {
+		tj.Platforms = []string{t.TagPlatform}
+	}
+	if ti := t.TagInfo; ti != nil {
+		if tj.Digest == "" {
+			tj.Digest = ti.Digest
+		}
+		if !ti.CreatedAt.IsZero() {
+			created := ti.CreatedAt
+			tj.CreatedAt = &created
+		}
+		if tj.Platforms == nil && ti.Platform() != "" {
+			tj.Platforms = []string{ti.Platform()}
+		}
+	}
+	if tj.CreatedAt == nil && t.TagDate != nil && t.TagDate.Unix() > 0 {
+		created := *t.TagDate
+		tj.CreatedAt = &created
+	}
+	return tj
+}
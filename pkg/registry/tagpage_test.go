@@ -0,0 +1,98 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/image"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/tag"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_GetTagsJSON(t *testing.T) {
+	ep, err := GetRegistryEndpoint("")
+	require.NoError(t, err)
+	img := image.NewFromIdentifier("foo/bar:1.0")
+	vc := &image.VersionConstraint{SortMode: image.VersionSortSemVer}
+
+	tagNames := func(tl *TagListJSON) []string {
+		names := []string{}
+		for _, t := range tl.Tags {
+			names = append(names, t.Name)
+		}
+		return names
+	}
+
+	t.Run("All tags newest first", func(t *testing.T) {
+		tl, err := ep.GetTagsJSON(context.Background(), img, newPlatformRegistryClient(), vc, TagPage{})
+		require.NoError(t, err)
+		assert.Equal(t, "foo/bar", tl.Image)
+		assert.Equal(t, "1.0", tl.Current)
+		assert.Equal(t, "1.2", tl.Selected)
+		assert.Equal(t, 3, tl.Total)
+		assert.Equal(t, []string{"1.2", "1.1", "1.0"}, tagNames(tl))
+		assert.Nil(t, tl.Tags[0].Platforms)
+	})
+
+	t.Run("Page of tags", func(t *testing.T) {
+		tl, err := ep.GetTagsJSON(context.Background(), img, newPlatformRegistryClient(), vc, TagPage{Offset: 1, Limit: 1})
+		require.NoError(t, err)
+		assert.Equal(t, 3, tl.Total)
+		assert.Equal(t, 1, tl.Offset)
+		assert.Equal(t, []string{"1.1"}, tagNames(tl))
+	})
+
+	t.Run("Page of tags with platforms", func(t *testing.T) {
+		tl, err := ep.GetTagsJSON(context.Background(), img, newPlatformRegistryClient(), vc, TagPage{Offset: 1, Limit: 5, Platforms: true})
+		require.NoError(t, err)
+		require.Equal(t, []string{"1.1", "1.0"}, tagNames(tl))
+		assert.Equal(t, []string{"linux/amd64", "linux/arm/v7", "linux/arm64"}, tl.Tags[0].Platforms)
+		assert.Equal(t, []string{"linux/amd64"}, tl.Tags[1].Platforms)
+	})
+
+	t.Run("Page beyond the last tag", func(t *testing.T) {
+		tl, err := ep.GetTagsJSON(context.Background(), img, newPlatformRegistryClient(), vc, TagPage{Offset: 5, Limit: 2})
+		require.NoError(t, err)
+		assert.Equal(t, 3, tl.Total)
+		assert.Empty(t, tl.Tags)
+		data, err := json.Marshal(tl)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"tags":[]`)
+	})
+
+	t.Run("Invalid page", func(t *testing.T) {
+		_, err := ep.GetTagsJSON(context.Background(), img, newPlatformRegistryClient(), vc, TagPage{Offset: -1})
+		assert.Error(t, err)
+	})
+}
+
+func Test_NewTagJSON(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Tag with meta data", func(t *testing.T) {
+		it := tag.NewImageTag("1.0", time.Unix(0, 0))
+		it.TagInfo = &tag.TagInfo{CreatedAt: created, OS: "linux", Arch: "arm64", Digest: "sha256:abc"}
+		data, err := json.Marshal(newTagJSON(it))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"name":"1.0","digest":"sha256:abc","createdAt":"2024-03-01T12:00:00Z","platforms":["linux/arm64"]}`, string(data))
+	})
+
+	t.Run("Tag without meta data", func(t *testing.T) {
+		data, err := json.Marshal(newTagJSON(tag.NewImageTag("1.0", time.Unix(0, 0))))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"name":"1.0"}`, string(data))
+	})
+
+	t.Run("Tag with date and digest", func(t *testing.T) {
+		it := tag.NewImageTag("1.0", created)
+		it.TagDigest = "sha256:def"
+		tj := newTagJSON(it)
+		assert.Equal(t, "sha256:def", tj.Digest)
+		require.NotNil(t, tj.CreatedAt)
+		assert.True(t, created.Equal(*tj.CreatedAt))
+	})
+}
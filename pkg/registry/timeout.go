@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// requestTimeoutError is returned when a single request to a registry takes
+// longer than the endpoint's timeout. It is a timeout as reported by net.Error,
+// so that it is classified like any other timeout of the network.
+type requestTimeoutError struct {
+	url     string
+	timeout time.Duration
+}
+
+func (e *requestTimeoutError) Error() string {
+	return fmt.Sprintf("request to %s exceeded timeout of %s", e.url, e.timeout)
+}
+
+// Timeout returns true
+func (e *requestTimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary returns true
+func (e *requestTimeoutError) Temporary() bool {
+	return true
+}
+
+// timeoutTransport limits the time each request may take, including reading
+// its response's body. Since it is wrapped by the retryTransport, every
+// attempt of a request gets the full timeout, and time spent waiting for a
+// retry, a pacing slot or the rate limiter does not count.
+type timeoutTransport struct {
+	timeout   time.Duration
+	transport http.RoundTripper
+}
+
+// RoundTrip performs the request, aborting it once the timeout is exceeded
+func (tt *timeoutTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), tt.timeout)
+	resp, err := tt.transport.RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		err = tt.timeoutError(ctx, r, err)
+		cancel()
+		return nil, err
+	}
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, transport: tt, request: r, ctx: ctx, cancel: cancel}
+	return resp, nil
+}
+
+// timeoutError returns a requestTimeoutError for err if the request failed
+// because the timeout was exceeded, and err otherwise. Errors caused by the
+// request's own context are returned as they are.
+func (tt *timeoutTransport) timeoutError(ctx context.Context, r *http.Request, err error) error {
+	if ctx.Err() == context.DeadlineExceeded && r.Context().Err() == nil {
+		return &requestTimeoutError{url: r.URL.Host + r.URL.Path, timeout: tt.timeout}
+	}
+	return err
+}
+
+// timeoutBody is the body of a response whose request's timeout is released
+// once the body is closed
+type timeoutBody struct {
+	io.ReadCloser
+	transport *timeoutTransport
+	request   *http.Request
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// Read reads from the body, failing with a requestTimeoutError once the
+// timeout is exceeded
+func (tb *timeoutBody) Read(p []byte) (int, error) {
+	n, err := tb.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = tb.transport.timeoutError(tb.ctx, tb.request, err)
+	}
+	return n, err
+}
+
+// Close closes the body and releases the timeout
+func (tb *timeoutBody) Close() error {
+	err := tb.ReadCloser.Close()
+	tb.cancel()
+	return err
+}
@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/kube"
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// Fields of a Kubernetes TLS secret holding the client certificate, its key
+// and, optionally, the CA certificate of the registry
+const (
+	tlsSecretCertField = "tls.crt"
+	tlsSecretKeyField  = "tls.key"
+	tlsSecretCAField   = "ca.crt"
+)
+
+// parseTLSCredentials parses a reference to the secret holding the TLS client
+// certificate of an endpoint, i.e. secret:namespace/name, and returns the
+// namespace and name of the secret
+func parseTLSCredentials(definition string) (string, string, error) {
+	if !strings.HasPrefix(definition, "secret:") {
+		return "", "", fmt.Errorf("invalid TLS credentials %s: must be a reference to a secret, i.e. secret:namespace/name", definition)
+	}
+	tokens := strings.Split(strings.TrimPrefix(definition, "secret:"), "/")
+	if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+		return "", "", fmt.Errorf("invalid secret definition: %s", definition)
+	}
+	return tokens[0], tokens[1], nil
+}
+
+// tlsCredentialsDue returns whether the TLS client certificate has yet to be
+// loaded from the endpoint's secret, or must be reloaded because it has
+// expired. Must be called with the transport lock held.
+func (ep *RegistryEndpoint) tlsCredentialsDue() bool {
+	if ep.TLSCredentials == "" {
+		return false
+	}
+	return ep.tlsUpdated.IsZero() || ep.CredsExpire > 0 && time.Since(ep.tlsUpdated) >= ep.CredsExpire
+}
+
+// setTLSCredentials loads the client certificate, its key and the CA
+// certificate of the registry from the endpoint's secret, if they have not
+// been loaded yet or have expired. If the certificates have changed, the
+// endpoint's transport is discarded, so that new connections use them. On
+// error, previously loaded certificates are kept. The secret is read without
+// holding the transport lock, so that requests to the registry are not held
+// up by the Kubernetes API.
+func (ep *RegistryEndpoint) setTLSCredentials(kubeClient *kube.KubernetesClient) error {
+	ep.transportLock.Lock()
+	due := ep.tlsCredentialsDue()
+	ep.transportLock.Unlock()
+	if !due {
+		return nil
+	}
+	namespace, name, err := parseTLSCredentials(ep.TLSCredentials)
+	if err == nil && kubeClient == nil {
+		err = fmt.Errorf("cannot read secret without Kubernetes client")
+	}
+	var data map[string][]byte
+	if err == nil {
+		data, err = kubeClient.GetSecretData(namespace, name)
+	}
+
+	ep.transportLock.Lock()
+	defer ep.transportLock.Unlock()
+	if err == nil {
+		err = ep.applyTLSCredentials(data)
+	}
+	if err != nil {
+		err = fmt.Errorf("could not load TLS credentials for registry %s from %s: %v", ep.RegistryAPI, ep.TLSCredentials, err)
+		if ep.tlsCert == nil {
+			return err
+		}
+		log.Warnf("%v, keeping current client certificate", err)
+	}
+	return nil
+}
+
+// applyTLSCredentials sets the client certificate and CA certificate of the
+// endpoint from the data of a TLS secret. Must be called with the transport
+// lock held.
+func (ep *RegistryEndpoint) applyTLSCredentials(data map[string][]byte) error {
+	certPEM, keyPEM, caPEM := data[tlsSecretCertField], data[tlsSecretKeyField], data[tlsSecretCAField]
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return fmt.Errorf("secret must have the fields %s and %s", tlsSecretCertField, tlsSecretKeyField)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid client certificate: %v", err)
+	}
+	changed := ep.tlsCert == nil || !bytes.Equal(ep.tlsCertPEM, certPEM) || !bytes.Equal(ep.tlsCAPEM, caPEM)
+	ep.tlsCert = &cert
+	ep.tlsCertPEM = certPEM
+	ep.tlsCAPEM = caPEM
+	ep.tlsUpdated = time.Now()
+	if changed && ep.transport != nil {
+		log.Debugf("client certificate for registry %s has changed, discarding connections", ep.RegistryAPI)
+		ep.transport.CloseIdleConnections()
+		ep.transport = nil
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseTLSCredentials(t *testing.T) {
+	namespace, name, err := parseTLSCredentials("secret:argocd/harbor-client")
+	require.NoError(t, err)
+	assert.Equal(t, "argocd", namespace)
+	assert.Equal(t, "harbor-client", name)
+
+	for _, definition := range []string{"argocd/harbor-client", "pullsecret:argocd/harbor-client", "secret:argocd", "secret:/harbor-client", "secret:a/b/c"} {
+		_, _, err := parseTLSCredentials(definition)
+		assert.Error(t, err, definition)
+	}
+}
+
+func Test_TLSCredentials(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(tempDir)
+
+	certFile, keyFile, cert := writeClientCert(t, tempDir)
+	certPEM, err := ioutil.ReadFile(certFile)
+	require.NoError(t, err)
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	require.NoError(t, err)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.StartTLS()
+	defer srv.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	get := func(ep *RegistryEndpoint) error {
+		transport, err := ep.getTransport(ep.Insecure)
+		if err != nil {
+			return err
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(srv.URL + "/v2/")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	t.Run("Client and CA certificate from secret are used", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: srv.URL, TLSCredentials: "secret:argocd/harbor-client"}
+		assert.Error(t, get(ep))
+
+		require.NoError(t, ep.applyTLSCredentials(map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM, "ca.crt": caPEM}))
+		assert.NoError(t, get(ep))
+		assert.False(t, ep.tlsCredentialsDue())
+	})
+
+	t.Run("Transport is discarded when certificates change", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: srv.URL, Insecure: true, TLSCredentials: "secret:argocd/harbor-client"}
+		require.NoError(t, ep.applyTLSCredentials(map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM}))
+		require.NoError(t, get(ep))
+		transport := ep.transport
+		require.NotNil(t, transport)
+
+		require.NoError(t, ep.applyTLSCredentials(map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM}))
+		assert.Equal(t, transport, ep.transport)
+
+		otherCert, otherKey, _ := writeClientCert(t, tempDir)
+		otherCertPEM, err := ioutil.ReadFile(otherCert)
+		require.NoError(t, err)
+		otherKeyPEM, err := ioutil.ReadFile(otherKey)
+		require.NoError(t, err)
+		require.NoError(t, ep.applyTLSCredentials(map[string][]byte{"tls.crt": otherCertPEM, "tls.key": otherKeyPEM}))
+		assert.Nil(t, ep.transport)
+		assert.Error(t, get(ep))
+	})
+
+	t.Run("Invalid secret", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: srv.URL, TLSCredentials: "secret:argocd/harbor-client"}
+		err := ep.applyTLSCredentials(map[string][]byte{"tls.crt": certPEM})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "must have the fields tls.crt and tls.key")
+		err = ep.applyTLSCredentials(map[string][]byte{"tls.crt": certPEM, "tls.key": certPEM})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid client certificate")
+		assert.Nil(t, ep.tlsCert)
+	})
+
+	t.Run("Certificates are reloaded when they expire", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: srv.URL, TLSCredentials: "secret:argocd/harbor-client"}
+		assert.True(t, ep.tlsCredentialsDue())
+		require.NoError(t, ep.applyTLSCredentials(map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM}))
+		assert.False(t, ep.tlsCredentialsDue())
+		ep.CredsExpire = time.Minute
+		assert.False(t, ep.tlsCredentialsDue())
+		ep.tlsUpdated = time.Now().Add(-2 * time.Minute)
+		assert.True(t, ep.tlsCredentialsDue())
+		assert.False(t, (&RegistryEndpoint{}).tlsCredentialsDue())
+	})
+
+	t.Run("Current certificate is kept if reloading fails", func(t *testing.T) {
+		ep := &RegistryEndpoint{RegistryAPI: srv.URL, TLSCredentials: "secret:argocd/harbor-client"}
+		err := ep.setTLSCredentials(nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "could not load TLS credentials for registry")
+
+		require.NoError(t, ep.applyTLSCredentials(map[string][]byte{"tls.crt": certPEM, "tls.key": keyPEM}))
+		ep.CredsExpire = time.Minute
+		ep.tlsUpdated = time.Now().Add(-2 * time.Minute)
+		assert.NoError(t, ep.setTLSCredentials(nil))
+		assert.NotNil(t, ep.tlsCert)
+	})
+}
@@ -0,0 +1,339 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+)
+
+// Lifetime of a token if the auth server does not tell us, as defined by the
+// Docker token authentication specification
+const defaultTokenLifetime = 60 * time.Second
+
+// Tokens are not reused during this period before they expire, so that they
+// are still valid when they arrive at the registry
+const tokenExpiryLeeway = 10 * time.Second
+
+// cachedToken is a response of an auth server issuing a bearer token
+type cachedToken struct {
+	header    http.Header
+	body      []byte
+	token     string
+	expiresAt time.Time
+}
+
+// tokenCache holds the bearer tokens issued by auth servers, keyed by realm,
+// service, scope and the credentials used to request them. It is shared by
+// all endpoints, so endpoints for the same registry host and with the same
+// credentials reuse each other's tokens.
+type tokenCache struct {
+	lock   sync.Mutex
+	realms map[string]bool
+	tokens map[string]*cachedToken
+}
+
+var bearerTokens = &tokenCache{realms: map[string]bool{}, tokens: map[string]*cachedToken{}}
+
+// tokenCacheTransport serves requests for bearer tokens from the token cache.
+// The realms of the auth servers are learned from the challenges returned by
+// registries, so only requests to a known realm are considered token requests.
+type tokenCacheTransport struct {
+	cache     *tokenCache
+	transport http.RoundTripper
+}
+
+// RoundTrip performs the request, unless it is a token request that can be
+// served from the cache
+func (tct *tokenCacheTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	key, isTokenRequest := tct.cache.key(r)
+	if isTokenRequest {
+		if token := tct.cache.get(key); token != nil {
+			log.Tracef("using cached token for %s", r.URL.Host)
+			return &http.Response{
+				Status:        "200 OK",
+				StatusCode:    http.StatusOK,
+				Proto:         r.Proto,
+				ProtoMajor:    r.ProtoMajor,
+				ProtoMinor:    r.ProtoMinor,
+				Header:        token.header.Clone(),
+				Body:          ioutil.NopCloser(bytes.NewReader(token.body)),
+				ContentLength: int64(len(token.body)),
+				Request:       r,
+			}, nil
+		}
+	}
+
+	resp, err := tct.transport.RoundTrip(r)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		tct.cache.learnRealms(resp.Header.Values("WWW-Authenticate"))
+		// A token the registry does not accept anymore, i.e. because it has
+		// been revoked, must not be handed out again
+		if fields := strings.Fields(r.Header.Get("Authorization")); len(fields) == 2 && strings.EqualFold(fields[0], "bearer") {
+			tct.cache.invalidate(fields[1])
+		}
+	} else if isTokenRequest && resp.StatusCode == http.StatusOK {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		tct.cache.put(key, resp.Header, body)
+	}
+	return resp, nil
+}
+
+// learnRealms records the realms of all bearer challenges
+func (tc *tokenCache) learnRealms(challenges []string) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	for _, challenge := range challenges {
+		if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+			continue
+		}
+		if m := realmRegexp.FindStringSubmatch(challenge); m != nil {
+			if u, err := url.Parse(m[1]); err == nil {
+				tc.realms[realmKey(u)] = true
+			}
+		}
+	}
+}
+
+// key returns the cache key for a token request, and whether r is a token
+// request at all
+func (tc *tokenCache) key(r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet {
+		return "", false
+	}
+	realm := realmKey(r.URL)
+	tc.lock.Lock()
+	known := tc.realms[realm]
+	tc.lock.Unlock()
+	if !known {
+		return "", false
+	}
+	query := r.URL.Query()
+	scopes := query["scope"]
+	sort.Strings(scopes)
+	// Credentials are only kept as a hash
+	creds := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return strings.Join([]string{realm, query.Get("service"), strings.Join(scopes, " "), hex.EncodeToString(creds[:])}, "|"), true
+}
+
+// get returns the token for key, if there is one that has not expired
+func (tc *tokenCache) get(key string) *cachedToken {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	token, ok := tc.tokens[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(token.expiresAt) {
+		delete(tc.tokens, key)
+		return nil
+	}
+	return token
+}
+
+// put caches the response of a token request until the token expires
+func (tc *tokenCache) put(key string, header http.Header, body []byte) {
+	var token struct {
+		Token       string    `json:"token"`
+		AccessToken string    `json:"access_token"`
+		ExpiresIn   int       `json:"expires_in"`
+		IssuedAt    time.Time `json:"issued_at"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || (token.Token == "" && token.AccessToken == "") {
+		return
+	}
+	bearer := token.Token
+	if bearer == "" {
+		bearer = token.AccessToken
+	}
+	lifetime := defaultTokenLifetime
+	if token.ExpiresIn > 0 {
+		lifetime = time.Duration(token.ExpiresIn) * time.Second
+	}
+	issuedAt := time.Now()
+	if !token.IssuedAt.IsZero() && token.IssuedAt.Before(issuedAt) {
+		issuedAt = token.IssuedAt
+	}
+	expiresAt := issuedAt.Add(lifetime - tokenExpiryLeeway)
+	if !expiresAt.After(time.Now()) {
+		return
+	}
+
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	tc.evictExpired()
+	tc.tokens[key] = &cachedToken{header: header.Clone(), body: body, token: bearer, expiresAt: expiresAt}
+}
+
+// evictExpired removes all expired tokens from the cache, so that tokens
+// which are never requested again do not pile up. Must be called with the
+// lock held.
+func (tc *tokenCache) evictExpired() {
+	now := time.Now()
+	for key, token := range tc.tokens {
+		if now.After(token.expiresAt) {
+			delete(tc.tokens, key)
+		}
+	}
+}
+
+// invalidate removes the given bearer token from the cache
+func (tc *tokenCache) invalidate(bearer string) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	for key, token := range tc.tokens {
+		if token.token == bearer {
+			log.Debugf("registry did not accept cached token, invalidating")
+			delete(tc.tokens, key)
+		}
+	}
+}
+
+// realmKey returns the realm URL without query
+func realmKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host + u.Path
+}
+
+// AuthChallenge is the authentication challenge sent by a registry in the
+// WWW-Authenticate header of a 401 response. For bearer token authentication,
+// Realm is the URL of the auth server, and Service and Scope are the
+// parameters the client requests a token with.
+type AuthChallenge struct {
+	Scheme  string
+	Realm   string
+	Service string
+	Scope   string
+	Error   string
+}
+
+// String returns a representation of the challenge suitable for logging
+func (ac *AuthChallenge) String() string {
+	s := fmt.Sprintf("%s realm=%q service=%q scope=%q", ac.Scheme, ac.Realm, ac.Service, ac.Scope)
+	if ac.Error != "" {
+		s += fmt.Sprintf(" error=%q", ac.Error)
+	}
+	return s
+}
+
+// challengeParamRegexp matches a parameter of an auth challenge, whose value
+// is either quoted or a token
+var challengeParamRegexp = regexp.MustCompile(`([A-Za-z_]+)=(?:"([^"]*)"|([^\s,]*))`)
+
+// parseAuthChallenge parses the given WWW-Authenticate challenges, and
+// returns the first bearer challenge, or the first challenge if there is no
+// bearer challenge. Returns nil if there is no challenge.
+func parseAuthChallenge(challenges []string) *AuthChallenge {
+	var first *AuthChallenge
+	for _, challenge := range challenges {
+		challenge = strings.TrimSpace(challenge)
+		if challenge == "" {
+			continue
+		}
+		ac := &AuthChallenge{}
+		params := challenge
+		if i := strings.IndexAny(challenge, " \t"); i >= 0 {
+			ac.Scheme, params = challenge[:i], challenge[i+1:]
+		} else {
+			ac.Scheme, params = challenge, ""
+		}
+		for _, m := range challengeParamRegexp.FindAllStringSubmatch(params, -1) {
+			value := m[2]
+			if value == "" {
+				value = m[3]
+			}
+			switch strings.ToLower(m[1]) {
+			case "realm":
+				ac.Realm = value
+			case "service":
+				ac.Service = value
+			case "scope":
+				ac.Scope = value
+			case "error":
+				ac.Error = value
+			}
+		}
+		if strings.EqualFold(ac.Scheme, "bearer") {
+			return ac
+		}
+		if first == nil {
+			first = ac
+		}
+	}
+	return first
+}
+
+// authChallengeTransport records the auth challenges sent by the registry of
+// an endpoint, and logs them along with the token requests sent in response
+// at trace level. Credentials and tokens are never logged.
+type authChallengeTransport struct {
+	endpoint  *RegistryEndpoint
+	transport http.RoundTripper
+}
+
+// RoundTrip performs the request, and records the auth challenge of the
+// response, if any
+func (act *authChallengeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := act.transport.RoundTrip(r)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		if challenge := parseAuthChallenge(resp.Header.Values("WWW-Authenticate")); challenge != nil {
+			log.Tracef("registry %s sent auth challenge for %s %s: %s", act.endpoint.RegistryAPI, r.Method, r.URL.Path, challenge)
+			act.endpoint.challengeLock.Lock()
+			act.endpoint.lastChallenge = challenge
+			act.endpoint.challengeLock.Unlock()
+		}
+	}
+	if challenge := act.endpoint.LastAuthChallenge(); challenge != nil && challenge.Realm != "" {
+		if realm, err := url.Parse(challenge.Realm); err == nil && realmKey(realm) == realmKey(r.URL) {
+			query := r.URL.Query()
+			log.Tracef("token request to %s for service=%q scope=%q with authorization %s: %s",
+				realmKey(r.URL), query.Get("service"), strings.Join(query["scope"], " "), redactAuthorization(r.Header.Get("Authorization")), resp.Status)
+		}
+	}
+	return resp, nil
+}
+
+// redactAuthorization returns the scheme of the given Authorization header,
+// with the credentials redacted
+func redactAuthorization(authorization string) string {
+	fields := strings.Fields(authorization)
+	if len(fields) == 0 {
+		return "none"
+	}
+	return fields[0] + " [REDACTED]"
+}
+
+// LastAuthChallenge returns the last auth challenge the endpoint's registry
+// has sent, or nil if it has not sent any. Useful for diagnosing problems
+// with token authentication, i.e. when the registry asks for an unexpected
+// scope.
+func (ep *RegistryEndpoint) LastAuthChallenge() *AuthChallenge {
+	ep.challengeLock.Lock()
+	defer ep.challengeLock.Unlock()
+	if ep.lastChallenge == nil {
+		return nil
+	}
+	challenge := *ep.lastChallenge
+	return &challenge
+}
@@ -0,0 +1,247 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/argoproj-labs/argocd-image-updater/pkg/log"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTokenAuthServer returns a test registry requiring bearer tokens, which
+// it issues with the given lifetime in seconds
+func newTokenAuthServer(expiresIn int) (*httptest.Server, *int32) {
+	var tokenRequests int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			user, _, _ := r.BasicAuth()
+			atomic.AddInt32(&tokenRequests, 1)
+			fmt.Fprintf(w, `{"token":"token-for-%s","expires_in":%d}`, user, expiresIn)
+			return
+		}
+		if r.Header.Get("Authorization") == "" || strings.HasSuffix(r.URL.Path, "/denied") {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:foo/bar:pull"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"name":"foo/bar","tags":["1.0"]}`)
+	}))
+	return srv, &tokenRequests
+}
+
+// getWithToken performs a GET request the way token authenticating clients
+// do: on an auth challenge, a token is fetched from the realm using basic auth
+// and the request is retried with the token.
+func getWithToken(t *testing.T, transport http.RoundTripper, url, username, password string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	m := realmRegexp.FindStringSubmatch(resp.Header.Get("WWW-Authenticate"))
+	require.NotNil(t, m)
+	tokenReq, err := http.NewRequest(http.MethodGet, m[1]+"?service=registry&scope=repository:foo/bar:pull", nil)
+	require.NoError(t, err)
+	tokenReq.SetBasicAuth(username, password)
+	resp, err = transport.RoundTrip(tokenReq)
+	require.NoError(t, err)
+	var token struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&token))
+	resp.Body.Close()
+	assert.Equal(t, "token-for-"+username, token.Token)
+
+	req, err = http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	resp, err = transport.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func newTestTokenCache() *tokenCache {
+	return &tokenCache{realms: map[string]bool{}, tokens: map[string]*cachedToken{}}
+}
+
+func Test_TokenCache(t *testing.T) {
+	t.Run("Endpoints with same credentials share one token", func(t *testing.T) {
+		srv, tokenRequests := newTokenAuthServer(300)
+		defer srv.Close()
+		cache := newTestTokenCache()
+		ep1 := &tokenCacheTransport{cache: cache, transport: http.DefaultTransport}
+		ep2 := &tokenCacheTransport{cache: cache, transport: http.DefaultTransport}
+		getWithToken(t, ep1, srv.URL+"/v2/foo/bar/tags/list", "user", "pass")
+		getWithToken(t, ep2, srv.URL+"/v2/foo/bar/tags/list", "user", "pass")
+		assert.Equal(t, int32(1), atomic.LoadInt32(tokenRequests))
+	})
+
+	t.Run("Endpoints with different credentials do not share tokens", func(t *testing.T) {
+		srv, tokenRequests := newTokenAuthServer(300)
+		defer srv.Close()
+		cache := newTestTokenCache()
+		ep1 := &tokenCacheTransport{cache: cache, transport: http.DefaultTransport}
+		ep2 := &tokenCacheTransport{cache: cache, transport: http.DefaultTransport}
+		getWithToken(t, ep1, srv.URL+"/v2/foo/bar/tags/list", "user", "pass")
+		getWithToken(t, ep2, srv.URL+"/v2/foo/bar/tags/list", "other", "pass")
+		assert.Equal(t, int32(2), atomic.LoadInt32(tokenRequests))
+	})
+
+	t.Run("Expired tokens are not reused", func(t *testing.T) {
+		srv, tokenRequests := newTokenAuthServer(5)
+		defer srv.Close()
+		transport := &tokenCacheTransport{cache: newTestTokenCache(), transport: http.DefaultTransport}
+		getWithToken(t, transport, srv.URL+"/v2/foo/bar/tags/list", "user", "pass")
+		getWithToken(t, transport, srv.URL+"/v2/foo/bar/tags/list", "user", "pass")
+		assert.Equal(t, int32(2), atomic.LoadInt32(tokenRequests))
+	})
+
+	t.Run("Tokens rejected by the registry are invalidated", func(t *testing.T) {
+		srv, tokenRequests := newTokenAuthServer(300)
+		defer srv.Close()
+		transport := &tokenCacheTransport{cache: newTestTokenCache(), transport: http.DefaultTransport}
+		getWithToken(t, transport, srv.URL+"/v2/foo/bar/tags/list", "user", "pass")
+
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/v2/foo/bar/denied", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer token-for-user")
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		getWithToken(t, transport, srv.URL+"/v2/foo/bar/tags/list", "user", "pass")
+		assert.Equal(t, int32(2), atomic.LoadInt32(tokenRequests))
+	})
+
+	t.Run("Expired tokens are evicted", func(t *testing.T) {
+		cache := newTestTokenCache()
+		cache.tokens["expired"] = &cachedToken{token: "old", expiresAt: time.Now().Add(-time.Minute)}
+		cache.put("current", http.Header{}, []byte(`{"token":"new","expires_in":300}`))
+		assert.Len(t, cache.tokens, 1)
+		assert.NotNil(t, cache.get("current"))
+	})
+
+	t.Run("Requests to unknown realms are not cached", func(t *testing.T) {
+		srv, tokenRequests := newTokenAuthServer(300)
+		defer srv.Close()
+		transport := &tokenCacheTransport{cache: newTestTokenCache(), transport: http.DefaultTransport}
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/token", nil)
+			require.NoError(t, err)
+			resp, err := transport.RoundTrip(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+		assert.Equal(t, int32(2), atomic.LoadInt32(tokenRequests))
+	})
+}
+
+func Test_ParseAuthChallenge(t *testing.T) {
+	t.Run("Bearer challenge", func(t *testing.T) {
+		ac := parseAuthChallenge([]string{`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:foo/bar:pull,push"`})
+		require.NotNil(t, ac)
+		assert.Equal(t, "Bearer", ac.Scheme)
+		assert.Equal(t, "https://auth.example.com/token", ac.Realm)
+		assert.Equal(t, "registry.example.com", ac.Service)
+		assert.Equal(t, "repository:foo/bar:pull,push", ac.Scope)
+		assert.Empty(t, ac.Error)
+	})
+
+	t.Run("Bearer challenge with error and unquoted values", func(t *testing.T) {
+		ac := parseAuthChallenge([]string{`Bearer realm="https://auth.example.com/token", service=registry, error="insufficient_scope"`})
+		require.NotNil(t, ac)
+		assert.Equal(t, "registry", ac.Service)
+		assert.Equal(t, "insufficient_scope", ac.Error)
+		assert.Contains(t, ac.String(), `error="insufficient_scope"`)
+	})
+
+	t.Run("Bearer challenge is preferred", func(t *testing.T) {
+		ac := parseAuthChallenge([]string{`Basic realm="Registry"`, `Bearer realm="https://auth.example.com/token"`})
+		require.NotNil(t, ac)
+		assert.Equal(t, "Bearer", ac.Scheme)
+	})
+
+	t.Run("Basic challenge", func(t *testing.T) {
+		ac := parseAuthChallenge([]string{`Basic realm="Registry"`})
+		require.NotNil(t, ac)
+		assert.Equal(t, "Basic", ac.Scheme)
+		assert.Equal(t, "Registry", ac.Realm)
+	})
+
+	t.Run("No challenge", func(t *testing.T) {
+		assert.Nil(t, parseAuthChallenge(nil))
+		assert.Nil(t, parseAuthChallenge([]string{" "}))
+	})
+}
+
+// messageHook collects the messages that are logged
+type messageHook struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (mh *messageHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (mh *messageHook) Fire(entry *logrus.Entry) error {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+	mh.messages = append(mh.messages, entry.Message)
+	return nil
+}
+
+func (mh *messageHook) String() string {
+	mh.lock.Lock()
+	defer mh.lock.Unlock()
+	return strings.Join(mh.messages, "\n")
+}
+
+func Test_LastAuthChallenge(t *testing.T) {
+	srv, _ := newTokenAuthServer(300)
+	defer srv.Close()
+	ep := &RegistryEndpoint{RegistryAPI: srv.URL}
+	assert.Nil(t, ep.LastAuthChallenge())
+
+	hook := &messageHook{}
+	defer log.Log().ReplaceHooks(log.Log().ReplaceHooks(logrus.LevelHooks{}))
+	log.Log().AddHook(hook)
+	defer log.Log().SetLevel(log.Log().GetLevel())
+	require.NoError(t, log.SetLogLevel("trace"))
+
+	transport := &authChallengeTransport{endpoint: ep, transport: http.DefaultTransport}
+	getWithToken(t, transport, srv.URL+"/v2/foo/bar/tags/list", "user", "s3cr3t")
+
+	ac := ep.LastAuthChallenge()
+	require.NotNil(t, ac)
+	assert.Equal(t, "Bearer", ac.Scheme)
+	assert.Equal(t, srv.URL+"/token", ac.Realm)
+	assert.Equal(t, "registry", ac.Service)
+	assert.Equal(t, "repository:foo/bar:pull", ac.Scope)
+
+	// Returned challenges are copies
+	ac.Scope = "changed"
+	assert.Equal(t, "repository:foo/bar:pull", ep.LastAuthChallenge().Scope)
+
+	logged := hook.String()
+	assert.Contains(t, logged, `scope="repository:foo/bar:pull"`)
+	assert.Contains(t, logged, "Basic [REDACTED]")
+	assert.NotContains(t, logged, "token-for-user")
+	assert.NotContains(t, logged, base64.StdEncoding.EncodeToString([]byte("user:s3cr3t")))
+}
@@ -13,8 +13,12 @@ import (
 // ImageTag is a representation of an image tag with metadata
 // Use NewImageTag to to initialize a new object.
 type ImageTag struct {
-	TagName string
-	TagDate *time.Time
+	TagName     string
+	TagDate     *time.Time
+	TagDigest   string
+	TagPlatform string
+	// TagInfo holds the meta data of the tag, if it has been fetched
+	TagInfo *TagInfo
 }
 
 // ImageTagList is a collection of ImageTag objects.
@@ -27,6 +31,24 @@ type ImageTagList struct {
 // TagInfo contains information for a tag
 type TagInfo struct {
 	CreatedAt time.Time
+	OS        string
+	Arch      string
+	// Digest is the digest of the manifest the tag points to, if known
+	Digest string
+	// Schema is the schema of the manifest the meta data has been read from,
+	// i.e. schema2, oci, index or schema1, if known
+	Schema string
+	// Labels are the labels set in the image configuration
+	Labels map[string]string
+}
+
+// Platform returns the platform of the tag in the form os/arch, or the empty
+// string if the platform is not known.
+func (ti *TagInfo) Platform() string {
+	if ti.OS == "" && ti.Arch == "" {
+		return ""
+	}
+	return ti.OS + "/" + ti.Arch
 }
 
 // SortableImageTagList is just that - a sortable list of ImageTag entries
@@ -50,6 +72,27 @@ func NewImageTag(tagName string, tagDate time.Time) *ImageTag {
 	return tag
 }
 
+// DeepCopy returns a copy of the tag, including copies of its date and meta
+// data
+func (tag *ImageTag) DeepCopy() *ImageTag {
+	t := *tag
+	if tag.TagDate != nil {
+		date := *tag.TagDate
+		t.TagDate = &date
+	}
+	if tag.TagInfo != nil {
+		ti := *tag.TagInfo
+		if tag.TagInfo.Labels != nil {
+			ti.Labels = make(map[string]string, len(tag.TagInfo.Labels))
+			for k, v := range tag.TagInfo.Labels {
+				ti.Labels[k] = v
+			}
+		}
+		t.TagInfo = &ti
+	}
+	return &t
+}
+
 // NewImageTagList initializes an ImageTagList object and returns it
 func NewImageTagList() *ImageTagList {
 	itl := ImageTagList{}
@@ -83,6 +126,15 @@ func (tag *ImageTag) String() string {
 	return tag.TagName
 }
 
+// TagWithDigest returns the name of the tag, followed by the digest it points
+// to if the digest is known, i.e. 1.0@sha256:...
+func (tag *ImageTag) TagWithDigest() string {
+	if tag.TagDigest == "" {
+		return tag.TagName
+	}
+	return tag.TagName + "@" + tag.TagDigest
+}
+
 // Checks whether given tag is contained in tag list in O(n) time
 func (il ImageTagList) Contains(tag *ImageTag) bool {
 	il.lock.RLock()
@@ -90,6 +142,25 @@ func (il ImageTagList) Contains(tag *ImageTag) bool {
 	return il.unlockedContains(tag)
 }
 
+// Get returns the ImageTag with given name from the list, or nil if the list
+// does not contain such tag.
+func (il ImageTagList) Get(tagName string) *ImageTag {
+	il.lock.RLock()
+	defer il.lock.RUnlock()
+	return il.items[tagName]
+}
+
+// DeepCopy returns a copy of the list, including copies of all its tags
+func (il *ImageTagList) DeepCopy() *ImageTagList {
+	il.lock.RLock()
+	defer il.lock.RUnlock()
+	nl := NewImageTagList()
+	for k, v := range il.items {
+		nl.items[k] = v.DeepCopy()
+	}
+	return nl
+}
+
 // Add adds an ImageTag to an ImageTagList, ensuring this will not result in
 // an double entry
 func (il ImageTagList) Add(tag *ImageTag) {
@@ -117,6 +188,9 @@ func (il ImageTagList) SortByDate() SortableImageTagList {
 		sil = append(sil, v)
 	}
 	sort.Slice(sil, func(i, j int) bool {
+		if sil[i].TagDate.Equal(*sil[j].TagDate) {
+			return sil[i].TagName < sil[j].TagName
+		}
 		return sil[i].TagDate.Before(*sil[j].TagDate)
 	})
 	return sil
@@ -139,7 +213,12 @@ func (il ImageTagList) SortBySemVer() SortableImageTagList {
 	}
 	sort.Sort(semver.Collection(svl))
 	for _, svi := range svl {
-		sil = append(sil, NewImageTag(svi.Original(), *il.items[svi.Original()].TagDate))
+		t := il.items[svi.Original()]
+		st := NewImageTag(svi.Original(), *t.TagDate)
+		st.TagDigest = t.TagDigest
+		st.TagPlatform = t.TagPlatform
+		st.TagInfo = t.TagInfo
+		sil = append(sil, st)
 	}
 	return sil
 }
@@ -125,3 +125,38 @@ func Test_TagsFromTagList(t *testing.T) {
 		assert.Len(t, tl, len(names))
 	})
 }
+
+func Test_TagInfoPlatform(t *testing.T) {
+	t.Run("Platform is known", func(t *testing.T) {
+		ti := &TagInfo{OS: "linux", Arch: "arm64"}
+		assert.Equal(t, "linux/arm64", ti.Platform())
+	})
+	t.Run("Platform is unknown", func(t *testing.T) {
+		ti := &TagInfo{}
+		assert.Equal(t, "", ti.Platform())
+	})
+}
+
+func Test_DeepCopyImageTagList(t *testing.T) {
+	il := NewImageTagList()
+	il.Add(NewImageTag("1.0", time.Unix(1, 0)))
+	cl := il.DeepCopy()
+	assert.Equal(t, il.Tags(), cl.Tags())
+	cl.Get("1.0").TagDigest = "sha256:abc"
+	*cl.Get("1.0").TagDate = time.Unix(2, 0)
+	assert.Equal(t, "", il.Get("1.0").TagDigest)
+	assert.Equal(t, time.Unix(1, 0), *il.Get("1.0").TagDate)
+}
+
+func Test_DeepCopyImageTag(t *testing.T) {
+	tag := NewImageTag("1.0", time.Unix(1, 0))
+	tag.TagInfo = &TagInfo{OS: "linux", Labels: map[string]string{"team": "a"}}
+	c := tag.DeepCopy()
+	assert.Equal(t, tag, c)
+	*c.TagDate = time.Unix(2, 0)
+	c.TagInfo.OS = "windows"
+	c.TagInfo.Labels["team"] = "b"
+	assert.Equal(t, time.Unix(1, 0), *tag.TagDate)
+	assert.Equal(t, "linux", tag.TagInfo.OS)
+	assert.Equal(t, "a", tag.TagInfo.Labels["team"])
+}